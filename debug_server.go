@@ -0,0 +1,127 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+// Number of the most recent GC pauses reported in /debug/vars
+const debugGCPauses = 16
+
+func init() {
+	expvar.Publish("input_raw", expvar.Func(rawInputsStats))
+	expvar.Publish("output_http", expvar.Func(httpOutputsStats))
+	expvar.Publish("output_spill", expvar.Func(spillQueuesStats))
+	expvar.Publish("output_shadow", expvar.Func(shadowOutputsStats))
+	expvar.Publish("gc", expvar.Func(gcStats))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
+
+// startDebugServer serves pprof profiles on /debug/pprof/ and expvar counters on /debug/vars, see --debug-http
+func startDebugServer(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Own mux, so handlers are not exposed by other http servers using default one
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Println("Debug server stopped:", err)
+		}
+	}()
+
+	return listener, nil
+}
+
+// rawInputsStats returns listener statistics of each --input-raw, by its address
+func rawInputsStats() interface{} {
+	stats := make(map[string]raw.ListenerStats)
+
+	for _, p := range Plugins.All {
+		if i, ok := p.(*RAWInput); ok {
+			stats[i.address] = i.Stats()
+		}
+	}
+
+	return stats
+}
+
+// httpOutputsStats returns counters of requests and retries of each --output-http, by its address
+func httpOutputsStats() interface{} {
+	stats := make(map[string]HTTPOutputStats)
+
+	for _, p := range Plugins.All {
+		if o, ok := p.(*HTTPOutput); ok {
+			stats[o.address] = o.Stats()
+		}
+	}
+
+	return stats
+}
+
+// shadowOutputsStats returns counters of compared responses of each --output-shadow, by its addresses
+func shadowOutputsStats() interface{} {
+	stats := make(map[string]ShadowOutputStats)
+
+	for _, p := range Plugins.All {
+		if o, ok := p.(*ShadowOutput); ok {
+			stats[o.address] = o.Stats()
+		}
+	}
+
+	return stats
+}
+
+// spillQueuesStats returns counters of spill queue of each output, see --output-spill-dir
+func spillQueuesStats() interface{} {
+	stats := make(map[string]SpillQueueStats)
+
+	for _, p := range Plugins.All {
+		switch s := p.(type) {
+		case *SpillQueue:
+			stats[fmt.Sprint(s.plugin)] = s.Stats()
+		case spillReadQueue:
+			stats[fmt.Sprint(s.plugin)] = s.Stats()
+		}
+	}
+
+	return stats
+}
+
+func gcStats() interface{} {
+	s := debug.GCStats{Pause: make([]time.Duration, debugGCPauses)}
+	debug.ReadGCStats(&s)
+
+	var last time.Duration
+	if len(s.Pause) > 0 {
+		last = s.Pause[0]
+	}
+
+	return map[string]interface{}{
+		"NumGC":        s.NumGC,
+		"PauseTotalNs": s.PauseTotal.Nanoseconds(),
+		"LastPauseNs":  last.Nanoseconds(),
+		// Most recent first
+		"RecentPausesNs": s.Pause,
+	}
+}
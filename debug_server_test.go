@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestDebugServer(t *testing.T) {
+	listener, err := startDebugServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	url := "http://" + listener.Addr().String()
+
+	resp, err := http.Get(url + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := make(map[string]json.RawMessage)
+	err = json.NewDecoder(resp.Body).Decode(&vars)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"input_raw", "gc", "goroutines", "memstats"} {
+		if _, ok := vars[name]; !ok {
+			t.Error("Should expose", name)
+		}
+	}
+
+	resp, err = http.Get(url + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Error("Should serve profiles", resp.StatusCode)
+	}
+}
@@ -35,6 +35,8 @@ type ESRequestResponse struct {
 	ReqIfModifiedSince   []byte `json:"Req_If-Modified-Since,omitempty"`
 	ReqConnection        []byte `json:"Req_Connection,omitempty"`
 	ReqCookies           []byte `json:"Req_Cookies,omitempty"`
+	ReqGraphQLOperation  string `json:"Req_GraphQL-Operation,omitempty"`
+	ReqGraphQLType       string `json:"Req_GraphQL-Type,omitempty"`
 	RespStatus           []byte `json:"Resp_Status"`
 	RespStatusCode       []byte `json:"Resp_Status-Code"`
 	RespProto            []byte `json:"Resp_Proto,omitempty"`
@@ -143,6 +145,11 @@ func (p *ESPlugin) ResponseAnalyze(req, resp []byte, start, stop time.Time) {
 		Rtt:                  rtt,
 		Timestamp:            t,
 	}
+	if op, ok := parseGraphQLRequest(req); ok {
+		esResp.ReqGraphQLOperation = op.Name
+		esResp.ReqGraphQLType = op.Type
+	}
+
 	j, err := json.Marshal(&esResp)
 	if err != nil {
 		log.Println(err)
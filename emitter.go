@@ -45,7 +45,10 @@ func Start(stop chan int) {
 	}
 }
 
-// CopyMulty copies from 1 reader to multiple writers
+// CopyMulty copies from 1 reader to multiple writers.
+//
+// Payload passed to Write is valid only until Write returns, since its buffer is reused to read the next one.
+// Outputs which keep payload after Write, like sending it from own goroutine, should copy it, see enqueuePayload.
 func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
 	buf := make([]byte, 5*1024*1024)
 	wIndex := 0
@@ -112,3 +115,20 @@ func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
 	}
 	return err
 }
+
+// copyPayload returns copy of payload passed to output Write, which output can keep after Write returns
+func copyPayload(data []byte) []byte {
+	payload := make([]byte, len(data))
+	copy(payload, data)
+
+	return payload
+}
+
+// enqueuePayload sends copy of payload passed to output Write to the queue, unless done is closed first.
+// If done is nil, waits until there is space in the queue.
+func enqueuePayload(queue chan<- []byte, done <-chan bool, data []byte) {
+	select {
+	case queue <- copyPayload(data):
+	case <-done:
+	}
+}
@@ -97,3 +97,25 @@ func BenchmarkEmitter(b *testing.B) {
 	wg.Wait()
 	close(quit)
 }
+
+func TestEnqueuePayload(t *testing.T) {
+	queue := make(chan []byte, 1)
+	data := []byte("1 a 1\nGET / HTTP/1.1\r\n\r\n")
+
+	enqueuePayload(queue, nil, data)
+	// Emitter reuses buffer
+	data[0] = '2'
+
+	if payload := <-queue; payload[0] != '1' {
+		t.Error("Should queue copy of payload", string(payload))
+	}
+
+	done := make(chan bool)
+	close(done)
+
+	queue <- nil
+	enqueuePayload(queue, done, data)
+	if len(queue) != 1 {
+		t.Error("Should not wait for full queue after done is closed")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Recordings are compressed based on file extension: ".gz" for gzip, and ".zst" for zstd
+
+// compressedWriter is writer of compressed recording
+type compressedWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newCompressedWriter returns writer compressing data written to w, or nil if recording with given name is not
+// compressed. Closing compressed writer does not close w.
+func newCompressedWriter(name string, w io.Writer) compressedWriter {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return gzip.NewWriter(w)
+	case strings.HasSuffix(name, ".zst"):
+		// Errors are possible only for wrong options
+		encoder, _ := zstd.NewWriter(w)
+		return encoder
+	}
+
+	return nil
+}
+
+// newDecompressedReader returns reader decompressing data of r, or r itself if recording with given name is not
+// compressed. Closing returned reader does not close r.
+func newDecompressedReader(name string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(name, ".zst"):
+		// Single goroutine is enough to decompress one recording, and keeps memory usage low
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return ioutil.NopCloser(r), nil
+}
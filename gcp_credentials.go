@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Token endpoint of GCE metadata server, serving tokens of instance service account
+var gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpCredentials issues access tokens for Google Cloud APIs.
+//
+// Tokens are issued for service account key file set in GOOGLE_APPLICATION_CREDENTIALS environment variable,
+// or for service account of GCE instance. Without them requests are anonymous.
+type gcpCredentials struct {
+	client *http.Client
+	scope  string
+
+	mu sync.Mutex
+	// Service account key, nil if not configured
+	key *gcpServiceAccountKey
+	// Access token and time it should be refreshed
+	token        string
+	tokenRefresh time.Time
+	// Metadata server is not available, so requests are anonymous
+	anonymous bool
+}
+
+// gcpServiceAccountKey holds fields of service account key file used for authorization
+type gcpServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	rsaKey *rsa.PrivateKey
+}
+
+// newGCPCredentials returns credentials with access to given scope. Anonymous credentials, like for emulators,
+// are used unless service account key is set.
+func newGCPCredentials(scope string, anonymous bool) (*gcpCredentials, error) {
+	c := &gcpCredentials{client: &http.Client{}, scope: scope, anonymous: anonymous}
+
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		key, err := readGCPServiceAccountKey(path)
+		if err != nil {
+			return nil, err
+		}
+		c.key = key
+		c.anonymous = false
+	}
+
+	return c, nil
+}
+
+func readGCPServiceAccountKey(path string) (*gcpServiceAccountKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := new(gcpServiceAccountKey)
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("Can't decode service account key %s: %s", path, err)
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("Service account key %s has no private key", path)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Can't parse private key of %s: %s", path, err)
+		}
+	}
+
+	var ok bool
+	if key.rsaKey, ok = parsed.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("Private key of %s is not RSA key", path)
+	}
+
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return key, nil
+}
+
+type gcpTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// accessToken returns cached access token, requesting new one if it expires soon.
+// Returns empty token for anonymous requests.
+func (c *gcpCredentials) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.anonymous || time.Now().Before(c.tokenRefresh) {
+		return c.token, nil
+	}
+
+	var resp *http.Response
+	var err error
+
+	if c.key != nil {
+		assertion, err := c.key.assertion(c.scope, time.Now())
+		if err != nil {
+			return "", err
+		}
+
+		resp, err = c.client.PostForm(c.key.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+		if err != nil {
+			return "", err
+		}
+	} else {
+		req, _ := http.NewRequest("GET", gcpMetadataTokenURL, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		if resp, err = client.Do(req); err != nil {
+			Debug("GCE metadata server is not available, making anonymous requests:", err)
+			c.anonymous = true
+			return "", nil
+		}
+	}
+
+	if err := checkRemoteResponse(resp); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token gcpTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Can't decode access token: %s", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("Empty access token")
+	}
+
+	c.token = token.AccessToken
+	// Refresh token a minute before it expires
+	c.tokenRefresh = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return c.token, nil
+}
+
+// assertion returns JWT signed with service account key, which is exchanged to access token of given scope
+func (k *gcpServiceAccountKey) assertion(scope string, now time.Time) (string, error) {
+	header := `{"alg":"RS256","typ":"JWT"}`
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   k.ClientEmail,
+		"scope": scope,
+		"aud":   k.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	var b bytes.Buffer
+	b.WriteString(base64.RawURLEncoding.EncodeToString([]byte(header)))
+	b.WriteByte('.')
+	b.WriteString(base64.RawURLEncoding.EncodeToString(claims))
+
+	hash := sha256.Sum256(b.Bytes())
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	b.WriteByte('.')
+	b.WriteString(base64.RawURLEncoding.EncodeToString(signature))
+
+	return b.String(), nil
+}
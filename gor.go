@@ -74,6 +74,12 @@ func main() {
 		profileCPU(*cpuprofile)
 	}
 
+	if Settings.debugHTTP != "" {
+		if _, err := startDebugServer(Settings.debugHTTP); err != nil {
+			log.Fatal("Can't start debug server: ", err)
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
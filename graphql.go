@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/buger/gor/proto"
+)
+
+// GraphQL operation types
+const (
+	GraphQLQuery        = "query"
+	GraphQLMutation     = "mutation"
+	GraphQLSubscription = "subscription"
+)
+
+// graphQLOperation describes operation of GraphQL request
+type graphQLOperation struct {
+	// Operation name, empty for anonymous operations
+	Name string
+	// One of GraphQLQuery, GraphQLMutation, GraphQLSubscription
+	Type string
+}
+
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// parseGraphQLRequest returns operation of GraphQL POST request, with JSON body like
+// {"query": "...", "operationName": "..."}, or query as body and application/graphql content type.
+// Batched requests get names of all operations joined with comma, and type of the most dangerous one,
+// so mutation in batch makes the whole batch a mutation.
+//
+// Compressed and chunked bodies are not decoded, so they are not recognized as GraphQL.
+func parseGraphQLRequest(payload []byte) (op graphQLOperation, ok bool) {
+	if !bytes.HasPrefix(payload, []byte("POST ")) || proto.MIMEHeadersEndPos(payload) == -1 {
+		return
+	}
+
+	if len(proto.Header(payload, []byte("Content-Encoding"))) > 0 || len(proto.Header(payload, []byte("Transfer-Encoding"))) > 0 {
+		return
+	}
+
+	body := bytes.TrimSpace(proto.Body(payload))
+	if len(body) == 0 {
+		return
+	}
+
+	if bytes.HasPrefix(proto.Header(payload, []byte("Content-Type")), []byte("application/graphql")) {
+		return parseGraphQLDocument(string(body), "")
+	}
+
+	// Cheap check, to not decode JSON of every request
+	if !bytes.Contains(body, []byte(`"query"`)) {
+		return
+	}
+
+	var requests []graphQLRequest
+
+	switch body[0] {
+	case '{':
+		var request graphQLRequest
+		if json.Unmarshal(body, &request) != nil {
+			return
+		}
+		requests = append(requests, request)
+	case '[':
+		if json.Unmarshal(body, &requests) != nil || len(requests) == 0 {
+			return
+		}
+	default:
+		return
+	}
+
+	var names []string
+	for _, request := range requests {
+		o, ok := parseGraphQLDocument(request.Query, request.OperationName)
+		if !ok {
+			return graphQLOperation{}, false
+		}
+
+		names = append(names, o.Name)
+		if graphQLTypeRank(o.Type) > graphQLTypeRank(op.Type) {
+			op.Type = o.Type
+		}
+	}
+	op.Name = strings.Join(names, ",")
+
+	return op, true
+}
+
+func graphQLTypeRank(t string) int {
+	switch t {
+	case GraphQLQuery:
+		return 1
+	case GraphQLSubscription:
+		return 2
+	case GraphQLMutation:
+		return 3
+	}
+
+	return 0
+}
+
+// parseGraphQLDocument finds operation of query document to be executed: operation with given name,
+// or the only operation of the document. It only tokenizes the document, skipping everything not
+// on the top level, so invalid documents may be accepted.
+func parseGraphQLDocument(query string, operationName string) (op graphQLOperation, ok bool) {
+	var operations []graphQLOperation
+
+	depth := 0
+	// Inside definition header, before its selection set
+	inDefinition := false
+	// Operation keyword seen, and name may follow
+	expectName := false
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+		case c == '"':
+			i = skipGraphQLString(query, i)
+			expectName = false
+		case c == '{' || c == '(' || c == '[':
+			if depth == 0 && c == '{' {
+				if !inDefinition {
+					// Shorthand query
+					operations = append(operations, graphQLOperation{Type: GraphQLQuery})
+				}
+				inDefinition = false
+			}
+			depth++
+			expectName = false
+			i++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+			if depth < 0 {
+				return
+			}
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(query) && (query[i] == '_' || query[i] >= 'a' && query[i] <= 'z' || query[i] >= 'A' && query[i] <= 'Z' || query[i] >= '0' && query[i] <= '9') {
+				i++
+			}
+			name := query[start:i]
+
+			if depth > 0 {
+				continue
+			}
+
+			switch {
+			case expectName:
+				operations[len(operations)-1].Name = name
+				expectName = false
+			case inDefinition:
+			case name == GraphQLQuery || name == GraphQLMutation || name == GraphQLSubscription:
+				operations = append(operations, graphQLOperation{Type: name})
+				inDefinition = true
+				expectName = true
+			case name == "fragment":
+				inDefinition = true
+			default:
+				// Type system definitions and extensions can't be executed
+				return
+			}
+		default:
+			i++
+			expectName = false
+		}
+	}
+
+	if depth != 0 || inDefinition {
+		return
+	}
+
+	if operationName == "" {
+		if len(operations) != 1 {
+			return
+		}
+		return operations[0], true
+	}
+
+	for _, o := range operations {
+		if o.Name == operationName {
+			return o, true
+		}
+	}
+
+	return
+}
+
+// skipGraphQLString returns position after string or block string starting at i
+func skipGraphQLString(query string, i int) int {
+	if strings.HasPrefix(query[i:], `"""`) {
+		i += 3
+		for i < len(query) {
+			if strings.HasPrefix(query[i:], `\"""`) {
+				i += 4
+			} else if strings.HasPrefix(query[i:], `"""`) {
+				return i + 3
+			} else {
+				i++
+			}
+		}
+		return i
+	}
+
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+
+	return i
+}
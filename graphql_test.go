@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func graphQLPayload(contentType string, body string) []byte {
+	return []byte("POST /graphql HTTP/1.1\r\nHost: api.com\r\nContent-Type: " + contentType + "\r\n\r\n" + body)
+}
+
+func TestParseGraphQLRequest(t *testing.T) {
+	cases := []struct {
+		payload []byte
+		op      graphQLOperation
+		ok      bool
+	}{
+		{graphQLPayload("application/json", `{"query": "{ me { id } }"}`), graphQLOperation{Type: GraphQLQuery}, true},
+		{graphQLPayload("application/json", `{"query": "query Me($id: ID = \"{\") { user(id: $id) { name } }", "variables": {"id": 1}}`), graphQLOperation{Name: "Me", Type: GraphQLQuery}, true},
+		{graphQLPayload("application/json", `{"query": "mutation { like(id: 1) }"}`), graphQLOperation{Type: GraphQLMutation}, true},
+		{graphQLPayload("application/json", `{"query": "# mutation X\nsubscription OnLike @live { liked { id } }"}`), graphQLOperation{Name: "OnLike", Type: GraphQLSubscription}, true},
+		// Document with several operations, and fragment
+		{graphQLPayload("application/json", `{"operationName": "Like", "query": "query Me { ...F } mutation Like { like } fragment F on User { query: id }"}`), graphQLOperation{Name: "Like", Type: GraphQLMutation}, true},
+		{graphQLPayload("application/json", `[{"query": "query A { a }"}, {"query": "mutation B { b }"}]`), graphQLOperation{Name: "A,B", Type: GraphQLMutation}, true},
+		{graphQLPayload("application/graphql", `query Me { me { id } }`), graphQLOperation{Name: "Me", Type: GraphQLQuery}, true},
+		// Operation to execute is ambiguous
+		{graphQLPayload("application/json", `{"query": "query A { a } query B { b }"}`), graphQLOperation{}, false},
+		{graphQLPayload("application/json", `{"query": "query A { a } query B { b }", "operationName": "C"}`), graphQLOperation{}, false},
+		{graphQLPayload("application/json", `{"query": "query A { a "}`), graphQLOperation{}, false},
+		{graphQLPayload("application/json", `{"id": 1}`), graphQLOperation{}, false},
+		{graphQLPayload("application/json", `{"query": 1}`), graphQLOperation{}, false},
+		{[]byte("GET /graphql?query={me} HTTP/1.1\r\nHost: api.com\r\n\r\n"), graphQLOperation{}, false},
+		{[]byte("POST /graphql HTTP/1.1\r\nContent-Encoding: gzip\r\n\r\n{\"query\": \"{ me }\"}"), graphQLOperation{}, false},
+	}
+
+	for i, c := range cases {
+		op, ok := parseGraphQLRequest(c.payload)
+
+		if ok != c.ok || op != c.op {
+			t.Errorf("%d: Expected %v %v, got %v %v", i, c.op, c.ok, op, ok)
+		}
+	}
+}
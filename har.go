@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAR (HTTP Archive) files, exported by browsers and proxies, are read by FileInput as recordings, so captured
+// sessions can be replayed against backends. Files are recognized by ".har" extension, and can be compressed.
+
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Total time of the request in milliseconds
+	Time     float64     `json:"time"`
+	Request  harRequest  `json:"request"`
+	Response harResponse `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Headers  []harHeader `json:"headers"`
+	PostData *struct {
+		Text   string      `json:"text"`
+		Params []harHeader `json:"params"`
+	} `json:"postData"`
+}
+
+type harResponse struct {
+	Status     int         `json:"status"`
+	StatusText string      `json:"statusText"`
+	Headers    []harHeader `json:"headers"`
+	Content    struct {
+		Text     string `json:"text"`
+		Encoding string `json:"encoding"`
+	} `json:"content"`
+}
+
+// isHARFile checks if recording with given name is HAR file
+func isHARFile(name string) bool {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zst")
+
+	return strings.HasSuffix(name, ".har")
+}
+
+// newHARReader converts entries of HAR file to payloads, in the format written by FileOutput.
+// Entries are ordered by time, and responses are included unless request was aborted.
+func newHARReader(r io.Reader) (io.Reader, error) {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, err
+	}
+
+	entries := har.Log.Entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+
+	var buf bytes.Buffer
+
+	for _, e := range entries {
+		request, ok := harRequestPayload(&e.Request)
+		if !ok {
+			continue
+		}
+
+		id := uuid()
+
+		buf.Write(payloadHeader(RequestPayload, id, e.StartedDateTime.UnixNano()))
+		buf.Write(request)
+		buf.WriteString(payloadSeparator)
+
+		if e.Response.Status <= 0 {
+			continue
+		}
+
+		buf.Write(payloadHeader(ResponsePayload, id, int64(e.Time*float64(time.Millisecond))))
+		buf.Write(harResponsePayload(&e.Response))
+		buf.WriteString(payloadSeparator)
+	}
+
+	return &buf, nil
+}
+
+// harMessageHeaders writes headers of HTTP/1.1 message. HTTP/2 pseudo headers are skipped, and headers of body
+// encoding are replaced by length of the body, since HAR files keep decoded bodies.
+func harMessageHeaders(buf *bytes.Buffer, headers []harHeader, body []byte, host string) {
+	hasHost := false
+
+	for _, h := range headers {
+		switch strings.ToLower(h.Name) {
+		case "content-length", "transfer-encoding", "content-encoding", "connection":
+			continue
+		case "host":
+			hasHost = true
+		}
+
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+
+		buf.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+
+	if !hasHost && host != "" {
+		buf.WriteString("Host: " + host + "\r\n")
+	}
+
+	if len(body) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(body)
+}
+
+// harRequestPayload returns HTTP/1.1 request of HAR entry. Requests with invalid URLs are skipped.
+func harRequestPayload(r *harRequest) ([]byte, bool) {
+	u, err := url.Parse(r.URL)
+	if err != nil || r.Method == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, false
+	}
+
+	var body []byte
+	if r.PostData != nil {
+		if r.PostData.Text != "" {
+			body = []byte(r.PostData.Text)
+		} else if len(r.PostData.Params) > 0 {
+			form := url.Values{}
+			for _, p := range r.PostData.Params {
+				form.Add(p.Name, p.Value)
+			}
+			body = []byte(form.Encode())
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(r.Method + " " + u.RequestURI() + " HTTP/1.1\r\n")
+	harMessageHeaders(&buf, r.Headers, body, u.Host)
+
+	return buf.Bytes(), true
+}
+
+// harResponsePayload returns HTTP/1.1 response of HAR entry
+func harResponsePayload(r *harResponse) []byte {
+	body := []byte(r.Content.Text)
+	if r.Content.Encoding == "base64" {
+		if decoded, err := base64.StdEncoding.DecodeString(r.Content.Text); err == nil {
+			body = decoded
+		}
+	}
+
+	statusText := r.StatusText
+	if statusText == "" {
+		statusText = http.StatusText(r.Status)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("HTTP/1.1 " + strconv.Itoa(r.Status) + " " + statusText + "\r\n")
+	harMessageHeaders(&buf, r.Headers, body, "")
+
+	return buf.Bytes()
+}
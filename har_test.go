@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testHAR = `{"log": {"version": "1.2", "entries": [
+	{
+		"startedDateTime": "2024-05-01T10:00:01.000Z",
+		"time": 20.5,
+		"request": {
+			"method": "POST", "url": "https://example.com/login?next=%2F", "httpVersion": "HTTP/2.0",
+			"headers": [
+				{"name": ":method", "value": "POST"},
+				{"name": ":authority", "value": "example.com"},
+				{"name": "content-type", "value": "application/x-www-form-urlencoded"},
+				{"name": "content-length", "value": "100"}
+			],
+			"postData": {"mimeType": "application/x-www-form-urlencoded", "params": [{"name": "user", "value": "a b"}]}
+		},
+		"response": {
+			"status": 200, "statusText": "", "httpVersion": "HTTP/2.0",
+			"headers": [{"name": "content-encoding", "value": "gzip"}, {"name": "content-type", "value": "text/plain"}],
+			"content": {"text": "b2s=", "encoding": "base64"}
+		}
+	},
+	{
+		"startedDateTime": "2024-05-01T10:00:00.000Z",
+		"time": 5,
+		"request": {
+			"method": "GET", "url": "http://example.com/", "httpVersion": "HTTP/1.1",
+			"headers": [{"name": "Host", "value": "example.com"}, {"name": "Accept", "value": "*/*"}]
+		},
+		"response": {"status": 0, "headers": [], "content": {}}
+	},
+	{
+		"startedDateTime": "2024-05-01T10:00:02.000Z",
+		"request": {"method": "GET", "url": "data:text/plain,skipped", "headers": []},
+		"response": {"status": 200, "headers": [], "content": {}}
+	}
+]}}`
+
+func TestHARReader(t *testing.T) {
+	r, err := newHARReader(strings.NewReader(testHAR))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadAll(r)
+	payloads := strings.Split(string(data), payloadSeparator)
+
+	if len(payloads) != 4 || payloads[3] != "" {
+		t.Fatalf("Should convert 2 requests and 1 response: %q", payloads)
+	}
+
+	if meta := payloadMeta([]byte(payloads[0])); string(meta[2]) != "1714557600000000000" {
+		t.Error("Entries should be ordered by time:", string(meta[2]))
+	}
+	if body := string(payloadBody([]byte(payloads[0]))); body != "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n" {
+		t.Errorf("Wrong request: %q", body)
+	}
+
+	if body := string(payloadBody([]byte(payloads[1]))); body != "POST /login?next=%2F HTTP/1.1\r\ncontent-type: application/x-www-form-urlencoded\r\nHost: example.com\r\nContent-Length: 8\r\n\r\nuser=a+b" {
+		t.Errorf("Wrong request: %q", body)
+	}
+
+	response := []byte(payloads[2])
+	if response[0] != ResponsePayload || string(payloadMeta(response)[2]) != "20500000" {
+		t.Errorf("Response should have latency: %q", response)
+	}
+	if string(payloadMeta(response)[1]) != string(payloadMeta([]byte(payloads[1]))[1]) {
+		t.Error("Response should have id of request")
+	}
+	if body := string(payloadBody(response)); body != "HTTP/1.1 200 OK\r\ncontent-type: text/plain\r\nContent-Length: 2\r\n\r\nok" {
+		t.Errorf("Wrong response: %q", body)
+	}
+}
+
+func TestInputFileHAR(t *testing.T) {
+	file, _ := ioutil.TempFile("", "gor_*.har")
+	file.WriteString(testHAR)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	input := NewFileInput(file.Name(), false)
+	buf := make([]byte, 1000)
+
+	n, _ := input.Read(buf)
+	if !strings.HasPrefix(string(payloadBody(buf[:n])), "GET / HTTP/1.1") {
+		t.Errorf("Should read HAR entries: %q", buf[:n])
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Headers set by signing, replacing ones of captured request
+var awsSignatureHeaders = []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256"}
+
+// awsSigner re-signs replayed requests with AWS Signature Version 4, so requests captured in front of API
+// Gateway, or S3 compatible storage, are accepted by replayed server
+type awsSigner struct {
+	service string
+	region  string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newAWSSigner creates signer for service set in config, or returns nil if signing is not enabled. Region and
+// credentials not set in config are taken from standard AWS environment variables.
+func newAWSSigner(config *HTTPOutputConfig) (*awsSigner, error) {
+	if config.AWSService == "" {
+		return nil, nil
+	}
+
+	s := &awsSigner{
+		service:      config.AWSService,
+		region:       config.AWSRegion,
+		accessKey:    config.AWSAccessKey,
+		secretKey:    config.AWSSecretKey,
+		sessionToken: config.AWSSessionToken,
+	}
+
+	if s.region == "" {
+		s.region = firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	if s.accessKey == "" && s.secretKey == "" {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("AWS credentials are not set: use --output-http-aws-access-key and --output-http-aws-secret-key, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	return s, nil
+}
+
+// sign returns signature headers of request sent to host, which replace ones of captured request
+func (s *awsSigner) sign(method, host string, u *url.URL, header http.Header, body []byte, now time.Time) http.Header {
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+
+	// S3 paths are encoded once, paths of other services twice
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if s.service != "s3" {
+		path = awsEscape(path, false)
+	}
+	unescaped, _ := url.PathUnescape(path)
+
+	req := &http.Request{
+		Method: method,
+		URL:    &url.URL{Host: host, Path: unescaped, RawPath: path, RawQuery: awsCanonicalQuery(u.Query())},
+		Header: make(http.Header),
+	}
+
+	// Only headers which are not changed on the way to replayed server are signed
+	for name, values := range header {
+		if name == "Content-Type" || name == "Content-Md5" || strings.HasPrefix(name, "X-Amz-") {
+			req.Header[name] = values
+		}
+	}
+	for _, name := range awsSignatureHeaders {
+		req.Header.Del(name)
+	}
+
+	if s.service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signAWSRequest(req, s.service, s.region, payloadHash, s.accessKey, s.secretKey, s.sessionToken, now)
+
+	signature := make(http.Header)
+	for _, name := range awsSignatureHeaders {
+		if value := req.Header.Get(name); value != "" {
+			signature.Set(name, value)
+		}
+	}
+
+	return signature
+}
+
+// signRequest replaces signature of request sent over http.Transport
+func (s *awsSigner) signRequest(req *http.Request, body []byte, now time.Time) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	signature := s.sign(req.Method, host, req.URL, req.Header, body, now)
+	for _, name := range awsSignatureHeaders {
+		req.Header.Del(name)
+	}
+	for name, values := range signature {
+		req.Header[name] = values
+	}
+}
+
+// signPayload replaces signature of request payload, sent to host if it has no Host header
+func (s *awsSigner) signPayload(data []byte, host string, now time.Time) ([]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return data, err
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return data, err
+	}
+
+	if req.Host != "" {
+		host = req.Host
+	}
+
+	signature := s.sign(req.Method, host, req.URL, req.Header, body, now)
+	for _, name := range awsSignatureHeaders {
+		if value := signature.Get(name); value != "" {
+			data = proto.SetHeader(data, []byte(name), []byte(value))
+		} else {
+			data = proto.DeleteHeader(data, []byte(name))
+		}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+func testAWSSigner(service string) *awsSigner {
+	s, _ := newAWSSigner(&HTTPOutputConfig{AWSService: service, AWSAccessKey: "AKIDEXAMPLE", AWSSecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"})
+	return s
+}
+
+func TestAWSSignerPayload(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	// "get-vanilla" case of AWS Signature Version 4 test suite, captured with signature of another key
+	payload := []byte("GET / HTTP/1.1\r\nHost: example.amazonaws.com\r\nAuthorization: AWS4-HMAC-SHA256 Credential=AKIDPRODUCTION\r\nX-Amz-Security-Token: production\r\n\r\n")
+
+	payload, err := testAWSSigner("service").signPayload(payload, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := proto.Header(payload, []byte("Authorization")); string(auth) != expected {
+		t.Errorf("Wrong signature: %s", auth)
+	}
+
+	if date := proto.Header(payload, []byte("X-Amz-Date")); string(date) != "20150830T123600Z" {
+		t.Errorf("Wrong date: %s", date)
+	}
+
+	if token := proto.Header(payload, []byte("X-Amz-Security-Token")); len(token) != 0 {
+		t.Errorf("Token of captured request should be removed: %s", token)
+	}
+}
+
+func TestAWSSignerTransport(t *testing.T) {
+	now := time.Now()
+	payload := []byte("POST /prod/items%20list?b=2&a=1 HTTP/1.1\r\nHost: api.example.com\r\nContent-Type: application/json\r\nUser-Agent: curl\r\nContent-Length: 2\r\n\r\n{}")
+
+	for _, service := range []string{"execute-api", "s3"} {
+		s := testAWSSigner(service)
+
+		signed, _ := s.signPayload(append([]byte{}, payload...), "", now)
+
+		req, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+		body, _ := ioutil.ReadAll(req.Body)
+		s.signRequest(req, body, now)
+
+		if auth := req.Header.Get("Authorization"); auth != string(proto.Header(signed, []byte("Authorization"))) {
+			t.Errorf("%s: Request and payload should have the same signature: %s", service, auth)
+		}
+
+		if !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-") {
+			t.Errorf("%s: Headers changed on the way should not be signed: %s", service, req.Header.Get("Authorization"))
+		}
+	}
+}
+
+func TestHTTPOutputAWSSign(t *testing.T) {
+	signatures := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatures <- r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workers: 1, AWSService: "execute-api", AWSRegion: "eu-west-1", AWSAccessKey: "AKIDEXAMPLE", AWSSecretKey: "secret"})
+	output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\nAuthorization: AWS4-HMAC-SHA256 Credential=AKIDPRODUCTION\r\n\r\n"))
+
+	if auth := <-signatures; !strings.Contains(auth, "Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/execute-api/aws4_request") {
+		t.Errorf("Request should be re-signed: %s", auth)
+	}
+
+	if _, err := newAWSSigner(&HTTPOutputConfig{AWSService: "s3", AWSAccessKey: "AKIDEXAMPLE"}); err == nil {
+		t.Error("Should require secret key")
+	}
+}
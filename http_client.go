@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"io"
 	"log"
@@ -38,9 +39,36 @@ type HTTPClientConfig struct {
 	ConnectionTimeout  time.Duration
 	Timeout            time.Duration
 	ResponseBufferSize int
+
+	// Limit of the whole request, from sending it until the response is read. Not limited by default.
+	RequestTimeout time.Duration
+	// Time to wait for response headers after request is sent, Timeout by default
+	ResponseHeaderTimeout time.Duration
+	// Response body is read up to this size, and connection is closed if body is larger. 1GB by default.
+	MaxResponseSize int
+
+	// Follow redirects to other hosts, sending them to replayed server. By default such redirects are returned.
+	RedirectRewriteHost bool
+
+	// Signs requests with AWS Signature Version 4, replacing signature of captured ones, if set
+	Signer *awsSigner
+
+	// TLS configuration of https connections. By default server certificate is not verified.
+	TLSConfig *tls.Config
+
+	// Forward proxy connections are dialed through, if set
+	Proxy *httpProxyDialer
+
+	// Dials connections instead of net.Dialer, if set, like connections to in-process test server
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 }
 
 type HTTPClient struct {
+	// Pool of connections shared with other clients. If it is not set, client keeps its own connection.
+	pool *httpConnPool
+	// Connection taken from the pool for the current request
+	pooled net.Conn
+
 	baseURL        string
 	scheme         string
 	host           string
@@ -50,8 +78,10 @@ type HTTPClient struct {
 	redirectsCount int
 }
 
+// NewHTTPClient creates client sending requests to baseURL: host and port, http:// or https:// URL, or
+// unix:// URL of Unix domain socket, like "unix:///var/run/app.sock"
 func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
-	if !strings.HasPrefix(baseURL, "http") {
+	if !strings.HasPrefix(baseURL, "http") && !strings.HasPrefix(baseURL, "unix://") {
 		baseURL = "http://" + baseURL
 	}
 
@@ -68,6 +98,14 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 
 	config.ConnectionTimeout = config.Timeout
 
+	if config.ResponseHeaderTimeout == 0 {
+		config.ResponseHeaderTimeout = config.Timeout
+	}
+
+	if config.MaxResponseSize == 0 {
+		config.MaxResponseSize = maxResponseSize
+	}
+
 	if config.ResponseBufferSize == 0 {
 		config.ResponseBufferSize = 100 * 1024 // 100kb
 	}
@@ -76,6 +114,9 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 	client.baseURL = u.String()
 	client.host = u.Host
 	client.scheme = u.Scheme
+	if u.Scheme == "unix" {
+		client.host = u.Path
+	}
 	client.respBuf = make([]byte, config.ResponseBufferSize)
 	client.config = config
 
@@ -85,23 +126,61 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 func (c *HTTPClient) Connect() (err error) {
 	c.Disconnect()
 
-	if !strings.Contains(c.host, ":") {
-		c.conn, err = net.DialTimeout("tcp", c.host+":80", c.config.ConnectionTimeout)
-	} else {
-		c.conn, err = net.DialTimeout("tcp", c.host, c.config.ConnectionTimeout)
+	c.conn, err = c.dial()
+
+	return
+}
+
+func (c *HTTPClient) dial() (conn net.Conn, err error) {
+	network, host := "tcp", c.host
+	if c.scheme == "unix" {
+		network = "unix"
+	} else if !strings.Contains(host, ":") {
+		host += ":80"
+	}
+
+	switch {
+	case c.config.DialContext != nil:
+		ctx, cancel := context.WithTimeout(context.Background(), c.config.ConnectionTimeout)
+		conn, err = c.config.DialContext(ctx, network, host)
+		cancel()
+	case c.config.Proxy != nil:
+		conn, err = c.config.Proxy.Dial(network, host)
+	default:
+		conn, err = net.DialTimeout(network, host, c.config.ConnectionTimeout)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
 	if c.scheme == "https" {
-		tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+		tlsConn := tls.Client(conn, c.tlsConfig())
 
 		if err = tlsConn.Handshake(); err != nil {
-			return
+			conn.Close()
+			return nil, err
 		}
 
-		c.conn = tlsConn
+		conn = tlsConn
 	}
 
-	return
+	return conn, nil
+}
+
+func (c *HTTPClient) tlsConfig() *tls.Config {
+	config := c.config.TLSConfig
+	if config == nil {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+
+	// Certificate is verified for the host, if server name is not overridden
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(c.host)
+	}
+
+	return config
 }
 
 func (c *HTTPClient) Disconnect() {
@@ -113,18 +192,21 @@ func (c *HTTPClient) Disconnect() {
 }
 
 func (c *HTTPClient) isAlive() bool {
+	return connAlive(c.conn)
+}
+
+// connAlive checks if connection was not closed by the other side
+func connAlive(conn net.Conn) bool {
 	one := make([]byte, 1)
 
 	// Ready 1 byte from socket without timeout to check if it not closed
-	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
-	_, err := c.conn.Read(one)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Read(one)
 
 	if err == nil {
 		return true
 	} else if err == io.EOF {
-		if c.config.Debug {
-			Debug("[HTTPClient] connection closed, reconnecting")
-		}
+		Debug("[HTTPClient] connection closed, reconnecting")
 		return false
 	} else if err == syscall.EPIPE {
 		Debug("Detected broken pipe.", err)
@@ -147,7 +229,18 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		}
 	}()
 
-	if c.conn == nil || !c.isAlive() {
+	if c.pool != nil {
+		if c.pooled, err = c.pool.get(c.dial); err != nil {
+			log.Println("[HTTPClient] Connection error:", err)
+			response = errorPayload(HTTP_CONNECTION_ERROR)
+			return
+		}
+		c.conn = c.pooled
+
+		defer func() {
+			c.release(err == nil && !bytes.Equal(proto.Header(response, []byte("Connection")), []byte("close")))
+		}()
+	} else if c.conn == nil || !c.isAlive() {
 		Debug("[HTTPClient] Connecting:", c.baseURL)
 		if err = c.Connect(); err != nil {
 			log.Println("[HTTPClient] Connection error:", err)
@@ -156,14 +249,28 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		}
 	}
 
-	timeout := time.Now().Add(c.config.Timeout)
+	// Deadline of the whole request, if it is limited
+	var deadline time.Time
+	if c.config.RequestTimeout > 0 {
+		deadline = time.Now().Add(c.config.RequestTimeout)
+	}
 
-	c.conn.SetWriteDeadline(timeout)
+	c.conn.SetWriteDeadline(earliest(time.Now().Add(c.config.Timeout), deadline))
 
-	if !c.config.OriginalHost {
+	// Requests sent to Unix socket keep original host
+	if !c.config.OriginalHost && c.scheme != "unix" {
 		data = proto.SetHost(data, []byte(c.baseURL), []byte(c.host))
 	}
 
+	// Signature covers Host header, so request is signed once it is set
+	if c.config.Signer != nil {
+		if data, err = c.config.Signer.signPayload(data, c.host, time.Now()); err != nil {
+			Debug("[HTTPClient] Can't sign request:", err)
+			response = errorPayload(HTTP_UNKNOWN_ERROR)
+			return
+		}
+	}
+
 	if c.config.Debug {
 		Debug("[HTTPClient] Sending:", string(data))
 	}
@@ -176,14 +283,15 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 
 	var readBytes, n int
 	var currentChunk []byte
-	timeout = time.Now().Add(c.config.Timeout)
+	timeout := time.Now().Add(c.config.ResponseHeaderTimeout)
+	headersRead := false
 	chunked := false
 	contentLength := -1
 	currentContentLength := 0
 	chunks := 0
 
 	for {
-		c.conn.SetReadDeadline(timeout)
+		c.conn.SetReadDeadline(earliest(timeout, deadline))
 
 		if readBytes < len(c.respBuf) {
 			n, err = c.conn.Read(c.respBuf[readBytes:])
@@ -192,17 +300,27 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 
 			if err != nil {
 				if err == io.EOF {
+					// Server closed connection after the response
+					c.Disconnect()
 					err = nil
 				}
 				break
 			}
 
+			// Interim responses, like 100 Continue to request with Expect header, precede the final one
+			for !headersRead && isInterimResponse(c.respBuf[:readBytes]) {
+				end := bytes.Index(c.respBuf[:readBytes], proto.EmptyLine) + len(proto.EmptyLine)
+				readBytes = copy(c.respBuf, c.respBuf[end:readBytes])
+			}
+
 			// First chunk
 			if chunked || contentLength != -1 {
 				currentContentLength += n
 			} else {
 				// If headers are finished
 				if bytes.Contains(c.respBuf[:readBytes], proto.EmptyLine) {
+					headersRead = true
+
 					if bytes.Equal(proto.Header(c.respBuf, []byte("Transfer-Encoding")), []byte("chunked")) {
 						chunked = true
 					} else {
@@ -213,6 +331,10 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 					}
 
 					currentContentLength += len(proto.Body(c.respBuf[:readBytes]))
+
+					if isBodylessResponse(data, c.respBuf[:readBytes]) {
+						break
+					}
 				}
 			}
 
@@ -238,6 +360,7 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 			n, err = c.conn.Read(currentChunk)
 
 			if err == io.EOF {
+				c.Disconnect()
 				break
 			} else if err != nil {
 				Debug("[HTTPClient] Read the whole body error:", err, c.baseURL)
@@ -268,18 +391,28 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 			}
 		}
 
-		if readBytes >= maxResponseSize {
-			Debug("[HTTPClient] Body is more than the max size", maxResponseSize,
+		if readBytes >= len(c.respBuf) {
+			headersRead = true
+		}
+
+		if currentContentLength > c.config.MaxResponseSize {
+			// The rest of the body is left unread, so connection can't be reused
+			Debug("[HTTPClient] Body is more than the max size", c.config.MaxResponseSize,
 				c.baseURL)
+			c.Disconnect()
 			break
 		}
 
-		// For following chunks expect less timeout
-		timeout = time.Now().Add(c.config.Timeout / 5)
+		// Headers are expected until response header timeout, following chunks expect less timeout
+		if headersRead {
+			timeout = time.Now().Add(c.config.Timeout / 5)
+		}
 	}
 
 	if err != nil {
 		Debug("[HTTPClient] Response read error", err, c.conn, readBytes)
+		// Response may still arrive later, so connection can't be reused
+		c.Disconnect()
 		response = errorPayload(HTTP_TIMEOUT)
 		return
 	}
@@ -298,16 +431,18 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		status := payload[9:12]
 
 		// 3xx requests
-		if status[0] == '3' {
+		if path, host, ok := c.redirectTarget(data, payload); status[0] == '3' && ok {
 			c.redirectsCount++
 
-			location := proto.Header(payload, []byte("Location"))
-			redirectPayload := []byte("GET " + string(location) + " HTTP/1.1\r\n\r\n")
+			redirectPayload := []byte("GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n")
 
 			if c.config.Debug {
-				Debug("[HTTPClient] Redirecting to: " + string(location))
+				Debug("[HTTPClient] Redirecting to: " + host + path)
 			}
 
+			// Redirect is sent over another connection of the pool
+			c.release(true)
+
 			return c.Send(redirectPayload)
 		}
 	}
@@ -317,6 +452,57 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 	return payload, err
 }
 
+// redirectTarget returns path and Host header of request following redirect response. Redirects are always
+// sent to replayed server: ones to other hosts are followed only if RedirectRewriteHost is set.
+func (c *HTTPClient) redirectTarget(request, response []byte) (path, host string, ok bool) {
+	header := proto.Header(response, []byte("Location"))
+	location, err := url.Parse(string(header))
+	if err != nil || len(header) == 0 {
+		return "", "", false
+	}
+
+	// Relative location, like "?page=2", is resolved against URI of request
+	requestURL, err := url.Parse(string(proto.Path(request)))
+	if err != nil {
+		return "", "", false
+	}
+	target := requestURL.ResolveReference(location)
+
+	// Host request was sent with, replayed server or original host
+	host = string(proto.Header(request, []byte("Host")))
+	if host == "" {
+		host = c.host
+	}
+
+	if location.Host != "" && location.Host != host && location.Host != c.host {
+		if !c.config.RedirectRewriteHost {
+			return "", "", false
+		}
+		host = location.Host
+	}
+
+	return target.RequestURI(), host, true
+}
+
+// earliest returns the earliest of time and deadline, if deadline is set
+func earliest(t, deadline time.Time) time.Time {
+	if !deadline.IsZero() && deadline.Before(t) {
+		return deadline
+	}
+	return t
+}
+
+// release returns connection of the current request to the pool. Connection is closed if it can't be reused,
+// or if it was closed during the request.
+func (c *HTTPClient) release(reusable bool) {
+	if c.pooled == nil {
+		return
+	}
+
+	c.pool.put(c.pooled, reusable && c.conn == c.pooled)
+	c.pooled, c.conn = nil, nil
+}
+
 func (c *HTTPClient) Get(path string) (response []byte, err error) {
 	payload := "GET " + path + " HTTP/1.1\r\n\r\n"
 
@@ -344,6 +530,28 @@ const (
 	HTTP_TIMEOUT = "524"
 )
 
+// isBodylessResponse checks if response has no body, even if it has Content-Length:
+// responses to HEAD requests, and responses with 101, 204 or 304 status
+func isBodylessResponse(request, response []byte) bool {
+	if bytes.HasPrefix(request, []byte("HEAD ")) {
+		return true
+	}
+
+	status := proto.Status(response)
+	return bytes.Equal(status, []byte("101")) || bytes.Equal(status, []byte("204")) || bytes.Equal(status, []byte("304"))
+}
+
+// isInterimResponse checks if response starts with complete header block of 1xx response, which is followed by
+// the final response. 101 Switching Protocols is final: data following it belongs to the new protocol.
+func isInterimResponse(response []byte) bool {
+	if !bytes.Contains(response, proto.EmptyLine) {
+		return false
+	}
+
+	status := proto.Status(response)
+	return len(status) == 3 && status[0] == '1' && !bytes.Equal(status, []byte("101"))
+}
+
 var errorPayloadTemplate = "HTTP/1.1 202 Accepted\r\nDate: Mon, 17 Aug 2015 14:10:11 GMT\r\nContent-Length: 0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"
 
 func errorPayload(errorCode string) []byte {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"github.com/buger/gor/proto"
 	"io/ioutil"
@@ -10,7 +11,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"os"
+	"path/filepath"
 	_ "reflect"
+	"runtime"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -325,6 +330,70 @@ func TestHTTPClientRedirectLimit(t *testing.T) {
 	wg.Wait()
 }
 
+// redirectServer redirects "/" to production host, "/relative" to path of the same host, and records
+// Host headers of requests to "/login"
+func redirectServer(hosts chan string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "http://production.example.com/login?next=1", 302)
+		case "/relative":
+			http.Redirect(w, r, "/login", 302)
+		case "/login":
+			hosts <- r.Host
+		}
+	}))
+}
+
+func TestHTTPClientRedirectHosts(t *testing.T) {
+	hosts := make(chan string, 10)
+	server := redirectServer(hosts)
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{FollowRedirects: 1})
+	if resp, _ := client.Get("/"); !bytes.Equal(proto.Status(resp), []byte("302")) {
+		t.Errorf("Redirect to other host should not be followed: %q", resp)
+	}
+
+	if resp, _ := client.Get("/relative"); !bytes.Equal(proto.Status(resp), []byte("200")) || <-hosts != server.Listener.Addr().String() {
+		t.Errorf("Redirect to the same host should be followed: %q", resp)
+	}
+
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{FollowRedirects: 1, RedirectRewriteHost: true, OriginalHost: true})
+	if resp, _ := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")); !bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Errorf("Redirect should be sent to replayed server: %q", resp)
+	}
+	if host := <-hosts; host != "production.example.com" {
+		t.Errorf("Redirect should keep host of location: %s", host)
+	}
+}
+
+func TestHTTPClientRedirectRelative(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Location is sent as is, http.Redirect would make it absolute
+		switch r.URL.RequestURI() {
+		case "/dir/page":
+			w.Header().Set("Location", "next?a=1")
+			w.WriteHeader(302)
+		case "/list?page=1":
+			w.Header().Set("Location", "?page=2")
+			w.WriteHeader(302)
+		default:
+			w.Write([]byte(r.URL.RequestURI()))
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{FollowRedirects: 1})
+
+	for path, target := range map[string]string{"/dir/page": "/dir/next?a=1", "/list?page=1": "/list?page=2"} {
+		resp, _ := client.Get(path)
+		if !bytes.Equal(proto.Status(resp), []byte("200")) || string(proto.Body(resp)) != target {
+			t.Errorf("Redirect of %s should be resolved to %s: %q", path, target, resp)
+		}
+	}
+}
+
 func TestHTTPClientHandleHTTP10(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -348,6 +417,99 @@ func TestHTTPClientHandleHTTP10(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientBodylessResponses(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				break
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+
+					// Responses have Content-Length, but no body, and connection is kept open
+					if bytes.HasPrefix(buf[:n], []byte("HEAD")) {
+						conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"))
+					} else {
+						conn.Write([]byte("HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{Timeout: time.Second})
+
+	for _, payload := range []string{"HEAD / HTTP/1.1\r\n\r\n", "GET / HTTP/1.1\r\n\r\n"} {
+		start := time.Now()
+		resp, _ := client.Send([]byte(payload))
+
+		if time.Since(start) > 500*time.Millisecond {
+			t.Error("Should not wait for body", payload)
+		}
+
+		if s := string(proto.Status(resp)); s != "200" && s != "304" {
+			t.Error("Should return response", string(resp))
+		}
+	}
+}
+
+func TestHTTPClientContinueResponse(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 1024)
+		for i := 0; ; i++ {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+
+			body := strconv.Itoa(i)
+			final := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+
+			// Interim response is sent separately, or along with the final one
+			if i == 0 {
+				conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+				time.Sleep(50 * time.Millisecond)
+				conn.Write([]byte(final))
+			} else {
+				conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n" + final))
+			}
+		}
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{Timeout: time.Second})
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Send([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nok"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(proto.Status(resp), []byte("200")) || string(proto.Body(resp)) != strconv.Itoa(i) {
+			t.Errorf("Should return the final response %d: %q", i, resp)
+		}
+	}
+}
+
 func TestHTTPClientErrors(t *testing.T) {
 	req := []byte("GET http://foobar.com/path HTTP/1.0\r\n\r\n")
 
@@ -411,3 +573,119 @@ func TestHTTPClientErrors(t *testing.T) {
 		t.Error("Should throw error")
 	}
 }
+
+func TestHTTPClientUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not supported")
+	}
+
+	dir, _ := ioutil.TempDir("", "gor_unix")
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := NewHTTPClient("unix://"+socket, &HTTPClientConfig{})
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Send([]byte("GET /status HTTP/1.1\r\nHost: api.example.com\r\n\r\n"))
+		if err != nil || !bytes.HasSuffix(resp, []byte("api.example.com/status")) {
+			t.Errorf("Should send request to socket, keeping host: %q %v", resp, err)
+		}
+	}
+
+	transport, err := newHTTPTransportClient("unix://"+socket, httpProtocolAuto, &HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := transport.Send([]byte("GET /status HTTP/1.1\r\nHost: api.example.com\r\n\r\n"))
+	if err != nil || !bytes.HasSuffix(resp, []byte("localhost/status")) {
+		t.Errorf("Should send request to socket over transport: %q %v", resp, err)
+	}
+}
+
+func TestHTTPClientDialContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("harness"))
+	}))
+	defer server.Close()
+
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return (&net.Dialer{}).DialContext(ctx, "tcp", server.Listener.Addr().String())
+	}
+
+	client := NewHTTPClient("http://harness.test:8080", &HTTPClientConfig{DialContext: dial})
+
+	resp, err := client.Send([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if err != nil || !bytes.HasSuffix(resp, []byte("harness")) {
+		t.Errorf("Should send request over custom connection: %q %v", resp, err)
+	}
+
+	if len(dialed) != 1 || dialed[0] != "harness.test:8080" {
+		t.Errorf("Dialer should get target address: %v", dialed)
+	}
+}
+
+func TestHTTPClientTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+
+		// Body is streamed slowly, each chunk in time
+		for i := 0; i < 20; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{ResponseHeaderTimeout: 50 * time.Millisecond})
+	resp, err := client.Get("/slow-headers")
+	if !isTimeout(err) || !bytes.Equal(proto.Status(resp), []byte(HTTP_TIMEOUT)) {
+		t.Errorf("Should time out waiting for headers: %q %v", resp, err)
+	}
+
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{})
+	if resp, err := client.Get("/slow-body"); err != nil || !bytes.HasSuffix(resp, []byte("chunk\r\n0\r\n\r\n")) {
+		t.Errorf("Should read the whole body without request timeout: %q %v", resp, err)
+	}
+
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{RequestTimeout: 100 * time.Millisecond})
+	resp, err = client.Get("/slow-body")
+	if !isTimeout(err) || !bytes.Equal(proto.Status(resp), []byte(HTTP_TIMEOUT)) {
+		t.Errorf("Should time out reading body: %q %v", resp, err)
+	}
+}
+
+func TestHTTPClientMaxResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024*1024))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{ResponseBufferSize: 1024, MaxResponseSize: 4096})
+
+	resp, err := client.Get("/")
+	if err != nil || !bytes.HasPrefix(resp, []byte("HTTP/1.1 200")) || len(resp) != 1024 {
+		t.Errorf("Should return truncated response: %d %v", len(resp), err)
+	}
+
+	if client.conn != nil {
+		t.Error("Should close connection with unread body")
+	}
+}
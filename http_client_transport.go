@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// Protocols of HTTP output
+const (
+	httpProtocolHTTP1 = "http/1.1"
+	// HTTP/2 over TLS negotiated with ALPN, or with prior knowledge (h2c) for http:// addresses
+	httpProtocolH2 = "h2"
+	// HTTP/3 over QUIC
+	httpProtocolH3 = "h3"
+	// HTTP/2 or HTTP/1.1, whichever server selects with ALPN
+	httpProtocolAuto = "auto"
+)
+
+// Hop-by-hop request headers, not forwarded by HTTP/2 and HTTP/3
+var httpHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Te", "Content-Length"}
+
+// parseHTTPOutputAddress extracts protocol set by address scheme: "h2://", "h2c://" and "h3://" select
+// protocol of the output, overriding default one. Returns address with http or https scheme.
+func parseHTTPOutputAddress(address, protocol string) (string, string) {
+	switch {
+	case strings.HasPrefix(address, "h2://"):
+		return "https://" + address[len("h2://"):], httpProtocolH2
+	case strings.HasPrefix(address, "h2c://"):
+		return "http://" + address[len("h2c://"):], httpProtocolH2
+	case strings.HasPrefix(address, "h3://"):
+		return "https://" + address[len("h3://"):], httpProtocolH3
+	}
+
+	return address, protocol
+}
+
+// httpTransportClient replays HTTP/1.1 requests over HTTP/2 or HTTP/3, using net/http transports.
+// Unlike HTTPClient, single client is safe for concurrent use, and all workers multiplex requests
+// over its connections. Responses are rendered back as HTTP/1.1 responses.
+type httpTransportClient struct {
+	baseURL  *url.URL
+	protocol string
+	client   *http.Client
+	config   *HTTPClientConfig
+}
+
+func newHTTPTransportClient(address, protocol string, config *HTTPClientConfig) (*httpTransportClient, error) {
+	// Connections to Unix socket are dialed for any host
+	if strings.HasPrefix(address, "unix://") {
+		socket := address[len("unix://"):]
+		config.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		address = "http://localhost"
+	}
+
+	if !strings.HasPrefix(address, "http") {
+		address = "http://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	if config.ResponseBufferSize == 0 {
+		config.ResponseBufferSize = 100 * 1024
+	}
+
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	var transport http.RoundTripper
+
+	switch protocol {
+	case httpProtocolH2:
+		t := &http2.Transport{TLSClientConfig: tlsConfig}
+		if u.Scheme == "http" {
+			t.AllowHTTP = true
+		}
+		if u.Scheme == "http" || config.Proxy != nil || config.DialContext != nil {
+			t.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialHTTP2(network, addr, cfg, u.Scheme == "http", config)
+			}
+		}
+		transport = t
+	case httpProtocolH3:
+		if config.Proxy != nil || config.DialContext != nil {
+			return nil, fmt.Errorf("HTTP/3 requests can't be replayed through proxy or custom dialer")
+		}
+		// QUIC is always encrypted
+		u.Scheme = "https"
+		transport = &http3.Transport{TLSClientConfig: tlsConfig}
+	case httpProtocolAuto:
+		t := &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 100,
+			DialContext:         (&net.Dialer{Timeout: config.Timeout}).DialContext,
+
+			ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		}
+		if config.Proxy != nil {
+			t.Proxy = http.ProxyURL(config.Proxy.url)
+		}
+		if config.DialContext != nil {
+			t.DialContext = config.DialContext
+		}
+		transport = t
+	default:
+		return nil, fmt.Errorf("Unknown HTTP output protocol: %s", protocol)
+	}
+
+	c := &httpTransportClient{baseURL: u, protocol: protocol, config: config}
+
+	// Whole request is limited by request timeout if it is set
+	timeout := config.Timeout
+	if config.RequestTimeout > 0 {
+		timeout = config.RequestTimeout
+	}
+
+	c.client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > config.FollowRedirects {
+				return http.ErrUseLastResponse
+			}
+
+			// Redirects are always sent to replayed server, ones to other hosts only if RedirectRewriteHost is set
+			if req.URL.Host != u.Host {
+				if req.URL.Host != via[0].Host && !config.RedirectRewriteHost {
+					return http.ErrUseLastResponse
+				}
+
+				if config.OriginalHost {
+					req.Host = req.URL.Host
+				}
+				req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+			}
+
+			return nil
+		},
+	}
+
+	return c, nil
+}
+
+// dialHTTP2 dials HTTP/2 connection, with custom dialer or through proxy if they are set. Connection is not
+// encrypted if cleartext (h2c).
+func dialHTTP2(network, addr string, tlsConfig *tls.Config, cleartext bool, config *HTTPClientConfig) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case config.DialContext != nil:
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		conn, err = config.DialContext(ctx, network, addr)
+		cancel()
+	case config.Proxy != nil:
+		conn, err = config.Proxy.Dial(network, addr)
+	default:
+		conn, err = net.DialTimeout(network, addr, config.Timeout)
+	}
+
+	if err != nil || cleartext {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// Send replays HTTP/1.1 request payload, and returns response as HTTP/1.1 payload
+func (c *httpTransportClient) Send(data []byte) ([]byte, error) {
+	original, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return errorPayload(HTTP_UNKNOWN_ERROR), err
+	}
+
+	body, _ := ioutil.ReadAll(original.Body)
+
+	target := *c.baseURL
+	target.Path, target.RawPath, target.RawQuery = original.URL.Path, original.URL.RawPath, original.URL.RawQuery
+
+	req, err := http.NewRequest(original.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return errorPayload(HTTP_UNKNOWN_ERROR), err
+	}
+
+	for name, values := range original.Header {
+		req.Header[name] = values
+	}
+	for _, name := range httpHopHeaders {
+		req.Header.Del(name)
+	}
+
+	if c.config.OriginalHost {
+		req.Host = original.Host
+	}
+
+	if c.config.Signer != nil {
+		c.config.Signer.signRequest(req, body, time.Now())
+	}
+
+	if c.config.Debug {
+		Debug("[HTTPClient] Sending over", c.protocol+":", string(data))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return errorPayload(HTTP_TIMEOUT), err
+		}
+		return errorPayload(HTTP_CONNECTION_ERROR), err
+	}
+	defer resp.Body.Close()
+
+	// Body over buffer size, or max response size, is discarded, as by HTTPClient
+	limit := c.config.ResponseBufferSize
+	if c.config.MaxResponseSize > 0 && c.config.MaxResponseSize < limit {
+		limit = c.config.MaxResponseSize
+	}
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(limit)))
+	if err != nil {
+		return errorPayload(HTTP_TIMEOUT), err
+	}
+
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Transfer-Encoding")
+
+	payload := httpResponseBytes(resp, respBody)
+
+	if c.config.Debug {
+		Debug("[HTTPClient] Received:", string(payload))
+	}
+
+	return payload, nil
+}
+
+// Close closes idle connections of the transport
+func (c *httpTransportClient) Close() error {
+	if closer, ok := c.client.Transport.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	c.client.CloseIdleConnections()
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/buger/gor/proto"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const transportTestRequest = "POST /path?q=1 HTTP/1.1\r\nHost: www.example.com\r\nConnection: keep-alive\r\nContent-Length: 5\r\nX-Test: 1\r\n\r\nhello"
+
+// transportTestHandler checks replayed request, and responds with protocol it was received over
+func transportTestHandler(t *testing.T, protoMajor int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.ProtoMajor != protoMajor {
+			t.Error("Wrong protocol:", r.Proto)
+		}
+
+		if r.Method != "POST" || r.URL.RequestURI() != "/path?q=1" || string(body) != "hello" || r.Header.Get("X-Test") != "1" {
+			t.Errorf("Wrong request: %s %s %q %v", r.Method, r.URL, body, r.Header)
+		}
+
+		if r.Host == "www.example.com" {
+			t.Error("Host should be replaced by output host")
+		}
+
+		w.Header().Set("X-Proto", r.Proto)
+		w.Write([]byte("world"))
+	}
+}
+
+func checkTransportResponse(t *testing.T, resp []byte, err error, proto string) {
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.Contains(resp, []byte("X-Proto: "+proto+"\r\n")) ||
+		!bytes.Contains(resp, []byte("Content-Length: 5\r\n")) || !bytes.HasSuffix(resp, []byte("\r\n\r\nworld")) {
+		t.Errorf("Wrong response: %q", resp)
+	}
+}
+
+func TestHTTPTransportClientH2(t *testing.T) {
+	server := httptest.NewUnstartedServer(transportTestHandler(t, 2))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := newHTTPTransportClient(server.URL, httpProtocolH2, &HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	resp, err := client.Send([]byte(transportTestRequest))
+	checkTransportResponse(t, resp, err, "HTTP/2.0")
+}
+
+func TestHTTPTransportClientH2C(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(transportTestHandler(t, 2), &http2.Server{}))
+	defer server.Close()
+
+	address, protocol := parseHTTPOutputAddress("h2c://"+server.Listener.Addr().String(), httpProtocolHTTP1)
+	client, err := newHTTPTransportClient(address, protocol, &HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	resp, err := client.Send([]byte(transportTestRequest))
+	checkTransportResponse(t, resp, err, "HTTP/2.0")
+}
+
+func TestHTTPTransportClientAuto(t *testing.T) {
+	server := httptest.NewTLSServer(transportTestHandler(t, 1))
+	defer server.Close()
+
+	// Server does not support HTTP/2
+	client, err := newHTTPTransportClient(server.URL, httpProtocolAuto, &HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	resp, err := client.Send([]byte(transportTestRequest))
+	checkTransportResponse(t, resp, err, "HTTP/1.1")
+}
+
+func TestHTTPTransportClientRedirectHosts(t *testing.T) {
+	hosts := make(chan string, 10)
+	server := redirectServer(hosts)
+	defer server.Close()
+
+	client, _ := newHTTPTransportClient(server.URL, httpProtocolAuto, &HTTPClientConfig{FollowRedirects: 1})
+	if resp, _ := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")); !bytes.Equal(proto.Status(resp), []byte("302")) {
+		t.Errorf("Redirect to other host should not be followed: %q", resp)
+	}
+
+	client, _ = newHTTPTransportClient(server.URL, httpProtocolAuto, &HTTPClientConfig{FollowRedirects: 1, RedirectRewriteHost: true, OriginalHost: true})
+	if resp, _ := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")); !bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Errorf("Redirect should be sent to replayed server: %q", resp)
+	}
+	if host := <-hosts; host != "production.example.com" {
+		t.Errorf("Redirect should keep host of location: %s", host)
+	}
+}
+
+func TestHTTPTransportClientH3(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_h3")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http3.Server{
+		Handler:   transportTestHandler(t, 3),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	address, protocol := parseHTTPOutputAddress("h3://"+conn.LocalAddr().String(), httpProtocolHTTP1)
+	client, err := newHTTPTransportClient(address, protocol, &HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	resp, err := client.Send([]byte(transportTestRequest))
+	checkTransportResponse(t, resp, err, "HTTP/3.0")
+}
+
+func TestHTTPTransportClientErrors(t *testing.T) {
+	if _, err := newHTTPTransportClient("staging.com", "spdy", &HTTPClientConfig{}); err == nil {
+		t.Error("Should reject unknown protocol")
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := ln.Addr().String()
+	ln.Close()
+
+	client, _ := newHTTPTransportClient("https://"+address, httpProtocolH2, &HTTPClientConfig{})
+	resp, err := client.Send([]byte(transportTestRequest))
+	if err == nil || !bytes.HasPrefix(resp, []byte("HTTP/1.1 521")) {
+		t.Errorf("Should return connection error: %q %v", resp, err)
+	}
+}
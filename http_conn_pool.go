@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// httpIdleConn is connection kept in the pool between requests
+type httpIdleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// httpConnPool keeps persistent connections to upstream host, shared by all workers of HTTP output,
+// so connections survive workers stopped by dynamic scaling.
+//
+// Connection is taken from the pool for a single request, and returned after response was fully read.
+// Connections closed by the server, or idle longer than idleTimeout, are dropped. If maxPerHost is set,
+// requests wait for a free connection when the limit is reached.
+type httpConnPool struct {
+	mu   sync.Mutex
+	idle []httpIdleConn
+
+	maxIdle     int
+	idleTimeout time.Duration
+
+	// Slots of open connections, nil if their number is not limited
+	slots chan struct{}
+
+	// Set once pool is closed, connections returned after it are closed
+	closed bool
+}
+
+func newHTTPConnPool(maxIdle, maxPerHost int, idleTimeout time.Duration) *httpConnPool {
+	p := &httpConnPool{maxIdle: maxIdle, idleTimeout: idleTimeout}
+
+	if maxPerHost > 0 {
+		p.slots = make(chan struct{}, maxPerHost)
+	}
+
+	return p
+}
+
+// get returns the most recently used idle connection, or dials new one.
+// Every connection returned must be given back with put.
+func (p *httpConnPool) get(dial func() (net.Conn, error)) (net.Conn, error) {
+	if p.slots != nil {
+		p.slots <- struct{}{}
+	}
+
+	for {
+		p.mu.Lock()
+		p.closeExpired()
+
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+
+		conn := p.idle[len(p.idle)-1].conn
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if connAlive(conn) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+
+	conn, err := dial()
+	if err != nil {
+		p.release()
+	}
+
+	return conn, err
+}
+
+// put returns connection to the pool, or closes it if it can't be reused or the pool is full
+func (p *httpConnPool) put(conn net.Conn, reusable bool) {
+	defer p.release()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closeExpired()
+
+	if !reusable || p.closed || len(p.idle) >= p.maxIdle {
+		conn.Close()
+		return
+	}
+
+	p.idle = append(p.idle, httpIdleConn{conn, time.Now()})
+}
+
+func (p *httpConnPool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// closeExpired closes connections idle for longer than timeout. Must be called with mu held.
+func (p *httpConnPool) closeExpired() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+
+	// Idle connections are ordered by the time they were returned
+	deadline := time.Now().Add(-p.idleTimeout)
+	expired := 0
+	for expired < len(p.idle) && p.idle[expired].since.Before(deadline) {
+		p.idle[expired].conn.Close()
+		expired++
+	}
+
+	if expired > 0 {
+		p.idle = append(p.idle[:0], p.idle[expired:]...)
+	}
+}
+
+// Close closes all idle connections, and connections returned after it
+func (p *httpConnPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = nil
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newConnCountingServer starts server which counts accepted connections
+func newConnCountingServer(handler http.HandlerFunc) (*httptest.Server, *int64) {
+	var conns int64
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+
+	return server, &conns
+}
+
+func TestHTTPConnPoolReuse(t *testing.T) {
+	server, conns := newConnCountingServer(func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+
+	pool := newHTTPConnPool(10, 0, time.Minute)
+	defer pool.Close()
+
+	// Clients of stopped workers leave their connections to the others
+	for i := 0; i < 5; i++ {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+		client.pool = pool
+
+		if resp, err := client.Get("/"); err != nil || string(resp[:12]) != "HTTP/1.1 200" {
+			t.Fatal("Wrong response:", string(resp), err)
+		}
+	}
+
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Error("Should reuse single connection:", n)
+	}
+}
+
+func TestHTTPConnPoolClose(t *testing.T) {
+	server, conns := newConnCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+	})
+	defer server.Close()
+
+	pool := newHTTPConnPool(10, 0, time.Minute)
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+	client.pool = pool
+
+	client.Get("/")
+	client.Get("/")
+
+	if n := atomic.LoadInt64(conns); n != 2 {
+		t.Error("Should not reuse connection closed by server:", n)
+	}
+}
+
+func TestHTTPConnPoolIdleTimeout(t *testing.T) {
+	server, conns := newConnCountingServer(func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+
+	pool := newHTTPConnPool(10, 0, 20*time.Millisecond)
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+	client.pool = pool
+
+	client.Get("/")
+	time.Sleep(50 * time.Millisecond)
+	client.Get("/")
+
+	if n := atomic.LoadInt64(conns); n != 2 {
+		t.Error("Should close idle connection:", n)
+	}
+}
+
+func TestHTTPConnPoolMaxPerHost(t *testing.T) {
+	var active, maxActive int64
+
+	server, conns := newConnCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&active, 1)
+		if n > atomic.LoadInt64(&maxActive) {
+			atomic.StoreInt64(&maxActive, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&active, -1)
+	})
+	defer server.Close()
+
+	pool := newHTTPConnPool(10, 2, time.Minute)
+	defer pool.Close()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+			client.pool = pool
+			client.Get("/")
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt64(conns); n > 2 {
+		t.Error("Should open at most 2 connections:", n)
+	}
+
+	if atomic.LoadInt64(&maxActive) > 2 {
+		t.Error("Should send at most 2 requests at once")
+	}
+}
@@ -22,7 +22,9 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 		len(config.paramHashFilters) == 0 &&
 		len(config.params) == 0 &&
 		len(config.headers) == 0 &&
-		len(config.methods) == 0 {
+		len(config.methods) == 0 &&
+		len(config.graphQLTypes) == 0 &&
+		len(config.graphQLNegativeTypes) == 0 {
 		return nil
 	}
 
@@ -51,6 +53,19 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if len(m.config.graphQLTypes) > 0 || len(m.config.graphQLNegativeTypes) > 0 {
+		// Requests which are not GraphQL are not filtered
+		if op, ok := parseGraphQLRequest(payload); ok {
+			if len(m.config.graphQLTypes) > 0 && !m.config.graphQLTypes.contains(op.Type) {
+				return
+			}
+
+			if m.config.graphQLNegativeTypes.contains(op.Type) {
+				return
+			}
+		}
+	}
+
 	if len(m.config.headers) > 0 {
 		for _, header := range m.config.headers {
 			payload = proto.SetHeader(payload, []byte(header.Name), []byte(header.Value))
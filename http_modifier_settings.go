@@ -21,6 +21,9 @@ type HTTPModifierConfig struct {
 	params  HTTPParams
 	headers HTTPHeaders
 	methods HTTPMethods
+
+	graphQLTypes         GraphQLTypes
+	graphQLNegativeTypes GraphQLTypes
 }
 
 //
@@ -166,6 +169,35 @@ func (h *HTTPMethods) Set(value string) error {
 	return nil
 }
 
+//
+// Handling of --http-allow-graphql-type, --http-disallow-graphql-type options
+//
+type GraphQLTypes []string
+
+func (h *GraphQLTypes) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *GraphQLTypes) Set(value string) error {
+	switch value {
+	case GraphQLQuery, GraphQLMutation, GraphQLSubscription:
+	default:
+		return fmt.Errorf("Unknown GraphQL operation type %q, should be query, mutation, or subscription", value)
+	}
+
+	*h = append(*h, value)
+	return nil
+}
+
+func (h GraphQLTypes) contains(value string) bool {
+	for _, t := range h {
+		if t == value {
+			return true
+		}
+	}
+	return false
+}
+
 //
 // Handling of --http-rewrite-url option
 //
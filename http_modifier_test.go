@@ -245,3 +245,43 @@ func TestHTTPModifierSetParam(t *testing.T) {
 		t.Error("Should override param", string(payload))
 	}
 }
+
+func TestHTTPModifierGraphQLTypes(t *testing.T) {
+	types := GraphQLTypes{}
+	types.Set("query")
+
+	negativeTypes := GraphQLTypes{}
+	negativeTypes.Set("subscription")
+
+	if types.Set("select") == nil {
+		t.Error("Should not accept unknown type")
+	}
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		graphQLTypes: types,
+	})
+
+	if len(modifier.Rewrite(graphQLPayload("application/json", `{"query": "query { me }"}`))) == 0 {
+		t.Error("Should pass query")
+	}
+
+	if len(modifier.Rewrite(graphQLPayload("application/json", `{"query": "mutation { like }"}`))) > 0 {
+		t.Error("Should not pass mutation")
+	}
+
+	if len(modifier.Rewrite([]byte("POST /post HTTP/1.1\r\nContent-Length: 7\r\nHost: www.w3.org\r\n\r\na=1&b=2"))) == 0 {
+		t.Error("Should pass request which is not GraphQL")
+	}
+
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		graphQLNegativeTypes: negativeTypes,
+	})
+
+	if len(modifier.Rewrite(graphQLPayload("application/json", `{"query": "subscription { liked }"}`))) > 0 {
+		t.Error("Should not pass subscription")
+	}
+
+	if len(modifier.Rewrite(graphQLPayload("application/json", `{"query": "mutation { like }"}`))) == 0 {
+		t.Error("Should pass mutation")
+	}
+}
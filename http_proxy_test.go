@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// connectProxy is HTTP proxy tunnelling connections with CONNECT method, requiring basic auth
+func connectProxy(t *testing.T, tunnels *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			t.Errorf("Proxy should receive CONNECT request, got %s", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		atomic.AddInt64(tunnels, 1)
+		w.WriteHeader(http.StatusOK)
+
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
+
+func TestHTTPOutputProxy(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Done()
+	}))
+	defer server.Close()
+
+	var tunnels int64
+	proxy := connectProxy(t, &tunnels)
+	defer proxy.Close()
+
+	proxyURL := strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workers: 1, Proxy: proxyURL})
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+	wg.Wait()
+
+	// Tunnelled connection is kept alive
+	if n := atomic.LoadInt64(&tunnels); n != 1 {
+		t.Errorf("Requests should be sent through single tunnel, got %d", n)
+	}
+
+	// Wrong credentials
+	dialer, _ := newHTTPProxyDialer(proxy.URL, 0)
+	if _, err := dialer.Dial("tcp", server.Listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Should fail when proxy refuses connection: %v", err)
+	}
+}
+
+// socks5Proxy accepts SOCKS5 connections with username and password authentication, see RFC 1928 and RFC 1929
+func socks5Proxy(t *testing.T) net.Listener {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				// Greeting: version, methods
+				header := make([]byte, 2)
+				io.ReadFull(r, header)
+				io.ReadFull(r, make([]byte, header[1]))
+				conn.Write([]byte{5, 2})
+
+				// Username and password
+				io.ReadFull(r, header)
+				user := make([]byte, header[1])
+				io.ReadFull(r, user)
+				io.ReadFull(r, header[:1])
+				password := make([]byte, header[0])
+				io.ReadFull(r, password)
+				if string(user) != "user" || string(password) != "secret" {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+
+				// Request: version, command, reserved, address type, IPv4 address, port
+				request := make([]byte, 10)
+				if _, err := io.ReadFull(r, request); err != nil || request[3] != 1 {
+					t.Errorf("Wrong SOCKS5 request: %v %v", request, err)
+					return
+				}
+
+				addr := &net.TCPAddr{IP: net.IP(request[4:8]), Port: int(binary.BigEndian.Uint16(request[8:]))}
+				upstream, err := net.Dial("tcp", addr.String())
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(upstream, r)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestHTTPOutputSOCKS5Proxy(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Done()
+	}))
+	defer server.Close()
+
+	proxy := socks5Proxy(t)
+	defer proxy.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workers: 1, Proxy: "socks5://user:secret@" + proxy.Addr().String()})
+
+	wg.Add(1)
+	output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	wg.Wait()
+
+	dialer, _ := newHTTPProxyDialer("socks5://user:wrong@"+proxy.Addr().String(), 0)
+	if _, err := dialer.Dial("tcp", server.Listener.Addr().String()); err == nil {
+		t.Error("Should fail with wrong credentials")
+	}
+
+	if _, err := newHTTPProxyDialer("ftp://proxy", 0); err == nil {
+		t.Error("Should reject unsupported proxy")
+	}
+}
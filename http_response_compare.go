@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Response headers which differ between servers or responses, and are not compared
+var httpVolatileHeaders = []string{
+	"Date", "Expires", "Last-Modified", "Age", "Etag", "Set-Cookie",
+	"X-Request-Id", "X-Correlation-Id", "X-Trace-Id",
+	"Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive",
+}
+
+// Volatile values replaced in compared responses: RFC 3339 and HTTP dates, and UUIDs
+var httpVolatileValues = []struct {
+	re          *regexp.Regexp
+	replacement []byte
+}{
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`), []byte("<date>")},
+	{regexp.MustCompile(`(Mon|Tue|Wed|Thu|Fri|Sat|Sun), \d{2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}:\d{2} [A-Z]{3}`), []byte("<date>")},
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), []byte("<uuid>")},
+}
+
+// Limits of mismatch report: differences recorded per request, and length of compared bodies which are not JSON
+const (
+	compareMaxDiffs     = 20
+	compareMaxBodyValue = 1024
+)
+
+// responseDiff is value which differs between responses. Path is "status", "header.<name>", "body" or
+// "body.<JSON path>".
+type responseDiff struct {
+	Path     string      `json:"path"`
+	Expected interface{} `json:"expected"`
+	Actual   interface{} `json:"actual"`
+}
+
+// responseMismatch is record of mismatch report
+type responseMismatch struct {
+	Time    time.Time      `json:"time"`
+	ID      string         `json:"id"`
+	Request string         `json:"request"`
+	Diffs   []responseDiff `json:"diffs"`
+}
+
+// httpResponseComparator compares HTTP responses after normalization: volatile headers, dates and UUIDs,
+// and configured JSON paths are ignored. Mismatches are appended to report file, one JSON object per line,
+// and counted by path of differing value.
+type httpResponseComparator struct {
+	// Prefix of logged messages
+	name string
+
+	ignoredHeaders map[string]bool
+	ignoredPaths   [][]string
+
+	mu     sync.Mutex
+	paths  map[string]uint64
+	report *os.File
+}
+
+// newHTTPResponseComparator creates comparator ignoring given headers and JSON paths, in addition to volatile
+// ones. JSON path is keys separated by dots, "*" matches any key or array element. If report is empty,
+// mismatches are printed with --verbose.
+func newHTTPResponseComparator(name, report string, ignoreHeaders, ignoreJSONPaths []string) (*httpResponseComparator, error) {
+	c := &httpResponseComparator{name: name, ignoredHeaders: make(map[string]bool), paths: make(map[string]uint64)}
+
+	for _, headers := range [][]string{httpVolatileHeaders, ignoreHeaders} {
+		for _, name := range headers {
+			c.ignoredHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+
+	for _, path := range ignoreJSONPaths {
+		c.ignoredPaths = append(c.ignoredPaths, strings.Split(path, "."))
+	}
+
+	if report != "" {
+		var err error
+		if c.report, err = os.OpenFile(report, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// comparedResponse is parsed response, normalized for comparison
+type comparedResponse struct {
+	status string
+	header http.Header
+	body   []byte
+}
+
+func parseComparedResponse(payload []byte) comparedResponse {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+	if err != nil {
+		return comparedResponse{status: string(proto.Status(payload)), header: http.Header{}, body: proto.Body(payload)}
+	}
+	defer resp.Body.Close()
+
+	// Truncated body is compared as is
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	return comparedResponse{status: strconv.Itoa(resp.StatusCode), header: resp.Header, body: body}
+}
+
+// compare returns differences of actual response from expected one, after normalization
+func (c *httpResponseComparator) compare(expectedPayload, actualPayload []byte) (diffs []responseDiff) {
+	expected, actual := parseComparedResponse(expectedPayload), parseComparedResponse(actualPayload)
+
+	if expected.status != actual.status {
+		diffs = append(diffs, responseDiff{"status", expected.status, actual.status})
+	}
+
+	var names []string
+	for name := range expected.header {
+		names = append(names, name)
+	}
+	for name := range actual.header {
+		if _, ok := expected.header[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if c.ignoredHeaders[name] {
+			continue
+		}
+
+		a := string(normalizeVolatile([]byte(strings.Join(expected.header[name], ", "))))
+		b := string(normalizeVolatile([]byte(strings.Join(actual.header[name], ", "))))
+		if a != b {
+			diffs = append(diffs, responseDiff{"header." + name, a, b})
+		}
+	}
+
+	diffs = append(diffs, c.compareBodies(expected.body, actual.body)...)
+
+	if len(diffs) > compareMaxDiffs {
+		diffs = diffs[:compareMaxDiffs]
+	}
+
+	return diffs
+}
+
+// compareBodies compares JSON bodies value by value, and other bodies as text
+func (c *httpResponseComparator) compareBodies(expected, actual []byte) []responseDiff {
+	a, errA := c.normalizeJSON(expected)
+	b, errB := c.normalizeJSON(actual)
+
+	if errA == nil && errB == nil {
+		return diffJSON("body", a, b, nil)
+	}
+
+	expected, actual = normalizeVolatile(expected), normalizeVolatile(actual)
+	if bytes.Equal(expected, actual) {
+		return nil
+	}
+
+	if len(expected) > compareMaxBodyValue {
+		expected = expected[:compareMaxBodyValue]
+	}
+	if len(actual) > compareMaxBodyValue {
+		actual = actual[:compareMaxBodyValue]
+	}
+
+	return []responseDiff{{"body", string(expected), string(actual)}}
+}
+
+// normalizeJSON decodes JSON body, removes ignored paths, and replaces volatile values in strings
+func (c *httpResponseComparator) normalizeJSON(body []byte) (interface{}, error) {
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	for _, path := range c.ignoredPaths {
+		value = removeJSONPath(value, path)
+	}
+
+	return normalizeJSONStrings(value), nil
+}
+
+// removeJSONPath removes values at given path, "*" matches any key or array element
+func removeJSONPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+
+	switch node := value.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(node, key)
+			} else {
+				node[key] = removeJSONPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if path[0] != "*" && path[0] != strconv.Itoa(i) {
+				continue
+			}
+			// Removed array elements are replaced by null, so indexes of the rest are kept
+			if len(path) == 1 {
+				node[i] = nil
+			} else {
+				node[i] = removeJSONPath(child, path[1:])
+			}
+		}
+	}
+
+	return value
+}
+
+func normalizeJSONStrings(value interface{}) interface{} {
+	switch node := value.(type) {
+	case string:
+		return string(normalizeVolatile([]byte(node)))
+	case map[string]interface{}:
+		for key, child := range node {
+			node[key] = normalizeJSONStrings(child)
+		}
+	case []interface{}:
+		for i, child := range node {
+			node[i] = normalizeJSONStrings(child)
+		}
+	}
+
+	return value
+}
+
+// normalizeVolatile replaces dates and UUIDs with placeholders
+func normalizeVolatile(data []byte) []byte {
+	for _, v := range httpVolatileValues {
+		data = v.re.ReplaceAll(data, v.replacement)
+	}
+
+	return data
+}
+
+// diffJSON appends differences of two decoded JSON values, with their paths
+func diffJSON(path string, a, b interface{}, diffs []responseDiff) []responseDiff {
+	switch nodeA := a.(type) {
+	case map[string]interface{}:
+		nodeB, ok := b.(map[string]interface{})
+		if !ok {
+			return append(diffs, responseDiff{path, a, b})
+		}
+
+		var keys []string
+		for key := range nodeA {
+			keys = append(keys, key)
+		}
+		for key := range nodeB {
+			if _, ok := nodeA[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			childA, okA := nodeA[key]
+			childB, okB := nodeB[key]
+			if okA != okB {
+				diffs = append(diffs, responseDiff{path + "." + key, childA, childB})
+				continue
+			}
+			diffs = diffJSON(path+"."+key, childA, childB, diffs)
+		}
+
+		return diffs
+	case []interface{}:
+		nodeB, ok := b.([]interface{})
+		if !ok {
+			return append(diffs, responseDiff{path, a, b})
+		}
+
+		for i := 0; i < len(nodeA) || i < len(nodeB); i++ {
+			elemPath := path + "." + strconv.Itoa(i)
+			if i >= len(nodeA) {
+				diffs = append(diffs, responseDiff{elemPath, nil, nodeB[i]})
+			} else if i >= len(nodeB) {
+				diffs = append(diffs, responseDiff{elemPath, nodeA[i], nil})
+			} else {
+				diffs = diffJSON(elemPath, nodeA[i], nodeB[i], diffs)
+			}
+		}
+
+		return diffs
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		diffs = append(diffs, responseDiff{path, a, b})
+	}
+
+	return diffs
+}
+
+var jsonArrayIndex = regexp.MustCompile(`\.\d+(\.|$)`)
+
+// record counts mismatch by paths, and appends it to the report
+func (c *httpResponseComparator) record(m responseMismatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, diff := range m.Diffs {
+		// Applied twice, as adjacent indexes share the separating dot
+		path := jsonArrayIndex.ReplaceAllString(diff.Path, ".*$1")
+		path = jsonArrayIndex.ReplaceAllString(path, ".*$1")
+		c.paths[path]++
+	}
+
+	if c.report == nil {
+		Debug(c.name, "Responses differ for request", m.ID, m.Diffs)
+		return
+	}
+
+	line, err := json.Marshal(m)
+	if err != nil {
+		log.Println(c.name, "Can't encode mismatch:", err)
+		return
+	}
+
+	if _, err := c.report.Write(append(line, '\n')); err != nil {
+		log.Println(c.name, "Can't write report:", err)
+	}
+}
+
+// mismatchPaths returns number of mismatches by path of differing value, with array indexes replaced by "*"
+func (c *httpResponseComparator) mismatchPaths() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths := make(map[string]uint64, len(c.paths))
+	for path, count := range c.paths {
+		paths[path] = count
+	}
+
+	return paths
+}
+
+// close closes the report
+func (c *httpResponseComparator) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.report == nil {
+		return nil
+	}
+
+	err := c.report.Close()
+	c.report = nil
+
+	return err
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestHTTPResponseComparator(t *testing.T) {
+	c, _ := newHTTPResponseComparator("", "", nil, []string{"items.*.id"})
+
+	tests := []struct {
+		expected, actual string
+		diffs            int
+	}{
+		{"HTTP/1.1 200 OK\r\nDate: a\r\n\r\nok", "HTTP/1.1 200 OK\r\nDate: b\r\n\r\nok", 0},
+		{"HTTP/1.1 200 OK\r\n\r\nok", "HTTP/1.1 500 Internal Server Error\r\n\r\nok", 1},
+		{"HTTP/1.1 200 OK\r\n\r\nrequest 123e4567-e89b-12d3-a456-426614174000", "HTTP/1.1 200 OK\r\n\r\nrequest 9b2e6d1c-0a41-4c3f-8b7e-1f2a3b4c5d6e", 0},
+		{"HTTP/1.1 200 OK\r\n\r\nat Mon, 02 Jan 2006 15:04:05 GMT", "HTTP/1.1 200 OK\r\n\r\nat Tue, 03 Jan 2006 10:00:00 GMT", 0},
+		{"HTTP/1.1 200 OK\r\n\r\nfoo", "HTTP/1.1 200 OK\r\n\r\nbar", 1},
+		{`HTTP/1.1 200 OK` + "\r\n\r\n" + `{"items": [{"id": 1, "a": 1.0}]}`, `HTTP/1.1 200 OK` + "\r\n\r\n" + `{"items": [{"id": 2, "a": 1.0}]}`, 0},
+		{`HTTP/1.1 200 OK` + "\r\n\r\n" + `{"a": 1, "b": null}`, `HTTP/1.1 200 OK` + "\r\n\r\n" + `{"a": "1"}`, 2},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", 0},
+	}
+
+	for i, tc := range tests {
+		if diffs := c.compare([]byte(tc.expected), []byte(tc.actual)); len(diffs) != tc.diffs {
+			t.Errorf("%d: expected %d differences, got %+v", i, tc.diffs, diffs)
+		}
+	}
+}
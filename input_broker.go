@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// brokerMessage is payload consumed from message broker. It is acknowledged once read by emitter, so payloads
+// which didn't get to outputs are delivered again after restart.
+type brokerMessage struct {
+	data []byte
+	ack  func() error
+}
+
+// readBrokerMessage copies payload of the next message to data, and acknowledges the message
+func readBrokerMessage(messages chan brokerMessage, data []byte, name string) int {
+	msg := <-messages
+	n := copy(data, msg.data)
+
+	if err := msg.ack(); err != nil {
+		log.Println(name, "Can't acknowledge message:", err)
+	}
+
+	return n
+}
+
+// Longest time acknowledgement of read message waits for other ones to be sent in the same batch
+var brokerAckInterval = time.Second
+
+// brokerAckBatcher collects ids of read messages, and acknowledges them in batches, for brokers acknowledging
+// messages with API requests
+type brokerAckBatcher struct {
+	name string
+	size int
+	ack  func(ids []string) error
+	ids  chan string
+}
+
+func newBrokerAckBatcher(name string, size int, ack func(ids []string) error) *brokerAckBatcher {
+	b := &brokerAckBatcher{name: name, size: size, ack: ack, ids: make(chan string, 1000)}
+
+	go b.run()
+
+	return b
+}
+
+// add queues message id for acknowledgement
+func (b *brokerAckBatcher) add(id string) error {
+	b.ids <- id
+	return nil
+}
+
+func (b *brokerAckBatcher) run() {
+	for id := range b.ids {
+		batch := []string{id}
+		timeout := time.After(brokerAckInterval)
+		expired := false
+
+		for len(batch) < b.size && !expired {
+			select {
+			case id := <-b.ids:
+				batch = append(batch, id)
+			case <-timeout:
+				expired = true
+			}
+		}
+
+		if err := b.ack(batch); err != nil {
+			log.Println(b.name, "Can't acknowledge messages:", err)
+		}
+	}
+}
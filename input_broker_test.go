@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadBrokerMessage(t *testing.T) {
+	messages := make(chan brokerMessage, 2)
+	acked := 0
+	ack := func() error {
+		acked++
+		return nil
+	}
+
+	messages <- brokerMessage{data: []byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"), ack: ack}
+	messages <- brokerMessage{data: []byte("1 2 1\nGET / HTTP/1.1\r\n\r\n"), ack: func() error { return errors.New("Connection closed") }}
+
+	buf := make([]byte, 1000)
+
+	n := readBrokerMessage(messages, buf, "[TEST]")
+	if string(buf[:n]) != "1 1 1\nGET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("Should read payload: %q", buf[:n])
+	}
+	if acked != 1 {
+		t.Error("Should acknowledge read message")
+	}
+
+	// Failed acknowledgement doesn't lose payload, broker delivers it again
+	n = readBrokerMessage(messages, buf, "[TEST]")
+	if string(buf[:n]) != "1 2 1\nGET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("Should read payload: %q", buf[:n])
+	}
+}
@@ -3,26 +3,69 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
-	"errors"
+	"container/heap"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/buger/gor/proto"
 )
 
-// FileInput can read requests generated by FileOutput
+// FileInput can read requests generated by FileOutput.
+//
+// Path can be a pattern, like "/recordings/*.gor". Payloads of all matching files are merged by recorded time,
+// so recordings made on different hosts are replayed interleaved, as they were captured. Only one payload per
+// file is kept in memory, so files are expected to be ordered by time, as written by FileOutput. Files matching
+// the pattern which appear during the replay are read once all other files end.
+//
+// HAR files, with ".har" extension, are converted to requests and responses of their entries, see newHARReader.
+//
+// Files can be streamed from cloud storage, with paths like "s3://bucket/recordings/*.gor", or
+// "s3://bucket/recordings/" to read all objects with the prefix. See remoteStorages for supported storages.
 type FileInput struct {
-	data          chan []byte
-	path          string
-	currentFile   *os.File
-	currentReader *bufio.Reader
-	speedFactor   float64
-	loop          bool
+	data chan []byte
+	path string
+	loop bool
+
+	// Storage of remote files, and pattern of object names
+	storage       remoteStorage
+	remotePattern string
+
+	// Header set to the number of loop iteration in HTTP requests, starting from 1
+	loopHeader []byte
+	iteration  int64
+
+	// Replay speed relative to recorded one, set with "|200%" limiter option.
+	// Set before first Read, which starts emitting.
+	speedFactor float64
+	emitOnce    sync.Once
+
+	// Recorded time of the first payload, and when it was emitted. Used only by emit goroutine.
+	firstTime   int64
+	replayStart time.Time
+
+	mu sync.Mutex
+	// Open files, ordered by time of their next payload
+	readers fileInputReaders
+	// Files read since start of the loop iteration
+	opened map[string]bool
+	// Number of files opened, to keep order of files with payloads recorded at the same time
+	openedCount int
+	closed      bool
+
+	// Replay position, saved to checkpoint file if it is set. Files are opened at positions of loaded
+	// checkpoint during the first loop iteration.
+	checkpointPath    string
+	checkpointMu      sync.Mutex
+	checkpoint        fileInputCheckpoint
+	checkpointChanged bool
+	resume            map[string]int64
+	quit              chan struct{}
 }
 
 // NewFileInput constructor for FileInput. Accepts file path as argument.
@@ -32,77 +75,249 @@ func NewFileInput(path string, loop bool) (i *FileInput) {
 	i.path = path
 	i.speedFactor = 1
 	i.loop = loop
-
-	if err := i.updateFile(); err != nil {
+	i.loopHeader = []byte(Settings.inputFileLoopHeader)
+	i.iteration = 1
+	i.opened = make(map[string]bool)
+
+	if scheme, bucket, pattern := parseRemotePath(path); scheme != "" {
+		var err error
+		if i.storage, err = remoteStorages[scheme](bucket); err != nil {
+			log.Println("Can't read files", i.path, err)
+			return
+		}
+		i.remotePattern = pattern
+	} else if _, err := filepath.Glob(i.path); err != nil {
+		log.Println("Wrong file pattern", i.path, err)
 		return
 	}
 
-	go i.emit()
+	if Settings.inputFileCheckpoint != "" {
+		i.checkpointPath = Settings.inputFileCheckpoint
+		i.quit = make(chan struct{})
+		i.loadCheckpoint()
+
+		go i.saveCheckpoints()
+	}
+
+	if !i.openFiles() {
+		log.Println("No files match pattern: ", i.path)
+	}
 
 	return
 }
 
-type NextFileNotFound struct{}
+// fileInputReader reads payloads of one file
+type fileInputReader struct {
+	name         string
+	file         io.ReadCloser
+	decompressed io.ReadCloser
+	reader       *bufio.Reader
+	index        int
+
+	// Next payload of the file, and its time. Responses are recorded with latency instead of time,
+	// so they get time of the preceding request.
+	payload []byte
+	ts      int64
+
+	// Offset of read data, and offset after the next payload, in decompressed data
+	offset     int64
+	payloadEnd int64
+}
+
+// newFileInputReader opens reader of the file, skipping given number of bytes of decompressed data
+func newFileInputReader(name string, file io.ReadCloser, index int, offset int64) (*fileInputReader, error) {
+	r := &fileInputReader{name: name, file: file, index: index}
 
-func (_ *NextFileNotFound) Error() string {
-	return "There is no new files"
+	decompressed, err := newDecompressedReader(name, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.decompressed = decompressed
+
+	var reader io.Reader = decompressed
+	if isHARFile(name) {
+		if reader, err = newHARReader(decompressed); err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	r.reader = bufio.NewReader(reader)
+
+	if offset > 0 {
+		skipped, err := r.reader.Discard(int(offset))
+		r.offset = int64(skipped)
+		if err != nil && err != io.EOF {
+			r.close()
+			return nil, err
+		}
+	}
+
+	return r, nil
 }
 
-// path can be a pattern
-// It sort paths lexicographically and tries to choose next one
-func (i *FileInput) updateFile() (err error) {
-	var matches []string
+func (r *fileInputReader) close() {
+	r.decompressed.Close()
+	r.file.Close()
+}
 
-	if matches, err = filepath.Glob(i.path); err != nil {
-		log.Println("Wrong file pattern", i.path, err)
-		return
+// next reads next payload of the file, returning false at the end of the file
+func (r *fileInputReader) next() bool {
+	payloadSeparatorAsBytes := []byte(payloadSeparator)
+
+	var buffer bytes.Buffer
+
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		r.offset += int64(len(line))
+
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Can't read file ", r.name, err)
+			}
+
+			r.payload = nil
+			return false
+		}
+
+		if !bytes.Equal(payloadSeparatorAsBytes[1:], line) {
+			buffer.Write(line)
+			continue
+		}
+
+		if buffer.Len() < 2 {
+			buffer.Reset()
+			continue
+		}
+
+		// Separator starts with new line
+		r.payload = buffer.Bytes()[:buffer.Len()-1]
+		r.payloadEnd = r.offset
+
+		meta := payloadMeta(r.payload)
+		if len(meta) > 2 && (r.payload[0] == RequestPayload || r.payload[0] == WebSocketPayload || r.payload[0] == TCPChunkPayload) {
+			r.ts, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+		}
+
+		return true
 	}
+}
 
-	if len(matches) == 0 {
-		log.Println("No files match pattern: ", i.path)
-		return errors.New("No matching files")
+type fileInputReaders []*fileInputReader
+
+func (h fileInputReaders) Len() int      { return len(h) }
+func (h fileInputReaders) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h fileInputReaders) Less(i, j int) bool {
+	if h[i].ts == h[j].ts {
+		return h[i].index < h[j].index
 	}
 
-	sort.Sort(sortByFileIndex(matches))
+	return h[i].ts < h[j].ts
+}
 
-	// Just pick first file, if there is many, and we are just started
-	if i.currentFile == nil {
-		if i.currentFile, err = os.Open(matches[0]); err != nil {
-			log.Println("Can't read file ", matches[0], err)
-			return
+func (h *fileInputReaders) Push(x interface{}) {
+	*h = append(*h, x.(*fileInputReader))
+}
+
+func (h *fileInputReaders) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return r
+}
+
+// openFiles opens files matching the path, which were not read yet in this loop iteration.
+// Returns false if there are no such files.
+func (i *FileInput) openFiles() bool {
+	var matches []string
+	objects := make(map[string]remoteObject)
+
+	if i.storage != nil {
+		list, err := listRemoteObjects(i.storage, i.remotePattern)
+		if err != nil {
+			log.Println("Can't list files", i.path, err)
+		}
+
+		for _, o := range list {
+			matches = append(matches, o.Name)
+			objects[o.Name] = o
 		}
 	} else {
-		found := false
-		for idx, p := range matches {
-			if p == i.currentFile.Name() && idx != len(matches)-1 {
-				if i.currentFile, err = os.Open(matches[idx+1]); err != nil {
-					log.Println("Can't read file ", matches[idx+1], err)
-					return
-				}
-
-				found = true
-			}
+		matches, _ = filepath.Glob(i.path)
+	}
+
+	sort.Sort(sortByFileIndex(matches))
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	found := false
+
+	for _, path := range matches {
+		if i.opened[path] {
+			continue
 		}
+		i.opened[path] = true
+		found = true
+
+		var file io.ReadCloser
+		var err error
 
-		if !found {
-			return new(NextFileNotFound)
+		if i.storage != nil {
+			file = newRemoteReader(i.storage, objects[path])
+		} else {
+			file, err = os.Open(path)
 		}
-	}
 
-	if strings.HasSuffix(i.currentFile.Name(), ".gz") {
-		gzReader, err := gzip.NewReader(i.currentFile)
+		var r *fileInputReader
+		if err == nil {
+			r, err = newFileInputReader(path, file, i.openedCount, i.resume[path])
+		}
 		if err != nil {
-			log.Fatal(err)
+			log.Println("Can't read file ", path, err)
+			continue
+		}
+		i.openedCount++
+
+		if r.next() {
+			heap.Push(&i.readers, r)
+		} else {
+			r.close()
 		}
-		i.currentReader = bufio.NewReader(gzReader)
+	}
+
+	return found
+}
+
+// nextPayload returns payload recorded earliest among open files, its time, and file position after it.
+// Returns nil if all open files ended.
+func (i *FileInput) nextPayload() (payload []byte, ts int64, name string, end int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.readers) == 0 || i.closed {
+		return nil, 0, "", 0
+	}
+
+	r := i.readers[0]
+	payload, ts, name, end = r.payload, r.ts, r.name, r.payloadEnd
+
+	if r.next() {
+		heap.Fix(&i.readers, 0)
 	} else {
-		i.currentReader = bufio.NewReader(i.currentFile)
+		r.close()
+		heap.Pop(&i.readers)
 	}
 
-	return nil
+	return
 }
 
 func (i *FileInput) Read(data []byte) (int, error) {
+	i.emitOnce.Do(func() {
+		go i.emit()
+	})
+
 	buf := <-i.data
 	copy(data, buf)
 
@@ -113,82 +328,117 @@ func (i *FileInput) String() string {
 	return "File input: " + i.path
 }
 
-func (i *FileInput) emit() {
-	var lastTime int64
-
-	payloadSeparatorAsBytes := []byte(payloadSeparator)
-
-	var buffer bytes.Buffer
-
-	if i.currentReader == nil {
+// wait sleeps until payload recorded at given time should be emitted. Emit time is computed from the first
+// payload of the replay, rather than from the previous one, so time spent on reading and sending payloads
+// does not slow the replay down.
+func (i *FileInput) wait(ts int64) {
+	if i.replayStart.IsZero() {
+		i.firstTime = ts
+		i.replayStart = time.Now()
 		return
 	}
 
+	offset := time.Duration(float64(ts-i.firstTime) / i.speedFactor)
+	time.Sleep(i.replayStart.Add(offset).Sub(time.Now()))
+}
+
+func (i *FileInput) emit() {
 	for {
-		line, err := i.currentReader.ReadBytes('\n')
+		payload, ts, name, end := i.nextPayload()
 
-		if err != nil {
-			if err != io.EOF {
-				log.Fatal(err)
+		if payload == nil {
+			if i.isClosed() {
+				return
 			}
 
-			// If our path pattern match multiple files, try to find them
-			if err == io.EOF {
-				if e := i.updateFile(); e != nil {
-					if _, ok := e.(*NextFileNotFound); ok && i.loop {
-						// Start from the first file
-						i.Close()
-						i.currentFile = nil
-						i.currentReader = nil
-						lastTime = 0
-						i.updateFile()
-
-						continue
-					} else {
-						break
-					}
-				}
-
+			// Files matching the pattern could be created since the last check
+			if i.openFiles() {
 				continue
 			}
-		}
 
-		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
-			asBytes := buffer.Bytes()
-			buffer.Reset()
+			if !i.loop {
+				break
+			}
 
-			meta := payloadMeta(asBytes)
+			// Start from the first file
+			i.mu.Lock()
+			i.opened = make(map[string]bool)
+			i.resume = nil
+			i.mu.Unlock()
 
-			if len(meta) > 2 && meta[0][0] == RequestPayload {
-				ts, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+			i.replayStart = time.Time{}
+			i.iteration++
+			i.resetCheckpoint()
 
-				if lastTime != 0 {
-					timeDiff := ts - lastTime
+			if !i.openFiles() {
+				break
+			}
 
-					if i.speedFactor != 1 {
-						timeDiff = int64(float64(timeDiff) / i.speedFactor)
-					}
+			continue
+		}
 
-					time.Sleep(time.Duration(timeDiff))
-				}
+		if payload[0] == RequestPayload || payload[0] == WebSocketPayload || payload[0] == TCPChunkPayload {
+			i.wait(ts)
+		}
 
-				lastTime = ts
-			}
+		if len(i.loopHeader) > 0 && payload[0] == RequestPayload {
+			payload = i.setLoopHeader(payload)
+		}
 
-			// Bytes() returns only pointer, so to remove data-race copy the data to an array
-			newBuf := make([]byte, len(asBytes)-1)
-			copy(newBuf, asBytes)
+		i.data <- payload
 
-			i.data <- newBuf
-		} else {
-			buffer.Write(line)
+		if i.checkpointPath != "" {
+			i.updateCheckpoint(name, end, ts)
 		}
+	}
 
+	if i.checkpointPath != "" {
+		i.saveCheckpoint()
 	}
 
 	log.Printf("FileInput: end of file '%s'\n", i.path)
 }
 
-func (i *FileInput) Close() {
-	i.currentFile.Close()
+// setLoopHeader sets loop header of HTTP request payload, so requests of different loop iterations can be
+// distinguished by the server
+func (i *FileInput) setLoopHeader(payload []byte) []byte {
+	body := payloadBody(payload)
+	if !proto.IsHTTPPayload(body) {
+		return payload
+	}
+
+	header := payload[:len(payload)-len(body)]
+	body = proto.SetHeader(body, i.loopHeader, strconv.AppendInt(nil, i.iteration, 10))
+
+	return append(append([]byte{}, header...), body...)
+}
+
+func (i *FileInput) isClosed() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.closed
+}
+
+// Close closes files, and saves checkpoint
+func (i *FileInput) Close() error {
+	i.mu.Lock()
+	if i.closed {
+		i.mu.Unlock()
+		return nil
+	}
+	i.closed = true
+
+	for _, r := range i.readers {
+		r.close()
+	}
+	i.readers = nil
+	i.mu.Unlock()
+
+	if i.checkpointPath != "" {
+		close(i.quit)
+		i.saveCheckpoint()
+	}
+
+	return nil
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileInputCheckpoint is replay position of FileInput, saved periodically so replay can resume after restart
+// instead of sending already replayed payloads again
+type fileInputCheckpoint struct {
+	// Offsets of files after the last emitted payload, in decompressed data
+	Files map[string]int64 `json:"files"`
+	// Recorded time of the last emitted payload
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Interval of saving checkpoints
+var fileInputCheckpointInterval = time.Second
+
+// Checkpoint file holds checkpoints of all file inputs, keyed by input path, so inputs read and update it
+// under the lock
+var fileInputCheckpointMu sync.Mutex
+
+func readFileInputCheckpoints(path string) (map[string]fileInputCheckpoint, error) {
+	checkpoints := make(map[string]fileInputCheckpoint)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return nil, err
+	}
+
+	return checkpoints, nil
+}
+
+// loadCheckpoint loads checkpoint of the input, so files are opened at saved positions
+func (i *FileInput) loadCheckpoint() {
+	fileInputCheckpointMu.Lock()
+	checkpoints, err := readFileInputCheckpoints(i.checkpointPath)
+	fileInputCheckpointMu.Unlock()
+
+	if err != nil {
+		log.Println("Can't read checkpoint", i.checkpointPath, err)
+	}
+
+	checkpoint, ok := checkpoints[i.path]
+	if !ok || len(checkpoint.Files) == 0 {
+		i.checkpoint.Files = make(map[string]int64)
+		return
+	}
+
+	i.checkpoint = checkpoint
+	i.resume = make(map[string]int64)
+	for name, offset := range checkpoint.Files {
+		i.resume[name] = offset
+	}
+
+	log.Printf("FileInput: resuming '%s' after payload recorded at %s\n", i.path, time.Unix(0, checkpoint.Timestamp))
+}
+
+// updateCheckpoint records position after emitted payload
+func (i *FileInput) updateCheckpoint(name string, offset int64, ts int64) {
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+
+	i.checkpoint.Files[name] = offset
+	if ts != 0 {
+		i.checkpoint.Timestamp = ts
+	}
+	i.checkpointChanged = true
+}
+
+// resetCheckpoint starts new loop iteration from the beginning of files
+func (i *FileInput) resetCheckpoint() {
+	if i.checkpointPath == "" {
+		return
+	}
+
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+
+	i.checkpoint = fileInputCheckpoint{Files: make(map[string]int64)}
+	i.checkpointChanged = true
+}
+
+// saveCheckpoints saves changed checkpoint periodically, until input is closed
+func (i *FileInput) saveCheckpoints() {
+	ticker := time.NewTicker(fileInputCheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			i.saveCheckpoint()
+		case <-i.quit:
+			return
+		}
+	}
+}
+
+// saveCheckpoint writes checkpoint if it changed. File is replaced atomically, so it is valid even if process
+// crashes while writing it.
+func (i *FileInput) saveCheckpoint() {
+	i.checkpointMu.Lock()
+	if !i.checkpointChanged {
+		i.checkpointMu.Unlock()
+		return
+	}
+	checkpoint := fileInputCheckpoint{Files: make(map[string]int64), Timestamp: i.checkpoint.Timestamp}
+	for name, offset := range i.checkpoint.Files {
+		checkpoint.Files[name] = offset
+	}
+	i.checkpointChanged = false
+	i.checkpointMu.Unlock()
+
+	fileInputCheckpointMu.Lock()
+	defer fileInputCheckpointMu.Unlock()
+
+	checkpoints, err := readFileInputCheckpoints(i.checkpointPath)
+	if err != nil {
+		checkpoints = make(map[string]fileInputCheckpoint)
+	}
+	checkpoints[i.path] = checkpoint
+
+	data, _ := json.Marshal(checkpoints)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(i.checkpointPath), filepath.Base(i.checkpointPath)+".tmp")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), i.checkpointPath)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+
+	if err != nil {
+		log.Println("Can't save checkpoint", i.checkpointPath, err)
+	}
+}
@@ -9,10 +9,13 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/buger/gor/proto"
 )
 
 var _ = log.Println
@@ -132,6 +135,45 @@ func TestInputFileMultipleFiles(t *testing.T) {
 	os.Remove(file2.Name())
 }
 
+func TestInputFileMerge(t *testing.T) {
+	rnd := rand.Int63()
+
+	// Recordings of two hosts, and file appearing during the replay
+	file1, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_host1.gor", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file1.Write([]byte("1 1 1\ntest1"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Write([]byte("2 1 5\ntest2"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Write([]byte("1 3 4\ntest4"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Close()
+	defer os.Remove(file1.Name())
+
+	file2, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_host2.gor", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file2.Write([]byte("1 2 2\ntest3"))
+	file2.Write([]byte(payloadSeparator))
+	file2.Write([]byte("1 4 5\ntest5"))
+	file2.Write([]byte(payloadSeparator))
+	file2.Close()
+	defer os.Remove(file2.Name())
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d_*.gor", rnd), false)
+
+	file3, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_host3.gor", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file3.Write([]byte("1 5 3\ntest6"))
+	file3.Write([]byte(payloadSeparator))
+	file3.Close()
+	defer os.Remove(file3.Name())
+
+	buf := make([]byte, 1000)
+	for _, expected := range []string{"test1", "test2", "test3", "test4", "test5", "test6"} {
+		n, _ := input.Read(buf)
+		if string(payloadBody(buf[:n])) != expected {
+			t.Errorf("Should emit %s: %q", expected, buf[:n])
+		}
+	}
+}
+
 func TestInputFileLoop(t *testing.T) {
 	rnd := rand.Int63()
 
@@ -154,6 +196,60 @@ func TestInputFileLoop(t *testing.T) {
 	os.Remove(file.Name())
 }
 
+func TestInputFileLoopHeader(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 1\nGET / HTTP/1.1\r\nHost: w3.org\r\n\r\n"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("2 1 1\nHTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	Settings.inputFileLoopHeader = "X-Iteration"
+	defer func() { Settings.inputFileLoopHeader = "" }()
+
+	input := NewFileInput(file.Name(), true)
+	buf := make([]byte, 1000)
+
+	for _, iteration := range []string{"1", "2", "3"} {
+		n, _ := input.Read(buf)
+		if value := proto.Header(payloadBody(buf[:n]), []byte("X-Iteration")); string(value) != iteration {
+			t.Errorf("Should set iteration %s: %q", iteration, buf[:n])
+		}
+
+		n, _ = input.Read(buf)
+		if proto.Header(payloadBody(buf[:n]), []byte("X-Iteration")) != nil {
+			t.Errorf("Should not modify response: %q", buf[:n])
+		}
+	}
+}
+
+func TestInputFileSpeed(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for i, ts := range []time.Duration{0, 200 * time.Millisecond, 400 * time.Millisecond} {
+		file.Write([]byte(fmt.Sprintf("1 %d %d\ntest%d", i, ts.Nanoseconds(), i)))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	input := NewLimiter(NewFileInput(file.Name(), false), "400%")
+	buf := make([]byte, 1000)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		input.Read(buf)
+	}
+
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Error("Should replay 4 times faster:", elapsed)
+	}
+}
+
 func TestInputFileCompressed(t *testing.T) {
 	rnd := rand.Int63()
 
@@ -181,6 +277,32 @@ func TestInputFileCompressed(t *testing.T) {
 	os.Remove(name2)
 }
 
+func TestInputFileZstd(t *testing.T) {
+	rnd := rand.Int63()
+
+	output := NewFileOutput(fmt.Sprintf("/tmp/%d.gor.zst", rnd), &FileOutputConfig{flushInterval: time.Minute, append: true})
+	for i := 0; i < 1000; i++ {
+		output.Write([]byte(fmt.Sprintf("1 %d 1\ntest%d", i, i)))
+	}
+	output.flush()
+
+	// Flushed data can be read while file is written
+	if data, _ := ioutil.ReadFile(output.file.Name()); len(data) == 0 || len(data) > 5000 {
+		t.Error("Should write compressed data:", len(data))
+	}
+	output.Close()
+	defer os.Remove(output.file.Name())
+
+	input := NewFileInput(output.file.Name(), false)
+	buf := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		n, _ := input.Read(buf)
+		if string(payloadBody(buf[:n])) != fmt.Sprintf("test%d", i) {
+			t.Fatalf("Should read payload %d: %q", i, buf[:n])
+		}
+	}
+}
+
 type CaptureFile struct {
 	data [][]byte
 	file *os.File
@@ -308,3 +430,45 @@ func Duplicate(data []byte) (duplicate []byte) {
 
 	return
 }
+
+func TestInputFileCheckpoint(t *testing.T) {
+	rnd := rand.Int63()
+
+	output := NewFileOutput(fmt.Sprintf("/tmp/%d.gor.gz", rnd), &FileOutputConfig{flushInterval: time.Minute, append: true})
+	for i := 0; i < 10; i++ {
+		output.Write([]byte(fmt.Sprintf("1 %d %d\ntest%d", i, i, i)))
+	}
+	output.Close()
+	defer os.Remove(output.file.Name())
+
+	checkpoint := fmt.Sprintf("/tmp/%d.checkpoint", rnd)
+	defer os.Remove(checkpoint)
+
+	Settings.inputFileCheckpoint = checkpoint
+	defer func() { Settings.inputFileCheckpoint = "" }()
+
+	buf := make([]byte, 1000)
+
+	input := NewFileInput(output.file.Name(), false)
+	for i := 0; i < 4; i++ {
+		input.Read(buf)
+	}
+	// Position is recorded once payload is passed to Read
+	time.Sleep(50 * time.Millisecond)
+	input.Close()
+
+	input = NewFileInput(output.file.Name(), false)
+	for i := 4; i < 10; i++ {
+		n, _ := input.Read(buf)
+		if string(payloadBody(buf[:n])) != fmt.Sprintf("test%d", i) {
+			t.Fatalf("Should resume from payload %d: %q", i, buf[:n])
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	input.Close()
+
+	data, _ := ioutil.ReadFile(checkpoint)
+	if !strings.Contains(string(data), `"timestamp":9`) {
+		t.Errorf("Should save time of the last payload: %s", data)
+	}
+}
@@ -1,25 +1,54 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strings"
 	"time"
 )
 
+// HTTPInputConfig struct for holding HTTP input configuration
+type HTTPInputConfig struct {
+	// URL of backend to proxy requests to. If empty, requests are answered with 200 OK.
+	Proxy string
+	// Emit responses of proxied requests
+	TrackResponse bool
+}
+
 // HTTPInput used for sending requests to Gor via http
+//
+// It can also run as reverse proxy in front of the application, forwarding requests to it and capturing them,
+// where raw sockets are not available:
+//
+//	gor --input-http :80 --input-http-proxy http://localhost:8080 --output-http staging.com
 type HTTPInput struct {
 	data     chan []byte
 	address  string
+	config   *HTTPInputConfig
 	listener net.Listener
+	proxy    *httputil.ReverseProxy
 }
 
 // NewHTTPInput constructor for HTTPInput. Accepts address with port which he will listen on.
-func NewHTTPInput(address string) (i *HTTPInput) {
+func NewHTTPInput(address string, config *HTTPInputConfig) (i *HTTPInput) {
 	i = new(HTTPInput)
 	i.data = make(chan []byte, 10000)
 	i.address = address
+	i.config = config
+
+	if config.Proxy != "" {
+		target, err := url.Parse(config.Proxy)
+		if err != nil || target.Host == "" {
+			log.Fatal("Wrong HTTP input proxy URL: ", config.Proxy)
+		}
+
+		i.proxy = httputil.NewSingleHostReverseProxy(target)
+		i.proxy.ModifyResponse = i.captureResponse
+	}
 
 	i.listen(address)
 
@@ -28,27 +57,83 @@ func NewHTTPInput(address string) (i *HTTPInput) {
 
 func (i *HTTPInput) Read(data []byte) (int, error) {
 	buf := <-i.data
+	copy(data, buf)
 
-	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano())
-
-	copy(data[0:len(header)], header)
-	copy(data[len(header):], buf)
+	return len(buf), nil
+}
 
-	return len(buf) + len(header), nil
+// emit passes payload to Read, dropping it if outputs don't keep up
+func (i *HTTPInput) emit(header, buf []byte) {
+	select {
+	case i.data <- append(header, buf...):
+	default:
+		Debug("[INPUT-HTTP] Dropping requests because output can't process them fast enough")
+	}
 }
 
 func (i *HTTPInput) handler(w http.ResponseWriter, r *http.Request) {
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano())
+
 	r.URL.Scheme = "http"
 	r.URL.Host = i.listener.Addr().String()
 
 	buf, _ := httputil.DumpRequestOut(r, true)
 	http.Error(w, http.StatusText(200), 200)
 
-	select {
-	case i.data <- buf:
-	default:
-		Debug("[INPUT-HTTP] Dropping requests because output can't process them fast enough")
+	i.emit(header, buf)
+}
+
+type httpInputRequestKey struct{}
+
+// httpInputRequest is proxied request, identifying its response
+type httpInputRequest struct {
+	id    []byte
+	start time.Time
+}
+
+// proxyHandler forwards request to backend, emitting its copy
+func (i *HTTPInput) proxyHandler(w http.ResponseWriter, r *http.Request) {
+	req := &httpInputRequest{id: uuid(), start: time.Now()}
+
+	// Dump restores the body for proxy
+	buf, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
+
+	i.emit(payloadHeader(RequestPayload, req.id, req.start.UnixNano()), buf)
+
+	i.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpInputRequestKey{}, req)))
+}
+
+// captureResponse emits copy of backend response
+func (i *HTTPInput) captureResponse(resp *http.Response) error {
+	if !i.config.TrackResponse {
+		return nil
+	}
+
+	req, ok := resp.Request.Context().Value(httpInputRequestKey{}).(*httpInputRequest)
+	if !ok {
+		return nil
+	}
+
+	// Event streams don't end, and should reach the client as they come
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return nil
+	}
+
+	latency := time.Now().Sub(req.start)
+
+	// Dump restores the body for client
+	buf, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return err
+	}
+
+	i.emit(payloadHeader(ResponsePayload, req.id, latency.Nanoseconds()), buf)
+
+	return nil
 }
 
 func (i *HTTPInput) listen(address string) {
@@ -56,7 +141,11 @@ func (i *HTTPInput) listen(address string) {
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/", i.handler)
+	if i.proxy != nil {
+		mux.HandleFunc("/", i.proxyHandler)
+	} else {
+		mux.HandleFunc("/", i.handler)
+	}
 
 	i.listener, err = net.Listen("tcp", address)
 	if err != nil {
@@ -72,5 +161,9 @@ func (i *HTTPInput) listen(address string) {
 }
 
 func (i *HTTPInput) String() string {
+	if i.proxy != nil {
+		return "HTTP input: " + i.address + ", proxy to " + i.config.Proxy
+	}
+
 	return "HTTP input: " + i.address
 }
@@ -3,8 +3,10 @@ package main
 import (
 	"github.com/buger/gor/proto"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os/exec"
 	"strings"
 	"sync"
@@ -15,7 +17,7 @@ func TestHTTPInput(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
 
-	input := NewHTTPInput("127.0.0.1:0")
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		wg.Done()
 	})
@@ -47,7 +49,7 @@ func TestInputHTTPLargePayload(t *testing.T) {
 		log.Fatal("dd error:", err)
 	}
 
-	input := NewHTTPInput("127.0.0.1:0")
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		if len(proto.Body(payloadBody(data))) != 4000000 {
 			t.Error("Should receive full file")
@@ -70,3 +72,42 @@ func TestInputHTTPLargePayload(t *testing.T) {
 	wg.Wait()
 	close(quit)
 }
+
+func TestHTTPInputProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("echo "), body...))
+	}))
+	defer backend.Close()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{Proxy: backend.URL, TrackResponse: true})
+
+	resp, err := http.Post("http://"+input.listener.Addr().String()+"/test", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "echo hello" {
+		t.Errorf("Should proxy request to backend: %q", body)
+	}
+
+	buf := make([]byte, 1000)
+
+	n, _ := input.Read(buf)
+	req := append([]byte{}, buf[:n]...)
+	if req[0] != RequestPayload || string(proto.Path(payloadBody(req))) != "/test" || string(proto.Body(payloadBody(req))) != "hello" {
+		t.Errorf("Should emit request: %q", req)
+	}
+
+	n, _ = input.Read(buf)
+	res := buf[:n]
+	if res[0] != ResponsePayload || string(proto.Body(payloadBody(res))) != "echo hello" {
+		t.Errorf("Should emit response: %q", res)
+	}
+
+	if string(payloadMeta(req)[1]) != string(payloadMeta(res)[1]) {
+		t.Error("Response should have id of request")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/IBM/sarama"
+)
+
+// KafkaInput plugin consumes gor payloads from Kafka topic, published by KafkaOutput. Capture agents can publish
+// traffic to Kafka, and replayers consume it at their own pace:
+//
+//	gor --input-kafka kafka1:9092,kafka2:9092 --input-kafka-topic traffic --output-http staging.com
+//
+// Topic is consumed by consumer group, so partitions are balanced between replayers of the same group. Offsets
+// of payloads passed to outputs are committed, and restarted replayer continues where it stopped.
+type KafkaInput struct {
+	brokers string
+	config  *KafkaConfig
+
+	group    sarama.ConsumerGroup
+	messages chan brokerMessage
+	cancel   context.CancelFunc
+}
+
+// NewKafkaInput constructor for KafkaInput, accepts comma-separated list of brokers
+func NewKafkaInput(brokers string, config *KafkaConfig) io.Reader {
+	i := new(KafkaInput)
+	i.brokers = brokers
+	i.config = config
+	i.messages = make(chan brokerMessage)
+
+	if i.config.Group == "" {
+		i.config.Group = "gor"
+	}
+
+	saramaConfig, err := config.saramaConfig()
+	if err != nil {
+		log.Fatal("Wrong Kafka input configuration: ", err)
+	}
+	saramaConfig.Consumer.Return.Errors = true
+
+	if i.group, err = sarama.NewConsumerGroup(kafkaBrokers(brokers), i.config.Group, saramaConfig); err != nil {
+		log.Fatal("Can't connect to Kafka: ", err)
+	}
+
+	var ctx context.Context
+	ctx, i.cancel = context.WithCancel(context.Background())
+
+	go i.consume(ctx)
+
+	go func() {
+		for err := range i.group.Errors() {
+			log.Println("[INPUT-KAFKA] Consumer error:", err)
+		}
+	}()
+
+	return i
+}
+
+// consume joins consumer group, and joins it again after rebalance
+func (i *KafkaInput) consume(ctx context.Context) {
+	for {
+		if err := i.group.Consume(ctx, []string{i.config.Topic}, i); err != nil {
+			log.Println("[INPUT-KAFKA] Consumer group error:", err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Setup is run at the beginning of consumer group session
+func (i *KafkaInput) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is run at the end of consumer group session
+func (i *KafkaInput) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim passes messages of partition to Read, which marks them to commit
+func (i *KafkaInput) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+
+			mark := func() error {
+				session.MarkMessage(msg, "")
+				return nil
+			}
+
+			select {
+			case i.messages <- brokerMessage{data: msg.Value, ack: mark}:
+			case <-session.Context().Done():
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (i *KafkaInput) Read(data []byte) (int, error) {
+	return readBrokerMessage(i.messages, data, "[INPUT-KAFKA]"), nil
+}
+
+func (i *KafkaInput) String() string {
+	return "Kafka input: " + i.brokers + "/" + i.config.Topic
+}
+
+// Close leaves consumer group, committing offsets of read payloads
+func (i *KafkaInput) Close() error {
+	i.cancel()
+
+	return i.group.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+type testKafkaSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	marked chan int64
+}
+
+func (s *testKafkaSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testKafkaSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked <- msg.Offset
+}
+
+type testKafkaClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *testKafkaClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func TestKafkaInputConsumeClaim(t *testing.T) {
+	input := &KafkaInput{config: &KafkaConfig{Topic: "traffic"}, messages: make(chan brokerMessage)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &testKafkaSession{ctx: ctx, marked: make(chan int64, 10)}
+	claim := &testKafkaClaim{messages: make(chan *sarama.ConsumerMessage, 10)}
+
+	claim.messages <- &sarama.ConsumerMessage{Offset: 1, Value: []byte("1 1 1\nGET / HTTP/1.1\r\n\r\n")}
+	claim.messages <- &sarama.ConsumerMessage{Offset: 2, Value: []byte("2 1 1\nHTTP/1.1 200 OK\r\n\r\n")}
+
+	done := make(chan error)
+	go func() {
+		done <- input.ConsumeClaim(session, claim)
+	}()
+
+	buf := make([]byte, 1000)
+
+	n, _ := input.Read(buf)
+	if string(buf[:n]) != "1 1 1\nGET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("Should read payload: %q", buf[:n])
+	}
+	if offset := <-session.marked; offset != 1 {
+		t.Error("Should mark read message:", offset)
+	}
+
+	if len(session.marked) != 0 {
+		t.Error("Should not mark message before it is read")
+	}
+
+	input.Read(buf)
+	if offset := <-session.marked; offset != 2 {
+		t.Error("Should mark read message:", offset)
+	}
+
+	// Rebalance ends the session
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSInput plugin consumes gor payloads from NATS JetStream stream, published by NATSOutput:
+//
+//	gor --input-nats nats://nats:4222 --input-nats-subject traffic --output-http staging.com
+//
+// Payloads are consumed with durable consumer, and acknowledged once read, so restarted replayer continues where
+// it stopped. Replayers using the same durable consumer share payloads.
+type NATSInput struct {
+	url    string
+	config *NATSConfig
+
+	conn     *nats.Conn
+	iterator jetstream.MessagesContext
+	messages chan brokerMessage
+}
+
+// Payloads are acknowledged once they pass to outputs, so they should get there before acknowledgement timeout
+const natsAckWait = 5 * time.Minute
+
+// NewNATSInput constructor for NATSInput, accepts URL of NATS servers
+func NewNATSInput(url string, config *NATSConfig) io.Reader {
+	i := new(NATSInput)
+	i.url = url
+	i.config = config
+	i.messages = make(chan brokerMessage)
+
+	var err error
+	if i.conn, err = config.connect(url); err != nil {
+		log.Fatal("Can't connect to NATS: ", err)
+	}
+
+	js, err := jetstream.New(i.conn)
+	if err != nil {
+		log.Fatal("Can't use NATS JetStream: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stream := config.Stream
+	if stream == "" {
+		if stream, err = js.StreamNameBySubject(ctx, config.Subject); err != nil {
+			log.Fatal("Can't find NATS stream of subject ", config.Subject, ": ", err)
+		}
+	}
+
+	consumer, err := js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:       config.Durable,
+		FilterSubject: config.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       natsAckWait,
+	})
+	if err != nil {
+		log.Fatal("Can't create NATS consumer: ", err)
+	}
+
+	if i.iterator, err = consumer.Messages(jetstream.PullMaxMessages(100)); err != nil {
+		log.Fatal("Can't consume NATS stream: ", err)
+	}
+
+	go i.consume()
+
+	return i
+}
+
+func (i *NATSInput) consume() {
+	for {
+		msg, err := i.iterator.Next()
+		if err == jetstream.ErrMsgIteratorClosed {
+			return
+		}
+		if err != nil {
+			log.Println("[INPUT-NATS] Consumer error:", err)
+			continue
+		}
+
+		i.messages <- brokerMessage{data: msg.Data(), ack: msg.Ack}
+	}
+}
+
+func (i *NATSInput) Read(data []byte) (int, error) {
+	return readBrokerMessage(i.messages, data, "[INPUT-NATS]"), nil
+}
+
+func (i *NATSInput) String() string {
+	return "NATS input: " + i.url + "/" + i.config.Subject
+}
+
+func (i *NATSInput) Close() error {
+	i.iterator.Stop()
+	i.conn.Close()
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scope of access tokens, allowing to pull messages
+const pubSubScope = "https://www.googleapis.com/auth/pubsub"
+
+// PubSubInput plugin consumes gor payloads from Google Cloud Pub/Sub subscription, for example published by
+// serverless capture shims:
+//
+//	gor --input-pubsub projects/my-project/subscriptions/traffic --output-http staging.com
+//
+// Message data is payload in gor format. Messages are acknowledged once read, and are delivered again after
+// acknowledgement deadline if replayer stops before reading them.
+//
+// Requests are authorized like requests to Google Cloud Storage, see gcpCredentials. Emulator is set with
+// PUBSUB_EMULATOR_HOST.
+type PubSubInput struct {
+	subscription string
+	endpoint     string
+	client       *http.Client
+	credentials  *gcpCredentials
+
+	messages chan brokerMessage
+	acks     *brokerAckBatcher
+}
+
+const (
+	// Messages are pulled in small batches, so they are read before acknowledgement deadline
+	pubSubPullSize = 10
+	pubSubAckSize  = 100
+)
+
+// NewPubSubInput constructor for PubSubInput, accepts subscription name in
+// "projects/<project>/subscriptions/<subscription>" format
+func NewPubSubInput(subscription string) io.Reader {
+	i := new(PubSubInput)
+	i.subscription = subscription
+	i.endpoint = "https://pubsub.googleapis.com"
+	i.client = &http.Client{Timeout: time.Minute}
+	i.messages = make(chan brokerMessage)
+
+	if !strings.HasPrefix(subscription, "projects/") || !strings.Contains(subscription, "/subscriptions/") {
+		log.Fatal("Pub/Sub subscription should be in projects/<project>/subscriptions/<subscription> format: ", subscription)
+	}
+
+	emulator := os.Getenv("PUBSUB_EMULATOR_HOST")
+	if emulator != "" {
+		i.endpoint = strings.TrimSuffix(emulator, "/")
+		if !strings.Contains(i.endpoint, "://") {
+			i.endpoint = "http://" + i.endpoint
+		}
+	}
+
+	var err error
+	if i.credentials, err = newGCPCredentials(pubSubScope, emulator != ""); err != nil {
+		log.Fatal("Can't read Google Cloud credentials: ", err)
+	}
+
+	i.acks = newBrokerAckBatcher("[INPUT-PUBSUB]", pubSubAckSize, i.acknowledge)
+
+	go i.pull()
+
+	return i
+}
+
+// call makes request to method of the subscription
+func (i *PubSubInput) call(method string, request, response interface{}) error {
+	body, _ := json.Marshal(request)
+
+	req, err := http.NewRequest("POST", i.endpoint+"/v1/"+i.subscription+":"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	token, err := i.credentials.accessToken()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRemoteResponse(resp); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+type pubSubPullResult struct {
+	ReceivedMessages []struct {
+		AckID   string `json:"ackId"`
+		Message struct {
+			// Decoded from base64 by JSON decoder
+			Data []byte `json:"data"`
+		} `json:"message"`
+	} `json:"receivedMessages"`
+}
+
+// pull pulls messages of the subscription, and passes them to Read
+func (i *PubSubInput) pull() {
+	for {
+		var result pubSubPullResult
+		if err := i.call("pull", map[string]int{"maxMessages": pubSubPullSize}, &result); err != nil {
+			log.Println("[INPUT-PUBSUB] Can't pull messages:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, m := range result.ReceivedMessages {
+			ackID := m.AckID
+			i.messages <- brokerMessage{data: m.Message.Data, ack: func() error { return i.acks.add(ackID) }}
+		}
+	}
+}
+
+// acknowledge acknowledges read messages
+func (i *PubSubInput) acknowledge(ackIDs []string) error {
+	var result struct{}
+	return i.call("acknowledge", map[string][]string{"ackIds": ackIDs}, &result)
+}
+
+func (i *PubSubInput) Read(data []byte) (int, error) {
+	return readBrokerMessage(i.messages, data, "[INPUT-PUBSUB]"), nil
+}
+
+func (i *PubSubInput) String() string {
+	return "Pub/Sub input: " + i.subscription
+}
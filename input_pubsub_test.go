@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPubSubInput(t *testing.T) {
+	brokerAckInterval = 10 * time.Millisecond
+	defer func() { brokerAckInterval = time.Second }()
+
+	acked := make(chan []string, 10)
+	pulled := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/test/subscriptions/traffic:pull":
+			if pulled {
+				time.Sleep(100 * time.Millisecond)
+				fmt.Fprint(w, `{}`)
+				return
+			}
+			pulled = true
+
+			// Data is base64 encoded "1 1 1\nGET / HTTP/1.1\r\n\r\n"
+			fmt.Fprint(w, `{"receivedMessages": [{"ackId": "a1", "message": {"data": "MSAxIDEKR0VUIC8gSFRUUC8xLjENCg0K"}}]}`)
+		case "/v1/projects/test/subscriptions/traffic:acknowledge":
+			var request struct {
+				AckIDs []string `json:"ackIds"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			acked <- request.AckIDs
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("PUBSUB_EMULATOR_HOST", server.URL)
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	input := NewPubSubInput("projects/test/subscriptions/traffic")
+	buf := make([]byte, 1000)
+
+	n, _ := input.Read(buf)
+	if string(buf[:n]) != "1 1 1\nGET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("Should read payload: %q", buf[:n])
+	}
+
+	select {
+	case ids := <-acked:
+		if len(ids) != 1 || ids[0] != "a1" {
+			t.Error("Wrong acknowledged messages:", ids)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should acknowledge read message")
+	}
+}
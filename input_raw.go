@@ -5,6 +5,7 @@ import (
 	raw "github.com/buger/gor/raw_socket_listener"
 	"log"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -17,6 +18,8 @@ type RAWInput struct {
 	engine        int
 	realIPHeader  []byte
 	trackResponse bool
+	trailersMeta  bool
+	config        *raw.ListenerConfig
 	listener      *raw.Listener
 }
 
@@ -24,10 +27,14 @@ type RAWInput struct {
 const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
+	EngineAFPacket
+	EngineUnixProxy
+	EngineUprobe
+	EnginePcapFile
 )
 
 // NewRAWInput constructor for RAWInput. Accepts address with port as argument.
-func NewRAWInput(address string, engine int, trackResponse bool, expire time.Duration, realIPHeader string) (i *RAWInput) {
+func NewRAWInput(address string, engine int, trackResponse bool, expire time.Duration, realIPHeader string, config *raw.ListenerConfig) (i *RAWInput) {
 	i = new(RAWInput)
 	i.data = make(chan *raw.TCPMessage)
 	i.address = address
@@ -36,10 +43,16 @@ func NewRAWInput(address string, engine int, trackResponse bool, expire time.Dur
 	i.realIPHeader = []byte(realIPHeader)
 	i.quit = make(chan bool)
 	i.trackResponse = trackResponse
+	i.trailersMeta = Settings.inputRAWTrailersMeta
+	i.config = config
 
 	i.listen(address)
 	i.listener.IsReady()
 
+	if Settings.stats {
+		go i.reportStats()
+	}
+
 	return
 }
 
@@ -49,13 +62,88 @@ func (i *RAWInput) Read(data []byte) (int, error) {
 
 	var header []byte
 
-	if msg.IsIncoming {
-		header = payloadHeader(RequestPayload, msg.UUID(), msg.Start.UnixNano())
-		if len(i.realIPHeader) > 0 {
+	// Prefer capture timestamps, so outputs see original timing of the traffic
+	start := msg.Start
+	if !msg.CaptureStart.IsZero() {
+		start = msg.CaptureStart
+	}
+
+	if msg.Chunk != nil {
+		header = payloadHeader(TCPChunkPayload, msg.UUID(), start.UnixNano())
+		header = appendTCPChunkMeta(header, msg.Chunk, msg.IsIncoming)
+	} else if msg.WebSocket != nil {
+		header = payloadHeader(WebSocketPayload, msg.UUID(), start.UnixNano())
+		header = appendWebSocketMeta(header, msg.WebSocket, msg.IsIncoming)
+	} else if msg.IsIncoming {
+		header = payloadHeader(RequestPayload, msg.UUID(), start.UnixNano())
+		if len(i.realIPHeader) > 0 && proto.IsHTTPPayload(buf) {
 			buf = proto.SetHeader(buf, i.realIPHeader, []byte(msg.IP().String()))
 		}
 	} else {
-		header = payloadHeader(ResponsePayload, msg.UUID(), msg.End.UnixNano()-msg.AssocMessage.Start.UnixNano())
+		latency := msg.End.Sub(msg.AssocMessage.Start)
+		if req := msg.AssocMessage; !msg.CaptureEnd.IsZero() && !req.CaptureStart.IsZero() {
+			latency = msg.CaptureEnd.Sub(req.CaptureStart)
+		}
+
+		header = payloadHeader(ResponsePayload, msg.UUID(), latency.Nanoseconds())
+	}
+
+	if msg.Truncated {
+		header = markTruncated(header)
+	}
+
+	if msg.GRPC != nil {
+		header = appendGRPCMeta(header, msg.GRPC)
+	}
+
+	if msg.MySQL != nil {
+		header = appendMySQLMeta(header, msg.MySQL, msg.IsIncoming)
+	}
+
+	if msg.Postgres != nil {
+		header = appendPostgresMeta(header, msg.Postgres, msg.IsIncoming)
+	}
+
+	if msg.Redis != nil {
+		header = appendRedisMeta(header, msg.Redis, msg.IsIncoming)
+	}
+
+	if msg.Memcached != nil {
+		header = appendMemcachedMeta(header, msg.Memcached, msg.IsIncoming)
+	}
+
+	if msg.Mongo != nil {
+		header = appendMongoMeta(header, msg.Mongo, msg.IsIncoming)
+	}
+
+	if msg.Kafka != nil {
+		header = appendKafkaMeta(header, msg.Kafka)
+	}
+
+	if msg.Thrift != nil {
+		header = appendThriftMeta(header, msg.Thrift)
+	}
+
+	// Responses get operation of their request, to allow stats per operation
+	request := buf
+	if !msg.IsIncoming && msg.AssocMessage != nil {
+		request = msg.AssocMessage.Bytes()
+	}
+	if msg.Chunk == nil && msg.WebSocket == nil {
+		if op, ok := parseGraphQLRequest(request); ok {
+			header = appendGraphQLMeta(header, op)
+		}
+	}
+
+	if i.trailersMeta {
+		if trailers := msg.Trailers(); trailers != nil {
+			header = appendPayloadMeta(header, payloadTrailersKey, encodeTrailers(trailers))
+		}
+	}
+
+	header = appendPayloadMeta(header, payloadSrcKey, []byte(msg.Src().String()))
+	if dst := msg.Dst(); !dst.IP.IsUnspecified() {
+		header = appendPayloadMeta(header, payloadDstKey, []byte(dst.String()))
 	}
 
 	copy(data[0:len(header)], header)
@@ -67,30 +155,99 @@ func (i *RAWInput) Read(data []byte) (int, error) {
 func (i *RAWInput) listen(address string) {
 	Debug("Listening for traffic on: " + address)
 
-	host, port, err := net.SplitHostPort(address)
+	var host, port string
+	var err error
 
-	if err != nil {
+	if i.engine == EngineUnixProxy {
+		// Address of unix socket proxy is "proxy.sock:upstream.sock", and all synthetic connections share same port
+		host, port = address, "0"
+	} else if i.engine == EnginePcapFile {
+		// Address is "capture.pcap:port", path of the file can contain colons
+		sep := strings.LastIndex(address, ":")
+		if sep == -1 {
+			log.Fatal("input-pcap-file: port should be set after file path: ", address)
+		}
+		host, port = address[:sep], address[sep+1:]
+	} else if host, port, err = net.SplitHostPort(address); err != nil {
 		log.Fatal("input-raw: error while parsing address", err)
 	}
 
-	i.listener = raw.NewListener(host, port, i.engine, i.trackResponse, i.expire)
+	i.listener, err = raw.NewListener(host, port, i.engine, i.trackResponse, i.expire, i.config)
+
+	if err != nil {
+		log.Fatal("input-raw: can't start traffic capture: ", err)
+	}
+
+	if batches := i.listener.ReceiverBatches(); batches != nil {
+		go i.receiveBatches(batches)
+		return
+	}
 
 	ch := i.listener.Receiver()
 
 	go func() {
 		for {
+			// Receiving TCPMessage object, channel closed when listener stops
+			m, ok := <-ch
+			if !ok {
+				return
+			}
+
+			select {
+			case i.data <- m:
+			case <-i.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (i *RAWInput) receiveBatches(batches chan []*raw.TCPMessage) {
+	// Channel closed when listener stops
+	for batch := range batches {
+		for _, m := range batch {
 			select {
+			case i.data <- m:
 			case <-i.quit:
 				return
-			default:
 			}
+		}
+	}
+}
+
+// Stats returns capture statistics of underlying listener
+func (i *RAWInput) Stats() raw.ListenerStats {
+	return i.listener.Stats()
+}
+
+// SetFilter changes BPF filter of running capture, see --input-raw-bpf-filter
+func (i *RAWInput) SetFilter(expr string) error {
+	return i.listener.SetFilter(expr)
+}
+
+// Pause temporarily stops capture, keeping listener state, see Resume
+func (i *RAWInput) Pause() error {
+	return i.listener.Pause()
+}
+
+// Resume restores capture stopped by Pause
+func (i *RAWInput) Resume() error {
+	return i.listener.Resume()
+}
 
-			// Receiving TCPMessage object
-			m := <-ch
+func (i *RAWInput) reportStats() {
+	log.Println("input_raw:received,dropped,if_dropped,dispatched,expired,in_flight,evicted,packets_queue_dropped,messages_queue_dropped,capture_interrupted,capture_resumed")
 
-			i.data <- m
+	for {
+		select {
+		case <-i.quit:
+			return
+		case <-time.After(rate * time.Second):
 		}
-	}()
+
+		s := i.Stats()
+		log.Printf("input_raw:%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d", s.PacketsReceived, s.PacketsDropped, s.PacketsIfDropped, s.MessagesDispatched, s.MessagesExpired, s.MessagesInFlight, s.MessagesEvicted, s.PacketsBufferDropped, s.MessagesBufferDropped, s.CaptureInterrupted, s.CaptureResumed)
+	}
 }
 
 func (i *RAWInput) String() string {
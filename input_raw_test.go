@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"github.com/buger/gor/proto"
+	raw "github.com/buger/gor/raw_socket_listener"
 	"io"
 	"io/ioutil"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
 	"strconv"
@@ -43,7 +45,7 @@ func TestRAWInputIPv4(t *testing.T) {
 
 	var respCounter, reqCounter int64
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "X-Real-IP")
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "X-Real-IP", &raw.ListenerConfig{})
 	defer input.Close()
 
 	output := NewTestOutput(func(data []byte) {
@@ -102,7 +104,7 @@ func TestRAWInputIPv6(t *testing.T) {
 
 	var respCounter, reqCounter int64
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "")
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", &raw.ListenerConfig{})
 	defer input.Close()
 
 	output := NewTestOutput(func(data []byte) {
@@ -153,7 +155,7 @@ func TestInputRAW100Expect(t *testing.T) {
 
 	originAddr := strings.Replace(origin.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
 
-	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "")
+	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "", &raw.ListenerConfig{})
 	defer input.Close()
 
 	// We will use it to get content of raw HTTP request
@@ -216,7 +218,7 @@ func TestInputRAWChunkedEncoding(t *testing.T) {
 	}))
 
 	originAddr := strings.Replace(origin.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
-	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "")
+	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "", &raw.ListenerConfig{})
 	defer input.Close()
 
 	replay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -252,6 +254,131 @@ func TestInputRAWChunkedEncoding(t *testing.T) {
 	close(quit)
 }
 
+func TestInputRAWTrailersMeta(t *testing.T) {
+	header := payloadHeader(ResponsePayload, uuid(), 1)
+	header = appendPayloadMeta(header, payloadTrailersKey, encodeTrailers([]byte("Grpc-Status: 0\r\nGrpc-Message: not found\r\nInvalid\r\n")))
+	payload := append(header, "HTTP/1.1 200 OK\r\n\r\n"...)
+
+	trailers, err := url.ParseQuery(string(payloadMetaValue(payload, payloadTrailersKey)))
+	if err != nil || len(trailers) != 2 || trailers.Get("Grpc-Status") != "0" || trailers.Get("Grpc-Message") != "not found" {
+		t.Error("Should encode trailers into payload header", trailers, err)
+	}
+}
+
+func TestInputRAWMySQLMeta(t *testing.T) {
+	command := &raw.MySQLCommand{Command: raw.MySQLComStmtExecute, StatementID: 7, Database: "shop", Rows: 2}
+
+	request := appendMySQLMeta(payloadHeader(RequestPayload, uuid(), 1), command, true)
+	if string(payloadMetaValue(request, payloadMySQLCommandKey)) != "stmt_execute" || string(payloadMetaValue(request, payloadMySQLStatementKey)) != "7" ||
+		string(payloadMetaValue(request, payloadMySQLDatabaseKey)) != "shop" || payloadMetaValue(request, payloadMySQLRowsKey) != nil {
+		t.Errorf("Should describe command: %q", request)
+	}
+
+	response := appendMySQLMeta(payloadHeader(ResponsePayload, uuid(), 1), command, false)
+	if string(payloadMetaValue(response, payloadMySQLRowsKey)) != "2" || payloadMetaValue(response, payloadMySQLErrorKey) != nil {
+		t.Errorf("Should describe result: %q", response)
+	}
+
+	command.ErrorCode = 1064
+	response = appendMySQLMeta(payloadHeader(ResponsePayload, uuid(), 1), command, false)
+	if string(payloadMetaValue(response, payloadMySQLErrorKey)) != "1064" {
+		t.Errorf("Should describe failed command: %q", response)
+	}
+}
+
+func TestInputRAWPostgresMeta(t *testing.T) {
+	query := &raw.PostgresQuery{Kind: raw.PostgresSimpleQuery, User: "bob", Database: "shop", Tag: "SELECT 2", Rows: 2}
+
+	request := appendPostgresMeta(payloadHeader(RequestPayload, uuid(), 1), query, true)
+	if string(payloadMetaValue(request, payloadPgKindKey)) != "query" || string(payloadMetaValue(request, payloadPgUserKey)) != "bob" ||
+		string(payloadMetaValue(request, payloadPgDatabaseKey)) != "shop" || payloadMetaValue(request, payloadPgTagKey) != nil {
+		t.Errorf("Should describe request: %q", request)
+	}
+
+	response := appendPostgresMeta(payloadHeader(ResponsePayload, uuid(), 1), query, false)
+	if string(payloadMetaValue(response, payloadPgTagKey)) != "SELECT+2" || string(payloadMetaValue(response, payloadPgRowsKey)) != "2" || payloadMetaValue(response, payloadPgErrorKey) != nil {
+		t.Errorf("Should describe response: %q", response)
+	}
+}
+
+func TestInputRAWRedisMeta(t *testing.T) {
+	command := &raw.RedisCommand{ConnID: []byte("abc"), Name: "EVAL", ReplyType: '-', Error: "NOSCRIPT No matching script"}
+
+	request := appendRedisMeta(payloadHeader(RequestPayload, uuid(), 1), command, true)
+	if string(payloadMetaValue(request, payloadRedisConnKey)) != "abc" || string(payloadMetaValue(request, payloadRedisCommandKey)) != "EVAL" ||
+		payloadMetaValue(request, payloadRedisReplyKey) != nil {
+		t.Errorf("Should describe command: %q", request)
+	}
+
+	response := appendRedisMeta(payloadHeader(ResponsePayload, uuid(), 1), command, false)
+	if string(payloadMetaValue(response, payloadRedisReplyKey)) != "-" || string(payloadMetaValue(response, payloadRedisErrorKey)) != "NOSCRIPT" {
+		t.Errorf("Should describe reply: %q", response)
+	}
+}
+
+func TestInputRAWMemcachedMeta(t *testing.T) {
+	command := &raw.MemcachedCommand{Command: "get", Key: []byte("a b"), Keys: 2, Status: "END", Hits: 1}
+
+	request := appendMemcachedMeta(payloadHeader(RequestPayload, uuid(), 1), command, true)
+	if string(payloadMetaValue(request, payloadMcCommandKey)) != "get" || string(payloadMetaValue(request, payloadMcKeyKey)) != "a+b" ||
+		string(payloadMetaValue(request, payloadMcKeysKey)) != "2" || payloadMetaValue(request, payloadMcStatusKey) != nil {
+		t.Errorf("Should describe command: %q", request)
+	}
+
+	response := appendMemcachedMeta(payloadHeader(ResponsePayload, uuid(), 1), command, false)
+	if string(payloadMetaValue(response, payloadMcStatusKey)) != "END" || string(payloadMetaValue(response, payloadMcHitsKey)) != "1" {
+		t.Errorf("Should describe reply: %q", response)
+	}
+}
+
+func TestInputRAWMongoMeta(t *testing.T) {
+	command := &raw.MongoCommand{Op: "msg", Command: "insert", Database: "shop", Collection: "users", Redacted: 1, ErrorCode: 11000}
+
+	request := appendMongoMeta(payloadHeader(RequestPayload, uuid(), 1), command, true)
+	if string(payloadMetaValue(request, payloadMongoCommandKey)) != "insert" || string(payloadMetaValue(request, payloadMongoCollectionKey)) != "users" ||
+		string(payloadMetaValue(request, payloadMongoRedactedKey)) != "1" || payloadMetaValue(request, payloadMongoOKKey) != nil {
+		t.Errorf("Should describe request: %q", request)
+	}
+
+	response := appendMongoMeta(payloadHeader(ResponsePayload, uuid(), 1), command, false)
+	if string(payloadMetaValue(response, payloadMongoOKKey)) != "0" || string(payloadMetaValue(response, payloadMongoErrorKey)) != "11000" {
+		t.Errorf("Should describe response: %q", response)
+	}
+}
+
+func TestInputRAWKafkaMeta(t *testing.T) {
+	request := &raw.KafkaRequest{APIKey: raw.KafkaProduce, APIVersion: 9, ClientID: "app 1", Topics: []string{"orders", "a,b"}, Acks: -1}
+
+	header := appendKafkaMeta(payloadHeader(RequestPayload, uuid(), 1), request)
+	if string(payloadMetaValue(header, payloadKafkaAPIKey)) != "Produce" || string(payloadMetaValue(header, payloadKafkaVersionKey)) != "9" ||
+		string(payloadMetaValue(header, payloadKafkaClientKey)) != "app+1" || string(payloadMetaValue(header, payloadKafkaTopicsKey)) != "orders,a%2Cb" ||
+		string(payloadMetaValue(header, payloadKafkaAcksKey)) != "-1" {
+		t.Errorf("Should describe request: %q", header)
+	}
+}
+
+func TestInputRAWThriftMeta(t *testing.T) {
+	header := appendThriftMeta(payloadHeader(ResponsePayload, uuid(), 1), &raw.ThriftMessage{Method: "Users:get", Type: raw.ThriftException})
+
+	if string(payloadMetaValue(header, payloadThriftMethodKey)) != "Users%3Aget" || string(payloadMetaValue(header, payloadThriftTypeKey)) != "exception" {
+		t.Errorf("Should describe reply: %q", header)
+	}
+}
+
+func TestInputRAWGraphQLMeta(t *testing.T) {
+	header := appendGraphQLMeta(payloadHeader(RequestPayload, uuid(), 1), graphQLOperation{Name: "Me", Type: GraphQLQuery})
+
+	if string(payloadMetaValue(header, payloadGraphQLOperationKey)) != "Me" || string(payloadMetaValue(header, payloadGraphQLTypeKey)) != "query" {
+		t.Errorf("Should describe operation: %q", header)
+	}
+
+	header = appendGraphQLMeta(payloadHeader(RequestPayload, uuid(), 1), graphQLOperation{Type: GraphQLMutation})
+
+	if payloadMetaValue(header, payloadGraphQLOperationKey) != nil || string(payloadMetaValue(header, payloadGraphQLTypeKey)) != "mutation" {
+		t.Errorf("Should omit name of anonymous operation: %q", header)
+	}
+}
+
 func TestInputRAWLargePayload(t *testing.T) {
 	// FIXME: Large payloads does not work for travis for some reason...
 	if os.Getenv("TRAVIS_BUILD_DIR") != "" {
@@ -280,7 +407,7 @@ func TestInputRAWLargePayload(t *testing.T) {
 	}))
 	originAddr := strings.Replace(origin.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "")
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", &raw.ListenerConfig{})
 	defer input.Close()
 
 	replay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -325,7 +452,7 @@ func BenchmarkRAWInput(b *testing.B) {
 
 	var respCounter, reqCounter int64
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "")
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", &raw.ListenerConfig{})
 	defer input.Close()
 
 	output := NewTestOutput(func(data []byte) {
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQSInput plugin consumes gor payloads from AWS SQS queue, for example sent by serverless capture shims:
+//
+//	gor --input-sqs https://sqs.us-east-1.amazonaws.com/123456789012/traffic --output-http staging.com
+//
+// Message body is payload in gor format. Binary payloads should be base64 encoded, with "encoding" message
+// attribute set to "base64". Messages are deleted from the queue once read, and are received again after
+// visibility timeout if replayer stops before reading them.
+//
+// Credentials and region are taken from standard AWS environment variables, see s3Storage. Region is detected
+// from queue URL by default.
+type SQSInput struct {
+	queueURL string
+	endpoint string
+	client   *http.Client
+
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	messages chan brokerMessage
+	acks     *brokerAckBatcher
+}
+
+// SQS deletes up to 10 messages per request
+const sqsBatchSize = 10
+
+// NewSQSInput constructor for SQSInput, accepts URL of the queue
+func NewSQSInput(queueURL string) io.Reader {
+	i := new(SQSInput)
+	i.queueURL = queueURL
+	i.client = &http.Client{Timeout: time.Minute}
+	i.messages = make(chan brokerMessage)
+
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		log.Fatal("Wrong SQS queue URL: ", queueURL)
+	}
+	i.endpoint = u.Scheme + "://" + u.Host + "/"
+
+	i.region = firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if host := strings.Split(u.Hostname(), "."); i.region == "" && len(host) > 2 && host[0] == "sqs" {
+		i.region = host[1]
+	}
+	if i.region == "" {
+		i.region = "us-east-1"
+	}
+
+	i.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	i.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	i.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+
+	i.acks = newBrokerAckBatcher("[INPUT-SQS]", sqsBatchSize, i.delete)
+
+	go i.receive()
+
+	return i
+}
+
+// call makes request to SQS API using JSON protocol
+func (i *SQSInput) call(action string, request, response interface{}) error {
+	body, _ := json.Marshal(request)
+
+	req, err := http.NewRequest("POST", i.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+
+	if i.accessKey != "" {
+		hash := sha256.Sum256(body)
+		signAWSRequest(req, "sqs", i.region, hex.EncodeToString(hash[:]), i.accessKey, i.secretKey, i.sessionToken, time.Now())
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRemoteResponse(resp); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+type sqsReceiveResult struct {
+	Messages []struct {
+		ReceiptHandle     string
+		Body              string
+		MessageAttributes map[string]struct {
+			StringValue string
+		}
+	}
+}
+
+// receive long polls the queue, and passes messages to Read
+func (i *SQSInput) receive() {
+	request := map[string]interface{}{
+		"QueueUrl":              i.queueURL,
+		"MaxNumberOfMessages":   sqsBatchSize,
+		"WaitTimeSeconds":       20,
+		"MessageAttributeNames": []string{"encoding"},
+	}
+
+	for {
+		var result sqsReceiveResult
+		if err := i.call("ReceiveMessage", request, &result); err != nil {
+			log.Println("[INPUT-SQS] Can't receive messages:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, m := range result.Messages {
+			data := []byte(m.Body)
+			if m.MessageAttributes["encoding"].StringValue == "base64" {
+				var err error
+				if data, err = base64.StdEncoding.DecodeString(m.Body); err != nil {
+					log.Println("[INPUT-SQS] Can't decode message:", err)
+					continue
+				}
+			}
+
+			handle := m.ReceiptHandle
+			i.messages <- brokerMessage{data: data, ack: func() error { return i.acks.add(handle) }}
+		}
+	}
+}
+
+type sqsDeleteResult struct {
+	Failed []struct {
+		Message string
+	}
+}
+
+// delete deletes read messages from the queue
+func (i *SQSInput) delete(handles []string) error {
+	entries := make([]map[string]string, len(handles))
+	for n, handle := range handles {
+		entries[n] = map[string]string{"Id": strconv.Itoa(n), "ReceiptHandle": handle}
+	}
+
+	var result sqsDeleteResult
+	if err := i.call("DeleteMessageBatch", map[string]interface{}{"QueueUrl": i.queueURL, "Entries": entries}, &result); err != nil {
+		return err
+	}
+
+	for _, f := range result.Failed {
+		log.Println("[INPUT-SQS] Can't delete message:", f.Message)
+	}
+
+	return nil
+}
+
+func (i *SQSInput) Read(data []byte) (int, error) {
+	return readBrokerMessage(i.messages, data, "[INPUT-SQS]"), nil
+}
+
+func (i *SQSInput) String() string {
+	return "SQS input: " + i.queueURL
+}
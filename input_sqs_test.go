@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQSInput(t *testing.T) {
+	brokerAckInterval = 10 * time.Millisecond
+	defer func() { brokerAckInterval = time.Second }()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	deleted := make(chan []string, 10)
+	received := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-west-2/sqs/aws4_request") {
+			w.WriteHeader(403)
+			return
+		}
+
+		var request struct {
+			QueueUrl string
+			Entries  []struct{ ReceiptHandle string }
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		if !strings.HasSuffix(request.QueueUrl, "/123/traffic") {
+			w.WriteHeader(400)
+			return
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSQS.ReceiveMessage":
+			if received {
+				time.Sleep(100 * time.Millisecond)
+				fmt.Fprint(w, `{}`)
+				return
+			}
+			received = true
+
+			fmt.Fprint(w, `{"Messages": [
+				{"ReceiptHandle": "h1", "Body": "1 1 1\nGET / HTTP/1.1\r\n\r\n"},
+				{"ReceiptHandle": "h2", "Body": "MSAyIDEKR0VUIC8gSFRUUC8xLjENCg0K", "MessageAttributes": {"encoding": {"DataType": "String", "StringValue": "base64"}}}
+			]}`)
+		case "AmazonSQS.DeleteMessageBatch":
+			var handles []string
+			for _, e := range request.Entries {
+				handles = append(handles, e.ReceiptHandle)
+			}
+			deleted <- handles
+			fmt.Fprint(w, `{"Successful": []}`)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_REGION", "us-west-2")
+	defer os.Unsetenv("AWS_REGION")
+
+	input := NewSQSInput(server.URL + "/123/traffic")
+	buf := make([]byte, 1000)
+
+	for _, expected := range []string{"1 1 1\nGET / HTTP/1.1\r\n\r\n", "1 2 1\nGET / HTTP/1.1\r\n\r\n"} {
+		n, _ := input.Read(buf)
+		if string(buf[:n]) != expected {
+			t.Errorf("Should read payload: %q", buf[:n])
+		}
+	}
+
+	var handles []string
+	for len(handles) < 2 {
+		select {
+		case batch := <-deleted:
+			handles = append(handles, batch...)
+		case <-time.After(time.Second):
+			t.Fatal("Should delete read messages:", handles)
+		}
+	}
+	if handles[0] != "h1" || handles[1] != "h2" {
+		t.Error("Wrong deleted messages:", handles)
+	}
+}
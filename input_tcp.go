@@ -3,25 +3,51 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 )
 
 // TCPInput used for internal communication
+//
+// Connections can be secured with TLS, and outputs can be required to know shared token:
+//
+//	gor --input-tcp :28020 --input-tcp-tls --input-tcp-tls-cert replay.pem --input-tcp-tls-key replay.key --input-tcp-tls-ca agents-ca.pem --input-tcp-token secret
+//
+// Connections of outputs with --output-tcp-ack are framed, and received payloads are acknowledged.
 type TCPInput struct {
 	data     chan []byte
 	address  string
+	config   *TCPConfig
 	listener net.Listener
+
+	// Sessions of framed connections, ones without connection for tcpSessionTimeout are removed
+	mu       sync.Mutex
+	sessions map[tcpSessionID]*tcpInputSession
+}
+
+// tcpInputSession holds state of session of output, kept across its reconnects
+type tcpInputSession struct {
+	// Sequence number of the last payload received
+	last uint64
+	// Number of open connections, and when the last one was closed
+	conns    int
+	closedAt time.Time
 }
 
 // NewTCPInput constructor for TCPInput, accepts address with port
-func NewTCPInput(address string) (i *TCPInput) {
+func NewTCPInput(address string, config *TCPConfig) (i *TCPInput) {
 	i = new(TCPInput)
 	i.data = make(chan []byte, 1000)
 	i.address = address
+	i.config = config
+	i.sessions = make(map[tcpSessionID]*tcpInputSession)
 
 	i.listen(address)
 
@@ -37,12 +63,26 @@ func (i *TCPInput) Read(data []byte) (int, error) {
 
 func (i *TCPInput) listen(address string) {
 	listener, err := net.Listen("tcp", address)
-	i.listener = listener
 
 	if err != nil {
 		log.Fatal("Can't start:", err)
 	}
 
+	if i.config.TLS {
+		if i.config.TLSCert == "" || i.config.TLSKey == "" {
+			log.Fatal("TLS of TCP input requires certificate and key")
+		}
+
+		tlsConfig, err := newTLSConfig(i.config.TLSCA, i.config.TLSCert, i.config.TLSKey, true)
+		if err != nil {
+			log.Fatal("Can't load TLS configuration: ", err)
+		}
+
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	i.listener = listener
+
 	go func() {
 		for {
 			conn, err := listener.Accept()
@@ -64,6 +104,18 @@ func (i *TCPInput) handleConnection(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	var buffer bytes.Buffer
 
+	if i.config.Token != "" {
+		if err := tcpAuthenticateClient(conn, reader, i.config.Token); err != nil {
+			log.Println("Can't authenticate TCP output", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	if magic, _ := reader.Peek(len(tcpFramedMagic)); string(magic) == tcpFramedMagic {
+		i.handleFramedConnection(conn, reader)
+		return
+	}
+
 	for {
 		line, err := reader.ReadBytes('\n')
 
@@ -89,6 +141,82 @@ func (i *TCPInput) handleConnection(conn net.Conn) {
 	}
 }
 
+// handleFramedConnection reads frames of output, skipping ones already received in its session, and
+// acknowledges them
+func (i *TCPInput) handleFramedConnection(conn net.Conn, reader *bufio.Reader) {
+	var id tcpSessionID
+	reader.Discard(len(tcpFramedMagic))
+	if _, err := io.ReadFull(reader, id[:]); err != nil {
+		return
+	}
+
+	session := i.openSession(id)
+	defer i.closeSession(session)
+
+	var ack [8]byte
+	unacked := 0
+
+	for {
+		f, err := readTCPFrame(reader)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, "Unexpected error in input tcp connection:", err)
+			}
+			return
+		}
+
+		i.mu.Lock()
+		last := session.last
+		received := f.seq <= last
+		if !received {
+			session.last, last = f.seq, f.seq
+		}
+		i.mu.Unlock()
+
+		if !received {
+			i.data <- f.data
+		}
+
+		if unacked++; unacked >= tcpAckEvery || reader.Buffered() == 0 {
+			binary.BigEndian.PutUint64(ack[:], last)
+			if _, err := conn.Write(ack[:]); err != nil {
+				return
+			}
+			unacked = 0
+		}
+	}
+}
+
+// openSession returns session of new connection, and removes sessions which have no connection for too long
+func (i *TCPInput) openSession(id tcpSessionID) *tcpInputSession {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for sid, s := range i.sessions {
+		if s.conns == 0 && now.Sub(s.closedAt) > tcpSessionTimeout {
+			delete(i.sessions, sid)
+		}
+	}
+
+	session, ok := i.sessions[id]
+	if !ok {
+		session = &tcpInputSession{}
+		i.sessions[id] = session
+	}
+	session.conns++
+
+	return session
+}
+
+// closeSession marks connection of session as closed, session is kept until output reconnects or it expires
+func (i *TCPInput) closeSession(session *tcpInputSession) {
+	i.mu.Lock()
+	session.conns--
+	session.closedAt = time.Now()
+	i.mu.Unlock()
+}
+
 func (i *TCPInput) String() string {
 	return "TCP input: " + i.address
 }
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestTCPInput(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
 
-	input := NewTCPInput("127.0.0.1:0")
+	input := NewTCPInput("127.0.0.1:0", &TCPConfig{})
 	output := NewTestOutput(func(data []byte) {
 		wg.Done()
 	})
@@ -46,3 +50,137 @@ func TestTCPInput(t *testing.T) {
 
 	close(quit)
 }
+
+func TestTCPInputFramed(t *testing.T) {
+	input := NewTCPInput("127.0.0.1:0", &TCPConfig{})
+	defer input.listener.Close()
+
+	id := newTCPSessionID()
+	send := func(from, to uint64) uint64 {
+		conn, err := net.Dial("tcp", input.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		writer := bufio.NewWriter(conn)
+		writer.WriteString(tcpFramedMagic)
+		writer.Write(id[:])
+		for seq := from; seq <= to; seq++ {
+			writeTCPFrame(writer, tcpFrame{seq: seq, data: []byte(strconv.FormatUint(seq, 10))})
+		}
+		writer.Flush()
+
+		// Wait for acknowledgement of the last frame
+		var ack [8]byte
+		for binary.BigEndian.Uint64(ack[:]) < to {
+			if _, err := io.ReadFull(conn, ack[:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return binary.BigEndian.Uint64(ack[:])
+	}
+
+	send(1, 3)
+	// Frames resent after reconnect are acknowledged, but received once
+	if ack := send(2, 5); ack != 5 {
+		t.Errorf("Wrong acknowledgement: %d", ack)
+	}
+
+	buf := make([]byte, 100)
+	for i := 1; i <= 5; i++ {
+		n, _ := input.Read(buf)
+		if string(buf[:n]) != strconv.Itoa(i) {
+			t.Errorf("Wrong payload %d: %q", i, buf[:n])
+		}
+	}
+	if len(input.data) != 0 {
+		t.Errorf("Resent payloads should be skipped: %d", len(input.data))
+	}
+
+	// Payloads of output with acknowledgements
+	output := NewTCPOutput(input.listener.Addr().String(), &TCPConfig{Ack: true})
+	for i := 0; i < 100; i++ {
+		output.Write([]byte("1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	received := make(map[string]bool)
+	for len(received) < 100 {
+		n, _ := input.Read(buf)
+		received[string(buf[:n])] = true
+	}
+}
+
+func TestTCPInputSessionExpire(t *testing.T) {
+	input := NewTCPInput("127.0.0.1:0", &TCPConfig{})
+	defer input.listener.Close()
+
+	connect := func(id tcpSessionID) net.Conn {
+		conn, err := net.Dial("tcp", input.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writer := bufio.NewWriter(conn)
+		writer.WriteString(tcpFramedMagic)
+		writer.Write(id[:])
+		writeTCPFrame(writer, tcpFrame{seq: 1, data: []byte("1")})
+		writer.Flush()
+
+		var ack [8]byte
+		if _, err := io.ReadFull(conn, ack[:]); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	closed := func() (n int) {
+		input.mu.Lock()
+		defer input.mu.Unlock()
+
+		for _, s := range input.sessions {
+			if s.conns == 0 {
+				n++
+			}
+		}
+		return
+	}
+
+	stopped, active := newTCPSessionID(), newTCPSessionID()
+	connect(stopped).Close()
+	conn := connect(active)
+	defer conn.Close()
+
+	for i := 0; i < 100 && closed() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if closed() != 1 {
+		t.Fatal("Connection of session should be closed")
+	}
+
+	// Session is kept while output may reconnect
+	connect(newTCPSessionID()).Close()
+
+	input.mu.Lock()
+	session, ok := input.sessions[stopped]
+	if !ok || session.last != 1 {
+		t.Error("Session should be kept until it expires")
+	}
+	for _, s := range input.sessions {
+		s.closedAt = time.Now().Add(-2 * tcpSessionTimeout)
+	}
+	input.mu.Unlock()
+
+	// Session without connection for too long is removed once other output connects, open session is kept
+	connect(newTCPSessionID()).Close()
+
+	input.mu.Lock()
+	defer input.mu.Unlock()
+
+	if _, ok := input.sessions[stopped]; ok {
+		t.Error("Session of stopped output should be removed")
+	}
+	if _, ok := input.sessions[active]; !ok {
+		t.Error("Session with open connection should be kept")
+	}
+}
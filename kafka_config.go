@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// KafkaConfig struct for holding configuration of Kafka input and output
+type KafkaConfig struct {
+	// Topic of gor payloads
+	Topic string
+	// Consumer group of input, its offsets are committed to brokers
+	Group string
+	// Offset of input to start from, when group has no committed offset: "oldest" or "newest"
+	Offset string
+
+	// Connect to brokers over TLS. Brokers are verified with CA certificate if set, and client authenticates
+	// with certificate and key if set.
+	TLS     bool
+	TLSCA   string
+	TLSCert string
+	TLSKey  string
+
+	// SASL mechanism: PLAIN, SCRAM-SHA-256, or SCRAM-SHA-512. Empty to not authenticate.
+	SASLMechanism string
+	SASLUser      string
+	SASLPassword  string
+
+	// Acknowledgement of produced payloads awaited from brokers: "leader" (default), "all" in-sync replicas, or
+	// "none". Compression of produced batches: "none" (default), "gzip", "snappy", "lz4", or "zstd".
+	Acks        string
+	Compression string
+
+	// Key partitioning produced payloads: request "id" (default), "path", "cookie:<name>", or "connection"
+	// of client. Payloads with the same key get to the same partition, and are consumed in order.
+	PartitionBy string
+}
+
+// kafkaBrokers splits comma-separated list of brokers
+func kafkaBrokers(address string) []string {
+	var brokers []string
+	for _, broker := range strings.Split(address, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+
+	return brokers
+}
+
+// saramaConfig returns configuration of Kafka client
+func (c *KafkaConfig) saramaConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "gor"
+
+	switch c.Offset {
+	case "", "newest":
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	case "oldest":
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		return nil, fmt.Errorf("Unknown Kafka offset %q, should be oldest or newest", c.Offset)
+	}
+
+	switch c.Acks {
+	case "", "leader":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("Unknown Kafka acks %q, should be leader, all, or none", c.Acks)
+	}
+
+	switch c.Compression {
+	case "", "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		// Supported by brokers since Kafka 2.1
+		config.Producer.Compression = sarama.CompressionZSTD
+		if !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+			config.Version = sarama.V2_1_0_0
+		}
+	default:
+		return nil, fmt.Errorf("Unknown Kafka compression %q, should be none, gzip, snappy, lz4, or zstd", c.Compression)
+	}
+
+	if c.TLS {
+		tlsConfig, err := newTLSConfig(c.TLSCA, c.TLSCert, c.TLSKey, false)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if c.SASLMechanism != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = c.SASLUser
+		config.Net.SASL.Password = c.SASLPassword
+
+		switch strings.ToUpper(c.SASLMechanism) {
+		case sarama.SASLTypePlaintext:
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case sarama.SASLTypeSCRAMSHA256:
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &kafkaSCRAMClient{hash: scram.SHA256}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &kafkaSCRAMClient{hash: scram.SHA512}
+			}
+		default:
+			return nil, fmt.Errorf("Unknown SASL mechanism %q, should be PLAIN, SCRAM-SHA-256, or SCRAM-SHA-512", c.SASLMechanism)
+		}
+	}
+
+	return config, nil
+}
+
+// kafkaSCRAMClient implements SCRAM authentication for Kafka client
+type kafkaSCRAMClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *kafkaSCRAMClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+
+	return nil
+}
+
+func (c *kafkaSCRAMClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *kafkaSCRAMClient) Done() bool {
+	return c.conversation.Done()
+}
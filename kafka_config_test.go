@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+func TestKafkaConfig(t *testing.T) {
+	config, err := (&KafkaConfig{Offset: "oldest", SASLMechanism: "scram-sha-512", SASLUser: "gor", SASLPassword: "secret"}).saramaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Consumer.Offsets.Initial != sarama.OffsetOldest {
+		t.Error("Should start from oldest offset")
+	}
+
+	if !config.Net.SASL.Enable || config.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || config.Net.SASL.SCRAMClientGeneratorFunc == nil {
+		t.Error("Should enable SCRAM authentication")
+	}
+
+	client := config.Net.SASL.SCRAMClientGeneratorFunc()
+	if err := client.Begin("gor", "secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	if first, err := client.Step(""); err != nil || first[:9] != "n,,n=gor," {
+		t.Errorf("Should start SCRAM conversation: %q %v", first, err)
+	}
+
+	config, err = (&KafkaConfig{Acks: "all", Compression: "zstd"}).saramaConfig()
+	if err != nil || config.Producer.RequiredAcks != sarama.WaitForAll || config.Producer.Compression != sarama.CompressionZSTD {
+		t.Errorf("Should wait for all replicas, and compress with zstd: %v", err)
+	}
+
+	if _, err := (&KafkaConfig{Compression: "brotli"}).saramaConfig(); err == nil {
+		t.Error("Should not accept unknown compression")
+	}
+
+	if _, err := (&KafkaConfig{Offset: "latest"}).saramaConfig(); err == nil {
+		t.Error("Should not accept unknown offset")
+	}
+
+	if _, err := (&KafkaConfig{SASLMechanism: "GSSAPI"}).saramaConfig(); err == nil {
+		t.Error("Should not accept unknown mechanism")
+	}
+
+	if _, err := (&KafkaConfig{TLS: true, TLSCA: "/nonexistent.pem"}).saramaConfig(); err == nil {
+		t.Error("Should fail to read CA")
+	}
+}
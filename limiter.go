@@ -3,29 +3,66 @@ package main
 import (
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// Limiter is a wrapper for input or output plugin which adds rate limiting
+// Limiter is a wrapper for input or output plugin which adds rate limiting.
+//
+// Limit is set after "|" of plugin address, either as percentage of traffic, like "10%", which passes random
+// requests, or as absolute rate, like "500" or "500/s" requests per second, or "3000/m" per minute. Absolute rate
+// is enforced with token bucket, which by default holds tokens for one second of traffic, and can be set
+// with burst option, like "500/s,burst=1000".
 type Limiter struct {
 	plugin    interface{}
 	limit     int
 	isPercent bool
 
-	currentRPS  int
-	currentTime int64
+	// Token bucket: tokens added per second, bucket size, and tokens left when it was last updated
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
 }
 
-func parseLimitOptions(options string) (limit int, isPercent bool) {
-	if strings.Contains(options, "%") {
-		limit, _ = strconv.Atoi(strings.Split(options, "%")[0])
-		isPercent = true
-	} else {
-		limit, _ = strconv.Atoi(options)
-		isPercent = false
+// parseLimitOptions parses limit, and for absolute limits, rate per second and burst
+func parseLimitOptions(options string) (limit int, isPercent bool, rate float64, burst int) {
+	parts := strings.Split(options, ",")
+
+	if strings.Contains(parts[0], "%") {
+		limit, _ = strconv.Atoi(strings.Split(parts[0], "%")[0])
+		return limit, true, 0, 0
+	}
+
+	rate = 1
+	value := parts[0]
+	if i := strings.Index(value, "/"); i != -1 {
+		switch value[i+1:] {
+		case "m":
+			rate = 1.0 / 60
+		case "h":
+			rate = 1.0 / 3600
+		}
+		value = value[:i]
+	}
+
+	limit, _ = strconv.Atoi(strings.TrimSpace(value))
+	rate *= float64(limit)
+
+	for _, option := range parts[1:] {
+		if strings.HasPrefix(option, "burst=") {
+			burst, _ = strconv.Atoi(option[len("burst="):])
+		}
+	}
+
+	if burst <= 0 {
+		// One second of traffic, at least single request
+		burst = int(math.Ceil(rate))
 	}
 
 	return
@@ -35,12 +72,19 @@ func parseLimitOptions(options string) (limit int, isPercent bool) {
 // `options` allow to sprcify relatve or absolute limiting
 func NewLimiter(plugin interface{}, options string) io.ReadWriter {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
+	var burst int
+	l.limit, l.isPercent, l.rate, burst = parseLimitOptions(options)
 	l.plugin = plugin
-	l.currentTime = time.Now().UnixNano()
+
+	l.burst = float64(burst)
+	if l.limit <= 0 {
+		l.burst = 0
+	}
+	l.tokens = l.burst
+	l.last = time.Now()
 
 	// FileInput have its own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
-	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent {
+	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent && l.limit > 0 {
 		fi.speedFactor = float64(l.limit) / float64(100)
 	}
 
@@ -57,16 +101,21 @@ func (l *Limiter) isLimited() bool {
 		return l.limit <= rand.Intn(100)
 	}
 
-	if (time.Now().UnixNano() - l.currentTime) > time.Second.Nanoseconds() {
-		l.currentTime = time.Now().UnixNano()
-		l.currentRPS = 0
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
 	}
+	l.last = now
 
-	if l.currentRPS >= l.limit {
+	if l.tokens < 1 {
 		return true
 	}
 
-	l.currentRPS++
+	l.tokens--
 
 	return false
 }
@@ -6,6 +6,7 @@ import (
 	"io"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestOutputLimiter(t *testing.T) {
@@ -104,3 +105,48 @@ func TestPercentLimiter2(t *testing.T) {
 
 	close(quit)
 }
+
+func TestParseLimitOptions(t *testing.T) {
+	cases := []struct {
+		options   string
+		limit     int
+		isPercent bool
+		rate      float64
+		burst     int
+	}{
+		{"10%", 10, true, 0, 0},
+		{"500", 500, false, 500, 500},
+		{"500/s", 500, false, 500, 500},
+		{"120/m", 120, false, 2, 2},
+		{"30/m", 30, false, 0.5, 1},
+		{"500/s,burst=1000", 500, false, 500, 1000},
+	}
+
+	for _, c := range cases {
+		limit, isPercent, rate, burst := parseLimitOptions(c.options)
+		if limit != c.limit || isPercent != c.isPercent || rate != c.rate || burst != c.burst {
+			t.Errorf("Wrong options %q: %d %v %f %d", c.options, limit, isPercent, rate, burst)
+		}
+	}
+}
+
+func TestLimiterTokenBucket(t *testing.T) {
+	l := NewLimiter(NewTestOutput(func(data []byte) {}), "100/s,burst=5").(*Limiter)
+
+	passed := 0
+	for i := 0; i < 20; i++ {
+		if !l.isLimited() {
+			passed++
+		}
+	}
+
+	if passed != 5 {
+		t.Error("Should pass burst of requests:", passed)
+	}
+
+	// Tokens are refilled with the rate
+	l.last = l.last.Add(-30 * time.Millisecond)
+	if l.isLimited() || l.isLimited() || l.isLimited() || !l.isLimited() {
+		t.Error("Should refill 3 tokens")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// NATSConfig struct for holding configuration of NATS input and output
+type NATSConfig struct {
+	// Subject of gor payloads
+	Subject string
+	// JetStream stream of input, looked up by subject if not set
+	Stream string
+	// Durable consumer of input, which tracks acknowledged payloads
+	Durable string
+	// Credentials file of NATS user
+	Creds string
+}
+
+// connect connects to NATS servers, reconnecting forever if connection breaks
+func (c *NATSConfig) connect(url string) (*nats.Conn, error) {
+	options := []nats.Option{nats.Name("gor"), nats.MaxReconnects(-1)}
+	if c.Creds != "" {
+		options = append(options, nats.UserCredentials(c.Creds))
+	}
+
+	return nats.Connect(url, options...)
+}
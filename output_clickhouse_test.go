@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClickHouseRow(t *testing.T) {
+	records := newTrafficRecords(true)
+
+	records.add([]byte("1 a 1546423200000000000 src=10.0.0.1:5000\nGET /users?page=2 HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	r := records.add([]byte("2 a 2500000\nHTTP/1.1 404 Not Found\r\nContent-Length: 3\r\n\r\nnop"))
+	if r == nil {
+		t.Fatal("Request should be matched with response")
+	}
+
+	row := clickhouseRow(r)
+	if len(row) != len(clickhouseColumns) {
+		t.Fatalf("Row should have value of each column: %d != %d", len(row), len(clickhouseColumns))
+	}
+
+	values := make(map[string]interface{})
+	for i, c := range clickhouseColumns {
+		values[c.name] = row[i]
+	}
+
+	if ts := values["timestamp"].(time.Time); !ts.Equal(time.Date(2019, 1, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Wrong timestamp: %v", ts)
+	}
+	if values["path"] != "/users" || values["query"] != "page=2" || values["host"] != "example.com" || values["client_ip"] != "10.0.0.1" {
+		t.Errorf("Wrong request metadata: %v", values)
+	}
+	if values["status"] != uint16(404) || values["response_size"] != uint64(3) || values["latency_ms"] != 2.5 {
+		t.Errorf("Wrong response metadata: %v", values)
+	}
+	if !strings.HasPrefix(values["request_body"].(string), "GET /users") || !strings.HasSuffix(values["response_body"].(string), "nop") {
+		t.Errorf("Payloads should be stored: %v", values)
+	}
+
+	records = newTrafficRecords(false)
+	records.add([]byte("1 b 1\nGET / HTTP/1.1\r\n\r\n"))
+	expired := records.expire(time.Now(), 0)
+	if len(expired) != 1 || expired[0].Request != nil {
+		t.Errorf("Request without response should be expired without payload: %v", expired)
+	}
+
+	if query := clickhouseCreateTable("traffic"); !strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS traffic (timestamp DateTime64(9), request_id String,") {
+		t.Errorf("Wrong table statement: %s", query)
+	}
+}
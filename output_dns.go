@@ -0,0 +1,284 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DNSOutputConfig struct for holding dns output configuration
+type DNSOutputConfig struct {
+	stats   bool
+	workers int
+
+	Timeout time.Duration
+
+	TrackResponses bool
+}
+
+// DNSOutput plugin replays captured DNS queries to given resolver, and compares its answers with original ones
+// Queries are captured from UDP traffic, and original answers are available if responses are tracked:
+//
+//	gor --input-raw :53 --input-raw-protocol udp --input-raw-track-response --output-dns 10.0.0.2:53
+type DNSOutput struct {
+	replayed   uint64
+	matched    uint64
+	mismatched uint64
+	failed     uint64
+
+	address string
+	queue   chan []byte
+
+	responses chan response
+
+	config *DNSOutputConfig
+
+	// Original and replayed answers waiting for comparison
+	answers *responsePairs
+
+	quit chan bool
+}
+
+// NewDNSOutput constructor for DNSOutput
+// Initialize workers, each holding own UDP socket
+func NewDNSOutput(address string, config *DNSOutputConfig) io.Writer {
+	o := new(DNSOutput)
+
+	o.address = address
+	o.config = config
+
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 2 * time.Second
+	}
+
+	if o.config.workers == 0 {
+		o.config.workers = 10
+	}
+
+	if len(Settings.middleware) > 0 {
+		o.config.TrackResponses = true
+	}
+
+	o.queue = make(chan []byte, 1000)
+	o.responses = make(chan response, 1000)
+	o.answers = newResponsePairs()
+	o.quit = make(chan bool)
+
+	for i := 0; i < o.config.workers; i++ {
+		go o.worker()
+	}
+
+	if o.config.stats {
+		go o.reportStats()
+	}
+
+	return o
+}
+
+// parseDNS decodes DNS message, returns error if payload is not DNS
+func parseDNS(payload []byte) (*layers.DNS, error) {
+	dns := new(layers.DNS)
+
+	if err := dns.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+
+	return dns, nil
+}
+
+// isDNSQuery checks if payload is DNS query with at least one question
+func isDNSQuery(payload []byte) bool {
+	dns, err := parseDNS(payload)
+
+	return err == nil && !dns.QR && len(dns.Questions) > 0
+}
+
+// dnsQuestionString returns readable form of query questions, like "example.com A"
+func dnsQuestionString(dns *layers.DNS) string {
+	questions := make([]string, len(dns.Questions))
+	for i, q := range dns.Questions {
+		questions[i] = string(q.Name) + " " + q.Type.String()
+	}
+
+	return strings.Join(questions, ", ")
+}
+
+// dnsAnswers returns readable form of answer records, sorted so order of records does not matter. TTL is ignored.
+func dnsAnswers(dns *layers.DNS) []string {
+	answers := make([]string, len(dns.Answers))
+	for i, rr := range dns.Answers {
+		answers[i] = string(rr.Name) + " " + rr.Type.String() + " " + rr.String()
+	}
+	sort.Strings(answers)
+
+	return answers
+}
+
+// dnsAnswersEqual compares response codes and answer records of two DNS responses
+func dnsAnswersEqual(a, b *layers.DNS) bool {
+	if a.ResponseCode != b.ResponseCode {
+		return false
+	}
+
+	answersA, answersB := dnsAnswers(a), dnsAnswers(b)
+	if len(answersA) != len(answersB) {
+		return false
+	}
+
+	for i := range answersA {
+		if answersA[i] != answersB[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (o *DNSOutput) Write(data []byte) (n int, err error) {
+	body := payloadBody(data)
+
+	switch data[0] {
+	case RequestPayload:
+		if !isDNSQuery(body) {
+			return len(data), nil
+		}
+
+		enqueuePayload(o.queue, nil, data)
+	case ResponsePayload:
+		meta := payloadMeta(data)
+		if len(meta) < 2 {
+			break
+		}
+
+		// Decoded message references payload, which is reused by emitter
+		if original, err := parseDNS(append([]byte{}, body...)); err == nil && original.QR {
+			o.compare(o.answers.add(meta[1], nil, original, nil))
+		}
+	}
+
+	return len(data), nil
+}
+
+func (o *DNSOutput) Read(data []byte) (int, error) {
+	resp := <-o.responses
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *DNSOutput) worker() {
+	conn, err := net.Dial("udp", o.address)
+	if err != nil {
+		log.Println("Can't connect to DNS server:", o.address, err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case data := <-o.queue:
+			o.sendQuery(conn, buf, data)
+		}
+	}
+}
+
+func (o *DNSOutput) sendQuery(conn net.Conn, buf []byte, data []byte) {
+	meta := payloadMeta(data)
+	if len(meta) < 2 {
+		return
+	}
+	uuid := meta[1]
+	query := payloadBody(data)
+	id := uint16(query[0])<<8 | uint16(query[1])
+
+	start := time.Now()
+	atomic.AddUint64(&o.replayed, 1)
+
+	if _, err := conn.Write(query); err != nil {
+		Debug("[OUTPUT-DNS] Query error:", err)
+		atomic.AddUint64(&o.failed, 1)
+		return
+	}
+
+	conn.SetReadDeadline(start.Add(o.config.Timeout))
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			Debug("[OUTPUT-DNS] Response error:", err)
+			atomic.AddUint64(&o.failed, 1)
+			return
+		}
+
+		replayed, err := parseDNS(buf[:n])
+		// Late answer to the previous, timed out query
+		if err != nil || replayed.ID != id {
+			continue
+		}
+
+		stop := time.Now()
+
+		if o.config.TrackResponses {
+			payload := make([]byte, n)
+			copy(payload, buf[:n])
+			o.responses <- response{payload, uuid, stop.UnixNano() - start.UnixNano()}
+		}
+
+		o.compare(o.answers.add(uuid, nil, nil, replayed))
+		return
+	}
+}
+
+// compare checks if original and replayed answers are equal, once both are received
+func (o *DNSOutput) compare(c *responsePair) {
+	if c == nil {
+		return
+	}
+	original, replayed := c.original.(*layers.DNS), c.replayed.(*layers.DNS)
+
+	if dnsAnswersEqual(original, replayed) {
+		atomic.AddUint64(&o.matched, 1)
+		return
+	}
+
+	atomic.AddUint64(&o.mismatched, 1)
+	Debug("[OUTPUT-DNS] Answers differ for", dnsQuestionString(original), "original:", original.ResponseCode, dnsAnswers(original), "replayed:", replayed.ResponseCode, dnsAnswers(replayed))
+}
+
+func (o *DNSOutput) reportStats() {
+	log.Println("output_dns:replayed,matched,mismatched,failed")
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-time.After(rate * time.Second):
+		}
+
+		log.Printf("output_dns:%d,%d,%d,%d", atomic.LoadUint64(&o.replayed), atomic.LoadUint64(&o.matched), atomic.LoadUint64(&o.mismatched), atomic.LoadUint64(&o.failed))
+	}
+}
+
+func (o *DNSOutput) String() string {
+	return "DNS output: " + o.address
+}
+
+// Close stops workers
+func (o *DNSOutput) Close() error {
+	close(o.quit)
+	return nil
+}
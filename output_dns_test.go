@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func buildDNS(id uint16, answer net.IP) []byte {
+	dns := &layers.DNS{
+		ID: id,
+		RD: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+	}
+
+	if answer != nil {
+		dns.QR = true
+		dns.Answers = []layers.DNSResourceRecord{
+			{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: answer},
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true})
+
+	return buf.Bytes()
+}
+
+func startDNSServer(answer net.IP) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			query, _ := parseDNS(buf[:n])
+			conn.WriteTo(buildDNS(query.ID, answer), addr)
+		}
+	}()
+
+	return conn
+}
+
+func TestDNSOutput(t *testing.T) {
+	server := startDNSServer(net.IP{10, 0, 0, 1})
+	defer server.Close()
+
+	output := NewDNSOutput(server.LocalAddr().String(), &DNSOutputConfig{}).(*DNSOutput)
+	defer output.Close()
+
+	same, other := uuid(), uuid()
+
+	output.Write(append(payloadHeader(RequestPayload, same, 1), buildDNS(1, nil)...))
+	output.Write(append(payloadHeader(ResponsePayload, same, 1), buildDNS(1, net.IP{10, 0, 0, 1})...))
+
+	output.Write(append(payloadHeader(RequestPayload, other, 1), buildDNS(2, nil)...))
+	output.Write(append(payloadHeader(ResponsePayload, other, 1), buildDNS(2, net.IP{10, 0, 0, 2})...))
+
+	// Not DNS
+	output.Write(append(payloadHeader(RequestPayload, uuid(), 1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&output.matched)+atomic.LoadUint64(&output.mismatched) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if replayed := atomic.LoadUint64(&output.replayed); replayed != 2 {
+		t.Error("Should replay only DNS queries", replayed)
+	}
+
+	if atomic.LoadUint64(&output.matched) != 1 || atomic.LoadUint64(&output.mismatched) != 1 {
+		t.Error("Should compare answers", output.matched, output.mismatched)
+	}
+}
+
+func TestDNSAnswersEqual(t *testing.T) {
+	a, _ := parseDNS(buildDNS(1, net.IP{10, 0, 0, 1}))
+	b, _ := parseDNS(buildDNS(2, net.IP{10, 0, 0, 1}))
+	c, _ := parseDNS(buildDNS(1, net.IP{10, 0, 0, 2}))
+
+	if !dnsAnswersEqual(a, b) {
+		t.Error("Should ignore query ID")
+	}
+
+	if dnsAnswersEqual(a, c) {
+		t.Error("Should detect different answers")
+	}
+
+	b.ResponseCode = layers.DNSResponseCodeNXDomain
+	if dnsAnswersEqual(a, b) {
+		t.Error("Should compare response codes")
+	}
+}
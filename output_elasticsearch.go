@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ElasticsearchOutputConfig configures indexing of Elasticsearch output
+type ElasticsearchOutputConfig struct {
+	// Documents are indexed into index name followed by date of request formatted with IndexDateFormat, like
+	// "gor-2019.01.01", so old indices can be deleted by ILM or ISM policy. If format is empty, documents are
+	// created in index as is, which can be data stream or rollover alias.
+	IndexDateFormat string
+	// Documents are sent in bulk requests of BulkSize documents, or every FlushInterval
+	BulkSize      int
+	FlushInterval time.Duration
+	// API key authenticating requests, basic auth credentials can be set in URL
+	APIKey string
+}
+
+// Mappings of index template installed for dated indices, so documents are aggregated by Kibana as is
+var esTrafficMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"@timestamp":        map[string]string{"type": "date"},
+		"request_id":        map[string]string{"type": "keyword"},
+		"method":            map[string]string{"type": "keyword"},
+		"path":              map[string]string{"type": "keyword"},
+		"query":             map[string]string{"type": "keyword"},
+		"host":              map[string]string{"type": "keyword"},
+		"user_agent":        map[string]string{"type": "keyword"},
+		"client_ip":         map[string]string{"type": "ip"},
+		"request_size":      map[string]string{"type": "long"},
+		"status":            map[string]string{"type": "short"},
+		"content_type":      map[string]string{"type": "keyword"},
+		"response_size":     map[string]string{"type": "long"},
+		"latency_ms":        map[string]string{"type": "float"},
+		"truncated":         map[string]string{"type": "boolean"},
+		"graphql_operation": map[string]string{"type": "keyword"},
+		"graphql_type":      map[string]string{"type": "keyword"},
+	},
+}
+
+// ElasticsearchOutput indexes metadata of captured requests and their responses into Elasticsearch or OpenSearch,
+// for dashboards of production traffic:
+//
+//	gor --input-raw :80 --input-raw-track-response --output-elasticsearch http://elastic:9200/gor
+//
+// Unlike --output-http-elasticsearch, which indexes responses of replayed server, it indexes original traffic.
+type ElasticsearchOutput struct {
+	address string
+	// Bulk API URL, and index name or prefix
+	url   string
+	index string
+	user  *url.Userinfo
+
+	config *ElasticsearchOutputConfig
+	client *http.Client
+
+	records *trafficRecords
+	bulk    bytes.Buffer
+	count   int
+}
+
+// NewElasticsearchOutput constructor for ElasticsearchOutput, accepts URL with index, like "http://host:9200/gor"
+func NewElasticsearchOutput(address string, config *ElasticsearchOutputConfig) io.Writer {
+	o := &ElasticsearchOutput{address: address, config: config}
+
+	if !strings.HasPrefix(address, "http") {
+		address = "http://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil || strings.Trim(u.Path, "/") == "" {
+		log.Fatalf("Wrong Elasticsearch output address %q, should be like http://host:9200/index", o.address)
+	}
+
+	o.index = strings.Trim(u.Path, "/")
+	o.user = u.User
+	u.User, u.Path = nil, "/_bulk"
+	o.url = u.String()
+
+	if o.config.BulkSize == 0 {
+		o.config.BulkSize = 500
+	}
+	if o.config.FlushInterval == 0 {
+		o.config.FlushInterval = 5 * time.Second
+	}
+
+	o.client = &http.Client{Timeout: 30 * time.Second}
+	o.records = newTrafficRecords(false)
+
+	if o.config.IndexDateFormat != "" {
+		o.installTemplate(strings.TrimSuffix(o.url, "/_bulk"))
+	}
+
+	go o.records.run(o.config.FlushInterval, o.add, o.flush)
+
+	return o
+}
+
+// installTemplate creates index template with mappings of dated indices, unless it already exists
+func (o *ElasticsearchOutput) installTemplate(base string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{o.index + "-*"},
+		"template":       map[string]interface{}{"mappings": esTrafficMappings},
+	})
+
+	resp, err := o.request("PUT", base+"/_index_template/"+url.PathEscape(o.index)+"?create=true", "application/json", body)
+	if err != nil {
+		Debug("[OUTPUT-ELASTICSEARCH] Index template is not installed:", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (o *ElasticsearchOutput) Write(data []byte) (n int, err error) {
+	o.records.write(data)
+
+	return len(data), nil
+}
+
+// add appends document to bulk request, and sends it once it is full
+func (o *ElasticsearchOutput) add(doc *trafficRecord) {
+	index := o.index
+	if o.config.IndexDateFormat != "" {
+		index += "-" + doc.Timestamp.Format(o.config.IndexDateFormat)
+	}
+
+	// Documents are created with generated IDs, as required by data streams
+	action, _ := json.Marshal(map[string]map[string]string{"create": {"_index": index}})
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+
+	o.bulk.Write(action)
+	o.bulk.WriteByte('\n')
+	o.bulk.Write(source)
+	o.bulk.WriteByte('\n')
+	o.count++
+
+	if o.count >= o.config.BulkSize {
+		o.flush()
+	}
+}
+
+// flush sends bulk request of added documents
+func (o *ElasticsearchOutput) flush() {
+	if o.count == 0 {
+		return
+	}
+
+	count := o.count
+	resp, err := o.request("POST", o.url, "application/x-ndjson", o.bulk.Bytes())
+	o.bulk.Reset()
+	o.count = 0
+
+	if err != nil {
+		log.Printf("[OUTPUT-ELASTICSEARCH] Can't index %d documents: %v", count, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors bool
+		Items  []map[string]struct {
+			Error json.RawMessage
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || !result.Errors {
+		return
+	}
+
+	failed := 0
+	var reason json.RawMessage
+	for _, item := range result.Items {
+		for _, r := range item {
+			if len(r.Error) > 0 {
+				failed++
+				reason = r.Error
+			}
+		}
+	}
+	log.Printf("[OUTPUT-ELASTICSEARCH] %d of %d documents are not indexed: %s", failed, count, reason)
+}
+
+// request sends authenticated request to Elasticsearch, returning error if it is not successful
+func (o *ElasticsearchOutput) request(method, url, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if o.config.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+o.config.APIKey)
+	} else if o.user != nil {
+		password, _ := o.user.Password()
+		req.SetBasicAuth(o.user.Username(), password)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("Elasticsearch error: %s %s", resp.Status, data)
+	}
+
+	return resp, nil
+}
+
+func (o *ElasticsearchOutput) String() string {
+	return "Elasticsearch output: " + o.address
+}
+
+// Close indexes pending requests and buffered documents
+func (o *ElasticsearchOutput) Close() error {
+	o.records.close()
+
+	return nil
+}
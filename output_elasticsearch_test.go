@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchOutput(t *testing.T) {
+	var mu sync.Mutex
+	var indices []string
+	var docs []trafficRecord
+	var templates, auth []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		user, pass, _ := r.BasicAuth()
+		auth = append(auth, user+":"+pass)
+
+		if r.URL.Path != "/_bulk" {
+			templates = append(templates, r.Method+" "+r.URL.RequestURI())
+			return
+		}
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(scanner.Bytes(), &action)
+			indices = append(indices, action["create"]["_index"])
+
+			scanner.Scan()
+			var doc trafficRecord
+			json.Unmarshal(scanner.Bytes(), &doc)
+			docs = append(docs, doc)
+		}
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer server.Close()
+
+	address := "http://elastic:secret@" + server.URL[len("http://"):] + "/gor"
+	output := NewElasticsearchOutput(address, &ElasticsearchOutputConfig{IndexDateFormat: "2006.01.02", BulkSize: 2}).(*ElasticsearchOutput)
+
+	start := time.Date(2019, 1, 2, 10, 0, 0, 0, time.UTC).UnixNano()
+	req := []byte("1 a " + strconv.FormatInt(start, 10) + " src=10.0.0.1:5000\nPOST /users?page=2 HTTP/1.1\r\nHost: example.com\r\nUser-Agent: curl\r\nContent-Length: 2\r\n\r\n{}")
+	resp := []byte("2 a 150000000\nHTTP/1.1 201 Created\r\nContent-Type: application/json\r\nContent-Length: 5\r\n\r\nhello")
+	unanswered := []byte("1 b " + strconv.FormatInt(start, 10) + "\nGET / HTTP/1.1\r\n\r\n")
+
+	output.Write(req)
+	output.Write([]byte("2 c 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	output.Write(resp)
+	output.Write(unanswered)
+	output.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(templates) != 1 || templates[0] != "PUT /_index_template/gor?create=true" {
+		t.Errorf("Should install index template: %v", templates)
+	}
+
+	for _, a := range auth {
+		if a != "elastic:secret" {
+			t.Errorf("Wrong credentials: %s", a)
+		}
+	}
+
+	if len(docs) != 2 {
+		t.Fatalf("Should index 2 requests: %+v", docs)
+	}
+
+	for _, index := range indices {
+		if index != "gor-2019.01.02" {
+			t.Errorf("Wrong index: %s", index)
+		}
+	}
+
+	doc := docs[0]
+	if doc.ID != "a" || doc.Method != "POST" || doc.Path != "/users" || doc.Query != "page=2" || doc.Host != "example.com" || doc.UserAgent != "curl" || doc.ClientIP != "10.0.0.1" {
+		t.Errorf("Wrong request metadata: %+v", doc)
+	}
+	if doc.Status != 201 || doc.ContentType != "application/json" || doc.RequestSize != 2 || doc.ResponseSize != 5 || doc.Latency != 150 {
+		t.Errorf("Wrong response metadata: %+v", doc)
+	}
+	if !doc.Timestamp.Equal(time.Unix(0, start)) {
+		t.Errorf("Wrong timestamp: %v", doc.Timestamp)
+	}
+
+	if docs[1].ID != "b" || docs[1].Status != 0 {
+		t.Errorf("Request without response should be indexed on close: %+v", docs[1])
+	}
+}
+
+func TestElasticsearchOutputAPIKey(t *testing.T) {
+	headers := make(chan string, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("Template should not be installed for index as is: %s", r.URL.Path)
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		if !bytes.Contains(buf.Bytes(), []byte(`{"create":{"_index":"traffic"}}`)) {
+			t.Errorf("Wrong bulk request: %s", buf.Bytes())
+		}
+		headers <- r.Header.Get("Authorization")
+		w.Write([]byte(`{"errors":true,"items":[{"create":{"error":{"type":"mapper_parsing_exception"}}}]}`))
+	}))
+	defer server.Close()
+
+	output := NewElasticsearchOutput(server.URL+"/traffic", &ElasticsearchOutputConfig{APIKey: "key"})
+	output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+	output.(*ElasticsearchOutput).Close()
+
+	if auth := <-headers; auth != "ApiKey key" {
+		t.Errorf("Wrong Authorization header: %s", auth)
+	}
+}
@@ -2,17 +2,17 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"time"
 	"sync"
+	"time"
 )
 
 var dateFileNameFuncs = map[string]func() string{
@@ -30,6 +30,11 @@ type FileOutputConfig struct {
 	sizeLimit     unitSizeVar
 	queueLimit    int
 	append        bool
+
+	// New chunk is started when the current one is older than rotationInterval, if it is set
+	rotationInterval time.Duration
+	// Number of chunks kept, older ones are removed on rotation. All chunks are kept if it is 0.
+	maxFiles int
 }
 
 // FileOutput output plugin
@@ -41,6 +46,10 @@ type FileOutput struct {
 	queueLength  int
 	chunkSize    int
 	writer       io.Writer
+	// Set for compressed files, writes to the file directly
+	compressed compressedWriter
+	// When the current chunk was opened
+	openedAt time.Time
 
 	config *FileOutputConfig
 }
@@ -138,35 +147,55 @@ func (o *FileOutput) filename() string {
 
 		if o.currentName == "" ||
 			((o.config.queueLimit > 0 && o.queueLength >= o.config.queueLimit) ||
-				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit))) {
+				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit)) ||
+				(o.config.rotationInterval > 0 && !o.openedAt.IsZero() && time.Since(o.openedAt) >= o.config.rotationInterval)) {
 			nextChunk = true
 		}
 
-		ext := filepath.Ext(path)
-		withoutExt := strings.TrimSuffix(path, ext)
+		matches := chunkNames(path)
+		if len(matches) == 0 {
+			return setFileIndex(path, 0)
+		}
+		sort.Sort(sortByFileIndex(matches))
 
-		if matches, err := filepath.Glob(withoutExt + "*" + ext); err == nil {
-			if len(matches) == 0 {
-				return setFileIndex(path, 0)
+		last := matches[len(matches)-1]
+
+		fileIndex := 0
+		if idx := getFileIndex(last); idx != -1 {
+			fileIndex = idx
+
+			if nextChunk {
+				fileIndex++
 			}
-			sort.Sort(sortByFileIndex(matches))
+		}
 
-			last := matches[len(matches)-1]
+		return setFileIndex(last, fileIndex)
+	}
 
-			fileIndex := 0
-			if idx := getFileIndex(last); idx != -1 {
-				fileIndex = idx
+	return path
+}
 
-				if nextChunk {
-					fileIndex++
-				}
-			}
+// chunkNames returns existing chunks of the path: files named as path, or with "_<index>" before extension.
+// Parts of path set by date placeholders match any time. Other files sharing the prefix, like "requests_backup.gor"
+// for "requests.gor", are not chunks.
+func chunkNames(path string) (names []string) {
+	path = filepath.Clean(path)
+	ext := filepath.Ext(path)
+	glob, pattern := strings.TrimSuffix(path, ext), regexp.QuoteMeta(strings.TrimSuffix(path, ext))
+	for name := range dateFileNameFuncs {
+		glob = strings.Replace(glob, name, "*", -1)
+		pattern = strings.Replace(pattern, name, "[0-9]+", -1)
+	}
+	chunk := regexp.MustCompile("^" + pattern + "(_[0-9]+)?" + regexp.QuoteMeta(ext) + "$")
 
-			return setFileIndex(last, fileIndex)
+	matches, _ := filepath.Glob(glob + "*" + ext)
+	for _, name := range matches {
+		if chunk.MatchString(name) {
+			names = append(names, name)
 		}
 	}
 
-	return path
+	return
 }
 
 func (o *FileOutput) updateName() {
@@ -185,8 +214,8 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
 		o.file.Sync()
 
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer = gzip.NewWriter(o.file)
+		if o.compressed = newCompressedWriter(o.currentName, o.file); o.compressed != nil {
+			o.writer = o.compressed
 		} else {
 			o.writer = bufio.NewWriter(o.file)
 		}
@@ -196,6 +225,12 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 		}
 
 		o.queueLength = 0
+		o.chunkSize = 0
+		o.openedAt = time.Now()
+
+		if o.config.maxFiles > 0 {
+			o.removeOldFiles()
+		}
 		o.mu.Unlock()
 	}
 
@@ -203,6 +238,7 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 	o.writer.Write([]byte(payloadSeparator))
 
 	o.queueLength++
+	o.chunkSize += len(data) + len(payloadSeparator)
 
 	return len(data), nil
 }
@@ -212,14 +248,43 @@ func (o *FileOutput) flush() {
 	o.mu.Lock()
 
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Flush()
+		if o.compressed != nil {
+			o.compressed.Flush()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
+	}
+}
 
-		if stat, err := o.file.Stat(); err != nil {
-			o.chunkSize = int(stat.Size())
+// removeOldFiles removes the oldest chunks written by output, so only maxFiles chunks are kept
+func (o *FileOutput) removeOldFiles() {
+	// Chunks of any time, if path has date placeholders
+	matches := chunkNames(o.pathTemplate)
+	if len(matches) <= o.config.maxFiles {
+		return
+	}
+
+	modified := make(map[string]time.Time)
+	for _, name := range matches {
+		if stat, err := os.Stat(name); err == nil {
+			modified[name] = stat.ModTime()
+		}
+	}
+
+	sort.Sort(sortByFileIndex(matches))
+	sort.SliceStable(matches, func(i, j int) bool {
+		return modified[matches[i]].Before(modified[matches[j]])
+	})
+
+	for _, name := range matches[:len(matches)-o.config.maxFiles] {
+		if name == o.currentName {
+			continue
+		}
+
+		if err := os.Remove(name); err != nil {
+			log.Println("[OUTPUT-FILE] Can't remove old file:", err)
+		} else {
+			Debug("[OUTPUT-FILE] Removed old file:", name)
 		}
 	}
 }
@@ -230,11 +295,13 @@ func (o *FileOutput) String() string {
 
 func (o *FileOutput) Close() {
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Close()
+		if o.compressed != nil {
+			o.compressed.Close()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
+		// Rotated chunk is fully on disk before the next one is started
+		o.file.Sync()
 		o.file.Close()
 	}
 }
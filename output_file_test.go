@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync"
@@ -272,3 +274,75 @@ func TestFileOutputSort(t *testing.T) {
 		t.Error("Should properly sort file names using indexes", files, expected)
 	}
 }
+
+func TestFileOutputRotation(t *testing.T) {
+	rnd := rand.Int63()
+	name := fmt.Sprintf("/tmp/%d", rnd)
+	defer func() {
+		for i := 0; i < 5; i++ {
+			os.Remove(fmt.Sprintf("%s_%d", name, i))
+		}
+	}()
+
+	var size unitSizeVar
+	size.Set("1kb")
+	if size != 1024 {
+		t.Fatal("Wrong size limit:", size)
+	}
+
+	output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, sizeLimit: size, rotationInterval: time.Hour, maxFiles: 2})
+
+	// Chunk is rotated by size
+	output.Write([]byte("1 1 1\r\n" + string(make([]byte, 1024))))
+	output.updateName()
+	output.Write([]byte("1 1 1\r\ntest"))
+
+	if output.file.Name() != name+"_1" {
+		t.Error("Should rotate file over size limit:", output.file.Name())
+	}
+
+	// Chunk is rotated by time
+	output.openedAt = time.Now().Add(-time.Hour)
+	output.updateName()
+	output.Write([]byte("1 1 1\r\ntest"))
+
+	if output.file.Name() != name+"_2" {
+		t.Error("Should rotate file older than interval:", output.file.Name())
+	}
+
+	// The oldest chunk is removed
+	if _, err := os.Stat(name + "_0"); !os.IsNotExist(err) {
+		t.Error("Should keep only 2 files:", err)
+	}
+	if _, err := os.Stat(name + "_1"); err != nil {
+		t.Error("Should keep previous file:", err)
+	}
+}
+
+func TestFileOutputRotationKeepsUnrelatedFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_rotation")
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "requests.gor")
+	backup := filepath.Join(dir, "requests_backup.gor")
+	ioutil.WriteFile(backup, []byte("backup"), 0660)
+
+	output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, queueLimit: 1, maxFiles: 1})
+
+	for i := 0; i < 3; i++ {
+		output.Write([]byte("1 1 1\r\ntest"))
+		output.updateName()
+	}
+	output.Close()
+
+	if _, err := os.Stat(backup); err != nil {
+		t.Error("Should keep file which is not chunk of output:", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "requests_1.gor")); !os.IsNotExist(err) {
+		t.Error("Should remove old chunk:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "requests_2.gor")); err != nil {
+		t.Error("Should keep the last chunk:", err)
+	}
+}
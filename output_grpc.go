@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Request headers not copied to replayed call, they are set by HTTP/2 transport
+var grpcSkippedHeaders = []string{"Host", "Content-Length", "Connection", "Transfer-Encoding"}
+
+// GRPCOutputConfig struct for holding grpc output configuration
+type GRPCOutputConfig struct {
+	stats   bool
+	workers int
+
+	Timeout time.Duration
+
+	TrackResponses bool
+}
+
+// GRPCOutput plugin replays captured gRPC unary calls to given server over HTTP/2. Calls are captured from h2c
+// connections, and streaming calls, sending multiple request messages, are skipped:
+//
+//	gor --input-raw :50051 --output-grpc staging:50051
+//
+// Address with "https://" scheme replays calls over TLS.
+type GRPCOutput struct {
+	replayed uint64
+	skipped  uint64
+	failed   uint64
+
+	address string
+	scheme  string
+	client  *http.Client
+	queue   chan []byte
+
+	responses chan response
+
+	config *GRPCOutputConfig
+
+	quit chan bool
+}
+
+// NewGRPCOutput constructor for GRPCOutput
+// Initialize workers, sharing HTTP/2 connection
+func NewGRPCOutput(address string, config *GRPCOutputConfig) io.Writer {
+	o := new(GRPCOutput)
+
+	o.config = config
+
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	if o.config.workers == 0 {
+		o.config.workers = 10
+	}
+
+	if len(Settings.middleware) > 0 {
+		o.config.TrackResponses = true
+	}
+
+	o.scheme = "http"
+	o.address = address
+	if strings.HasPrefix(address, "https://") {
+		o.scheme = "https"
+		o.address = address[len("https://"):]
+	} else if strings.HasPrefix(address, "http://") {
+		o.address = address[len("http://"):]
+	}
+
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	if o.scheme == "http" {
+		// Prior knowledge: HTTP/2 without TLS, like h2c connections calls are captured from
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, o.config.Timeout)
+		}
+	}
+	o.client = &http.Client{Transport: transport, Timeout: o.config.Timeout}
+
+	o.queue = make(chan []byte, 1000)
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan bool)
+
+	for i := 0; i < o.config.workers; i++ {
+		go o.worker()
+	}
+
+	if o.config.stats {
+		go o.reportStats()
+	}
+
+	return o
+}
+
+func (o *GRPCOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) || payloadMetaValue(data, payloadGRPCMethodKey) == nil {
+		return len(data), nil
+	}
+
+	// Unary call sends single message, and truncated one can't be replayed
+	if string(payloadMetaValue(data, payloadGRPCMessagesKey)) != "1" || isTruncatedPayload(data) {
+		atomic.AddUint64(&o.skipped, 1)
+		return len(data), nil
+	}
+
+	enqueuePayload(o.queue, nil, data)
+
+	return len(data), nil
+}
+
+func (o *GRPCOutput) Read(data []byte) (int, error) {
+	resp := <-o.responses
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *GRPCOutput) worker() {
+	for {
+		select {
+		case <-o.quit:
+			return
+		case data := <-o.queue:
+			o.sendCall(data)
+		}
+	}
+}
+
+// sendCall replays request, captured as HTTP/1.1 request with gRPC metadata in headers
+func (o *GRPCOutput) sendCall(data []byte) {
+	meta := payloadMeta(data)
+	if len(meta) < 2 {
+		return
+	}
+	uuid := meta[1]
+
+	original, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payloadBody(data))))
+	if err != nil {
+		Debug("[OUTPUT-GRPC] Can't parse request:", err)
+		atomic.AddUint64(&o.failed, 1)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(original.Body)
+
+	req, err := http.NewRequest("POST", o.scheme+"://"+o.address+original.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		atomic.AddUint64(&o.failed, 1)
+		return
+	}
+
+	for name, values := range original.Header {
+		if !isGRPCSkippedHeader(name) {
+			req.Header[name] = values
+		}
+	}
+
+	start := time.Now()
+	atomic.AddUint64(&o.replayed, 1)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		Debug("[OUTPUT-GRPC] Call error:", err)
+		atomic.AddUint64(&o.failed, 1)
+		return
+	}
+
+	// Trailers are available once body is read
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		Debug("[OUTPUT-GRPC] Response error:", err)
+		atomic.AddUint64(&o.failed, 1)
+		return
+	}
+
+	stop := time.Now()
+
+	if o.config.TrackResponses {
+		o.responses <- response{httpResponseBytes(resp, respBody), uuid, stop.UnixNano() - start.UnixNano()}
+	}
+}
+
+func isGRPCSkippedHeader(name string) bool {
+	for _, h := range grpcSkippedHeaders {
+		if name == h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpResponseBytes renders response received over HTTP/2 or HTTP/3 as HTTP/1.1 response, the same way
+// captured ones are. Body is sent as single chunk, followed by trailers.
+func httpResponseBytes(resp *http.Response, body []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+	resp.Header.Write(&buf)
+
+	if len(resp.Trailer) == 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+		buf.Write(body)
+
+		return buf.Bytes()
+	}
+
+	buf.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+
+	if len(body) > 0 {
+		buf.WriteString(strconv.FormatInt(int64(len(body)), 16) + "\r\n")
+		buf.Write(body)
+		buf.WriteString("\r\n")
+	}
+
+	buf.WriteString("0\r\n")
+	resp.Trailer.Write(&buf)
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+func (o *GRPCOutput) reportStats() {
+	log.Println("output_grpc:replayed,skipped,failed")
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-time.After(rate * time.Second):
+		}
+
+		log.Printf("output_grpc:%d,%d,%d", atomic.LoadUint64(&o.replayed), atomic.LoadUint64(&o.skipped), atomic.LoadUint64(&o.failed))
+	}
+}
+
+func (o *GRPCOutput) String() string {
+	return "gRPC output: " + o.address
+}
+
+// Close stops workers
+func (o *GRPCOutput) Close() error {
+	close(o.quit)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func grpcTestPayload(call *raw.GRPCCall, request string) []byte {
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano())
+	header = appendGRPCMeta(header, call)
+
+	return append(header, request...)
+}
+
+func TestGRPCOutput(t *testing.T) {
+	calls := make(chan *http.Request, 10)
+	bodies := make(chan string, 10)
+
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		calls <- r
+		bodies <- string(body)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("\x00\x00\x00\x00\x02hi"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer server.Close()
+
+	output := NewGRPCOutput(server.Listener.Addr().String(), &GRPCOutputConfig{TrackResponses: true}).(*GRPCOutput)
+	defer output.Close()
+
+	unary := &raw.GRPCCall{Method: "/helloworld.Greeter/SayHello", Messages: [][]byte{[]byte("abc")}}
+	output.Write(grpcTestPayload(unary, "POST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: grpc.local\r\nContent-Type: application/grpc\r\nTe: trailers\r\nX-Token: abc\r\nContent-Length: 8\r\n\r\n\x00\x00\x00\x00\x03abc"))
+
+	streaming := &raw.GRPCCall{Method: "/helloworld.Greeter/SayHelloStream", Messages: [][]byte{[]byte("a"), []byte("b")}}
+	output.Write(grpcTestPayload(streaming, "POST /helloworld.Greeter/SayHelloStream HTTP/1.1\r\nContent-Type: application/grpc\r\nContent-Length: 12\r\n\r\n\x00\x00\x00\x00\x01a\x00\x00\x00\x00\x01b"))
+
+	// Not gRPC
+	output.Write(append(payloadHeader(RequestPayload, uuid(), 1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+
+	select {
+	case r := <-calls:
+		if r.ProtoMajor != 2 || r.URL.Path != "/helloworld.Greeter/SayHello" || r.Header.Get("X-Token") != "abc" || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Error("Should replay call over HTTP/2, with original metadata", r.Proto, r.URL, r.Header)
+		}
+
+		if body := <-bodies; body != "\x00\x00\x00\x00\x03abc" {
+			t.Errorf("Should replay request message: %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should replay unary call")
+	}
+
+	data := make([]byte, 1024)
+	n, _ := output.Read(data)
+	resp := string(payloadBody(data[:n]))
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "Transfer-Encoding: chunked\r\n\r\n7\r\n\x00\x00\x00\x00\x02hi\r\n0\r\nGrpc-Status: 0\r\n\r\n") {
+		t.Errorf("Should render replayed response with trailers: %q", resp)
+	}
+
+	select {
+	case r := <-calls:
+		t.Error("Should skip streaming calls", r.URL)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if atomic.LoadUint64(&output.replayed) != 1 || atomic.LoadUint64(&output.skipped) != 1 {
+		t.Error("Should count replayed and skipped calls", output.replayed, output.skipped)
+	}
+}
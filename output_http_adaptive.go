@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Interval of adaptive throttling adjustments, and limits of replayed fraction of requests.
+// Fraction is halved when target is unhealthy, and restored in steps while it is healthy.
+var httpAdaptiveInterval = time.Second
+
+const (
+	httpAdaptiveMinRate  = 0.01
+	httpAdaptiveRateStep = 0.05
+)
+
+// httpAdaptiveThrottle reduces fraction of replayed requests while replayed server responds slowly or with
+// errors, and restores it once server recovers, so replay doesn't overload the target. Requests over
+// the fraction are dropped before they are queued.
+type httpAdaptiveThrottle struct {
+	maxLatency   time.Duration
+	maxErrorRate float64
+
+	mu sync.Mutex
+	// Responses of the current interval: their number, failed ones, and total latency
+	responses int
+	failed    int
+	latency   time.Duration
+
+	rate float64
+}
+
+func newHTTPAdaptiveThrottle(maxLatency time.Duration, maxErrorRate float64) *httpAdaptiveThrottle {
+	return &httpAdaptiveThrottle{maxLatency: maxLatency, maxErrorRate: maxErrorRate, rate: 1}
+}
+
+// observe records response of replayed request
+func (a *httpAdaptiveThrottle) observe(latency time.Duration, failed bool) {
+	a.mu.Lock()
+	a.responses++
+	a.latency += latency
+	if failed {
+		a.failed++
+	}
+	a.mu.Unlock()
+}
+
+// allow checks if request should be replayed
+func (a *httpAdaptiveThrottle) allow() bool {
+	a.mu.Lock()
+	rate := a.rate
+	a.mu.Unlock()
+
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// adjust updates replayed fraction by responses of the passed interval, and starts new one.
+// Returns new fraction, and if it was changed.
+func (a *httpAdaptiveThrottle) adjust() (float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	unhealthy := false
+	if a.responses > 0 {
+		if a.maxLatency > 0 && a.latency/time.Duration(a.responses) > a.maxLatency {
+			unhealthy = true
+		}
+		if a.maxErrorRate > 0 && float64(a.failed)/float64(a.responses) > a.maxErrorRate {
+			unhealthy = true
+		}
+	}
+	a.responses, a.failed, a.latency = 0, 0, 0
+
+	prev := a.rate
+	if unhealthy {
+		a.rate /= 2
+		if a.rate < httpAdaptiveMinRate {
+			a.rate = httpAdaptiveMinRate
+		}
+	} else {
+		a.rate += httpAdaptiveRateStep
+		if a.rate > 1 {
+			a.rate = 1
+		}
+	}
+
+	return a.rate, a.rate != prev
+}
+
+func (o *HTTPOutput) adjustThrottling() {
+	for {
+		time.Sleep(httpAdaptiveInterval)
+
+		if rate, changed := o.adaptive.adjust(); changed {
+			log.Printf("[OUTPUT-HTTP] %s: replaying %.0f%% of requests", o.address, rate*100)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHTTPAdaptiveThrottle(t *testing.T) {
+	a := newHTTPAdaptiveThrottle(100*time.Millisecond, 0.1)
+
+	// Healthy
+	a.observe(10*time.Millisecond, false)
+	if rate, changed := a.adjust(); rate != 1 || changed {
+		t.Error("Should not throttle healthy server:", rate)
+	}
+
+	// Slow
+	a.observe(300*time.Millisecond, false)
+	a.observe(10*time.Millisecond, false)
+	if rate, _ := a.adjust(); rate != 0.5 {
+		t.Error("Should throttle slow server:", rate)
+	}
+
+	// Failing
+	for i := 0; i < 10; i++ {
+		a.observe(time.Millisecond, i < 2)
+	}
+	if rate, _ := a.adjust(); rate != 0.25 {
+		t.Error("Should throttle failing server:", rate)
+	}
+
+	for i := 0; i < 10; i++ {
+		a.observe(time.Millisecond, true)
+		a.adjust()
+	}
+	if a.rate != httpAdaptiveMinRate {
+		t.Error("Should keep minimal rate:", a.rate)
+	}
+
+	// Without responses rate is restored
+	for i := 0; i < 30; i++ {
+		a.adjust()
+	}
+	if a.rate != 1 || !a.allow() {
+		t.Error("Should restore rate:", a.rate)
+	}
+}
+
+func TestHTTPAdaptiveThrottleAllow(t *testing.T) {
+	a := newHTTPAdaptiveThrottle(0, 0.1)
+	a.rate = 0.2
+
+	allowed := 0
+	for i := 0; i < 10000; i++ {
+		if a.allow() {
+			allowed++
+		}
+	}
+
+	if allowed < 1500 || allowed > 2500 {
+		t.Error("Should allow fraction of requests:", allowed)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buger/gor/proto"
+)
+
+// Strategies of distributing requests between upstreams of HTTP output
+const (
+	httpBalanceRoundRobin   = "roundrobin"
+	httpBalanceLeastPending = "least-pending"
+	httpBalanceHash         = "hash"
+)
+
+// Number of points of each upstream on consistent hashing ring
+const httpBalanceReplicas = 100
+
+// httpUpstream is one of servers requests of HTTP output are replayed to
+type httpUpstream struct {
+	// Keep first for 64bit alignment required by atomic. Number of requests being sent to upstream.
+	pending int64
+	// Set when upstream is removed by discovery
+	removed int32
+
+	address string
+	pool    *httpConnPool
+	// Client shared by workers, if requests are replayed over HTTP/2 or HTTP/3
+	transport *httpTransportClient
+}
+
+// newHTTPUpstream creates upstream with given address, which can set protocol by its scheme
+func newHTTPUpstream(address string, config *HTTPOutputConfig, clientConfig *HTTPClientConfig) (*httpUpstream, error) {
+	u := &httpUpstream{}
+
+	protocol := config.Protocol
+	u.address, protocol = parseHTTPOutputAddress(address, protocol)
+
+	if protocol != "" && protocol != httpProtocolHTTP1 {
+		var err error
+		if u.transport, err = newHTTPTransportClient(u.address, protocol, clientConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	u.pool = newHTTPConnPool(config.MaxIdleConns, config.MaxConnsPerHost, config.IdleConnTimeout)
+
+	return u, nil
+}
+
+// client returns client of worker sending requests to upstream
+func (u *httpUpstream) client(config *HTTPClientConfig) httpSender {
+	if u.transport != nil {
+		return u.transport
+	}
+
+	c := NewHTTPClient(u.address, config)
+	c.pool = u.pool
+
+	return c
+}
+
+// close closes connections of upstream removed by discovery. Requests being sent are completed.
+func (u *httpUpstream) close() {
+	atomic.StoreInt32(&u.removed, 1)
+
+	u.pool.Close()
+	if u.transport != nil {
+		u.transport.Close()
+	}
+}
+
+func (u *httpUpstream) isRemoved() bool {
+	return atomic.LoadInt32(&u.removed) == 1
+}
+
+type httpRingPoint struct {
+	hash     uint32
+	upstream int
+}
+
+// Kinds of request keys of hash balancing
+const (
+	httpBalanceKeyHeader = "header"
+	httpBalanceKeyCookie = "cookie"
+	// Client IP: the first address of X-Forwarded-For header, or address request was captured from
+	httpBalanceKeyIP = "ip"
+)
+
+type httpBalanceKey struct {
+	kind string
+	name []byte
+}
+
+// httpBalancer picks upstream for each request: in turn, the one with fewest pending requests, or by
+// consistent hash of request header, cookie or client IP, so requests of the same session go to the same
+// upstream, and only sessions of removed upstream move when list of upstreams changes. Keys are tried in
+// order, and requests without any of them are distributed in turn.
+type httpBalancer struct {
+	// Keep first for 64bit alignment required by atomic
+	next uint64
+
+	strategy string
+	keys     []httpBalanceKey
+
+	// Guards upstreams, which are changed by discovery
+	mu        sync.RWMutex
+	upstreams []*httpUpstream
+	ring      []httpRingPoint
+}
+
+// newHTTPBalancer creates balancer with given strategy. Keys of hash strategy are comma separated list of
+// "header:<name>", "cookie:<name>" and "ip". Hash strategy is used by default if keys are set.
+func newHTTPBalancer(strategy, keys string, upstreams []*httpUpstream) (*httpBalancer, error) {
+	if strategy == "" && keys != "" {
+		strategy = httpBalanceHash
+	}
+
+	b := &httpBalancer{strategy: strategy}
+
+	switch strategy {
+	case "", httpBalanceRoundRobin, httpBalanceLeastPending:
+	case httpBalanceHash:
+		if err := b.parseKeys(keys); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown HTTP output balancing strategy: %s", strategy)
+	}
+
+	b.update(upstreams)
+
+	return b, nil
+}
+
+func (b *httpBalancer) parseKeys(keys string) error {
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+
+		kind, name := key, ""
+		if i := strings.IndexByte(key, ':'); i != -1 {
+			kind, name = key[:i], key[i+1:]
+		}
+
+		switch {
+		case kind == httpBalanceKeyIP && name == "":
+		case (kind == httpBalanceKeyHeader || kind == httpBalanceKeyCookie) && name != "":
+		default:
+			return fmt.Errorf("Balancing key should be header:<name>, cookie:<name> or ip, got: %q", key)
+		}
+
+		b.keys = append(b.keys, httpBalanceKey{kind, []byte(name)})
+	}
+
+	return nil
+}
+
+// update replaces upstreams requests are distributed between
+func (b *httpBalancer) update(upstreams []*httpUpstream) {
+	var ring []httpRingPoint
+	if b.strategy == httpBalanceHash {
+		for i, u := range upstreams {
+			for r := 0; r < httpBalanceReplicas; r++ {
+				ring = append(ring, httpRingPoint{hashKey([]byte(u.address + "#" + strconv.Itoa(r))), i})
+			}
+		}
+		sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	}
+
+	b.mu.Lock()
+	b.upstreams, b.ring = upstreams, ring
+	b.mu.Unlock()
+}
+
+// list returns current upstreams
+func (b *httpBalancer) list() []*httpUpstream {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.upstreams
+}
+
+// hashKey returns FNV-1a hash of key, mixed so similar keys, like addresses of upstreams, are spread over the ring
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+
+	return x
+}
+
+// pick returns upstream for request payload, with given HTTP body, or nil if there are no upstreams
+func (b *httpBalancer) pick(request, body []byte) *httpUpstream {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	switch len(b.upstreams) {
+	case 0:
+		return nil
+	case 1:
+		return b.upstreams[0]
+	}
+
+	switch b.strategy {
+	case httpBalanceLeastPending:
+		// Ties are resolved in turn, so idle upstreams get equal share
+		start := int(atomic.AddUint64(&b.next, 1) % uint64(len(b.upstreams)))
+		best := b.upstreams[start]
+		for i := 1; i < len(b.upstreams); i++ {
+			u := b.upstreams[(start+i)%len(b.upstreams)]
+			if atomic.LoadInt64(&u.pending) < atomic.LoadInt64(&best.pending) {
+				best = u
+			}
+		}
+		return best
+	case httpBalanceHash:
+		if key := b.requestKey(request, body); len(key) > 0 {
+			hash := hashKey(key)
+			i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+			if i == len(b.ring) {
+				i = 0
+			}
+			return b.upstreams[b.ring[i].upstream]
+		}
+	}
+
+	return b.upstreams[(atomic.AddUint64(&b.next, 1)-1)%uint64(len(b.upstreams))]
+}
+
+// requestKey returns value of the first key request has. Value is prefixed by kind of key, so
+// cookie and header with the same value are not mixed.
+func (b *httpBalancer) requestKey(request, body []byte) []byte {
+	for _, key := range b.keys {
+		var value []byte
+
+		switch key.kind {
+		case httpBalanceKeyHeader:
+			value = proto.Header(body, key.name)
+		case httpBalanceKeyCookie:
+			value = requestCookie(body, key.name)
+		case httpBalanceKeyIP:
+			value = clientIP(request, body)
+		}
+
+		if len(value) > 0 {
+			return append([]byte(key.kind+":"), value...)
+		}
+	}
+
+	return nil
+}
+
+// requestCookie returns value of request cookie with given name
+func requestCookie(body, name []byte) []byte {
+	for _, cookie := range bytes.Split(proto.Header(body, []byte("Cookie")), []byte(";")) {
+		cookie = bytes.TrimSpace(cookie)
+		if i := bytes.IndexByte(cookie, '='); i != -1 && bytes.Equal(cookie[:i], name) {
+			return cookie[i+1:]
+		}
+	}
+
+	return nil
+}
+
+// clientIP returns IP of client which sent request: the first address of X-Forwarded-For header, set
+// by proxies in front of captured server, or source address of captured request
+func clientIP(request, body []byte) []byte {
+	if forwarded := proto.Header(body, []byte("X-Forwarded-For")); len(forwarded) > 0 {
+		if i := bytes.IndexByte(forwarded, ','); i != -1 {
+			forwarded = forwarded[:i]
+		}
+		return bytes.TrimSpace(forwarded)
+	}
+
+	src := payloadMetaValue(request, payloadSrcKey)
+	if host, _, err := net.SplitHostPort(string(src)); err == nil {
+		return []byte(host)
+	}
+
+	return src
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputBalance(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	counts := make([]int64, 3)
+
+	var addresses string
+	for i := range counts {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&counts[i], 1)
+			wg.Done()
+		}))
+		defer server.Close()
+
+		if i > 0 {
+			addresses += ","
+		}
+		addresses += server.URL
+	}
+
+	output := NewHTTPOutput(addresses, &HTTPOutputConfig{workers: 1})
+
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		output.Write([]byte("1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	wg.Wait()
+
+	for i, c := range counts {
+		if c != 3 {
+			t.Errorf("Upstream %d should receive 3 requests, got %d", i, c)
+		}
+	}
+}
+
+func newTestUpstreams(addresses ...string) []*httpUpstream {
+	var upstreams []*httpUpstream
+	for _, addr := range addresses {
+		upstreams = append(upstreams, &httpUpstream{address: addr})
+	}
+	return upstreams
+}
+
+func TestHTTPBalancerLeastPending(t *testing.T) {
+	upstreams := newTestUpstreams("a", "b", "c")
+	b, _ := newHTTPBalancer(httpBalanceLeastPending, "", upstreams)
+
+	upstreams[0].pending = 2
+	upstreams[2].pending = 1
+
+	for i := 0; i < 3; i++ {
+		if u := b.pick(nil, nil); u != upstreams[1] {
+			t.Errorf("Should pick upstream with fewest pending requests, got %s", u.address)
+		}
+	}
+
+	upstreams[0].pending, upstreams[1].pending = 1, 1
+	picked := map[string]int{}
+	for i := 0; i < 6; i++ {
+		picked[b.pick(nil, nil).address]++
+	}
+	if picked["a"] != 2 || picked["b"] != 2 || picked["c"] != 2 {
+		t.Errorf("Ties should be picked in turn: %v", picked)
+	}
+}
+
+func TestHTTPBalancerHash(t *testing.T) {
+	upstreams := newTestUpstreams("a", "b", "c")
+
+	if _, err := newHTTPBalancer(httpBalanceHash, "session", upstreams); err == nil {
+		t.Error("Should reject key without type")
+	}
+	if _, err := newHTTPBalancer("random", "", upstreams); err == nil {
+		t.Error("Should reject unknown strategy")
+	}
+
+	b, err := newHTTPBalancer(httpBalanceHash, "cookie:sid", upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(sid int) []byte {
+		return []byte("GET / HTTP/1.1\r\nCookie: lang=en; sid=" + strconv.Itoa(sid) + "\r\n\r\n")
+	}
+
+	picked := map[*httpUpstream]int{}
+	for sid := 0; sid < 300; sid++ {
+		u := b.pick(nil, request(sid))
+		if b.pick(nil, request(sid)) != u {
+			t.Fatal("Requests of the same session should be sent to the same upstream")
+		}
+		picked[u]++
+	}
+
+	for _, u := range upstreams {
+		if picked[u] < 50 {
+			t.Errorf("Sessions should be spread between upstreams: %s got %d", u.address, picked[u])
+		}
+	}
+
+	// Only sessions of removed upstream move
+	reduced, _ := newHTTPBalancer(httpBalanceHash, "cookie:sid", upstreams[:2])
+	for sid := 0; sid < 300; sid++ {
+		if u := b.pick(nil, request(sid)); u != upstreams[2] && reduced.pick(nil, request(sid)) != u {
+			t.Fatal("Session moved to another upstream:", sid)
+		}
+	}
+
+	// Requests without key are distributed in turn
+	header, _ := newHTTPBalancer(httpBalanceHash, "header:X-User", upstreams)
+	if header.pick(nil, []byte("GET / HTTP/1.1\r\n\r\n")) == header.pick(nil, []byte("GET / HTTP/1.1\r\n\r\n")) {
+		t.Error("Requests without key should be picked in turn")
+	}
+	if header.pick(nil, []byte("GET / HTTP/1.1\r\nX-User: 1\r\n\r\n")) != header.pick(nil, []byte("GET / HTTP/1.1\r\nX-User: 1\r\n\r\n")) {
+		t.Error("Should hash by header")
+	}
+}
+
+func TestHTTPOutputBalancePending(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	var fast int64
+	fastServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fast, 1)
+	}))
+	defer fastServer.Close()
+
+	output := NewHTTPOutput(slow.URL+","+fastServer.URL, &HTTPOutputConfig{workers: 4, Balance: httpBalanceLeastPending})
+
+	for i := 0; i < 10; i++ {
+		output.Write([]byte("1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\n\r\n"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Only the first request is stuck on slow upstream
+	if n := atomic.LoadInt64(&fast); n < 8 {
+		t.Errorf("Requests should be sent to upstream with fewer pending requests, fast one got %d", n)
+	}
+}
+
+func TestHTTPBalancerSessionAffinity(t *testing.T) {
+	upstreams := newTestUpstreams("a", "b", "c", "d")
+
+	b, err := newHTTPBalancer("", "cookie:sid, ip", upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(src string) []byte {
+		header := payloadHeader(RequestPayload, []byte(src), 1)
+		header = appendPayloadMeta(header, payloadSrcKey, []byte(src))
+		return header
+	}
+
+	// Requests of client without session cookie go to the same upstream, regardless of client port
+	for i := 0; i < 50; i++ {
+		ip := "10.0.0." + strconv.Itoa(i)
+		u := b.pick(request(ip+":1000"), []byte("GET / HTTP/1.1\r\n\r\n"))
+		if b.pick(request(ip+":2000"), []byte("GET /a HTTP/1.1\r\n\r\n")) != u {
+			t.Fatal("Requests of the same client IP should be sent to the same upstream")
+		}
+		if b.pick(request("192.168.0.1:1000"), []byte("GET / HTTP/1.1\r\nX-Forwarded-For: "+ip+", 192.168.0.2\r\n\r\n")) != u {
+			t.Fatal("Client IP should be taken from X-Forwarded-For")
+		}
+	}
+
+	// Session cookie takes priority over client IP
+	for sid := 0; sid < 50; sid++ {
+		body := []byte("GET / HTTP/1.1\r\nCookie: sid=" + strconv.Itoa(sid) + "\r\n\r\n")
+		u := b.pick(request("10.0.0.1:1000"), body)
+		for i := 2; i < 10; i++ {
+			if b.pick(request("10.0.0."+strconv.Itoa(i)+":1000"), body) != u {
+				t.Fatal("Requests of the same session should be sent to the same upstream")
+			}
+		}
+	}
+
+	if _, err := newHTTPBalancer("", "ip:x", upstreams); err == nil {
+		t.Error("Should reject ip key with name")
+	}
+}
+
+func TestHTTPOutputSessionAffinity(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	// Upstreams session requests were sent to
+	sessions := map[string]map[int]bool{}
+
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, _ := r.Cookie("sid")
+			mu.Lock()
+			if sessions[c.Value] == nil {
+				sessions[c.Value] = map[int]bool{}
+			}
+			sessions[c.Value][i] = true
+			mu.Unlock()
+			wg.Done()
+		}))
+		defer server.Close()
+		addresses = append(addresses, server.URL)
+	}
+
+	output := NewHTTPOutput(strings.Join(addresses, ","), &HTTPOutputConfig{workers: 4, BalanceKey: "cookie:sid"})
+
+	for i := 0; i < 60; i++ {
+		wg.Add(1)
+		output.Write([]byte("1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\nCookie: sid=" + strconv.Itoa(i%10) + "\r\n\r\n"))
+	}
+
+	wg.Wait()
+
+	for sid, upstreams := range sessions {
+		if len(upstreams) != 1 {
+			t.Errorf("Session %s was sent to several upstreams: %v", sid, upstreams)
+		}
+	}
+}
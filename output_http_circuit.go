@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Error rate of circuit breaker is measured in windows of given duration, with at least given number of requests
+const (
+	httpCircuitWindow      = 10 * time.Second
+	httpCircuitMinRequests = 20
+)
+
+const (
+	httpCircuitClosed = iota
+	httpCircuitOpen
+	httpCircuitHalfOpen
+)
+
+// httpCircuitBreaker stops replay to unhealthy server. Circuit opens after number of consecutive failed
+// requests, or when error rate crosses threshold. While it is open, requests are not sent. After probe
+// interval single request is sent as a probe: circuit closes if it succeeds, and stays open otherwise.
+type httpCircuitBreaker struct {
+	maxFailures   int
+	maxErrorRate  float64
+	probeInterval time.Duration
+
+	mu    sync.Mutex
+	state int
+	// Consecutive failures, and requests of the current window
+	failures    int
+	requests    int
+	failed      int
+	windowStart time.Time
+	openedAt    time.Time
+}
+
+func newHTTPCircuitBreaker(maxFailures int, maxErrorRate float64, probeInterval time.Duration) *httpCircuitBreaker {
+	return &httpCircuitBreaker{
+		maxFailures:   maxFailures,
+		maxErrorRate:  maxErrorRate,
+		probeInterval: probeInterval,
+		windowStart:   time.Now(),
+	}
+}
+
+// allow checks if request can be sent. Request allowed when circuit is open becomes the probe.
+func (b *httpCircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case httpCircuitClosed:
+		return true
+	case httpCircuitOpen:
+		if time.Now().Sub(b.openedAt) >= b.probeInterval {
+			b.state = httpCircuitHalfOpen
+			return true
+		}
+	}
+
+	return false
+}
+
+// record records result of sent request. Returns true if circuit was opened after failures, or closed
+// by successful probe, and its new state.
+func (b *httpCircuitBreaker) record(failed bool) (state int, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case httpCircuitOpen:
+		// Response of request sent before circuit opened
+		return b.state, false
+	case httpCircuitHalfOpen:
+		if failed {
+			b.open()
+			return b.state, false
+		}
+
+		b.state = httpCircuitClosed
+		b.failures, b.requests, b.failed = 0, 0, 0
+		b.windowStart = time.Now()
+
+		return b.state, true
+	}
+
+	if now := time.Now(); now.Sub(b.windowStart) > httpCircuitWindow {
+		b.requests, b.failed = 0, 0
+		b.windowStart = now
+	}
+
+	b.requests++
+	if failed {
+		b.failures++
+		b.failed++
+	} else {
+		b.failures = 0
+	}
+
+	if (b.maxFailures > 0 && b.failures >= b.maxFailures) ||
+		(b.maxErrorRate > 0 && b.requests >= httpCircuitMinRequests && float64(b.failed)/float64(b.requests) > b.maxErrorRate) {
+		b.open()
+		return b.state, true
+	}
+
+	return b.state, false
+}
+
+// open opens circuit. Must be called with mu held.
+func (b *httpCircuitBreaker) open() {
+	b.state = httpCircuitOpen
+	b.openedAt = time.Now()
+}
+
+func (b *httpCircuitBreaker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == httpCircuitClosed
+}
+
+// httpSpool stores requests not sent while circuit is open, in the format of file output
+type httpSpool struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (s *httpSpool) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		var err error
+		if s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	_, err := s.file.Write([]byte(payloadSeparator))
+
+	return err
+}
+
+// take moves spooled requests to separate file, so new ones can be spooled while it is read.
+// Returns name of the file, or empty string if there are no spooled requests.
+func (s *httpSpool) take() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	// File left by interrupted drain is read first
+	name := s.path + ".drain"
+	if _, err := os.Stat(name); err == nil {
+		return name
+	}
+
+	if err := os.Rename(s.path, name); err != nil {
+		return ""
+	}
+
+	return name
+}
+
+// spool stores request not sent because circuit is open, or drops it if spool is not set
+func (o *HTTPOutput) spool(request []byte) {
+	if o.spooler == nil {
+		atomic.AddUint64(&o.stats.Dropped, 1)
+		return
+	}
+
+	if err := o.spooler.write(request); err != nil {
+		log.Println("[OUTPUT-HTTP] Can't spool request:", err)
+		atomic.AddUint64(&o.stats.Dropped, 1)
+		return
+	}
+
+	atomic.AddUint64(&o.stats.Spooled, 1)
+}
+
+// drainSpool queues spooled requests again, while circuit is closed
+func (o *HTTPOutput) drainSpool() {
+	if !atomic.CompareAndSwapInt32(&o.draining, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&o.draining, 0)
+
+	for o.breaker.isClosed() {
+		name := o.spooler.take()
+		if name == "" {
+			return
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			log.Println("[OUTPUT-HTTP] Can't read spool:", err)
+			return
+		}
+
+		r, err := newFileInputReader(name, file, 0, 0)
+		if err != nil {
+			log.Println("[OUTPUT-HTTP] Can't read spool:", err)
+			return
+		}
+
+		count := 0
+		for r.next() {
+			// Requests are spooled again if circuit opens meanwhile
+			o.queue <- r.payload
+			count++
+		}
+		r.close()
+		os.Remove(name)
+
+		log.Printf("[OUTPUT-HTTP] %s: %d spooled requests queued", o.address, count)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPCircuitBreaker(t *testing.T) {
+	b := newHTTPCircuitBreaker(3, 0, 20*time.Millisecond)
+
+	b.record(true)
+	b.record(true)
+	b.record(false)
+	b.record(true)
+	if _, changed := b.record(true); changed || !b.allow() {
+		t.Error("Should open only after consecutive failures")
+	}
+
+	if state, changed := b.record(true); !changed || state != httpCircuitOpen || b.allow() {
+		t.Error("Should open circuit")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() || b.allow() {
+		t.Error("Should allow single probe")
+	}
+
+	// Failed probe
+	if _, changed := b.record(true); changed || b.allow() {
+		t.Error("Should stay open after failed probe")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	if state, changed := b.record(false); !changed || state != httpCircuitClosed || !b.allow() {
+		t.Error("Should close after successful probe")
+	}
+}
+
+func TestHTTPCircuitBreakerErrorRate(t *testing.T) {
+	b := newHTTPCircuitBreaker(0, 0.5, time.Second)
+
+	for i := 0; i < httpCircuitMinRequests-1; i++ {
+		b.record(i%3 != 0)
+	}
+	if !b.isClosed() {
+		t.Error("Should wait for minimum number of requests")
+	}
+
+	if _, changed := b.record(true); !changed || b.isClosed() {
+		t.Error("Should open when error rate is exceeded")
+	}
+}
+
+func TestHTTPOutputCircuitSpool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_circuit")
+	defer os.RemoveAll(dir)
+
+	var healthy int32
+	var mu sync.Mutex
+	var received []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(503)
+			return
+		}
+
+		mu.Lock()
+		received = append(received, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{
+		workers:              1,
+		CircuitFailures:      2,
+		CircuitProbeInterval: 100 * time.Millisecond,
+		CircuitSpool:         filepath.Join(dir, "spool.gor"),
+	}).(*HTTPOutput)
+
+	for i := 0; i < 5; i++ {
+		o.Write(append(payloadHeader(RequestPayload, uuid(), 1), "GET /"+string('a'+byte(i))+" HTTP/1.1\r\n\r\n"...))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if s := o.Stats(); s.CircuitOpened != 1 || s.Spooled != 3 {
+		t.Fatalf("Should spool requests while circuit is open: %+v", s)
+	}
+
+	// Next request after probe interval is sent as probe
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(100 * time.Millisecond)
+	o.Write(append(payloadHeader(RequestPayload, uuid(), 1), "GET /probe HTTP/1.1\r\n\r\n"...))
+
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(received, ",") != "/probe,/c,/d,/e" {
+		t.Error("Should replay spooled requests once circuit closes:", received)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// originalResponse stores response payload tracked by input, for comparison with replayed one
+func (o *HTTPOutput) originalResponse(data []byte) {
+	meta := payloadMeta(data)
+	if len(meta) < 2 {
+		return
+	}
+
+	body := payloadBody(data)
+	original := make([]byte, len(body))
+	copy(original, body)
+
+	o.compareResponses(o.matcher.add(meta[1], nil, original, nil))
+}
+
+// compareResponses compares original response of request with replayed one, once both are received
+func (o *HTTPOutput) compareResponses(c *responsePair) {
+	if c == nil {
+		return
+	}
+
+	atomic.AddUint64(&o.stats.Compared, 1)
+
+	diffs := o.comparator.compare(c.original.([]byte), c.replayed.([]byte))
+	if len(diffs) == 0 {
+		return
+	}
+
+	atomic.AddUint64(&o.stats.Mismatched, 1)
+	o.comparator.record(responseMismatch{Time: time.Now(), ID: c.id, Request: string(c.request), Diffs: diffs})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputCompareResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"user": "` + r.URL.Query().Get("user") + `", "version": 2, "at": "` + time.Now().Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "gor_compare")
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.jsonl")
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workers: 1, CompareReport: report, CompareIgnoreJSONPaths: MultiOption{"version"}}).(*HTTPOutput)
+
+	original := "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n"
+
+	// Original response is received before, or after replayed one
+	output.Write([]byte("2 a 1\n" + original + `{"user": "1", "version": 1, "at": "2020-01-01T00:00:00Z"}`))
+	output.Write([]byte("1 a 1\nGET /?user=1 HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 b 1\nGET /?user=2 HTTP/1.1\r\n\r\n"))
+
+	replayed := func() bool {
+		output.matcher.mu.Lock()
+		defer output.matcher.mu.Unlock()
+
+		c := output.matcher.pending["b"]
+		return c != nil && c.replayed != nil
+	}
+	for i := 0; i < 100 && !replayed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.Write([]byte("2 b 1\n" + original + `{"user": "3", "version": 1, "at": "2020-01-01T00:00:00Z"}`))
+
+	for i := 0; i < 100 && output.Stats().Compared < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s := output.Stats(); s.Compared != 2 || s.Mismatched != 1 {
+		t.Fatalf("Wrong stats: %+v", s)
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m responseMismatch
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.ID != "b" || !strings.HasPrefix(m.Request, "GET /?user=2") {
+		t.Errorf("Should record originating request: %+v", m)
+	}
+
+	if len(m.Diffs) != 1 || m.Diffs[0] != (responseDiff{"body.user", "3", "2"}) {
+		t.Errorf("Wrong differences: %+v", m.Diffs)
+	}
+}
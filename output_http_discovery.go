@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of upstreams discovered by HTTP output, selected by address scheme
+const (
+	// DNS SRV records: srv://_http._tcp.staging.example.com
+	httpDiscoverySRV = "srv"
+	// Healthy instances of Consul service: consul://consul.example.com:8500/staging-api?tag=v2
+	httpDiscoveryConsul = "consul"
+	// Ready addresses of Kubernetes service endpoints: k8s://namespace/service or k8s://namespace/service:port
+	httpDiscoveryKubernetes = "k8s"
+)
+
+// Credentials of the pod service account, when running inside cluster
+var kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// lookupSRV resolves SRV records, replaced in tests
+var lookupSRV = net.LookupSRV
+
+// httpDiscovery resolves addresses of upstreams from DNS SRV records, Consul service or Kubernetes endpoints
+type httpDiscovery struct {
+	address string
+	kind    string
+	// Scheme of discovered upstreams, "https" if discovery scheme has "+https" suffix
+	scheme string
+
+	// SRV name, Consul service, or Kubernetes namespace and service
+	name      string
+	namespace string
+	// Consul service tag, or name or number of Kubernetes service port
+	filter string
+
+	// Address of Consul or Kubernetes API
+	api    string
+	client *http.Client
+
+	// Addresses of the last successful resolution, kept if discovery fails
+	last []string
+}
+
+// parseHTTPDiscovery returns discovery of upstreams set by address scheme, or nil if address is static
+func parseHTTPDiscovery(address string, config *HTTPOutputConfig) (*httpDiscovery, error) {
+	i := strings.Index(address, "://")
+	if i == -1 {
+		return nil, nil
+	}
+
+	d := &httpDiscovery{address: address, kind: address[:i], scheme: "http"}
+	if strings.HasSuffix(d.kind, "+https") {
+		d.kind, d.scheme = strings.TrimSuffix(d.kind, "+https"), "https"
+	}
+
+	switch d.kind {
+	case httpDiscoverySRV, httpDiscoveryConsul, httpDiscoveryKubernetes:
+	default:
+		return nil, nil
+	}
+
+	u, err := url.Parse("http" + address[i:])
+	if err != nil {
+		return nil, err
+	}
+
+	d.client = &http.Client{Timeout: 10 * time.Second}
+
+	switch d.kind {
+	case httpDiscoverySRV:
+		d.name = u.Host
+	case httpDiscoveryConsul:
+		d.api = "http://" + u.Host
+		d.name = strings.Trim(u.Path, "/")
+		d.filter = u.Query().Get("tag")
+	case httpDiscoveryKubernetes:
+		d.namespace = u.Host
+		d.name = strings.Trim(u.Path, "/")
+		if j := strings.IndexByte(d.name, ':'); j != -1 {
+			d.name, d.filter = d.name[:j], d.name[j+1:]
+		}
+
+		if err := d.kubernetesClient(config.DiscoveryKubernetesAPI); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.name == "" {
+		return nil, fmt.Errorf("Service name is missing in discovery address: %s", address)
+	}
+
+	return d, nil
+}
+
+// kubernetesClient sets API address, and CA certificates of service account, when running inside cluster
+func (d *httpDiscovery) kubernetesClient(api string) error {
+	d.api = api
+
+	if d.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("Kubernetes API address is unknown: KUBERNETES_SERVICE_HOST is not set, Gor is not running inside cluster")
+		}
+
+		d.api = "https://" + net.JoinHostPort(host, port)
+	}
+
+	if ca, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt")); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		d.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	return nil
+}
+
+// resolve returns sorted addresses of discovered upstreams, like "http://10.0.0.1:8080"
+func (d *httpDiscovery) resolve() (addresses []string, err error) {
+	var hosts []string
+
+	switch d.kind {
+	case httpDiscoverySRV:
+		hosts, err = d.resolveSRV()
+	case httpDiscoveryConsul:
+		hosts, err = d.resolveConsul()
+	case httpDiscoveryKubernetes:
+		hosts, err = d.resolveKubernetes()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, host := range hosts {
+		addresses = append(addresses, d.scheme+"://"+host)
+	}
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
+
+func (d *httpDiscovery) resolveSRV() (hosts []string, err error) {
+	_, records, err := lookupSRV("", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, srv := range records {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+
+	return hosts, nil
+}
+
+// get requests discovery API, and decodes JSON response
+func (d *httpDiscovery) get(req *http.Request, v interface{}) error {
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Discovery API error: %s %s", resp.Status, body)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+func (d *httpDiscovery) resolveConsul() (hosts []string, err error) {
+	query := url.Values{"passing": {"true"}}
+	if d.filter != "" {
+		query.Set("tag", d.filter)
+	}
+
+	req, err := http.NewRequest("GET", d.api+"/v1/health/service/"+url.PathEscape(d.name)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	var entries []consulServiceEntry
+	if err := d.get(req, &entries); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		// Service address is empty if it is the same as node one
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		hosts = append(hosts, net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)))
+	}
+
+	return hosts, nil
+}
+
+type kubernetesEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+func (d *httpDiscovery) resolveKubernetes() (hosts []string, err error) {
+	req, err := http.NewRequest("GET", d.api+"/api/v1/namespaces/"+url.PathEscape(d.namespace)+"/endpoints/"+url.PathEscape(d.name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Token is re-read on each request, because projected tokens are rotated
+	if token, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "token")); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	var endpoints kubernetesEndpoints
+	if err := d.get(req, &endpoints); err != nil {
+		return nil, err
+	}
+
+	for _, subset := range endpoints.Subsets {
+		port := 0
+		for _, p := range subset.Ports {
+			if d.filter == "" || p.Name == d.filter || strconv.Itoa(p.Port) == d.filter {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		// Only ready addresses are listed in "addresses"
+		for _, a := range subset.Addresses {
+			hosts = append(hosts, net.JoinHostPort(a.IP, strconv.Itoa(port)))
+		}
+	}
+
+	return hosts, nil
+}
+
+// refreshUpstreams resolves discovered upstreams, and updates set of upstreams requests are distributed
+// between. Upstreams which are still discovered keep their connections.
+func (o *HTTPOutput) refreshUpstreams() {
+	var addresses []string
+	for _, d := range o.discoveries {
+		found, err := d.resolve()
+		if err != nil {
+			log.Printf("[OUTPUT-HTTP] Can't discover upstreams of %s: %v", d.address, err)
+			found = d.last
+		}
+		d.last = found
+		addresses = append(addresses, found...)
+	}
+
+	current := make(map[string]*httpUpstream)
+	for _, u := range o.balancer.list() {
+		current[u.address] = u
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range o.static {
+		delete(current, u.address)
+		seen[u.address] = true
+	}
+
+	upstreams := append([]*httpUpstream{}, o.static...)
+	added := 0
+	for _, addr := range addresses {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		if u, ok := current[addr]; ok {
+			upstreams = append(upstreams, u)
+			delete(current, addr)
+			continue
+		}
+
+		u, err := newHTTPUpstream(addr, o.config, o.clientConfig())
+		if err != nil {
+			log.Printf("[OUTPUT-HTTP] Wrong discovered upstream %s: %v", addr, err)
+			continue
+		}
+		upstreams = append(upstreams, u)
+		added++
+	}
+
+	o.balancer.update(upstreams)
+
+	// Upstreams no longer discovered
+	for _, u := range current {
+		u.close()
+	}
+
+	if added > 0 || len(current) > 0 {
+		log.Printf("[OUTPUT-HTTP] %s: %d upstreams, %d added, %d removed", o.address, len(upstreams), added, len(current))
+	}
+}
+
+func (o *HTTPOutput) discoverUpstreams() {
+	for {
+		time.Sleep(o.config.DiscoveryInterval)
+		o.refreshUpstreams()
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPDiscoverySRV(t *testing.T) {
+	defer func(lookup func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = lookup }(lookupSRV)
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_http._tcp.staging.example.com" {
+			t.Errorf("Wrong SRV name: %s", name)
+		}
+		return name, []*net.SRV{{Target: "web2.example.com.", Port: 8080}, {Target: "web1.example.com.", Port: 8081}}, nil
+	}
+
+	d, err := parseHTTPDiscovery("srv+https://_http._tcp.staging.example.com", &HTTPOutputConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := d.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"https://web1.example.com:8081", "https://web2.example.com:8080"}; !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("Wrong addresses: %v", addresses)
+	}
+
+	if d, _ := parseHTTPDiscovery("http://staging.example.com", &HTTPOutputConfig{}); d != nil {
+		t.Error("Should not discover static address")
+	}
+}
+
+func TestHTTPDiscoveryKubernetes(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/staging/endpoints/web" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte(`{"subsets": [
+			{"addresses": [{"ip": "10.0.0.2"}, {"ip": "10.0.0.1"}], "notReadyAddresses": [{"ip": "10.0.0.3"}], "ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 8080}]},
+			{"addresses": [{"ip": "10.0.1.1"}], "ports": [{"name": "metrics", "port": 9090}]}
+		]}`))
+	}))
+	defer api.Close()
+
+	d, err := parseHTTPDiscovery("k8s://staging/web:http", &HTTPOutputConfig{DiscoveryKubernetesAPI: api.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := d.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}; !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("Wrong addresses: %v", addresses)
+	}
+
+	d, _ = parseHTTPDiscovery("k8s://staging/missing", &HTTPOutputConfig{DiscoveryKubernetesAPI: api.URL})
+	if _, err := d.resolve(); err == nil {
+		t.Error("Should return API error")
+	}
+}
+
+func TestHTTPOutputDiscoveryConsul(t *testing.T) {
+	var counts [2]int64
+	wg := new(sync.WaitGroup)
+
+	var backends []string
+	for i := range counts {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&counts[i], 1)
+			wg.Done()
+		}))
+		defer server.Close()
+
+		backends = append(backends, strings.TrimPrefix(server.URL, "http://"))
+	}
+
+	var mu sync.Mutex
+	healthy := backends[:1]
+
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" || r.URL.Query().Get("passing") != "true" || r.URL.Query().Get("tag") != "v2" {
+			http.NotFound(w, r)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var entries []string
+		for _, b := range healthy {
+			host, port, _ := net.SplitHostPort(b)
+			entries = append(entries, `{"Node": {"Address": "`+host+`"}, "Service": {"Address": "", "Port": `+port+`}}`)
+		}
+		w.Write([]byte("[" + strings.Join(entries, ",") + "]"))
+	}))
+	defer consul.Close()
+
+	address := "consul://" + strings.TrimPrefix(consul.URL, "http://") + "/web?tag=v2"
+	output := NewHTTPOutput(address, &HTTPOutputConfig{workers: 1, DiscoveryInterval: time.Hour}).(*HTTPOutput)
+
+	wg.Add(2)
+	output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 2 1\nGET / HTTP/1.1\r\n\r\n"))
+	wg.Wait()
+
+	// The first backend is replaced by the second one
+	mu.Lock()
+	healthy = backends[1:]
+	mu.Unlock()
+
+	removed := output.balancer.list()[0]
+	output.refreshUpstreams()
+
+	if !removed.isRemoved() {
+		t.Error("Upstream no longer discovered should be closed")
+	}
+
+	wg.Add(2)
+	output.Write([]byte("1 3 1\nGET / HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 4 1\nGET / HTTP/1.1\r\n\r\n"))
+	wg.Wait()
+
+	if atomic.LoadInt64(&counts[0]) != 2 || atomic.LoadInt64(&counts[1]) != 2 {
+		t.Errorf("Requests should follow discovered upstreams: %v", counts)
+	}
+
+	// Upstreams are kept while discovery fails
+	consul.Close()
+	output.refreshUpstreams()
+
+	if upstreams := output.balancer.list(); len(upstreams) != 1 || upstreams[0].address != "http://"+backends[1] {
+		t.Errorf("Should keep upstreams of the last discovery: %v", upstreams)
+	}
+}
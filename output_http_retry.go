@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Maximum number of retry tokens accumulated by successful requests
+const httpRetryBudgetMax = 10
+
+// httpRetryBudget limits retries to fraction of requests, so failing server is not overloaded by retries.
+// Every request adds fraction of token, up to httpRetryBudgetMax tokens, and every retry takes one.
+type httpRetryBudget struct {
+	mu       sync.Mutex
+	ratio    float64
+	tokens   float64
+	disabled bool
+}
+
+func newHTTPRetryBudget(ratio float64) *httpRetryBudget {
+	return &httpRetryBudget{ratio: ratio, tokens: httpRetryBudgetMax, disabled: ratio <= 0}
+}
+
+func (b *httpRetryBudget) request() {
+	b.mu.Lock()
+	b.tokens += b.ratio
+	if b.tokens > httpRetryBudgetMax {
+		b.tokens = httpRetryBudgetMax
+	}
+	b.mu.Unlock()
+}
+
+// retry takes token for retry, returns false if there are no tokens left
+func (b *httpRetryBudget) retry() bool {
+	if b.disabled {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// isFailedResponse checks if request should be retried: connection failed, or server responded with 5xx status
+func isFailedResponse(resp []byte, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	status := proto.Status(resp)
+	return len(status) == 3 && status[0] == '5'
+}
+
+// isTimeout checks if request failed because server didn't respond in time
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// retryBackoff returns delay before retry attempt, starting from 0: random duration up to exponentially
+// growing limit, so retries of concurrent requests are spread in time
+func (o *HTTPOutput) retryBackoff(attempt int) time.Duration {
+	limit := o.config.RetryBackoff
+	for i := 0; i < attempt && limit < o.config.RetryMaxBackoff; i++ {
+		limit *= 2
+	}
+	if limit > o.config.RetryMaxBackoff {
+		limit = o.config.RetryMaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// send sends request, retrying failed ones if retries are enabled. Returns response of the last attempt,
+// and when it was sent.
+func (o *HTTPOutput) send(client httpSender, body []byte) (resp []byte, start time.Time, err error) {
+	atomic.AddUint64(&o.stats.Requests, 1)
+	o.retryBudget.request()
+
+	start = time.Now()
+	resp, err = client.Send(body)
+
+	for attempt := 0; attempt < o.config.RetryAttempts && isFailedResponse(resp, err); attempt++ {
+		if !o.retryBudget.retry() {
+			atomic.AddUint64(&o.stats.RetryBudgetExceeded, 1)
+			break
+		}
+
+		if attempt == 0 {
+			atomic.AddUint64(&o.stats.Retried, 1)
+		}
+		atomic.AddUint64(&o.stats.Retries, 1)
+
+		time.Sleep(o.retryBackoff(attempt))
+
+		Debug("[OUTPUT-HTTP] Retrying request, attempt", attempt+1, err)
+
+		start = time.Now()
+		resp, err = client.Send(body)
+	}
+
+	if isTimeout(err) {
+		atomic.AddUint64(&o.stats.Timeouts, 1)
+	} else if isFailedResponse(resp, err) {
+		atomic.AddUint64(&o.stats.Failed, 1)
+	}
+
+	return
+}
+
+func (o *HTTPOutput) reportRetryStats() {
+	log.Println("output_http_retries:requests,failed,timeouts,retries,retried,budget_exceeded")
+
+	for {
+		time.Sleep(rate * time.Second)
+
+		s := o.Stats()
+		log.Printf("output_http_retries:%d,%d,%d,%d,%d,%d", s.Requests, s.Failed, s.Timeouts, s.Retries, s.Retried, s.RetryBudgetExceeded)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputRetry(t *testing.T) {
+	// Number of requests failed before server recovers
+	failures := int64(2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&failures, -1) >= 0 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{RetryAttempts: 2, RetryBackoff: time.Millisecond, workers: 1}).(*HTTPOutput)
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+
+	resp, _, err := o.send(client, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if err != nil || !bytes.HasPrefix(resp, []byte("HTTP/1.1 200")) {
+		t.Errorf("Should succeed after retries: %q %v", resp, err)
+	}
+
+	// Retries are exhausted
+	atomic.StoreInt64(&failures, 3)
+	resp, _, _ = o.send(client, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.1 503")) {
+		t.Errorf("Should return last response: %q", resp)
+	}
+
+	if s := o.Stats(); s != (HTTPOutputStats{Requests: 2, Failed: 1, Retries: 4, Retried: 2}) {
+		t.Errorf("Wrong stats: %+v", s)
+	}
+}
+
+func TestHTTPRetryBudget(t *testing.T) {
+	b := newHTTPRetryBudget(0.5)
+
+	for i := 0; i < httpRetryBudgetMax; i++ {
+		if !b.retry() {
+			t.Fatal("Should allow retries up to initial budget")
+		}
+	}
+
+	if b.retry() {
+		t.Error("Should exhaust budget")
+	}
+
+	b.request()
+	b.request()
+	if !b.retry() || b.retry() {
+		t.Error("Two requests should allow single retry")
+	}
+
+	if b = newHTTPRetryBudget(0); !b.retry() {
+		t.Error("Should not limit retries")
+	}
+}
+
+func TestHTTPOutputRetryBackoff(t *testing.T) {
+	o := &HTTPOutput{config: &HTTPOutputConfig{RetryBackoff: 10 * time.Millisecond, RetryMaxBackoff: 50 * time.Millisecond}}
+
+	for attempt, limit := range []time.Duration{10, 20, 40, 50, 50} {
+		for i := 0; i < 100; i++ {
+			if d := o.retryBackoff(attempt); d < 0 || d > limit*time.Millisecond {
+				t.Fatalf("Wrong backoff of attempt %d: %s", attempt, d)
+			}
+		}
+	}
+}
+
+func TestHTTPOutputTimeoutStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if r.URL.Path == "/error" {
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{ResponseHeaderTimeout: 20 * time.Millisecond, workers: 1}).(*HTTPOutput)
+	client := NewHTTPClient(server.URL, o.clientConfig())
+
+	o.send(client, []byte("GET /slow HTTP/1.1\r\n\r\n"))
+	o.send(client, []byte("GET /error HTTP/1.1\r\n\r\n"))
+	o.send(client, []byte("GET / HTTP/1.1\r\n\r\n"))
+
+	if s := o.Stats(); s != (HTTPOutputStats{Requests: 3, Failed: 1, Timeouts: 1}) {
+		t.Errorf("Timed out requests should be counted separately: %+v", s)
+	}
+}
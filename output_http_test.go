@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/httputil"
+	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -99,6 +102,27 @@ func TestHTTPOutputKeepOriginalHost(t *testing.T) {
 	Settings.modifierConfig = HTTPModifierConfig{}
 }
 
+func TestHTTPOutputOriginalHostSNI(t *testing.T) {
+	for _, protocol := range []string{httpProtocolHTTP1, httpProtocolAuto} {
+		wg := new(sync.WaitGroup)
+
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "www.example.com" || r.TLS.ServerName != "staging.example.com" {
+				t.Errorf("%s: Host and SNI should be set independently: %s %s", protocol, r.Host, r.TLS.ServerName)
+			}
+			wg.Done()
+		}))
+
+		output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workers: 1, Protocol: protocol, OriginalHost: true, TLSServerName: "staging.example.com"})
+
+		wg.Add(1)
+		output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+		wg.Wait()
+
+		server.Close()
+	}
+}
+
 func TestOutputHTTPSSL(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
@@ -152,3 +176,131 @@ func BenchmarkHTTPOutput(b *testing.B) {
 
 	close(quit)
 }
+
+func TestHTTPOutputForwardClientAddr(t *testing.T) {
+	header := payloadHeader(RequestPayload, uuid(), 1)
+	header = markTruncated(header)
+	header = appendPayloadMeta(header, payloadSrcKey, []byte("[2001:db8::1]:51234"))
+	payload := append(header, "GET / HTTP/1.1\r\nX-Forwarded-For: 10.0.0.1\r\n\r\n"...)
+
+	if !isTruncatedPayload(payload) {
+		t.Error("Should keep truncation mark")
+	}
+
+	src := payloadMetaValue(payload, payloadSrcKey)
+	if string(src) != "[2001:db8::1]:51234" {
+		t.Errorf("Wrong client address: %q", src)
+	}
+
+	if dst := payloadMetaValue(payload, payloadDstKey); dst != nil {
+		t.Errorf("Should not find missing field: %q", dst)
+	}
+
+	body := forwardClientAddr(payloadBody(payload), src)
+	if string(body) != "GET / HTTP/1.1\r\nX-Original-Port: 51234\r\nX-Forwarded-For: 10.0.0.1, 2001:db8::1\r\n\r\n" {
+		t.Errorf("Wrong headers: %q", body)
+	}
+
+	body = []byte("GET / HTTP/1.1\r\n\r\n")
+	if !bytes.Equal(forwardClientAddr(body, nil), body) {
+		t.Error("Should not change request without client address")
+	}
+}
+
+func TestHTTPOutputMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_http_tls")
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir)
+
+	serverTLS, err := newTLSConfig(cert, cert, key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Server-Name", r.TLS.ServerName)
+	}))
+	server.TLS = serverTLS
+	server.StartTLS()
+	defer server.Close()
+
+	send := func(config *HTTPOutputConfig) ([]byte, error) {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{TLSConfig: tlsConfig})
+		return client.Get("/")
+	}
+
+	resp, err := send(&HTTPOutputConfig{TLSCA: cert, TLSCert: cert, TLSKey: key})
+	if err != nil || !bytes.HasPrefix(resp, []byte("HTTP/1.1 200")) {
+		t.Errorf("Should authenticate with client certificate: %q %v", resp, err)
+	}
+
+	if _, err := send(&HTTPOutputConfig{TLSCA: cert}); err == nil {
+		t.Error("Should be rejected without client certificate")
+	}
+
+	// Certificate is issued for 127.0.0.1
+	if _, err := send(&HTTPOutputConfig{TLSCA: cert, TLSCert: cert, TLSKey: key, TLSServerName: "staging.internal"}); err == nil {
+		t.Error("Should verify overridden server name")
+	}
+
+	resp, err = send(&HTTPOutputConfig{TLSCA: cert, TLSCert: cert, TLSKey: key, TLSServerName: "staging.internal", TLSInsecureSkipVerify: true})
+	if err != nil || !bytes.Contains(resp, []byte("X-Server-Name: staging.internal\r\n")) {
+		t.Errorf("Should send overridden server name: %q %v", resp, err)
+	}
+}
+
+func TestHTTPOutputQueueOverflow(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{workers: 1, QueueSize: 1, QueueOverflow: httpQueueDrop}).(*HTTPOutput)
+
+	request := append(payloadHeader(RequestPayload, uuid(), 1), "GET / HTTP/1.1\r\n\r\n"...)
+
+	// Single worker waits for response, and single request is queued
+	o.Write(request)
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if n, _ := o.Write(request); n != len(request) {
+			t.Error("Should not fail on dropped request")
+		}
+	}
+
+	if s := o.Stats(); s.Dropped != 4 {
+		t.Error("Should drop requests when queue is full:", s.Dropped)
+	}
+}
+
+func TestHTTPOutputMaxWorkers(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{MaxWorkers: 3, QueueSize: 100}).(*HTTPOutput)
+
+	request := append(payloadHeader(RequestPayload, uuid(), 1), "GET / HTTP/1.1\r\n\r\n"...)
+	for i := 0; i < 50; i++ {
+		o.Write(request)
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := atomic.LoadInt64(&o.activeWorkers); n != 3 {
+		t.Error("Should limit number of workers:", n)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/buger/gor/proto"
+)
+
+// KafkaOutput plugin publishes gor payloads to Kafka topic, to be consumed by KafkaInput of replayers:
+//
+//	gor --input-raw :80 --output-kafka kafka1:9092,kafka2:9092 --output-kafka-topic traffic
+//
+// Payloads are keyed by request ID, so request and its response get to the same partition, and are consumed in
+// order. With --output-kafka-partition-by, payloads of the same path, session cookie, or client connection share
+// partition, so consumers preserve per-session ordering.
+type KafkaOutput struct {
+	brokers  string
+	config   *KafkaConfig
+	producer sarama.AsyncProducer
+
+	// Cookie name, if payloads are partitioned by cookie
+	cookie []byte
+	// Keys of requests, by request ID, given to their responses if key is taken from request
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// Maximum number of requests waiting for responses, whose keys are kept
+const kafkaMaxPendingKeys = 100000
+
+// NewKafkaOutput constructor for KafkaOutput, accepts comma-separated list of brokers
+func NewKafkaOutput(brokers string, config *KafkaConfig) io.Writer {
+	o := new(KafkaOutput)
+	o.brokers = brokers
+	o.config = config
+
+	saramaConfig, err := config.saramaConfig()
+	if err != nil {
+		log.Fatal("Wrong Kafka output configuration: ", err)
+	}
+
+	if err := o.parsePartitionBy(); err != nil {
+		log.Fatal("Wrong Kafka output configuration: ", err)
+	}
+
+	if o.producer, err = sarama.NewAsyncProducer(kafkaBrokers(brokers), saramaConfig); err != nil {
+		log.Fatal("Can't connect to Kafka: ", err)
+	}
+
+	go func() {
+		for err := range o.producer.Errors() {
+			log.Println("[OUTPUT-KAFKA] Producer error:", err)
+		}
+	}()
+
+	return o
+}
+
+func (o *KafkaOutput) Write(data []byte) (n int, err error) {
+	payload := copyPayload(data)
+	msg := &sarama.ProducerMessage{Topic: o.config.Topic, Value: sarama.ByteEncoder(payload)}
+	if key := o.key(payload); len(key) > 0 {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+
+	o.producer.Input() <- msg
+
+	return len(data), nil
+}
+
+func (o *KafkaOutput) parsePartitionBy() error {
+	switch {
+	case o.config.PartitionBy == "", o.config.PartitionBy == "id", o.config.PartitionBy == "path", o.config.PartitionBy == "connection":
+	case strings.HasPrefix(o.config.PartitionBy, "cookie:") && len(o.config.PartitionBy) > len("cookie:"):
+		o.cookie = []byte(strings.TrimPrefix(o.config.PartitionBy, "cookie:"))
+	default:
+		return fmt.Errorf("Unknown Kafka partitioning %q, should be id, path, cookie:<name>, or connection", o.config.PartitionBy)
+	}
+
+	if o.config.PartitionBy == "path" || o.cookie != nil {
+		o.keys = make(map[string][]byte)
+	}
+
+	return nil
+}
+
+// key returns partitioning key of payload. Payloads without path or cookie are keyed by request ID.
+func (o *KafkaOutput) key(payload []byte) []byte {
+	meta := payloadMeta(payload)
+	if len(meta) < 2 {
+		return nil
+	}
+	id := meta[1]
+
+	if o.config.PartitionBy == "connection" {
+		// Client address is source of requests, and destination of responses
+		if conn := payloadMetaValue(payload, payloadTCPConnKey); conn != nil {
+			return conn
+		}
+		if meta[0][0] == RequestPayload {
+			if src := payloadMetaValue(payload, payloadSrcKey); src != nil {
+				return src
+			}
+		} else if dst := payloadMetaValue(payload, payloadDstKey); dst != nil {
+			return dst
+		}
+		return id
+	}
+
+	if o.keys == nil {
+		return id
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Response gets key of its request
+	if meta[0][0] != RequestPayload {
+		if key, ok := o.keys[string(id)]; ok {
+			delete(o.keys, string(id))
+			return key
+		}
+		return id
+	}
+
+	var key []byte
+	if o.cookie != nil {
+		key = requestCookie(payloadBody(payload), o.cookie)
+	} else {
+		key = proto.Path(payloadBody(payload))
+		if i := bytes.IndexByte(key, '?'); i != -1 {
+			key = key[:i]
+		}
+	}
+	if len(key) == 0 {
+		key = id
+	}
+
+	// Keys of requests without responses are dropped eventually
+	if len(o.keys) >= kafkaMaxPendingKeys {
+		o.keys = make(map[string][]byte)
+	}
+	o.keys[string(id)] = key
+
+	return key
+}
+
+func (o *KafkaOutput) String() string {
+	return "Kafka output: " + o.brokers + "/" + o.config.Topic
+}
+
+// Close sends buffered payloads, and closes connections
+func (o *KafkaOutput) Close() error {
+	return o.producer.Close()
+}
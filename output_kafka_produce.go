@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// KafkaProduceOutputConfig struct for holding Kafka produce output configuration
+type KafkaProduceOutputConfig struct {
+	// Timeout of connecting to the broker, and sending requests
+	Timeout time.Duration
+}
+
+// KafkaProduceOutput plugin replays captured Produce requests to given broker, for example to test cluster with
+// production traffic. Other requests are not replayed. Requests of all captured connections are sent over single
+// connection, and responses are discarded:
+//
+//	gor --input-raw :9092 --input-raw-protocol kafka --output-kafka-produce test-kafka:9092
+//
+// Requests are sent as captured, so broker should lead partitions of produced topics, and accept captured
+// producer IDs of idempotent and transactional producers.
+type KafkaProduceOutput struct {
+	address  string
+	config   *KafkaProduceOutputConfig
+	replayer *streamReplayer
+}
+
+// NewKafkaProduceOutput constructor for KafkaProduceOutput
+func NewKafkaProduceOutput(address string, config *KafkaProduceOutputConfig) io.Writer {
+	o := new(KafkaProduceOutput)
+
+	o.address = address
+	o.config = config
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	o.replayer = newStreamReplayer("[OUTPUT-KAFKA-PRODUCE]", address, o.config.Timeout)
+
+	return o
+}
+
+func (o *KafkaProduceOutput) Write(data []byte) (n int, err error) {
+	if isRequestPayload(data) && string(payloadMetaValue(data, payloadKafkaAPIKey)) == "Produce" && !isTruncatedPayload(data) {
+		o.replayer.send(data)
+	}
+
+	return len(data), nil
+}
+
+func (o *KafkaProduceOutput) String() string {
+	return "Kafka produce output: " + o.address
+}
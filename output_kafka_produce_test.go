@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+func kafkaTestPayload(apiKey int16, data string) []byte {
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano())
+	header = appendKafkaMeta(header, &raw.KafkaRequest{APIKey: apiKey, Acks: 1})
+
+	return append(header, data...)
+}
+
+func TestKafkaProduceOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 10)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		for {
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			received <- string(buf)
+		}
+	}()
+
+	output := NewKafkaProduceOutput(listener.Addr().String(), &KafkaProduceOutputConfig{})
+
+	output.Write(kafkaTestPayload(raw.KafkaProduce, "pro1"))
+	output.Write(kafkaTestPayload(raw.KafkaFetch, "fetc"))
+	output.Write(kafkaTestPayload(raw.KafkaProduce, "pro2"))
+
+	for _, expected := range []string{"pro1", "pro2"} {
+		select {
+		case data := <-received:
+			if data != expected {
+				t.Errorf("Should replay only Produce requests: %q", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should replay request", expected)
+		}
+	}
+}
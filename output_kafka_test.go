@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+)
+
+func TestKafkaOutput(t *testing.T) {
+	producer := mocks.NewAsyncProducer(t, nil)
+	output := &KafkaOutput{config: &KafkaConfig{Topic: "traffic"}, producer: producer}
+
+	producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		key, _ := msg.Key.Encode()
+		value, _ := msg.Value.Encode()
+
+		if msg.Topic != "traffic" || string(key) != "abc" || string(value) != "1 abc 1\nGET / HTTP/1.1\r\n\r\n" {
+			return fmt.Errorf("Wrong message: %s %q %q", msg.Topic, key, value)
+		}
+		return nil
+	})
+
+	data := []byte("1 abc 1\nGET / HTTP/1.1\r\n\r\n")
+	output.Write(data)
+	// Emitter reuses buffer
+	data[0] = '2'
+
+	output.Close()
+}
+
+func TestKafkaOutputPartitionBy(t *testing.T) {
+	tests := []struct {
+		partitionBy string
+		keys        []string
+	}{
+		{"", []string{"a", "a", "b"}},
+		{"path", []string{"/users", "/users", "/users"}},
+		{"cookie:session", []string{"s1", "s1", "b"}},
+		{"connection", []string{"10.0.0.1:5000", "10.0.0.1:5000", "10.0.0.2:6000"}},
+	}
+
+	payloads := []string{
+		"1 a 1 src=10.0.0.1:5000\nGET /users?page=1 HTTP/1.1\r\nCookie: theme=dark; session=s1\r\n\r\n",
+		"2 a 1 src=10.0.0.5:80 dst=10.0.0.1:5000\nHTTP/1.1 200 OK\r\n\r\n",
+		"1 b 1 src=10.0.0.2:6000\nGET /users HTTP/1.1\r\n\r\n",
+	}
+
+	for _, tt := range tests {
+		output := &KafkaOutput{config: &KafkaConfig{PartitionBy: tt.partitionBy}}
+		if err := output.parsePartitionBy(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, payload := range payloads {
+			if key := output.key([]byte(payload)); string(key) != tt.keys[i] {
+				t.Errorf("%s: Wrong key of payload %d: %s", tt.partitionBy, i, key)
+			}
+		}
+	}
+
+	if err := (&KafkaOutput{config: &KafkaConfig{PartitionBy: "header"}}).parsePartitionBy(); err == nil {
+		t.Error("Should not accept unknown partitioning")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// MemcachedOutputConfig struct for holding memcached output configuration
+type MemcachedOutputConfig struct {
+	// Timeout of connecting to the server, and sending commands
+	Timeout time.Duration
+}
+
+// MemcachedOutput plugin replays captured memcached commands to given server, for example to fill new cache tier
+// before switching to it. Commands of all captured connections are sent over connection per protocol, since commands
+// don't depend on connection. Replies of the server are discarded:
+//
+//	gor --input-raw :11211 --input-raw-protocol memcached --output-memcached new-cache:11211
+//
+// Commands closing connection, and binary SASL authentication, are skipped.
+type MemcachedOutput struct {
+	address string
+	config  *MemcachedOutputConfig
+
+	// Connections of text and binary protocol
+	text   *streamReplayer
+	binary *streamReplayer
+}
+
+// NewMemcachedOutput constructor for MemcachedOutput
+func NewMemcachedOutput(address string, config *MemcachedOutputConfig) io.Writer {
+	o := new(MemcachedOutput)
+
+	o.address = address
+	o.config = config
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	o.text = newStreamReplayer("[OUTPUT-MEMCACHED]", address, o.config.Timeout)
+	o.binary = newStreamReplayer("[OUTPUT-MEMCACHED]", address, o.config.Timeout)
+
+	return o
+}
+
+func (o *MemcachedOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	name := string(payloadMetaValue(data, payloadMcCommandKey))
+	if name == "" {
+		return len(data), nil
+	}
+
+	if name == "quit" || name == "quitq" || strings.HasPrefix(name, "sasl_") || isTruncatedPayload(data) {
+		return len(data), nil
+	}
+
+	if body := payloadBody(data); len(body) > 0 && body[0] == 0x80 {
+		o.binary.send(data)
+	} else {
+		o.text.send(data)
+	}
+
+	return len(data), nil
+}
+
+func (o *MemcachedOutput) String() string {
+	return "Memcached output: " + o.address
+}
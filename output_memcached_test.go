@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+func memcachedTestPayload(command string, data string) []byte {
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano())
+	header = appendMemcachedMeta(header, &raw.MemcachedCommand{Command: command}, true)
+
+	return append(header, data...)
+}
+
+func TestMemcachedOutput(t *testing.T) {
+	listener, received := startStreamServer(t, "", func(r *bufio.Reader) (string, error) {
+		return r.ReadString('\n')
+	})
+	defer listener.Close()
+
+	output := NewMemcachedOutput(listener.Addr().String(), &MemcachedOutputConfig{})
+
+	output.Write(memcachedTestPayload("set", "set foo 0 0 1\r\n"))
+	output.Write(memcachedTestPayload("quit", "quit\r\n"))
+	output.Write(memcachedTestPayload("get", "get foo\r\n"))
+
+	for _, expected := range []string{"set foo 0 0 1\r\n", "get foo\r\n"} {
+		select {
+		case line := <-received:
+			if line != expected {
+				t.Errorf("Should replay commands except quit: %q", line)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should replay command", expected)
+		}
+	}
+}
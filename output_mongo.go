@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"time"
+)
+
+// MongoDB commands not replayed: authentication, which can't be replayed, and cursor commands, since cursor IDs are
+// assigned by the original server. Legacy operations are named by operation code.
+var mongoSkippedCommands = map[string]bool{
+	"saslStart": true, "saslContinue": true, "authenticate": true, "logout": true,
+	"getMore": true, "killCursors": true, "get_more": true, "kill_cursors": true,
+}
+
+// MongoOutputConfig struct for holding MongoDB output configuration
+type MongoOutputConfig struct {
+	// Timeout of connecting to the server, and sending requests
+	Timeout time.Duration
+}
+
+// MongoOutput plugin replays captured MongoDB requests to given server, for example to test candidate cluster with
+// production traffic. Requests of all captured connections are sent over single connection, and responses are
+// discarded:
+//
+//	gor --input-raw :27017 --input-raw-protocol mongo --output-mongo candidate:27017
+//
+// Captured authentication can't be replayed, so server should not require it. Documents redacted during capture are
+// replayed as redacted.
+type MongoOutput struct {
+	address  string
+	config   *MongoOutputConfig
+	replayer *streamReplayer
+}
+
+// NewMongoOutput constructor for MongoOutput
+func NewMongoOutput(address string, config *MongoOutputConfig) io.Writer {
+	o := new(MongoOutput)
+
+	o.address = address
+	o.config = config
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	o.replayer = newStreamReplayer("[OUTPUT-MONGO]", address, o.config.Timeout)
+
+	return o
+}
+
+func (o *MongoOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) || payloadMetaValue(data, payloadMongoOpKey) == nil {
+		return len(data), nil
+	}
+
+	name, _ := url.QueryUnescape(string(payloadMetaValue(data, payloadMongoCommandKey)))
+	if mongoSkippedCommands[name] || isTruncatedPayload(data) {
+		return len(data), nil
+	}
+
+	o.replayer.send(data)
+
+	return len(data), nil
+}
+
+func (o *MongoOutput) String() string {
+	return "MongoDB output: " + o.address
+}
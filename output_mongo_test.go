@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+func mongoTestPayload(command string, data string) []byte {
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano())
+	header = appendMongoMeta(header, &raw.MongoCommand{Op: "msg", Command: command}, true)
+
+	return append(header, data...)
+}
+
+func TestMongoOutput(t *testing.T) {
+	listener, received := startStreamServer(t, "", readTestChunk(4))
+	defer listener.Close()
+
+	output := NewMongoOutput(listener.Addr().String(), &MongoOutputConfig{})
+
+	output.Write(mongoTestPayload("find", "find"))
+	output.Write(mongoTestPayload("saslStart", "sasl"))
+	output.Write(mongoTestPayload("getMore", "more"))
+	output.Write(mongoTestPayload("insert", "ins1"))
+
+	for _, expected := range []string{"find", "ins1"} {
+		select {
+		case data := <-received:
+			if data != expected {
+				t.Errorf("Should replay requests except authentication and cursors: %q", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should replay request", expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSOutput plugin publishes gor payloads to NATS JetStream subject, to be consumed by NATSInput of replayers.
+// Subject should be bound to stream:
+//
+//	nats stream add traffic --subjects traffic
+//	gor --input-raw :80 --output-nats nats://nats:4222 --output-nats-subject traffic
+type NATSOutput struct {
+	url    string
+	config *NATSConfig
+
+	conn *nats.Conn
+	js   jetstream.JetStream
+}
+
+// NewNATSOutput constructor for NATSOutput, accepts URL of NATS servers
+func NewNATSOutput(url string, config *NATSConfig) io.Writer {
+	o := new(NATSOutput)
+	o.url = url
+	o.config = config
+
+	var err error
+	if o.conn, err = config.connect(url); err != nil {
+		log.Fatal("Can't connect to NATS: ", err)
+	}
+
+	o.js, err = jetstream.New(o.conn,
+		jetstream.WithPublishAsyncMaxPending(1000),
+		jetstream.WithPublishAsyncErrHandler(func(_ jetstream.JetStream, _ *nats.Msg, err error) {
+			log.Println("[OUTPUT-NATS] Publish error:", err)
+		}))
+	if err != nil {
+		log.Fatal("Can't use NATS JetStream: ", err)
+	}
+
+	return o
+}
+
+func (o *NATSOutput) Write(data []byte) (n int, err error) {
+	if _, err := o.js.PublishAsync(o.config.Subject, copyPayload(data)); err != nil {
+		log.Println("[OUTPUT-NATS] Publish error:", err)
+	}
+
+	return len(data), nil
+}
+
+func (o *NATSOutput) String() string {
+	return "NATS output: " + o.url + "/" + o.config.Subject
+}
+
+// Close waits for acknowledgement of published payloads, and closes connection
+func (o *NATSOutput) Close() error {
+	select {
+	case <-o.js.PublishAsyncComplete():
+	case <-time.After(5 * time.Second):
+	}
+	o.conn.Close()
+
+	return nil
+}
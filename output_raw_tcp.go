@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Connection of replayed raw TCP stream is closed, if client sent no data for this time
+const rawTCPReplayIdleTimeout = time.Minute
+
+// RawTCPOutputConfig struct for holding raw tcp output configuration
+type RawTCPOutputConfig struct {
+	// Timeout of connecting to the server, and writing data
+	Timeout time.Duration
+}
+
+// RawTCPOutput plugin replays data sent by clients of connections captured in raw TCP mode to given server,
+// byte for byte. Each captured connection is replayed over own connection, and data sent by server is discarded:
+//
+//	gor --input-raw :6379 --input-raw-protocol raw-tcp --output-raw-tcp staging:6379
+type RawTCPOutput struct {
+	address string
+
+	config *RawTCPOutputConfig
+
+	mu sync.Mutex
+	// Connection ID -> replayed connections
+	conns map[string]*rawTCPReplayConn
+}
+
+// rawTCPReplayConn passes chunks of captured connection to the goroutine replaying it
+type rawTCPReplayConn struct {
+	chunks chan []byte
+	// Closed when goroutine stops, and chunks are not read anymore
+	done chan bool
+}
+
+// NewRawTCPOutput constructor for RawTCPOutput
+func NewRawTCPOutput(address string, config *RawTCPOutputConfig) io.Writer {
+	o := new(RawTCPOutput)
+
+	o.address = address
+	o.config = config
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	o.conns = make(map[string]*rawTCPReplayConn)
+
+	return o
+}
+
+func (o *RawTCPOutput) Write(data []byte) (n int, err error) {
+	if data[0] != TCPChunkPayload || string(payloadMetaValue(data, payloadTCPFromKey)) != "client" {
+		return len(data), nil
+	}
+
+	id := payloadMetaValue(data, payloadTCPConnKey)
+	if id == nil {
+		return len(data), nil
+	}
+
+	c := o.conn(string(id))
+	enqueuePayload(c.chunks, c.done, data)
+
+	return len(data), nil
+}
+
+// conn returns replayed connection, starting it on the first chunk
+func (o *RawTCPOutput) conn(id string) *rawTCPReplayConn {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	c, ok := o.conns[id]
+	if ok {
+		return c
+	}
+
+	c = &rawTCPReplayConn{chunks: make(chan []byte, 100), done: make(chan bool)}
+	o.conns[id] = c
+
+	go o.replay(id, c)
+
+	return c
+}
+
+// replay opens connection to the server, and sends data of the captured connection until it is closed, or idle.
+// If connection fails, remaining data is discarded.
+func (o *RawTCPOutput) replay(id string, c *rawTCPReplayConn) {
+	defer func() {
+		o.mu.Lock()
+		delete(o.conns, id)
+		o.mu.Unlock()
+	}()
+	defer close(c.done)
+
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		Debug("[OUTPUT-RAW-TCP] Connection error:", err)
+	} else {
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn)
+	}
+
+	var offset uint64
+
+	for {
+		var data []byte
+
+		select {
+		case data = <-c.chunks:
+		case <-time.After(rawTCPReplayIdleTimeout):
+			return
+		}
+
+		if hasPayloadMark(data, payloadTCPClosedMark) {
+			return
+		}
+
+		// Lost data can't be replayed, following data is sent anyway
+		chunkOffset, _ := strconv.ParseUint(string(payloadMetaValue(data, payloadTCPOffsetKey)), 10, 64)
+		if chunkOffset != offset {
+			Debug("[OUTPUT-RAW-TCP] Missing data of connection", id, "at offset", offset)
+		}
+
+		body := payloadBody(data)
+		offset = chunkOffset + uint64(len(body))
+
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+			if _, err := conn.Write(body); err != nil {
+				Debug("[OUTPUT-RAW-TCP] Write error:", err)
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
+
+func (o *RawTCPOutput) String() string {
+	return "Raw TCP output: " + o.address
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+func tcpChunkTestPayload(conn string, isIncoming bool, offset uint64, closed bool, data string) []byte {
+	header := payloadHeader(TCPChunkPayload, uuid(), time.Now().UnixNano())
+	header = appendTCPChunkMeta(header, &raw.TCPChunk{ConnID: []byte(conn), Offset: offset, Closed: closed}, isIncoming)
+
+	return append(header, data...)
+}
+
+func TestRawTCPOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				conn.Write([]byte("greeting is discarded"))
+				data, _ := ioutil.ReadAll(conn)
+				received <- string(data)
+			}()
+		}
+	}()
+
+	output := NewRawTCPOutput(listener.Addr().String(), &RawTCPOutputConfig{})
+
+	output.Write(tcpChunkTestPayload("a", true, 0, false, "\x00\x01"))
+	output.Write(tcpChunkTestPayload("b", true, 0, false, "\xff"))
+	output.Write(tcpChunkTestPayload("a", false, 0, false, "reply"))
+	output.Write(tcpChunkTestPayload("a", true, 2, false, "\x02"))
+	output.Write(tcpChunkTestPayload("a", true, 3, true, ""))
+	output.Write(tcpChunkTestPayload("b", true, 1, true, ""))
+
+	// Not raw TCP data
+	output.Write(append(payloadHeader(RequestPayload, uuid(), 1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+
+	conns := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			conns[data] = true
+		case <-time.After(time.Second):
+			t.Fatal("Should replay connections", i)
+		}
+	}
+
+	if !conns["\x00\x01\x02"] || !conns["\xff"] {
+		t.Errorf("Should replay client data of each connection over own one: %v", conns)
+	}
+}
+
+func TestTCPChunkMeta(t *testing.T) {
+	payload := tcpChunkTestPayload("abc", false, 10, true, "")
+
+	if payload[0] != TCPChunkPayload || !isOriginPayload(payload) {
+		t.Error("Should be origin payload")
+	}
+
+	if string(payloadMetaValue(payload, payloadTCPConnKey)) != "abc" || string(payloadMetaValue(payload, payloadTCPFromKey)) != "server" ||
+		string(payloadMetaValue(payload, payloadTCPOffsetKey)) != "10" || !hasPayloadMark(payload, payloadTCPClosedMark) {
+		t.Errorf("Should describe chunk: %q", payload)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection of replayed Redis client is closed, if it sent no commands for this time
+const redisReplayIdleTimeout = time.Minute
+
+// Commands not modifying data, replayed with RedisOutputConfig.ReadOnly. Connection commands are included, since
+// following commands depend on them.
+var redisReadOnlyCommands = map[string]bool{
+	"GET": true, "MGET": true, "GETRANGE": true, "SUBSTR": true, "STRLEN": true, "LCS": true, "GETBIT": true,
+	"BITCOUNT": true, "BITPOS": true, "EXISTS": true, "TYPE": true, "TTL": true, "PTTL": true, "EXPIRETIME": true,
+	"PEXPIRETIME": true, "KEYS": true, "SCAN": true, "RANDOMKEY": true, "DBSIZE": true,
+	"HGET": true, "HMGET": true, "HGETALL": true, "HKEYS": true, "HVALS": true, "HLEN": true, "HEXISTS": true,
+	"HSTRLEN": true, "HSCAN": true, "HRANDFIELD": true,
+	"LRANGE": true, "LINDEX": true, "LLEN": true, "LPOS": true,
+	"SMEMBERS": true, "SISMEMBER": true, "SMISMEMBER": true, "SCARD": true, "SRANDMEMBER": true, "SSCAN": true,
+	"SINTER": true, "SINTERCARD": true, "SUNION": true, "SDIFF": true,
+	"ZRANGE": true, "ZRANGEBYSCORE": true, "ZRANGEBYLEX": true, "ZREVRANGE": true, "ZREVRANGEBYSCORE": true,
+	"ZREVRANGEBYLEX": true, "ZRANK": true, "ZREVRANK": true, "ZSCORE": true, "ZMSCORE": true, "ZCARD": true,
+	"ZCOUNT": true, "ZLEXCOUNT": true, "ZSCAN": true, "ZRANDMEMBER": true, "ZINTER": true, "ZINTERCARD": true,
+	"ZUNION": true, "ZDIFF": true,
+	"PFCOUNT": true, "GEOPOS": true, "GEODIST": true, "GEOHASH": true, "GEOSEARCH": true, "GEORADIUS_RO": true,
+	"GEORADIUSBYMEMBER_RO": true, "XRANGE": true, "XREVRANGE": true, "XLEN": true,
+	"PING": true, "ECHO": true, "SELECT": true, "AUTH": true, "HELLO": true, "READONLY": true, "QUIT": true,
+}
+
+// RedisOutputConfig struct for holding redis output configuration
+type RedisOutputConfig struct {
+	// Replay only commands not modifying data, see redisReadOnlyCommands
+	ReadOnly bool
+
+	// Timeout of connecting to the server, and sending commands
+	Timeout time.Duration
+}
+
+// RedisOutput plugin replays commands of captured Redis connections to given server. Each captured connection is
+// replayed over own connection, so commands depending on connection state, like SELECT or MULTI, work as captured.
+// Replies of the server are discarded:
+//
+//	gor --input-raw :6379 --input-raw-protocol redis --output-redis staging:6379
+//
+// Address can be URL with password and database, like "redis://:secret@staging:6379/2". Then AUTH and SELECT
+// are sent when connection is opened, and captured AUTH commands are skipped.
+type RedisOutput struct {
+	address  string
+	password string
+	db       string
+
+	config *RedisOutputConfig
+
+	mu sync.Mutex
+	// Connection ID -> replayed connections
+	conns map[string]*redisReplayConn
+}
+
+// redisReplayConn passes commands of captured connection to the goroutine replaying it
+type redisReplayConn struct {
+	commands chan []byte
+	// Closed when goroutine stops, and commands are not read anymore
+	done chan bool
+}
+
+// NewRedisOutput constructor for RedisOutput
+func NewRedisOutput(address string, config *RedisOutputConfig) io.Writer {
+	o := new(RedisOutput)
+
+	o.config = config
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	o.address = address
+	if strings.HasPrefix(address, "redis://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			log.Fatal("Redis output address is not valid:", err)
+		}
+
+		o.address = u.Host
+		if u.User != nil {
+			o.password, _ = u.User.Password()
+		}
+		o.db = strings.Trim(u.Path, "/")
+	}
+
+	o.conns = make(map[string]*redisReplayConn)
+
+	return o
+}
+
+func (o *RedisOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	id := payloadMetaValue(data, payloadRedisConnKey)
+	if id == nil {
+		return len(data), nil
+	}
+
+	name, _ := url.QueryUnescape(string(payloadMetaValue(data, payloadRedisCommandKey)))
+	if o.config.ReadOnly && !redisReadOnlyCommands[name] || name == "AUTH" && o.password != "" || isTruncatedPayload(data) {
+		return len(data), nil
+	}
+
+	c := o.conn(string(id))
+	enqueuePayload(c.commands, c.done, data)
+
+	return len(data), nil
+}
+
+// conn returns replayed connection, starting it on the first command
+func (o *RedisOutput) conn(id string) *redisReplayConn {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	c, ok := o.conns[id]
+	if ok {
+		return c
+	}
+
+	c = &redisReplayConn{commands: make(chan []byte, 100), done: make(chan bool)}
+	o.conns[id] = c
+
+	go o.replay(id, c)
+
+	return c
+}
+
+// replay opens connection to the server, and sends commands of the captured connection until client quits, or it is
+// idle. If connection fails, remaining commands are discarded.
+func (o *RedisOutput) replay(id string, c *redisReplayConn) {
+	defer func() {
+		o.mu.Lock()
+		delete(o.conns, id)
+		o.mu.Unlock()
+	}()
+	defer close(c.done)
+
+	conn, err := o.connect()
+	if err != nil {
+		Debug("[OUTPUT-REDIS] Connection error:", err)
+	} else {
+		defer conn.Close()
+	}
+
+	for {
+		var data []byte
+
+		select {
+		case data = <-c.commands:
+		case <-time.After(redisReplayIdleTimeout):
+			return
+		}
+
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+			if _, err := conn.Write(payloadBody(data)); err != nil {
+				Debug("[OUTPUT-REDIS] Write error:", err)
+				conn.Close()
+				conn = nil
+			}
+		}
+
+		if string(payloadMetaValue(data, payloadRedisCommandKey)) == "QUIT" {
+			return
+		}
+	}
+}
+
+// connect opens connection to the server, authenticates and selects database if they are given by address.
+// Replies are discarded.
+func (o *RedisOutput) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var setup [][]string
+	if o.password != "" {
+		setup = append(setup, []string{"AUTH", o.password})
+	}
+	if o.db != "" {
+		setup = append(setup, []string{"SELECT", o.db})
+	}
+
+	w := bufio.NewWriter(conn)
+	for _, args := range setup {
+		w.Write(redisEncodeCommand(args))
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go io.Copy(ioutil.Discard, conn)
+
+	return conn, nil
+}
+
+// redisEncodeCommand encodes command as array of bulk strings
+func redisEncodeCommand(args []string) []byte {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+
+	return buf
+}
+
+func (o *RedisOutput) String() string {
+	return "Redis output: " + o.address
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+func redisTestPayload(conn string, command string, args ...string) []byte {
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano())
+	header = appendRedisMeta(header, &raw.RedisCommand{ConnID: []byte(conn), Name: command, Args: len(args) + 1}, true)
+
+	return append(header, redisEncodeCommand(append([]string{command}, args...))...)
+}
+
+func TestRedisOutput(t *testing.T) {
+	listener, received := startStreamServer(t, "+OK\r\n", func(r *bufio.Reader) (string, error) {
+		data, _ := ioutil.ReadAll(r)
+		return string(data), io.EOF
+	})
+	defer listener.Close()
+
+	output := NewRedisOutput("redis://:secret@"+listener.Addr().String()+"/2", &RedisOutputConfig{ReadOnly: true})
+
+	output.Write(redisTestPayload("a", "AUTH", "captured"))
+	output.Write(redisTestPayload("a", "GET", "foo"))
+	output.Write(redisTestPayload("a", "SET", "foo", "1"))
+	output.Write(redisTestPayload("a", "QUIT"))
+
+	select {
+	case data := <-received:
+		expected := string(redisEncodeCommand([]string{"AUTH", "secret"})) + string(redisEncodeCommand([]string{"SELECT", "2"})) +
+			string(redisEncodeCommand([]string{"GET", "foo"})) + string(redisEncodeCommand([]string{"QUIT"}))
+
+		if data != expected {
+			t.Errorf("Should authenticate, and replay read-only commands: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should replay connection")
+	}
+}
+
+func TestRedisEncodeCommand(t *testing.T) {
+	if data := redisEncodeCommand([]string{"GET", "foo"}); string(data) != "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" {
+		t.Errorf("Wrong command: %q", data)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimum size of multipart upload part, except the last one
+const s3MinPartSize = 5 * 1024 * 1024
+
+// S3OutputConfig configures uploads of S3 output
+type S3OutputConfig struct {
+	// Size of uploaded parts, 8mb by default. S3 requires at least 5mb.
+	PartSize unitSizeVar
+	// Traffic of each time window is uploaded as separate object, 5m by default
+	Window time.Duration
+	// Extension of objects: ".gor", or ".gor.gz" and ".gor.zst" to compress them
+	Extension string
+	// Attempts of failed S3 requests, 3 by default
+	Retries int
+}
+
+// S3Output uploads recorded traffic directly to S3 bucket, or S3 compatible storage, with multipart upload, so
+// capture agents don't need local disk:
+//
+//	gor --input-raw :80 --output-s3 s3://bucket/recordings
+//
+// Traffic is buffered in memory up to part size. Object of each time window is named by time its upload
+// started and host, like "recordings/20190101T120000Z_web1.gor", and can be replayed with
+// --input-file "s3://bucket/recordings/*.gor".
+type S3Output struct {
+	address string
+	prefix  string
+	host    string
+	config  *S3OutputConfig
+	storage *s3Storage
+
+	queue chan []byte
+	done  chan struct{}
+
+	// Object being uploaded, and when its window ends
+	upload    *s3Upload
+	windowEnd time.Time
+
+	// Data of the next part, and compressor writing to it
+	buf        bytes.Buffer
+	writer     io.Writer
+	compressed compressedWriter
+}
+
+// s3Upload is multipart upload of single object
+type s3Upload struct {
+	key   string
+	id    string
+	parts []s3CompletedPart
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// NewS3Output constructor for S3Output, accepts address like "s3://bucket/prefix"
+func NewS3Output(address string, config *S3OutputConfig) io.Writer {
+	o := &S3Output{address: address, config: config}
+
+	if !strings.HasPrefix(address, "s3://") {
+		address = "s3://" + address
+	}
+	_, bucket, prefix := parseRemotePath(address)
+	o.prefix = strings.Trim(prefix, "/")
+
+	storage, err := newS3Storage(bucket)
+	if err != nil {
+		log.Fatal("Wrong S3 output: ", err)
+	}
+	o.storage = storage.(*s3Storage)
+
+	if o.config.PartSize == 0 {
+		o.config.PartSize = 8 * 1024 * 1024
+	}
+	if o.config.PartSize < s3MinPartSize {
+		log.Fatal("S3 output part size should be at least 5mb")
+	}
+
+	if o.config.Window == 0 {
+		o.config.Window = 5 * time.Minute
+	}
+
+	if o.config.Extension == "" {
+		o.config.Extension = ".gor"
+	}
+
+	if o.config.Retries == 0 {
+		o.config.Retries = 3
+	}
+
+	if o.host, err = os.Hostname(); err != nil {
+		o.host = "gor"
+	}
+
+	o.queue = make(chan []byte, 1000)
+	o.done = make(chan struct{})
+
+	go o.run()
+
+	return o
+}
+
+func (o *S3Output) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+
+	enqueuePayload(o.queue, nil, data)
+
+	return len(data), nil
+}
+
+func (o *S3Output) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data, ok := <-o.queue:
+			if !ok {
+				o.complete()
+				close(o.done)
+				return
+			}
+			o.write(data)
+		case now := <-ticker.C:
+			if o.upload != nil && !now.Before(o.windowEnd) {
+				o.complete()
+			}
+		}
+	}
+}
+
+// write buffers payload, starting new object if needed, and uploads part once buffer is full
+func (o *S3Output) write(data []byte) {
+	if o.upload != nil && !time.Now().Before(o.windowEnd) {
+		o.complete()
+	}
+
+	if o.upload == nil {
+		if err := o.start(time.Now()); err != nil {
+			log.Println("[OUTPUT-S3] Can't start upload, payload is dropped:", err)
+			return
+		}
+	}
+
+	o.writer.Write(data)
+	o.writer.Write([]byte(payloadSeparator))
+
+	if o.buf.Len() >= int(o.config.PartSize) {
+		o.uploadPart()
+	}
+}
+
+// start creates multipart upload of object of window now is in
+func (o *S3Output) start(now time.Time) error {
+	key := now.UTC().Format("20060102T150405Z") + "_" + o.host + o.config.Extension
+	if o.prefix != "" {
+		key = o.prefix + "/" + key
+	}
+
+	var result struct {
+		UploadId string
+	}
+	err := o.retry(func() error {
+		resp, err := o.storage.do("POST", key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return xml.NewDecoder(resp.Body).Decode(&result)
+	})
+	if err != nil {
+		return err
+	}
+
+	o.upload = &s3Upload{key: key, id: result.UploadId}
+	o.windowEnd = now.Truncate(o.config.Window).Add(o.config.Window)
+
+	o.buf.Reset()
+	o.writer = &o.buf
+	if o.compressed = newCompressedWriter(o.config.Extension, &o.buf); o.compressed != nil {
+		o.writer = o.compressed
+	}
+
+	Debug("[OUTPUT-S3] Started upload:", key)
+
+	return nil
+}
+
+// uploadPart uploads buffered data as the next part. Upload is aborted if part can't be uploaded.
+func (o *S3Output) uploadPart() {
+	number := len(o.upload.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {o.upload.id}}
+
+	var etag string
+	err := o.retry(func() error {
+		resp, err := o.storage.do("PUT", o.upload.key, query, nil, o.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		etag = resp.Header.Get("ETag")
+		return nil
+	})
+
+	o.buf.Reset()
+
+	if err != nil {
+		log.Printf("[OUTPUT-S3] Can't upload part %d of %s: %v", number, o.upload.key, err)
+		o.abort()
+		return
+	}
+
+	o.upload.parts = append(o.upload.parts, s3CompletedPart{PartNumber: number, ETag: etag})
+}
+
+// complete uploads the rest of buffered data, and completes upload of the current object
+func (o *S3Output) complete() {
+	if o.upload == nil {
+		return
+	}
+
+	if o.compressed != nil {
+		o.compressed.Close()
+	}
+	if o.buf.Len() > 0 {
+		o.uploadPart()
+	}
+
+	// Upload is aborted if part failed
+	if o.upload == nil {
+		return
+	}
+
+	if len(o.upload.parts) == 0 {
+		o.abort()
+		return
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: o.upload.parts})
+
+	err := o.retry(func() error {
+		resp, err := o.storage.do("POST", o.upload.key, url.Values{"uploadId": {o.upload.id}}, nil, body)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// Error of complete request can be reported with 200 status
+		var result struct {
+			XMLName xml.Name
+			Message string
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+			return errors.New(result.Message)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("[OUTPUT-S3] Can't complete upload of %s: %v", o.upload.key, err)
+		o.abort()
+		return
+	}
+
+	Debug("[OUTPUT-S3] Uploaded:", o.upload.key)
+	o.upload = nil
+}
+
+// abort aborts the current upload, so its parts are not stored
+func (o *S3Output) abort() {
+	resp, err := o.storage.do("DELETE", o.upload.key, url.Values{"uploadId": {o.upload.id}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	o.upload = nil
+}
+
+// retry calls f until it succeeds, or attempts are exhausted, with growing delay between attempts
+func (o *S3Output) retry(f func() error) (err error) {
+	for attempt := 0; attempt < o.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(remoteRetryDelay * time.Duration(attempt))
+		}
+
+		if err = f(); err == nil {
+			return nil
+		}
+		Debug("[OUTPUT-S3] Request failed:", err)
+	}
+
+	return err
+}
+
+func (o *S3Output) String() string {
+	return fmt.Sprintf("S3 output: %s", o.address)
+}
+
+// Close uploads buffered traffic, and completes the current upload
+func (o *S3Output) Close() error {
+	close(o.queue)
+	<-o.done
+
+	return nil
+}
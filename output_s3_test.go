@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3Uploads accepts multipart uploads to "bucket", failing the first attempt of each part
+type fakeS3Uploads struct {
+	mu      sync.Mutex
+	parts   map[string][]byte
+	failed  map[string]bool
+	objects map[string][]byte
+}
+
+func (f *fakeS3Uploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "POST" && query.Get("uploads") == "" && strings.Contains(r.URL.RawQuery, "uploads"):
+		w.Write([]byte("<InitiateMultipartUploadResult><UploadId>" + key + "-id</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == "PUT":
+		part := key + "/" + query.Get("partNumber")
+		if !f.failed[part] {
+			f.failed[part] = true
+			w.WriteHeader(500)
+			return
+		}
+		f.parts[part] = body
+		w.Header().Set("ETag", "\"etag-"+query.Get("partNumber")+"\"")
+	case r.Method == "POST":
+		var complete struct {
+			Parts []s3CompletedPart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+
+		var object []byte
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != "\"etag-"+strconv.Itoa(i+1)+"\"" {
+				w.WriteHeader(400)
+				return
+			}
+			object = append(object, f.parts[key+"/"+strconv.Itoa(p.PartNumber)]...)
+		}
+		f.objects[key] = object
+		w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func TestS3Output(t *testing.T) {
+	uploads := &fakeS3Uploads{parts: make(map[string][]byte), failed: make(map[string]bool), objects: make(map[string][]byte)}
+	server := httptest.NewServer(uploads)
+	defer server.Close()
+
+	os.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ENDPOINT_URL_S3")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	remoteRetryDelay = time.Millisecond
+	defer func() { remoteRetryDelay = time.Second }()
+
+	for _, ext := range []string{".gor", ".gor.gz"} {
+		output := NewS3Output("s3://bucket/recordings/", &S3OutputConfig{Extension: ext}).(*S3Output)
+
+		large := "1 1 1\n" + strings.Repeat("a", 9*1024*1024)
+		output.Write([]byte(large))
+		output.Write([]byte("1 2 1\nsmall"))
+		output.Close()
+
+		uploads.mu.Lock()
+		if len(uploads.objects) != 1 {
+			t.Fatalf("%s: Should upload single object: %d", ext, len(uploads.objects))
+		}
+
+		for key, object := range uploads.objects {
+			if !strings.HasPrefix(key, "recordings/") || !strings.HasSuffix(key, "_"+output.host+ext) {
+				t.Errorf("%s: Wrong key: %s", ext, key)
+			}
+
+			reader, _ := newDecompressedReader(key, bytes.NewReader(object))
+			data, _ := ioutil.ReadAll(reader)
+			if string(data) != large+payloadSeparator+"1 2 1\nsmall"+payloadSeparator {
+				t.Errorf("%s: Wrong object of %d bytes", ext, len(data))
+			}
+			delete(uploads.objects, key)
+		}
+		uploads.mu.Unlock()
+	}
+}
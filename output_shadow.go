@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Size of response buffer, responses are truncated to it before comparison
+const shadowResponseBufferSize = 1024 * 1024
+
+// ShadowOutputConfig struct for holding shadow output configuration
+type ShadowOutputConfig struct {
+	stats   bool
+	workers int
+
+	Timeout time.Duration
+
+	// File mismatches are appended to, one JSON object per line. If not set, they are printed with --verbose.
+	Report string
+
+	// Response headers not compared, in addition to Date, X-Request-Id and other headers which differ
+	// between responses
+	IgnoreHeaders MultiOption
+
+	// Paths of JSON response bodies not compared, like "meta.generated_at" or "items.*.id": keys separated
+	// by dots, "*" matches any key or array element
+	IgnoreJSONPaths MultiOption
+}
+
+// ShadowOutputStats counts compared responses, and mismatches by path of differing value
+type ShadowOutputStats struct {
+	Compared   uint64
+	Matched    uint64
+	Mismatched uint64
+	// Requests not compared, because one of the servers failed to respond
+	Failed uint64
+	// Paths of differing values, with array indexes replaced by "*", and number of mismatches
+	Paths map[string]uint64
+}
+
+// ShadowOutput plugin sends each request to two servers, like current production build and release candidate,
+// and compares their responses. Response of candidate server is compared against primary one, see
+// httpResponseComparator. Mismatches are recorded with the request they were caused by:
+//
+//	gor --input-raw :80 --output-shadow "prod.internal,rc.internal" --output-shadow-report mismatches.jsonl
+type ShadowOutput struct {
+	compared   uint64
+	matched    uint64
+	mismatched uint64
+	failed     uint64
+
+	address   string
+	primary   string
+	candidate string
+
+	queue      chan []byte
+	config     *ShadowOutputConfig
+	comparator *httpResponseComparator
+
+	quit chan bool
+}
+
+// NewShadowOutput constructor for ShadowOutput, address is comma separated addresses of primary and candidate servers
+func NewShadowOutput(address string, config *ShadowOutputConfig) io.Writer {
+	o := new(ShadowOutput)
+
+	o.address = address
+	o.config = config
+
+	targets := strings.Split(address, ",")
+	if len(targets) != 2 {
+		log.Fatal("Shadow output requires addresses of two servers, separated by comma: ", address)
+	}
+	o.primary, o.candidate = strings.TrimSpace(targets[0]), strings.TrimSpace(targets[1])
+
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	if o.config.workers == 0 {
+		o.config.workers = 10
+	}
+
+	var err error
+	if o.comparator, err = newHTTPResponseComparator("[OUTPUT-SHADOW]", o.config.Report, o.config.IgnoreHeaders, o.config.IgnoreJSONPaths); err != nil {
+		log.Fatal("Can't open shadow output report: ", err)
+	}
+
+	o.queue = make(chan []byte, 1000)
+	o.quit = make(chan bool)
+
+	for i := 0; i < o.config.workers; i++ {
+		go o.worker()
+	}
+
+	if o.config.stats {
+		go o.reportStats()
+	}
+
+	return o
+}
+
+func (o *ShadowOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	enqueuePayload(o.queue, nil, data)
+
+	return len(data), nil
+}
+
+func (o *ShadowOutput) worker() {
+	primary := NewHTTPClient(o.primary, &HTTPClientConfig{Timeout: o.config.Timeout, ResponseBufferSize: shadowResponseBufferSize})
+	candidate := NewHTTPClient(o.candidate, &HTTPClientConfig{Timeout: o.config.Timeout, ResponseBufferSize: shadowResponseBufferSize})
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case data := <-o.queue:
+			o.sendRequest(primary, candidate, data)
+		}
+	}
+}
+
+func (o *ShadowOutput) sendRequest(primary, candidate httpSender, request []byte) {
+	meta := payloadMeta(request)
+	if len(meta) < 2 {
+		return
+	}
+	uuid := meta[1]
+
+	body := payloadBody(request)
+	if !proto.IsHTTPPayload(body) {
+		return
+	}
+
+	// Both servers get the request at the same time, so responses depend on the same state
+	var candidateResp []byte
+	var candidateErr error
+	done := make(chan struct{})
+	go func() {
+		candidateResp, candidateErr = candidate.Send(body)
+		close(done)
+	}()
+
+	primaryResp, primaryErr := primary.Send(body)
+	<-done
+
+	if primaryErr != nil || candidateErr != nil {
+		atomic.AddUint64(&o.failed, 1)
+		Debug("[OUTPUT-SHADOW] Request failed:", primaryErr, candidateErr)
+		return
+	}
+
+	atomic.AddUint64(&o.compared, 1)
+
+	diffs := o.comparator.compare(primaryResp, candidateResp)
+	if len(diffs) == 0 {
+		atomic.AddUint64(&o.matched, 1)
+		return
+	}
+
+	atomic.AddUint64(&o.mismatched, 1)
+	o.comparator.record(responseMismatch{Time: time.Now(), ID: string(uuid), Request: string(body), Diffs: diffs})
+}
+
+// Stats returns counters of compared responses
+func (o *ShadowOutput) Stats() ShadowOutputStats {
+	return ShadowOutputStats{
+		Compared:   atomic.LoadUint64(&o.compared),
+		Matched:    atomic.LoadUint64(&o.matched),
+		Mismatched: atomic.LoadUint64(&o.mismatched),
+		Failed:     atomic.LoadUint64(&o.failed),
+		Paths:      o.comparator.mismatchPaths(),
+	}
+}
+
+func (o *ShadowOutput) reportStats() {
+	log.Println("output_shadow:compared,matched,mismatched,failed")
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-time.After(rate * time.Second):
+		}
+
+		s := o.Stats()
+		log.Printf("output_shadow:%d,%d,%d,%d", s.Compared, s.Matched, s.Mismatched, s.Failed)
+	}
+}
+
+func (o *ShadowOutput) String() string {
+	return "Shadow output: " + o.address
+}
+
+// Close stops workers, and closes the report
+func (o *ShadowOutput) Close() error {
+	close(o.quit)
+
+	return o.comparator.close()
+}
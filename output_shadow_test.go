@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShadowOutput(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	server := func(version string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer wg.Done()
+
+			w.Header().Set("X-Request-Id", version)
+			w.Header().Set("Content-Type", "application/json")
+
+			switch r.URL.Path {
+			case "/same":
+				w.Write([]byte(`{"id": 1, "created": "` + time.Now().Format(time.RFC3339Nano) + `", "build": "` + version + `"}`))
+			case "/different":
+				if version == "rc" {
+					w.Header().Set("Cache-Control", "no-cache")
+					w.Write([]byte(`{"items": [{"name": "a", "price": 2}]}`))
+				} else {
+					w.Write([]byte(`{"items": [{"name": "a", "price": 1}, {"name": "b"}]}`))
+				}
+			}
+		}))
+	}
+
+	prod, rc := server("prod"), server("rc")
+	defer prod.Close()
+	defer rc.Close()
+
+	dir, _ := ioutil.TempDir("", "gor_shadow")
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.jsonl")
+
+	output := NewShadowOutput(prod.URL+","+rc.URL, &ShadowOutputConfig{
+		workers:         1,
+		Report:          report,
+		IgnoreJSONPaths: MultiOption{"build"},
+	}).(*ShadowOutput)
+
+	wg.Add(4)
+	output.Write([]byte("1 a 1\nGET /same HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 b 1\nGET /different HTTP/1.1\r\n\r\n"))
+	wg.Wait()
+
+	// Comparison is done after responses are received
+	for i := 0; i < 100 && output.Stats().Compared < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.Close()
+
+	stats := output.Stats()
+	if stats.Compared != 2 || stats.Matched != 1 || stats.Mismatched != 1 {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+	if stats.Paths["body.items.*.price"] != 1 || stats.Paths["body.items.*"] != 1 {
+		t.Errorf("Mismatches should be counted by path: %v", stats.Paths)
+	}
+
+	file, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var mismatches []responseMismatch
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var m responseMismatch
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		mismatches = append(mismatches, m)
+	}
+
+	if len(mismatches) != 1 {
+		t.Fatalf("Should record single mismatch: %+v", mismatches)
+	}
+
+	m := mismatches[0]
+	if m.ID != "b" || m.Request != "GET /different HTTP/1.1\r\n\r\n" {
+		t.Errorf("Should record originating request: %+v", m)
+	}
+
+	var paths []string
+	for _, diff := range m.Diffs {
+		paths = append(paths, diff.Path)
+	}
+	if len(paths) != 3 || paths[0] != "header.Cache-Control" || paths[1] != "body.items.0.price" || paths[2] != "body.items.1" {
+		t.Errorf("Wrong differences: %+v", m.Diffs)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of payloads kept in memory before output spills to disk, size of spill segment files, and number of
+// payloads read between saves of the read position
+var (
+	spillMemorySize  = 1000
+	spillSegmentSize = int64(64 << 20)
+	spillIndexEvery  = 64
+)
+
+var errSpillFull = errors.New("Spill queue is full")
+
+// SpillQueue is a wrapper for output plugin, which keeps payloads the output can't accept yet on disk.
+//
+// Payloads are passed to the output by separate goroutine. When output is slow or down, its Write blocks,
+// and payloads are queued in memory, then in segment files of spill directory, up to its size limit.
+// Queued payloads are written to the output in order, once it recovers. Queue is kept on disk between
+// restarts, and payloads queued in memory are spilled on close.
+//
+// Enabled for all outputs by --output-spill-dir, each output is queued in own subdirectory.
+type SpillQueue struct {
+	spilled uint64
+	dropped uint64
+
+	plugin io.Writer
+	memory chan []byte
+	disk   *spillDiskQueue
+
+	// Guards decision whether payload is queued in memory or on disk
+	mu       sync.Mutex
+	notify   chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	closed   bool
+	closeErr error
+}
+
+// spillReadQueue is SpillQueue of output which returns responses
+type spillReadQueue struct {
+	*SpillQueue
+}
+
+func (s spillReadQueue) Read(data []byte) (int, error) {
+	return s.plugin.(io.Reader).Read(data)
+}
+
+// NewSpillQueue constructor for SpillQueue, spilling payloads of the plugin to given directory, up to maxSize bytes
+func NewSpillQueue(plugin io.Writer, dir string, maxSize int64) (io.Writer, error) {
+	disk, err := openSpillDiskQueue(dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SpillQueue{
+		plugin: plugin,
+		memory: make(chan []byte, spillMemorySize),
+		disk:   disk,
+		notify: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go s.deliver()
+
+	if _, ok := plugin.(io.Reader); ok {
+		return spillReadQueue{s}, nil
+	}
+
+	return s, nil
+}
+
+// spillDirName returns name of spill directory of the output, by its position and description
+func spillDirName(index int, plugin interface{}) string {
+	name := []byte(fmt.Sprintf("%d-%s", index, plugin))
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			name[i] = '_'
+		}
+	}
+
+	return string(name)
+}
+
+func (s *SpillQueue) Write(data []byte) (int, error) {
+	buf := copyPayload(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return len(data), nil
+	}
+
+	// Payloads are queued on disk until it is empty, to keep their order
+	if s.disk.empty() {
+		select {
+		case s.memory <- buf:
+			return len(data), nil
+		default:
+		}
+	}
+
+	if err := s.disk.push(buf); err != nil {
+		if atomic.AddUint64(&s.dropped, 1) == 1 {
+			log.Println("Can't spill payload of", s.plugin, err)
+		}
+		return len(data), nil
+	}
+	atomic.AddUint64(&s.spilled, 1)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return len(data), nil
+}
+
+// deliver writes queued payloads to the output: first ones queued in memory, then on disk
+func (s *SpillQueue) deliver() {
+	defer close(s.done)
+
+	for {
+		select {
+		case data := <-s.memory:
+			s.plugin.Write(data)
+			continue
+		case <-s.quit:
+			return
+		default:
+		}
+
+		if data, err := s.disk.pop(); err != nil {
+			log.Println("Can't read spilled payloads of", s.plugin, err)
+		} else if data != nil {
+			s.plugin.Write(data)
+			continue
+		}
+
+		select {
+		case data := <-s.memory:
+			s.plugin.Write(data)
+		case <-s.notify:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// SpillQueueStats counts payloads spilled to disk, and dropped because spill queue was full
+type SpillQueueStats struct {
+	Spilled     uint64
+	Dropped     uint64
+	QueuedBytes int64
+}
+
+// Stats returns counters of spilled payloads
+func (s *SpillQueue) Stats() SpillQueueStats {
+	s.disk.mu.Lock()
+	size := s.disk.size
+	s.disk.mu.Unlock()
+
+	return SpillQueueStats{Spilled: atomic.LoadUint64(&s.spilled), Dropped: atomic.LoadUint64(&s.dropped), QueuedBytes: size}
+}
+
+func (s *SpillQueue) String() string {
+	return fmt.Sprintf("Spill queue of %s", s.plugin)
+}
+
+// Close stops delivery, and moves payloads queued in memory to disk, after already spilled ones, so they are
+// delivered after restart. Payload being written to the output, if it blocks, is not waited for.
+func (s *SpillQueue) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return s.closeErr
+	}
+	s.closed = true
+	close(s.quit)
+
+	var pending [][]byte
+	for len(s.memory) > 0 {
+		pending = append(pending, <-s.memory)
+	}
+	s.mu.Unlock()
+
+	s.closeErr = s.disk.close(pending)
+
+	return s.closeErr
+}
+
+// spillDiskQueue is queue of payloads in segment files of directory. Each payload is stored with 4 byte length
+// prefix. Read position is saved to index file, and segments are removed once read.
+type spillDiskQueue struct {
+	dir     string
+	maxSize int64
+
+	mu sync.Mutex
+	// Numbers of read and written segments, and read offset in the first one
+	readSegment  int
+	writeSegment int
+	readOffset   int64
+	reader       *bufio.Reader
+	readFile     *os.File
+	writeFile    *os.File
+	writeSize    int64
+	// Bytes queued, and payloads read since the last index save
+	size  int64
+	reads int
+}
+
+func openSpillDiskQueue(dir string, maxSize int64) (*spillDiskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &spillDiskQueue{dir: dir, maxSize: maxSize, readSegment: 1}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	for _, name := range segments {
+		if n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".seg")); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+
+	if index, err := ioutil.ReadFile(filepath.Join(dir, "index")); err == nil {
+		fmt.Sscanf(string(index), "%d %d", &q.readSegment, &q.readOffset)
+	} else if len(numbers) > 0 {
+		q.readSegment = numbers[0]
+	}
+	q.writeSegment = q.readSegment
+
+	for _, n := range numbers {
+		if n < q.readSegment {
+			os.Remove(q.segmentPath(n))
+			continue
+		}
+
+		info, err := os.Stat(q.segmentPath(n))
+		if err != nil {
+			continue
+		}
+
+		q.size += info.Size()
+		q.writeSegment = n
+		q.writeSize = info.Size()
+	}
+
+	if q.size -= q.readOffset; q.size <= 0 {
+		q.reset()
+	}
+
+	return q, nil
+}
+
+func (q *spillDiskQueue) segmentPath(n int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%08d.seg", n))
+}
+
+func (q *spillDiskQueue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size == 0
+}
+
+func (q *spillDiskQueue) push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.write(data)
+}
+
+// write appends payload to the last segment. Must be called with mu held.
+func (q *spillDiskQueue) write(data []byte) error {
+	if q.size+int64(len(data))+4 > q.maxSize {
+		return errSpillFull
+	}
+
+	if q.writeSize >= spillSegmentSize {
+		if q.writeFile != nil {
+			q.writeFile.Close()
+			q.writeFile = nil
+		}
+		q.writeSegment++
+		q.writeSize = 0
+	}
+
+	if q.writeFile == nil {
+		var err error
+		if q.writeFile, err = os.OpenFile(q.segmentPath(q.writeSegment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+
+	if _, err := q.writeFile.Write(record); err != nil {
+		return err
+	}
+
+	q.writeSize += int64(len(record))
+	q.size += int64(len(record))
+
+	return nil
+}
+
+// pop returns the oldest payload, or nil if queue is empty
+func (q *spillDiskQueue) pop() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.read()
+}
+
+// read reads the oldest payload. Must be called with mu held.
+func (q *spillDiskQueue) read() ([]byte, error) {
+	for q.size > 0 {
+		if q.reader == nil {
+			file, err := os.Open(q.segmentPath(q.readSegment))
+			if err != nil {
+				q.reset()
+				return nil, err
+			}
+			if _, err := file.Seek(q.readOffset, io.SeekStart); err != nil {
+				file.Close()
+				q.reset()
+				return nil, err
+			}
+			q.readFile, q.reader = file, bufio.NewReader(file)
+		}
+
+		header := make([]byte, 4)
+		_, err := io.ReadFull(q.reader, header)
+
+		var data []byte
+		if err == nil {
+			data = make([]byte, binary.BigEndian.Uint32(header))
+			_, err = io.ReadFull(q.reader, data)
+		}
+
+		if err != nil {
+			// End of segment, or record truncated by crash
+			if q.readSegment >= q.writeSegment {
+				q.reset()
+				return nil, nil
+			}
+
+			q.readFile.Close()
+			q.readFile, q.reader = nil, nil
+			// Remainder is counted before segment is removed
+			q.size -= q.segmentRemainder()
+			os.Remove(q.segmentPath(q.readSegment))
+			q.readSegment++
+			q.readOffset = 0
+			q.saveIndex()
+			continue
+		}
+
+		q.readOffset += int64(4 + len(data))
+		q.size -= int64(4 + len(data))
+
+		if q.size <= 0 {
+			q.reset()
+		} else if q.reads++; q.reads >= spillIndexEvery {
+			q.saveIndex()
+		}
+
+		return data, nil
+	}
+
+	return nil, nil
+}
+
+// segmentRemainder returns unread bytes of the read segment, which is not the last one
+func (q *spillDiskQueue) segmentRemainder() int64 {
+	info, err := os.Stat(q.segmentPath(q.readSegment))
+	if err != nil {
+		return 0
+	}
+
+	return info.Size() - q.readOffset
+}
+
+// reset removes all segments, once queue is empty
+func (q *spillDiskQueue) reset() {
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile, q.reader = nil, nil
+	}
+	if q.writeFile != nil {
+		q.writeFile.Close()
+		q.writeFile = nil
+	}
+
+	for n := q.readSegment; n <= q.writeSegment; n++ {
+		os.Remove(q.segmentPath(n))
+	}
+
+	q.writeSegment++
+	q.readSegment = q.writeSegment
+	q.readOffset, q.writeSize, q.size = 0, 0, 0
+	q.saveIndex()
+}
+
+func (q *spillDiskQueue) saveIndex() {
+	q.reads = 0
+
+	tmp := filepath.Join(q.dir, "index.tmp")
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", q.readSegment, q.readOffset)), 0644); err != nil {
+		log.Println("Can't save spill index:", err)
+		return
+	}
+	os.Rename(tmp, filepath.Join(q.dir, "index"))
+}
+
+// close writes given payloads to the queue, and closes its files
+func (q *spillDiskQueue) close(payloads [][]byte) (err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, data := range payloads {
+		if e := q.write(data); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile, q.reader = nil, nil
+	}
+	if q.writeFile != nil {
+		q.writeFile.Close()
+		q.writeFile = nil
+	}
+	q.saveIndex()
+
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpillDiskQueue(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_spill")
+	defer os.RemoveAll(dir)
+
+	defer func(size int64) { spillSegmentSize = size }(spillSegmentSize)
+	spillSegmentSize = 20
+
+	q, err := openSpillDiskQueue(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := q.push([]byte("payload" + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if data, _ := q.pop(); string(data) != "payload"+strconv.Itoa(i) {
+			t.Errorf("Wrong payload %d: %q", i, data)
+		}
+	}
+
+	// Queue is resumed after restart
+	q.close([][]byte{[]byte("payload10")})
+	if q, err = openSpillDiskQueue(dir, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 3; i <= 10; i++ {
+		if data, _ := q.pop(); string(data) != "payload"+strconv.Itoa(i) {
+			t.Errorf("Wrong payload %d: %q", i, data)
+		}
+	}
+
+	if data, _ := q.pop(); data != nil || !q.empty() {
+		t.Error("Queue should be empty:", string(data))
+	}
+
+	if segments, _ := ioutil.ReadDir(dir); len(segments) != 1 {
+		t.Error("Should remove read segments:", len(segments))
+	}
+
+	// Size limit
+	if err := q.push(make([]byte, 990)); err != nil {
+		t.Error(err)
+	}
+	if err := q.push([]byte("payload")); err != errSpillFull {
+		t.Error("Should not exceed size limit:", err)
+	}
+}
+
+func TestSpillDiskQueueTruncatedSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_spill")
+	defer os.RemoveAll(dir)
+
+	defer func(size int64) { spillSegmentSize = size }(spillSegmentSize)
+	spillSegmentSize = 20
+
+	q, err := openSpillDiskQueue(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records of 12 bytes, 2 in each segment
+	for i := 0; i < 6; i++ {
+		q.push([]byte("payload" + strconv.Itoa(i)))
+	}
+	q.close(nil)
+
+	// The last record of the first segment is truncated by crash
+	if err := os.Truncate(q.segmentPath(q.readSegment), 18); err != nil {
+		t.Fatal(err)
+	}
+
+	if q, err = openSpillDiskQueue(dir, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{0, 2} {
+		if data, _ := q.pop(); string(data) != "payload"+strconv.Itoa(i) {
+			t.Errorf("Wrong payload %d: %q", i, data)
+		}
+	}
+
+	if q.size != 36 {
+		t.Error("Unread bytes of truncated segment should not be counted:", q.size)
+	}
+
+	for i := 3; i < 6; i++ {
+		if data, _ := q.pop(); string(data) != "payload"+strconv.Itoa(i) {
+			t.Errorf("Wrong payload %d: %q", i, data)
+		}
+	}
+
+	if !q.empty() {
+		t.Error("Queue should be empty:", q.size)
+	}
+}
+
+func TestSpillQueue(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_spill")
+	defer os.RemoveAll(dir)
+
+	defer func(size int) { spillMemorySize = size }(spillMemorySize)
+	spillMemorySize = 2
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var received []string
+
+	output := NewTestOutput(func(data []byte) {
+		<-release
+
+		mu.Lock()
+		received = append(received, string(data))
+		mu.Unlock()
+	})
+
+	queue, err := NewSpillQueue(output, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		payload := "payload" + strconv.Itoa(i)
+		expected = append(expected, payload)
+
+		if n, _ := queue.Write([]byte(payload)); n != len(payload) {
+			t.Error("Write should not block")
+		}
+	}
+
+	if s := queue.(*SpillQueue).Stats(); s.Spilled < 17 || s.QueuedBytes == 0 {
+		t.Errorf("Should spill payloads: %+v", s)
+	}
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Error("Should deliver payloads in order:", received)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// streamReplayer sends bodies of payloads to the server over single connection, in order, and discards data sent by
+// server. It is used by outputs replaying messages of binary protocols, which don't depend on connection they were
+// captured on. Connection is opened when needed, and opened again if sending fails.
+type streamReplayer struct {
+	replayed uint64
+
+	// Prefix of debug messages, like "[OUTPUT-MONGO]"
+	name    string
+	address string
+	timeout time.Duration
+
+	payloads chan []byte
+
+	// Used only by replay goroutine
+	conn net.Conn
+}
+
+func newStreamReplayer(name string, address string, timeout time.Duration) *streamReplayer {
+	r := &streamReplayer{name: name, address: address, timeout: timeout}
+	r.payloads = make(chan []byte, 1000)
+
+	go r.replay()
+
+	return r
+}
+
+// send queues payload, blocking if server doesn't keep up
+func (r *streamReplayer) send(data []byte) {
+	enqueuePayload(r.payloads, nil, data)
+}
+
+func (r *streamReplayer) replay() {
+	for data := range r.payloads {
+		body := payloadBody(data)
+		if len(body) == 0 {
+			continue
+		}
+
+		if r.conn == nil {
+			conn, err := net.DialTimeout("tcp", r.address, r.timeout)
+			if err != nil {
+				Debug(r.name, "Connection error:", err)
+				continue
+			}
+
+			go io.Copy(ioutil.Discard, conn)
+			r.conn = conn
+		}
+
+		r.conn.SetWriteDeadline(time.Now().Add(r.timeout))
+		if _, err := r.conn.Write(body); err != nil {
+			Debug(r.name, "Write error:", err)
+			r.conn.Close()
+			r.conn = nil
+			continue
+		}
+
+		atomic.AddUint64(&r.replayed, 1)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+)
+
+// startStreamServer starts server standing for replayed one. It writes reply to each accepted connection, and sends
+// data returned by read to received, until read fails.
+func startStreamServer(t *testing.T, reply string, read func(r *bufio.Reader) (string, error)) (listener net.Listener, received chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received = make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if reply != "" {
+					conn.Write([]byte(reply))
+				}
+
+				r := bufio.NewReader(conn)
+				for {
+					data, err := read(r)
+					if data != "" {
+						received <- data
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener, received
+}
+
+// readTestChunk returns read function for startStreamServer, which reads data by chunks of size bytes
+func readTestChunk(size int) func(r *bufio.Reader) (string, error) {
+	return func(r *bufio.Reader) (string, error) {
+		buf := make([]byte, size)
+		n, err := io.ReadFull(r, buf)
+		return string(buf[:n]), err
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,33 +15,60 @@ import (
 // TCPOutput used for sending raw tcp payloads
 // Currently used for internal communication between listener and replay server
 // Can be used for transfering binary payloads like protocol buffers
+//
+// With --output-tcp-ack payloads are framed, and ones not acknowledged by input are resent after reconnect:
+//
+//	gor --input-raw :80 --output-tcp replay.local:28020 --output-tcp-ack
 type TCPOutput struct {
 	address  string
+	config   *TCPConfig
+	tls      *tls.Config
 	limit    int
 	buf      chan []byte
 	bufStats *GorStat
+
+	// Maximum number of frames not acknowledged yet, see TCPConfig.AckWindow
+	ackWindow int
 }
 
 // NewTCPOutput constructor for TCPOutput
 // Initialize 10 workers which hold keep-alive connection
-func NewTCPOutput(address string) io.Writer {
+func NewTCPOutput(address string, config *TCPConfig) io.Writer {
 	o := new(TCPOutput)
 
 	o.address = address
+	o.config = config
+
+	if config.TLS {
+		var err error
+		if o.tls, err = newTLSConfig(config.TLSCA, config.TLSCert, config.TLSKey, false); err != nil {
+			log.Fatal("Can't load TLS configuration: ", err)
+		}
+	}
 
 	o.buf = make(chan []byte, 100)
 	if Settings.outputTCPStats {
 		o.bufStats = NewGorStat("output_tcp")
 	}
 
+	o.ackWindow = config.AckWindow
+	if o.ackWindow <= 0 {
+		o.ackWindow = 1000
+	}
+
 	for i := 0; i < 10; i++ {
-		go o.worker()
+		if config.Ack {
+			go o.ackWorker()
+		} else {
+			go o.worker()
+		}
 	}
 
 	return o
 }
 
-func (o *TCPOutput) worker() {
+// dial connects to aggregator instance, retrying until it succeeds
+func (o *TCPOutput) dial() net.Conn {
 	retries := 1
 	conn, err := o.connect(o.address)
 	for {
@@ -45,7 +76,7 @@ func (o *TCPOutput) worker() {
 			break
 		}
 
-		log.Println("Can't connect to aggregator instance, reconnecting in 1 second. Retries:", retries)
+		log.Println("Can't connect to aggregator instance, reconnecting in 1 second. Retries:", retries, err)
 		time.Sleep(1 * time.Second)
 
 		conn, err = o.connect(o.address)
@@ -56,6 +87,11 @@ func (o *TCPOutput) worker() {
 		log.Println("Connected to aggregator instance after ", retries, " retries")
 	}
 
+	return conn
+}
+
+func (o *TCPOutput) worker() {
+	conn := o.dial()
 	defer conn.Close()
 
 	for {
@@ -70,16 +106,108 @@ func (o *TCPOutput) worker() {
 	}
 }
 
+// ackWorker sends payloads in frames, keeping up to ackWindow frames until input acknowledges them, and resends
+// them after reconnect
+func (o *TCPOutput) ackWorker() {
+	id := newTCPSessionID()
+	var seq uint64
+	var unacked []tcpFrame
+
+	for {
+		conn := o.dial()
+		acks := make(chan uint64, 100)
+		go readTCPAcks(conn, acks)
+
+		writer := bufio.NewWriter(conn)
+		writer.WriteString(tcpFramedMagic)
+		writer.Write(id[:])
+		for _, f := range unacked {
+			writeTCPFrame(writer, f)
+		}
+		err := writer.Flush()
+
+		ticker := time.NewTicker(time.Second)
+		lastAck := time.Now()
+
+		for err == nil {
+			// Stop taking payloads once window is full
+			var buf chan []byte
+			if len(unacked) < o.ackWindow {
+				buf = o.buf
+			}
+
+			select {
+			case data := <-buf:
+				if len(unacked) == 0 {
+					lastAck = time.Now()
+				}
+
+				// Write payloads which are already queued before flushing
+				for more := true; more && err == nil; {
+					seq++
+					f := tcpFrame{seq: seq, data: data}
+					unacked = append(unacked, f)
+					err = writeTCPFrame(writer, f)
+
+					more = false
+					if len(unacked) < o.ackWindow {
+						select {
+						case data = <-o.buf:
+							more = true
+						default:
+						}
+					}
+				}
+				if err == nil {
+					err = writer.Flush()
+				}
+			case ack, ok := <-acks:
+				if !ok {
+					err = errors.New("Connection closed by input")
+					break
+				}
+
+				n := 0
+				for n < len(unacked) && unacked[n].seq <= ack {
+					n++
+				}
+				unacked = append(unacked[:0], unacked[n:]...)
+				lastAck = time.Now()
+			case now := <-ticker.C:
+				if len(unacked) > 0 && now.Sub(lastAck) > tcpAckTimeout {
+					err = errors.New("Payloads are not acknowledged")
+				}
+			}
+		}
+
+		ticker.Stop()
+		conn.Close()
+		for range acks {
+		}
+
+		log.Println("Lost connection with aggregator instance, reconnecting. Payloads to resend:", len(unacked), err)
+	}
+}
+
+// readTCPAcks reads sequence numbers acknowledged by input, until connection is closed
+func readTCPAcks(conn net.Conn, acks chan<- uint64) {
+	defer close(acks)
+
+	var ack [8]byte
+	for {
+		if _, err := io.ReadFull(conn, ack[:]); err != nil {
+			return
+		}
+		acks <- binary.BigEndian.Uint64(ack[:])
+	}
+}
+
 func (o *TCPOutput) Write(data []byte) (n int, err error) {
 	if !isOriginPayload(data) {
 		return len(data), nil
 	}
 
-	// We have to copy, because sending data in multiple threads
-	newBuf := make([]byte, len(data))
-	copy(newBuf, data)
-
-	o.buf <- newBuf
+	enqueuePayload(o.buf, nil, data)
 
 	if Settings.outputTCPStats {
 		o.bufStats.Write(len(o.buf))
@@ -89,7 +217,17 @@ func (o *TCPOutput) Write(data []byte) (n int, err error) {
 }
 
 func (o *TCPOutput) connect(address string) (conn net.Conn, err error) {
-	conn, err = net.Dial("tcp", address)
+	if o.tls != nil {
+		conn, err = tls.Dial("tcp", address, o.tls)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
+
+	if err == nil && o.config.Token != "" {
+		if err = tcpAuthenticateServer(conn, o.config.Token); err != nil {
+			conn.Close()
+		}
+	}
 
 	return
 }
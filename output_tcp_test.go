@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
 )
@@ -17,7 +19,7 @@ func TestTCPOutput(t *testing.T) {
 		wg.Done()
 	})
 	input := NewTestInput()
-	output := NewTCPOutput(listener.Addr().String())
+	output := NewTCPOutput(listener.Addr().String(), &TCPConfig{})
 
 	Plugins.Inputs = []io.Reader{input}
 	Plugins.Outputs = []io.Writer{output}
@@ -34,6 +36,64 @@ func TestTCPOutput(t *testing.T) {
 	close(quit)
 }
 
+func TestTCPOutputAck(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+
+	o := &TCPOutput{address: listener.Addr().String(), config: &TCPConfig{Ack: true}, buf: make(chan []byte, 100), ackWindow: 10}
+	for i := 1; i <= 5; i++ {
+		o.buf <- []byte(strconv.Itoa(i))
+	}
+	go o.ackWorker()
+
+	accept := func() (net.Conn, *bufio.Reader, tcpSessionID) {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+
+		var hello [len(tcpFramedMagic) + tcpSessionIDSize]byte
+		io.ReadFull(reader, hello[:])
+		if string(hello[:len(tcpFramedMagic)]) != tcpFramedMagic {
+			t.Fatalf("Wrong connection preamble: %q", hello)
+		}
+
+		var id tcpSessionID
+		copy(id[:], hello[len(tcpFramedMagic):])
+		return conn, reader, id
+	}
+
+	// Connection is lost before frames are acknowledged
+	conn, reader, id := accept()
+	for i := 0; i < 3; i++ {
+		readTCPFrame(reader)
+	}
+	conn.Close()
+
+	conn, reader, resumed := accept()
+	defer conn.Close()
+	if resumed != id {
+		t.Error("Session should be resumed after reconnect")
+	}
+
+	var ack [8]byte
+	for i := uint64(1); i <= 5; i++ {
+		f, err := readTCPFrame(reader)
+		if err != nil || f.seq != i || string(f.data) != strconv.FormatUint(i, 10) {
+			t.Fatalf("Frame %d should be resent: %d %q %v", i, f.seq, f.data, err)
+		}
+	}
+	binary.BigEndian.PutUint64(ack[:], 5)
+	conn.Write(ack[:])
+
+	// Acknowledged frames are not kept
+	o.buf <- []byte("6")
+	if f, _ := readTCPFrame(reader); f.seq != 6 || string(f.data) != "6" {
+		t.Errorf("Wrong frame after acknowledgement: %d %q", f.seq, f.data)
+	}
+}
+
 func startTCP(cb func([]byte)) net.Listener {
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 
@@ -69,7 +129,7 @@ func BenchmarkTCPOutput(b *testing.B) {
 		wg.Done()
 	})
 	input := NewTestInput()
-	output := NewTCPOutput(listener.Addr().String())
+	output := NewTCPOutput(listener.Addr().String(), &TCPConfig{})
 
 	Plugins.Inputs = []io.Reader{input}
 	Plugins.Outputs = []io.Writer{output}
@@ -86,3 +146,18 @@ func BenchmarkTCPOutput(b *testing.B) {
 
 	close(quit)
 }
+
+func TestTCPOutputAckWindow(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+
+	// Default is applied to window which is not set or invalid, shared config is kept as is
+	for _, window := range []int{0, -1} {
+		config := &TCPConfig{Ack: true, AckWindow: window}
+		o := NewTCPOutput(listener.Addr().String(), config).(*TCPOutput)
+
+		if o.ackWindow != 1000 || config.AckWindow != window {
+			t.Errorf("Wrong window %d: %d, config %d", window, o.ackWindow, config.AckWindow)
+		}
+	}
+}
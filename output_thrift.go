@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// ThriftOutputConfig struct for holding Thrift output configuration
+type ThriftOutputConfig struct {
+	// Timeout of connecting to the server, and sending calls
+	Timeout time.Duration
+}
+
+// ThriftOutput plugin replays captured Thrift calls to given server, for example to shadow test new version of
+// service. Calls of all captured connections are sent over single connection, and replies are discarded:
+//
+//	gor --input-raw :9090 --input-raw-protocol thrift --output-thrift staging.com:9090
+//
+// Calls are sent as captured, so server should use the same protocol and transport.
+type ThriftOutput struct {
+	address  string
+	config   *ThriftOutputConfig
+	replayer *streamReplayer
+}
+
+// NewThriftOutput constructor for ThriftOutput
+func NewThriftOutput(address string, config *ThriftOutputConfig) io.Writer {
+	o := new(ThriftOutput)
+
+	o.address = address
+	o.config = config
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	o.replayer = newStreamReplayer("[OUTPUT-THRIFT]", address, o.config.Timeout)
+
+	return o
+}
+
+func (o *ThriftOutput) Write(data []byte) (n int, err error) {
+	switch string(payloadMetaValue(data, payloadThriftTypeKey)) {
+	case "call", "oneway":
+		if isRequestPayload(data) && !isTruncatedPayload(data) {
+			o.replayer.send(data)
+		}
+	}
+
+	return len(data), nil
+}
+
+func (o *ThriftOutput) String() string {
+	return "Thrift output: " + o.address
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+func thriftTestPayload(payloadType byte, messageType byte, data string) []byte {
+	header := payloadHeader(payloadType, uuid(), time.Now().UnixNano())
+	header = appendThriftMeta(header, &raw.ThriftMessage{Method: "ping", Type: messageType})
+
+	return append(header, data...)
+}
+
+func TestThriftOutput(t *testing.T) {
+	listener, received := startStreamServer(t, "", readTestChunk(4))
+	defer listener.Close()
+
+	output := NewThriftOutput(listener.Addr().String(), &ThriftOutputConfig{})
+
+	output.Write(thriftTestPayload(RequestPayload, raw.ThriftCall, "cal1"))
+	output.Write(thriftTestPayload(ResponsePayload, raw.ThriftReply, "repl"))
+	output.Write(thriftTestPayload(RequestPayload, raw.ThriftOneway, "onew"))
+
+	for _, expected := range []string{"cal1", "onew"} {
+		select {
+		case data := <-received:
+			if data != expected {
+				t.Errorf("Should replay only calls: %q", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should replay call", expected)
+		}
+	}
+}
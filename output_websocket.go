@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Connection of replayed WebSocket stream is closed, if client sent no frames for this time
+const wsReplayIdleTimeout = time.Minute
+
+// How long handshake request waits for the first frame of its connection
+const wsHandshakeTimeout = time.Minute
+
+// WebSocket close opcode, replayed connection is closed after client sends it
+const wsCloseOpcode = 8
+
+// Handshake headers generated for replayed connection, original ones are not copied. Extensions are not negotiated,
+// since replayed frames do not use them.
+var wsHandshakeHeaders = []string{"Host", "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions"}
+
+// WebSocketOutputConfig struct for holding websocket output configuration
+type WebSocketOutputConfig struct {
+	// Timeout of connecting to the server, handshake, and writing frames
+	Timeout time.Duration
+}
+
+// WebSocketOutput plugin replays frames sent by clients of captured WebSocket connections to given server.
+// Each captured connection is replayed over own connection, opened using path and headers of the original
+// handshake request. Responses should be tracked, so connections switched to WebSocket are detected:
+//
+//	gor --input-raw :8080 --input-raw-track-response --output-websocket ws://staging:8080
+type WebSocketOutput struct {
+	address string
+	host    string
+	secure  bool
+
+	config *WebSocketOutputConfig
+
+	mu sync.Mutex
+	// UUID -> handshake requests waiting for the first frame of their connections
+	handshakes  map[string]*wsHandshake
+	lastCleanup time.Time
+	// Stream ID -> replayed connections
+	conns map[string]*wsReplayConn
+}
+
+type wsHandshake struct {
+	request []byte
+	created time.Time
+}
+
+// wsReplayConn passes frames of captured connection to the goroutine replaying it
+type wsReplayConn struct {
+	frames chan []byte
+	// Closed when goroutine stops, and frames are not read anymore
+	done chan bool
+}
+
+// NewWebSocketOutput constructor for WebSocketOutput. Address is server URL, like "ws://host:port" or
+// "wss://host:port", or just "host:port".
+func NewWebSocketOutput(address string, config *WebSocketOutputConfig) io.Writer {
+	o := new(WebSocketOutput)
+
+	o.config = config
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	if !bytes.Contains([]byte(address), []byte("://")) {
+		address = "ws://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		log.Fatal("WebSocket output address is not valid:", err)
+	}
+
+	o.secure = u.Scheme == "wss"
+	o.host = u.Host
+	o.address = u.Host
+	if u.Port() == "" {
+		if o.secure {
+			o.address += ":443"
+		} else {
+			o.address += ":80"
+		}
+	}
+
+	o.handshakes = make(map[string]*wsHandshake)
+	o.conns = make(map[string]*wsReplayConn)
+
+	return o
+}
+
+func (o *WebSocketOutput) Write(data []byte) (n int, err error) {
+	meta := payloadMeta(data)
+	if len(meta) < 2 {
+		return len(data), nil
+	}
+
+	switch data[0] {
+	case RequestPayload:
+		body := payloadBody(data)
+		if !bytes.EqualFold(proto.Header(body, []byte("Upgrade")), []byte("websocket")) {
+			break
+		}
+
+		o.mu.Lock()
+		o.cleanup()
+		o.handshakes[string(meta[1])] = &wsHandshake{request: append([]byte{}, body...), created: time.Now()}
+		o.mu.Unlock()
+	case WebSocketPayload:
+		stream := payloadMetaValue(data, payloadWSStreamKey)
+		if stream == nil || string(payloadMetaValue(data, payloadWSFromKey)) != "client" {
+			break
+		}
+
+		c := o.conn(string(stream))
+		enqueuePayload(c.frames, c.done, data)
+	}
+
+	return len(data), nil
+}
+
+// conn returns replayed connection of the stream, starting it on the first frame
+func (o *WebSocketOutput) conn(stream string) *wsReplayConn {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	c, ok := o.conns[stream]
+	if ok {
+		return c
+	}
+
+	c = &wsReplayConn{frames: make(chan []byte, 100), done: make(chan bool)}
+	o.conns[stream] = c
+
+	var request []byte
+	if h, ok := o.handshakes[stream]; ok {
+		request = h.request
+		delete(o.handshakes, stream)
+	}
+
+	go o.replay(stream, c, request)
+
+	return c
+}
+
+// cleanup forgets handshakes of connections without frames, should be called with lock held
+func (o *WebSocketOutput) cleanup() {
+	now := time.Now()
+	if now.Sub(o.lastCleanup) < wsHandshakeTimeout {
+		return
+	}
+
+	for id, h := range o.handshakes {
+		if now.Sub(h.created) > wsHandshakeTimeout {
+			delete(o.handshakes, id)
+		}
+	}
+	o.lastCleanup = now
+}
+
+// replay opens connection to the server, and sends frames of the stream until client closes it, or it is idle.
+// If connection fails, frames are discarded.
+func (o *WebSocketOutput) replay(stream string, c *wsReplayConn, request []byte) {
+	defer func() {
+		o.mu.Lock()
+		delete(o.conns, stream)
+		o.mu.Unlock()
+	}()
+	defer close(c.done)
+
+	conn, err := o.connect(request)
+	if err != nil {
+		Debug("[OUTPUT-WEBSOCKET] Handshake error:", err)
+	} else {
+		defer conn.Close()
+	}
+
+	for {
+		var data []byte
+
+		select {
+		case data = <-c.frames:
+		case <-time.After(wsReplayIdleTimeout):
+			return
+		}
+
+		opcode, _ := strconv.Atoi(string(payloadMetaValue(data, payloadWSOpcodeKey)))
+		fin := string(payloadMetaValue(data, payloadWSFinKey)) != "0"
+
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+			if _, err := conn.Write(wsEncodeFrame(byte(opcode), fin, payloadBody(data))); err != nil {
+				Debug("[OUTPUT-WEBSOCKET] Frame error:", err)
+				conn.Close()
+				conn = nil
+			}
+		}
+
+		if opcode == wsCloseOpcode {
+			return
+		}
+	}
+}
+
+// connect opens connection to the server, and performs handshake. Frames sent by server are discarded.
+func (o *WebSocketOutput) connect(request []byte) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.config.Timeout}
+
+	var conn net.Conn
+	var err error
+	if o.secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", o.address, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", o.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+
+	if _, err = conn.Write(o.handshakeRequest(request)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("Server rejected handshake: %s", resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	go io.Copy(ioutil.Discard, reader)
+
+	return conn, nil
+}
+
+// handshakeRequest builds handshake of replayed connection, with path and headers of the original request.
+// If original request is not captured, root path is used.
+func (o *WebSocketOutput) handshakeRequest(original []byte) []byte {
+	path := []byte("/")
+	if original != nil {
+		path = proto.Path(original)
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	buf := []byte("GET ")
+	buf = append(buf, path...)
+	buf = append(buf, " HTTP/1.1\r\nHost: "...)
+	buf = append(buf, o.host...)
+	buf = append(buf, "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: "...)
+	buf = append(buf, base64.StdEncoding.EncodeToString(key)...)
+	buf = append(buf, "\r\nSec-WebSocket-Version: 13\r\n"...)
+
+	if end := proto.MIMEHeadersEndPos(original); original != nil && end != -1 {
+		lines := bytes.Split(original[:end], proto.CLRF)
+
+		// First line is request line
+		for _, line := range lines[1:] {
+			i := bytes.IndexByte(line, ':')
+			if i <= 0 || isWSHandshakeHeader(string(bytes.TrimSpace(line[:i]))) {
+				continue
+			}
+
+			buf = append(buf, line...)
+			buf = append(buf, proto.CLRF...)
+		}
+	}
+
+	return append(buf, proto.CLRF...)
+}
+
+func isWSHandshakeHeader(name string) bool {
+	for _, h := range wsHandshakeHeaders {
+		if http.CanonicalHeaderKey(name) == h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wsEncodeFrame builds frame sent by client, so payload is masked
+func wsEncodeFrame(opcode byte, fin bool, payload []byte) []byte {
+	frame := []byte{opcode, 0x80}
+	if fin {
+		frame[0] |= 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame[1] |= byte(len(payload))
+	case len(payload) < 1<<16:
+		frame[1] |= 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame[1] |= 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+func (o *WebSocketOutput) String() string {
+	return "WebSocket output: " + o.address
+}
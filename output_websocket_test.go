@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+type wsTestFrame struct {
+	opcode  byte
+	fin     bool
+	masked  bool
+	payload string
+}
+
+// startWSServer accepts WebSocket connections, and reports handshake requests and received frames
+func startWSServer(t *testing.T) (net.Listener, chan *http.Request, chan wsTestFrame) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan *http.Request, 10)
+	frames := make(chan wsTestFrame, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				requests <- req
+
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+				// Greeting is discarded by output
+				conn.Write([]byte{0x81, 2, 'h', 'i'})
+
+				for {
+					header := make([]byte, 2)
+					if _, err := io.ReadFull(reader, header); err != nil {
+						return
+					}
+
+					f := wsTestFrame{opcode: header[0] & 0xf, fin: header[0]&0x80 != 0, masked: header[1]&0x80 != 0}
+					length := uint64(header[1] & 0x7f)
+					switch length {
+					case 126:
+						ext := make([]byte, 2)
+						io.ReadFull(reader, ext)
+						length = uint64(binary.BigEndian.Uint16(ext))
+					case 127:
+						ext := make([]byte, 8)
+						io.ReadFull(reader, ext)
+						length = binary.BigEndian.Uint64(ext)
+					}
+
+					mask := make([]byte, 4)
+					if f.masked {
+						io.ReadFull(reader, mask)
+					}
+
+					payload := make([]byte, length)
+					io.ReadFull(reader, payload)
+					for i := range payload {
+						payload[i] ^= mask[i%4]
+					}
+					f.payload = string(payload)
+
+					frames <- f
+				}
+			}()
+		}
+	}()
+
+	return listener, requests, frames
+}
+
+func wsTestPayload(stream []byte, isIncoming bool, opcode byte, fin bool, payload string) []byte {
+	header := payloadHeader(WebSocketPayload, uuid(), time.Now().UnixNano())
+	header = appendWebSocketMeta(header, &raw.WebSocketFrame{StreamID: stream, Opcode: opcode, Fin: fin}, isIncoming)
+
+	return append(header, payload...)
+}
+
+func TestWebSocketOutput(t *testing.T) {
+	listener, requests, frames := startWSServer(t)
+	defer listener.Close()
+
+	output := NewWebSocketOutput("ws://"+listener.Addr().String(), &WebSocketOutputConfig{})
+
+	stream := uuid()
+	handshake := "GET /chat?room=1 HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Extensions: permessage-deflate\r\nX-Token: abc\r\n\r\n"
+	output.Write(append(payloadHeader(RequestPayload, stream, 1), handshake...))
+
+	output.Write(wsTestPayload(stream, true, 1, false, "hel"))
+	output.Write(wsTestPayload(stream, false, 1, true, "from server"))
+	output.Write(wsTestPayload(stream, true, 0, true, "lo"))
+	output.Write(wsTestPayload(stream, true, 8, true, "\x03\xe8"))
+
+	select {
+	case req := <-requests:
+		if req.URL.String() != "/chat?room=1" || req.Header.Get("X-Token") != "abc" {
+			t.Error("Should use path and headers of original handshake", req.URL, req.Header)
+		}
+
+		if req.Host != listener.Addr().String() || req.Header.Get("Sec-WebSocket-Extensions") != "" || req.Header.Get("Sec-WebSocket-Key") == "dGhlIHNhbXBsZSBub25jZQ==" {
+			t.Error("Should generate handshake headers", req.Host, req.Header)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should open connection")
+	}
+
+	expected := []wsTestFrame{
+		{1, false, true, "hel"},
+		{0, true, true, "lo"},
+		{8, true, true, "\x03\xe8"},
+	}
+
+	for i, e := range expected {
+		select {
+		case f := <-frames:
+			if f != e {
+				t.Errorf("Wrong frame %d: %+v", i, f)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should replay client frames", i)
+		}
+	}
+
+	// Frame of connection which handshake is not captured
+	output.Write(wsTestPayload(uuid(), true, 2, true, "data"))
+
+	select {
+	case req := <-requests:
+		if req.URL.Path != "/" {
+			t.Error("Should use root path", req.URL)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should open connection")
+	}
+
+	if f := <-frames; f.opcode != 2 || f.payload != "data" {
+		t.Errorf("Wrong frame: %+v", f)
+	}
+}
+
+func TestWSEncodeFrame(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		frame := wsEncodeFrame(2, true, make([]byte, size))
+
+		headerSize := 2 + 4
+		if size > 65535 {
+			headerSize += 8
+		} else if size > 125 {
+			headerSize += 2
+		}
+
+		if len(frame) != headerSize+size || frame[0] != 0x82 || frame[1]&0x80 == 0 {
+			t.Error("Wrong frame header", size, frame[:2])
+		}
+	}
+}
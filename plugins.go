@@ -2,6 +2,8 @@ package main
 
 import (
 	"io"
+	"log"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
@@ -57,15 +59,26 @@ func registerPlugin(constructor interface{}, options ...interface{}) {
 	plugin := vc.Call(vo)[0].Interface()
 	pluginWrapper := plugin
 
-	if limit != "" {
-		pluginWrapper = NewLimiter(plugin, limit)
-	} else {
-		pluginWrapper = plugin
-	}
-
 	_, isR := plugin.(io.Reader)
 	_, isW := plugin.(io.Writer)
 
+	// Outputs are wrapped by spill queue, and limiter drops payloads before they are queued
+	if isW && Settings.outputSpillDir != "" {
+		dir := filepath.Join(Settings.outputSpillDir, spillDirName(len(Plugins.Outputs), plugin))
+		spill, err := NewSpillQueue(plugin.(io.Writer), dir, parseDataUnit(Settings.outputSpillMaxSize))
+		if err != nil {
+			log.Fatal("Can't open spill queue: ", err)
+		}
+
+		pluginWrapper = spill
+		// Closed before the output, to spill payloads it didn't accept
+		Plugins.All = append(Plugins.All, spill)
+	}
+
+	if limit != "" {
+		pluginWrapper = NewLimiter(pluginWrapper, limit)
+	}
+
 	// Some of the output can be Readers as well because return responses
 	if isR && !isW {
 		Plugins.Inputs = append(Plugins.Inputs, pluginWrapper.(io.Reader))
@@ -96,20 +109,37 @@ func InitPlugins() {
 	}
 
 	engine := EnginePcap
-	if Settings.inputRAWEngine == "raw_socket" {
+	switch Settings.inputRAWEngine {
+	case "raw_socket":
 		engine = EngineRawSocket
+	case "af_packet":
+		engine = EngineAFPacket
+	case "uprobe":
+		engine = EngineUprobe
 	}
 
 	for _, options := range Settings.inputRAW {
-		registerPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, time.Duration(0), Settings.inputRAWRealIPHeader)
+		// Each input gets own copy of config, listener filter can be changed per input
+		config := Settings.inputRAWConfig
+		registerPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, time.Duration(0), Settings.inputRAWRealIPHeader, &config)
+	}
+
+	for _, options := range Settings.inputUnixSocket {
+		config := Settings.inputRAWConfig
+		registerPlugin(NewRAWInput, options, EngineUnixProxy, Settings.inputRAWTrackResponse, time.Duration(0), Settings.inputRAWRealIPHeader, &config)
+	}
+
+	for _, options := range Settings.inputPcapFile {
+		config := Settings.inputRAWConfig
+		registerPlugin(NewRAWInput, options, EnginePcapFile, Settings.inputRAWTrackResponse, time.Duration(0), Settings.inputRAWRealIPHeader, &config)
 	}
 
 	for _, options := range Settings.inputTCP {
-		registerPlugin(NewTCPInput, options)
+		registerPlugin(NewTCPInput, options, &Settings.inputTCPConfig)
 	}
 
 	for _, options := range Settings.outputTCP {
-		registerPlugin(NewTCPOutput, options)
+		registerPlugin(NewTCPOutput, options, &Settings.outputTCPConfig)
 	}
 
 	for _, options := range Settings.inputFile {
@@ -120,8 +150,52 @@ func InitPlugins() {
 		registerPlugin(NewFileOutput, options, &Settings.outputFileConfig)
 	}
 
+	for _, options := range Settings.outputS3 {
+		registerPlugin(NewS3Output, options, &Settings.outputS3Config)
+	}
+
+	for _, options := range Settings.outputElasticsearch {
+		registerPlugin(NewElasticsearchOutput, options, &Settings.outputElasticsearchConfig)
+	}
+
+	for _, options := range Settings.outputClickHouse {
+		registerPlugin(NewClickHouseOutput, options, &Settings.outputClickHouseConfig)
+	}
+
+	for _, options := range Settings.inputKafka {
+		registerPlugin(NewKafkaInput, options, &Settings.inputKafkaConfig)
+	}
+
+	for _, options := range Settings.outputKafka {
+		registerPlugin(NewKafkaOutput, options, &Settings.outputKafkaConfig)
+	}
+
+	for _, options := range Settings.inputNATS {
+		registerPlugin(NewNATSInput, options, &Settings.inputNATSConfig)
+	}
+
+	for _, options := range Settings.outputNATS {
+		registerPlugin(NewNATSOutput, options, &Settings.outputNATSConfig)
+	}
+
+	for _, options := range Settings.inputRabbitMQ {
+		registerPlugin(NewRabbitMQInput, options, &Settings.inputRabbitMQConfig)
+	}
+
+	for _, options := range Settings.outputRabbitMQ {
+		registerPlugin(NewRabbitMQOutput, options, &Settings.outputRabbitMQConfig)
+	}
+
+	for _, options := range Settings.inputSQS {
+		registerPlugin(NewSQSInput, options)
+	}
+
+	for _, options := range Settings.inputPubSub {
+		registerPlugin(NewPubSubInput, options)
+	}
+
 	for _, options := range Settings.inputHTTP {
-		registerPlugin(NewHTTPInput, options)
+		registerPlugin(NewHTTPInput, options, &Settings.inputHTTPConfig)
 	}
 
 	// If we explicitly set Host header http output should not rewrite it
@@ -136,4 +210,44 @@ func InitPlugins() {
 	for _, options := range Settings.outputHTTP {
 		registerPlugin(NewHTTPOutput, options, &Settings.outputHTTPConfig)
 	}
+
+	for _, options := range Settings.outputDNS {
+		registerPlugin(NewDNSOutput, options, &Settings.outputDNSConfig)
+	}
+
+	for _, options := range Settings.outputWebSocket {
+		registerPlugin(NewWebSocketOutput, options, &Settings.outputWebSocketConfig)
+	}
+
+	for _, options := range Settings.outputGRPC {
+		registerPlugin(NewGRPCOutput, options, &Settings.outputGRPCConfig)
+	}
+
+	for _, options := range Settings.outputRawTCP {
+		registerPlugin(NewRawTCPOutput, options, &Settings.outputRawTCPConfig)
+	}
+
+	for _, options := range Settings.outputRedis {
+		registerPlugin(NewRedisOutput, options, &Settings.outputRedisConfig)
+	}
+
+	for _, options := range Settings.outputMemcached {
+		registerPlugin(NewMemcachedOutput, options, &Settings.outputMemcachedConfig)
+	}
+
+	for _, options := range Settings.outputMongo {
+		registerPlugin(NewMongoOutput, options, &Settings.outputMongoConfig)
+	}
+
+	for _, options := range Settings.outputKafkaProduce {
+		registerPlugin(NewKafkaProduceOutput, options, &Settings.outputKafkaProduceConfig)
+	}
+
+	for _, options := range Settings.outputThrift {
+		registerPlugin(NewThriftOutput, options, &Settings.outputThriftConfig)
+	}
+
+	for _, options := range Settings.outputShadow {
+		registerPlugin(NewShadowOutput, options, &Settings.outputShadowConfig)
+	}
 }
@@ -166,6 +166,21 @@ func SetHeader(payload, name, value []byte) []byte {
 	return AddHeader(payload, name, value)
 }
 
+// DeleteHeader removes header, if it is present
+// Returns modified request payload
+func DeleteHeader(payload, name []byte) []byte {
+	_, hs, _, he := header(payload, name)
+
+	if hs == -1 {
+		return payload
+	}
+
+	// Remove line break after the value too
+	he += bytes.IndexByte(payload[he:], '\n') + 1
+
+	return byteutils.Replace(payload, hs, he, nil)
+}
+
 // AddHeader takes http payload and appends new header to the start of headers section
 // Returns modified request payload
 func AddHeader(payload, name, value []byte) []byte {
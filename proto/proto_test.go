@@ -97,6 +97,18 @@ func TestSetHeader(t *testing.T) {
 	}
 }
 
+func TestDeleteHeader(t *testing.T) {
+	payload := []byte("POST /post HTTP/1.1\r\nContent-Length: 7\r\nHost: www.w3.org\r\n\r\na=1&b=2")
+
+	if payload = DeleteHeader(payload, []byte("Content-Length")); !bytes.Equal(payload, []byte("POST /post HTTP/1.1\r\nHost: www.w3.org\r\n\r\na=1&b=2")) {
+		t.Error("Should remove header", string(payload))
+	}
+
+	if payload = DeleteHeader(payload, []byte("User-Agent")); !bytes.Equal(payload, []byte("POST /post HTTP/1.1\r\nHost: www.w3.org\r\n\r\na=1&b=2")) {
+		t.Error("Should keep payload if header not found", string(payload))
+	}
+}
+
 func TestPath(t *testing.T) {
 	var path, payload []byte
 
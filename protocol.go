@@ -4,13 +4,22 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"net/url"
 	"strconv"
+	"strings"
+
+	"github.com/buger/gor/proto"
+	raw "github.com/buger/gor/raw_socket_listener"
 )
 
 const (
 	RequestPayload          = '1'
 	ResponsePayload         = '2'
 	ReplayedResponsePayload = '3'
+	// Frame of WebSocket connection, holding unmasked frame payload, see appendWebSocketMeta
+	WebSocketPayload = '4'
+	// Chunk of connection captured in raw TCP mode, holding data as is, see appendTCPChunkMeta
+	TCPChunkPayload = '5'
 )
 
 func uuid() []byte {
@@ -60,6 +69,391 @@ func payloadHeader(payloadType byte, uuid []byte, timing int64) (header []byte)
 	return header
 }
 
+// Added to payload header after timing, if message was truncated by --input-raw-max-message-size
+var payloadTruncatedMark = []byte("truncated")
+
+// Payload header fields holding original sender and receiver addresses, like "src=10.0.0.1:51234"
+var payloadSrcKey = []byte("src=")
+var payloadDstKey = []byte("dst=")
+
+// Payload header field holding trailers of chunked message, see encodeTrailers
+var payloadTrailersKey = []byte("trailers=")
+
+// Payload header fields of WebSocket frame: UUID of the handshake request, side which sent the frame
+// ("client" or "server"), frame opcode, and "1" if frame is the final fragment of the message, otherwise "0"
+var payloadWSStreamKey = []byte("ws_stream=")
+var payloadWSFromKey = []byte("ws_from=")
+var payloadWSOpcodeKey = []byte("ws_opcode=")
+var payloadWSFinKey = []byte("ws_fin=")
+
+// Payload header fields of gRPC call: full method name, number of messages, and status code of response
+var payloadGRPCMethodKey = []byte("grpc_method=")
+var payloadGRPCMessagesKey = []byte("grpc_messages=")
+var payloadGRPCStatusKey = []byte("grpc_status=")
+
+// Payload header fields of raw TCP chunk: connection ID, side which sent the data ("client" or "server"), and offset
+// of the data in the byte stream of the side. Closing chunk of connection has additional "tcp_closed" mark.
+var payloadTCPConnKey = []byte("tcp_conn=")
+var payloadTCPFromKey = []byte("tcp_from=")
+var payloadTCPOffsetKey = []byte("tcp_offset=")
+var payloadTCPClosedMark = []byte("tcp_closed")
+
+// Payload header fields of MySQL command and result: command name, like "query", prepared statement ID, and default
+// database of the connection. Results also have number of rows, and error code if command failed.
+var payloadMySQLCommandKey = []byte("mysql_cmd=")
+var payloadMySQLStatementKey = []byte("mysql_stmt=")
+var payloadMySQLDatabaseKey = []byte("mysql_db=")
+var payloadMySQLRowsKey = []byte("mysql_rows=")
+var payloadMySQLErrorKey = []byte("mysql_error=")
+
+// Payload header fields of PostgreSQL request and response: request kind, like "query", user and database of the
+// connection. Responses also have URL-encoded command tag, number of rows, and SQLSTATE error code if request failed.
+var payloadPgKindKey = []byte("pg_kind=")
+var payloadPgUserKey = []byte("pg_user=")
+var payloadPgDatabaseKey = []byte("pg_db=")
+var payloadPgTagKey = []byte("pg_tag=")
+var payloadPgRowsKey = []byte("pg_rows=")
+var payloadPgErrorKey = []byte("pg_error=")
+
+// Payload header fields of Redis command and reply: connection ID and command name, like "GET". Replies also have
+// reply type, like "+" for simple string, and error code of error reply, like "ERR" or "MOVED".
+var payloadRedisConnKey = []byte("redis_conn=")
+var payloadRedisCommandKey = []byte("redis_cmd=")
+var payloadRedisReplyKey = []byte("redis_reply=")
+var payloadRedisErrorKey = []byte("redis_error=")
+
+// Payload header fields of memcached command and reply: command name, like "get", URL-encoded first key, and number of
+// keys. Replies also have status, like "STORED" or "KEY_NOT_FOUND", and number of returned values.
+var payloadMcCommandKey = []byte("mc_cmd=")
+var payloadMcKeyKey = []byte("mc_key=")
+var payloadMcKeysKey = []byte("mc_keys=")
+var payloadMcStatusKey = []byte("mc_status=")
+var payloadMcHitsKey = []byte("mc_hits=")
+
+// Payload header fields of MongoDB request and response: operation code name, like "msg", command name, like "find",
+// database and collection, and number of redacted documents. Responses also have "1" or "0" ok field, and error code
+// if command failed.
+var payloadMongoOpKey = []byte("mongo_op=")
+var payloadMongoCommandKey = []byte("mongo_cmd=")
+var payloadMongoDatabaseKey = []byte("mongo_db=")
+var payloadMongoCollectionKey = []byte("mongo_coll=")
+var payloadMongoRedactedKey = []byte("mongo_redacted=")
+var payloadMongoOKKey = []byte("mongo_ok=")
+var payloadMongoErrorKey = []byte("mongo_error=")
+
+// Payload header fields of Kafka request and response: API name, like "Produce", its version, client ID, and
+// comma-separated topics of Produce and Fetch requests. Produce requests also have acks.
+var payloadKafkaAPIKey = []byte("kafka_api=")
+var payloadKafkaVersionKey = []byte("kafka_version=")
+var payloadKafkaClientKey = []byte("kafka_client=")
+var payloadKafkaTopicsKey = []byte("kafka_topics=")
+var payloadKafkaAcksKey = []byte("kafka_acks=")
+
+// Payload header fields of Thrift call and reply: URL-encoded method name, and message type: "call", "oneway",
+// "reply", or "exception"
+var payloadThriftMethodKey = []byte("thrift_method=")
+var payloadThriftTypeKey = []byte("thrift_type=")
+
+// Payload header fields of GraphQL request and its response: operation name, omitted for anonymous operations, and
+// operation type: "query", "mutation", or "subscription". Batched requests have names of all operations,
+// comma-separated, and type "mutation" if any operation of the batch is mutation.
+var payloadGraphQLOperationKey = []byte("gql_op=")
+var payloadGraphQLTypeKey = []byte("gql_type=")
+
+// Names of Thrift message types
+var thriftMessageTypes = map[byte]string{
+	raw.ThriftCall:      "call",
+	raw.ThriftReply:     "reply",
+	raw.ThriftException: "exception",
+	raw.ThriftOneway:    "oneway",
+}
+
+// encodeTrailers converts trailer fields to URL-encoded form, like "Grpc-Status=0&Grpc-Message=ok",
+// so they fit into payload header field
+func encodeTrailers(trailers []byte) []byte {
+	values := url.Values{}
+
+	for _, line := range bytes.Split(trailers, proto.CLRF) {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+
+		values.Add(string(bytes.TrimSpace(line[:i])), string(bytes.TrimSpace(line[i+1:])))
+	}
+
+	return []byte(values.Encode())
+}
+
+// appendPayloadMeta appends optional field, concatenated from given parts, to the payload header.
+// Optional fields follow type, UUID and timing, so readers not aware of them are not affected.
+func appendPayloadMeta(header []byte, parts ...[]byte) []byte {
+	header = append(header[:len(header)-1], ' ')
+	for _, p := range parts {
+		header = append(header, p...)
+	}
+
+	return append(header, '\n')
+}
+
+// appendWebSocketMeta appends fields describing WebSocket frame to the payload header
+func appendWebSocketMeta(header []byte, frame *raw.WebSocketFrame, isIncoming bool) []byte {
+	from, fin := "server", "0"
+	if isIncoming {
+		from = "client"
+	}
+	if frame.Fin {
+		fin = "1"
+	}
+
+	header = appendPayloadMeta(header, payloadWSStreamKey, frame.StreamID)
+	header = appendPayloadMeta(header, payloadWSFromKey, []byte(from))
+	header = appendPayloadMeta(header, payloadWSOpcodeKey, strconv.AppendInt(nil, int64(frame.Opcode), 10))
+
+	return appendPayloadMeta(header, payloadWSFinKey, []byte(fin))
+}
+
+// appendGRPCMeta appends fields describing gRPC request or response to the payload header
+func appendGRPCMeta(header []byte, call *raw.GRPCCall) []byte {
+	header = appendPayloadMeta(header, payloadGRPCMethodKey, []byte(call.Method))
+	header = appendPayloadMeta(header, payloadGRPCMessagesKey, strconv.AppendInt(nil, int64(len(call.Messages)), 10))
+
+	if call.Status != "" {
+		header = appendPayloadMeta(header, payloadGRPCStatusKey, []byte(call.Status))
+	}
+
+	return header
+}
+
+// appendTCPChunkMeta appends fields describing raw TCP chunk to the payload header
+func appendTCPChunkMeta(header []byte, chunk *raw.TCPChunk, isIncoming bool) []byte {
+	from := "server"
+	if isIncoming {
+		from = "client"
+	}
+
+	header = appendPayloadMeta(header, payloadTCPConnKey, chunk.ConnID)
+	header = appendPayloadMeta(header, payloadTCPFromKey, []byte(from))
+	header = appendPayloadMeta(header, payloadTCPOffsetKey, strconv.AppendUint(nil, chunk.Offset, 10))
+
+	if chunk.Closed {
+		header = appendPayloadMeta(header, payloadTCPClosedMark)
+	}
+
+	return header
+}
+
+// appendMySQLMeta appends fields describing MySQL command or its result to the payload header
+func appendMySQLMeta(header []byte, command *raw.MySQLCommand, isIncoming bool) []byte {
+	header = appendPayloadMeta(header, payloadMySQLCommandKey, []byte(command.Name()))
+
+	if command.StatementID != 0 {
+		header = appendPayloadMeta(header, payloadMySQLStatementKey, strconv.AppendUint(nil, uint64(command.StatementID), 10))
+	}
+
+	if command.Database != "" {
+		header = appendPayloadMeta(header, payloadMySQLDatabaseKey, []byte(url.QueryEscape(command.Database)))
+	}
+
+	if isIncoming {
+		return header
+	}
+
+	if command.ErrorCode != 0 {
+		return appendPayloadMeta(header, payloadMySQLErrorKey, strconv.AppendUint(nil, uint64(command.ErrorCode), 10))
+	}
+
+	return appendPayloadMeta(header, payloadMySQLRowsKey, strconv.AppendUint(nil, command.Rows, 10))
+}
+
+// appendPostgresMeta appends fields describing PostgreSQL request or its response to the payload header
+func appendPostgresMeta(header []byte, query *raw.PostgresQuery, isIncoming bool) []byte {
+	header = appendPayloadMeta(header, payloadPgKindKey, []byte(query.Kind))
+
+	if query.User != "" {
+		header = appendPayloadMeta(header, payloadPgUserKey, []byte(url.QueryEscape(query.User)))
+	}
+
+	if query.Database != "" {
+		header = appendPayloadMeta(header, payloadPgDatabaseKey, []byte(url.QueryEscape(query.Database)))
+	}
+
+	if isIncoming {
+		return header
+	}
+
+	if query.Tag != "" {
+		header = appendPayloadMeta(header, payloadPgTagKey, []byte(url.QueryEscape(query.Tag)))
+	}
+
+	header = appendPayloadMeta(header, payloadPgRowsKey, strconv.AppendUint(nil, query.Rows, 10))
+
+	if query.ErrorCode != "" {
+		header = appendPayloadMeta(header, payloadPgErrorKey, []byte(query.ErrorCode))
+	}
+
+	return header
+}
+
+// appendRedisMeta appends fields describing Redis command or its reply to the payload header
+func appendRedisMeta(header []byte, command *raw.RedisCommand, isIncoming bool) []byte {
+	header = appendPayloadMeta(header, payloadRedisConnKey, command.ConnID)
+	header = appendPayloadMeta(header, payloadRedisCommandKey, []byte(url.QueryEscape(command.Name)))
+
+	if isIncoming {
+		return header
+	}
+
+	header = appendPayloadMeta(header, payloadRedisReplyKey, []byte{command.ReplyType})
+
+	// Error message starts with error code
+	if code := strings.Fields(command.Error); len(code) > 0 {
+		header = appendPayloadMeta(header, payloadRedisErrorKey, []byte(url.QueryEscape(code[0])))
+	}
+
+	return header
+}
+
+// appendMemcachedMeta appends fields describing memcached command or its reply to the payload header
+func appendMemcachedMeta(header []byte, command *raw.MemcachedCommand, isIncoming bool) []byte {
+	header = appendPayloadMeta(header, payloadMcCommandKey, []byte(url.QueryEscape(command.Command)))
+
+	if command.Keys > 0 {
+		header = appendPayloadMeta(header, payloadMcKeyKey, []byte(url.QueryEscape(string(command.Key))))
+		header = appendPayloadMeta(header, payloadMcKeysKey, strconv.AppendInt(nil, int64(command.Keys), 10))
+	}
+
+	if isIncoming {
+		return header
+	}
+
+	if command.Status != "" {
+		header = appendPayloadMeta(header, payloadMcStatusKey, []byte(url.QueryEscape(command.Status)))
+	}
+
+	header = appendPayloadMeta(header, payloadMcHitsKey, strconv.AppendInt(nil, int64(command.Hits), 10))
+
+	return header
+}
+
+// appendMongoMeta appends fields describing MongoDB request or its response to the payload header
+func appendMongoMeta(header []byte, command *raw.MongoCommand, isIncoming bool) []byte {
+	header = appendPayloadMeta(header, payloadMongoOpKey, []byte(command.Op))
+
+	if command.Command != "" {
+		header = appendPayloadMeta(header, payloadMongoCommandKey, []byte(url.QueryEscape(command.Command)))
+	}
+
+	if command.Database != "" {
+		header = appendPayloadMeta(header, payloadMongoDatabaseKey, []byte(url.QueryEscape(command.Database)))
+	}
+
+	if command.Collection != "" {
+		header = appendPayloadMeta(header, payloadMongoCollectionKey, []byte(url.QueryEscape(command.Collection)))
+	}
+
+	if command.Redacted > 0 {
+		header = appendPayloadMeta(header, payloadMongoRedactedKey, strconv.AppendInt(nil, int64(command.Redacted), 10))
+	}
+
+	if isIncoming {
+		return header
+	}
+
+	if command.OK {
+		header = appendPayloadMeta(header, payloadMongoOKKey, []byte("1"))
+	} else {
+		header = appendPayloadMeta(header, payloadMongoOKKey, []byte("0"))
+	}
+
+	if command.ErrorCode != 0 {
+		header = appendPayloadMeta(header, payloadMongoErrorKey, strconv.AppendInt(nil, int64(command.ErrorCode), 10))
+	}
+
+	return header
+}
+
+// appendKafkaMeta appends fields describing Kafka request or its response to the payload header
+func appendKafkaMeta(header []byte, request *raw.KafkaRequest) []byte {
+	header = appendPayloadMeta(header, payloadKafkaAPIKey, []byte(request.Name()))
+	header = appendPayloadMeta(header, payloadKafkaVersionKey, strconv.AppendInt(nil, int64(request.APIVersion), 10))
+
+	if request.ClientID != "" {
+		header = appendPayloadMeta(header, payloadKafkaClientKey, []byte(url.QueryEscape(request.ClientID)))
+	}
+
+	if len(request.Topics) > 0 {
+		topics := make([]string, len(request.Topics))
+		for i, topic := range request.Topics {
+			topics[i] = url.QueryEscape(topic)
+		}
+		header = appendPayloadMeta(header, payloadKafkaTopicsKey, []byte(strings.Join(topics, ",")))
+	}
+
+	if request.APIKey == raw.KafkaProduce {
+		header = appendPayloadMeta(header, payloadKafkaAcksKey, strconv.AppendInt(nil, int64(request.Acks), 10))
+	}
+
+	return header
+}
+
+// appendThriftMeta appends fields describing Thrift call or its reply to the payload header
+func appendThriftMeta(header []byte, message *raw.ThriftMessage) []byte {
+	header = appendPayloadMeta(header, payloadThriftMethodKey, []byte(url.QueryEscape(message.Method)))
+	header = appendPayloadMeta(header, payloadThriftTypeKey, []byte(thriftMessageTypes[message.Type]))
+
+	return header
+}
+
+// appendGraphQLMeta appends fields describing GraphQL operation to the payload header
+func appendGraphQLMeta(header []byte, op graphQLOperation) []byte {
+	if op.Name != "" {
+		header = appendPayloadMeta(header, payloadGraphQLOperationKey, []byte(op.Name))
+	}
+
+	return appendPayloadMeta(header, payloadGraphQLTypeKey, []byte(op.Type))
+}
+
+// markTruncated appends truncation mark to the payload header
+func markTruncated(header []byte) []byte {
+	return appendPayloadMeta(header, payloadTruncatedMark)
+}
+
+// isTruncatedPayload checks if payload body is not complete
+func isTruncatedPayload(payload []byte) bool {
+	return hasPayloadMark(payload, payloadTruncatedMark)
+}
+
+// hasPayloadMark checks if payload header has optional field without value, like truncation mark
+func hasPayloadMark(payload []byte, mark []byte) bool {
+	for _, field := range optionalPayloadMeta(payload) {
+		if bytes.Equal(field, mark) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// payloadMetaValue returns value of optional `key=value` payload header field, nil if it is missing
+func payloadMetaValue(payload []byte, key []byte) []byte {
+	for _, field := range optionalPayloadMeta(payload) {
+		if bytes.HasPrefix(field, key) {
+			return field[len(key):]
+		}
+	}
+
+	return nil
+}
+
+func optionalPayloadMeta(payload []byte) [][]byte {
+	if meta := payloadMeta(payload); len(meta) > 3 {
+		return meta[3:]
+	}
+
+	return nil
+}
+
 func payloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
@@ -75,7 +469,7 @@ func payloadMeta(payload []byte) [][]byte {
 
 func isOriginPayload(payload []byte) bool {
 	switch payload[0] {
-	case RequestPayload, ResponsePayload:
+	case RequestPayload, ResponsePayload, WebSocketPayload, TCPChunkPayload:
 		return true
 	default:
 		return false
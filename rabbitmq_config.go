@@ -0,0 +1,32 @@
+package main
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RabbitMQConfig struct for holding configuration of RabbitMQ input and output
+type RabbitMQConfig struct {
+	// Queue of gor payloads, declared durable if it doesn't exist
+	Queue string
+	// Exchange output publishes to, with queue name as routing key. Default exchange routes payloads to the queue.
+	Exchange string
+}
+
+// channel connects to RabbitMQ and opens channel, declaring the queue
+func (c *RabbitMQConfig) channel(url string) (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err == nil {
+		_, err = ch.QueueDeclare(c.Queue, true, false, false, false, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, ch, nil
+}
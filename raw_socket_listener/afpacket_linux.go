@@ -0,0 +1,284 @@
+package rawSocket
+
+import (
+	"fmt"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"log"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Default size of ring buffer of each AF_PACKET socket
+const defaultAFPacketBufferSize = 8 << 20
+
+// Approximate size of ring buffer block, gopacket uses 128 frames per block
+const afpacketBlockSize = 1 << 20
+
+// afpacketSocket is open AF_PACKET socket of the device
+type afpacketSocket struct {
+	*afpacket.TPacket
+	device pcap.Interface
+}
+
+// afpacketSockets holds AF_PACKET sockets opened by the Listener
+type afpacketSockets []*afpacketSocket
+
+func (s afpacketSockets) close() {
+	for _, h := range s {
+		h.Close()
+	}
+}
+
+// dropped returns number of packets dropped by kernel because ring buffers were full
+func (s afpacketSockets) dropped() (n uint64) {
+	for _, h := range s {
+		_, stats, err := h.SocketStats()
+		if err != nil {
+			log.Println("Can't get AF_PACKET stats:", err)
+			continue
+		}
+
+		n += uint64(stats.Drops())
+	}
+
+	return
+}
+
+var fanoutGroupSeq uint32
+
+// fanoutGroupID returns id for the new PACKET_FANOUT group.
+// Groups are shared by all processes in network namespace, so id is derived from pid, to not join groups of other Gor instances.
+func fanoutGroupID() uint16 {
+	return uint16(os.Getpid()) + uint16(atomic.AddUint32(&fanoutGroupSeq, 1))
+}
+
+// afpacketRing computes layout of socket ring buffer of about `bufferSize` bytes, with frames fitting `snapLen` bytes.
+// Block size should be multiple of both page and frame sizes.
+func afpacketRing(snapLen, bufferSize int) (frameSize, blockSize, numBlocks int) {
+	pageSize := os.Getpagesize()
+
+	frameSize = (snapLen + pageSize - 1) / pageSize * pageSize
+
+	blockSize = frameSize
+	if frameSize < afpacketBlockSize {
+		blockSize = afpacketBlockSize / frameSize * frameSize
+	}
+
+	numBlocks = bufferSize / blockSize
+	if numBlocks == 0 {
+		numBlocks = 1
+	}
+
+	return
+}
+
+// readAFPacket starts capture on all matching devices, using `FanoutSockets` AF_PACKET sockets per device.
+// Returns error if none of them can be opened.
+//
+// Sockets of device joined into PACKET_FANOUT group in hash mode, and each read by own goroutine. Kernel distributes packets
+// between sockets by flow hash, so capture scales across cores, and all packets of connection are read by the same goroutine,
+// in order they arrived.
+func (t *Listener) readAFPacket() error {
+	devices, err := findPcapDevices(t.addr)
+	if err != nil {
+		return err
+	}
+
+	sockets := t.config.FanoutSockets
+	if sockets <= 0 {
+		sockets = runtime.NumCPU()
+	}
+
+	var firstErr error
+	opened := 0
+
+	for _, device := range devices {
+		handles, err := t.openFanoutGroup(device, sockets)
+		if err != nil {
+			log.Println("AF_PACKET Error while opening device", device.Name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("AF_PACKET Error while opening device %s: %v", device.Name, err)
+			}
+			continue
+		}
+
+		for _, h := range handles {
+			go t.readAFPacketSocket(h)
+		}
+
+		opened++
+	}
+
+	if opened == 0 {
+		return firstErr
+	}
+
+	t.readyCh <- true
+
+	return nil
+}
+
+// openFanoutGroup opens `n` AF_PACKET sockets on the device, with BPF filter attached, and joins them into new fanout group
+func (t *Listener) openFanoutGroup(device pcap.Interface, n int) (handles afpacketSockets, err error) {
+	t.mu.Lock()
+	filter, err := t.afpacketBPF(device)
+	t.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("BPF filter error: %v", err)
+	}
+
+	bufferSize := t.config.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultAFPacketBufferSize
+	}
+	frameSize, blockSize, numBlocks := afpacketRing(t.config.SnapLen, bufferSize)
+
+	id := fanoutGroupID()
+
+	for i := 0; i < n; i++ {
+		var tpacket *afpacket.TPacket
+
+		tpacket, err = afpacket.NewTPacket(
+			afpacket.OptInterface(device.Name),
+			afpacket.OptFrameSize(frameSize),
+			afpacket.OptBlockSize(blockSize),
+			afpacket.OptNumBlocks(numBlocks),
+			afpacket.OptPollTimeout(t.messageExpire),
+		)
+		if err != nil {
+			break
+		}
+
+		h := &afpacketSocket{tpacket, device}
+		handles = append(handles, h)
+
+		if err = h.SetBPF(filter); err != nil {
+			break
+		}
+
+		if err = h.SetFanout(afpacket.FanoutHash, id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		handles.close()
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.afpackets = append(t.afpackets, handles...)
+	t.mu.Unlock()
+
+	return
+}
+
+// afpacketBPF compiles same filter as used by pcap engine. Should be called with t.mu locked.
+func (t *Listener) afpacketBPF(device pcap.Interface) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, t.config.SnapLen, t.deviceBPF(device))
+	if err != nil {
+		return nil, err
+	}
+
+	filter := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		filter[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+
+	return filter, nil
+}
+
+// afpacketFilterSetters compiles current filter for each socket, and returns functions applying it
+func (t *Listener) afpacketFilterSetters() (setters []func() error, err error) {
+	for _, h := range t.afpackets {
+		h := h
+
+		filter, err := t.afpacketBPF(h.device)
+		if err != nil {
+			return nil, fmt.Errorf("BPF filter error: %v Device: %s", err, h.device.Name)
+		}
+
+		setters = append(setters, func() error {
+			return h.SetBPF(filter)
+		})
+	}
+
+	return
+}
+
+// closeAFPacketSocket removes socket from the Listener and closes it.
+// Socket closed by the goroutine reading it, since it can't be closed during read.
+func (t *Listener) closeAFPacketSocket(handle *afpacketSocket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, h := range t.afpackets {
+		if h == handle {
+			t.afpackets = append(t.afpackets[:i], t.afpackets[i+1:]...)
+			break
+		}
+	}
+
+	handle.Close()
+}
+
+func (t *Listener) readAFPacketSocket(handle *afpacketSocket) {
+	defer t.closeAFPacketSocket(handle)
+
+	device := handle.device
+	truncatedWarned := false
+
+	// AF_PACKET sockets receive Ethernet frames, loopback included
+	decoder, _ := newPacketDecoder(layers.LinkTypeEthernet)
+
+	// Delay before next read after socket error, so persistent error doesn't spin CPU
+	var errDelay time.Duration
+
+	for {
+		// Data valid only until next read, processIPPacket copies it.
+		// Read returns at least once per poll timeout, so goroutine notices when listener is closed.
+		data, ci, err := handle.ZeroCopyReadPacketData()
+
+		if t.ctx.Err() != nil {
+			return
+		} else if err == afpacket.ErrTimeout || err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		} else if err != nil {
+			if errDelay == 0 {
+				log.Println("AF_PACKET Error while reading device", device.Name, err)
+				errDelay = pcapReopenMinDelay
+			} else {
+				errDelay = nextReopenDelay(errDelay)
+			}
+
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-time.After(errDelay):
+			}
+			continue
+		}
+		errDelay = 0
+
+		if ci.CaptureLength < ci.Length && !truncatedWarned {
+			log.Println("Captured packet truncated by snaplen", ci.CaptureLength, "of", ci.Length, "bytes on", device.Name+".",
+				"Increase --input-raw-snaplen or disable receive offloads: `ethtool -K", device.Name, "gro off lro off`")
+			truncatedWarned = true
+		}
+
+		data = decoder.decode(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		if !t.processIPPacket(data, ci.Timestamp, device, true) {
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package rawSocket
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAFPacketRing(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	for _, c := range []struct {
+		snapLen, bufferSize int
+	}{
+		{65536, 8 << 20},
+		{1500, 8 << 20},
+		{3 * pageSize, 1 << 20},
+		{65536, 0},
+		{1 << 21, 8 << 20},
+	} {
+		frameSize, blockSize, numBlocks := afpacketRing(c.snapLen, c.bufferSize)
+
+		if frameSize < c.snapLen || frameSize%pageSize != 0 {
+			t.Error("Frame should fit snaplen and be aligned to page", c, frameSize)
+		}
+
+		if blockSize%frameSize != 0 || blockSize%pageSize != 0 {
+			t.Error("Block should be multiple of frame and page sizes", c, blockSize)
+		}
+
+		if numBlocks < 1 || (numBlocks > 1 && numBlocks*blockSize > c.bufferSize) {
+			t.Error("Ring should not exceed buffer size", c, numBlocks)
+		}
+	}
+}
+
+func TestFanoutGroupID(t *testing.T) {
+	ids := make(map[uint16]bool)
+
+	for i := 0; i < 100; i++ {
+		id := fanoutGroupID()
+		if ids[id] {
+			t.Error("Fanout group ids should be unique", id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestAFPacketUnknownDevice(t *testing.T) {
+	_, err := NewListener("gor-missing0", "80", EngineAFPacket, false, 0, &ListenerConfig{})
+
+	if err == nil {
+		t.Error("Should return error if device not found")
+	}
+}
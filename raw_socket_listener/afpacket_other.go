@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package rawSocket
+
+import (
+	"fmt"
+)
+
+// afpacketSockets is always empty, AF_PACKET available only on Linux
+type afpacketSockets []struct{}
+
+func (s afpacketSockets) dropped() uint64 {
+	return 0
+}
+
+func (t *Listener) afpacketFilterSetters() ([]func() error, error) {
+	return nil, nil
+}
+
+func (t *Listener) readAFPacket() error {
+	return fmt.Errorf("AF_PACKET engine is supported only on Linux")
+}
@@ -0,0 +1,79 @@
+package rawSocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Default time incomplete batch waits for more messages
+const defaultBatchInterval = 10 * time.Millisecond
+
+// emit passes dispatched message to the receiver, directly or as part of the batch, see ListenerConfig.BatchSize
+func (t *shard) emit(message *TCPMessage) {
+	if message.expectContinue && !t.config.KeepExpectHeader {
+		message.stripExpectContinue()
+	}
+
+	message.detach()
+
+	if t.batchesChan == nil {
+		t.sendMessage(message)
+		return
+	}
+
+	t.batch = append(t.batch, message)
+	if len(t.batch) >= t.config.BatchSize {
+		t.flushBatch()
+	}
+}
+
+// flushBatch sends collected messages, even if batch is not full
+func (t *shard) flushBatch() {
+	if len(t.batch) == 0 {
+		return
+	}
+
+	t.sendBatch(t.batch)
+	// Batch is owned by the receiver now
+	t.batch = make([]*TCPMessage, 0, t.config.BatchSize)
+}
+
+// sendBatch puts batch to batchesChan according to the backpressure policy
+func (t *Listener) sendBatch(batch []*TCPMessage) {
+	switch t.config.Backpressure {
+	case BackpressureDropNewest:
+		select {
+		case t.batchesChan <- batch:
+		default:
+			atomic.AddUint64(&t.stats.messagesBufferDropped, uint64(len(batch)))
+			return
+		}
+	case BackpressureDropOldest:
+		for sent := false; !sent; {
+			select {
+			case t.batchesChan <- batch:
+				sent = true
+			default:
+				select {
+				case oldest := <-t.batchesChan:
+					atomic.AddUint64(&t.stats.messagesBufferDropped, uint64(len(oldest)))
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case t.batchesChan <- batch:
+		default:
+			// Receiver may stop reading once listener is closed, so do not wait for it then
+			select {
+			case t.batchesChan <- batch:
+			case <-t.ctx.Done():
+				atomic.AddUint64(&t.stats.messagesBufferDropped, uint64(len(batch)))
+				return
+			}
+		}
+	}
+
+	atomic.AddUint64(&t.stats.messagesDispatched, uint64(len(batch)))
+}
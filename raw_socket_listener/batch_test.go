@@ -0,0 +1,51 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRawListenerBatches(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Second, &ListenerConfig{BatchSize: 3, BatchInterval: 20 * time.Millisecond})
+	defer listener.Close()
+
+	batches := listener.ReceiverBatches()
+	if batches == nil {
+		t.Fatal("Should dispatch messages in batches")
+	}
+
+	for port := uint16(1); port <= 4; port++ {
+		listener.packetsChan <- newPacketBuffer(buildConnPacket(true, port, 0, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")).Dump())
+	}
+
+	select {
+	case batch := <-batches:
+		if len(batch) != 3 {
+			t.Error("Should send full batch", len(batch))
+		}
+	case <-time.After(10 * time.Millisecond):
+		t.Fatal("Full batch should be sent immediately")
+	}
+
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 {
+			t.Error("Should send incomplete batch", len(batch))
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Incomplete batch should be sent after interval")
+	}
+
+	if s := listener.Stats(); s.MessagesDispatched != 4 {
+		t.Error("Should count dispatched messages", s.MessagesDispatched)
+	}
+}
+
+func TestRawListenerWithoutBatches(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Second, &ListenerConfig{})
+	defer listener.Close()
+
+	if listener.ReceiverBatches() != nil {
+		t.Error("Messages should be sent one by one")
+	}
+}
@@ -0,0 +1,501 @@
+package rawSocket
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Minimal eBPF support used by uprobe engine: programs are assembled in Go, so neither compiler nor
+// loader library is needed. See linux/bpf.h and linux/perf_event.h for used structures.
+
+// bpf(2) is missing from syscall package
+const sysBPF = 321
+
+// bpf(2) commands
+const (
+	bpfMapCreate = 0
+	bpfMapUpdate = 2
+	bpfProgLoad  = 5
+)
+
+// Map and program types
+const (
+	bpfMapTypeHash           = 1
+	bpfMapTypePerfEventArray = 4
+	bpfMapTypePerCPUArray    = 6
+	bpfProgTypeKprobe        = 2
+	bpfPseudoMapFD           = 1
+	bpfLogSize               = 64 * 1024
+
+	perfTypeSoftware         = 1
+	perfCountSWBPFOutput     = 10
+	perfSampleRaw            = 1 << 10
+	perfFlagFDCloexec        = 1 << 3
+	perfEventIOCEnable       = 0x2400
+	perfEventIOCSetBPF       = 0x40042408
+	perfRecordLost           = 2
+	perfRecordSample         = 9
+	perfEventAttrSize        = 112
+	perfEventMmapDataHeadOff = 1024
+	perfEventMmapDataTailOff = 1032
+)
+
+// Helper functions
+const (
+	bpfFuncMapLookupElem    = 1
+	bpfFuncMapUpdateElem    = 2
+	bpfFuncMapDeleteElem    = 3
+	bpfFuncProbeRead        = 4
+	bpfFuncKtimeGetNS       = 5
+	bpfFuncGetCurrentPIDTID = 14
+	bpfFuncPerfEventOutput  = 25
+	bpfFuncProbeReadUser    = 112
+)
+
+// Instruction classes and operations
+const (
+	bpfLD    = 0x00
+	bpfLDX   = 0x01
+	bpfST    = 0x02
+	bpfSTX   = 0x03
+	bpfALU   = 0x04
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW   = 0x00
+	bpfDW  = 0x18
+	bpfMEM = 0x60
+	bpfIMM = 0x00
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfAdd  = 0x00
+	bpfSub  = 0x10
+	bpfLsh  = 0x60
+	bpfRsh  = 0x70
+	bpfMov  = 0xb0
+	bpfArsh = 0xc0
+
+	bpfJEq  = 0x10
+	bpfJNE  = 0x50
+	bpfCall = 0x80
+	bpfExit = 0x90
+	bpfJLE  = 0xb0
+	bpfJSLE = 0xd0
+)
+
+// Registers: R0 is return value, R1-R5 are helper arguments, R6-R9 are preserved by helpers, R10 is frame pointer
+const (
+	bpfR0 = iota
+	bpfR1
+	bpfR2
+	bpfR3
+	bpfR4
+	bpfR5
+	bpfR6
+	bpfR7
+	bpfR8
+	bpfR9
+	bpfFP
+)
+
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// bpfAsm assembles program, jumps refer to labels, which can be defined after the jump
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func newBPFAsm() *bpfAsm {
+	return &bpfAsm{labels: make(map[string]int), jumps: make(map[int]string)}
+}
+
+func (a *bpfAsm) emit(code uint8, dst, src int, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{code: code, regs: uint8(dst) | uint8(src)<<4, off: off, imm: imm})
+}
+
+// movImm sets dst = imm
+func (a *bpfAsm) movImm(dst int, imm int32) { a.emit(bpfALU64|bpfMov|bpfK, dst, 0, 0, imm) }
+
+// movImm32 sets dst = uint32(imm), without sign extension
+func (a *bpfAsm) movImm32(dst int, imm int32) { a.emit(bpfALU|bpfMov|bpfK, dst, 0, 0, imm) }
+
+// mov sets dst = src
+func (a *bpfAsm) mov(dst, src int) { a.emit(bpfALU64|bpfMov|bpfX, dst, src, 0, 0) }
+
+// aluImm applies `op` to dst and imm, like bpfAdd
+func (a *bpfAsm) aluImm(op uint8, dst int, imm int32) { a.emit(bpfALU64|op|bpfK, dst, 0, 0, imm) }
+
+// load sets dst = *(size *)(src + off), size is bpfW or bpfDW
+func (a *bpfAsm) load(size uint8, dst, src int, off int16) {
+	a.emit(bpfLDX|bpfMEM|size, dst, src, off, 0)
+}
+
+// store sets *(size *)(dst + off) = src
+func (a *bpfAsm) store(size uint8, dst int, off int16, src int) {
+	a.emit(bpfSTX|bpfMEM|size, dst, src, off, 0)
+}
+
+// storeImm sets *(size *)(dst + off) = imm
+func (a *bpfAsm) storeImm(size uint8, dst int, off int16, imm int32) {
+	a.emit(bpfST|bpfMEM|size, dst, 0, off, imm)
+}
+
+// loadMap sets dst to map file descriptor, replaced by map address when program is loaded
+func (a *bpfAsm) loadMap(dst int, fd int) {
+	a.emit(bpfLD|bpfIMM|bpfDW, dst, bpfPseudoMapFD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+func (a *bpfAsm) call(helper int32) { a.emit(bpfJMP|bpfCall, 0, 0, 0, helper) }
+
+// jumpImm jumps to label if `dst op imm`
+func (a *bpfAsm) jumpImm(op uint8, dst int, imm int32, label string) {
+	a.jumps[len(a.insns)] = label
+	a.emit(bpfJMP|op|bpfK, dst, 0, 0, imm)
+}
+
+func (a *bpfAsm) label(name string) { a.labels[name] = len(a.insns) }
+
+func (a *bpfAsm) exit() { a.emit(bpfJMP|bpfExit, 0, 0, 0, 0) }
+
+// assemble resolves jumps, and returns program code
+func (a *bpfAsm) assemble() ([]bpfInsn, error) {
+	for i, name := range a.jumps {
+		target, ok := a.labels[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown BPF label: %s", name)
+		}
+		a.insns[i].off = int16(target - i - 1)
+	}
+
+	return a.insns, nil
+}
+
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+// bpfCreateMap creates map and returns its file descriptor
+func bpfCreateMap(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, flags uint32
+	}{mapType, keySize, valueSize, maxEntries, 0}
+
+	fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("Can't create BPF map: %v", err)
+	}
+
+	return fd, nil
+}
+
+// bpfUpdateMap sets value of the map element
+func bpfUpdateMap(fd int, key, value unsafe.Pointer) error {
+	attr := struct {
+		fd    uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{fd: uint32(fd), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+
+	_, err := bpfSyscall(bpfMapUpdate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// bpfLoadProgram loads kprobe program, which is used for uprobes too. Verifier log is returned in error.
+func bpfLoadProgram(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	log := make([]byte, bpfLogSize)
+
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType:    bpfProgTypeKprobe,
+		insnCnt:     uint32(len(insns)),
+		insns:       uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:     uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:    1,
+		logSize:     bpfLogSize,
+		logBuf:      uint64(uintptr(unsafe.Pointer(&log[0]))),
+		kernVersion: kernelVersion(),
+	}
+
+	fd, err := bpfSyscall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		if n := strings.IndexByte(string(log), 0); n > 0 {
+			return -1, fmt.Errorf("Can't load BPF program: %v\n%s", err, log[:n])
+		}
+		return -1, fmt.Errorf("Can't load BPF program: %v", err)
+	}
+
+	return fd, nil
+}
+
+// kernelVersion returns LINUX_VERSION_CODE of running kernel, required for kprobe programs by kernels before 5.0
+func kernelVersion() uint32 {
+	var uts syscall.Utsname
+	if syscall.Uname(&uts) != nil {
+		return 0
+	}
+
+	release := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+
+	var version [3]uint32
+	for i, part := range strings.SplitN(string(release), ".", 3) {
+		n := 0
+		for n < len(part) && part[n] >= '0' && part[n] <= '9' {
+			n++
+		}
+
+		v, _ := strconv.Atoi(part[:n])
+		if v > 255 {
+			v = 255
+		}
+		version[i] = uint32(v)
+	}
+
+	return version[0]<<16 | version[1]<<8 | version[2]
+}
+
+// perfEventAttr is perf_event_attr structure, up to PERF_ATTR_SIZE_VER5
+type perfEventAttr struct {
+	eventType    uint32
+	size         uint32
+	config       uint64
+	samplePeriod uint64
+	sampleType   uint64
+	readFormat   uint64
+	flags        uint64
+	wakeupEvents uint32
+	bpType       uint32
+	config1      uint64
+	config2      uint64
+	_            [4]uint64
+}
+
+func perfEventOpen(attr *perfEventAttr, pid, cpu int) (int, error) {
+	attr.size = perfEventAttrSize
+
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(attr)), uintptr(pid), uintptr(cpu), ^uintptr(0), perfFlagFDCloexec, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+func ioctl(fd int, req uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, arg); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// attachUprobe creates uprobe at offset of the binary, and runs program when it is hit by any process
+func attachUprobe(path string, offset uint64, isReturn bool, prog int) (int, error) {
+	data, err := ioutil.ReadFile("/sys/bus/event_source/devices/uprobe/type")
+	if err != nil {
+		return -1, fmt.Errorf("Uprobes are not supported by kernel: %v", err)
+	}
+
+	pmu, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1, err
+	}
+
+	pathBytes := append([]byte(path), 0)
+	attr := &perfEventAttr{
+		eventType: uint32(pmu),
+		config1:   uint64(uintptr(unsafe.Pointer(&pathBytes[0]))),
+		config2:   offset,
+	}
+	// Return probe is selected by the first bit of config, see /sys/bus/event_source/devices/uprobe/format/retprobe
+	if isReturn {
+		attr.config = 1
+	}
+
+	// Program runs on all CPUs, though event is opened for one
+	fd, err := perfEventOpen(attr, -1, 0)
+	if err != nil {
+		return -1, fmt.Errorf("Can't create uprobe at %s+%#x: %v", path, offset, err)
+	}
+
+	if err = ioctl(fd, perfEventIOCSetBPF, uintptr(prog)); err == nil {
+		err = ioctl(fd, perfEventIOCEnable, 0)
+	}
+
+	if err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("Can't attach BPF program to uprobe at %s+%#x: %v", path, offset, err)
+	}
+
+	return fd, nil
+}
+
+// perfRing is memory mapped ring buffer of perf event, which receives data sent by bpf_perf_event_output
+type perfRing struct {
+	fd   int
+	mmap []byte
+	data []byte
+}
+
+// openPerfRing opens ring buffer of `pages` pages (power of two) for the cpu
+func openPerfRing(cpu, pages int) (*perfRing, error) {
+	attr := &perfEventAttr{
+		eventType:    perfTypeSoftware,
+		config:       perfCountSWBPFOutput,
+		samplePeriod: 1,
+		sampleType:   perfSampleRaw,
+		wakeupEvents: 1,
+	}
+
+	fd, err := perfEventOpen(attr, -1, cpu)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := syscall.Getpagesize()
+	mmap, err := syscall.Mmap(fd, 0, (pages+1)*pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	if err = ioctl(fd, perfEventIOCEnable, 0); err != nil {
+		syscall.Munmap(mmap)
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &perfRing{fd: fd, mmap: mmap, data: mmap[pageSize:]}, nil
+}
+
+func (r *perfRing) close() {
+	syscall.Munmap(r.mmap)
+	syscall.Close(r.fd)
+}
+
+// read calls fn for each raw sample written since the last read, and returns number of lost samples.
+// Sample data is valid only during fn call.
+func (r *perfRing) read(fn func(sample []byte)) (lost uint64) {
+	head := atomic.LoadUint64((*uint64)(unsafe.Pointer(&r.mmap[perfEventMmapDataHeadOff])))
+	tailPtr := (*uint64)(unsafe.Pointer(&r.mmap[perfEventMmapDataTailOff]))
+	tail := atomic.LoadUint64(tailPtr)
+
+	size := uint64(len(r.data))
+	var record []byte
+
+	for tail < head {
+		// Record header: type, misc, size
+		header := r.copy(record[:0], tail, 8)
+		recordType := *(*uint32)(unsafe.Pointer(&header[0]))
+		recordSize := uint64(*(*uint16)(unsafe.Pointer(&header[6])))
+
+		if recordSize < 8 || recordSize > size {
+			break
+		}
+
+		record = r.copy(header[:0], tail, recordSize)
+
+		switch recordType {
+		case perfRecordSample:
+			// Raw data size follows header
+			if len(record) >= 12 {
+				n := *(*uint32)(unsafe.Pointer(&record[8]))
+				if int(n) <= len(record)-12 {
+					fn(record[12 : 12+n])
+				}
+			}
+		case perfRecordLost:
+			if len(record) >= 24 {
+				lost += *(*uint64)(unsafe.Pointer(&record[16]))
+			}
+		}
+
+		tail += recordSize
+	}
+
+	atomic.StoreUint64(tailPtr, tail)
+
+	return
+}
+
+// copy reads n bytes at position of ring buffer, which can wrap around its end
+func (r *perfRing) copy(buf []byte, pos, n uint64) []byte {
+	size := uint64(len(r.data))
+	start := pos % size
+
+	if start+n <= size {
+		return append(buf, r.data[start:start+n]...)
+	}
+
+	buf = append(buf, r.data[start:]...)
+	return append(buf, r.data[:n-(size-start)]...)
+}
+
+// possibleCPUs returns ids of CPUs, which can run BPF programs
+func possibleCPUs() ([]int, error) {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return nil, err
+	}
+
+	var cpus []int
+	// Like "0-3,5"
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		bounds := strings.SplitN(r, "-", 2)
+
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		for cpu := from; cpu <= to; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
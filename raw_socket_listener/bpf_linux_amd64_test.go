@@ -0,0 +1,40 @@
+package rawSocket
+
+import (
+	"testing"
+)
+
+func TestBPFAsmJumps(t *testing.T) {
+	a := newBPFAsm()
+	a.jumpImm(bpfJEq, bpfR1, 0, "exit")
+	a.loadMap(bpfR1, 3)
+	a.label("exit")
+	a.exit()
+
+	insns, err := a.assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Map address takes two instructions
+	if len(insns) != 4 || insns[0].off != 2 || insns[1].imm != 3 || insns[1].regs>>4 != bpfPseudoMapFD {
+		t.Errorf("Should resolve jump to label defined later: %+v", insns)
+	}
+
+	a.jumpImm(bpfJEq, bpfR1, 0, "unknown")
+	if _, err := a.assemble(); err == nil {
+		t.Error("Should fail on unknown label")
+	}
+}
+
+func TestPerfRingCopy(t *testing.T) {
+	r := &perfRing{data: []byte("0123456789")}
+
+	if b := r.copy(nil, 12, 3); string(b) != "234" {
+		t.Error("Should read data at position modulo size", string(b))
+	}
+
+	if b := r.copy(nil, 8, 4); string(b) != "8901" {
+		t.Error("Should read data wrapped around end of the buffer", string(b))
+	}
+}
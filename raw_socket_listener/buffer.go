@@ -0,0 +1,81 @@
+package rawSocket
+
+import (
+	"sync"
+)
+
+// Size of segment fitting pooled buffer for regular packets. Larger ones, like coalesced by GRO, use buffers of snaplen size.
+const smallPacketSize = 2048
+
+// packetBuffer holds captured packet: header followed by segment.
+// Packets parsed from the buffer reference its data, so buffer is reference counted, and returned to the pool once
+// last packet is released. Buffer is owned by single goroutine at a time, so counter is not atomic.
+type packetBuffer struct {
+	data []byte
+	refs int
+
+	// Pool buffer is returned to, nil if it is not pooled
+	pool *sync.Pool
+}
+
+// newPacketBuffer wraps not pooled packet data
+func newPacketBuffer(data []byte) *packetBuffer {
+	return &packetBuffer{data: data, refs: 1}
+}
+
+func (b *packetBuffer) pooled() bool {
+	return b != nil && b.pool != nil
+}
+
+func (b *packetBuffer) retain() {
+	if b != nil {
+		b.refs++
+	}
+}
+
+func (b *packetBuffer) release() {
+	if b == nil {
+		return
+	}
+
+	if b.refs--; b.refs == 0 && b.pool != nil {
+		b.pool.Put(b)
+	}
+}
+
+// packetBuffers are pools of buffers for small and snaplen sized packets
+type packetBuffers struct {
+	small, large sync.Pool
+}
+
+func newPacketBuffers(snapLen int) *packetBuffers {
+	p := &packetBuffers{}
+
+	p.small.New = func() interface{} {
+		return &packetBuffer{data: make([]byte, packetHeaderSize+smallPacketSize), pool: &p.small}
+	}
+	p.large.New = func() interface{} {
+		return &packetBuffer{data: make([]byte, packetHeaderSize+snapLen), pool: &p.large}
+	}
+
+	return p
+}
+
+// get returns buffer for packet of `size` bytes, including header
+func (p *packetBuffers) get(size int) *packetBuffer {
+	pool := &p.small
+	if size > packetHeaderSize+smallPacketSize {
+		pool = &p.large
+	}
+
+	b := pool.Get().(*packetBuffer)
+	if cap(b.data) < size {
+		// Segments coalesced by GRO can exceed snaplen
+		b = &packetBuffer{data: make([]byte, size)}
+	}
+
+	b.data = b.data[:size]
+	b.refs = 1
+
+	return b
+}
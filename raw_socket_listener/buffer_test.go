@@ -0,0 +1,69 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketBuffers(t *testing.T) {
+	buffers := newPacketBuffers(defaultSnapLen)
+
+	small := buffers.get(packetHeaderSize + 100)
+	if len(small.data) != packetHeaderSize+100 || small.pool != &buffers.small || small.refs != 1 {
+		t.Error("Should take buffer from small packets pool", len(small.data))
+	}
+
+	if large := buffers.get(packetHeaderSize + 10000); large.pool != &buffers.large {
+		t.Error("Should take buffer from large packets pool")
+	}
+
+	if huge := buffers.get(packetHeaderSize + defaultSnapLen + 1); huge.pooled() {
+		t.Error("Packets larger than snaplen should not be pooled")
+	}
+
+	small.retain()
+	small.release()
+	if small.refs != 1 {
+		t.Error("Should count references", small.refs)
+	}
+}
+
+func TestTCPMessageDetach(t *testing.T) {
+	buffers := newPacketBuffers(defaultSnapLen)
+
+	data := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")).Dump()
+	buf := buffers.get(len(data))
+	copy(buf.data, data)
+
+	packet := ParseTCPPacket(buf.data[:16], buf.data[16:packetAddrSize], buf.data[packetHeaderSize:])
+	packet.buf = buf
+
+	msg := NewTCPMessage(packet.Seq, packet.Ack, true)
+	msg.AddPacket(packet)
+
+	if buf.refs != 2 {
+		t.Fatal("Message should retain buffer", buf.refs)
+	}
+
+	// Released by packet processing
+	buf.release()
+
+	msg.detach()
+
+	if buf.refs != 0 || packet.buf != nil {
+		t.Error("Should release buffer", buf.refs)
+	}
+
+	// Buffer reused by the next packet
+	for i := range buf.data {
+		buf.data[i] = 'x'
+	}
+
+	if !bytes.Equal(msg.Bytes(), []byte("GET / HTTP/1.1\r\n\r\n")) {
+		t.Errorf("Message data should be copied: %q", msg.Bytes())
+	}
+
+	if !bytes.HasPrefix(msg.packets[0].Addr, []byte("123")) {
+		t.Errorf("Addresses should be copied: %q", msg.packets[0].Addr)
+	}
+}
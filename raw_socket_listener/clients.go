@@ -0,0 +1,82 @@
+package rawSocket
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseClientNets parses list of client addresses, each either CIDR like "10.0.0.0/8" or single IP
+func parseClientNets(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid client address: %s", s)
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client address: %s", s)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAllowedClient checks client address against ListenerConfig.AllowClients and ListenerConfig.DenyClients
+func (t *Listener) isAllowedClient(ip net.IP) bool {
+	if containsIP(t.denyClients, ip) {
+		return false
+	}
+
+	return len(t.allowClients) == 0 || containsIP(t.allowClients, ip)
+}
+
+// bpfClients returns BPF expression restricting client addresses, or empty string if lists are not set.
+// `dir` is direction of client address: "src" for requests, and "dst" for responses.
+func (t *Listener) bpfClients(dir string) string {
+	var filters []string
+
+	if len(t.allowClients) > 0 {
+		filters = append(filters, "("+bpfNets(dir, t.allowClients)+")")
+	}
+
+	if len(t.denyClients) > 0 {
+		filters = append(filters, "not ("+bpfNets(dir, t.denyClients)+")")
+	}
+
+	return strings.Join(filters, " and ")
+}
+
+func bpfNets(dir string, nets []*net.IPNet) string {
+	filters := make([]string, len(nets))
+
+	for i, n := range nets {
+		filters[i] = dir + " net " + n.String()
+	}
+
+	return strings.Join(filters, " or ")
+}
@@ -0,0 +1,106 @@
+package rawSocket
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestParseClientNets(t *testing.T) {
+	nets, err := parseClientNets([]string{"10.0.0.0/8", "192.168.1.5", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.0.0.0/8", "192.168.1.5/32", "2001:db8::/32", "::1/128"}
+	for i, n := range nets {
+		if n.String() != expected[i] {
+			t.Error("Wrong network", i, n, expected[i])
+		}
+	}
+
+	if _, err := parseClientNets([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Should reject invalid CIDR")
+	}
+
+	if _, err := parseClientNets([]string{"lb.local"}); err == nil {
+		t.Error("Should reject invalid IP")
+	}
+}
+
+func TestRawListenerClients(t *testing.T) {
+	_, err := NewListener("", "80", engineTest, true, 0, &ListenerConfig{DenyClients: []string{"office"}})
+	if err == nil {
+		t.Error("Should reject invalid client address")
+	}
+
+	l, err := NewListener("", "80", engineTest, true, 0, &ListenerConfig{
+		AllowClients: []string{"10.0.0.0/8", "2001:db8::/32"},
+		DenyClients:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"2001:db8::1": true,
+		"10.1.0.1":    false,
+		"192.168.0.1": false,
+	} {
+		if l.isAllowedClient(net.ParseIP(ip)) != allowed {
+			t.Error("Wrong client check", ip, allowed)
+		}
+	}
+
+	device := pcap.Interface{Name: "eth0"}
+	expected := "((tcp dst port 80) and (src net 10.0.0.0/8 or src net 2001:db8::/32) and not (src net 10.1.0.0/16)) or " +
+		"((tcp src port 80) and (dst net 10.0.0.0/8 or dst net 2001:db8::/32) and not (dst net 10.1.0.0/16))"
+	if bpf := l.deviceBPF(device); bpf != expected {
+		t.Error("Should add clients to BPF filter", bpf)
+	}
+}
+
+func TestRawListenerClientsWithoutBPF(t *testing.T) {
+	l := &Listener{ctx: context.Background(), config: &ListenerConfig{}, ports: testPorts("80"), packetsChan: make(chan *packetBuffer, 10), buffers: newPacketBuffers(defaultSnapLen)}
+	l.denyClients, _ = parseClientNets([]string{"10.1.0.0/16"})
+
+	segment := make([]byte, 20+5)
+	binary.BigEndian.PutUint16(segment[0:2], 40000)
+	binary.BigEndian.PutUint16(segment[2:4], 80)
+	segment[12] = 5 << 4
+	copy(segment[20:], "GET /")
+
+	ipPacket := func(src string) []byte {
+		packet := make([]byte, 20, 20+len(segment))
+		packet[0] = 0x45
+		packet[9] = ipProtoTCP
+		copy(packet[12:16], net.ParseIP(src).To4())
+		copy(packet[16:20], net.ParseIP("10.0.0.100").To4())
+		return append(packet, segment...)
+	}
+
+	l.processIPPacket(ipPacket("10.1.2.3"), time.Time{}, pcap.Interface{}, false)
+	l.processIPPacket(ipPacket("10.2.2.3"), time.Time{}, pcap.Interface{}, false)
+
+	if len(l.packetsChan) != 1 {
+		t.Fatal("Should capture only allowed client", len(l.packetsChan))
+	}
+
+	if src := net.IP((<-l.packetsChan).data[:4]); !src.Equal(net.ParseIP("10.2.2.3")) {
+		t.Error("Wrong client captured", src)
+	}
+
+	if l.isValidPacket(segment, net.ParseIP("10.1.2.3")) {
+		t.Error("Raw socket should skip denied client")
+	}
+
+	if !l.isValidPacket(segment, net.ParseIP("10.2.2.3")) {
+		t.Error("Raw socket should capture allowed client")
+	}
+}
@@ -0,0 +1,151 @@
+package rawSocket
+
+import (
+	"bytes"
+	"github.com/buger/gor/proto"
+	"strconv"
+)
+
+// With GRO/LRO (receive offloads) enabled, or when client pipelines requests, single captured segment
+// may contain multiple HTTP messages. Such segments are split, so each message starts in its own packet.
+// Alternatively offloads can be disabled on the interface: `ethtool -K eth0 gro off lro off`.
+
+var bHTTP = []byte("HTTP/")
+
+// isHTTPStart checks if data starts with request or response line
+func isHTTPStart(data []byte) bool {
+	return proto.IsHTTPPayload(data) || bytes.HasPrefix(data, bHTTP)
+}
+
+// httpMessageSize returns size of HTTP message at the beginning of data. Responses to HEAD requests,
+// and responses with 1xx, 204 and 304 statuses have no body, even if they have Content-Length.
+// Returns -1 if message is not complete, or its size can't be determined from headers.
+func httpMessageSize(data []byte, headResponse bool) int {
+	if !isHTTPStart(data) {
+		return -1
+	}
+
+	headersEnd := proto.MIMEHeadersEndPos(data)
+	if headersEnd == -1 {
+		return -1
+	}
+
+	bodyStart := headersEnd + len(proto.EmptyLine)
+	headers := data[:bodyStart]
+
+	if bytes.HasPrefix(data, bHTTP) && (headResponse || isBodylessStatus(data)) {
+		return bodyStart
+	}
+
+	if enc := proto.Header(headers, []byte("Transfer-Encoding")); len(enc) > 0 {
+		size := chunkedBodySize(data[bodyStart:])
+		if size == -1 {
+			return -1
+		}
+
+		return bodyStart + size
+	}
+
+	if length := proto.Header(headers, []byte("Content-Length")); len(length) > 0 {
+		l, err := strconv.Atoi(string(length))
+		if err != nil || l < 0 || bodyStart+l > len(data) {
+			return -1
+		}
+
+		return bodyStart + l
+	}
+
+	// Response without length is read until connection closed
+	if bytes.HasPrefix(data, bHTTP) {
+		return -1
+	}
+
+	return bodyStart
+}
+
+// chunkedBodySize returns size of chunked body, including trailers, or -1 if it is not complete
+func chunkedBodySize(body []byte) int {
+	pos := 0
+
+	for {
+		lineEnd := bytes.Index(body[pos:], proto.CLRF)
+		if lineEnd == -1 {
+			return -1
+		}
+
+		sizeLine := body[pos : pos+lineEnd]
+		if i := bytes.IndexByte(sizeLine, ';'); i != -1 {
+			sizeLine = sizeLine[:i]
+		}
+
+		size, err := strconv.ParseUint(string(bytes.TrimSpace(sizeLine)), 16, 64)
+		if err != nil {
+			return -1
+		}
+
+		pos += lineEnd + len(proto.CLRF)
+
+		// Check size before adding it, so huge chunk size can't overflow position
+		if size > uint64(len(body)-pos) {
+			return -1
+		}
+
+		if size == 0 {
+			// Trailers section, ends with empty line
+			if bytes.HasPrefix(body[pos:], proto.CLRF) {
+				return pos + len(proto.CLRF)
+			}
+
+			end := bytes.Index(body[pos:], proto.EmptyLine)
+			if end == -1 {
+				return -1
+			}
+
+			return pos + end + len(proto.EmptyLine)
+		}
+
+		pos += int(size) + len(proto.CLRF)
+		if pos > len(body) {
+			return -1
+		}
+	}
+}
+
+// splitCoalesced splits segment containing multiple HTTP messages into packets, one per message.
+// Packets starting new message after complete one are marked with `messageStart`.
+// If segment continues previous message, `continued` is size of data completing it, or 0 if unknown.
+// For responses, isHeadResponse reports if n-th message of the segment responds to HEAD request, it is nil for requests.
+func splitCoalesced(packet *TCPPacket, continued int, isHeadResponse func(n int) bool) (packets []*TCPPacket) {
+	data := packet.Data
+	offset := 0
+	n := 0
+
+	if continued > 0 && continued < len(data) && isHTTPStart(data[continued:]) {
+		packets = append(packets, packet.slice(0, continued))
+		offset = continued
+		// Completed message is counted as well
+		n++
+	}
+
+	for ; ; n++ {
+		size := httpMessageSize(data[offset:], isHeadResponse != nil && isHeadResponse(n))
+		if size <= 0 || offset+size >= len(data) || !isHTTPStart(data[offset+size:]) {
+			break
+		}
+
+		p := packet.slice(offset, offset+size)
+		p.messageStart = offset > 0
+		packets = append(packets, p)
+
+		offset += size
+	}
+
+	if offset == 0 {
+		return []*TCPPacket{packet}
+	}
+
+	p := packet.slice(offset, len(data))
+	p.messageStart = true
+
+	return append(packets, p)
+}
@@ -0,0 +1,80 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHTTPMessageSize(t *testing.T) {
+	cases := []struct {
+		data string
+		size int
+	}{
+		{"GET / HTTP/1.1\r\n\r\nGET", 18},
+		{"POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nabGET", 40},
+		{"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nab", -1},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n0\r\n\r\nGET", 58},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n0\r\nX-Trailer: 1\r\n\r\n", 72},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n", -1},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nffffffffffffffff\r\na\r\n0\r\n\r\n", -1},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n7fffffffffffffff\r\na\r\n0\r\n\r\n", -1},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n-1\r\na\r\n0\r\n\r\n", -1},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na", 39},
+		{"HTTP/1.1 200 OK\r\n\r\nabc", -1},
+		{"HTTP/1.1 204 No Content\r\nContent-Length: 10\r\n\r\nHTTP", 47},
+		{"HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\nHTTP", 49},
+		{"GET / HTTP/1.1\r\nHost: a", -1},
+		{"body", -1},
+	}
+
+	for _, c := range cases {
+		if size := httpMessageSize([]byte(c.data), false); size != c.size {
+			t.Error("Wrong size", size, c.size, c.data)
+		}
+	}
+}
+
+func TestSplitCoalesced(t *testing.T) {
+	req1 := "GET /1 HTTP/1.1\r\n\r\n"
+	req2 := "POST /2 HTTP/1.1\r\nContent-Length: 2\r\n\r\nab"
+	req3 := "GET /3 HTTP/1.1\r\n"
+
+	packets := splitCoalesced(buildPacket(true, 1, 100, []byte(req1+req2+req3)), 0, nil)
+
+	if len(packets) != 3 {
+		t.Fatal("Should split segment by messages", len(packets))
+	}
+
+	for i, expected := range []string{req1, req2, req3} {
+		if !bytes.Equal(packets[i].Data, []byte(expected)) {
+			t.Error("Wrong packet data", i, string(packets[i].Data))
+		}
+
+		if packets[i].messageStart != (i > 0) {
+			t.Error("Only following messages should be marked", i)
+		}
+	}
+
+	if packets[1].Seq != 100+uint32(len(req1)) || packets[2].Seq != packets[1].nextSeq() {
+		t.Error("Wrong sequence numbers", packets[1].Seq, packets[2].Seq)
+	}
+
+	// Body which happens to start like request is not split
+	p := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\nnot a request"))
+	if packets := splitCoalesced(p, 0, nil); len(packets) != 1 || packets[0] != p {
+		t.Error("Should not split", packets)
+	}
+}
+
+func TestSplitCoalescedHeadResponses(t *testing.T) {
+	resp1 := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"
+	resp2 := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+
+	// First response is to HEAD request
+	isHeadResponse := func(n int) bool { return n == 0 }
+	packets := splitCoalesced(buildPacket(false, 1, 1, []byte(resp1+resp2)), 0, isHeadResponse)
+
+	if len(packets) != 2 || string(packets[0].Data) != resp1 || string(packets[1].Data) != resp2 {
+		t.Error("Should split response to HEAD request after headers", packets)
+	}
+}
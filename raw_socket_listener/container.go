@@ -0,0 +1,84 @@
+package rawSocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Docker API socket, DOCKER_HOST environment variable is used if set to unix:// address
+var dockerSocket = "/var/run/docker.sock"
+
+type dockerContainer struct {
+	State struct {
+		Running bool `json:"Running"`
+		Pid     int  `json:"Pid"`
+	} `json:"State"`
+}
+
+// containerPID resolves container name or ID to PID of its main process, using Docker API
+func containerPID(container string) (int, error) {
+	socket := dockerSocket
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		socket = strings.TrimPrefix(host, "unix://")
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://docker/containers/" + url.PathEscape(container) + "/json")
+	if err != nil {
+		return 0, fmt.Errorf("Can't connect to Docker API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("Can't find container %s: %s %s", container, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var c dockerContainer
+	if err = json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return 0, err
+	}
+
+	if !c.State.Running || c.State.Pid == 0 {
+		return 0, fmt.Errorf("Container %s is not running", container)
+	}
+
+	return c.State.Pid, nil
+}
+
+// containerNetns returns path of container network namespace.
+// Container can be specified by name, ID, or as "pid:1234" for processes not managed by Docker.
+func containerNetns(container string) (string, error) {
+	var pid int
+	var err error
+
+	if strings.HasPrefix(container, "pid:") {
+		pid, err = strconv.Atoi(strings.TrimPrefix(container, "pid:"))
+	} else {
+		pid, err = containerPID(container)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return "/proc/" + strconv.Itoa(pid) + "/ns/net", nil
+}
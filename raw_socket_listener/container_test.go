@@ -0,0 +1,60 @@
+package rawSocket
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContainerNetns(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_docker")
+	defer os.RemoveAll(dir)
+
+	defer func(s string) { dockerSocket = s }(dockerSocket)
+	dockerSocket = filepath.Join(dir, "docker.sock")
+
+	ln, err := net.Listen("unix", dockerSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/web/json":
+			w.Write([]byte(`{"Id": "4fa6e0f0c678", "State": {"Running": true, "Pid": 4242}}`))
+		case "/containers/stopped/json":
+			w.Write([]byte(`{"Id": "5fa6e0f0c678", "State": {"Running": false, "Pid": 0}}`))
+		default:
+			http.Error(w, `{"message": "No such container"}`, http.StatusNotFound)
+		}
+	}))
+	defer ln.Close()
+
+	os.Unsetenv("DOCKER_HOST")
+
+	if netns, err := containerNetns("web"); err != nil || netns != "/proc/4242/ns/net" {
+		t.Error("Should resolve container network namespace", netns, err)
+	}
+
+	if _, err := containerNetns("stopped"); err == nil {
+		t.Error("Should fail if container is not running")
+	}
+
+	if _, err := containerNetns("unknown"); err == nil {
+		t.Error("Should fail if container not found")
+	}
+
+	if netns, err := containerNetns("pid:1"); err != nil || netns != "/proc/1/ns/net" {
+		t.Error("Should use network namespace of given process", netns, err)
+	}
+}
+
+func TestContainerRequiresPcap(t *testing.T) {
+	_, err := NewListener("", "80", EngineRawSocket, true, 0, &ListenerConfig{Container: "pid:1"})
+	if err == nil {
+		t.Error("Should support container capture only with pcap engine")
+	}
+}
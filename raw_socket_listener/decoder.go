@@ -0,0 +1,83 @@
+package rawSocket
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetDecoder extracts IP packets from captured frames. Layers are preallocated and reused,
+// so decoding does not allocate. Not safe for concurrent use: each capture goroutine has own decoder.
+type packetDecoder struct {
+	parser *gopacket.DecodingLayerParser
+	// Used for raw IP link types, when first packet layer can be IPv6
+	parser6 *gopacket.DecodingLayerParser
+
+	eth   layers.Ethernet
+	dot1q layers.Dot1Q
+	loop  layers.Loopback
+	sll   layers.LinuxSLL
+	ip4   layers.IPv4
+	ip6   layers.IPv6
+	tcp   layers.TCP
+	udp   layers.UDP
+
+	decoded []gopacket.LayerType
+}
+
+// newPacketDecoder creates decoder of frames with given link layer. Returns error if link type is not supported.
+func newPacketDecoder(linkType layers.LinkType) (*packetDecoder, error) {
+	d := &packetDecoder{decoded: make([]gopacket.LayerType, 0, 8)}
+
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		d.parser = d.newParser(layers.LayerTypeEthernet)
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		// BSD loopback and Npcap loopback adapter: 4 bytes of address family
+		d.parser = d.newParser(layers.LayerTypeLoopback)
+	case layers.LinkTypeLinuxSLL:
+		// "any" interface uses Linux cooked capture header
+		d.parser = d.newParser(layers.LayerTypeLinuxSLL)
+	case layers.LinkTypeRaw, 12, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		// Raw IP, like tunnel interfaces. 12 is DLT_RAW on some BSDs
+		d.parser = d.newParser(layers.LayerTypeIPv4)
+		d.parser6 = d.newParser(layers.LayerTypeIPv6)
+	default:
+		return nil, fmt.Errorf("Unsupported link type: %s", linkType)
+	}
+
+	return d, nil
+}
+
+func (d *packetDecoder) newParser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser := gopacket.NewDecodingLayerParser(first, &d.eth, &d.dot1q, &d.loop, &d.sll, &d.ip4, &d.ip6, &d.tcp, &d.udp)
+	// Decoding stops at the first layer we are not interested in, like tunnel payload
+	parser.IgnoreUnsupported = true
+
+	return parser
+}
+
+// decode returns IP packet contained in the frame, or nil if frame is not IP, or it is malformed
+func (d *packetDecoder) decode(data []byte) []byte {
+	parser := d.parser
+	if d.parser6 != nil && len(data) > 0 && data[0]>>4 == 6 {
+		parser = d.parser6
+	}
+
+	if err := parser.DecodeLayers(data, &d.decoded); err != nil {
+		return nil
+	}
+
+	for _, layer := range d.decoded {
+		switch layer {
+		case layers.LayerTypeIPv4:
+			// Payload follows header in the frame, and is cut to the packet length, without link layer padding
+			return d.ip4.Contents[:len(d.ip4.Contents)+len(d.ip4.Payload)]
+		case layers.LayerTypeIPv6:
+			return d.ip6.Contents[:len(d.ip6.Contents)+len(d.ip6.Payload)]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package rawSocket
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// buildFrame serializes TCP segment with given link layers, returns frame and IP packet inside it
+func buildFrame(t *testing.T, link ...gopacket.SerializableLayer) (frame []byte, ip []byte) {
+	ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 51234, DstPort: 80, Seq: 1, ACK: true, DataOffset: 5}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+
+	if err := gopacket.SerializeLayers(buf, opts, ip4, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	ip = append([]byte{}, buf.Bytes()...)
+
+	if err := gopacket.SerializeLayers(buf, opts, append(link, ip4, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))...); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), ip
+}
+
+func TestPacketDecoder(t *testing.T) {
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+
+	cases := []struct {
+		name     string
+		linkType layers.LinkType
+		link     []gopacket.SerializableLayer
+	}{
+		{"ethernet", layers.LinkTypeEthernet, []gopacket.SerializableLayer{
+			&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+		}},
+		{"vlan", layers.LinkTypeEthernet, []gopacket.SerializableLayer{
+			&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeDot1Q},
+			&layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4},
+		}},
+		{"loopback", layers.LinkTypeNull, []gopacket.SerializableLayer{
+			&layers.Loopback{Family: layers.ProtocolFamilyIPv4},
+		}},
+		{"raw", layers.LinkTypeRaw, nil},
+	}
+
+	for _, c := range cases {
+		decoder, err := newPacketDecoder(c.linkType)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		frame, ip := buildFrame(t, c.link...)
+
+		if data := decoder.decode(frame); !bytes.Equal(data, ip) {
+			t.Errorf("%s: should return IP packet\n%x\n%x", c.name, data, ip)
+		}
+	}
+
+	// Ethernet frames shorter than 60 bytes are padded
+	decoder, _ := newPacketDecoder(layers.LinkTypeEthernet)
+	frame, ip := buildFrame(t, &layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4})
+	if data := decoder.decode(append(frame, 0, 0, 0, 0)); !bytes.Equal(data, ip) {
+		t.Error("Should strip padding")
+	}
+
+	if data := decoder.decode(frame[:10]); data != nil {
+		t.Error("Should skip truncated frame", data)
+	}
+
+	arp, _ := buildFrame(t, &layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeARP})
+	if data := decoder.decode(arp[:14]); data != nil {
+		t.Error("Should skip not IP frames", data)
+	}
+
+	if _, err := newPacketDecoder(layers.LinkTypeFDDI); err == nil {
+		t.Error("Should not support unknown link types")
+	}
+}
@@ -0,0 +1,141 @@
+package rawSocket
+
+import (
+	"bytes"
+
+	"github.com/buger/gor/proto"
+)
+
+var bExpect = []byte("Expect")
+var b100Continue = []byte("100-continue")
+
+// expectContinueHeader finds `Expect: 100-continue` header line in headers block, including its CRLF.
+// Header name and value are case insensitive. Returns -1 if header is not found.
+func expectContinueHeader(headers []byte) (start, end int) {
+	// Skip request line
+	start = bytes.Index(headers, proto.CLRF)
+	if start == -1 {
+		return -1, -1
+	}
+	start += 2
+
+	for start < len(headers) {
+		lineEnd := bytes.Index(headers[start:], proto.CLRF)
+		// Empty line is the end of headers
+		if lineEnd <= 0 {
+			break
+		}
+
+		line := headers[start : start+lineEnd]
+		if colon := bytes.IndexByte(line, ':'); colon != -1 &&
+			bytes.EqualFold(bytes.TrimSpace(line[:colon]), bExpect) &&
+			bytes.EqualFold(bytes.TrimSpace(line[colon+1:]), b100Continue) {
+			return start, start + lineEnd + 2
+		}
+
+		start += lineEnd + 2
+	}
+
+	return -1, -1
+}
+
+// checkExpectContinue detects request with `Expect: 100-continue` header, which body is not sent yet.
+// Client sends body only after `100 Continue` response, so body packets have different Ack, and are merged
+// with the request by sequence number, see expectedBodyRequest. Headers can span multiple packets.
+func (t *shard) checkExpectContinue(stream *tcpStream, message *TCPMessage) {
+	if message.headersChecked || len(message.packets) == 0 {
+		return
+	}
+
+	// Packets are ordered by Seq
+	last := message.packets[len(message.packets)-1]
+	if !bytes.HasSuffix(last.Data, []byte("\n")) {
+		return
+	}
+
+	data := message.Bytes()
+	headersEnd := proto.MIMEHeadersEndPos(data)
+	if headersEnd == -1 {
+		return
+	}
+	message.headersChecked = true
+
+	// Body is already sent, no need to merge
+	if headersEnd+len(proto.EmptyLine) != len(data) {
+		return
+	}
+
+	if start, _ := expectContinueHeader(data[:headersEnd+2]); start == -1 {
+		return
+	}
+
+	message.expectContinue = true
+
+	seq := last.nextSeq()
+	message.DataSeq = seq
+
+	// In case if sequence packet came first
+	for _, m := range stream.messages {
+		if m.Seq == seq {
+			t.deleteMessage(m)
+			if m.AssocMessage != nil {
+				message.AssocMessage = m.AssocMessage
+			}
+
+			for _, pkt := range m.packets {
+				pkt.UpdateAck(message.Ack)
+				t.addPacket(message, pkt)
+			}
+			m.release()
+		}
+	}
+}
+
+// expectedBodyRequest finds `Expect: 100-continue` request of connection, which body starts with the packet, or
+// continues with it: body packets have Ack of the body start, which is remembered once first of them is added.
+func (s *tcpStream) expectedBodyRequest(packet *TCPPacket, isIncoming bool) *TCPMessage {
+	if !isIncoming {
+		return nil
+	}
+
+	for _, m := range s.messages {
+		if m.expectContinue && packet.Ack != m.Ack && (packet.Seq == m.DataSeq || (m.DataAck != 0 && packet.Ack == m.DataAck)) {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// stripExpectContinue removes `Expect: 100-continue` header, so replayed request is sent without waiting for `100 Continue`.
+// Header can span multiple packets.
+func (t *TCPMessage) stripExpectContinue() {
+	data := t.Bytes()
+	headersEnd := proto.MIMEHeadersEndPos(data)
+	if headersEnd == -1 {
+		return
+	}
+
+	start, end := expectContinueHeader(data[:headersEnd+2])
+	if start == -1 {
+		return
+	}
+
+	offset := 0
+	for _, p := range t.packets {
+		pStart, pEnd := offset, offset+len(p.Data)
+		offset = pEnd
+
+		from, to := start-pStart, end-pStart
+		if from < 0 {
+			from = 0
+		}
+		if to > len(p.Data) {
+			to = len(p.Data)
+		}
+
+		if from < to {
+			p.Data = append(p.Data[:from], p.Data[to:]...)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestExpectContinueHeader(t *testing.T) {
+	cases := []struct {
+		headers string
+		header  string
+	}{
+		{"POST / HTTP/1.1\r\nExpect: 100-continue\r\n", "Expect: 100-continue\r\n"},
+		{"PUT / HTTP/1.1\r\nexpect:100-Continue\r\nHost: a\r\n", "expect:100-Continue\r\n"},
+		{"POST / HTTP/1.1\r\nX-Expect: 100-continue\r\n", ""},
+		{"POST / HTTP/1.1\r\nHost: a\r\n\r\nExpect: 100-continue\r\n", ""},
+		{"POST / HTTP/1.1", ""},
+	}
+
+	for _, c := range cases {
+		start, end := expectContinueHeader([]byte(c.headers))
+
+		if c.header == "" {
+			if start != -1 {
+				t.Error("Should not find header", c.headers)
+			}
+		} else if start == -1 || c.headers[start:end] != c.header {
+			t.Error("Should find header", c.headers, start, end)
+		}
+	}
+}
+
+// sendExpectContinue sends request with headers split into given packets, and body sent after `100 Continue` response
+func sendExpectContinue(listener *Listener, headers ...string) *TCPMessage {
+	seq := uint32(1)
+	for _, h := range headers {
+		listener.packetsChan <- newPacketBuffer(buildPacket(true, 1, seq, []byte(h)).Dump())
+		seq += uint32(len(h))
+	}
+
+	listener.packetsChan <- newPacketBuffer(buildPacket(false, seq, 1, []byte("HTTP/1.1 100 Continue\r\n\r\n")).Dump())
+	listener.packetsChan <- newPacketBuffer(buildPacket(true, 26, seq, []byte("ab")).Dump())
+
+	select {
+	case req := <-listener.messagesChan:
+		return req
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestRawListener100ContinuePut(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	req := sendExpectContinue(listener, "PUT / HTTP/1.1\r\nexpect: 100-Continue\r\nContent-Length: 2\r\n\r\n")
+	if req == nil {
+		t.Fatal("Should return request")
+	}
+
+	if !bytes.Equal(req.Bytes(), []byte("PUT / HTTP/1.1\r\nContent-Length: 2\r\n\r\nab")) {
+		t.Error("Should merge body and remove header", string(req.Bytes()))
+	}
+}
+
+func TestRawListener100ContinueSplitHeader(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	req := sendExpectContinue(listener, "PATCH / HTTP/1.1\r\nContent-Length: 2\r\nExpe", "ct: 100-continue\r", "\n\r\n")
+	if req == nil {
+		t.Fatal("Should return request")
+	}
+
+	if !bytes.Equal(req.Bytes(), []byte("PATCH / HTTP/1.1\r\nContent-Length: 2\r\n\r\nab")) {
+		t.Error("Should merge body and remove header", string(req.Bytes()))
+	}
+}
+
+func TestRawListener100ContinueKeepHeader(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, 10*time.Millisecond, &ListenerConfig{KeepExpectHeader: true})
+	defer listener.Close()
+
+	headers := "POST / HTTP/1.1\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\n"
+	req := sendExpectContinue(listener, headers)
+	if req == nil {
+		t.Fatal("Should return request")
+	}
+
+	if !bytes.Equal(req.Bytes(), []byte(headers+"ab")) {
+		t.Error("Should merge body and keep header", string(req.Bytes()))
+	}
+}
@@ -0,0 +1,71 @@
+package rawSocket
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryQueue is min-heap of messages being assembled, ordered by time of their last packet.
+// Allows to find expired messages without scanning all of them.
+type expiryQueue []*TCPMessage
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool { return q[i].End.Before(q[j].End) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].expiryIndex = i
+	q[j].expiryIndex = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	message := x.(*TCPMessage)
+	message.expiryIndex = len(*q)
+	*q = append(*q, message)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	message := old[n-1]
+	old[n-1] = nil
+	message.expiryIndex = -1
+	*q = old[:n-1]
+
+	return message
+}
+
+// trackExpiry adds new message to the expiry queue
+func (t *shard) trackExpiry(message *TCPMessage) {
+	heap.Push(&t.expiry, message)
+}
+
+// updateExpiry moves message in the expiry queue after its End time changed
+func (t *shard) updateExpiry(message *TCPMessage) {
+	if message.expiryIndex >= 0 {
+		heap.Fix(&t.expiry, message.expiryIndex)
+	}
+}
+
+// untrackExpiry removes message from the expiry queue
+func (t *shard) untrackExpiry(message *TCPMessage) {
+	if message.expiryIndex >= 0 {
+		heap.Remove(&t.expiry, message.expiryIndex)
+	}
+}
+
+// expireMessages dispatches messages which got no packets for messageExpire.
+// Since requests End earlier than their responses, they get dispatched first.
+func (t *shard) expireMessages(now time.Time) {
+	for len(t.expiry) > 0 && now.Sub(t.expiry[0].End) >= t.messageExpire {
+		message := t.expiry[0]
+
+		t.dispatchMessage(message)
+
+		// Should not happen: message is queued, but not tracked
+		if message.expiryIndex >= 0 {
+			t.untrackExpiry(message)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryQueue(t *testing.T) {
+	listener, _ := NewListener("", "80", engineTest, true, time.Second, &ListenerConfig{})
+	defer listener.Close()
+
+	// Not used by shard goroutine, since no packets are sent
+	l := listener.shards[0]
+
+	now := time.Now()
+
+	var messages []*TCPMessage
+	for i := 0; i < 3; i++ {
+		m := NewTCPMessage(uint32(i), 0, true)
+		m.End = now.Add(time.Duration(i) * time.Second)
+		messages = append(messages, m)
+		l.trackExpiry(m)
+	}
+
+	if l.expiry[0] != messages[0] {
+		t.Error("Message with earliest End should be first")
+	}
+
+	messages[0].End = now.Add(10 * time.Second)
+	l.updateExpiry(messages[0])
+
+	if l.expiry[0] != messages[1] {
+		t.Error("Should reorder updated message")
+	}
+
+	l.untrackExpiry(messages[1])
+	if messages[1].expiryIndex != -1 || l.expiry.Len() != 2 || l.expiry[0] != messages[2] {
+		t.Error("Should remove message from queue")
+	}
+
+	// Not queued message is ignored
+	l.untrackExpiry(messages[1])
+	if l.expiry.Len() != 2 {
+		t.Error("Should ignore not queued message")
+	}
+}
@@ -0,0 +1,307 @@
+package rawSocket
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/buger/gor/proto"
+)
+
+// Methods of requests, which completion can be detected
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("OPTIONS "), []byte("POST "), []byte("PUT "), []byte("PATCH "),
+	[]byte("DELETE "), []byte("TRACE "), []byte("CONNECT "), []byte("BAN "), []byte("PURGE "),
+}
+
+// Limits of data searched for end of line, longer lines are considered malformed
+const (
+	maxHeadersSize   = 64 * 1024
+	maxChunkLineSize = 4096
+)
+
+// httpFraming describes how end of HTTP message body is detected, parsed when message headers are received
+type httpFraming struct {
+	// Message Seq headers were parsed for, packets may be prepended later
+	seq uint32
+	// Size of headers, including empty line. 0 if headers are not received yet.
+	headersSize int
+	// Body length from Content-Length header, -1 if not set
+	contentLength int
+	// Body uses chunked transfer encoding
+	chunked bool
+	// Offset of the next not parsed chunk size line, relative to the message Seq
+	chunkOffset int
+	// Offset of trailers following the last chunk, 0 if the last chunk is not received yet
+	trailersOffset int
+}
+
+// Methods of requests, which without Content-Length are read until connection is closed
+var httpMethodsWithBody = [][]byte{[]byte("POST "), []byte("PUT "), []byte("PATCH ")}
+
+func isRequestStart(payload []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isRequestWithBody(payload []byte) bool {
+	for _, m := range httpMethodsWithBody {
+		if bytes.HasPrefix(payload, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contiguousSize returns size of message data received without gaps, counting from the message Seq
+func (t *TCPMessage) contiguousSize() int {
+	next := t.Seq
+
+	for _, p := range t.packets {
+		if seqDiff(p.Seq, next) > 0 {
+			break
+		}
+
+		if end := p.nextSeq(); seqDiff(end, next) > 0 {
+			next = end
+		}
+	}
+
+	return int(seqDiff(next, t.Seq))
+}
+
+// dataAt returns up to `n` bytes of contiguous message data starting at `offset`.
+// Data is copied only if it spans multiple packets.
+func (t *TCPMessage) dataAt(offset, n int) (data []byte) {
+	end := offset + n
+	if size := t.contiguousSize(); end > size {
+		end = size
+	}
+
+	for _, p := range t.packets {
+		start := int(seqDiff(p.Seq, t.Seq))
+		if start >= end {
+			break
+		}
+
+		from, to := offset-start, end-start
+		if from >= len(p.Data) {
+			continue
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to > len(p.Data) {
+			to = len(p.Data)
+		}
+
+		// Whole range is inside single packet
+		if data == nil && offset >= start && end-start <= len(p.Data) {
+			return p.Data[from:to]
+		}
+
+		data = append(data, p.Data[from:to]...)
+	}
+
+	return
+}
+
+// parseHeaders reads body framing from message headers, returns false if headers are not received yet
+func (t *TCPMessage) parseHeaders() bool {
+	f := &t.framing
+	if f.headersSize > 0 && f.seq == t.Seq {
+		return true
+	}
+
+	headers := t.dataAt(0, maxHeadersSize)
+	end := proto.MIMEHeadersEndPos(headers)
+	if end == -1 {
+		return false
+	}
+	headers = headers[:end+2]
+
+	*f = httpFraming{seq: t.Seq, headersSize: end + len(proto.EmptyLine), contentLength: -1}
+
+	if enc := proto.Header(headers, []byte("Transfer-Encoding")); len(enc) > 0 {
+		// Chunked is always the last encoding, and takes precedence over Content-Length
+		f.chunked = bytes.HasSuffix(bytes.ToLower(bytes.TrimSpace(enc)), []byte("chunked"))
+		f.chunkOffset = f.headersSize
+	}
+
+	if length := proto.Header(headers, []byte("Content-Length")); len(length) > 0 && !f.chunked {
+		if l, err := strconv.Atoi(string(bytes.TrimSpace(length))); err == nil && l >= 0 {
+			f.contentLength = l
+		}
+	}
+
+	return true
+}
+
+// isBodyComplete checks if body is received according to Content-Length or chunked encoding.
+// If message has neither, request has no body, while response is read until connection is closed (RFC 7230, 3.3.3),
+// and dispatched by closeDirection.
+func (t *TCPMessage) isBodyComplete() bool {
+	f := &t.framing
+
+	if f.chunked {
+		return t.isChunkedComplete()
+	}
+
+	if f.contentLength == -1 {
+		return t.IsIncoming
+	}
+
+	if f.contentLength == 0 {
+		return true
+	}
+
+	// Data beyond maximum message size is not kept, but its size is known
+	return t.contiguousSize()+t.truncatedSize()-f.headersSize >= f.contentLength
+}
+
+// isChunkedComplete parses chunks received since previous check, until last chunk and trailers are found.
+// Chunk data is skipped without reading, so only chunk size lines are parsed.
+func (t *TCPMessage) isChunkedComplete() bool {
+	f := &t.framing
+	size := t.contiguousSize()
+
+	for f.chunkOffset < size {
+		line := t.dataAt(f.chunkOffset, maxChunkLineSize)
+		end := bytes.Index(line, proto.CLRF)
+		if end == -1 {
+			return false
+		}
+
+		// Chunk extensions are ignored
+		sizeField := line[:end]
+		if i := bytes.IndexByte(sizeField, ';'); i != -1 {
+			sizeField = sizeField[:i]
+		}
+
+		chunkSize, err := strconv.ParseUint(string(bytes.TrimSpace(sizeField)), 16, 31)
+		if err != nil {
+			// Malformed chunk, message is dispatched on expire
+			return false
+		}
+
+		if chunkSize == 0 {
+			// Last chunk is followed by optional trailers, and empty line
+			f.trailersOffset = f.chunkOffset + end + 2
+			trailers := t.dataAt(f.trailersOffset, maxHeadersSize)
+			return bytes.HasPrefix(trailers, proto.CLRF) || bytes.Contains(trailers, proto.EmptyLine)
+		}
+
+		// Chunk data is followed by CRLF
+		f.chunkOffset += end + 2 + int(chunkSize) + 2
+	}
+
+	return false
+}
+
+// chunkedRemainder returns size of packet data completing chunked message, which packet continues.
+// Returns -1 if message is not chunked, already complete, or the end is not in the packet.
+func (t *TCPMessage) chunkedRemainder(packet *TCPPacket) int {
+	if len(t.packets) == 0 || t.Truncated || !t.parseHeaders() || !t.framing.chunked || t.isComplete() {
+		return -1
+	}
+
+	f := &t.framing
+	size := t.contiguousSize()
+	if int(seqDiff(packet.Seq, t.Seq)) != size {
+		return -1
+	}
+
+	if f.trailersOffset == 0 {
+		// Chunk size line, or chunk data span packets
+		offset := f.chunkOffset - size
+		if offset < 0 || offset >= len(packet.Data) {
+			return -1
+		}
+
+		if n := chunkedBodySize(packet.Data[offset:]); n != -1 {
+			return offset + n
+		}
+
+		return -1
+	}
+
+	// Last chunk is received, search for the end of trailers
+	received := t.dataAt(f.trailersOffset, size-f.trailersOffset)
+	trailers := append(append([]byte{}, received...), packet.Data...)
+
+	end := -1
+	if bytes.HasPrefix(trailers, proto.CLRF) {
+		end = len(proto.CLRF)
+	} else if i := bytes.Index(trailers, proto.EmptyLine); i != -1 {
+		end = i + len(proto.EmptyLine)
+	}
+
+	if end <= len(received) {
+		return -1
+	}
+
+	return end - len(received)
+}
+
+// Trailers returns header fields sent after the last chunk of chunked message, each ending with CRLF.
+// Returns nil if message has no trailers, or they are not received completely.
+func (t *TCPMessage) Trailers() []byte {
+	if len(t.packets) == 0 || !t.parseHeaders() || !t.framing.chunked || !t.isChunkedComplete() {
+		return nil
+	}
+
+	trailers := t.dataAt(t.framing.trailersOffset, maxHeadersSize)
+	if bytes.HasPrefix(trailers, proto.CLRF) {
+		return nil
+	}
+
+	end := bytes.Index(trailers, proto.EmptyLine)
+	if end == -1 {
+		return nil
+	}
+
+	return trailers[:end+len(proto.CLRF)]
+}
+
+// isComplete checks if headers and body of HTTP message are received
+func (t *TCPMessage) isComplete() bool {
+	if !t.parseHeaders() {
+		return false
+	}
+
+	if !t.IsIncoming && t.isResponseWithoutBody(t.packets[0].Data) {
+		return true
+	}
+
+	return t.isBodyComplete()
+}
+
+// isBodylessStatus checks if response status is 1xx, 204 or 304, responses with them never have body
+func isBodylessStatus(payload []byte) bool {
+	// HTTP/1.1 204 No Content
+	if len(payload) < 12 {
+		return false
+	}
+
+	status := payload[9:12]
+	return status[0] == '1' || bytes.Equal(status, []byte("204")) || bytes.Equal(status, []byte("304"))
+}
+
+// isHeadRequest checks if request method is HEAD
+func isHeadRequest(request *TCPMessage) bool {
+	return len(request.packets) > 0 && bytes.HasPrefix(request.packets[0].Data, []byte("HEAD "))
+}
+
+// isResponseWithoutBody checks status codes, which responses never have body, and responses to HEAD requests
+func (t *TCPMessage) isResponseWithoutBody(payload []byte) bool {
+	if isBodylessStatus(payload) {
+		return true
+	}
+
+	return t.AssocMessage != nil && isHeadRequest(t.AssocMessage)
+}
@@ -0,0 +1,148 @@
+package rawSocket
+
+import (
+	"testing"
+)
+
+// buildSplitMessage builds message from data split into packets at given offsets, and reports
+// if it is finished after each packet
+func buildSplitMessage(isIncoming bool, data string, splits ...int) (msg *TCPMessage, finished []bool) {
+	splits = append(splits, len(data))
+	start := 0
+
+	for _, end := range splits {
+		p := buildPacket(isIncoming, 1, 1+uint32(start), []byte(data[start:end]))
+		if msg == nil {
+			msg = buildMessage(p)
+		} else {
+			msg.AddPacket(p)
+		}
+
+		finished = append(finished, msg.IsFinished())
+		start = end
+	}
+
+	return
+}
+
+func TestTCPMessageContentLength(t *testing.T) {
+	data := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\n0123456789"
+
+	// Headers span packets, and body split into multiple packets
+	_, finished := buildSplitMessage(true, data, 10, 30, 52, 55)
+	for i, f := range finished {
+		if f != (i == len(finished)-1) {
+			t.Error("Should be finished only when body is complete", i, f)
+		}
+	}
+
+	msg := buildMessage(buildPacket(true, 1, 1, []byte("DELETE / HTTP/1.1\r\nContent-Length: 0\r\n\r\n")))
+	if !msg.IsFinished() {
+		t.Error("Should finish request with empty body")
+	}
+}
+
+func TestTCPMessageMissingPacket(t *testing.T) {
+	data := "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789"
+
+	msg := buildMessage(buildPacket(true, 1, 1, []byte(data[:40])))
+	msg.AddPacket(buildPacket(true, 1, 1+45, []byte(data[45:])))
+
+	if msg.IsFinished() {
+		t.Error("Should wait for missing packet")
+	}
+
+	msg.AddPacket(buildPacket(true, 1, 1+40, []byte(data[40:45])))
+
+	if !msg.IsFinished() {
+		t.Error("Should be finished when missing packet received")
+	}
+}
+
+func TestTCPMessageChunked(t *testing.T) {
+	headers := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"
+	// Chunk data looks like last chunk
+	data := headers + "5\r\n0\r\n\r\n\r\n" + "a;ext=1\r\n0123456789\r\n" + "0\r\n" + "\r\n"
+
+	_, finished := buildSplitMessage(true, data, len(headers)+3, len(headers)+8, len(data)-4, len(data)-2)
+	for i, f := range finished {
+		if f != (i == len(finished)-1) {
+			t.Error("Should be finished only after last chunk", i, f)
+		}
+	}
+
+	// Finished can be checked only for associated responses
+	msg, _ := buildSplitMessage(false, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n0\r\nExpires: 0\r\n", 30)
+	msg.AssocMessage = &TCPMessage{}
+	if msg.IsFinished() {
+		t.Error("Should wait for the end of trailers")
+	}
+
+	msg.AddPacket(buildPacket(false, 1, msg.packets[len(msg.packets)-1].nextSeq(), []byte("\r\n")))
+	if !msg.IsFinished() {
+		t.Error("Should be finished after trailers")
+	}
+}
+
+func TestTCPMessageTrailers(t *testing.T) {
+	headers := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	msg, _ := buildSplitMessage(false, headers+"1\r\na\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: ok\r\n\r\n", len(headers)+8)
+	if trailers := string(msg.Trailers()); trailers != "Grpc-Status: 0\r\nGrpc-Message: ok\r\n" {
+		t.Errorf("Should return trailers %q", trailers)
+	}
+
+	for _, data := range []string{
+		headers + "1\r\na\r\n0\r\n\r\n",
+		headers + "1\r\na\r\n0\r\nGrpc-Status: 0\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+	} {
+		msg, _ := buildSplitMessage(false, data)
+		if trailers := msg.Trailers(); trailers != nil {
+			t.Errorf("Should not return trailers of %q: %q", data, trailers)
+		}
+	}
+}
+
+func TestTCPMessageChunkedRemainder(t *testing.T) {
+	headers := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	next := "HTTP/1.1 200 OK\r\n\r\n"
+
+	for _, c := range []struct {
+		received, rest string
+		remainder      int
+	}{
+		{"2\r\na", "b\r\n0\r\n\r\n", 8},
+		{"2\r\nab\r\n", "0\r\nGrpc-Status: 0\r\n\r\n", 21},
+		{"2\r\nab\r\n0\r\nGrpc-Status: 0\r", "\n\r\n", 3},
+		{"2\r\nab\r\n0\r\n", "\r\n", 2},
+		// Chunk size line spans packets
+		{"2\r", "\nab\r\n0\r\n\r\n", -1},
+		{"2\r\nab\r\n", "1\r\na\r\n", -1},
+	} {
+		msg, _ := buildSplitMessage(false, headers+c.received)
+		packet := buildPacket(false, 1, msg.packets[0].nextSeq(), []byte(c.rest+next))
+
+		if n := msg.chunkedRemainder(packet); n != c.remainder {
+			t.Errorf("Expected remainder %d of %q, got %d", c.remainder, c.rest, n)
+		}
+	}
+}
+
+func TestTCPMessageResponseWithoutBody(t *testing.T) {
+	for _, status := range []string{"100 Continue", "204 No Content", "304 Not Modified"} {
+		msg := buildMessage(buildPacket(false, 1, 1, []byte("HTTP/1.1 "+status+"\r\nContent-Length: 10\r\n\r\n")))
+		msg.AssocMessage = &TCPMessage{}
+
+		if !msg.IsFinished() {
+			t.Error("Response should not have body", status)
+		}
+	}
+
+	msg := buildMessage(buildPacket(false, 1, 1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n")))
+	msg.AssocMessage = buildMessage(buildPacket(true, 1, 1, []byte("HEAD / HTTP/1.1\r\n\r\n")))
+
+	if !msg.IsFinished() {
+		t.Error("Response to HEAD request should not have body")
+	}
+}
@@ -0,0 +1,72 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// gRPC calls are HTTP/2 streams with `application/grpc` content type, so they are decoded only if connection is h2c,
+// see h2c.go. Body of request and response is sequence of length-prefixed messages. Calls are emitted as usual
+// requests and responses, with TCPMessage.GRPC describing them.
+
+// Message prefix: compressed flag, and 4 bytes of message length
+const grpcMessagePrefixSize = 5
+
+// GRPCCall describes request or response of gRPC call
+type GRPCCall struct {
+	// Full method name from :path of the request, like "/helloworld.Greeter/SayHello"
+	Method string
+
+	// Messages sent by this side of the call, compressed ones are kept as is. If message was truncated,
+	// the last not complete message is missing.
+	Messages [][]byte
+
+	// Compression of messages from grpc-encoding header, empty if it is not set
+	Encoding string
+
+	// Status code from grpc-status trailer, or header of trailers-only response. Empty for requests.
+	Status string
+}
+
+// isGRPCContentType checks if content type is "application/grpc", optionally followed by message format,
+// like "application/grpc+proto"
+func isGRPCContentType(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// newGRPCCall decodes request or response of the stream, if stream is gRPC call. Returns nil otherwise.
+func newGRPCCall(s *h2cStream, m *h2cMessage) *GRPCCall {
+	if s.request == nil || !isGRPCContentType(h2Header(s.request.headers, "content-type")) {
+		return nil
+	}
+
+	call := &GRPCCall{
+		Method:   h2Header(s.request.headers, ":path"),
+		Messages: parseGRPCMessages(m.body),
+		Encoding: h2Header(m.headers, "grpc-encoding"),
+	}
+
+	if !m.message.IsIncoming {
+		if call.Status = h2Header(m.trailers, "grpc-status"); call.Status == "" {
+			call.Status = h2Header(m.headers, "grpc-status")
+		}
+	}
+
+	return call
+}
+
+// parseGRPCMessages splits body into length-prefixed messages, data following the last complete message is ignored
+func parseGRPCMessages(body []byte) (messages [][]byte) {
+	for len(body) >= grpcMessagePrefixSize {
+		size := binary.BigEndian.Uint32(body[1:grpcMessagePrefixSize])
+		if uint64(len(body)-grpcMessagePrefixSize) < uint64(size) {
+			break
+		}
+
+		messages = append(messages, body[grpcMessagePrefixSize:grpcMessagePrefixSize+int(size)])
+		body = body[grpcMessagePrefixSize+int(size):]
+	}
+
+	return
+}
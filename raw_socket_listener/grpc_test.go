@@ -0,0 +1,95 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRawListenerGRPC(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	c := newH2CConversation()
+
+	// Unary call, and failed streaming call with trailers-only response
+	client := append([]byte{}, h2cPreface...)
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 1, c.request(
+		":method", "POST", ":scheme", "http", ":path", "/helloworld.Greeter/SayHello", "content-type", "application/grpc+proto"))...)
+	client = append(client, h2Frame(h2FrameData, h2FlagEndStream, 1, []byte("\x00\x00\x00\x00\x03abc"))...)
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 3, c.request(
+		":method", "POST", ":scheme", "http", ":path", "/helloworld.Greeter/SayHelloStream", "content-type", "application/grpc", "grpc-encoding", "gzip"))...)
+	client = append(client, h2Frame(h2FrameData, h2FlagEndStream, 3, []byte("\x01\x00\x00\x00\x01a\x00\x00\x00\x00\x00"))...)
+
+	server := h2Frame(h2FrameHeaders, h2FlagEndHeaders, 1, c.response(":status", "200", "content-type", "application/grpc"))
+	server = append(server, h2Frame(h2FrameData, 0, 1, []byte("\x00\x00\x00\x00\x02hi"))...)
+	server = append(server, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, c.response("grpc-status", "0"))...)
+	server = append(server, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 3, c.response(":status", "200", "content-type", "application/grpc", "grpc-status", "12"))...)
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, client).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, 1+uint32(len(client)), 100, server).Dump())
+
+	calls := make(map[string]*GRPCCall)
+	for i := 0; i < 4; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if m.GRPC == nil {
+				t.Fatal("Should describe gRPC call", string(m.Bytes()))
+			}
+
+			key := m.GRPC.Method + " response"
+			if m.IsIncoming {
+				key = m.GRPC.Method + " request"
+			}
+			calls[key] = m.GRPC
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit gRPC calls", i)
+		}
+	}
+
+	if c := calls["/helloworld.Greeter/SayHello request"]; c == nil || len(c.Messages) != 1 || string(c.Messages[0]) != "abc" || c.Status != "" {
+		t.Errorf("Should decode request messages: %+v", c)
+	}
+
+	if c := calls["/helloworld.Greeter/SayHello response"]; c == nil || len(c.Messages) != 1 || string(c.Messages[0]) != "hi" || c.Status != "0" {
+		t.Errorf("Should decode response messages and status: %+v", c)
+	}
+
+	if c := calls["/helloworld.Greeter/SayHelloStream request"]; c == nil || len(c.Messages) != 2 || c.Encoding != "gzip" {
+		t.Errorf("Should decode streamed messages: %+v", c)
+	}
+
+	if c := calls["/helloworld.Greeter/SayHelloStream response"]; c == nil || len(c.Messages) != 0 || c.Status != "12" {
+		t.Errorf("Should take status of trailers-only response: %+v", c)
+	}
+}
+
+func TestRawListenerH2CNotGRPC(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	c := newH2CConversation()
+
+	client := append([]byte{}, h2cPreface...)
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, c.request(":method", "GET", ":path", "/", "content-type", "application/grpc-web"))...)
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, client).Dump())
+
+	select {
+	case m := <-listener.messagesChan:
+		if m.GRPC != nil {
+			t.Error("Should describe only gRPC calls")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Should emit request")
+	}
+}
+
+func TestParseGRPCMessages(t *testing.T) {
+	messages := parseGRPCMessages([]byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02ab\x00\x00\x00\x00\x05abc"))
+	if len(messages) != 2 || len(messages[0]) != 0 || string(messages[1]) != "ab" {
+		t.Errorf("Should split messages, ignoring not complete one: %q", messages)
+	}
+
+	if messages := parseGRPCMessages([]byte("\x00\xff\xff\xff\xff")); len(messages) != 0 {
+		t.Errorf("Should not fail on large length: %q", messages)
+	}
+}
@@ -0,0 +1,520 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP/2 over cleartext TCP (h2c) is detected by the client connection preface, so only connections
+// captured from the beginning, and using prior knowledge (like gRPC) are decoded. Each HTTP/2 stream is
+// emitted as HTTP/1.1 request and response, so outputs do not need to know about HTTP/2.
+
+var h2cPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// HTTP/2 frame types and flags, see RFC 7540 section 6
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePushPromise  = 0x5
+	h2FrameContinuation = 0x9
+
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2SettingHeaderTableSize = 0x1
+)
+
+const (
+	h2FrameHeaderSize = 9
+	// Default size of HPACK dynamic table
+	h2DefaultTableSize = 4096
+	// Maximum number of concurrent streams tracked per connection, new streams beyond it are ignored
+	h2MaxStreams = 1024
+)
+
+// h2cConn holds HTTP/2 decoding state of single connection
+type h2cConn struct {
+	client, server h2cDirection
+	streams        map[uint32]*h2cStream
+
+	// Size of client preface not received yet, it can be split between segments
+	prefaceLeft int
+
+	// Decoding failed, like because of missing segment, and HPACK state is lost
+	broken bool
+}
+
+// h2cDirection holds state of frames sent by one side of connection
+type h2cDirection struct {
+	// Sequence number of the next expected segment, and not complete frame from previous segments
+	nextSeq uint32
+	started bool
+	buf     []byte
+
+	decoder *hpack.Decoder
+
+	// Header block split into CONTINUATION frames
+	headersStream uint32
+	headersFlags  byte
+	headerBlock   []byte
+	// Header block of PUSH_PROMISE frame, decoded only to keep HPACK state
+	pushPromise bool
+}
+
+// h2cStream holds request and response of single HTTP/2 stream
+type h2cStream struct {
+	request, response *h2cMessage
+}
+
+// h2cMessage collects headers and data frames of one side of HTTP/2 stream
+type h2cMessage struct {
+	message *TCPMessage
+
+	headers  []hpack.HeaderField
+	trailers []hpack.HeaderField
+	body     []byte
+
+	// End of stream is received, and message is passed to receiver
+	finished, emitted bool
+}
+
+func newH2CConn() *h2cConn {
+	c := &h2cConn{streams: make(map[uint32]*h2cStream), prefaceLeft: len(h2cPreface)}
+	c.client.decoder = hpack.NewDecoder(h2DefaultTableSize, nil)
+	c.server.decoder = hpack.NewDecoder(h2DefaultTableSize, nil)
+
+	return c
+}
+
+// isH2CPreface checks if packet starts HTTP/2 connection with prior knowledge
+func isH2CPreface(packet *TCPPacket, isIncoming bool) bool {
+	if !isIncoming || len(packet.Data) < 4 {
+		return false
+	}
+
+	return bytes.HasPrefix(packet.Data, h2cPreface) || bytes.HasPrefix(h2cPreface, packet.Data)
+}
+
+// processH2C decodes frames of the segment, and emits streams which are complete
+func (t *shard) processH2C(stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	c := stream.h2c
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data := packet.Data
+
+	// Preface, or first server segment starts sequence of the direction
+	if !d.started {
+		d.nextSeq, d.started = packet.Seq, true
+	}
+
+	switch diff := seqDiff(packet.Seq, d.nextSeq); {
+	case diff > 0:
+		// Missing data can't be skipped, since HPACK state depends on it
+		t.breakH2C(c)
+		return
+	case diff < 0:
+		// Retransmission of already processed data
+		if int(-diff) >= len(data) {
+			return
+		}
+		data = data[-diff:]
+	}
+	d.nextSeq = packet.Seq + uint32(len(packet.Data))
+
+	if isIncoming && c.prefaceLeft > 0 {
+		n := c.prefaceLeft
+		if n > len(data) {
+			n = len(data)
+		}
+
+		data = data[n:]
+		c.prefaceLeft -= n
+	}
+
+	// Packet data is reused after processing, so incomplete frames are copied
+	buf := data
+	if len(d.buf) > 0 {
+		d.buf = append(d.buf, data...)
+		buf = d.buf
+	}
+
+	for len(buf) >= h2FrameHeaderSize {
+		length := int(buf[0])<<16 | int(buf[1])<<8 | int(buf[2])
+		if len(buf) < h2FrameHeaderSize+length {
+			break
+		}
+
+		frameType, flags := buf[3], buf[4]
+		streamID := binary.BigEndian.Uint32(buf[5:9]) & (1<<31 - 1)
+		payload := buf[h2FrameHeaderSize : h2FrameHeaderSize+length]
+		buf = buf[h2FrameHeaderSize+length:]
+
+		if !t.processH2CFrame(c, d, packet, isIncoming, frameType, flags, streamID, payload) {
+			t.breakH2C(c)
+			return
+		}
+	}
+
+	d.buf = append(d.buf[:0], buf...)
+}
+
+// processH2CFrame handles single frame, returns false if connection can't be decoded further
+func (t *shard) processH2CFrame(c *h2cConn, d *h2cDirection, packet *TCPPacket, isIncoming bool, frameType, flags byte, streamID uint32, payload []byte) bool {
+	// Header block should be continued without interleaving with other frames
+	if d.headersStream != 0 && (frameType != h2FrameContinuation || streamID != d.headersStream) {
+		return false
+	}
+
+	switch frameType {
+	case h2FrameData:
+		payload, ok := h2Unpad(payload, flags)
+		if !ok {
+			return false
+		}
+
+		if m := c.message(streamID, isIncoming); m != nil {
+			m.appendBody(payload, t.config.MaxMessageSize)
+			m.message.updateCaptureTime(packet.Timestamp)
+
+			if flags&h2FlagEndStream != 0 {
+				t.finishH2CMessage(c, streamID, isIncoming)
+			}
+		}
+	case h2FrameHeaders, h2FramePushPromise:
+		block, ok := h2Unpad(payload, flags)
+		if !ok {
+			return false
+		}
+
+		if frameType == h2FramePushPromise {
+			// Promised stream ID
+			if len(block) < 4 {
+				return false
+			}
+			block = block[4:]
+		} else if flags&h2FlagPriority != 0 {
+			// Stream dependency and weight
+			if len(block) < 5 {
+				return false
+			}
+			block = block[5:]
+		}
+
+		d.headerBlock = append(d.headerBlock[:0], block...)
+		d.headersFlags = flags
+		d.pushPromise = frameType == h2FramePushPromise
+
+		if flags&h2FlagEndHeaders == 0 {
+			d.headersStream = streamID
+			return true
+		}
+
+		return t.processH2CHeaders(c, d, packet, isIncoming, streamID)
+	case h2FrameContinuation:
+		if d.headersStream != streamID {
+			return false
+		}
+
+		d.headerBlock = append(d.headerBlock, payload...)
+		if flags&h2FlagEndHeaders == 0 {
+			return true
+		}
+
+		d.headersStream = 0
+		return t.processH2CHeaders(c, d, packet, isIncoming, streamID)
+	case h2FrameRSTStream:
+		t.dropH2CStream(c, streamID)
+	case h2FrameSettings:
+		if flags&h2FlagAck != 0 {
+			return true
+		}
+
+		// Table size limits encoder of the other side
+		other := &c.client
+		if isIncoming {
+			other = &c.server
+		}
+
+		for ; len(payload) >= 6; payload = payload[6:] {
+			if binary.BigEndian.Uint16(payload[:2]) == h2SettingHeaderTableSize {
+				other.decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[2:6]))
+			}
+		}
+	}
+
+	return true
+}
+
+// processH2CHeaders decodes complete header block, which starts message or holds its trailers
+func (t *shard) processH2CHeaders(c *h2cConn, d *h2cDirection, packet *TCPPacket, isIncoming bool, streamID uint32) bool {
+	fields, err := d.decoder.DecodeFull(d.headerBlock)
+	if err != nil {
+		return false
+	}
+
+	if d.pushPromise {
+		return true
+	}
+
+	s, ok := c.streams[streamID]
+	if !ok {
+		// Server pushed streams, and streams started before capture have no requests
+		if !isIncoming || len(c.streams) >= h2MaxStreams {
+			return true
+		}
+
+		s = &h2cStream{}
+		c.streams[streamID] = s
+	}
+
+	m := s.request
+	if !isIncoming {
+		m = s.response
+	}
+
+	if m != nil {
+		// Headers following data are trailers
+		m.trailers = fields
+	} else if !isIncoming {
+		// Informational responses, like 100 Continue, are followed by final response
+		if status := h2Header(fields, ":status"); len(status) > 0 && status[0] == '1' {
+			return true
+		}
+
+		m = t.newH2CMessage(packet, isIncoming, streamID, fields)
+		s.response = m
+	} else {
+		m = t.newH2CMessage(packet, isIncoming, streamID, fields)
+		s.request = m
+	}
+
+	m.message.updateCaptureTime(packet.Timestamp)
+
+	if d.headersFlags&h2FlagEndStream != 0 {
+		t.finishH2CMessage(c, streamID, isIncoming)
+	}
+
+	return true
+}
+
+// newH2CMessage creates message of stream, addressed like packets of the connection
+func (t *shard) newH2CMessage(packet *TCPPacket, isIncoming bool, streamID uint32, headers []hpack.HeaderField) *h2cMessage {
+	// Streams multiplexed in same segment share Ack, so stream ID keeps their UUIDs distinct
+	message := NewTCPMessage(packet.Seq, packet.Ack+streamID, isIncoming)
+	message.packets = []*TCPPacket{packet.headerCopy()}
+
+	return &h2cMessage{message: message, headers: headers}
+}
+
+// message returns not finished request or response of the stream
+func (c *h2cConn) message(streamID uint32, isIncoming bool) *h2cMessage {
+	s, ok := c.streams[streamID]
+	if !ok {
+		return nil
+	}
+
+	if isIncoming {
+		return s.request
+	}
+
+	return s.response
+}
+
+// finishH2CMessage renders message, when its side ends the stream
+func (t *shard) finishH2CMessage(c *h2cConn, streamID uint32, isIncoming bool) {
+	s := c.streams[streamID]
+	m := s.request
+	if !isIncoming {
+		m = s.response
+	}
+
+	m.message.packets[0].Data = m.bytes()
+	m.message.size = len(m.message.packets[0].Data)
+	m.message.End = time.Now()
+	m.message.GRPC = newGRPCCall(s, m)
+	m.finished = true
+
+	t.emitH2CStream(c, streamID)
+}
+
+// emitH2CStream emits finished request, and response after its request. Response can finish first,
+// like if server replies before reading whole request body.
+func (t *shard) emitH2CStream(c *h2cConn, streamID uint32) {
+	s := c.streams[streamID]
+	if s.request == nil || !s.request.finished {
+		return
+	}
+
+	if !s.request.emitted {
+		s.request.emitted = true
+		t.emit(s.request.message)
+	}
+
+	if !t.trackResponse {
+		delete(c.streams, streamID)
+		return
+	}
+
+	if s.response != nil && s.response.finished {
+		s.response.message.AssocMessage = s.request.message
+		t.emit(s.response.message)
+		delete(c.streams, streamID)
+	}
+}
+
+// dropH2CStream removes reset stream, its messages not emitted yet are discarded
+func (t *shard) dropH2CStream(c *h2cConn, streamID uint32) {
+	if _, ok := c.streams[streamID]; ok {
+		atomic.AddUint64(&t.stats.messagesExpired, 1)
+		delete(c.streams, streamID)
+	}
+}
+
+// breakH2C stops decoding of connection, streams in progress are discarded
+func (t *shard) breakH2C(c *h2cConn) {
+	for id := range c.streams {
+		t.dropH2CStream(c, id)
+	}
+
+	c.broken = true
+	c.client.buf, c.server.buf = nil, nil
+}
+
+// h2Unpad removes padding from DATA, HEADERS and PUSH_PROMISE frame payload
+func h2Unpad(payload []byte, flags byte) ([]byte, bool) {
+	if flags&h2FlagPadded == 0 {
+		return payload, true
+	}
+
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, false
+	}
+
+	return payload[1 : len(payload)-int(payload[0])], true
+}
+
+// h2Header returns value of the first header field with given name
+func h2Header(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+
+	return ""
+}
+
+// appendBody adds DATA frame payload, discarding data beyond maximum message size
+func (m *h2cMessage) appendBody(data []byte, maxSize int) {
+	if maxSize > 0 && len(m.body)+len(data) > maxSize {
+		if len(m.body) < maxSize {
+			m.body = append(m.body, data[:maxSize-len(m.body)]...)
+		}
+
+		m.message.Truncated = true
+		return
+	}
+
+	m.body = append(m.body, data...)
+}
+
+// bytes renders message as HTTP/1.1 request or response. Body is sent with Content-Length,
+// or as single chunk if message has trailers, like gRPC responses.
+func (m *h2cMessage) bytes() []byte {
+	var buf []byte
+
+	if m.message.IsIncoming {
+		buf = append(buf, h2Header(m.headers, ":method")...)
+		buf = append(buf, ' ')
+		buf = append(buf, h2Header(m.headers, ":path")...)
+		buf = append(buf, " HTTP/1.1\r\n"...)
+
+		if authority := h2Header(m.headers, ":authority"); authority != "" && h2Header(m.headers, "host") == "" {
+			buf = append(buf, "Host: "...)
+			buf = append(buf, authority...)
+			buf = append(buf, "\r\n"...)
+		}
+	} else {
+		status := h2Header(m.headers, ":status")
+		code, _ := strconv.Atoi(status)
+
+		buf = append(buf, "HTTP/1.1 "...)
+		buf = append(buf, status...)
+		buf = append(buf, ' ')
+		buf = append(buf, http.StatusText(code)...)
+		buf = append(buf, "\r\n"...)
+	}
+
+	var cookies []string
+
+	for _, f := range m.headers {
+		switch {
+		case len(f.Name) > 0 && f.Name[0] == ':', f.Name == "content-length" && len(m.trailers) > 0:
+			continue
+		case f.Name == "cookie":
+			// Cookie can be split into multiple fields, see RFC 7540 section 8.1.2.5
+			cookies = append(cookies, f.Value)
+			continue
+		}
+
+		buf = h2AppendHeader(buf, f.Name, f.Value)
+	}
+
+	if len(cookies) > 0 {
+		buf = h2AppendHeader(buf, "cookie", strings.Join(cookies, "; "))
+	}
+
+	if len(m.trailers) > 0 {
+		buf = append(buf, "Transfer-Encoding: chunked\r\n\r\n"...)
+
+		if len(m.body) > 0 {
+			buf = strconv.AppendInt(buf, int64(len(m.body)), 16)
+			buf = append(buf, "\r\n"...)
+			buf = append(buf, m.body...)
+			buf = append(buf, "\r\n"...)
+		}
+
+		buf = append(buf, "0\r\n"...)
+		for _, f := range m.trailers {
+			buf = h2AppendHeader(buf, f.Name, f.Value)
+		}
+
+		return append(buf, "\r\n"...)
+	}
+
+	if h2Header(m.headers, "content-length") == "" && (len(m.body) > 0 || m.message.IsIncoming && isRequestWithBody(buf)) {
+		buf = h2AppendHeader(buf, "content-length", strconv.Itoa(len(m.body)))
+	}
+
+	buf = append(buf, "\r\n"...)
+
+	return append(buf, m.body...)
+}
+
+func h2AppendHeader(buf []byte, name, value string) []byte {
+	buf = append(buf, textproto.CanonicalMIMEHeaderKey(name)...)
+	buf = append(buf, ": "...)
+	buf = append(buf, value...)
+
+	return append(buf, "\r\n"...)
+}
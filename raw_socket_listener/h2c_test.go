@@ -0,0 +1,187 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// h2Frame builds HTTP/2 frame
+func h2Frame(frameType, flags byte, streamID uint32, payload []byte) []byte {
+	frame := make([]byte, h2FrameHeaderSize, h2FrameHeaderSize+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = frameType, flags
+	binary.BigEndian.PutUint32(frame[5:9], streamID)
+
+	return append(frame, payload...)
+}
+
+// h2Headers encodes header fields given as name and value pairs
+func h2Headers(enc *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+
+	return append([]byte{}, buf.Bytes()...)
+}
+
+// h2cConversation holds HPACK encoders of both sides of connection
+type h2cConversation struct {
+	clientBuf, serverBuf bytes.Buffer
+	client, server       *hpack.Encoder
+}
+
+func newH2CConversation() *h2cConversation {
+	c := &h2cConversation{}
+	c.client = hpack.NewEncoder(&c.clientBuf)
+	c.server = hpack.NewEncoder(&c.serverBuf)
+
+	return c
+}
+
+func (c *h2cConversation) request(fields ...string) []byte {
+	return h2Headers(c.client, &c.clientBuf, fields...)
+}
+
+func (c *h2cConversation) response(fields ...string) []byte {
+	return h2Headers(c.server, &c.serverBuf, fields...)
+}
+
+// receiveH2C reads `count` messages, and returns them by UUID
+func receiveH2C(t *testing.T, listener *Listener, count int) (requests, responses map[string]string) {
+	requests, responses = make(map[string]string), make(map[string]string)
+
+	for i := 0; i < count; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				requests[string(m.UUID())] = string(m.Bytes())
+			} else {
+				responses[string(m.UUID())] = string(m.Bytes())
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit HTTP/2 streams", i)
+		}
+	}
+
+	return
+}
+
+func TestRawListenerH2C(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	c := newH2CConversation()
+
+	// gRPC call, and concurrent GET request sent in the same segment
+	client := append([]byte{}, h2cPreface...)
+	client = append(client, h2Frame(h2FrameSettings, 0, 0, nil)...)
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 1, c.request(
+		":method", "POST", ":scheme", "http", ":path", "/helloworld.Greeter/SayHello", ":authority", "grpc.local",
+		"content-type", "application/grpc", "te", "trailers"))...)
+	client = append(client, h2Frame(h2FrameData, h2FlagEndStream, 1, []byte("\x00\x00\x00\x00\x03abc"))...)
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 3, c.request(
+		":method", "GET", ":scheme", "http", ":path", "/status", ":authority", "grpc.local", "cookie", "a=1", "cookie", "b=2"))...)
+
+	// Second response finishes first, and gRPC response ends with trailers
+	server := h2Frame(h2FrameSettings, 0, 0, []byte{0, h2SettingHeaderTableSize, 0, 0, 0x10, 0})
+	server = append(server, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 3, c.response(":status", "200", "content-length", "2"))...)
+	server = append(server, h2Frame(h2FrameData, h2FlagEndStream, 3, []byte("ok"))...)
+	server = append(server, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 1, c.response(":status", "200", "content-type", "application/grpc"))...)
+	server = append(server, h2Frame(h2FrameData, 0, 1, []byte("\x00\x00\x00\x00\x02hi"))...)
+	server = append(server, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, c.response("grpc-status", "0"))...)
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, client).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, 1+uint32(len(client)), 100, server).Dump())
+
+	requests, responses := receiveH2C(t, listener, 4)
+
+	grpcRequest := "POST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: grpc.local\r\nContent-Type: application/grpc\r\nTe: trailers\r\nContent-Length: 8\r\n\r\n\x00\x00\x00\x00\x03abc"
+	grpcResponse := "HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nTransfer-Encoding: chunked\r\n\r\n7\r\n\x00\x00\x00\x00\x02hi\r\n0\r\nGrpc-Status: 0\r\n\r\n"
+	getRequest := "GET /status HTTP/1.1\r\nHost: grpc.local\r\nCookie: a=1; b=2\r\n\r\n"
+	getResponse := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	expected := map[string]string{grpcRequest: grpcResponse, getRequest: getResponse}
+
+	if len(requests) != 2 {
+		t.Fatal("Should emit each stream as separate request", requests)
+	}
+
+	for uuid, req := range requests {
+		resp, ok := expected[req]
+		if !ok {
+			t.Errorf("Unexpected request %q", req)
+		} else if responses[uuid] != resp {
+			t.Errorf("Wrong response of %q: %q", req, responses[uuid])
+		}
+	}
+}
+
+func TestRawListenerH2CFraming(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	c := newH2CConversation()
+	block := c.request(":method", "PUT", ":path", "/a", ":authority", "example.com", "x-long", string(bytes.Repeat([]byte("a"), 100)))
+
+	// Padded HEADERS with priority, continued in CONTINUATION frame, and padded DATA
+	headers := append([]byte{2, 0, 0, 0, 0, 16}, block[:10]...)
+	headers = append(headers, 0, 0)
+
+	client := append([]byte{}, h2cPreface...)
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagPadded|h2FlagPriority, 1, headers)...)
+	client = append(client, h2Frame(h2FrameContinuation, h2FlagEndHeaders, 1, block[10:])...)
+	client = append(client, h2Frame(h2FrameData, h2FlagPadded|h2FlagEndStream, 1, []byte("\x03body\x00\x00\x00"))...)
+	// Second stream reuses headers from HPACK dynamic table
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 3,
+		c.request(":method", "PUT", ":path", "/a", ":authority", "example.com", "x-long", string(bytes.Repeat([]byte("a"), 100))))...)
+
+	// Frames are split between segments at arbitrary positions
+	for i, seq := 0, uint32(1); i < len(client); i += 7 {
+		end := i + 7
+		if end > len(client) {
+			end = len(client)
+		}
+
+		listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, seq, client[i:end]).Dump())
+		seq += uint32(end - i)
+	}
+
+	requests, _ := receiveH2C(t, listener, 2)
+
+	headersBlock := "PUT /a HTTP/1.1\r\nHost: example.com\r\nX-Long: " + string(bytes.Repeat([]byte("a"), 100)) + "\r\n"
+	for _, req := range requests {
+		if req != headersBlock+"Content-Length: 4\r\n\r\nbody" && req != headersBlock+"Content-Length: 0\r\n\r\n" {
+			t.Errorf("Wrong request %q", req)
+		}
+	}
+}
+
+func TestRawListenerH2CMissingSegment(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	c := newH2CConversation()
+
+	client := append([]byte{}, h2cPreface...)
+	client = append(client, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 1, c.request(":method", "POST", ":path", "/a"))...)
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, client).Dump())
+
+	// Segment after the gap can't be decoded, since HPACK state can be changed by the missing one
+	next := h2Frame(h2FrameData, h2FlagEndStream, 1, []byte("body"))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 11+uint32(len(client)), next).Dump())
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Errorf("Should not emit stream with missing data: %q", m.Bytes())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if stats := listener.Stats(); stats.MessagesExpired != 1 {
+		t.Error("Should count discarded stream", stats.MessagesExpired)
+	}
+}
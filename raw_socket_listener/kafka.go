@@ -0,0 +1,449 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// With ProtocolKafka connections to brokers are decoded as Kafka protocol. Each request sent by client is emitted as
+// message describing its API, version and client ID, and topics of Produce and Fetch requests. Responses are matched
+// to requests by correlation ID, Produce requests with acks set to 0 get no response. Connections with missing
+// segments, or data not looking like Kafka protocol, are not decoded anymore.
+
+// Kafka API keys
+const (
+	KafkaProduce = 0
+	KafkaFetch   = 1
+)
+
+// Names of Kafka APIs by key
+var kafkaAPINames = map[int16]string{
+	0: "Produce", 1: "Fetch", 2: "ListOffsets", 3: "Metadata", 8: "OffsetCommit", 9: "OffsetFetch",
+	10: "FindCoordinator", 11: "JoinGroup", 12: "Heartbeat", 13: "LeaveGroup", 14: "SyncGroup", 15: "DescribeGroups",
+	16: "ListGroups", 17: "SaslHandshake", 18: "ApiVersions", 19: "CreateTopics", 20: "DeleteTopics",
+	21: "DeleteRecords", 22: "InitProducerId", 23: "OffsetForLeaderEpoch", 24: "AddPartitionsToTxn",
+	25: "AddOffsetsToTxn", 26: "EndTxn", 28: "TxnOffsetCommit", 29: "DescribeAcls", 30: "CreateAcls",
+	31: "DeleteAcls", 32: "DescribeConfigs", 33: "AlterConfigs", 35: "DescribeLogDirs", 36: "SaslAuthenticate",
+	37: "CreatePartitions", 42: "DeleteGroups", 44: "IncrementalAlterConfigs", 47: "OffsetDelete",
+	60: "DescribeCluster", 61: "DescribeProducers", 65: "DescribeTransactions", 66: "ListTransactions",
+	68: "ConsumerGroupHeartbeat",
+}
+
+// First versions of APIs using flexible encoding: compact strings and arrays, and tagged fields. Request header
+// of flexible versions has tagged fields after client ID.
+var kafkaFlexibleVersions = map[int16]int16{
+	0: 9, 1: 12, 2: 6, 3: 9, 8: 8, 9: 6, 10: 3, 11: 6, 12: 4, 13: 4, 14: 4, 15: 5, 16: 3, 18: 3, 19: 5, 20: 4,
+	21: 2, 22: 2, 23: 4, 24: 3, 25: 3, 26: 3, 28: 3, 29: 2, 30: 2, 31: 2, 32: 4, 33: 2, 35: 2, 36: 2, 37: 2, 42: 2,
+	44: 1, 47: 0, 60: 0, 61: 0, 65: 0, 66: 0, 68: 0,
+}
+
+// Maximum size of request, larger size means data is not Kafka protocol. It is default limit of brokers.
+const kafkaMaxRequestSize = 100 * 1024 * 1024
+
+// Maximum number of requests waiting for response
+const kafkaMaxPending = 1000
+
+// KafkaRequest describes message holding Kafka request, or its response
+type KafkaRequest struct {
+	// API key, like KafkaProduce, and its version
+	APIKey     int16
+	APIVersion int16
+
+	CorrelationID int32
+	ClientID      string
+
+	// Topics of Produce and Fetch requests. Versions referencing topics by ID have hex encoded topic IDs instead.
+	Topics []string
+
+	// Acks of Produce request, broker sends no response if it is 0
+	Acks int16
+}
+
+// Name returns name of the API, like "Produce", or its key for unknown APIs
+func (r *KafkaRequest) Name() string {
+	if name, ok := kafkaAPINames[r.APIKey]; ok {
+		return name
+	}
+
+	return strconv.Itoa(int(r.APIKey))
+}
+
+// kafkaConn holds Kafka decoding state of single connection
+type kafkaConn struct {
+	client, server lengthFramer
+
+	// Requests waiting for response, by correlation ID
+	pending map[int32]*kafkaPending
+
+	// Decoding failed, like because of missing segment, and message boundaries are lost
+	broken bool
+}
+
+type kafkaPending struct {
+	request *TCPMessage
+	info    *KafkaRequest
+}
+
+// feed parses requests and responses of the segment, and emits ones which are complete
+func (c *kafkaConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if gap > 0 {
+		// Message boundaries are unknown after missing data
+		t.breakKafka(c)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	// Request header has API key, version, correlation ID and client ID, response header has correlation ID
+	minSize := 4
+	if isIncoming {
+		minSize = 10
+	}
+	size := func(header []byte) (int, bool) {
+		n := int(int32(binary.BigEndian.Uint32(header)))
+		return n, n >= minSize && n <= kafkaMaxRequestSize
+	}
+	finish := func() bool {
+		return t.finishKafkaMessage(c, isIncoming)
+	}
+	if !d.feed(packet, data, isIncoming, 4, t.kafkaBufferSize(), size, finish) {
+		t.breakKafka(c)
+	}
+}
+
+// kafkaBufferSize returns maximum size of buffered message. Size prefix and header are always kept.
+func (t *shard) kafkaBufferSize() int {
+	if max := t.config.MaxMessageSize; max > 0 && max < 64 {
+		return 64
+	}
+
+	return t.config.MaxMessageSize
+}
+
+// finishKafkaMessage emits request, or response of the request with the same correlation ID. Returns false if
+// request can't be decoded.
+func (t *shard) finishKafkaMessage(c *kafkaConn, isIncoming bool) bool {
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	message, buf, truncated := d.take()
+	message.packets[0].Data = buf
+	message.size = len(buf)
+	message.Truncated = truncated
+	message.End = time.Now()
+
+	if isIncoming {
+		info, ok := decodeKafkaRequest(buf[4:])
+		if !ok {
+			return false
+		}
+
+		// Correlation ID is unique within connection, so it keeps UUIDs distinct
+		message.Ack += uint32(info.CorrelationID)
+		message.Kafka = info
+		t.emit(message)
+
+		noResponse := info.APIKey == KafkaProduce && info.Acks == 0
+		if t.trackResponse && !noResponse && len(c.pending) < kafkaMaxPending {
+			c.pending[info.CorrelationID] = &kafkaPending{request: message, info: info}
+		}
+		return true
+	}
+
+	correlationID := int32(binary.BigEndian.Uint32(buf[4:]))
+	p, ok := c.pending[correlationID]
+	if !ok {
+		return true
+	}
+	delete(c.pending, correlationID)
+
+	message.AssocMessage = p.request
+	message.Kafka = p.info
+
+	t.emit(message)
+
+	return true
+}
+
+// breakKafka stops decoding of connection, messages in progress and responses not received yet are discarded
+func (t *shard) breakKafka(c *kafkaConn) {
+	atomic.AddUint64(&t.stats.messagesExpired, uint64(len(c.pending)))
+	c.pending = make(map[int32]*kafkaPending)
+
+	c.client.reset()
+	c.server.reset()
+
+	c.broken = true
+}
+
+// close discards messages in progress once connection is closed
+func (c *kafkaConn) close(t *shard, stream *tcpStream) {
+	t.breakKafka(c)
+}
+
+// kafkaReader reads fields of Kafka request, failing all reads after data ends
+type kafkaReader struct {
+	data     []byte
+	flexible bool
+	failed   bool
+}
+
+func (r *kafkaReader) skip(n int) {
+	if r.failed || n < 0 || n > len(r.data) {
+		r.failed = true
+		return
+	}
+
+	r.data = r.data[n:]
+}
+
+func (r *kafkaReader) int8() int8 {
+	if r.failed || len(r.data) < 1 {
+		r.failed = true
+		return 0
+	}
+
+	v := int8(r.data[0])
+	r.data = r.data[1:]
+	return v
+}
+
+func (r *kafkaReader) int16() int16 {
+	if r.failed || len(r.data) < 2 {
+		r.failed = true
+		return 0
+	}
+
+	v := int16(binary.BigEndian.Uint16(r.data))
+	r.data = r.data[2:]
+	return v
+}
+
+func (r *kafkaReader) int32() int32 {
+	if r.failed || len(r.data) < 4 {
+		r.failed = true
+		return 0
+	}
+
+	v := int32(binary.BigEndian.Uint32(r.data))
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *kafkaReader) uvarint() int {
+	if r.failed {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 || v > kafkaMaxRequestSize {
+		r.failed = true
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return int(v)
+}
+
+// bytes reads string or bytes field: nullable ones have length -1 if they are null, and compact ones of flexible
+// versions have unsigned varint length increased by one, 0 if they are null
+func (r *kafkaReader) bytes(lengthSize int) []byte {
+	var n int
+
+	switch {
+	case r.flexible:
+		n = r.uvarint() - 1
+	case lengthSize == 2:
+		n = int(r.int16())
+	default:
+		n = int(r.int32())
+	}
+
+	if r.failed || n < 0 {
+		return nil
+	}
+
+	if n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+// arrayLength reads number of array elements, compact arrays of flexible versions have it increased by one
+func (r *kafkaReader) arrayLength() int {
+	if r.flexible {
+		return r.uvarint() - 1
+	}
+
+	return int(r.int32())
+}
+
+// taggedFields skips tagged fields of flexible versions
+func (r *kafkaReader) taggedFields() {
+	if !r.flexible {
+		return
+	}
+
+	for n := r.uvarint(); n > 0 && !r.failed; n-- {
+		r.uvarint()
+		r.skip(r.uvarint())
+	}
+}
+
+// decodeKafkaRequest decodes header of request, and topics of Produce and Fetch requests. Returns false if data is
+// not Kafka request.
+func decodeKafkaRequest(data []byte) (*KafkaRequest, bool) {
+	r := &kafkaReader{data: data}
+
+	info := &KafkaRequest{
+		APIKey:        r.int16(),
+		APIVersion:    r.int16(),
+		CorrelationID: r.int32(),
+	}
+
+	// Client ID is never compact, even in flexible versions
+	info.ClientID = string(r.bytes(2))
+
+	if r.failed || info.APIKey < 0 || info.APIVersion < 0 {
+		return nil, false
+	}
+
+	if v, ok := kafkaFlexibleVersions[info.APIKey]; ok && info.APIVersion >= v {
+		r.flexible = true
+		r.taggedFields()
+	}
+
+	if r.failed {
+		return nil, false
+	}
+
+	switch info.APIKey {
+	case KafkaProduce:
+		info.Topics = decodeKafkaProduce(r, info)
+	case KafkaFetch:
+		info.Topics = decodeKafkaFetch(r, info.APIVersion)
+	}
+
+	return info, true
+}
+
+// kafkaTopic reads topic name, or hex encoded topic ID of versions referencing topics by ID
+func kafkaTopic(r *kafkaReader, byID bool) string {
+	if !byID {
+		return string(r.bytes(2))
+	}
+
+	if len(r.data) < 16 {
+		r.failed = true
+		return ""
+	}
+
+	id := hex.EncodeToString(r.data[:16])
+	r.data = r.data[16:]
+	return id
+}
+
+// decodeKafkaProduce reads acks and topics of Produce request. Topics not complete, like because of truncated
+// request, are not returned.
+func decodeKafkaProduce(r *kafkaReader, info *KafkaRequest) (topics []string) {
+	version := info.APIVersion
+
+	if version >= 3 {
+		// transactional_id
+		r.bytes(2)
+	}
+	info.Acks = r.int16()
+	// timeout_ms
+	r.int32()
+
+	for n := r.arrayLength(); n > 0 && !r.failed; n-- {
+		topic := kafkaTopic(r, version >= 13)
+
+		for p := r.arrayLength(); p > 0 && !r.failed; p-- {
+			// index, and records
+			r.int32()
+			r.bytes(4)
+			r.taggedFields()
+		}
+		r.taggedFields()
+
+		if r.failed {
+			break
+		}
+		topics = append(topics, topic)
+	}
+
+	return topics
+}
+
+// decodeKafkaFetch reads topics of Fetch request
+func decodeKafkaFetch(r *kafkaReader, version int16) (topics []string) {
+	if version <= 14 {
+		// replica_id
+		r.int32()
+	}
+	// max_wait_ms, min_bytes
+	r.skip(8)
+	if version >= 3 {
+		// max_bytes
+		r.int32()
+	}
+	if version >= 4 {
+		// isolation_level
+		r.int8()
+	}
+	if version >= 7 {
+		// session_id, session_epoch
+		r.skip(8)
+	}
+
+	// Partition fields: partition, current_leader_epoch, fetch_offset, last_fetched_epoch, log_start_offset, and
+	// partition_max_bytes
+	partitionSize := 4 + 8 + 4
+	if version >= 9 {
+		partitionSize += 4
+	}
+	if version >= 12 {
+		partitionSize += 4
+	}
+	if version >= 5 {
+		partitionSize += 8
+	}
+
+	for n := r.arrayLength(); n > 0 && !r.failed; n-- {
+		topic := kafkaTopic(r, version >= 13)
+
+		for p := r.arrayLength(); p > 0 && !r.failed; p-- {
+			r.skip(partitionSize)
+			r.taggedFields()
+		}
+		r.taggedFields()
+
+		if r.failed {
+			break
+		}
+		topics = append(topics, topic)
+	}
+
+	return topics
+}
@@ -0,0 +1,102 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func kafkaTestInt16(v int16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	return b
+}
+
+func kafkaTestInt32(v int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return b
+}
+
+func kafkaTestString(s string) []byte {
+	return append(kafkaTestInt16(int16(len(s))), s...)
+}
+
+func kafkaTestCompactString(s string) []byte {
+	// Length is short enough to be single byte varint
+	return append([]byte{byte(len(s) + 1)}, s...)
+}
+
+// kafkaTestMessage prefixes fields with size of message
+func kafkaTestMessage(fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	return append(kafkaTestInt32(int32(len(body))), body...)
+}
+
+func TestRawListenerKafka(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolKafka})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Produce v3: transactional_id, acks, timeout, and topics with partitions holding records
+	produce := kafkaTestMessage(kafkaTestInt16(KafkaProduce), kafkaTestInt16(3), kafkaTestInt32(7), kafkaTestString("app"),
+		kafkaTestInt16(-1), kafkaTestInt16(1), kafkaTestInt32(1000),
+		kafkaTestInt32(2),
+		kafkaTestString("orders"), kafkaTestInt32(1), kafkaTestInt32(0), kafkaTestInt32(3), []byte("abc"),
+		kafkaTestString("events"), kafkaTestInt32(0),
+	)
+	// Size prefix is split between segments
+	c.send(true, produce[:2])
+	c.send(true, produce[2:])
+
+	// Flexible Produce v9 with acks 0 gets no response
+	c.send(true, kafkaTestMessage(kafkaTestInt16(KafkaProduce), kafkaTestInt16(9), kafkaTestInt32(8), kafkaTestString("app"), []byte{0},
+		[]byte{0}, kafkaTestInt16(0), kafkaTestInt32(1000),
+		[]byte{2}, kafkaTestCompactString("logs"), []byte{2}, kafkaTestInt32(0), []byte{4}, []byte("xyz"), []byte{0}, []byte{0},
+		[]byte{0},
+	))
+
+	// Fetch v4: replica_id, max_wait_ms, min_bytes, max_bytes, isolation_level, and topics
+	c.send(true, kafkaTestMessage(kafkaTestInt16(KafkaFetch), kafkaTestInt16(4), kafkaTestInt32(9), kafkaTestString("app"),
+		kafkaTestInt32(-1), kafkaTestInt32(500), kafkaTestInt32(1), kafkaTestInt32(1024), []byte{0},
+		kafkaTestInt32(1), kafkaTestString("orders"), kafkaTestInt32(1), make([]byte, 16),
+	))
+
+	c.send(false, append(kafkaTestMessage(kafkaTestInt32(9), []byte("fetched")), kafkaTestMessage(kafkaTestInt32(7), []byte("produced"))...))
+
+	messages := receiveMessages(t, listener, 5, func(m *TCPMessage) bool { return m.Kafka != nil })
+
+	if m := messages[0]; m.Kafka.Name() != "Produce" || m.Kafka.ClientID != "app" || m.Kafka.Acks != 1 || len(m.Kafka.Topics) != 2 ||
+		m.Kafka.Topics[0] != "orders" || m.Kafka.Topics[1] != "events" || !bytes.Equal(m.Bytes(), produce) {
+		t.Errorf("Should emit Produce request: %q %+v", m.Bytes(), m.Kafka)
+	}
+
+	if m := messages[1]; m.Kafka.APIVersion != 9 || m.Kafka.Acks != 0 || len(m.Kafka.Topics) != 1 || m.Kafka.Topics[0] != "logs" {
+		t.Errorf("Should decode flexible version: %+v", m.Kafka)
+	}
+
+	if m := messages[2]; m.Kafka.Name() != "Fetch" || len(m.Kafka.Topics) != 1 || m.Kafka.Topics[0] != "orders" {
+		t.Errorf("Should emit Fetch request: %+v", m.Kafka)
+	}
+
+	if m := messages[3]; m.IsIncoming || m.AssocMessage != messages[2] || m.Kafka.Name() != "Fetch" {
+		t.Errorf("Should match response by correlation ID: %q %+v", m.Bytes(), m.Kafka)
+	}
+
+	if m := messages[4]; m.AssocMessage != messages[0] {
+		t.Errorf("Should emit Produce response: %q", m.Bytes())
+	}
+}
+
+func TestRawListenerKafkaNotKafka(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolKafka})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	c.send(true, []byte("GET / HTTP/1.1\r\n\r\n"))
+
+	receiveMessages(t, listener, 0, func(m *TCPMessage) bool { return m.Kafka != nil })
+}
@@ -0,0 +1,200 @@
+package rawSocket
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Maximum number of requests per connection waiting for responses, or responses waiting for requests.
+// Older messages are forgotten.
+const maxPendingRequests = 64
+
+// trackRequest remembers request waiting for response, see responseRequest
+func (t *shard) trackRequest(stream *tcpStream, request *TCPMessage) {
+	if len(stream.pendingRequests) >= maxPendingRequests {
+		stream.pendingRequests = stream.pendingRequests[1:]
+	}
+
+	stream.pendingRequests = append(stream.pendingRequests, request)
+}
+
+// forgetRequest removes discarded request from requests waiting for responses
+func (t *shard) forgetRequest(stream *tcpStream, request *TCPMessage) {
+	for i, req := range stream.pendingRequests {
+		if req == request {
+			stream.pendingRequests = append(stream.pendingRequests[:i], stream.pendingRequests[i+1:]...)
+			return
+		}
+	}
+}
+
+// trackOrphanResponse remembers response captured before its request, see waitingResponse
+func (t *shard) trackOrphanResponse(stream *tcpStream, response *TCPMessage) {
+	if len(stream.pendingResponses) >= maxPendingRequests {
+		t.dropResponses(stream.pendingResponses[:1])
+		stream.pendingResponses = stream.pendingResponses[1:]
+	}
+
+	stream.pendingResponses = append(stream.pendingResponses, response)
+}
+
+// parkResponse removes complete response without request from messages, when next response of the connection
+// shares its Ack, like pipelined one. Response waits for request in stream.pendingResponses.
+func (t *shard) parkResponse(response *TCPMessage) {
+	t.deleteMessage(response)
+	response.parked = true
+}
+
+// dispatchResponse dispatches response associated with request, if it is finished
+func (t *shard) dispatchResponse(response *TCPMessage) {
+	if response.parked {
+		response.parked = false
+		t.emit(response)
+	} else if response.IsFinished() {
+		t.dispatchMessage(response)
+	}
+}
+
+// dropResponses discards parked responses, which requests were not captured
+func (t *shard) dropResponses(responses []*TCPMessage) {
+	for _, resp := range responses {
+		if resp.parked {
+			resp.parked = false
+			resp.release()
+			atomic.AddUint64(&t.stats.messagesExpired, 1)
+		}
+	}
+}
+
+// forgetResponse removes response from responses waiting for requests
+func (t *shard) forgetResponse(stream *tcpStream, response *TCPMessage) {
+	for i, resp := range stream.pendingResponses {
+		if resp == response {
+			stream.pendingResponses = append(stream.pendingResponses[:i], stream.pendingResponses[i+1:]...)
+			return
+		}
+	}
+}
+
+// waitingResponse finds response of the request, which was captured before the request, and associates them.
+//
+// Response which Ack matches the end of request is preferred. Otherwise, as responses are sent in order of requests,
+// request gets the oldest waiting response which either acknowledges the end of request, or starts at the request Ack:
+// responses to pipelined requests share Ack, which is the end of the last request.
+func (t *shard) waitingResponse(stream *tcpStream, request *TCPMessage) *TCPMessage {
+	var response *TCPMessage
+
+	for _, resp := range stream.pendingResponses {
+		if resp.AssocMessage == nil && resp.Ack == request.ResponseAck && t.messages[resp.ID()] == resp {
+			response = resp
+			t.forgetResponse(stream, resp)
+			break
+		}
+	}
+
+	if response == nil {
+		for i, resp := range stream.pendingResponses {
+			if resp.AssocMessage == nil && (resp.Ack == request.ResponseAck || resp.Seq == request.Ack) {
+				response = resp
+				// Older responses belong to requests which were not captured
+				t.dropResponses(stream.pendingResponses[:i])
+				stream.pendingResponses = stream.pendingResponses[i+1:]
+				break
+			}
+		}
+	}
+
+	if response != nil {
+		response.AssocMessage = request
+		request.AssocMessage = response
+		t.forgetRequest(stream, request)
+	}
+
+	return response
+}
+
+// responseRequest finds request of connection, response starting with the packet belongs to.
+//
+// HTTP/1.1 responses are sent in order of requests, so response belongs to the oldest request without response,
+// which was received before response was sent, as response acknowledges it. Response should acknowledge
+// the end of one of requests, otherwise its request was not captured. If client pipelines requests,
+// response can acknowledge multiple of them. Request sent when previous response was received, has Ack equal
+// to Seq of the next response, and is preferred: requests which responses were not captured are skipped.
+// Falls back to matching response Ack with the end of request.
+func (t *shard) responseRequest(stream *tcpStream, packet *TCPPacket) *TCPMessage {
+	// Interim responses, like `100 Continue`, are followed by the final one
+	if !bytes.HasPrefix(packet.Data, bHTTP) || len(packet.Data) < 10 || packet.Data[9] == '1' {
+		return t.aliasedRequest(stream, packet)
+	}
+
+	match, exact, acknowledged := -1, false, false
+	for i, req := range stream.pendingRequests {
+		// Request sent after response
+		if seqLess(packet.Ack, req.ResponseAck) {
+			break
+		}
+
+		if match == -1 || (!exact && req.Ack == packet.Seq) {
+			match, exact = i, req.Ack == packet.Seq
+		}
+
+		if req.ResponseAck == packet.Ack {
+			acknowledged = true
+		}
+	}
+
+	// Response acknowledges data which is not part of known requests, its request was not captured
+	if match == -1 || !acknowledged {
+		return t.aliasedRequest(stream, packet)
+	}
+
+	request := stream.pendingRequests[match]
+	stream.pendingRequests = stream.pendingRequests[match+1:]
+
+	return request
+}
+
+// aliasedRequest finds request which ends at response Ack
+func (t *shard) aliasedRequest(stream *tcpStream, packet *TCPPacket) *TCPMessage {
+	request := stream.requestEndingAt(packet.Ack)
+	if request != nil {
+		t.forgetRequest(stream, request)
+	}
+
+	return request
+}
+
+// requestEndingAt finds request of connection being assembled, which ends right before given sequence number
+func (s *tcpStream) requestEndingAt(seq uint32) *TCPMessage {
+	for _, m := range s.messages {
+		if m.IsIncoming && m.ResponseAck == seq {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// isHeadResponse checks if n-th of the following responses responds to HEAD request
+func (t *tcpStream) isHeadResponse(n int) bool {
+	return n < len(t.pendingRequests) && isHeadRequest(t.pendingRequests[n])
+}
+
+// isNextMessage checks if packet starts new message of keep-alive connection, right after the end of complete message.
+// Sequential messages can share Ack, like pipelined requests, or responses to them.
+func (t *TCPMessage) isNextMessage(packet *TCPPacket) bool {
+	last := t.packets[len(t.packets)-1]
+	if packet.Seq != last.nextSeq() || t.Truncated {
+		return false
+	}
+
+	if t.IsIncoming {
+		if !isRequestStart(packet.Data) || !isRequestStart(t.packets[0].Data) {
+			return false
+		}
+	} else if !bytes.HasPrefix(packet.Data, bHTTP) || !bytes.HasPrefix(t.packets[0].Data, bHTTP) {
+		return false
+	}
+
+	return t.isComplete()
+}
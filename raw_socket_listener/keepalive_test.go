@@ -0,0 +1,158 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// receiveExchanges reads requests and responses, and returns response bodies by request paths
+func receiveExchanges(t *testing.T, listener *Listener, count int) map[string]string {
+	requests := make(map[string]string)
+	responses := make(map[string]string)
+
+	for i := 0; i < count; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				requests[string(m.UUID())] = string(proto.Path(m.Bytes()))
+			} else {
+				responses[string(m.UUID())] = string(proto.Body(m.Bytes()))
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should dispatch messages without waiting for expire", i)
+		}
+	}
+
+	exchanges := make(map[string]string)
+	for uuid, path := range requests {
+		exchanges[path] = responses[uuid]
+	}
+
+	return exchanges
+}
+
+func TestRawListenerPipelinedRequests(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	req1 := []byte("GET /1 HTTP/1.1\r\n\r\n")
+	req2 := []byte("GET /2 HTTP/1.1\r\n\r\n")
+	resp1 := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1")
+	resp2 := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n2")
+
+	// Requests sent one after another, before responses: both share Ack, and responses acknowledge both of them
+	reqEnd := 1 + uint32(len(req1)+len(req2))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, req1).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1+uint32(len(req1)), req2).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100, resp1).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100+uint32(len(resp1)), resp2).Dump())
+
+	exchanges := receiveExchanges(t, listener, 4)
+	if exchanges["/1"] != "1" || exchanges["/2"] != "2" {
+		t.Error("Should associate responses with requests in order", exchanges)
+	}
+}
+
+func TestRawListenerKeepAliveMissingResponse(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	req1 := []byte("GET /1 HTTP/1.1\r\n\r\n")
+	req2 := []byte("GET /2 HTTP/1.1\r\n\r\n")
+	resp2 := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n2")
+
+	// Response to the first request was not captured, second request acknowledges it
+	req2Seq := 1 + uint32(len(req1))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, req1).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 150, req2Seq, req2).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, req2Seq+uint32(len(req2)), 150, resp2).Dump())
+
+	exchanges := receiveExchanges(t, listener, 2)
+	if exchanges["/2"] != "2" {
+		t.Error("Should skip request without response", exchanges)
+	}
+}
+
+func TestRawListenerPipelinedResponsesFirst(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	req1 := []byte("GET /1 HTTP/1.1\r\n\r\n")
+	req2 := []byte("GET /2 HTTP/1.1\r\n\r\n")
+	resp1 := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1")
+	resp2 := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n2")
+
+	// Responses captured before requests
+	reqEnd := 1 + uint32(len(req1)+len(req2))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100, resp1).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100+uint32(len(resp1)), resp2).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, req1).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1+uint32(len(req1)), req2).Dump())
+
+	exchanges := receiveExchanges(t, listener, 4)
+	if exchanges["/1"] != "1" || exchanges["/2"] != "2" {
+		t.Error("Should associate responses with requests in order", exchanges)
+	}
+}
+
+func TestRawListenerPipelinedCoalesced(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	reqs := []byte("GET /1 HTTP/1.1\r\n\r\nGET /2 HTTP/1.1\r\n\r\nGET /3 HTTP/1.1\r\n\r\n")
+	resps := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n2" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n3")
+
+	// All requests and responses are sent in single segments
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, reqs).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, 1+uint32(len(reqs)), 100, resps).Dump())
+
+	exchanges := receiveExchanges(t, listener, 6)
+	if exchanges["/1"] != "1" || exchanges["/2"] != "2" || exchanges["/3"] != "3" {
+		t.Error("Should associate responses with requests in order", exchanges)
+	}
+}
+
+func TestRawListenerBodylessResponses(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	reqs := []byte("HEAD /1 HTTP/1.1\r\n\r\nGET /2 HTTP/1.1\r\n\r\nGET /3 HTTP/1.1\r\n\r\n")
+	// Responses have Content-Length, but no body
+	resp1 := []byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n")
+	resp2 := []byte("HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n")
+	resp3 := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n3")
+
+	reqEnd := 1 + uint32(len(reqs))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, reqs).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100, append(resp1, resp2...)).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100+uint32(len(resp1)+len(resp2)), resp3).Dump())
+
+	exchanges := receiveExchanges(t, listener, 6)
+	if exchanges["/1"] != "" || exchanges["/2"] != "" || exchanges["/3"] != "3" {
+		t.Error("Should finish responses without body after headers", exchanges)
+	}
+}
+
+func TestRawListenerChunkedTrailers(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	reqs := []byte("GET /1 HTTP/1.1\r\n\r\nGET /2 HTTP/1.1\r\n\r\n")
+	// Trailers of the first response are sent in separate segment, together with the next response
+	resp1 := []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1\r\n1\r\n0\r\n")
+	resp2 := []byte("Grpc-Status: 0\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n2")
+
+	reqEnd := 1 + uint32(len(reqs))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, reqs).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100, resp1).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, reqEnd, 100+uint32(len(resp1)), resp2).Dump())
+
+	exchanges := receiveExchanges(t, listener, 4)
+	if exchanges["/1"] != "1\r\n1\r\n0\r\nGrpc-Status: 0\r\n\r\n" || exchanges["/2"] != "2" {
+		t.Errorf("Should include trailers into chunked response %q", exchanges)
+	}
+}
@@ -0,0 +1,262 @@
+package rawSocket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// Credentials of the pod service account, when running inside cluster
+var kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Routing table used to find host interfaces of pods
+var procNetRoute = "/proc/net/route"
+
+// How often list of pods is refreshed, if ListenerConfig.KubernetesRefresh is not set
+const defaultKubernetesRefresh = 10 * time.Second
+
+// kubernetesClient lists pods using Kubernetes API
+type kubernetesClient struct {
+	api    string
+	client *http.Client
+}
+
+func newKubernetesClient(api string) (*kubernetesClient, error) {
+	c := &kubernetesClient{api: api, client: &http.Client{Timeout: 10 * time.Second}}
+
+	if c.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("Kubernetes API address is unknown: KUBERNETES_SERVICE_HOST is not set, Gor is not running inside cluster")
+		}
+
+		c.api = "https://" + net.JoinHostPort(host, port)
+	}
+
+	if ca, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt")); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	return c, nil
+}
+
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			PodIP  string `json:"podIP"`
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// podIPs returns IPs of running pods matching label selector, scheduled on the given node
+func (c *kubernetesClient) podIPs(namespace, selector, node string) (ips []net.IP, err error) {
+	path := "/api/v1/pods"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	}
+
+	fields := "status.phase=Running"
+	if node != "" {
+		fields += ",spec.nodeName=" + node
+	}
+
+	query := url.Values{"labelSelector": {selector}, "fieldSelector": {fields}}
+
+	req, err := http.NewRequest("GET", c.api+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Token is re-read on each request, because projected tokens are rotated
+	if token, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "token")); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Kubernetes API error: %s %s", resp.Status, body)
+	}
+
+	var pods kubernetesPodList
+	if err = json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, err
+	}
+
+	for _, pod := range pods.Items {
+		addrs := []string{pod.Status.PodIP}
+		for _, ip := range pod.Status.PodIPs {
+			addrs = append(addrs, ip.IP)
+		}
+
+		seen := make(map[string]bool)
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil && !seen[a] {
+				ips = append(ips, ip)
+				seen[a] = true
+			}
+		}
+	}
+
+	return ips, nil
+}
+
+type route struct {
+	iface string
+	dst   *net.IPNet
+}
+
+// readRoutes parses IPv4 routing table from /proc/net/route
+func readRoutes() (routes []route, err error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+
+		dst, err1 := hex.DecodeString(fields[1])
+		mask, err2 := hex.DecodeString(fields[7])
+		if err1 != nil || err2 != nil || len(dst) != 4 || len(mask) != 4 {
+			continue
+		}
+
+		// Addresses are in host byte order
+		ip, m := make(net.IP, 4), make(net.IPMask, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(dst))
+		binary.BigEndian.PutUint32(m, binary.LittleEndian.Uint32(mask))
+
+		routes = append(routes, route{fields[0], &net.IPNet{IP: ip, Mask: m}})
+	}
+
+	return routes, scanner.Err()
+}
+
+// routeInterface returns interface used to reach given IP, using longest prefix match.
+// Depending on CNI plugin it is either host side of pod veth pair, or bridge.
+// If route is not found, like for IPv6 pods, "any" interface is used.
+func routeInterface(routes []route, ip net.IP) string {
+	iface, best := "any", -1
+
+	for _, r := range routes {
+		if ones, _ := r.dst.Mask.Size(); ones > best && r.dst.Contains(ip) {
+			iface, best = r.iface, ones
+		}
+	}
+
+	return iface
+}
+
+// kubernetesDevices resolves pods to capture, and groups their IPs by host interface
+func (t *Listener) kubernetesDevices(client *kubernetesClient) (map[string]pcap.Interface, error) {
+	ips, err := client.podIPs(t.config.KubernetesNamespace, t.config.KubernetesSelector, t.config.KubernetesNode)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := readRoutes()
+	if err != nil {
+		log.Println("Can't read routing table, capturing pods on 'any' interface:", err)
+	}
+
+	devices := make(map[string]pcap.Interface)
+	for _, ip := range ips {
+		name := routeInterface(routes, ip)
+
+		device := devices[name]
+		device.Name = name
+		device.Addresses = append(device.Addresses, pcap.InterfaceAddress{IP: ip})
+		devices[name] = device
+	}
+
+	return devices, nil
+}
+
+// readKubernetes captures traffic of pods matching ListenerConfig.KubernetesSelector.
+// Pods are re-discovered periodically, and capture follows them as they are rescheduled.
+func (t *Listener) readKubernetes() error {
+	if t.config.KubernetesNode == "" {
+		t.config.KubernetesNode = os.Getenv("NODE_NAME")
+	}
+
+	if t.config.KubernetesRefresh == 0 {
+		t.config.KubernetesRefresh = defaultKubernetesRefresh
+	}
+
+	client, err := newKubernetesClient(t.config.KubernetesAPI)
+	if err != nil {
+		return err
+	}
+
+	devices, err := t.kubernetesDevices(client)
+	if err != nil {
+		return err
+	}
+
+	if len(devices) == 0 {
+		log.Println("No running pods match selector", t.config.KubernetesSelector, "waiting for them to appear")
+	}
+
+	t.syncPcapDevices(devices)
+
+	go func() {
+		ticker := time.NewTicker(t.config.KubernetesRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if devices, err := t.kubernetesDevices(client); err != nil {
+				log.Println("Can't discover Kubernetes pods:", err)
+			} else {
+				t.syncPcapDevices(devices)
+			}
+		}
+	}()
+
+	t.readyCh <- true
+
+	return nil
+}
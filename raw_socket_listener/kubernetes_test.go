@@ -0,0 +1,127 @@
+package rawSocket
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const kubernetesPods = `{"items": [
+	{"metadata": {"name": "web-1"}, "status": {"podIP": "10.244.1.5", "podIPs": [{"ip": "10.244.1.5"}, {"ip": "fd00::5"}]}},
+	{"metadata": {"name": "web-2"}, "status": {"podIP": "10.244.1.6"}},
+	{"metadata": {"name": "web-3"}, "status": {"podIP": "192.168.5.10"}}
+]}`
+
+// Iface Destination Gateway Flags RefCnt Use Metric Mask
+const procRoutes = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0
+eth0	0005A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+cni0	0001F40A	00000000	0001	0	0	0	00FFFFFF	0	0	0
+cali1	0501F40A	00000000	0005	0	0	0	FFFFFFFF	0	0	0
+`
+
+func TestKubernetesPodIPs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_k8s")
+	defer os.RemoveAll(dir)
+
+	defer func(d string) { kubernetesServiceAccountDir = d }(kubernetesServiceAccountDir)
+	kubernetesServiceAccountDir = dir
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0644)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/prod/pods" {
+			t.Error("Wrong path", r.URL.Path)
+		}
+
+		if r.URL.Query().Get("labelSelector") != "app=web" || r.URL.Query().Get("fieldSelector") != "status.phase=Running,spec.nodeName=node-1" {
+			t.Error("Wrong query", r.URL.RawQuery)
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Error("Should authorize with service account token", r.Header.Get("Authorization"))
+		}
+
+		w.Write([]byte(kubernetesPods))
+	}))
+	defer server.Close()
+
+	client, _ := newKubernetesClient(server.URL)
+
+	ips, err := client.podIPs("prod", "app=web", "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.244.1.5", "fd00::5", "10.244.1.6", "192.168.5.10"}
+	if len(ips) != len(expected) {
+		t.Fatal("Wrong pod IPs", ips)
+	}
+
+	for i, ip := range ips {
+		if ip.String() != expected[i] {
+			t.Error("Wrong pod IP", i, ip)
+		}
+	}
+}
+
+func TestKubernetesDevices(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_k8s")
+	defer os.RemoveAll(dir)
+
+	defer func(d, r string) { kubernetesServiceAccountDir, procNetRoute = d, r }(kubernetesServiceAccountDir, procNetRoute)
+	kubernetesServiceAccountDir = dir
+	procNetRoute = filepath.Join(dir, "route")
+	ioutil.WriteFile(procNetRoute, []byte(procRoutes), 0644)
+
+	routes, err := readRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, iface := range map[string]string{
+		"10.244.1.5":   "cali1",
+		"10.244.1.6":   "cni0",
+		"192.168.5.10": "eth0",
+		"8.8.8.8":      "eth0",
+		"fd00::5":      "any",
+	} {
+		if found := routeInterface(routes, net.ParseIP(ip)); found != iface {
+			t.Error("Wrong route interface", ip, found, iface)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(kubernetesPods))
+	}))
+	defer server.Close()
+
+	client, _ := newKubernetesClient(server.URL)
+
+	l := &Listener{config: &ListenerConfig{KubernetesSelector: "app=web"}}
+	devices, err := l.kubernetesDevices(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"cali1": "10.244.1.5", "cni0": "10.244.1.6", "eth0": "192.168.5.10", "any": "fd00::5"}
+	if len(devices) != len(expected) {
+		t.Fatal("Wrong devices", devices)
+	}
+
+	for name, addrs := range expected {
+		if device := devices[name]; device.Name != name || deviceAddrs(device) != addrs {
+			t.Error("Wrong device", name, device)
+		}
+	}
+}
+
+func TestKubernetesRequiresPcap(t *testing.T) {
+	_, err := NewListener("", "80", EngineRawSocket, true, 0, &ListenerConfig{KubernetesSelector: "app=web"})
+	if err == nil {
+		t.Error("Should support Kubernetes mode only with pcap engine")
+	}
+}
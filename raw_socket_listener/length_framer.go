@@ -0,0 +1,100 @@
+package rawSocket
+
+// lengthFramer splits data sent by one side of connection into messages starting with header which holds their
+// size, like MongoDB and Kafka messages
+type lengthFramer struct {
+	streamPosition
+
+	// Not complete header, and bytes of the message left to receive
+	header    []byte
+	remaining int
+
+	// Message being received, and its bytes, without ones beyond maximum message size
+	message   *TCPMessage
+	buf       []byte
+	truncated bool
+}
+
+// feed adds data of the segment to messages, and calls finish once message is complete. Header of headerSize bytes
+// is passed to size, which validates it and returns number of message bytes following it. Message bytes beyond
+// maxSize are discarded, 0 means no limit.
+// Returns false if header is not valid, or finish failed to decode message: message boundaries are lost then.
+func (f *lengthFramer) feed(packet *TCPPacket, data []byte, isIncoming bool, headerSize, maxSize int, size func(header []byte) (int, bool), finish func() bool) bool {
+	for len(data) > 0 {
+		if f.message == nil {
+			f.message = NewTCPMessage(packet.Seq, packet.Ack, isIncoming)
+			f.message.packets = []*TCPPacket{packet.headerCopy()}
+		}
+		f.message.updateCaptureTime(packet.Timestamp)
+
+		if f.remaining == 0 {
+			n := headerSize - len(f.header)
+			if n > len(data) {
+				n = len(data)
+			}
+
+			f.header = append(f.header, data[:n]...)
+			data = data[n:]
+			if len(f.header) < headerSize {
+				return true
+			}
+
+			remaining, ok := size(f.header)
+			if !ok {
+				return false
+			}
+
+			f.appendRaw(f.header, maxSize)
+			f.header = f.header[:0]
+			f.remaining = remaining
+
+			if f.remaining == 0 {
+				if !finish() {
+					return false
+				}
+				continue
+			}
+		}
+
+		n := f.remaining
+		if n > len(data) {
+			n = len(data)
+		}
+
+		f.appendRaw(data[:n], maxSize)
+		f.remaining -= n
+		data = data[n:]
+
+		if f.remaining == 0 && !finish() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// appendRaw adds message bytes, discarding ones beyond maximum size
+func (f *lengthFramer) appendRaw(data []byte, maxSize int) {
+	if maxSize > 0 && len(f.buf)+len(data) > maxSize {
+		f.truncated = true
+		if len(f.buf) >= maxSize {
+			return
+		}
+		data = data[:maxSize-len(f.buf)]
+	}
+
+	f.buf = append(f.buf, data...)
+}
+
+// take returns complete message and its bytes, and clears them for the next message
+func (f *lengthFramer) take() (message *TCPMessage, buf []byte, truncated bool) {
+	message, buf, truncated = f.message, f.buf, f.truncated
+	f.message, f.buf, f.truncated = nil, nil, false
+
+	return
+}
+
+// reset discards message in progress, once decoding of connection stops
+func (f *lengthFramer) reset() {
+	f.header, f.message, f.buf = nil, nil, nil
+}
@@ -0,0 +1,50 @@
+package rawSocket
+
+import (
+	"testing"
+)
+
+func TestLengthFramer(t *testing.T) {
+	var f lengthFramer
+	var messages []string
+
+	// One byte header holds size of the following bytes, 0xff is not valid size
+	size := func(header []byte) (int, bool) {
+		return int(header[0]), header[0] != 0xff
+	}
+	finish := func() bool {
+		_, buf, truncated := f.take()
+		if truncated {
+			buf = append(buf, '~')
+		}
+		messages = append(messages, string(buf))
+		return len(buf) < 2 || buf[1] != '!'
+	}
+	feed := func(data string) bool {
+		return f.feed(buildPacket(true, 1, 1, []byte(data)), []byte(data), true, 1, 4, size, finish)
+	}
+
+	// Messages are split between segments, or share one
+	if !feed("\x02a") || !feed("b\x00\x05cd") || !feed("efg") {
+		t.Fatal("Messages should be valid")
+	}
+
+	expected := []string{"\x02ab", "\x00", "\x05cde~"}
+	if len(messages) != len(expected) {
+		t.Fatalf("Wrong messages: %q", messages)
+	}
+	for i, m := range expected {
+		if messages[i] != m {
+			t.Errorf("Wrong message %d: %q", i, messages[i])
+		}
+	}
+
+	if feed("\xff") {
+		t.Error("Should fail on header which is not valid")
+	}
+
+	f.reset()
+	if feed("\x01!") || f.message != nil {
+		t.Error("Should fail once message can't be decoded")
+	}
+}
@@ -0,0 +1,40 @@
+package rawSocket
+
+import (
+	"sync/atomic"
+)
+
+// addPacket adds packet to the message, accounting its size in total size of buffered messages, and its time in expiry queue
+func (t *shard) addPacket(message *TCPMessage, packet *TCPPacket) {
+	size := message.size
+	message.AddPacket(packet)
+	t.bufferedBytes += message.size - size
+	t.updateExpiry(message)
+}
+
+// overLimits checks if messages being assembled exceed ListenerConfig.MaxMessages or ListenerConfig.MaxBufferedBytes
+func (t *shard) overLimits() bool {
+	if t.maxMessages > 0 && len(t.messages) > t.maxMessages {
+		return true
+	}
+
+	return t.maxBufferedBytes > 0 && t.bufferedBytes > t.maxBufferedBytes
+}
+
+// evictMessages discards least recently active unfinished messages until they fit the limits, taking them from
+// the expiry queue. Prevents memory exhaustion when lots of connections never finish their messages, like slow-loris clients.
+func (t *shard) evictMessages() {
+	for len(t.expiry) > 0 && t.overLimits() {
+		oldest := t.expiry[0]
+
+		t.deleteMessage(oldest)
+		if oldest.IsIncoming {
+			t.forgetRequest(oldest.stream, oldest)
+		} else {
+			t.forgetResponse(oldest.stream, oldest)
+		}
+
+		oldest.release()
+		atomic.AddUint64(&t.stats.messagesEvicted, 1)
+	}
+}
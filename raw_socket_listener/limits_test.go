@@ -0,0 +1,66 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRawListenerMaxMessages(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Second, &ListenerConfig{MaxMessages: 2})
+	defer listener.Close()
+
+	// Requests waiting for the body which never comes
+	for port := uint16(1); port <= 3; port++ {
+		listener.packetsChan <- newPacketBuffer(buildConnPacket(true, port, 0, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n")).Dump())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	stats := listener.Stats()
+	if stats.MessagesEvicted != 1 {
+		t.Error("Should evict oldest message", stats.MessagesEvicted)
+	}
+
+	if stats.MessagesInFlight != 2 {
+		t.Error("Should keep limited number of messages", stats.MessagesInFlight)
+	}
+}
+
+func TestRawListenerMaxBufferedBytes(t *testing.T) {
+	data := []byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n")
+
+	listener, _ := NewListener("", "0", engineTest, true, time.Second, &ListenerConfig{MaxBufferedBytes: 2*len(data) + 1})
+	defer listener.Close()
+
+	for port := uint16(1); port <= 2; port++ {
+		listener.packetsChan <- newPacketBuffer(buildConnPacket(true, port, 0, 1, 1, data).Dump())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if stats := listener.Stats(); stats.MessagesEvicted != 0 {
+		t.Error("Messages fit the limit", stats.MessagesEvicted)
+	}
+
+	// Body growing over the limit
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 2, 0, 1, 1+uint32(len(data)), []byte("12")).Dump())
+
+	time.Sleep(10 * time.Millisecond)
+
+	stats := listener.Stats()
+	if stats.MessagesEvicted != 1 || stats.MessagesInFlight != 1 {
+		t.Error("Should evict oldest message", stats.MessagesEvicted, stats.MessagesInFlight)
+	}
+
+	// Message which got the last packet is kept, and dispatched once it expires
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 2, 0, 1, 3+uint32(len(data)), []byte("34567890")).Dump())
+
+	select {
+	case m := <-listener.messagesChan:
+		if port := m.packets[0].SrcPort; port != 2 {
+			t.Error("Should finish message of active connection", port)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Should finish message of active connection")
+	}
+}
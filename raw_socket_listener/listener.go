@@ -14,19 +14,17 @@ package rawSocket
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"io"
 	"log"
 	"net"
 	"runtime"
 	"runtime/debug"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,42 +32,78 @@ var _ = fmt.Println
 
 // Listener handle traffic capture
 type Listener struct {
-	mu sync.Mutex
-	// buffer of TCPMessages waiting to be send
-	// ID -> TCPMessage
-	messages map[tcpID]*TCPMessage
-
-	// Expect: 100-continue request is send in 2 tcp messages
-	// We store ACK aliases to merge this packets together
-	ackAliases map[uint32]uint32
-	// To get ACK of second message we need to compute its Seq and wait for them message
-	seqWithData map[uint32]uint32
+	// Keep counters first, to guarantee 64bit alignment required by atomic
+	stats listenerCounters
 
-	// Ack -> Req
-	respAliases map[uint32]*TCPMessage
+	mu sync.Mutex
 
-	// Ack -> ID
-	respWithoutReq map[uint32]tcpID
+	// Reassembly state, partitioned by connection
+	shards []*shard
 
-	// Messages ready to be send to client
-	packetsChan chan []byte
+	// Captured packets waiting for processing
+	packetsChan chan *packetBuffer
+	// Pools of captured packets buffers
+	buffers *packetBuffers
 
 	// Messages ready to be send to client
 	messagesChan chan *TCPMessage
+	// Used instead of messagesChan if messages are dispatched in batches
+	batchesChan chan []*TCPMessage
+
+	addr    string      // IP to listen
+	ports   []portRange // Ports to listen
+	anyPort bool        // Listen on all TCP ports
+
+	// Parsed ListenerConfig.AllowClients and ListenerConfig.DenyClients
+	allowClients, denyClients []*net.IPNet
+
+	// Network namespace capture devices are opened in, see ListenerConfig.Container
+	netns string
+
+	// Current BPF filter customization, see ListenerConfig.BPFFilter and SetFilter. Guarded by mu.
+	bpfFilter string
 
-	addr string // IP to listen
-	port uint16 // Port to listen
+	// Set to 1 while capture is paused, see Pause
+	paused int32
+
+	// Local ports of sockets owned by ListenerConfig.PID or ListenerConfig.Cgroup: map[uint16]bool
+	processPorts atomic.Value
 
 	trackResponse bool
 	messageExpire time.Duration
 
+	// Capture UDP datagrams instead of TCP segments
+	udp bool
+	// Creates decoder of connections captured with protocol other than HTTP, see streamDecoders
+	newDecoder func(stream *tcpStream) streamDecoder
+
+	// Server keys and secrets used to decrypt TLS sessions, see ListenerConfig.TLSKey
+	tlsKeys *tlsKeys
+
+	config *ListenerConfig
+
 	conn        net.PacketConn
-	pcapHandles []*pcap.Handle
+	pcapHandles []*pcapHandle
+	// Devices captured by pcap engine
+	pcapDevices map[string]*pcapCapture
+	afpackets   afpacketSockets
 
-	quit    chan bool
+	unixListener net.Listener
+
+	// BPF objects of uprobe engine, closed by goroutine reading its events
+	uprobes *uprobeCapture
+
+	ctx     context.Context
+	cancel  context.CancelFunc
 	readyCh chan bool
 }
 
+// pcapHandle is open pcap handle of the device
+type pcapHandle struct {
+	*pcap.Handle
+	device pcap.Interface
+}
+
 type request struct {
 	id    tcpID
 	start time.Time
@@ -80,27 +114,269 @@ type request struct {
 const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
+	// Linux only: multiple AF_PACKET sockets per device, joined into PACKET_FANOUT group
+	EngineAFPacket
+	// Proxy in front of unix domain socket, address is in "proxy.sock:upstream.sock" format
+	EngineUnixProxy
+	// Linux amd64 only: uprobes attached to OpenSSL and Go crypto/tls functions capture plaintext of TLS connections
+	EngineUprobe
+	// Packets are read from .pcap or .pcapng file, address is path of the file
+	EnginePcapFile
+
+	// Used in tests: no traffic capture started, packets written directly to packetsChan
+	engineTest
+)
+
+// EngineInject starts no traffic capture, packets are passed using Listener.Inject, for example by load generator
+const EngineInject = engineTest
+
+// Default maximum size of captured packet
+const defaultSnapLen = 65536
+
+// Default size of packets and messages buffers
+const defaultBufferSize = 10000
+
+// Policies applied when packets or messages buffer is full
+const (
+	// Wait until there is free space, may cause kernel drops if pcap reader stalls
+	BackpressureBlock = "block"
+	// Discard oldest item in the buffer to free space for the new one
+	BackpressureDropOldest = "drop-oldest"
+	// Discard new item
+	BackpressureDropNewest = "drop-newest"
 )
 
+// ListenerConfig holds optional Listener settings
+type ListenerConfig struct {
+	// Transport protocol to capture: ProtocolTCP (default), ProtocolUDP, ProtocolRawTCP to capture TCP
+	// connections of any application protocol, ProtocolMySQL, ProtocolPostgres, ProtocolRedis,
+	// ProtocolMemcached, ProtocolMongo, ProtocolKafka, or ProtocolThrift
+	Protocol string
+
+	// Handling of password messages of PostgreSQL connections: PostgresAuthStrip (default) removes them,
+	// PostgresAuthKeep keeps them as captured, and PostgresAuthReplace replaces them with ones holding PostgresPassword
+	PostgresAuth     string
+	PostgresPassword string
+
+	// Documents of MongoDB messages larger than this size are replaced by {"$redacted": <size>} document, for
+	// example to avoid recording large user data. Commands themselves are kept. Disabled if 0.
+	MongoRedactSize int
+
+	// Unwrap GRE (including ERSPAN), VXLAN or Geneve tunnels, and process inner TCP segments
+	// as if they were captured directly. Supported only by pcap engine.
+	Decapsulate bool
+
+	// Customize pcap filter: expression starting with "and" or "or" gets appended to
+	// the auto-generated filter, like "and not src net 10.0.0.0/8", any other expression replaces it.
+	BPFFilter string
+
+	// Capture only traffic of clients matching one of given CIDRs or IPs, like "10.0.0.0/8".
+	// With pcap engines lists are added to the BPF filter, otherwise checked for each packet.
+	AllowClients []string
+	// Ignore traffic of clients matching one of given CIDRs or IPs, takes precedence over AllowClients
+	DenyClients []string
+
+	// Capture only traffic of sockets owned by the process, or by processes of the cgroup,
+	// like "system.slice/nginx.service". Ports of sockets are read from /proc, supported only on Linux.
+	PID    int
+	Cgroup string
+
+	// Capture traffic of Kubernetes pods matching label selector, like "app=web", instead of interfaces matching address.
+	// Pods are discovered using Kubernetes API, and capture follows them as they are rescheduled. Supported only by pcap engine.
+	KubernetesSelector string
+	// Namespace of pods, all namespaces by default
+	KubernetesNamespace string
+	// Capture only pods scheduled on this node, NODE_NAME environment variable by default
+	KubernetesNode string
+	// Kubernetes API address, by default in-cluster service address is used
+	KubernetesAPI string
+	// How often list of pods is refreshed, 10s by default
+	KubernetesRefresh time.Duration
+
+	// Capture inside network namespace of Docker container, given by name or ID, or "pid:1234" for any process.
+	// Address is matched against container interfaces. Supported only by pcap engine on Linux.
+	Container string
+
+	// Called from capture goroutine when pcap capture on device is interrupted, like when interface goes down,
+	// and when it is resumed after handle re-opened
+	OnCaptureInterrupted func(device string, err error)
+	OnCaptureResumed     func(device string)
+
+	// Source of pcap packet timestamps: "host", "host_lowprec", "host_hiprec", "adapter" (hardware) or "adapter_unsynced".
+	// Timestamps are captured with nanosecond precision if supported. By default OS setting is used.
+	TimestampType string
+
+	// Maximum number of bytes captured from each packet, 64kb by default
+	SnapLen int
+	// Put interface into promiscuous mode
+	Promiscuous bool
+	// Size of pcap buffer in bytes, if 0 OS default is used.
+	// For AF_PACKET engine it is size of ring buffer of each socket, 8mb by default.
+	// For uprobe engine it is size of perf buffer of each CPU, 1mb by default.
+	BufferSize int
+	// Number of AF_PACKET sockets opened per device, each read by own goroutine. If 0, one per CPU.
+	FanoutSockets int
+
+	// Number of captured packets waiting for processing, 10000 by default
+	PacketsBufferSize int
+	// Number of assembled messages waiting to be read from Receiver(), 10000 by default
+	MessagesBufferSize int
+	// Number of messages sent to ReceiverBatches() at once. If 0, messages are sent one by one to Receiver().
+	BatchSize int
+	// How long incomplete batch waits for more messages, 10ms by default
+	BatchInterval time.Duration
+	// What to do when one of buffers is full: BackpressureBlock (default), BackpressureDropOldest or BackpressureDropNewest
+	Backpressure string
+
+	// Maximum size of message in bytes, data beyond it is discarded and message marked as Truncated.
+	// If 0, size is not limited.
+	MaxMessageSize int
+
+	// Number of goroutines assembling messages, each processing own part of connections. If 0, one.
+	Shards int
+
+	// Maximum number of messages being assembled. When exceeded, oldest messages are discarded.
+	// If 0, number of messages is not limited. Limits are split evenly between shards.
+	MaxMessages int
+	// Maximum total size of messages being assembled, in bytes. When exceeded, oldest messages are discarded.
+	// If 0, size is not limited.
+	MaxBufferedBytes int
+
+	// Maximum number of out of order segments buffered per connection direction, while waiting for the missing one.
+	// If 0, segments are not reordered.
+	ReorderWindow int
+	// How long to wait for the missing segment, 100ms by default
+	ReorderTimeout time.Duration
+
+	// Keep `Expect: 100-continue` header of requests which body was sent after `100 Continue` response.
+	// By default header is removed, so replayed requests are sent at once.
+	KeepExpectHeader bool
+
+	// PEM encoded RSA private key of the server, or directory of keys named by server name, like "example.com.pem".
+	// TLS sessions using RSA key exchange are decrypted, and processed like plaintext traffic.
+	TLSKey string
+
+	// NSS key log file with secrets of TLS sessions, like one written by server when SSLKEYLOGFILE is set.
+	// TLS 1.2 and 1.3 sessions with any key exchange are decrypted. File is read as it grows.
+	TLSKeyLog string
+
+	// Binaries uprobe engine attaches to: OpenSSL libraries, or Go executables using crypto/tls, glob patterns allowed.
+	// By default system libssl is used.
+	UprobeBinaries []string
+}
+
 // NewListener creates and initializes new Listener object
-func NewListener(addr string, port string, engine int, trackResponse bool, expire time.Duration) (l *Listener) {
+//
+// `ports` is comma separated list of ports or port ranges, like "8080,8443" or "8000-8100". All of them captured using same pcap handle.
+// Port 0 means all TCP ports.
+//
+// Returns error if traffic capture can't be started, for example when device not found or there is not enough permissions.
+func NewListener(addr string, ports string, engine int, trackResponse bool, expire time.Duration, config *ListenerConfig) (l *Listener, err error) {
+	return NewListenerContext(context.Background(), addr, ports, engine, trackResponse, expire, config)
+}
+
+// NewListenerContext creates Listener bound to the context. Config is copied, and can be nil to use defaults.
+//
+// When context is cancelled (or Close called) capture stops, all in-flight messages get dispatched, and Receiver() channel is closed.
+func NewListenerContext(ctx context.Context, addr string, ports string, engine int, trackResponse bool, expire time.Duration, config *ListenerConfig) (l *Listener, err error) {
 	l = &Listener{}
 
-	l.packetsChan = make(chan []byte, 10000)
-	l.messagesChan = make(chan *TCPMessage, 10000)
-	l.quit = make(chan bool)
+	l.ctx, l.cancel = context.WithCancel(ctx)
 	l.readyCh = make(chan bool, 1)
 
-	l.messages = make(map[tcpID]*TCPMessage)
-	l.ackAliases = make(map[uint32]uint32)
-	l.seqWithData = make(map[uint32]uint32)
-	l.respAliases = make(map[uint32]*TCPMessage)
-	l.respWithoutReq = make(map[uint32]tcpID)
+	l.pcapDevices = make(map[string]*pcapCapture)
 	l.trackResponse = trackResponse
 
+	// Defaults are filled in own copy, caller's config is left as is
+	l.config = new(ListenerConfig)
+	if config != nil {
+		*l.config = *config
+	}
+	l.bpfFilter = l.config.BPFFilter
+
+	if l.config.SnapLen == 0 {
+		l.config.SnapLen = defaultSnapLen
+	}
+
+	if l.config.PacketsBufferSize == 0 {
+		l.config.PacketsBufferSize = defaultBufferSize
+	}
+
+	if l.config.MessagesBufferSize == 0 {
+		l.config.MessagesBufferSize = defaultBufferSize
+	}
+
+	if l.config.Shards == 0 {
+		l.config.Shards = 1
+	}
+
+	if l.config.BatchInterval == 0 {
+		l.config.BatchInterval = defaultBatchInterval
+	}
+
+	if l.config.ReorderTimeout == 0 {
+		l.config.ReorderTimeout = defaultReorderTimeout
+	}
+
+	switch l.config.Protocol {
+	case "":
+		l.config.Protocol = ProtocolTCP
+	case ProtocolTCP:
+	case ProtocolUDP:
+		l.udp = true
+	default:
+		l.newDecoder = streamDecoders[l.config.Protocol]
+		if l.newDecoder == nil {
+			l.cancel()
+			return nil, fmt.Errorf("Unknown protocol: %s", l.config.Protocol)
+		}
+	}
+
+	switch l.config.PostgresAuth {
+	case "":
+		l.config.PostgresAuth = PostgresAuthStrip
+	case PostgresAuthStrip, PostgresAuthKeep, PostgresAuthReplace:
+	default:
+		l.cancel()
+		return nil, fmt.Errorf("Unknown PostgreSQL authentication handling: %s", l.config.PostgresAuth)
+	}
+
+	switch l.config.Backpressure {
+	case "":
+		l.config.Backpressure = BackpressureBlock
+	case BackpressureBlock, BackpressureDropOldest, BackpressureDropNewest:
+	default:
+		l.cancel()
+		return nil, fmt.Errorf("Unknown backpressure policy: %s", l.config.Backpressure)
+	}
+
+	if l.allowClients, err = parseClientNets(l.config.AllowClients); err == nil {
+		l.denyClients, err = parseClientNets(l.config.DenyClients)
+	}
+
+	if err == nil && (l.config.TLSKey != "" || l.config.TLSKeyLog != "") {
+		l.tlsKeys, err = loadTLSKeys(l.config.TLSKey, l.config.TLSKeyLog)
+	}
+
+	if err != nil {
+		l.cancel()
+		return nil, err
+	}
+
+	l.packetsChan = make(chan *packetBuffer, l.config.PacketsBufferSize)
+	l.buffers = newPacketBuffers(l.config.SnapLen)
+	l.messagesChan = make(chan *TCPMessage, l.config.MessagesBufferSize)
+	if l.config.BatchSize > 1 {
+		l.batchesChan = make(chan []*TCPMessage, l.config.MessagesBufferSize/l.config.BatchSize+1)
+	}
+	l.shards = newShards(l, l.config.Shards)
+
 	l.addr = addr
-	_port, _ := strconv.Atoi(port)
-	l.port = uint16(_port)
+	if l.ports, err = parsePorts(ports); err != nil {
+		l.cancel()
+		return nil, err
+	}
+	l.anyPort = isAnyPort(l.ports)
 
 	if expire.Nanoseconds() == 0 {
 		expire = 2000 * time.Millisecond
@@ -108,63 +384,121 @@ func NewListener(addr string, port string, engine int, trackResponse bool, expir
 
 	l.messageExpire = expire
 
-	go l.listen()
+	if l.config.KubernetesSelector != "" && engine != EnginePcap {
+		l.cancel()
+		return nil, fmt.Errorf("Kubernetes capture mode is supported only by libpcap engine")
+	}
 
-	// Special case for testing
-	if l.port != 0 {
-		switch engine {
-		case EngineRawSocket:
-			go l.readRAWSocket()
-		case EnginePcap:
-			go l.readPcap()
-		default:
-			log.Fatal("Unknown traffic interception engine:", engine)
+	if l.config.Container != "" {
+		if engine != EnginePcap {
+			l.cancel()
+			return nil, fmt.Errorf("Container capture is supported only by libpcap engine")
+		}
+
+		if l.netns, err = containerNetns(l.config.Container); err != nil {
+			l.cancel()
+			return nil, err
 		}
 	}
 
+	// Uprobe engine filters events by process, since connections may have synthetic addresses
+	if (l.config.PID != 0 || l.config.Cgroup != "") && engine != EngineUprobe {
+		if err = l.watchProcess(); err != nil {
+			l.cancel()
+			return nil, err
+		}
+	}
+
+	switch engine {
+	case EngineRawSocket:
+		err = l.readRAWSocket()
+	case EnginePcap:
+		err = l.readPcap()
+	case EngineAFPacket:
+		err = l.readAFPacket()
+	case EngineUnixProxy:
+		err = l.readUnixProxy()
+	case EngineUprobe:
+		err = l.readUprobe()
+	case EnginePcapFile:
+		err = l.readPcapFile()
+	case engineTest:
+	default:
+		err = fmt.Errorf("Unknown traffic interception engine: %d", engine)
+	}
+
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	go l.listen()
+
 	return
 }
 
+// listen starts shards processing captured packets. When listener is stopped, waits until shards dispatch remaining messages, and closes messagesChan.
 func (t *Listener) listen() {
-	gcTicker := time.Tick(t.messageExpire / 2)
+	done := make(chan struct{})
 
-	for {
-		select {
-		case <-t.quit:
-			if t.conn != nil {
-				t.conn.Close()
-			}
-			return
-		case data := <-t.packetsChan:
-			packet := ParseTCPPacket(data[:16], data[16:])
-			t.processTCPPacket(packet)
-		case <-gcTicker:
-			now := time.Now()
-
-			// Dispatch requests before responses
-			for _, message := range t.messages {
-				if now.Sub(message.End) >= t.messageExpire {
-					t.dispatchMessage(message)
-				}
-			}
-		}
+	var wg sync.WaitGroup
+	for _, s := range t.shards {
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			s.listen(done)
+		}(s)
+	}
+
+	if len(t.shards) == 1 {
+		// Single shard reads packetsChan directly
+		<-t.ctx.Done()
+		t.closeCapture()
+	} else {
+		t.routePackets()
+	}
+
+	close(done)
+	wg.Wait()
+
+	close(t.messagesChan)
+	if t.batchesChan != nil {
+		close(t.batchesChan)
 	}
 }
 
-func (t *Listener) deleteMessage(message *TCPMessage) {
-	delete(t.messages, message.ID())
-	delete(t.ackAliases, message.Ack)
-	if message.DataAck != 0 {
-		delete(t.ackAliases, message.DataAck)
+// closeCapture stops all packet readers
+func (t *Listener) closeCapture() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+	}
+
+	if t.unixListener != nil {
+		t.unixListener.Close()
+	}
+
+	for _, h := range t.pcapHandles {
+		h.Close()
 	}
-	if message.DataSeq != 0 {
-		delete(t.seqWithData, message.DataSeq)
+	t.pcapHandles = nil
+}
+
+func (t *shard) deleteMessage(message *TCPMessage) {
+	stream := message.stream
+
+	if _, ok := t.messages[message.ID()]; ok {
+		t.bufferedBytes -= message.size
+		t.untrackExpiry(message)
 	}
 
-	delete(t.respAliases, message.ResponseAck)
+	delete(t.messages, message.ID())
+	delete(stream.messages, message.ID())
 }
 
-func (t *Listener) dispatchMessage(message *TCPMessage) {
+func (t *shard) dispatchMessage(message *TCPMessage) {
 	// If already dispatched
 	if _, ok := t.messages[message.ID()]; !ok {
 		return
@@ -172,23 +506,16 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 
 	t.deleteMessage(message)
 
+	stream := message.stream
+
 	// log.Println("Dispatching, message", message.Start.UnixNano(), message.Seq, message.Ack, string(message.Bytes()))
 
 	if message.IsIncoming {
 		// If there were response before request
-		// log.Println("Looking for Response: ", t.respWithoutReq, message.ResponseAck)
 		if t.trackResponse {
-			if respID, ok := t.respWithoutReq[message.ResponseAck]; ok {
-				if resp, rok := t.messages[respID]; rok {
-					// if resp.AssocMessage == nil {
-					// log.Println("FOUND RESPONSE")
-					resp.AssocMessage = message
-					message.AssocMessage = resp
-
-					if resp.IsFinished() {
-						defer t.dispatchMessage(resp)
-					}
-					// }
+			if message.AssocMessage == nil {
+				if resp := t.waitingResponse(stream, message); resp != nil {
+					defer t.dispatchResponse(resp)
 				}
 			}
 
@@ -198,26 +525,117 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 		}
 	} else {
 		if message.AssocMessage == nil {
-			if responseRequest, ok := t.respAliases[message.Ack]; ok {
+			if responseRequest := stream.requestEndingAt(message.Ack); responseRequest != nil {
 				message.AssocMessage = responseRequest
 				responseRequest.AssocMessage = message
+				t.forgetRequest(stream, responseRequest)
 			}
 		}
 
-		delete(t.respAliases, message.Ack)
-		delete(t.respWithoutReq, message.Ack)
+		t.forgetResponse(stream, message)
 
 		// Do not track responses which have no associated requests
 		if message.AssocMessage == nil {
 			// log.Println("Can't dispatch resp", message.Seq, message.Ack, string(message.Bytes()))
+			atomic.AddUint64(&t.stats.messagesExpired, 1)
+			message.release()
 			return
 		}
 	}
 
-	t.messagesChan <- message
+	t.emit(message)
 }
 
-// DeviceNotFoundError raised if user specified wrong ip
+// sendMessage puts message to messagesChan according to the backpressure policy
+func (t *Listener) sendMessage(message *TCPMessage) {
+	switch t.config.Backpressure {
+	case BackpressureDropNewest:
+		select {
+		case t.messagesChan <- message:
+		default:
+			atomic.AddUint64(&t.stats.messagesBufferDropped, 1)
+			return
+		}
+	case BackpressureDropOldest:
+		for sent := false; !sent; {
+			select {
+			case t.messagesChan <- message:
+				sent = true
+			default:
+				select {
+				case <-t.messagesChan:
+					atomic.AddUint64(&t.stats.messagesBufferDropped, 1)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case t.messagesChan <- message:
+		default:
+			// Receiver may stop reading once listener is closed, so do not wait for it then
+			select {
+			case t.messagesChan <- message:
+			case <-t.ctx.Done():
+				atomic.AddUint64(&t.stats.messagesBufferDropped, 1)
+				return
+			}
+		}
+	}
+
+	atomic.AddUint64(&t.stats.messagesDispatched, 1)
+}
+
+// Inject passes packet for processing, as if it was captured. Packet should be in the format returned by TCPPacket.Dump.
+// Returns false if listener was stopped.
+func (t *Listener) Inject(data []byte) bool {
+	return t.sendPacket(newPacketBuffer(data))
+}
+
+// sendPacket puts captured packet to packetsChan according to the backpressure policy.
+// Packets captured while listener is paused are discarded. Returns false if listener was stopped.
+func (t *Listener) sendPacket(buf *packetBuffer) bool {
+	// Kernel filter may be not supported by engine, or packets were captured before it was applied
+	if t.isPaused() {
+		buf.release()
+		return true
+	}
+
+	switch t.config.Backpressure {
+	case BackpressureDropNewest:
+		select {
+		case t.packetsChan <- buf:
+		default:
+			buf.release()
+			atomic.AddUint64(&t.stats.packetsBufferDropped, 1)
+		}
+	case BackpressureDropOldest:
+		for {
+			select {
+			case t.packetsChan <- buf:
+				return true
+			default:
+				select {
+				case oldest := <-t.packetsChan:
+					oldest.release()
+					atomic.AddUint64(&t.stats.packetsBufferDropped, 1)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case t.packetsChan <- buf:
+		case <-t.ctx.Done():
+			buf.release()
+			return false
+		}
+	}
+
+	return true
+}
+
+// DeviceNotFoundError raised if user specified wrong ip or interface name
 type DeviceNotFoundError struct {
 	addr string
 }
@@ -230,7 +648,7 @@ func (e *DeviceNotFoundError) Error() string {
 	}
 
 	var msg string
-	msg += "Can't find interfaces with addr: " + e.addr + ". Provide available IP for intercepting traffic: \n"
+	msg += "Can't find interfaces with addr: " + e.addr + ". Provide available IP or interface name for intercepting traffic: \n"
 	for _, device := range devices {
 		msg += "Name: " + device.Name + "\n"
 		if device.Description != "" {
@@ -244,220 +662,525 @@ func (e *DeviceNotFoundError) Error() string {
 	return msg
 }
 
+// findPcapDevices returns interfaces matching `addr`, which can be IP address, interface name (including "any"),
+// or comma separated list of them. Blank address or "0.0.0.0" means all interfaces which have IP address.
+//
+// Interfaces selected by name are returned without addresses: traffic on them captured without host filtering,
+// so interfaces without IP, like mirror or SPAN ports, can be used as well.
 func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 	devices, err := pcap.FindAllDevs()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	for _, device := range devices {
-		if (addr == "" || addr == "0.0.0.0" || addr == "[::]" || addr == "::") && len(device.Addresses) > 0 {
-			interfaces = append(interfaces, device)
-			continue
-		}
+	return matchDevices(devices, addr)
+}
 
-		for _, address := range device.Addresses {
-			if device.Name == addr || address.IP.String() == addr {
+// PCAP_IF_LOOPBACK flag of pcap.Interface
+const pcapIfLoopback = 1
+
+func isLoopbackDevice(device pcap.Interface) bool {
+	return device.Flags&pcapIfLoopback != 0
+}
+
+func isLoopbackAddr(addr string) bool {
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// isDeviceGUID checks if Npcap device, named like `\Device\NPF_{GUID}`, selected by its GUID, with or without braces
+func isDeviceGUID(device pcap.Interface, guid string) bool {
+	guid = strings.ToUpper(strings.Trim(guid, "{}"))
+	name := strings.ToUpper(device.Name)
+
+	return len(guid) == 36 && strings.HasPrefix(name, `\DEVICE\NPF_`) && strings.HasSuffix(name, "{"+guid+"}")
+}
+
+func matchDevices(devices []pcap.Interface, addr string) (interfaces []pcap.Interface, err error) {
+	added := make(map[string]bool)
+
+	for _, a := range strings.Split(addr, ",") {
+		a = strings.TrimSpace(a)
+
+		for _, device := range devices {
+			if added[device.Name] {
+				continue
+			}
+
+			if a == "" || a == "0.0.0.0" || a == "[::]" || a == "::" {
+				if len(device.Addresses) > 0 {
+					interfaces = append(interfaces, device)
+					added[device.Name] = true
+				}
+				continue
+			}
+
+			// Npcap loopback adapter has no addresses, but captures all local traffic
+			if device.Name == a || isDeviceGUID(device, a) || (isLoopbackDevice(device) && len(device.Addresses) == 0 && isLoopbackAddr(a)) {
+				device.Addresses = nil
 				interfaces = append(interfaces, device)
-				return interfaces, nil
+				added[device.Name] = true
+				continue
+			}
+
+			for _, address := range device.Addresses {
+				if address.IP.String() == a {
+					interfaces = append(interfaces, device)
+					added[device.Name] = true
+					break
+				}
 			}
 		}
 	}
 
 	if len(interfaces) == 0 {
 		return nil, &DeviceNotFoundError{addr}
-	} else {
-		return interfaces, nil
 	}
+
+	return interfaces, nil
 }
 
-func (t *Listener) readPcap() {
-	devices, err := findPcapDevices(t.addr)
+// openPcapHandle activates pcap handle for given device using snaplen, promiscuous mode and buffer size from config
+func (t *Listener) openPcapHandle(device string) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer inactive.CleanUp()
 
-	bpfSupported := true
-	if runtime.GOOS == "darwin" {
-		bpfSupported = false
+	if err = inactive.SetSnapLen(t.config.SnapLen); err != nil {
+		return nil, err
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(devices))
+	if err = inactive.SetPromisc(t.config.Promiscuous); err != nil {
+		return nil, err
+	}
+
+	if err = inactive.SetTimeout(t.messageExpire); err != nil {
+		return nil, err
+	}
+
+	if t.config.BufferSize > 0 {
+		if err = inactive.SetBufferSize(t.config.BufferSize); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.config.TimestampType != "" {
+		source, err := pcap.TimestampSourceFromString(t.config.TimestampType)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = inactive.SetTimestampSource(source); err != nil {
+			return nil, fmt.Errorf("Timestamp type %s is not supported: %v", t.config.TimestampType, err)
+		}
+	}
+
+	return inactive.Activate()
+}
+
+// readPcap starts capture on all matching devices. Returns error if none of them can be opened.
+func (t *Listener) readPcap() error {
+	if t.config.KubernetesSelector != "" {
+		return t.readKubernetes()
+	}
+
+	var devices []pcap.Interface
+	err := inNetns(t.netns, func() (err error) {
+		devices, err = findPcapDevices(t.addr)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	started := make(chan error, len(devices))
 
 	for _, d := range devices {
-		go func(device pcap.Interface) {
-			handle, err := pcap.OpenLive(device.Name, 65536, true, t.messageExpire)
-			if err != nil {
-				log.Println("Pcap Error while opening device", device.Name, err)
-				wg.Done()
+		go t.capturePcapDevice(d, started)
+	}
+
+	var lastErr error
+	failed := 0
+	for range devices {
+		if err := <-started; err != nil {
+			lastErr = err
+			failed++
+		}
+	}
+
+	if failed == len(devices) {
+		return lastErr
+	}
+
+	go t.watchPcapDevices()
+
+	t.readyCh <- true
+
+	return nil
+}
+
+// capturePcapDevice opens pcap handle for the device and processes captured packets until capture is stopped.
+// Result of opening the handle is sent to `started`. If capture is interrupted later, like when interface goes down,
+// handle is re-opened with backoff.
+func (t *Listener) capturePcapDevice(device pcap.Interface, started chan<- error) {
+	c := t.addPcapCapture(device)
+	if c == nil {
+		// Device already captured
+		started <- nil
+		return
+	}
+	defer t.removePcapCapture(c)
+
+	handle, err := t.openPcapDevice(device)
+	started <- err
+	if err != nil {
+		return
+	}
+
+	for {
+		err = t.readPcapHandle(c, handle)
+		if err == nil {
+			return
+		}
+
+		log.Println("Capture interrupted on", device.Name, err, "re-opening")
+		atomic.AddUint64(&t.stats.captureInterrupted, 1)
+		if t.config.OnCaptureInterrupted != nil {
+			t.config.OnCaptureInterrupted(device.Name, err)
+		}
+
+		delay := pcapReopenMinDelay
+		for handle = nil; handle == nil; delay = nextReopenDelay(delay) {
+			select {
+			case <-c.stop:
 				return
-			}
-			defer handle.Close()
-
-			t.mu.Lock()
-			t.pcapHandles = append(t.pcapHandles, handle)
-
-			var bpfDstHost, bpfSrcHost string
-			for i, addr := range device.Addresses {
-				bpfDstHost += "dst host " + addr.IP.String()
-				bpfSrcHost += "src host " + addr.IP.String()
-				if i != len(device.Addresses) - 1 {
-					bpfDstHost += " or "
-					bpfSrcHost += " or "
-				}
+			case <-t.ctx.Done():
+				return
+			case <-time.After(delay):
 			}
 
-			if bpfSupported {
-				var bpf string
+			handle, _ = t.openPcapDevice(t.pcapCaptureDevice(c))
+		}
 
-				if t.trackResponse {
-					bpf = "(tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")) or (" + "tcp src port " + strconv.Itoa(int(t.port)) + " and (" + bpfSrcHost + "))"
-				} else {
-					bpf = "tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")"
-				}
+		log.Println("Capture resumed on", device.Name)
+		atomic.AddUint64(&t.stats.captureResumed, 1)
+		if t.config.OnCaptureResumed != nil {
+			t.config.OnCaptureResumed(device.Name)
+		}
+	}
+}
 
-				if err := handle.SetBPFFilter(bpf); err != nil {
-					log.Println("BPF filter error:", err, "Device:", device.Name, bpf)
-					wg.Done()
-					return
-				}
-			}
-			t.mu.Unlock()
+// openPcapDevice opens pcap handle for the device, in container network namespace if needed, and sets BPF filter
+func (t *Listener) openPcapDevice(device pcap.Interface) (*pcap.Handle, error) {
+	var handle *pcap.Handle
+	err := inNetns(t.netns, func() (err error) {
+		handle, err = t.openPcapHandle(device.Name)
+		return
+	})
+	if err != nil {
+		log.Println("Pcap Error while opening device", device.Name, err)
+		return nil, fmt.Errorf("Pcap Error while opening device %s: %v", device.Name, err)
+	}
 
-			var decoder gopacket.Decoder
+	if runtime.GOOS != "darwin" {
+		t.mu.Lock()
+		bpf := t.deviceBPF(device)
+		t.mu.Unlock()
 
-			// Special case for tunnel interface https://github.com/google/gopacket/issues/99
-			if handle.LinkType() == 12 {
-			    decoder = layers.LayerTypeIPv4
-			} else {
-			    decoder = handle.LinkType()
-			}
+		if err := handle.SetBPFFilter(bpf); err != nil {
+			handle.Close()
+			log.Println("BPF filter error:", err, "Device:", device.Name, bpf)
+			return nil, fmt.Errorf("BPF filter error: %v Device: %s %s", err, device.Name, bpf)
+		}
+	}
 
-			source := gopacket.NewPacketSource(handle, decoder)
-			source.Lazy = true
-			source.NoCopy = true
+	return handle, nil
+}
 
-			wg.Done()
+// readPcapHandle processes packets captured by the handle, and closes it when done.
+// Returns nil if capture was stopped, or error which interrupted it.
+func (t *Listener) readPcapHandle(c *pcapCapture, handle *pcap.Handle) error {
+	defer handle.Close()
 
-			var data, srcIP, dstIP []byte
+	bpfSupported := true
+	if runtime.GOOS == "darwin" {
+		bpfSupported = false
+	}
 
-			for {
-				packet, err := source.NextPacket()
+	device := t.pcapCaptureDevice(c)
 
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					continue
-				}
+	h := &pcapHandle{handle, device}
+	t.mu.Lock()
+	t.pcapHandles = append(t.pcapHandles, h)
+	t.mu.Unlock()
+	defer t.removePcapHandle(h)
 
-				if decoder == layers.LinkTypeEthernet {
-					// Skip ethernet layer, 14 bytes
-					data = packet.Data()[14:]
-				} else if decoder == layers.LinkTypeNull || decoder == layers.LinkTypeLoop {
-					data = packet.Data()[4:]
-				} else {
-					log.Println("Unknown packet layer", packet)
-					break
-				}
+	decoder, err := newPacketDecoder(handle.LinkType())
+	if err != nil {
+		log.Println(err, "on", device.Name)
+		return nil
+	}
 
-				version := uint8(data[0]) >> 4
+	truncatedWarned := false
 
-				if version == 4 {
-					ihl := uint8(data[0]) & 0x0F
+	for {
+		// Data is valid only until next read, processIPPacket copies it
+		packet, ci, err := handle.ZeroCopyReadPacketData()
 
-					// Truncated IP info
-					if len(data) < int(ihl*4) {
-						continue
-					}
+		if t.ctx.Err() != nil || c.stopped() {
+			return nil
+		} else if err == pcap.NextErrorTimeoutExpired {
+			continue
+		} else if err != nil {
+			return err
+		}
 
-					srcIP = data[12:16]
-					dstIP = data[16:20]
-					data = data[ihl*4:]
-				} else {
-					// Truncated IP info
-					if len(data) < 40 {
-						continue
-					}
+		// Segments coalesced by GRO/LRO can be larger than snaplen
+		if ci.CaptureLength < ci.Length && !truncatedWarned {
+			log.Println("Captured packet truncated by snaplen", ci.CaptureLength, "of", ci.Length, "bytes on", device.Name+".",
+				"Increase --input-raw-snaplen or disable receive offloads: `ethtool -K", device.Name, "gro off lro off`")
+			truncatedWarned = true
+		}
 
-					srcIP = data[8:24]
-					dstIP = data[24:40]
+		data := decoder.decode(packet)
+		if len(data) == 0 {
+			continue
+		}
 
-					data = data[40:]
-				}
+		if !t.processIPPacket(data, ci.Timestamp, device, bpfSupported) {
+			return nil
+		}
+	}
+}
 
-				// Truncated TCP info
-				if len(data) < 13 {
-					continue
-				}
+// deviceBPF builds BPF filter for the device: listened ports, and device addresses if they are known.
+// Should be called with t.mu locked.
+func (t *Listener) deviceBPF(device pcap.Interface) (bpf string) {
+	if t.isPaused() {
+		return pauseBPF
+	}
 
-				dataOffset := (data[12] & 0xF0) >> 4
+	var bpfDstHost, bpfSrcHost string
+	for i, addr := range device.Addresses {
+		bpfDstHost += "dst host " + addr.IP.String()
+		bpfSrcHost += "src host " + addr.IP.String()
+		if i != len(device.Addresses)-1 {
+			bpfDstHost += " or "
+			bpfSrcHost += " or "
+		}
+	}
 
-				// We need only packets with data inside
-				// Check that the buffer is larger than the size of the TCP header
-				if len(data) > int(dataOffset*4) {
-					if !bpfSupported {
-						destPort := binary.BigEndian.Uint16(data[2:4])
-						srcPort := binary.BigEndian.Uint16(data[0:2])
+	bpfRequests, bpfResponses := t.bpfPorts("dst"), t.bpfPorts("src")
+	if clients := t.bpfClients("src"); clients != "" {
+		bpfRequests = "(" + bpfRequests + " and " + clients + ")"
+		bpfResponses = "(" + bpfResponses + " and " + t.bpfClients("dst") + ")"
+	}
+
+	if len(device.Addresses) == 0 {
+		// Interface selected by name, capture everything what goes through it
+		if t.trackResponse {
+			bpf = bpfRequests + " or " + bpfResponses
+		} else {
+			bpf = bpfRequests
+		}
+	} else if t.trackResponse {
+		bpf = "(" + bpfRequests + " and (" + bpfDstHost + ")) or (" + bpfResponses + " and (" + bpfSrcHost + "))"
+	} else {
+		bpf = bpfRequests + " and (" + bpfDstHost + ")"
+	}
 
-						var addrCheck []byte
+	// Tunneled traffic filtered by port in user space, after unwrapping
+	if t.config.Decapsulate {
+		bpf = "(" + bpf + ") or " + bpfTunnels
+	}
 
-						if destPort == t.port {
-							addrCheck = dstIP
-						}
+	return t.applyBPFFilter(bpf)
+}
 
-						if t.trackResponse && srcPort == t.port {
-							addrCheck = srcIP
-						}
+// processIPPacket parses IP packet, optionally wrapped into tunnel, checks if it should be captured,
+// and sends TCP segment for processing. Returns false if listener is stopped.
+func (t *Listener) processIPPacket(data []byte, timestamp time.Time, device pcap.Interface, bpfSupported bool) bool {
+	var srcIP, dstIP []byte
 
-						if len(addrCheck) == 0 {
-							continue
-						}
+	tunneled := false
+	if t.config.Decapsulate {
+		var ok bool
+		if data, tunneled, ok = decapsulate(data); !ok {
+			return true
+		}
+	}
 
-						addrMatched := false
-						for _, a := range device.Addresses {
-							if a.IP.Equal(net.IP(addrCheck)) {
-								addrMatched = true
-								break
-							}
-						}
+	version := uint8(data[0]) >> 4
 
-						if !addrMatched {
-							continue
-						}
-					}
+	if version == 4 {
+		ihl := uint8(data[0]) & 0x0F
 
-					newBuf := make([]byte, len(data)+16)
-					copy(newBuf[:16], srcIP)
-					copy(newBuf[16:], data)
+		// Truncated IP info
+		if len(data) < 20 || len(data) < int(ihl*4) || data[9] != t.ipProtocol() {
+			return true
+		}
 
-					t.packetsChan <- newBuf
+		srcIP = data[12:16]
+		dstIP = data[16:20]
+		data = data[ihl*4:]
+	} else {
+		// Truncated IP info
+		if len(data) < 40 || data[6] != t.ipProtocol() {
+			return true
+		}
+
+		srcIP = data[8:24]
+		dstIP = data[24:40]
+
+		data = data[40:]
+	}
+
+	if !t.hasData(data) {
+		return true
+	}
+
+	if !bpfSupported || tunneled {
+		destPort := binary.BigEndian.Uint16(data[2:4])
+		srcPort := binary.BigEndian.Uint16(data[0:2])
+
+		var addrCheck, clientIP []byte
+
+		if t.isIncoming(srcPort, destPort) {
+			addrCheck, clientIP = dstIP, srcIP
+		} else if t.trackResponse && t.isListenPort(srcPort) {
+			addrCheck, clientIP = srcIP, dstIP
+		}
+
+		if len(addrCheck) == 0 || !t.isAllowedClient(net.IP(clientIP)) {
+			return true
+		}
+
+		// Mirrored traffic addressed to other hosts, so check address only for local packets
+		if !tunneled && len(device.Addresses) > 0 {
+			addrMatched := false
+			for _, a := range device.Addresses {
+				if a.IP.Equal(net.IP(addrCheck)) {
+					addrMatched = true
+					break
 				}
 			}
-		}(d)
+
+			if !addrMatched {
+				return true
+			}
+		}
 	}
 
-	wg.Wait()
-	t.readyCh <- true
+	buf := t.buffers.get(len(data) + packetHeaderSize)
+	putPacketHeader(buf.data, srcIP, dstIP, timestamp)
+	copy(buf.data[packetHeaderSize:], data)
+
+	return t.sendPacket(buf)
 }
 
-func (t *Listener) readRAWSocket() {
-	conn, e := net.ListenPacket("ip:tcp", t.addr)
-	t.conn = conn
+// SetFilter replaces BPF filter customization, see ListenerConfig.BPFFilter, without restarting capture.
+// Filter is compiled for all open devices first, and applied only if it is valid for all of them.
+func (t *Listener) SetFilter(expr string) error {
+	if runtime.GOOS == "darwin" {
+		return fmt.Errorf("BPF filters are not supported on %s", runtime.GOOS)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev := t.bpfFilter
+	t.bpfFilter = expr
+
+	if err := t.applyFilters(); err != nil {
+		t.bpfFilter = prev
+		return err
+	}
+
+	return nil
+}
+
+// applyFilters re-compiles filters of all open devices and sets them, only if they are valid for all devices.
+// Should be called with t.mu locked.
+func (t *Listener) applyFilters() error {
+	var setters []func() error
+
+	for _, h := range t.pcapHandles {
+		h := h
+		bpf := t.deviceBPF(h.device)
+
+		instructions, err := h.CompileBPFFilter(bpf)
+		if err != nil {
+			return fmt.Errorf("BPF filter error: %v Device: %s %s", err, h.device.Name, bpf)
+		}
+
+		setters = append(setters, func() error {
+			return h.SetBPFInstructionFilter(instructions)
+		})
+	}
+
+	afpacketSetters, err := t.afpacketFilterSetters()
+	if err != nil {
+		return err
+	}
+
+	for _, set := range append(setters, afpacketSetters...) {
+		if err := set(); err != nil {
+			return fmt.Errorf("BPF filter error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// applyBPFFilter appends user supplied BPF expression to the auto-generated one, or replaces it.
+// Should be called with t.mu locked.
+func (t *Listener) applyBPFFilter(bpf string) string {
+	filter := strings.TrimSpace(t.bpfFilter)
+
+	if filter == "" {
+		return bpf
+	}
+
+	if strings.HasPrefix(filter, "and ") || strings.HasPrefix(filter, "or ") {
+		return "(" + bpf + ") " + filter
+	}
+
+	return filter
+}
+
+func (t *Listener) readRAWSocket() error {
+	// Windows raw sockets do not receive TCP traffic
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("raw_socket engine is not supported on Windows, use libpcap engine with Npcap installed")
+	}
+
+	conn, e := net.ListenPacket("ip:"+t.transportProtocol(), t.addr)
 
 	if e != nil {
-		log.Fatal(e)
+		return e
 	}
 
-	defer t.conn.Close()
+	t.conn = conn
 
-	buf := make([]byte, 64*1024) // 64kb
+	go t.readRAWSocketPackets()
 
 	t.readyCh <- true
 
+	return nil
+}
+
+func (t *Listener) readRAWSocketPackets() {
+	defer t.conn.Close()
+
+	conn := t.conn.(*net.IPConn)
+	buf := make([]byte, 64*1024) // 64kb
+
 	for {
-		// Note: ReadFrom receive messages without IP header
-		n, addr, err := t.conn.ReadFrom(buf)
+		// Unlike ReadFrom, ReadMsgIP keeps IP header of IPv4 packets, so their destination address is known
+		n, _, _, addr, err := conn.ReadMsgIP(buf, nil)
 
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "closed network connection") {
@@ -467,47 +1190,62 @@ func (t *Listener) readRAWSocket() {
 			}
 		}
 
-		if n > 0 {
-			if t.isValidPacket(buf[:n]) {
-				newBuf := make([]byte, n+16)
-				copy(newBuf[16:], buf[:n])
-				copy(newBuf[:16], []byte(addr.(*net.IPAddr).IP))
+		data := buf[:n]
+		var dstIP net.IP
 
-				t.packetsChan <- newBuf
+		if len(addr.IP) == net.IPv4len {
+			ihl := int(data[0]&0x0F) * 4
+			if n < 20 || n < ihl {
+				continue
+			}
+
+			dstIP = data[16:20]
+			data = data[ihl:]
+		}
+
+		if len(data) > 0 {
+			if t.isValidPacket(data, addr.IP) {
+				// Destination address is not available for IPv6 RAW sockets, and left blank
+				packet := t.buffers.get(len(data) + packetHeaderSize)
+				putPacketHeader(packet.data, addr.IP, dstIP, time.Now())
+				copy(packet.data[packetHeaderSize:], data)
+
+				if !t.sendPacket(packet) {
+					return
+				}
 			}
 		}
 	}
 }
 
-func (t *Listener) isValidPacket(buf []byte) bool {
+// isValidPacket checks if segment received by raw socket should be captured. `srcIP` is source address of the packet.
+func (t *Listener) isValidPacket(buf []byte, srcIP net.IP) bool {
 	// To avoid full packet parsing every time, we manually parsing values needed for packet filtering
 	// http://en.wikipedia.org/wiki/Transmission_Control_Protocol
+	if len(buf) < 14 {
+		return false
+	}
+
 	destPort := binary.BigEndian.Uint16(buf[2:4])
 	srcPort := binary.BigEndian.Uint16(buf[0:2])
 
 	// Because RAW_SOCKET can't be bound to port, we have to control it by ourself
-	if destPort == t.port || (t.trackResponse && srcPort == t.port) {
-		// Get the 'data offset' (size of the TCP header in 32-bit words)
-		dataOffset := (buf[12] & 0xF0) >> 4
-
-		// We need only packets with data inside
-		// Check that the buffer is larger than the size of the TCP header
-		if len(buf) > int(dataOffset*4) {
-			// We should create new buffer because go slices is pointers. So buffer data shoud be immutable.
-			return true
-		}
+	if t.isIncoming(srcPort, destPort) {
+		return t.isAllowedClient(srcIP) && t.hasData(buf)
+	}
+
+	// Destination address is not known, responses of filtered out clients are dropped later as not associated with requests
+	if t.trackResponse && t.isListenPort(srcPort) {
+		return t.hasData(buf)
 	}
 
 	return false
 }
 
-var bExpect100ContinueCheck = []byte("Expect: 100-continue")
-var bPOST = []byte("POST")
-
 // Trying to add packet to existing message or creating new message
 //
 // For TCP message unique id is Acknowledgment number (see tcp_packet.go)
-func (t *Listener) processTCPPacket(packet *TCPPacket) {
+func (t *shard) processTCPPacket(packet *TCPPacket) {
 	// Don't exit on panic
 	defer func() {
 		if r := recover(); r != nil {
@@ -517,105 +1255,173 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 
 	// log.Println("Processing packet:", packet.Ack, packet.Seq, packet.ID)
 
-	var message *TCPMessage
+	isIncoming := t.isIncoming(packet.SrcPort, packet.DestPort)
+	stream := t.stream(packet, isIncoming)
 
-	isIncoming := packet.DestPort == t.port
+	closed := stream.trackFlags(packet, isIncoming)
 
-	// Seek for 100-expect chunks
-	if parentAck, ok := t.seqWithData[packet.Seq]; ok {
-		// In case if non-first data chunks comes first
-		for _, m := range t.messages {
-			if m.Ack == packet.Ack && bytes.Equal(m.packets[0].Addr, packet.Addr) {
-				t.deleteMessage(m)
+	if len(packet.Data) > 0 && stream.tls != nil {
+		// Records are not split, decrypted data is split once decrypted
+		t.processSegments(stream, packet, isIncoming)
+	} else if len(packet.Data) > 0 {
+		for _, p := range t.splitSegment(stream, packet, isIncoming) {
+			t.processSegments(stream, p, isIncoming)
+		}
+	}
 
-				if m.AssocMessage != nil {
-					m.AssocMessage.AssocMessage = nil
-				}
+	// Connection finished by FIN from both sides or RST: nothing more will come, so no need to wait for expire
+	if closed {
+		t.closeStream(stream)
+	} else if packet.Flags&fFIN != 0 {
+		// Half-closed: message of this direction is complete, like response read until connection close
+		t.closeDirection(stream, packet, isIncoming)
+	}
+}
 
-				for _, pkt := range m.packets {
-					// log.Println("Updating ack", parentAck, pkt.Ack)
-					pkt.UpdateAck(parentAck)
-					// Re-queue this packets
-					t.processTCPPacket(pkt)
-				}
-			}
-		}
+// splitSegment splits segment holding multiple HTTP messages, see splitCoalesced
+func (t *shard) splitSegment(stream *tcpStream, packet *TCPPacket, isIncoming bool) []*TCPPacket {
+	// Frames and data of other protocols are not split, HTTP/2 streams are emitted once decoded
+	if stream.h2c != nil || stream.ws != nil || !t.isHTTP() {
+		return []*TCPPacket{packet}
+	}
 
-		t.ackAliases[packet.Ack] = parentAck
-		packet.UpdateAck(parentAck)
+	var isHeadResponse func(int) bool
+	if !isIncoming {
+		isHeadResponse = stream.isHeadResponse
 	}
 
-	if alias, ok := t.ackAliases[packet.Ack]; ok {
-		packet.UpdateAck(alias)
+	// Segment can complete chunked message, and start the next one
+	continued := 0
+	if message, ok := t.messages[packet.ID]; ok {
+		continued = message.chunkedRemainder(packet)
 	}
 
-	var responseRequest *TCPMessage
+	packets := splitCoalesced(packet, continued, isHeadResponse)
 
+	// WebSocket frames can follow handshake response in the same segment
 	if !isIncoming {
-		responseRequest, _ = t.respAliases[packet.Ack]
+		last := packets[len(packets)-1]
+		if size := webSocketAcceptSize(last.Data); size != -1 {
+			packets = append(packets[:len(packets)-1], last.slice(0, size), last.slice(size, len(last.Data)))
+		}
 	}
 
-	message, ok := t.messages[packet.ID]
-
-	if !ok {
-		message = NewTCPMessage(packet.Seq, packet.Ack, isIncoming)
-		t.messages[packet.ID] = message
+	return packets
+}
 
-		if !isIncoming {
-			if responseRequest != nil {
-				message.AssocMessage = responseRequest
-				responseRequest.AssocMessage = message
-			} else {
-				t.respWithoutReq[packet.Ack] = packet.ID
-			}
+// processTCPData processes segments of connection in order, decrypting them if connection uses TLS
+func (t *shard) processTCPData(stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if t.newDecoder != nil {
+		if stream.decoder == nil {
+			stream.decoder = t.newDecoder(stream)
 		}
+		stream.decoder.feed(t, stream, packet, isIncoming)
+		return
 	}
 
-	// Adding packet to message
-	message.AddPacket(packet)
-
-	// Handling Expect: 100-continue requests
-	if len(packet.Data) > 4 && bytes.Equal(packet.Data[0:4], bPOST) {
-		// reading last 20 bytes (not counting CRLF): last header value (if no body presented)
-		if bytes.Equal(packet.Data[len(packet.Data)-24:len(packet.Data)-4], bExpect100ContinueCheck) {
-			seq := packet.Seq + uint32(len(packet.Data))
-			t.seqWithData[seq] = packet.Ack
-			message.DataSeq = seq
-
-			// In case if sequence packet came first
-			for _, m := range t.messages {
-				if m.Seq == seq {
+	if stream.tls == nil && t.tlsKeys != nil && len(stream.messages) == 0 && isTLSClientHello(packet, isIncoming) {
+		stream.tls = &tlsConn{}
+	}
+
+	if stream.tls != nil {
+		t.processTLS(stream, packet, isIncoming)
+		return
+	}
+
+	t.processHTTPData(stream, packet, isIncoming)
+}
+
+// processHTTPData adds plaintext segment to HTTP message, and dispatches complete messages
+func (t *shard) processHTTPData(stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	var message *TCPMessage
+
+	if stream.h2c == nil && len(stream.messages) == 0 && isH2CPreface(packet, isIncoming) {
+		stream.h2c = newH2CConn()
+	}
+
+	if stream.h2c != nil {
+		t.processH2C(stream, packet, isIncoming)
+		return
+	}
+
+	if stream.ws != nil {
+		t.processWebSocket(stream, packet, isIncoming)
+		return
+	}
+
+	// Body of `Expect: 100-continue` request is sent after `100 Continue` response, so it has greater Ack
+	if parent := stream.expectedBodyRequest(packet, isIncoming); parent != nil {
+		if packet.Seq == parent.DataSeq {
+			// In case if non-first data chunks comes first
+			for _, m := range stream.messages {
+				if m.Ack == packet.Ack && bytes.Equal(m.packets[0].Addr, packet.Addr) {
 					t.deleteMessage(m)
+
 					if m.AssocMessage != nil {
-						message.AssocMessage = m.AssocMessage
+						m.AssocMessage.AssocMessage = nil
 					}
-					// log.Println("2: Adding ack alias:", m.Ack, packet.Ack)
-					t.ackAliases[m.Ack] = packet.Ack
 
 					for _, pkt := range m.packets {
-						pkt.UpdateAck(packet.Ack)
-						message.AddPacket(pkt)
+						pkt.UpdateAck(parent.Ack)
+						// Re-queue this packets
+						t.processHTTPData(stream, pkt, isIncoming)
 					}
+					m.release()
 				}
 			}
+		}
+
+		packet.UpdateAck(parent.Ack)
+	}
 
-			// Removing `Expect: 100-continue` header
-			packet.Data = append(packet.Data[:len(packet.Data)-24], packet.Data[len(packet.Data)-2:]...)
+	message, ok := t.messages[packet.ID]
 
-			// log.Println(string(packet.Data))
+	// Previous message is complete: packet starts next message of coalesced segment, or of keep-alive connection
+	if ok && (packet.messageStart || message.isNextMessage(packet)) {
+		if t.trackResponse && !message.IsIncoming && message.AssocMessage == nil {
+			t.parkResponse(message)
+		} else {
+			t.dispatchMessage(message)
 		}
+		ok = false
 	}
 
-	// log.Println("Received message:", string(message.Bytes()), message.ID(), t.messages)
+	if !ok {
+		message = NewTCPMessage(packet.Seq, packet.Ack, isIncoming)
+		message.stream = stream
+		message.maxSize = t.config.MaxMessageSize
+		t.messages[packet.ID] = message
+		stream.messages[packet.ID] = message
+		t.trackExpiry(message)
 
-	if isIncoming {
-		// If message have multiple packets, delete previous alias
-		if len(message.packets) > 1 {
-			delete(t.respAliases, message.ResponseAck)
+		if isIncoming {
+			if t.trackResponse {
+				t.trackRequest(stream, message)
+			}
+		} else if responseRequest := t.responseRequest(stream, packet); responseRequest != nil {
+			message.AssocMessage = responseRequest
+			// Pipelined request can be already dispatched
+			if t.messages[responseRequest.ID()] == responseRequest {
+				responseRequest.AssocMessage = message
+			}
+		} else {
+			t.trackOrphanResponse(stream, message)
 		}
+	}
 
+	// Adding packet to message
+	t.addPacket(message, packet)
+
+	if isIncoming {
+		t.checkExpectContinue(stream, message)
+	} else {
+		t.checkWebSocketAccept(stream, message)
+	}
+
+	// log.Println("Received message:", string(message.Bytes()), message.ID(), t.messages)
+
+	if isIncoming {
 		message.UpdateResponseAck()
-		t.respAliases[message.ResponseAck] = message
 	}
 
 	// If message contains only single packet immediately dispatch it
@@ -623,12 +1429,20 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 		if isIncoming {
 			// log.Println("I'm finished", string(message.Bytes()), message.ResponseID, t.messages)
 			if t.trackResponse {
-				if resp, ok := t.messages[message.ResponseID]; ok {
-					t.dispatchMessage(message)
-					if resp.IsFinished() {
-						t.dispatchMessage(resp)
+				resp, ok := t.messages[message.ResponseID]
+				if assoc := message.AssocMessage; assoc != nil && t.messages[assoc.ID()] == assoc {
+					resp, ok = assoc, true
+				} else if assoc == nil {
+					// Response captured before request
+					if waiting := t.waitingResponse(stream, message); waiting != nil {
+						resp, ok = waiting, true
 					}
 				}
+
+				if ok {
+					t.dispatchMessage(message)
+					t.dispatchResponse(resp)
+				}
 			} else {
 				t.dispatchMessage(message)
 			}
@@ -637,11 +1451,12 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 				return
 			}
 
-			if req, ok := t.messages[message.AssocMessage.ID()]; ok {
-				if req.IsFinished() {
-					t.dispatchMessage(req)
-					t.dispatchMessage(message)
-				}
+			if req := message.AssocMessage; t.messages[req.ID()] != req {
+				// Request is already dispatched, like pipelined one
+				t.dispatchMessage(message)
+			} else if req.IsFinished() {
+				t.dispatchMessage(req)
+				t.dispatchMessage(message)
 			}
 		}
 	}
@@ -661,15 +1476,14 @@ func (t *Listener) Receiver() chan *TCPMessage {
 	return t.messagesChan
 }
 
-func (t *Listener) Close() {
-	close(t.quit)
-	if t.conn != nil {
-		t.conn.Close()
-	}
-
-	for _, h := range t.pcapHandles {
-		h.Close()
-	}
+// ReceiverBatches returns channel of message batches, if ListenerConfig.BatchSize is set. Otherwise it returns nil.
+// When batches are used, Receiver() channel gets no messages, and is only closed when listener stops.
+func (t *Listener) ReceiverBatches() chan []*TCPMessage {
+	return t.batchesChan
+}
 
-	return
+// Close stops traffic capture. In-flight messages are dispatched to the Receiver() channel, which is closed afterwards.
+func (t *Listener) Close() {
+	t.cancel()
+	t.closeCapture()
 }
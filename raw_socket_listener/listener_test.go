@@ -2,8 +2,13 @@ package rawSocket
 
 import (
 	"bytes"
+	"context"
+	"github.com/buger/gor/proto"
+	"github.com/google/gopacket/pcap"
 	"log"
 	"math/rand"
+	"net"
+	"reflect"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -12,16 +17,16 @@ import (
 func TestRawListenerInput(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
 
 	respAck := reqPacket.Seq + uint32(len(reqPacket.Data))
-	respPacket := buildPacket(false, respAck, reqPacket.Seq+1, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+	respPacket := buildPacket(false, respAck, reqPacket.Seq+1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
 
-	listener.packetsChan <- reqPacket.Dump()
-	listener.packetsChan <- respPacket.Dump()
+	listener.packetsChan <- newPacketBuffer(reqPacket.Dump())
+	listener.packetsChan <- newPacketBuffer(respPacket.Dump())
 
 	select {
 	case req = <-listener.messagesChan:
@@ -49,12 +54,12 @@ func TestRawListenerInput(t *testing.T) {
 func TestRawListenerInputWithoutResponse(t *testing.T) {
 	var req *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, false, 10*time.Millisecond)
+	listener, _ := NewListener("", "0", engineTest, false, 10*time.Millisecond, &ListenerConfig{})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
 
-	listener.packetsChan <- reqPacket.Dump()
+	listener.packetsChan <- newPacketBuffer(reqPacket.Dump())
 
 	select {
 	case req = <-listener.messagesChan:
@@ -68,18 +73,189 @@ func TestRawListenerInputWithoutResponse(t *testing.T) {
 	}
 }
 
+func TestRawListenerStats(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+	// Response without request
+	respPacket := buildPacket(false, 100, 100, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+	listener.packetsChan <- newPacketBuffer(reqPacket.Dump())
+	listener.packetsChan <- newPacketBuffer(respPacket.Dump())
+
+	select {
+	case <-listener.messagesChan:
+	case <-time.After(20 * time.Millisecond):
+		t.Fatal("Should return request")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	stats := listener.Stats()
+
+	if stats.PacketsReceived != 2 {
+		t.Error("Should count received packets", stats.PacketsReceived)
+	}
+
+	if stats.MessagesDispatched != 1 {
+		t.Error("Should count dispatched messages", stats.MessagesDispatched)
+	}
+
+	if stats.MessagesExpired != 1 {
+		t.Error("Should count response without request as expired", stats.MessagesExpired)
+	}
+
+	if stats.MessagesInFlight != 0 {
+		t.Error("Should not have messages in flight", stats.MessagesInFlight)
+	}
+}
+
+func TestRawListenerMultiplePorts(t *testing.T) {
+	listener, _ := NewListener("", "8080,8081", engineTest, false, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	for _, port := range []uint16{8080, 8081} {
+		reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+		reqPacket.DestPort = port
+
+		listener.packetsChan <- newPacketBuffer(reqPacket.Dump())
+
+		select {
+		case req := <-listener.messagesChan:
+			if !req.IsIncoming {
+				t.Error("Should be request")
+			}
+
+			if req.Port() != port {
+				t.Error("Should track port message arrived on", req.Port(), port)
+			}
+		case <-time.After(time.Millisecond):
+			t.Error("Should return request immediately", port)
+			return
+		}
+	}
+
+	// Port which is not listened
+	respPacket := buildPacket(true, 2, 2, []byte("GET / HTTP/1.1\r\n\r\n"))
+	respPacket.DestPort = 9000
+
+	listener.packetsChan <- newPacketBuffer(respPacket.Dump())
+
+	select {
+	case <-listener.messagesChan:
+		t.Error("Should ignore packets to other ports")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRawListenerBPFFilter(t *testing.T) {
+	l := &Listener{config: &ListenerConfig{}}
+
+	if bpf := l.applyBPFFilter("tcp dst port 80"); bpf != "tcp dst port 80" {
+		t.Error("Should keep auto-generated filter", bpf)
+	}
+
+	l.bpfFilter = "and not src net 10.0.0.0/8"
+	if bpf := l.applyBPFFilter("tcp dst port 80"); bpf != "(tcp dst port 80) and not src net 10.0.0.0/8" {
+		t.Error("Should append filter", bpf)
+	}
+
+	l.bpfFilter = "tcp port 8080"
+	if bpf := l.applyBPFFilter("tcp dst port 80"); bpf != "tcp port 8080" {
+		t.Error("Should replace filter", bpf)
+	}
+}
+
+func TestRawListenerMatchNpcapDevices(t *testing.T) {
+	devices := []pcap.Interface{
+		{Name: `\Device\NPF_{6C8A4D4E-2D9B-4E0B-9A3A-0F1B2C3D4E5F}`, Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1")}}},
+		{Name: `\Device\NPF_Loopback`, Flags: pcapIfLoopback},
+	}
+
+	found, _ := matchDevices(devices, "6c8a4d4e-2d9b-4e0b-9a3a-0f1b2c3d4e5f")
+	if len(found) != 1 || found[0].Name != devices[0].Name || len(found[0].Addresses) != 0 {
+		t.Error("Should match Npcap device by GUID", found)
+	}
+
+	if found, _ = matchDevices(devices, "{6C8A4D4E-2D9B-4E0B-9A3A-0F1B2C3D4E5F}"); len(found) != 1 {
+		t.Error("Should match Npcap device by GUID in braces", found)
+	}
+
+	found, _ = matchDevices(devices, "127.0.0.1")
+	if len(found) != 1 || found[0].Name != devices[1].Name {
+		t.Error("Should match loopback adapter by loopback address", found)
+	}
+}
+
+func TestRawListenerSetFilter(t *testing.T) {
+	listener, _ := NewListener("", "80", engineTest, false, 0, &ListenerConfig{BPFFilter: "and not src net 10.0.0.0/8"})
+	defer listener.Close()
+
+	if err := listener.SetFilter("and src host 192.168.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if bpf := listener.applyBPFFilter("tcp dst port 80"); bpf != "(tcp dst port 80) and src host 192.168.0.1" {
+		t.Error("Should replace filter customization", bpf)
+	}
+}
+
+func TestRawListenerMatchDevices(t *testing.T) {
+	devices := []pcap.Interface{
+		{Name: "eth0", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1")}}},
+		{Name: "eth1", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.2")}}},
+		{Name: "span0"},
+		{Name: "any"},
+	}
+
+	names := func(interfaces []pcap.Interface) (result []string) {
+		for _, i := range interfaces {
+			result = append(result, i.Name)
+		}
+		return
+	}
+
+	if found, _ := matchDevices(devices, ""); len(found) != 2 {
+		t.Error("Should match all interfaces with IP", names(found))
+	}
+
+	found, _ := matchDevices(devices, "10.0.0.2")
+	if len(found) != 1 || found[0].Name != "eth1" || len(found[0].Addresses) == 0 {
+		t.Error("Should match interface by IP", names(found))
+	}
+
+	found, _ = matchDevices(devices, "span0")
+	if len(found) != 1 || found[0].Name != "span0" {
+		t.Error("Should match interface without IP by name", names(found))
+	}
+
+	found, _ = matchDevices(devices, "eth0,any,10.0.0.1")
+	if len(found) != 2 || found[0].Name != "eth0" || found[1].Name != "any" {
+		t.Error("Should match comma separated list of interfaces", names(found))
+	}
+
+	if len(found[0].Addresses) != 0 {
+		t.Error("Interfaces selected by name should not be filtered by address")
+	}
+
+	if _, err := matchDevices(devices, "eth2"); err == nil {
+		t.Error("Should return error if interface not found")
+	}
+}
+
 func TestRawListenerResponse(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
-	respPacket := buildPacket(false, 1+uint32(len(reqPacket.Data)), 2, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+	respPacket := buildPacket(false, 1+uint32(len(reqPacket.Data)), 2, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
 
 	// If response packet comes before request
-	listener.packetsChan <- respPacket.Dump()
-	listener.packetsChan <- reqPacket.Dump()
+	listener.packetsChan <- newPacketBuffer(respPacket.Dump())
+	listener.packetsChan <- newPacketBuffer(reqPacket.Dump())
 
 	select {
 	case req = <-listener.messagesChan:
@@ -111,7 +287,7 @@ func TestRawListenerResponse(t *testing.T) {
 func TestRawListener100Continue(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
 	defer listener.Close()
 
 	reqPacket1 := buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\n"))
@@ -122,14 +298,14 @@ func TestRawListener100Continue(t *testing.T) {
 	respPacket1 := buildPacket(false, 10, 3, []byte("HTTP/1.1 100 Continue\r\n"))
 
 	// panic(int(uint32(len(reqPacket1.Data)) + uint32(len(reqPacket2.Data)) + uint32(len(reqPacket3.Data))))
-	respPacket2 := buildPacket(false, reqPacket3.Seq+1 /* len of data */, 2, []byte("HTTP/1.1 200 OK\r\n"))
+	respPacket2 := buildPacket(false, reqPacket3.Seq+1 /* len of data */, 2, []byte("HTTP/1.1 200 OK\r\n\r\n"))
 
-	listener.packetsChan <- reqPacket1.Dump()
-	listener.packetsChan <- reqPacket2.Dump()
-	listener.packetsChan <- reqPacket3.Dump()
+	listener.packetsChan <- newPacketBuffer(reqPacket1.Dump())
+	listener.packetsChan <- newPacketBuffer(reqPacket2.Dump())
+	listener.packetsChan <- newPacketBuffer(reqPacket3.Dump())
 
-	listener.packetsChan <- respPacket1.Dump()
-	listener.packetsChan <- respPacket2.Dump()
+	listener.packetsChan <- newPacketBuffer(respPacket1.Dump())
+	listener.packetsChan <- newPacketBuffer(respPacket2.Dump())
 
 	select {
 	case req = <-listener.messagesChan:
@@ -168,7 +344,7 @@ func TestRawListener100Continue(t *testing.T) {
 func TestRawListener100ContinueWrongOrder(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
 	defer listener.Close()
 
 	reqPacket1 := buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\n"))
@@ -181,12 +357,12 @@ func TestRawListener100ContinueWrongOrder(t *testing.T) {
 	// panic(int(uint32(len(reqPacket1.Data)) + uint32(len(reqPacket2.Data)) + uint32(len(reqPacket3.Data))))
 	respPacket2 := buildPacket(false, reqPacket3.Seq+1 /* len of data */, 2, []byte("HTTP/1.1 200 OK\r\n"))
 
-	listener.packetsChan <- respPacket1.Dump()
-	listener.packetsChan <- respPacket2.Dump()
+	listener.packetsChan <- newPacketBuffer(respPacket1.Dump())
+	listener.packetsChan <- newPacketBuffer(respPacket2.Dump())
 
-	listener.packetsChan <- reqPacket1.Dump()
-	listener.packetsChan <- reqPacket2.Dump()
-	listener.packetsChan <- reqPacket3.Dump()
+	listener.packetsChan <- newPacketBuffer(reqPacket1.Dump())
+	listener.packetsChan <- newPacketBuffer(reqPacket2.Dump())
+	listener.packetsChan <- newPacketBuffer(reqPacket3.Dump())
 
 	select {
 	case req = <-listener.messagesChan:
@@ -225,7 +401,7 @@ func testChunkedSequence(t *testing.T, listener *Listener, packets ...*TCPPacket
 	var r, req, resp *TCPMessage
 
 	for _, p := range packets {
-		listener.packetsChan <- p.Dump()
+		listener.packetsChan <- newPacketBuffer(p.Dump())
 	}
 
 	select {
@@ -287,24 +463,14 @@ func testChunkedSequence(t *testing.T, listener *Listener, packets ...*TCPPacket
 		t.Fatal("messagesChan non empty:", <-listener.messagesChan)
 	}
 
-	if len(listener.messages) != 0 {
-		t.Fatal("Messages non empty:", listener.messages)
-	}
-
-	if len(listener.ackAliases) != 0 {
-		t.Fatal("ackAliases non empty:", listener.ackAliases)
-	}
-
-	if len(listener.seqWithData) != 0 {
-		t.Fatal("seqWithData non empty:", listener.seqWithData)
+	if len(listener.shards[0].messages) != 0 {
+		t.Fatal("Messages non empty:", listener.shards[0].messages)
 	}
 
-	if len(listener.respAliases) != 0 {
-		t.Fatal("respAliases non empty:", listener.respAliases)
-	}
-
-	if len(listener.respWithoutReq) != 0 {
-		t.Fatal("respWithoutReq non empty:", listener.respWithoutReq)
+	for _, stream := range listener.shards[0].streams {
+		if len(stream.messages) != 0 {
+			t.Fatal("Stream messages non empty:", stream.messages)
+		}
 	}
 }
 
@@ -325,7 +491,7 @@ func permutation(n int, list []*TCPPacket) []*TCPPacket {
 
 // Response comes before Request
 func TestRawListenerChunkedWrongOrder(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
 	defer listener.Close()
 
 	reqPacket1 := buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nExpect: 100-continue\r\n\r\n"))
@@ -403,7 +569,7 @@ func getMessage() []*TCPPacket {
 
 // Response comes before Request
 func TestRawListenerBench(t *testing.T) {
-	l := NewListener("", "0", EnginePcap, true, 200*time.Millisecond)
+	l, _ := NewListener("", "0", engineTest, true, 200*time.Millisecond, &ListenerConfig{})
 	defer l.Close()
 
 	// Should re-construct message from all possible combinations
@@ -428,7 +594,7 @@ func TestRawListenerBench(t *testing.T) {
 						}
 					}
 
-					l.packetsChan <- p.Dump()
+					l.packetsChan <- newPacketBuffer(p.Dump())
 					time.Sleep(time.Millisecond)
 				}
 
@@ -446,8 +612,435 @@ func TestRawListenerBench(t *testing.T) {
 		case <-ch:
 			atomic.AddInt32(&count, 1)
 		case <-time.After(2000 * time.Millisecond):
-			log.Println("Emitted 200000 messages, captured: ", count, len(l.ackAliases), len(l.seqWithData), len(l.respAliases), len(l.respWithoutReq), len(l.packetsChan))
+			log.Println("Emitted 200000 messages, captured: ", count, len(l.shards[0].messages), len(l.shards[0].streams), len(l.packetsChan))
 			return
 		}
 	}
 }
+
+func TestRawListenerUnknownEngine(t *testing.T) {
+	l, err := NewListener("", "80", 1<<10, false, 0, &ListenerConfig{})
+
+	if err == nil || l != nil {
+		t.Error("Should return error for unknown engine")
+	}
+}
+
+func TestRawListenerConfigCopy(t *testing.T) {
+	config := &ListenerConfig{}
+	listener, err := NewListener("", "80", engineTest, false, 0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	if !reflect.DeepEqual(config, &ListenerConfig{}) {
+		t.Errorf("Caller's config should not be changed: %+v", config)
+	}
+
+	if listener, err = NewListener("", "80", engineTest, false, 0, nil); err != nil {
+		t.Fatal("Should use defaults for nil config: ", err)
+	}
+	if listener.config.SnapLen != defaultSnapLen || listener.config.Protocol != ProtocolTCP {
+		t.Errorf("Defaults should be filled: %+v", listener.config)
+	}
+	listener.Close()
+}
+
+func TestRawListenerContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	listener, _ := NewListenerContext(ctx, "", "0", engineTest, true, time.Minute, &ListenerConfig{})
+
+	// Incomplete POST request, waiting for the body
+	reqPacket := buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n"))
+	listener.packetsChan <- newPacketBuffer(reqPacket.Dump())
+
+	cancel()
+
+	var messages []*TCPMessage
+	for m := range listener.Receiver() {
+		messages = append(messages, m)
+	}
+
+	if len(messages) != 1 || !messages[0].IsIncoming {
+		t.Error("Should dispatch in-flight request before closing", messages)
+	}
+
+	// Should be safe to call after cancel
+	listener.Close()
+}
+
+func TestRawListenerBackpressure(t *testing.T) {
+	for _, policy := range []string{BackpressureDropNewest, BackpressureDropOldest} {
+		listener, _ := NewListener("", "0", engineTest, false, 10*time.Millisecond, &ListenerConfig{MessagesBufferSize: 1, Backpressure: policy})
+
+		listener.packetsChan <- newPacketBuffer(buildPacket(true, 1, 1, []byte("GET /1 HTTP/1.1\r\n\r\n")).Dump())
+		listener.packetsChan <- newPacketBuffer(buildPacket(true, 2, 2, []byte("GET /2 HTTP/1.1\r\n\r\n")).Dump())
+
+		time.Sleep(20 * time.Millisecond)
+
+		if stats := listener.Stats(); stats.MessagesBufferDropped != 1 {
+			t.Error(policy, "Should count dropped messages", stats.MessagesBufferDropped)
+		}
+
+		expected := "GET /1"
+		if policy == BackpressureDropOldest {
+			expected = "GET /2"
+		}
+
+		if msg := <-listener.Receiver(); !bytes.HasPrefix(msg.Bytes(), []byte(expected)) {
+			t.Error(policy, "Wrong message kept:", string(msg.Bytes()))
+		}
+
+		listener.Close()
+	}
+
+	if _, err := NewListener("", "0", engineTest, false, 0, &ListenerConfig{Backpressure: "wrong"}); err == nil {
+		t.Error("Should return error on unknown policy")
+	}
+}
+
+func TestRawListenerBlockingClose(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Minute, &ListenerConfig{MessagesBufferSize: 1})
+
+	for i := uint32(1); i <= 3; i++ {
+		listener.packetsChan <- newPacketBuffer(buildPacket(true, i, i, []byte("GET / HTTP/1.1\r\n\r\n")).Dump())
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Nobody reads messages, closing should not wait for it
+	listener.Close()
+
+	deadline := time.After(time.Second)
+	for listener.Stats().MessagesBufferDropped != 2 {
+		select {
+		case <-deadline:
+			t.Fatal("Messages which can't be sent should be dropped on close", listener.Stats().MessagesBufferDropped)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if _, ok := <-listener.Receiver(); !ok {
+		t.Error("Should keep message sent before close")
+	}
+	if _, ok := <-listener.Receiver(); ok {
+		t.Error("Receiver should be closed")
+	}
+}
+
+func TestRawListenerConcurrentConnections(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	// Two connections with same SEQ and ACK values
+	for _, port := range []uint16{1, 2} {
+		reqPacket := buildConnPacket(true, port, 0, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\n"))
+		listener.packetsChan <- newPacketBuffer(reqPacket.Dump())
+	}
+
+	seq := uint32(1 + len("POST / HTTP/1.1\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\n"))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 2, 0, 2, seq, []byte("cd")).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 2, seq, []byte("ab")).Dump())
+
+	bodies := map[uint16]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case req := <-listener.messagesChan:
+			bodies[req.packets[0].SrcPort] = string(proto.Body(req.Bytes()))
+		case <-time.After(50 * time.Millisecond):
+			t.Fatal("Should return request")
+		}
+	}
+
+	if bodies[1] != "ab" || bodies[2] != "cd" {
+		t.Error("Should not mix connections", bodies)
+	}
+}
+
+func TestRawListenerConnectionClose(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	isn := uint32(0xFFFFFFF0)
+	request := []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	header := []byte("HTTP/1.1 200 OK\r\n\r\n")
+	respAck := 101 + uint32(len(request))
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fSYN, 0, 100, nil).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fSYN|fACK, 101, isn, nil).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fACK, isn+1, 101, request).Dump())
+
+	// Sequence number wraps in the middle of the message, and packets captured in wrong order
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fACK, respAck, isn+1+uint32(len(header)), []byte("body")).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fACK, respAck, isn+1, header).Dump())
+
+	select {
+	case <-listener.messagesChan:
+		t.Fatal("Response without Content-Length should wait for connection close")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fFIN|fACK, respAck, isn+5+uint32(len(header)), nil).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fFIN|fACK, isn+6+uint32(len(header)), respAck, nil).Dump())
+
+	if resp := receiveResponse(listener, 10*time.Millisecond); resp == nil {
+		t.Fatal("Should dispatch response when connection closed")
+	} else if !bytes.Equal(resp.Bytes(), append(header, "body"...)) {
+		t.Error("Should order packets by sequence", string(resp.Bytes()))
+	}
+
+	// Reset closes connection immediately
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 2, 0, 1, 1, request).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 2, 0, 1+uint32(len(request)), 1, header).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 2, fRST, 0, 1+uint32(len(request)), nil).Dump())
+
+	if receiveResponse(listener, 10*time.Millisecond) == nil {
+		t.Fatal("Should dispatch response on connection reset")
+	}
+}
+
+// receiveResponse skips requests dispatched by listener, and returns the first response, or nil on timeout
+func receiveResponse(listener *Listener, timeout time.Duration) *TCPMessage {
+	for {
+		select {
+		case m := <-listener.messagesChan:
+			if !m.IsIncoming {
+				return m
+			}
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+}
+
+// testConn sends segments of one connection, tracking sequence numbers of both sides
+type testConn struct {
+	listener             *Listener
+	clientSeq, serverSeq uint32
+}
+
+func (c *testConn) send(isIncoming bool, data []byte) {
+	if isIncoming {
+		c.listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fACK, c.serverSeq, c.clientSeq, data).Dump())
+		c.clientSeq += uint32(len(data))
+	} else {
+		c.listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fACK, c.clientSeq, c.serverSeq, data).Dump())
+		c.serverSeq += uint32(len(data))
+	}
+}
+
+// receiveMessages returns count messages dispatched by listener, each checked by described to be decoded by
+// protocol decoder, and fails if more messages follow
+func receiveMessages(t *testing.T, listener *Listener, count int, described func(*TCPMessage) bool) []*TCPMessage {
+	var messages []*TCPMessage
+
+	for i := 0; i < count; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if !described(m) {
+				t.Fatal("Should describe protocol message", m.Bytes())
+			}
+			messages = append(messages, m)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit requests and responses", i)
+		}
+	}
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Errorf("Unexpected message: %q", m.Bytes())
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	return messages
+}
+
+func TestRawListenerReorder(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{ReorderWindow: 10, ReorderTimeout: time.Second})
+	defer listener.Close()
+
+	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+	respAck := reqPacket.Seq + uint32(len(reqPacket.Data))
+
+	header := []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+	resp1 := buildPacket(false, respAck, 100, header)
+	resp2 := buildPacket(false, respAck, 100+uint32(len(header)), []byte("1\r\na\r\n"))
+	resp3 := buildPacket(false, respAck, resp2.Seq+6, []byte("0\r\n\r\n"))
+
+	// Last chunk captured before the middle one
+	for _, p := range []*TCPPacket{reqPacket, resp1, resp3, resp2} {
+		listener.packetsChan <- newPacketBuffer(p.Dump())
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if !m.IsIncoming && !bytes.Equal(m.Bytes(), append(header, "1\r\na\r\n0\r\n\r\n"...)) {
+				t.Error("Should assemble response in right order", string(m.Bytes()))
+			}
+		case <-time.After(50 * time.Millisecond):
+			t.Fatal("Should dispatch messages")
+		}
+	}
+}
+
+func TestRawListenerSeqWraparound(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	// Request crosses sequence space boundary
+	req1 := buildPacket(true, 1, 0xFFFFFFF0, []byte("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n"))
+	req2 := buildPacket(true, 1, req1.nextSeq(), []byte("body"))
+	resp := buildPacket(false, req2.nextSeq(), 1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+
+	for _, p := range []*TCPPacket{req2, req1, resp} {
+		listener.packetsChan <- newPacketBuffer(p.Dump())
+	}
+
+	var req *TCPMessage
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				req = m
+			} else if m.AssocMessage == nil || m.AssocMessage != req {
+				t.Error("Response should be associated with request")
+			}
+		case <-time.After(50 * time.Millisecond):
+			t.Fatal("Should dispatch request and response")
+		}
+	}
+
+	if req == nil || !bytes.Equal(req.Bytes(), append(req1.Data, req2.Data...)) {
+		t.Error("Should assemble request across wrapped sequence")
+	}
+}
+
+func TestRawListenerCoalescedSegment(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	req1 := []byte("POST /1 HTTP/1.1\r\nContent-Length: 1\r\n\r\na")
+	req2 := []byte("POST /2 HTTP/1.1\r\nContent-Length: 1\r\n\r\nb")
+
+	// Two requests coalesced into single segment
+	listener.packetsChan <- newPacketBuffer(buildPacket(true, 1, 1, append(append([]byte{}, req1...), req2...)).Dump())
+
+	var requests [][]byte
+	for {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				requests = append(requests, m.Bytes())
+			}
+			continue
+		case <-time.After(50 * time.Millisecond):
+		}
+		break
+	}
+
+	if len(requests) != 2 || !bytes.Equal(requests[0], req1) || !bytes.Equal(requests[1], req2) {
+		t.Errorf("Should emit each request separately: %q", requests)
+	}
+}
+
+func TestRawListenerMaxMessageSize(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{MaxMessageSize: 40})
+	defer listener.Close()
+
+	head := []byte("POST / HTTP/1.1\r\nContent-Length: 30\r\n\r\n")
+	body := bytes.Repeat([]byte("a"), 30)
+
+	listener.packetsChan <- newPacketBuffer(buildPacket(true, 1, 1, head).Dump())
+	listener.packetsChan <- newPacketBuffer(buildPacket(true, 1, 1+uint32(len(head)), body).Dump())
+
+	respAck := 1 + uint32(len(head)+len(body))
+	listener.packetsChan <- newPacketBuffer(buildPacket(false, respAck, 1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")).Dump())
+
+	var req, resp *TCPMessage
+	for req == nil || resp == nil {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				req = m
+			} else {
+				resp = m
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should emit request and response")
+		}
+	}
+
+	if !req.Truncated || req.Size() != 40 {
+		t.Error("Request should be truncated", req.Truncated, req.Size())
+	}
+
+	if resp.Truncated || resp.AssocMessage != req {
+		t.Error("Response should be associated with truncated request")
+	}
+}
+
+func TestRawListenerHalfClose(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{ReorderWindow: 8})
+	defer listener.Close()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	header := []byte("HTTP/1.1 200 OK\r\n\r\n")
+	respAck := 1 + uint32(len(request))
+	end := 101 + uint32(len(header)) + 4
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fSYN, 0, 0, nil).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fSYN|fACK, 1, 100, nil).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fACK, 101, 1, request).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fACK, respAck, 101, header).Dump())
+
+	// FIN captured before the last segment: should wait for it
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fFIN|fACK, respAck, end, nil).Dump())
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Fatalf("Should wait for missing data before FIN: %q", m.Bytes())
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fACK, respAck, 101+uint32(len(header)), []byte("body")).Dump())
+	// Retransmitted FIN, client side of connection is still open
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fFIN|fACK, respAck, end, nil).Dump())
+
+	if m := receiveResponse(listener, time.Second); m == nil {
+		t.Fatal("Should dispatch response when server closed its side of connection")
+	} else if !bytes.Equal(m.Bytes(), append(header, "body"...)) {
+		t.Errorf("Wrong response: %q", m.Bytes())
+	}
+}
+
+func TestRawListenerCaptureTimestamp(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, 10*time.Millisecond, &ListenerConfig{})
+	defer listener.Close()
+
+	ts := time.Unix(1500000000, 123456789)
+
+	req := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+	req.Timestamp = ts
+	resp := buildPacket(false, 1+uint32(len(req.Data)), 1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	resp.Timestamp = ts.Add(1500 * time.Microsecond)
+
+	listener.packetsChan <- newPacketBuffer(req.Dump())
+	listener.packetsChan <- newPacketBuffer(resp.Dump())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming && m.CaptureStart.UnixNano() != ts.UnixNano() {
+				t.Error("Request should keep capture timestamp", m.CaptureStart.UnixNano())
+			}
+
+			if !m.IsIncoming && m.CaptureEnd.Sub(m.AssocMessage.CaptureStart) != 1500*time.Microsecond {
+				t.Error("Wrong response latency", m.CaptureEnd.Sub(m.AssocMessage.CaptureStart))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should dispatch messages")
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Package loadgen generates synthetic HTTP conversations and passes them directly to the raw listener,
+// bypassing network capture, so reassembly and outputs can be measured reproducibly.
+package loadgen
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+// TCP flags of generated packets
+const (
+	flagFIN = 1 << 0
+	flagSYN = 1 << 1
+	flagPSH = 1 << 3
+	flagACK = 1 << 4
+)
+
+// Default maximum size of generated segment data
+const defaultMSS = 1460
+
+// ErrStopped returned if listener was stopped before all packets were generated
+var ErrStopped = errors.New("loadgen: listener stopped")
+
+// Config of generated traffic
+type Config struct {
+	// Number of concurrent connections, each generated by own goroutine. If 0, one.
+	Connections int
+	// Number of requests sent over connection before it is closed. If 0 or 1, connections are not kept alive.
+	RequestsPerConnection int
+
+	// Size of request body in bytes. Requests with body are sent as POST, otherwise as GET.
+	RequestSize int
+	// Size of response body in bytes
+	ResponseSize int
+	// Maximum size of segment data, larger messages are split into multiple packets. 1460 by default.
+	MSS int
+
+	// Port requests are sent to, should be listened by the listener
+	Port uint16
+}
+
+// Generator passes generated traffic to the listener
+type Generator struct {
+	config   Config
+	listener *raw.Listener
+
+	request, response []byte
+}
+
+// New creates generator of traffic for the listener, usually started with raw.EngineInject engine
+func New(listener *raw.Listener, config Config) *Generator {
+	if config.Connections == 0 {
+		config.Connections = 1
+	}
+
+	if config.RequestsPerConnection == 0 {
+		config.RequestsPerConnection = 1
+	}
+
+	if config.MSS == 0 {
+		config.MSS = defaultMSS
+	}
+
+	g := &Generator{config: config, listener: listener}
+
+	if config.RequestSize > 0 {
+		g.request = message("POST / HTTP/1.1\r\nHost: loadgen\r\nContent-Length: ", config.RequestSize)
+	} else {
+		g.request = []byte("GET / HTTP/1.1\r\nHost: loadgen\r\n\r\n")
+	}
+
+	g.response = message("HTTP/1.1 200 OK\r\nContent-Length: ", config.ResponseSize)
+
+	return g
+}
+
+func message(start string, size int) []byte {
+	buf := []byte(start)
+	buf = strconv.AppendInt(buf, int64(size), 10)
+	buf = append(buf, "\r\n\r\n"...)
+
+	return append(buf, bytes.Repeat([]byte("a"), size)...)
+}
+
+// Run generates `requests` request and response pairs, spread between concurrent connections.
+// Returns when all packets are passed to the listener, they still may be in processing.
+func (g *Generator) Run(requests int) error {
+	var wg sync.WaitGroup
+	var stopped bool
+	var mu sync.Mutex
+
+	for i := 0; i < g.config.Connections; i++ {
+		// Requests are spread evenly, first connections get the remainder
+		n := requests / g.config.Connections
+		if i < requests%g.config.Connections {
+			n++
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i, n int) {
+			defer wg.Done()
+
+			if !g.connections(i, n) {
+				mu.Lock()
+				stopped = true
+				mu.Unlock()
+			}
+		}(i, n)
+	}
+
+	wg.Wait()
+
+	if stopped {
+		return ErrStopped
+	}
+
+	return nil
+}
+
+// connections sends `requests` requests from the client `id`, opening new connection after each RequestsPerConnection requests
+func (g *Generator) connections(id, requests int) bool {
+	c := &conn{
+		generator: g,
+		clientIP:  []byte{10, 0, byte(id >> 8), byte(id)},
+		serverIP:  []byte{10, 255, 0, 1},
+	}
+
+	for sent := 0; sent < requests; {
+		c.clientPort++
+		if c.clientPort < 1024 {
+			c.clientPort = 1024
+		}
+
+		n := g.config.RequestsPerConnection
+		if n > requests-sent {
+			n = requests - sent
+		}
+
+		if !c.run(n) {
+			return false
+		}
+
+		sent += n
+	}
+
+	return true
+}
+
+// conn is state of generated connection
+type conn struct {
+	generator *Generator
+
+	clientIP, serverIP []byte
+	clientPort         uint16
+
+	clientSeq, serverSeq uint32
+}
+
+// run generates connection with `requests` request and response pairs
+func (c *conn) run(requests int) bool {
+	c.clientSeq, c.serverSeq = uint32(c.clientPort)<<16, uint32(c.clientPort)<<8
+
+	// Handshake
+	if !c.send(true, flagSYN, nil) || !c.send(false, flagSYN|flagACK, nil) {
+		return false
+	}
+
+	for i := 0; i < requests; i++ {
+		if !c.sendMessage(true, c.generator.request) || !c.sendMessage(false, c.generator.response) {
+			return false
+		}
+	}
+
+	return c.send(true, flagFIN|flagACK, nil) && c.send(false, flagFIN|flagACK, nil)
+}
+
+// sendMessage splits data into segments of maximum size
+func (c *conn) sendMessage(incoming bool, data []byte) bool {
+	mss := c.generator.config.MSS
+
+	for len(data) > 0 {
+		n := mss
+		if n > len(data) {
+			n = len(data)
+		}
+
+		flags := flagACK
+		if n == len(data) {
+			flags |= flagPSH
+		}
+
+		if !c.send(incoming, uint16(flags), data[:n]) {
+			return false
+		}
+
+		data = data[n:]
+	}
+
+	return true
+}
+
+// send passes single packet to the listener, and advances sequence numbers
+func (c *conn) send(incoming bool, flags uint16, data []byte) bool {
+	packet := &raw.TCPPacket{Flags: flags, Data: data}
+
+	if incoming {
+		packet.Addr, packet.DstAddr = c.clientIP, c.serverIP
+		packet.SrcPort, packet.DestPort = c.clientPort, c.generator.config.Port
+		packet.Seq, packet.Ack = c.clientSeq, c.serverSeq
+	} else {
+		packet.Addr, packet.DstAddr = c.serverIP, c.clientIP
+		packet.SrcPort, packet.DestPort = c.generator.config.Port, c.clientPort
+		packet.Seq, packet.Ack = c.serverSeq, c.clientSeq
+	}
+
+	// SYN and FIN occupy one sequence number
+	next := uint32(len(data))
+	if flags&(flagSYN|flagFIN) != 0 {
+		next++
+	}
+
+	if incoming {
+		c.clientSeq += next
+	} else {
+		c.serverSeq += next
+	}
+
+	return c.generator.listener.Inject(packet.Dump())
+}
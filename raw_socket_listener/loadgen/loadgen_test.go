@@ -0,0 +1,97 @@
+package loadgen
+
+import (
+	"testing"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+// receive counts requests and responses received from the listener, until `count` messages or timeout
+func receive(listener *raw.Listener, count int, timeout time.Duration) (requests, responses int) {
+	ch := listener.Receiver()
+
+	for requests+responses < count {
+		select {
+		case m := <-ch:
+			if m.IsIncoming {
+				requests++
+			} else {
+				responses++
+			}
+		case <-time.After(timeout):
+			return
+		}
+	}
+
+	return
+}
+
+func TestGenerator(t *testing.T) {
+	listener, _ := raw.NewListener("", "80", raw.EngineInject, true, time.Second, &raw.ListenerConfig{})
+	defer listener.Close()
+
+	g := New(listener, Config{
+		Connections:           4,
+		RequestsPerConnection: 10,
+		RequestSize:           3000,
+		ResponseSize:          100,
+		Port:                  80,
+	})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- g.Run(100) }()
+
+	requests, responses := receive(listener, 200, time.Second)
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 100 || responses != 100 {
+		t.Error("Should receive all generated messages", requests, responses)
+	}
+}
+
+func TestGeneratorStopped(t *testing.T) {
+	listener, _ := raw.NewListener("", "80", raw.EngineInject, true, time.Second, &raw.ListenerConfig{})
+	listener.Close()
+
+	if err := New(listener, Config{Port: 80}).Run(10); err != ErrStopped {
+		t.Error("Should stop when listener is closed", err)
+	}
+}
+
+func benchmarkGenerator(b *testing.B, config Config) {
+	listener, _ := raw.NewListener("", "80", raw.EngineInject, true, time.Second, &raw.ListenerConfig{})
+	defer listener.Close()
+
+	config.Port = 80
+	g := New(listener, config)
+
+	b.SetBytes(int64(len(g.request) + len(g.response)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go g.Run(b.N)
+
+	if requests, responses := receive(listener, 2*b.N, 5*time.Second); requests != b.N || responses != b.N {
+		b.Fatal("Should receive all generated messages", requests, responses)
+	}
+}
+
+func BenchmarkGET(b *testing.B) {
+	benchmarkGenerator(b, Config{Connections: 1, ResponseSize: 100})
+}
+
+func BenchmarkKeepAlive(b *testing.B) {
+	benchmarkGenerator(b, Config{Connections: 1, RequestsPerConnection: 100, ResponseSize: 100})
+}
+
+func BenchmarkConcurrent(b *testing.B) {
+	benchmarkGenerator(b, Config{Connections: 16, RequestsPerConnection: 10, ResponseSize: 100})
+}
+
+func BenchmarkLargeBody(b *testing.B) {
+	benchmarkGenerator(b, Config{Connections: 4, RequestsPerConnection: 10, RequestSize: 64 * 1024, ResponseSize: 16 * 1024})
+}
@@ -0,0 +1,532 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With ProtocolMemcached connections are decoded as memcached text or binary protocol, detected by the first byte
+// sent by client. Each command, including its data block, is emitted as request holding it as sent, and each reply
+// is emitted as response of the command. Text replies are matched to commands in order, commands with noreply option
+// get no reply. Quiet meta commands get reply only sometimes, so commands waiting for reply are resynchronized by
+// reply of meta no-op command, which clients send after quiet commands. Binary replies are matched to commands by
+// opaque field, commands skipped by reply are quiet ones which succeeded. Connections with missing segments, or data
+// not looking like memcached protocol, are not decoded anymore.
+
+// Maximum size of text command or reply line
+const mcMaxLineSize = 8 * 1024
+
+// Maximum size of key, keys are limited to 250 bytes by memcached
+const mcMaxKeySize = 250
+
+// Binary protocol constants: magic bytes of requests and responses, and header size
+const (
+	mcBinaryRequest    = 0x80
+	mcBinaryResponse   = 0x81
+	mcBinaryHeaderSize = 24
+)
+
+// Binary stat command is replied by response per statistic, and response without key ends them
+const mcBinaryStat = 0x10
+
+// Names of binary commands by opcode
+var mcBinaryCommands = map[byte]string{
+	0x00: "get", 0x01: "set", 0x02: "add", 0x03: "replace", 0x04: "delete", 0x05: "increment", 0x06: "decrement",
+	0x07: "quit", 0x08: "flush", 0x09: "getq", 0x0a: "noop", 0x0b: "version", 0x0c: "getk", 0x0d: "getkq",
+	0x0e: "append", 0x0f: "prepend", 0x10: "stat", 0x11: "setq", 0x12: "addq", 0x13: "replaceq", 0x14: "deleteq",
+	0x15: "incrementq", 0x16: "decrementq", 0x17: "quitq", 0x18: "flushq", 0x19: "appendq", 0x1a: "prependq",
+	0x1b: "verbosity", 0x1c: "touch", 0x1d: "gat", 0x1e: "gatq", 0x20: "sasl_list_mechs", 0x21: "sasl_auth",
+	0x22: "sasl_step",
+}
+
+// Binary get commands, successful reply of which returns value
+var mcBinaryGet = map[byte]bool{0x00: true, 0x09: true, 0x0c: true, 0x0d: true, 0x1d: true, 0x1e: true}
+
+// Names of binary response statuses
+var mcBinaryStatus = map[uint16]string{
+	0x00: "NO_ERROR", 0x01: "KEY_NOT_FOUND", 0x02: "KEY_EXISTS", 0x03: "VALUE_TOO_LARGE", 0x04: "INVALID_ARGUMENTS",
+	0x05: "ITEM_NOT_STORED", 0x06: "NON_NUMERIC_VALUE", 0x20: "AUTH_ERROR", 0x21: "AUTH_CONTINUE",
+	0x81: "UNKNOWN_COMMAND", 0x82: "OUT_OF_MEMORY",
+}
+
+// Text storage commands, followed by data block
+var mcStorageCommands = map[string]bool{
+	"set": true, "add": true, "replace": true, "append": true, "prepend": true, "cas": true,
+}
+
+// Text commands having single key as the first argument
+var mcKeyCommands = map[string]bool{
+	"delete": true, "incr": true, "decr": true, "touch": true, "mg": true, "md": true, "ma": true, "me": true,
+}
+
+// MemcachedCommand describes message holding memcached command, or its reply
+type MemcachedCommand struct {
+	// Connection uses binary protocol
+	Binary bool
+
+	// Command name in lower case, like "get" or "set", binary commands are named by opcode, like "getq". First key
+	// of the command, and number of keys, which can be more than one for get commands.
+	Command string
+	Key     []byte
+	Keys    int
+
+	// Reply fields: status, like "STORED", "END" or "NOT_FOUND", or binary status, like "KEY_NOT_FOUND", and number
+	// of values returned. Replies of incr and decr holding the new value have no status.
+	Status string
+	Hits   int
+}
+
+// memcachedConn holds decoding state of single connection
+type memcachedConn struct {
+	client, server mcDirection
+
+	// Protocol is detected by the first byte sent by client
+	detected bool
+	binary   bool
+
+	// Commands waiting for replies, in order
+	pending []*mcPending
+
+	// Number of commands, it keeps UUIDs of commands sent in the same segment distinct
+	commands uint32
+
+	// Decoding failed, like because of missing segment, and message boundaries are lost
+	broken bool
+}
+
+type mcPending struct {
+	request *TCPMessage
+	command *MemcachedCommand
+
+	// Opaque field of binary command, replies have the same one
+	opaque uint32
+}
+
+// mcDirection holds state of messages sent by one side of connection
+type mcDirection struct {
+	streamPosition
+
+	// Not complete text line, or binary header
+	line []byte
+	// Bytes of data block or binary body left to receive
+	data int64
+
+	// Message being received, command or reply fields, and whether message is complete once data is received
+	message  *TCPMessage
+	command  *MemcachedCommand
+	complete bool
+
+	// Binary message fields: opaque, opcode, and key position within body, and position of data being received
+	opaque   uint32
+	opcode   byte
+	keyStart int64
+	keyEnd   int64
+	pos      int64
+
+	// Command gets no reply
+	noreply bool
+}
+
+// feed parses commands and replies of the segment, and emits ones which are complete
+func (c *memcachedConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if gap > 0 {
+		// Message boundaries are unknown after missing data
+		t.breakMemcached(c)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	if !c.detected {
+		// Replies sent before the first captured command can't be matched to commands
+		if !isIncoming {
+			return
+		}
+		c.detected, c.binary = true, data[0] == mcBinaryRequest
+	}
+
+	for len(data) > 0 && !c.broken {
+		if d.message == nil {
+			t.newMemcachedMessage(c, d, packet, isIncoming)
+		}
+		d.message.updateCaptureTime(packet.Timestamp)
+
+		if d.data > 0 {
+			n := int64(len(data))
+			if n > d.data {
+				n = d.data
+			}
+
+			d.appendRaw(data[:n], t.config.MaxMessageSize)
+			if c.binary {
+				d.collectKey(data[:n])
+			}
+			d.data -= n
+			data = data[n:]
+		} else if c.binary {
+			n := mcBinaryHeaderSize - len(d.line)
+			if n > len(data) {
+				n = len(data)
+			}
+
+			d.line = append(d.line, data[:n]...)
+			d.appendRaw(data[:n], t.config.MaxMessageSize)
+			data = data[n:]
+
+			if len(d.line) < mcBinaryHeaderSize {
+				return
+			}
+
+			ok := d.parseBinaryHeader(d.line, isIncoming)
+			d.line = d.line[:0]
+			if !ok {
+				t.breakMemcached(c)
+				return
+			}
+		} else {
+			i := bytes.IndexByte(data, '\n')
+			if i == -1 {
+				d.line = append(d.line, data...)
+				d.appendRaw(data, t.config.MaxMessageSize)
+				if len(d.line) > mcMaxLineSize {
+					t.breakMemcached(c)
+				}
+				return
+			}
+
+			line := append(d.line, data[:i+1]...)
+			d.appendRaw(data[:i+1], t.config.MaxMessageSize)
+			d.line = d.line[:0]
+			data = data[i+1:]
+
+			if !d.parseTextLine(line, isIncoming) {
+				t.breakMemcached(c)
+				return
+			}
+		}
+
+		if d.data == 0 && d.complete {
+			t.finishMemcached(c, isIncoming)
+		}
+	}
+}
+
+func (t *shard) newMemcachedMessage(c *memcachedConn, d *mcDirection, packet *TCPPacket, isIncoming bool) {
+	ack := packet.Ack
+	if isIncoming {
+		c.commands++
+		ack += c.commands
+	}
+
+	d.message = NewTCPMessage(packet.Seq, ack, isIncoming)
+	d.message.packets = []*TCPPacket{packet.headerCopy()}
+	d.command = &MemcachedCommand{Binary: c.binary}
+	d.complete, d.noreply = false, false
+}
+
+// appendRaw adds message bytes, discarding ones beyond maximum message size
+func (d *mcDirection) appendRaw(data []byte, maxSize int) {
+	m := d.message
+	if m.Truncated {
+		return
+	}
+
+	p := m.packets[0]
+	if maxSize > 0 && len(p.Data)+len(data) > maxSize {
+		data = data[:maxSize-len(p.Data)]
+		m.Truncated = true
+	}
+
+	p.Data = append(p.Data, data...)
+	m.size = len(p.Data)
+}
+
+// parseTextLine handles line of text command or reply. Returns false if data is not memcached text protocol.
+func (d *mcDirection) parseTextLine(line []byte, isIncoming bool) bool {
+	line = bytes.TrimRight(line, "\r\n")
+
+	for _, b := range line {
+		if b < 0x20 && b != '\t' || b == 0x7f {
+			return false
+		}
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	if isIncoming {
+		return d.parseTextCommand(fields)
+	}
+
+	r := d.command
+	switch word := string(fields[0]); word {
+	case "VALUE":
+		// VALUE <key> <flags> <bytes> [<cas unique>], followed by data block, and more values or END
+		if len(fields) < 4 || !d.setDataSize(fields[3]) {
+			return false
+		}
+		r.Hits++
+	case "VA":
+		// Value of meta get: VA <size> <flags>*, followed by data block
+		if len(fields) < 2 || !d.setDataSize(fields[1]) {
+			return false
+		}
+		r.Hits++
+		r.Status = word
+		d.complete = true
+	case "STAT", "ITEM":
+		// Statistics are sent until END
+	default:
+		if _, err := strconv.ParseUint(word, 10, 64); err != nil {
+			r.Status = word
+		}
+		d.complete = true
+	}
+
+	return true
+}
+
+// parseTextCommand handles line of text command, storage commands are complete once data block is received
+func (d *mcDirection) parseTextCommand(fields [][]byte) bool {
+	c := d.command
+	c.Command = strings.ToLower(string(fields[0]))
+	args := fields[1:]
+
+	var keys [][]byte
+
+	switch name := c.Command; {
+	case mcStorageCommands[name]:
+		// <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+		if len(args) < 4 || !d.setDataSize(args[3]) {
+			return false
+		}
+		keys = args[:1]
+	case name == "ms":
+		// ms <key> <datalen> <flags>*
+		if len(args) < 2 || !d.setDataSize(args[1]) {
+			return false
+		}
+		keys = args[:1]
+	case name == "get" || name == "gets":
+		keys = args
+	case name == "gat" || name == "gats":
+		// gat <exptime> <key>*
+		if len(args) > 0 {
+			keys = args[1:]
+		}
+	case mcKeyCommands[name]:
+		if len(args) > 0 {
+			keys = args[:1]
+		}
+	case name == "quit":
+		d.noreply = true
+	}
+
+	if len(args) > 0 && string(args[len(args)-1]) == "noreply" {
+		d.noreply = true
+	}
+
+	if len(keys) > 0 {
+		c.Key = append([]byte{}, keys[0]...)
+		if len(c.Key) > mcMaxKeySize {
+			c.Key = c.Key[:mcMaxKeySize]
+		}
+	}
+	c.Keys = len(keys)
+	d.complete = true
+
+	return true
+}
+
+// setDataSize sets size of data block following the line, data block ends with CRLF
+func (d *mcDirection) setDataSize(size []byte) bool {
+	n, err := strconv.ParseInt(string(size), 10, 64)
+	if err != nil || n < 0 {
+		return false
+	}
+
+	d.data = n + 2
+	return true
+}
+
+// parseBinaryHeader handles header of binary command or reply, message is complete once body is received. Returns
+// false if data is not memcached binary protocol.
+func (d *mcDirection) parseBinaryHeader(h []byte, isIncoming bool) bool {
+	magic := byte(mcBinaryResponse)
+	if isIncoming {
+		magic = mcBinaryRequest
+	}
+	if h[0] != magic {
+		return false
+	}
+
+	keyLen := int64(binary.BigEndian.Uint16(h[2:4]))
+	extrasLen := int64(h[4])
+	bodyLen := int64(binary.BigEndian.Uint32(h[8:12]))
+	if keyLen+extrasLen > bodyLen {
+		return false
+	}
+
+	d.opcode = h[1]
+	d.opaque = binary.BigEndian.Uint32(h[12:16])
+	d.data, d.pos = bodyLen, 0
+	d.keyStart, d.keyEnd = extrasLen, extrasLen+keyLen
+	d.complete = true
+
+	c := d.command
+	if isIncoming {
+		c.Command = mcBinaryCommands[d.opcode]
+		if c.Command == "" {
+			c.Command = "0x" + strconv.FormatUint(uint64(d.opcode), 16)
+		}
+		if keyLen > 0 {
+			c.Keys = 1
+		}
+		// Quiet quit closes connection without reply
+		d.noreply = d.opcode == 0x17
+
+		return true
+	}
+
+	status := binary.BigEndian.Uint16(h[6:8])
+	c.Status = mcBinaryStatus[status]
+	if c.Status == "" {
+		c.Status = "0x" + strconv.FormatUint(uint64(status), 16)
+	}
+	if status == 0 && mcBinaryGet[d.opcode] {
+		c.Hits++
+	}
+
+	// Statistics are sent until response without key
+	if d.opcode == mcBinaryStat && keyLen > 0 {
+		d.complete = false
+	}
+
+	return true
+}
+
+// collectKey keeps key of binary command, located after extras in the body
+func (d *mcDirection) collectKey(data []byte) {
+	start, end := d.pos, d.pos+int64(len(data))
+	d.pos = end
+
+	if !d.message.IsIncoming || end <= d.keyStart || start >= d.keyEnd {
+		return
+	}
+
+	from, to := d.keyStart-start, d.keyEnd-start
+	if from < 0 {
+		from = 0
+	}
+	if to > int64(len(data)) {
+		to = int64(len(data))
+	}
+
+	if len(d.command.Key) < mcMaxKeySize {
+		d.command.Key = append(d.command.Key, data[from:to]...)
+	}
+}
+
+// finishMemcached emits command, or reply as response of the matching command
+func (t *shard) finishMemcached(c *memcachedConn, isIncoming bool) {
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	message, command := d.message, d.command
+	d.message, d.command = nil, nil
+	message.End = time.Now()
+	message.Memcached = command
+
+	if isIncoming {
+		t.emit(message)
+
+		if t.trackResponse && !d.noreply {
+			c.pending = append(c.pending, &mcPending{request: message, command: command, opaque: d.opaque})
+		}
+		return
+	}
+
+	p := c.matchMemcachedReply(d, command)
+	if p == nil {
+		return
+	}
+
+	reply := *p.command
+	reply.Status, reply.Hits = command.Status, command.Hits
+
+	message.AssocMessage = p.request
+	message.Memcached = &reply
+
+	t.emit(message)
+}
+
+// matchMemcachedReply removes command matching the reply from pending ones. Commands before it, which got no reply,
+// are removed as well.
+func (c *memcachedConn) matchMemcachedReply(d *mcDirection, reply *MemcachedCommand) *mcPending {
+	i := -1
+
+	switch {
+	case c.binary:
+		for j, p := range c.pending {
+			if p.opaque == d.opaque {
+				i = j
+				break
+			}
+		}
+	case reply.Status == "MN":
+		for j, p := range c.pending {
+			if p.command.Command == "mn" {
+				i = j
+				break
+			}
+		}
+	case len(c.pending) > 0 && c.pending[0].command.Command != "mn":
+		// Other replies expected before reply of no-op are ones of quiet commands, which were skipped otherwise
+		i = 0
+	}
+
+	if i == -1 {
+		return nil
+	}
+
+	p := c.pending[i]
+	c.pending = c.pending[i+1:]
+
+	return p
+}
+
+// breakMemcached stops decoding of connection, messages in progress and replies not received yet are discarded
+func (t *shard) breakMemcached(c *memcachedConn) {
+	atomic.AddUint64(&t.stats.messagesExpired, uint64(len(c.pending)))
+	c.pending = nil
+
+	for _, d := range []*mcDirection{&c.client, &c.server} {
+		d.line, d.message, d.command = nil, nil, nil
+	}
+
+	c.broken = true
+}
+
+// close discards messages in progress once connection is closed
+func (c *memcachedConn) close(t *shard, stream *tcpStream) {
+	t.breakMemcached(c)
+}
@@ -0,0 +1,122 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func mcTestBinary(magic, opcode byte, status uint16, opaque uint32, extras, key, value string) []byte {
+	msg := make([]byte, mcBinaryHeaderSize)
+	msg[0], msg[1], msg[4] = magic, opcode, byte(len(extras))
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(key)))
+	binary.BigEndian.PutUint16(msg[6:], status)
+	binary.BigEndian.PutUint32(msg[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(msg[12:], opaque)
+
+	return append(msg, extras+key+value...)
+}
+
+func TestRawListenerMemcachedText(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMemcached})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Data block is split between segments
+	set := "set foo 0 0 5\r\nhello\r\n"
+	c.send(true, []byte(set[:18]))
+	c.send(true, []byte(set[18:]))
+	c.send(false, []byte("STORED\r\n"))
+
+	c.send(true, []byte("get foo bar\r\ndelete bar noreply\r\nincr n 1\r\n"))
+	c.send(false, []byte("VALUE foo 0 5\r\nhello\r\nEND\r\n12\r\n"))
+
+	// Quiet meta get gets no reply on miss, and no-op reply resynchronizes commands
+	c.send(true, []byte("mg a v q\r\nmg b v q\r\nmn\r\n"))
+	c.send(false, []byte("VA 1\r\nx\r\nMN\r\n"))
+
+	messages := receiveMessages(t, listener, 12, func(m *TCPMessage) bool { return m.Memcached != nil })
+
+	if m := messages[0]; !m.IsIncoming || m.Memcached.Command != "set" || string(m.Memcached.Key) != "foo" || string(m.Bytes()) != set {
+		t.Errorf("Should emit storage command with data: %q %+v", m.Bytes(), m.Memcached)
+	}
+
+	if m := messages[1]; m.AssocMessage != messages[0] || m.Memcached.Status != "STORED" || m.Memcached.Command != "set" {
+		t.Errorf("Should emit reply of storage command: %q %+v", m.Bytes(), m.Memcached)
+	}
+
+	if m := messages[2]; m.Memcached.Command != "get" || m.Memcached.Keys != 2 || string(m.Memcached.Key) != "foo" {
+		t.Errorf("Should emit get command: %+v", m.Memcached)
+	}
+
+	if m := messages[3]; m.Memcached.Command != "delete" {
+		t.Errorf("Should emit command with noreply: %+v", m.Memcached)
+	}
+
+	if m := messages[5]; m.AssocMessage != messages[2] || m.Memcached.Hits != 1 || m.Memcached.Status != "END" || string(m.Bytes()) != "VALUE foo 0 5\r\nhello\r\nEND\r\n" {
+		t.Errorf("Should emit values: %q %+v", m.Bytes(), m.Memcached)
+	}
+
+	if m := messages[6]; m.AssocMessage != messages[4] || m.Memcached.Status != "" || string(m.Bytes()) != "12\r\n" {
+		t.Errorf("Should emit reply of incr: %q %+v", m.Bytes(), m.Memcached)
+	}
+
+	if m := messages[10]; m.AssocMessage != messages[7] || m.Memcached.Status != "VA" || m.Memcached.Hits != 1 {
+		t.Errorf("Should emit reply of quiet command: %+v", m.Memcached)
+	}
+
+	if m := messages[11]; m.AssocMessage != messages[9] || m.Memcached.Status != "MN" {
+		t.Errorf("Should emit reply of no-op: %+v", m.Memcached)
+	}
+}
+
+func TestRawListenerMemcachedBinary(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMemcached})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Quiet get hits, quiet set succeeds, and no-op ends the pipeline
+	getq := mcTestBinary(mcBinaryRequest, 0x09, 0, 1, "", "foo", "")
+	setq := mcTestBinary(mcBinaryRequest, 0x11, 0, 2, "\x00\x00\x00\x00\x00\x00\x00\x00", "bar", "value")
+	noop := mcTestBinary(mcBinaryRequest, 0x0a, 0, 3, "", "", "")
+	c.send(true, append(append(getq, setq...), noop[:10]...))
+	c.send(true, noop[10:])
+
+	hit := mcTestBinary(mcBinaryResponse, 0x09, 0, 1, "\x00\x00\x00\x00", "", "hello")
+	c.send(false, append(hit, mcTestBinary(mcBinaryResponse, 0x0a, 0, 3, "", "", "")...))
+
+	c.send(true, mcTestBinary(mcBinaryRequest, 0x10, 0, 4, "", "", ""))
+	c.send(false, append(mcTestBinary(mcBinaryResponse, 0x10, 0, 4, "", "pid", "1"), mcTestBinary(mcBinaryResponse, 0x10, 0, 4, "", "", "")...))
+
+	messages := receiveMessages(t, listener, 7, func(m *TCPMessage) bool { return m.Memcached != nil })
+
+	if m := messages[1]; m.Memcached.Command != "setq" || !m.Memcached.Binary || string(m.Memcached.Key) != "bar" || string(m.Bytes()) != string(setq) {
+		t.Errorf("Should emit binary command: %q %+v", m.Bytes(), m.Memcached)
+	}
+
+	if m := messages[3]; m.AssocMessage != messages[0] || m.Memcached.Hits != 1 || m.Memcached.Status != "NO_ERROR" || string(m.Bytes()) != string(hit) {
+		t.Errorf("Should match reply by opaque: %q %+v", m.Bytes(), m.Memcached)
+	}
+
+	if m := messages[4]; m.AssocMessage != messages[2] || m.Memcached.Command != "noop" {
+		t.Errorf("Should skip quiet command without reply: %+v", m.Memcached)
+	}
+
+	if m := messages[6]; m.AssocMessage != messages[5] || len(m.Bytes()) != 2*mcBinaryHeaderSize+4 {
+		t.Errorf("Should emit statistics as one reply: %q %+v", m.Bytes(), m.Memcached)
+	}
+}
+
+func TestRawListenerMemcachedNotMemcached(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMemcached})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	c.send(true, []byte("\x16\x03\x01\x00\x05hello\r\n"))
+	c.send(true, []byte("get foo\r\n"))
+
+	receiveMessages(t, listener, 0, func(m *TCPMessage) bool { return m.Memcached != nil })
+}
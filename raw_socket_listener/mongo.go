@@ -0,0 +1,667 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With ProtocolMongo connections are decoded as MongoDB wire protocol. Each message sent by client is emitted as
+// request, and messages sent by server are emitted as responses of requests they reply to, matched by request ID.
+// OP_MSG requests with moreToCome flag, like unacknowledged writes, get no response, and exhaust cursors get several.
+// If ListenerConfig.MongoRedactSize is set, documents larger than it are replaced by {"$redacted": <size>} document,
+// see bsonRedactor. Compressed messages are emitted as captured. Connections with missing segments, or data not looking
+// like MongoDB protocol, are not decoded anymore.
+
+// Operation codes of MongoDB wire protocol
+const (
+	mongoOpReply       = 1
+	mongoOpUpdate      = 2001
+	mongoOpInsert      = 2002
+	mongoOpQuery       = 2004
+	mongoOpGetMore     = 2005
+	mongoOpDelete      = 2006
+	mongoOpKillCursors = 2007
+	mongoOpCompressed  = 2012
+	mongoOpMsg         = 2013
+)
+
+// Names of operation codes
+var mongoOpNames = map[int32]string{
+	mongoOpReply:       "reply",
+	mongoOpUpdate:      "update",
+	mongoOpInsert:      "insert",
+	mongoOpQuery:       "query",
+	mongoOpGetMore:     "get_more",
+	mongoOpDelete:      "delete",
+	mongoOpKillCursors: "kill_cursors",
+	mongoOpCompressed:  "compressed",
+	mongoOpMsg:         "msg",
+}
+
+// OP_MSG flags
+const (
+	mongoMsgChecksumPresent = 1 << 0
+	mongoMsgMoreToCome      = 1 << 1
+)
+
+// OP_REPLY flag set if query failed
+const mongoReplyQueryFailure = 1 << 1
+
+const mongoHeaderSize = 16
+
+// Maximum size of message accepted by MongoDB, larger length means data is not MongoDB protocol
+const mongoMaxMessageSize = 48 * 1000 * 1000
+
+// Maximum number of requests waiting for response, unacknowledged legacy writes are never replied
+const mongoMaxPending = 1000
+
+// MongoCommand describes message holding MongoDB request, or its response
+type MongoCommand struct {
+	// Operation code name, like "msg" for OP_MSG, or "query" for OP_QUERY
+	Op string
+
+	// Command name, like "find" or "insert", and its database and collection. Legacy operations, like OP_INSERT,
+	// are named by operation code.
+	Command    string
+	Database   string
+	Collection string
+
+	// Number of documents replaced because of their size, see ListenerConfig.MongoRedactSize
+	Redacted int
+
+	// Response fields: whether command succeeded, and error code if it failed
+	OK        bool
+	ErrorCode int32
+}
+
+// mongoConn holds MongoDB decoding state of single connection
+type mongoConn struct {
+	client, server lengthFramer
+
+	// Requests waiting for response, by request ID
+	pending map[int32]*mongoPending
+
+	// Decoding failed, like because of missing segment, and message boundaries are lost
+	broken bool
+}
+
+type mongoPending struct {
+	request *TCPMessage
+	command *MongoCommand
+}
+
+// feed parses messages of the segment, and emits ones which are complete
+func (c *mongoConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if gap > 0 {
+		// Message boundaries are unknown after missing data
+		t.breakMongo(c)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	finish := func() bool {
+		t.finishMongoMessage(c, isIncoming)
+		return true
+	}
+	if !d.feed(packet, data, isIncoming, mongoHeaderSize, t.mongoBufferSize(), mongoMessageSize, finish) {
+		t.breakMongo(c)
+	}
+}
+
+// mongoMessageSize returns number of message bytes following its header, or false if header is not valid
+func mongoMessageSize(header []byte) (int, bool) {
+	length := int(int32(binary.LittleEndian.Uint32(header)))
+	opCode := int32(binary.LittleEndian.Uint32(header[12:]))
+	if _, ok := mongoOpNames[opCode]; !ok || length < mongoHeaderSize || length > mongoMaxMessageSize {
+		return 0, false
+	}
+
+	return length - mongoHeaderSize, true
+}
+
+// mongoBufferSize returns maximum size of buffered message. Messages are redacted when they are complete, so they
+// are buffered whole if redaction is enabled.
+func (t *shard) mongoBufferSize() int {
+	switch max := t.config.MaxMessageSize; {
+	case t.config.MongoRedactSize > 0:
+		return 0
+	case max > 0 && max < mongoHeaderSize:
+		// Header is needed to decode message
+		return mongoHeaderSize
+	default:
+		return max
+	}
+}
+
+// finishMongoMessage decodes complete message, and emits it as request, or as response of request it replies to
+func (t *shard) finishMongoMessage(c *mongoConn, isIncoming bool) {
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	message, buf, truncated := d.take()
+
+	requestID := int32(binary.LittleEndian.Uint32(buf[4:]))
+	responseTo := int32(binary.LittleEndian.Uint32(buf[8:]))
+
+	command, buf, expectsReply := decodeMongoMessage(buf, isIncoming, truncated, t.config.MongoRedactSize)
+
+	if max := t.config.MaxMessageSize; max > 0 && len(buf) > max {
+		buf = buf[:max]
+		truncated = true
+	}
+
+	message.packets[0].Data = buf
+	message.size = len(buf)
+	message.Truncated = truncated
+	message.End = time.Now()
+	message.Mongo = command
+
+	if isIncoming {
+		// Request ID is unique within connection, so it keeps UUIDs distinct
+		message.Ack += uint32(requestID)
+		t.emit(message)
+
+		if t.trackResponse && expectsReply && len(c.pending) < mongoMaxPending {
+			c.pending[requestID] = &mongoPending{request: message, command: command}
+		}
+		return
+	}
+
+	p, ok := c.pending[responseTo]
+	if !ok {
+		return
+	}
+	delete(c.pending, responseTo)
+
+	// Exhaust cursor sends more responses, each replying to the previous one
+	if expectsReply {
+		c.pending[requestID] = p
+	}
+
+	response := *p.command
+	response.Redacted, response.OK, response.ErrorCode = command.Redacted, command.OK, command.ErrorCode
+
+	message.AssocMessage = p.request
+	message.Mongo = &response
+
+	t.emit(message)
+}
+
+// breakMongo stops decoding of connection, messages in progress and responses not received yet are discarded
+func (t *shard) breakMongo(c *mongoConn) {
+	atomic.AddUint64(&t.stats.messagesExpired, uint64(len(c.pending)))
+	c.pending = make(map[int32]*mongoPending)
+
+	c.client.reset()
+	c.server.reset()
+
+	c.broken = true
+}
+
+// close discards messages in progress once connection is closed
+func (c *mongoConn) close(t *shard, stream *tcpStream) {
+	t.breakMongo(c)
+}
+
+// decodeMongoMessage describes message, and redacts its documents larger than redactSize. Returns message with
+// redacted documents, and whether more messages follow it: response of request, or next response of exhaust cursor.
+// Documents of truncated messages are not complete, and they are not redacted.
+func decodeMongoMessage(msg []byte, isIncoming bool, truncated bool, redactSize int) (*MongoCommand, []byte, bool) {
+	opCode := int32(binary.LittleEndian.Uint32(msg[12:]))
+	command := &MongoCommand{Op: mongoOpNames[opCode], OK: true}
+
+	r := &bsonRedactor{limit: redactSize}
+	if truncated {
+		r.limit = 0
+	}
+
+	body := msg[mongoHeaderSize:]
+	expectsReply := isIncoming
+
+	switch opCode {
+	case mongoOpMsg:
+		if len(body) < 4 {
+			break
+		}
+
+		flags := binary.LittleEndian.Uint32(body)
+		expectsReply = flags&mongoMsgMoreToCome == 0
+		if !isIncoming {
+			// Exhaust cursor sends responses with moreToCome flag, until the last one
+			expectsReply = !expectsReply
+		}
+
+		sections := body[4:]
+		if flags&mongoMsgChecksumPresent != 0 && len(sections) >= 4 && !truncated {
+			sections = sections[:len(sections)-4]
+		}
+
+		var out []byte
+		for len(sections) > 0 {
+			kind := sections[0]
+			sections = sections[1:]
+
+			switch kind {
+			case 0:
+				doc, ok := bsonReadDocument(sections)
+				if !ok {
+					// Elements of truncated document, which are complete, still describe command
+					command.describe(sections, isIncoming)
+					sections = nil
+					break
+				}
+				sections = sections[len(doc):]
+
+				command.describe(doc, isIncoming)
+				out = append(append(out, kind), r.redact(doc, true)...)
+			case 1:
+				// Document sequence: size, identifier, and documents
+				if len(sections) < 4 {
+					sections = nil
+					break
+				}
+				size := int(int32(binary.LittleEndian.Uint32(sections)))
+				if size < 4 || size > len(sections) {
+					sections = nil
+					break
+				}
+
+				seq := sections[4:size]
+				sections = sections[size:]
+
+				i := bytes.IndexByte(seq, 0)
+				if i == -1 {
+					break
+				}
+
+				var docs []byte
+				for rest := seq[i+1:]; len(rest) > 0; {
+					doc, ok := bsonReadDocument(rest)
+					if !ok {
+						break
+					}
+					rest = rest[len(doc):]
+					docs = append(docs, r.redact(doc, false)...)
+				}
+
+				section := make([]byte, 4, 4+i+1+len(docs))
+				section = append(append(section, seq[:i+1]...), docs...)
+				binary.LittleEndian.PutUint32(section, uint32(len(section)))
+				out = append(append(out, kind), section...)
+			default:
+				sections = nil
+			}
+		}
+
+		if r.redacted > 0 {
+			// Checksum is not valid anymore
+			rewritten := make([]byte, 4, 4+len(out))
+			binary.LittleEndian.PutUint32(rewritten, flags&^mongoMsgChecksumPresent)
+			body = append(rewritten, out...)
+		}
+	case mongoOpQuery:
+		// flags, fullCollectionName, numberToSkip, numberToReturn, query
+		if len(body) < 4 {
+			break
+		}
+		i := bytes.IndexByte(body[4:], 0)
+		if i == -1 {
+			break
+		}
+		command.setNamespace(string(body[4 : 4+i]))
+
+		rest := body[4+i+1:]
+		if len(rest) < 8 {
+			break
+		}
+		doc, ok := bsonReadDocument(rest[8:])
+		if !ok {
+			break
+		}
+
+		if command.Collection == "$cmd" {
+			command.Collection = ""
+			query := doc
+			if name, value, ok := bsonFirst(doc); ok && (name == "$query" || name == "query") && len(value) > 0 {
+				query = value
+			}
+			command.describe(query, true)
+		} else {
+			command.Command = "find"
+		}
+
+		if redacted := r.redact(doc, true); r.redacted > 0 {
+			prefix := len(body) - len(rest) + 8
+			body = append(append(append([]byte{}, body[:prefix]...), redacted...), rest[8+len(doc):]...)
+		}
+	case mongoOpReply:
+		// responseFlags, cursorID, startingFrom, numberReturned, documents
+		if len(body) < 20 {
+			break
+		}
+
+		flags := binary.LittleEndian.Uint32(body)
+		command.OK = flags&mongoReplyQueryFailure == 0
+
+		out := append([]byte{}, body[:20]...)
+		for docs, first := body[20:], true; len(docs) > 0; first = false {
+			doc, ok := bsonReadDocument(docs)
+			if !ok {
+				out = append(out, docs...)
+				break
+			}
+			docs = docs[len(doc):]
+
+			if first {
+				command.describe(doc, false)
+				if flags&mongoReplyQueryFailure != 0 {
+					command.OK = false
+				}
+			}
+			out = append(out, r.redact(doc, false)...)
+		}
+
+		if r.redacted > 0 {
+			body = out
+		}
+	case mongoOpInsert, mongoOpUpdate, mongoOpDelete, mongoOpGetMore:
+		// Legacy operations start with flags or reserved field, followed by fullCollectionName
+		if len(body) >= 4 {
+			if i := bytes.IndexByte(body[4:], 0); i != -1 {
+				command.setNamespace(string(body[4 : 4+i]))
+			}
+		}
+
+		command.Command = command.Op
+		expectsReply = isIncoming && opCode == mongoOpGetMore
+	case mongoOpKillCursors:
+		command.Command = command.Op
+		expectsReply = false
+	case mongoOpCompressed:
+		// Original operation code, followed by compressed message
+		if len(body) >= 4 {
+			original := int32(binary.LittleEndian.Uint32(body))
+			expectsReply = isIncoming && (original == mongoOpMsg || original == mongoOpQuery || original == mongoOpGetMore)
+		}
+	}
+
+	command.Redacted = r.redacted
+	if r.redacted == 0 {
+		return command, msg, expectsReply
+	}
+
+	out := make([]byte, mongoHeaderSize, mongoHeaderSize+len(body))
+	copy(out, msg[:mongoHeaderSize])
+	out = append(out, body...)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+
+	return command, out, expectsReply
+}
+
+// setNamespace sets database and collection of legacy operation from full collection name, like "shop.users"
+func (c *MongoCommand) setNamespace(ns string) {
+	if i := strings.IndexByte(ns, '.'); i != -1 {
+		c.Database, c.Collection = ns[:i], ns[i+1:]
+	} else {
+		c.Database = ns
+	}
+}
+
+// describe sets command fields from command document, or response fields from reply document
+func (c *MongoCommand) describe(doc []byte, isIncoming bool) {
+	first := true
+
+	bsonEach(doc, func(typ byte, name string, value []byte) bool {
+		if isIncoming {
+			switch {
+			case first:
+				c.Command = name
+				if typ == bsonTypeString {
+					c.Collection = bsonStringValue(value)
+				}
+			case name == "$db" && typ == bsonTypeString:
+				c.Database = bsonStringValue(value)
+			case name == "collection" && typ == bsonTypeString && c.Collection == "":
+				// getMore names collection in separate field
+				c.Collection = bsonStringValue(value)
+			}
+		} else {
+			switch name {
+			case "ok":
+				c.OK = bsonNumber(typ, value) == 1
+			case "code":
+				c.ErrorCode = int32(bsonNumber(typ, value))
+			}
+		}
+
+		first = false
+		return true
+	})
+}
+
+// BSON element types, see bsonValueSize
+const (
+	bsonTypeDouble   = 0x01
+	bsonTypeString   = 0x02
+	bsonTypeDocument = 0x03
+	bsonTypeArray    = 0x04
+	bsonTypeBool     = 0x08
+	bsonTypeInt32    = 0x10
+	bsonTypeInt64    = 0x12
+)
+
+// bsonReadDocument returns document at the start of data, if it is complete
+func bsonReadDocument(data []byte) ([]byte, bool) {
+	if len(data) < 5 {
+		return nil, false
+	}
+
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 5 || size > len(data) {
+		return nil, false
+	}
+
+	return data[:size], true
+}
+
+// bsonValueSize returns size of element value of given type at the start of data, or -1 if it is not valid
+func bsonValueSize(typ byte, data []byte) int {
+	switch typ {
+	case 0x06, 0x0a, 0xff, 0x7f:
+		// undefined, null, min key, max key
+		return 0
+	case bsonTypeBool:
+		return 1
+	case bsonTypeInt32:
+		return 4
+	case bsonTypeDouble, 0x09, 0x11, bsonTypeInt64:
+		// double, UTC datetime, timestamp, int64
+		return 8
+	case 0x07:
+		// ObjectId
+		return 12
+	case 0x13:
+		// decimal128
+		return 16
+	case bsonTypeString, 0x0d, 0x0e:
+		// string, JavaScript code, symbol
+		if len(data) < 4 {
+			return -1
+		}
+		return 4 + int(int32(binary.LittleEndian.Uint32(data)))
+	case 0x05:
+		// binary: size, subtype, and data
+		if len(data) < 4 {
+			return -1
+		}
+		return 5 + int(int32(binary.LittleEndian.Uint32(data)))
+	case bsonTypeDocument, bsonTypeArray, 0x0f:
+		// document, array, code with scope
+		if len(data) < 4 {
+			return -1
+		}
+		return int(int32(binary.LittleEndian.Uint32(data)))
+	case 0x0b:
+		// regular expression: pattern and options
+		i := bytes.IndexByte(data, 0)
+		if i == -1 {
+			return -1
+		}
+		j := bytes.IndexByte(data[i+1:], 0)
+		if j == -1 {
+			return -1
+		}
+		return i + 1 + j + 1
+	case 0x0c:
+		// DBPointer: string and ObjectId
+		if len(data) < 4 {
+			return -1
+		}
+		return 4 + int(int32(binary.LittleEndian.Uint32(data))) + 12
+	}
+
+	return -1
+}
+
+// bsonEach calls fn for elements of the document, until it returns false, or document is not valid. Returns false
+// if document is not valid.
+func bsonEach(doc []byte, fn func(typ byte, name string, value []byte) bool) bool {
+	if len(doc) < 5 {
+		return false
+	}
+
+	data := doc[4 : len(doc)-1]
+	for len(data) > 0 {
+		typ := data[0]
+		i := bytes.IndexByte(data[1:], 0)
+		if i == -1 {
+			return false
+		}
+		name := string(data[1 : 1+i])
+		data = data[1+i+1:]
+
+		size := bsonValueSize(typ, data)
+		if size < 0 || size > len(data) {
+			return false
+		}
+
+		if !fn(typ, name, data[:size]) {
+			return true
+		}
+		data = data[size:]
+	}
+
+	return true
+}
+
+// bsonFirst returns name of the first element of the document, and its value if it is document
+func bsonFirst(doc []byte) (name string, value []byte, ok bool) {
+	bsonEach(doc, func(typ byte, n string, v []byte) bool {
+		name, ok = n, true
+		if typ == bsonTypeDocument {
+			value = v
+		}
+		return false
+	})
+
+	return
+}
+
+// bsonStringValue returns value of string element, without terminating zero byte
+func bsonStringValue(value []byte) string {
+	if len(value) < 5 {
+		return ""
+	}
+
+	return string(value[4 : len(value)-1])
+}
+
+// bsonNumber returns numeric or boolean value as float
+func bsonNumber(typ byte, value []byte) float64 {
+	switch typ {
+	case bsonTypeDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(value))
+	case bsonTypeInt32:
+		return float64(int32(binary.LittleEndian.Uint32(value)))
+	case bsonTypeInt64:
+		return float64(int64(binary.LittleEndian.Uint64(value)))
+	case bsonTypeBool:
+		if value[0] != 0 {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// bsonRedactor replaces documents larger than limit with {"$redacted": <size>} document
+type bsonRedactor struct {
+	limit    int
+	redacted int
+}
+
+// redact returns document with nested documents larger than limit replaced. Document itself is replaced too, unless
+// keep is set, like for command document. Arrays are kept, while their elements larger than limit are replaced.
+func (r *bsonRedactor) redact(doc []byte, keep bool) []byte {
+	if r.limit <= 0 || len(doc) <= r.limit {
+		return doc
+	}
+
+	if !keep {
+		r.redacted++
+		return bsonRedactedDocument(len(doc))
+	}
+
+	out := make([]byte, 4, len(doc))
+	valid := bsonEach(doc, func(typ byte, name string, value []byte) bool {
+		out = append(out, typ)
+		out = append(out, name...)
+		out = append(out, 0)
+
+		switch typ {
+		case bsonTypeDocument:
+			value = r.redact(value, false)
+		case bsonTypeArray:
+			value = r.redact(value, true)
+		}
+
+		out = append(out, value...)
+		return true
+	})
+	if !valid {
+		return doc
+	}
+
+	out = append(out, 0)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+
+	return out
+}
+
+// bsonRedactedDocument returns {"$redacted": <size>} document
+func bsonRedactedDocument(size int) []byte {
+	doc := []byte{20, 0, 0, 0, bsonTypeInt32}
+	doc = append(doc, "$redacted"...)
+	doc = append(doc, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(doc[15:], uint32(size))
+
+	return doc
+}
@@ -0,0 +1,168 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bsonTestDoc(elements ...[]byte) []byte {
+	body := bytes.Join(elements, nil)
+	doc := make([]byte, 4, 4+len(body)+1)
+	doc = append(append(doc, body...), 0)
+	binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+
+	return doc
+}
+
+func bsonTestElement(typ byte, name string, value []byte) []byte {
+	return append(append(append([]byte{typ}, name...), 0), value...)
+}
+
+func bsonTestString(name, value string) []byte {
+	v := make([]byte, 4, 4+len(value)+1)
+	binary.LittleEndian.PutUint32(v, uint32(len(value)+1))
+	v = append(append(v, value...), 0)
+
+	return bsonTestElement(bsonTypeString, name, v)
+}
+
+func bsonTestInt32(name string, value int32) []byte {
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, uint32(value))
+
+	return bsonTestElement(bsonTypeInt32, name, v)
+}
+
+func mongoTestMessage(requestID, responseTo, opCode int32, body ...[]byte) []byte {
+	msg := make([]byte, mongoHeaderSize)
+	for _, b := range body {
+		msg = append(msg, b...)
+	}
+
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+	binary.LittleEndian.PutUint32(msg[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(msg[12:], uint32(opCode))
+
+	return msg
+}
+
+// mongoTestOpMsg builds OP_MSG holding body section, and document sequence section if docs are given
+func mongoTestOpMsg(requestID, responseTo int32, flags uint32, body []byte, sequence string, docs ...[]byte) []byte {
+	f := make([]byte, 4)
+	binary.LittleEndian.PutUint32(f, flags)
+
+	sections := append([]byte{0}, body...)
+	if len(docs) > 0 {
+		seq := append(append(make([]byte, 4), sequence...), 0)
+		seq = append(seq, bytes.Join(docs, nil)...)
+		binary.LittleEndian.PutUint32(seq, uint32(len(seq)))
+		sections = append(append(sections, 1), seq...)
+	}
+
+	return mongoTestMessage(requestID, responseTo, mongoOpMsg, f, sections)
+}
+
+func TestRawListenerMongo(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMongo, MongoRedactSize: 100})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	find := mongoTestOpMsg(1, 0, 0, bsonTestDoc(bsonTestString("find", "users"), bsonTestString("$db", "shop")), "")
+	// Header is split between segments
+	c.send(true, find[:10])
+	c.send(true, find[10:])
+
+	large := bsonTestDoc(bsonTestString("name", strings.Repeat("x", 200)))
+	small := bsonTestDoc(bsonTestString("name", "ann"))
+	insert := mongoTestOpMsg(2, 0, 0, bsonTestDoc(bsonTestString("insert", "users"), bsonTestString("$db", "shop")), "documents", small, large)
+	c.send(true, insert)
+
+	// Unacknowledged write gets no response
+	c.send(true, mongoTestOpMsg(3, 0, mongoMsgMoreToCome, bsonTestDoc(bsonTestString("delete", "users"), bsonTestString("$db", "shop")), ""))
+
+	c.send(false, mongoTestOpMsg(10, 2, 0, bsonTestDoc(bsonTestInt32("ok", 0), bsonTestInt32("code", 11000)), ""))
+	c.send(false, mongoTestOpMsg(11, 1, 0, bsonTestDoc(bsonTestElement(bsonTypeDouble, "ok", []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f})), ""))
+
+	messages := receiveMessages(t, listener, 5, func(m *TCPMessage) bool { return m.Mongo != nil })
+
+	if m := messages[0]; !m.IsIncoming || m.Mongo.Op != "msg" || m.Mongo.Command != "find" || m.Mongo.Collection != "users" || m.Mongo.Database != "shop" || !bytes.Equal(m.Bytes(), find) {
+		t.Errorf("Should emit command as sent: %q %+v", m.Bytes(), m.Mongo)
+	}
+
+	expected := mongoTestOpMsg(2, 0, 0, bsonTestDoc(bsonTestString("insert", "users"), bsonTestString("$db", "shop")), "documents", small, bsonRedactedDocument(len(large)))
+	if m := messages[1]; m.Mongo.Command != "insert" || m.Mongo.Redacted != 1 || !bytes.Equal(m.Bytes(), expected) {
+		t.Errorf("Should redact large document: %q %+v", m.Bytes(), m.Mongo)
+	}
+
+	if m := messages[2]; m.Mongo.Command != "delete" {
+		t.Errorf("Should emit unacknowledged write: %+v", m.Mongo)
+	}
+
+	if m := messages[3]; m.IsIncoming || m.AssocMessage != messages[1] || m.Mongo.OK || m.Mongo.ErrorCode != 11000 || m.Mongo.Command != "insert" {
+		t.Errorf("Should match response by request ID: %+v", m.Mongo)
+	}
+
+	if m := messages[4]; m.AssocMessage != messages[0] || !m.Mongo.OK {
+		t.Errorf("Should emit response of find: %+v", m.Mongo)
+	}
+}
+
+func TestRawListenerMongoLegacy(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMongo})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// flags, fullCollectionName, numberToSkip, numberToReturn, query
+	query := bsonTestDoc(bsonTestInt32("isMaster", 1))
+	c.send(true, mongoTestMessage(7, 0, mongoOpQuery, make([]byte, 4), []byte("admin.$cmd\x00"), make([]byte, 8), query))
+
+	// responseFlags, cursorID, startingFrom, numberReturned, documents
+	c.send(false, mongoTestMessage(8, 7, mongoOpReply, make([]byte, 20), bsonTestDoc(bsonTestInt32("ok", 1))))
+
+	messages := receiveMessages(t, listener, 2, func(m *TCPMessage) bool { return m.Mongo != nil })
+
+	if m := messages[0]; m.Mongo.Op != "query" || m.Mongo.Command != "isMaster" || m.Mongo.Database != "admin" || m.Mongo.Collection != "" {
+		t.Errorf("Should describe legacy command: %+v", m.Mongo)
+	}
+
+	if m := messages[1]; m.AssocMessage != messages[0] || !m.Mongo.OK || m.Mongo.Command != "isMaster" {
+		t.Errorf("Should emit legacy reply: %+v", m.Mongo)
+	}
+}
+
+func TestRawListenerMongoNotMongo(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMongo})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	c.send(true, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	c.send(true, mongoTestOpMsg(1, 0, 0, bsonTestDoc(bsonTestString("find", "users")), ""))
+
+	receiveMessages(t, listener, 0, func(m *TCPMessage) bool { return m.Mongo != nil })
+}
+
+func TestBSONRedactor(t *testing.T) {
+	large := bsonTestDoc(bsonTestString("data", strings.Repeat("x", 100)))
+	array := bsonTestDoc(bsonTestElement(bsonTypeDocument, "0", large), bsonTestInt32("1", 5))
+	doc := bsonTestDoc(bsonTestString("update", "users"), bsonTestElement(bsonTypeArray, "updates", array))
+
+	r := &bsonRedactor{limit: 50}
+	redacted := r.redact(doc, true)
+
+	expected := bsonTestDoc(bsonTestString("update", "users"), bsonTestElement(bsonTypeArray, "updates",
+		bsonTestDoc(bsonTestElement(bsonTypeDocument, "0", bsonRedactedDocument(len(large))), bsonTestInt32("1", 5))))
+	if !bytes.Equal(redacted, expected) || r.redacted != 1 {
+		t.Errorf("Should redact document nested in array: %q", redacted)
+	}
+
+	if r := (&bsonRedactor{limit: 50}); !bytes.Equal(r.redact(large, false), bsonRedactedDocument(len(large))) {
+		t.Error("Should redact document")
+	}
+}
@@ -0,0 +1,705 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// With ProtocolMySQL connections are decoded as MySQL client/server protocol. Each command sent by client, like
+// COM_QUERY, is emitted as request holding its packets as sent, and its result, like OK packet or whole result set,
+// is emitted as response. Handshake is not emitted, but it is used to learn default database and capabilities of the
+// connection. Connections captured after handshake are decoded starting from the next command. Connections switched
+// to TLS, and connections with missing segments, are not decoded anymore.
+
+// MySQL command codes
+const (
+	MySQLComQuit             = 0x01
+	MySQLComInitDB           = 0x02
+	MySQLComQuery            = 0x03
+	MySQLComChangeUser       = 0x11
+	MySQLComBinlogDump       = 0x12
+	MySQLComStmtPrepare      = 0x16
+	MySQLComStmtExecute      = 0x17
+	MySQLComStmtSendLongData = 0x18
+	MySQLComStmtClose        = 0x19
+	MySQLComBinlogDumpGTID   = 0x1e
+)
+
+// Capability flags used by decoder
+const (
+	mysqlClientConnectWithDB    = 0x00000008
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConn       = 0x00008000
+	mysqlClientPluginAuthLenenc = 0x00200000
+	mysqlClientDeprecateEOF     = 0x01000000
+)
+
+// Server status flag, set when result is followed by another one, like for multi-statement queries
+const mysqlServerMoreResultsExists = 0x0008
+
+// Packet payload of maximum length is continued by the next packet
+const mysqlMaxPacketLength = 0xffffff
+
+var mysqlCommandNames = map[byte]string{
+	MySQLComQuit:             "quit",
+	MySQLComInitDB:           "init_db",
+	MySQLComQuery:            "query",
+	0x04:                     "field_list",
+	0x08:                     "statistics",
+	0x0e:                     "ping",
+	MySQLComChangeUser:       "change_user",
+	MySQLComBinlogDump:       "binlog_dump",
+	MySQLComStmtPrepare:      "stmt_prepare",
+	MySQLComStmtExecute:      "stmt_execute",
+	MySQLComStmtSendLongData: "stmt_send_long_data",
+	MySQLComStmtClose:        "stmt_close",
+	0x1a:                     "stmt_reset",
+	0x1b:                     "set_option",
+	0x1c:                     "stmt_fetch",
+	MySQLComBinlogDumpGTID:   "binlog_dump_gtid",
+	0x1f:                     "reset_connection",
+}
+
+// MySQLCommand describes message holding MySQL command, or its result
+type MySQLCommand struct {
+	// Command code, like MySQLComQuery
+	Command byte
+
+	// Query of COM_QUERY and COM_STMT_PREPARE, query of the statement run by COM_STMT_EXECUTE, if its
+	// preparation was captured, and database name of COM_INIT_DB
+	Query []byte
+
+	// ID of prepared statement, assigned by server in response to COM_STMT_PREPARE, or referenced by other
+	// statement commands
+	StatementID uint32
+
+	// Default database of the connection, selected during handshake or by COM_INIT_DB
+	Database string
+
+	// Result fields, set only for responses. Rows is number of rows of result sets, or number of affected rows
+	// reported by OK packet. ErrorCode is set if command failed.
+	Rows      uint64
+	ErrorCode uint16
+}
+
+// Name returns name of the command, like "query" for COM_QUERY, or hex code for unknown commands
+func (c *MySQLCommand) Name() string {
+	if name, ok := mysqlCommandNames[c.Command]; ok {
+		return name
+	}
+
+	const hex = "0123456789abcdef"
+	return "0x" + string([]byte{hex[c.Command>>4], hex[c.Command&0xf]})
+}
+
+type mysqlPhase int
+
+const (
+	// Connection captured after handshake, decoding starts from the next command
+	mysqlPhaseUnknown mysqlPhase = iota
+	mysqlPhaseHandshake
+	mysqlPhaseCommands
+)
+
+// Stages of response decoding
+const (
+	// First packet of result: OK, ERR, or column count of result set
+	mysqlRespFirst = iota
+	mysqlRespColumns
+	mysqlRespColumnsEOF
+	mysqlRespRows
+	// Parameter and column definitions following COM_STMT_PREPARE OK
+	mysqlRespDefinitions
+	// Client sends file requested by LOAD DATA LOCAL INFILE
+	mysqlRespInfile
+)
+
+// mysqlConn holds MySQL decoding state of single connection
+type mysqlConn struct {
+	client, server mysqlDirection
+
+	phase              mysqlPhase
+	serverCapabilities uint32
+	deprecateEOF       bool
+	database           string
+
+	// Queries of statements prepared on the connection, by statement ID
+	statements map[uint32][]byte
+
+	// Command waiting for its result
+	command *mysqlCommand
+
+	// Number of commands, it keeps UUIDs of commands sent in the same segment distinct
+	commands uint32
+
+	// Decoding failed, like because of missing segment, and packet boundaries are lost
+	broken bool
+}
+
+// mysqlDirection holds state of packets sent by one side of connection
+type mysqlDirection struct {
+	streamPosition
+
+	// Not complete packet header, it can be split between segments
+	header []byte
+	// Payload of packet being received, payload continued by next packets is joined
+	payload []byte
+	// Payload bytes left to receive, and whether payload is continued by the next packet
+	remaining int
+	continued bool
+	// Sequence ID of the first packet of the payload
+	sequenceID byte
+	// Packet bytes, including headers, added to the message
+	raw []byte
+	// Payload bytes beyond maximum message size are not kept
+	truncated bool
+}
+
+// mysqlCommand holds command and state of its result decoding
+type mysqlCommand struct {
+	request  *TCPMessage
+	response *TCPMessage
+
+	stage int
+	// Packets left in the current stage
+	remaining uint64
+
+	rows      uint64
+	errorCode uint16
+}
+
+func newMySQLConn() *mysqlConn {
+	return &mysqlConn{statements: make(map[uint32][]byte)}
+}
+
+// feed splits data of the segment into packets, and decodes packets which are complete
+func (c *mysqlConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if gap > 0 {
+		// Packet boundaries are unknown after missing data
+		t.breakMySQL(c)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	for len(data) > 0 && !c.broken {
+		if d.remaining == 0 {
+			n := 4 - len(d.header)
+			if n > len(data) {
+				n = len(data)
+			}
+
+			d.header = append(d.header, data[:n]...)
+			data = data[n:]
+			if len(d.header) < 4 {
+				return
+			}
+
+			length := int(d.header[0]) | int(d.header[1])<<8 | int(d.header[2])<<16
+			if !d.continued {
+				d.sequenceID = d.header[3]
+			}
+			d.appendRaw(d.header, t.config.MaxMessageSize)
+			d.header = d.header[:0]
+			d.remaining = length
+			d.continued = length == mysqlMaxPacketLength
+
+			if length == 0 && !d.continued {
+				t.processMySQLPacket(c, packet, isIncoming)
+				continue
+			}
+		}
+
+		n := d.remaining
+		if n > len(data) {
+			n = len(data)
+		}
+
+		d.appendPayload(data[:n], t.config.MaxMessageSize)
+		d.appendRaw(data[:n], t.config.MaxMessageSize)
+		d.remaining -= n
+		data = data[n:]
+
+		if d.remaining == 0 && !d.continued {
+			t.processMySQLPacket(c, packet, isIncoming)
+		}
+	}
+}
+
+// appendPayload adds payload bytes, discarding ones beyond maximum message size. Payload is needed only to decode
+// packet, so large payloads are cut.
+func (d *mysqlDirection) appendPayload(data []byte, maxSize int) {
+	if maxSize > 0 && len(d.payload)+len(data) > maxSize {
+		if len(d.payload) >= maxSize {
+			return
+		}
+		data = data[:maxSize-len(d.payload)]
+	}
+
+	d.payload = append(d.payload, data...)
+}
+
+// appendRaw adds packet bytes to the message, discarding ones beyond maximum message size
+func (d *mysqlDirection) appendRaw(data []byte, maxSize int) {
+	if maxSize > 0 && len(d.raw)+len(data) > maxSize {
+		d.truncated = true
+		if len(d.raw) >= maxSize {
+			return
+		}
+		data = data[:maxSize-len(d.raw)]
+	}
+
+	d.raw = append(d.raw, data...)
+}
+
+// processMySQLPacket decodes complete packet according to connection phase
+func (t *shard) processMySQLPacket(c *mysqlConn, packet *TCPPacket, isIncoming bool) {
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	payload, raw, truncated := d.payload, d.raw, d.truncated
+	d.payload, d.raw, d.truncated = nil, nil, false
+
+	switch c.phase {
+	case mysqlPhaseUnknown:
+		switch {
+		case !isIncoming && d.sequenceID == 0 && len(payload) > 0 && payload[0] == 0x0a:
+			// Initial handshake packet of protocol version 10
+			c.phase = mysqlPhaseHandshake
+			c.serverCapabilities = parseMySQLGreeting(payload)
+		case isIncoming && d.sequenceID == 0 && len(payload) > 0:
+			c.phase = mysqlPhaseCommands
+			t.processMySQLCommand(c, packet, payload, raw, truncated)
+		}
+	case mysqlPhaseHandshake:
+		t.processMySQLHandshake(c, payload, isIncoming)
+	case mysqlPhaseCommands:
+		if isIncoming {
+			t.processMySQLCommand(c, packet, payload, raw, truncated)
+		} else {
+			t.processMySQLResult(c, packet, payload, raw, truncated)
+		}
+	}
+}
+
+// parseMySQLGreeting returns capabilities of the server from initial handshake packet
+func parseMySQLGreeting(payload []byte) uint32 {
+	// Protocol version, and server version terminated by 0
+	i := 1
+	for i < len(payload) && payload[i] != 0 {
+		i++
+	}
+	// Connection ID, first part of auth data, filler
+	i += 1 + 4 + 8 + 1
+
+	if i+2 > len(payload) {
+		return 0
+	}
+	capabilities := uint32(binary.LittleEndian.Uint16(payload[i:]))
+
+	// Character set and status flags
+	i += 2 + 1 + 2
+	if i+2 <= len(payload) {
+		capabilities |= uint32(binary.LittleEndian.Uint16(payload[i:])) << 16
+	}
+
+	return capabilities
+}
+
+// processMySQLHandshake decodes handshake response of client, and waits for authentication result
+func (t *shard) processMySQLHandshake(c *mysqlConn, payload []byte, isIncoming bool) {
+	if isIncoming {
+		if c.client.sequenceID != 1 || len(payload) < 4 {
+			// Authentication exchange
+			return
+		}
+
+		capabilities := binary.LittleEndian.Uint32(payload)
+
+		if capabilities&mysqlClientSSL != 0 && len(payload) == 32 {
+			// SSL request, connection is switched to TLS
+			c.broken = true
+			return
+		}
+
+		c.deprecateEOF = capabilities&c.serverCapabilities&mysqlClientDeprecateEOF != 0
+		c.database = parseMySQLHandshakeDatabase(payload, capabilities)
+
+		return
+	}
+
+	// OK packet finishes authentication, other packets are part of authentication exchange, or error
+	if len(payload) > 0 && payload[0] == 0x00 && c.server.sequenceID > 0 {
+		c.phase = mysqlPhaseCommands
+	}
+}
+
+// parseMySQLHandshakeDatabase returns database sent in client handshake response
+func parseMySQLHandshakeDatabase(payload []byte, capabilities uint32) string {
+	if capabilities&mysqlClientConnectWithDB == 0 {
+		return ""
+	}
+
+	// Capabilities, max packet size, character set, filler
+	i := 4 + 4 + 1 + 23
+	if i > len(payload) {
+		return ""
+	}
+
+	// User name
+	_, n := mysqlNullString(payload[i:])
+	i += n
+
+	// Auth response
+	switch {
+	case capabilities&mysqlClientPluginAuthLenenc != 0:
+		length, n := mysqlLenencInt(payload[i:])
+		i += n + int(length)
+	case capabilities&mysqlClientSecureConn != 0:
+		if i < len(payload) {
+			i += 1 + int(payload[i])
+		}
+	default:
+		_, n := mysqlNullString(payload[i:])
+		i += n
+	}
+
+	if i >= len(payload) {
+		return ""
+	}
+
+	database, _ := mysqlNullString(payload[i:])
+
+	return string(database)
+}
+
+// processMySQLCommand emits command sent by client, and starts decoding its result
+func (t *shard) processMySQLCommand(c *mysqlConn, packet *TCPPacket, payload, raw []byte, truncated bool) {
+	if cmd := c.command; cmd != nil {
+		if cmd.stage == mysqlRespInfile {
+			// Empty packet ends file contents
+			if len(payload) == 0 {
+				cmd.stage = mysqlRespFirst
+			}
+			return
+		}
+
+		// Result of previous command is not complete, it can't be decoded anymore
+		t.breakMySQL(c)
+		return
+	}
+
+	if len(payload) == 0 {
+		return
+	}
+
+	c.commands++
+
+	request := NewTCPMessage(packet.Seq, packet.Ack+c.commands, true)
+	request.packets = []*TCPPacket{packet.headerCopy()}
+	request.packets[0].Data = raw
+	request.size = len(raw)
+	request.Truncated = truncated
+	request.End = request.Start
+	request.updateCaptureTime(packet.Timestamp)
+
+	command := &MySQLCommand{Command: payload[0], Database: c.database}
+	request.MySQL = command
+
+	switch command.Command {
+	case MySQLComQuery, MySQLComStmtPrepare:
+		command.Query = payload[1:]
+	case MySQLComInitDB:
+		// Default database is changed once server accepts it
+		command.Query = payload[1:]
+	case MySQLComStmtExecute, MySQLComStmtSendLongData, MySQLComStmtClose, 0x1a, 0x1c:
+		if len(payload) >= 5 {
+			command.StatementID = binary.LittleEndian.Uint32(payload[1:])
+			command.Query = c.statements[command.StatementID]
+		}
+	}
+
+	t.emit(request)
+
+	switch command.Command {
+	case MySQLComQuit, MySQLComStmtSendLongData:
+		// No response
+		return
+	case MySQLComStmtClose:
+		delete(c.statements, command.StatementID)
+		return
+	case MySQLComChangeUser:
+		// Authentication exchange follows
+		c.phase = mysqlPhaseHandshake
+		return
+	case MySQLComBinlogDump, MySQLComBinlogDumpGTID:
+		// Server streams replication events, they are not decoded
+		c.broken = true
+		return
+	}
+
+	c.command = &mysqlCommand{request: request}
+}
+
+// processMySQLResult decodes packet of result, and emits result once it is complete
+func (t *shard) processMySQLResult(c *mysqlConn, packet *TCPPacket, payload, raw []byte, truncated bool) {
+	cmd := c.command
+	if cmd == nil {
+		// Result of command sent before capture started
+		return
+	}
+
+	if t.trackResponse {
+		if cmd.response == nil {
+			cmd.response = NewTCPMessage(packet.Seq, packet.Ack, false)
+			cmd.response.packets = []*TCPPacket{packet.headerCopy()}
+			cmd.response.AssocMessage = cmd.request
+		}
+
+		r := cmd.response
+		r.updateCaptureTime(packet.Timestamp)
+
+		if !r.Truncated {
+			d := r.packets[0]
+			if max := t.config.MaxMessageSize; max > 0 && len(d.Data)+len(raw) > max {
+				raw = raw[:max-len(d.Data)]
+				truncated = true
+			}
+			d.Data = append(d.Data, raw...)
+			r.size = len(d.Data)
+			r.Truncated = truncated
+		}
+	}
+
+	if c.decodeResult(cmd, payload) {
+		c.command = nil
+		t.finishMySQLResult(c, cmd)
+	}
+}
+
+// decodeResult updates result state with the packet, returns true if result is complete
+func (c *mysqlConn) decodeResult(cmd *mysqlCommand, payload []byte) bool {
+	var first byte
+	if len(payload) > 0 {
+		first = payload[0]
+	}
+
+	command := cmd.request.MySQL.Command
+
+	switch cmd.stage {
+	case mysqlRespFirst:
+		switch {
+		case first == 0xff:
+			cmd.errorCode = mysqlErrorCode(payload)
+			return true
+		case first == 0x00 && command == MySQLComStmtPrepare:
+			if len(payload) < 9 {
+				return true
+			}
+
+			id := binary.LittleEndian.Uint32(payload[1:])
+			columns := uint64(binary.LittleEndian.Uint16(payload[5:]))
+			params := uint64(binary.LittleEndian.Uint16(payload[7:]))
+
+			cmd.request.MySQL.StatementID = id
+			c.statements[id] = cmd.request.MySQL.Query
+
+			cmd.remaining = params + columns
+			if !c.deprecateEOF {
+				if params > 0 {
+					cmd.remaining++
+				}
+				if columns > 0 {
+					cmd.remaining++
+				}
+			}
+			cmd.stage = mysqlRespDefinitions
+
+			return cmd.remaining == 0
+		case first == 0x00:
+			rows, status := parseMySQLOK(payload)
+			cmd.rows += rows
+
+			if command == MySQLComInitDB {
+				c.database = string(cmd.request.MySQL.Query)
+			}
+
+			return status&mysqlServerMoreResultsExists == 0
+		case first == 0xfb && (command == MySQLComQuery || command == MySQLComStmtExecute):
+			cmd.stage = mysqlRespInfile
+			return false
+		case command != MySQLComQuery && command != MySQLComStmtExecute && command != 0x04 && command != 0x1c:
+			// Commands without result sets reply with single packet, like EOF for COM_SET_OPTION
+			return true
+		case command == 0x04 || command == 0x1c:
+			// Column definitions of COM_FIELD_LIST, and rows of COM_STMT_FETCH, terminated by EOF
+			cmd.stage = mysqlRespRows
+			return c.decodeResult(cmd, payload)
+		}
+
+		columns, _ := mysqlLenencInt(payload)
+		cmd.remaining = columns
+		cmd.stage = mysqlRespColumns
+	case mysqlRespColumns:
+		cmd.remaining--
+		if cmd.remaining > 0 {
+			return false
+		}
+
+		cmd.stage = mysqlRespRows
+		if !c.deprecateEOF {
+			cmd.stage = mysqlRespColumnsEOF
+		}
+	case mysqlRespColumnsEOF:
+		cmd.stage = mysqlRespRows
+	case mysqlRespRows:
+		switch {
+		case first == 0xff:
+			cmd.errorCode = mysqlErrorCode(payload)
+			return true
+		case first == 0xfe && len(payload) < 9:
+			// EOF packet, or OK packet replacing it
+			var status uint16
+			if c.deprecateEOF {
+				_, status = parseMySQLOK(payload)
+			} else if len(payload) >= 5 {
+				status = binary.LittleEndian.Uint16(payload[3:])
+			}
+
+			if status&mysqlServerMoreResultsExists != 0 {
+				cmd.stage = mysqlRespFirst
+				return false
+			}
+
+			return true
+		}
+
+		cmd.rows++
+	case mysqlRespDefinitions:
+		cmd.remaining--
+		return cmd.remaining == 0
+	}
+
+	return false
+}
+
+// finishMySQLResult emits complete result
+func (t *shard) finishMySQLResult(c *mysqlConn, cmd *mysqlCommand) {
+	if cmd.response == nil {
+		return
+	}
+
+	command := *cmd.request.MySQL
+	command.Rows = cmd.rows
+	command.ErrorCode = cmd.errorCode
+
+	cmd.response.MySQL = &command
+	cmd.response.End = time.Now()
+
+	t.emit(cmd.response)
+}
+
+// breakMySQL stops decoding of connection, result in progress is discarded
+func (t *shard) breakMySQL(c *mysqlConn) {
+	if c.command != nil {
+		if c.command.response != nil {
+			atomic.AddUint64(&t.stats.messagesExpired, 1)
+		}
+		c.command = nil
+	}
+
+	for _, d := range []*mysqlDirection{&c.client, &c.server} {
+		d.header, d.payload, d.raw = nil, nil, nil
+	}
+
+	c.broken = true
+}
+
+// close discards messages in progress once connection is closed
+func (c *mysqlConn) close(t *shard, stream *tcpStream) {
+	t.breakMySQL(c)
+}
+
+// parseMySQLOK returns number of affected rows and status flags of OK packet
+func parseMySQLOK(payload []byte) (rows uint64, status uint16) {
+	if len(payload) < 1 {
+		return 0, 0
+	}
+
+	i := 1
+	rows, n := mysqlLenencInt(payload[i:])
+	i += n
+	// Last insert ID
+	_, n = mysqlLenencInt(payload[i:])
+	i += n
+
+	if i+2 <= len(payload) {
+		status = binary.LittleEndian.Uint16(payload[i:])
+	}
+
+	return rows, status
+}
+
+// mysqlErrorCode returns error code of ERR packet
+func mysqlErrorCode(payload []byte) uint16 {
+	if len(payload) < 3 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint16(payload[1:])
+}
+
+// mysqlLenencInt decodes length-encoded integer, returns its value and size
+func mysqlLenencInt(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+
+	size := 1
+	switch data[0] {
+	case 0xfc:
+		size = 3
+	case 0xfd:
+		size = 4
+	case 0xfe:
+		size = 9
+	default:
+		return uint64(data[0]), 1
+	}
+
+	if len(data) < size {
+		return 0, len(data)
+	}
+
+	var value uint64
+	for i := size - 1; i > 0; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+
+	return value, size
+}
+
+// mysqlNullString returns string terminated by 0, and number of bytes it takes with terminator
+func mysqlNullString(data []byte) ([]byte, int) {
+	for i, b := range data {
+		if b == 0 {
+			return data[:i], i + 1
+		}
+	}
+
+	return data, len(data)
+}
@@ -0,0 +1,149 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func mysqlPacket(sequenceID byte, payload string) []byte {
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), sequenceID}, payload...)
+}
+
+func mysqlPackets(packets ...[]byte) []byte {
+	return bytes.Join(packets, nil)
+}
+
+func TestRawListenerMySQL(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMySQL})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 101, serverSeq: 501}
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fSYN, 0, 100, nil).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fSYN|fACK, 101, 500, nil).Dump())
+
+	// Server supports CLIENT_DEPRECATE_EOF, so result sets are terminated by OK packets
+	c.send(false, mysqlPacket(0, "\x0a8.0.36\x00\x01\x00\x00\x0012345678\x00\x08\x82\x21\x02\x00\x00\x01"))
+	c.send(true, mysqlPacket(1, "\x08\x80\x00\x01\x00\x00\x00\x01\x21"+string(make([]byte, 23))+"root\x00\x02abshop\x00"))
+	c.send(false, mysqlPacket(2, "\x00\x00\x00\x02\x00\x00\x00"))
+
+	query := mysqlPacket(0, "\x03SELECT id FROM users")
+	c.send(true, query)
+
+	result := mysqlPackets(
+		mysqlPacket(1, "\x01"),
+		mysqlPacket(2, "\x03def\x04shop\x05users\x05users\x02id\x02id"),
+		mysqlPacket(3, "\x011"),
+		mysqlPacket(4, "\x012"),
+		mysqlPacket(5, "\xfe\x00\x00\x02\x00\x00\x00"),
+	)
+	// Packet header is split between segments
+	c.send(false, result[:len(result)-9])
+	c.send(false, result[len(result)-9:])
+
+	c.send(true, mysqlPacket(0, "\x16SELECT name FROM users WHERE id = ?"))
+	c.send(false, mysqlPackets(
+		mysqlPacket(1, "\x00\x07\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00"),
+		mysqlPacket(2, "\x03def\x00\x00\x00\x01?"),
+		mysqlPacket(3, "\x03def\x04shop\x05users\x05users\x04name\x04name"),
+	))
+
+	c.send(true, mysqlPacket(0, "\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00\x00\x01\x03\x00\x01\x00\x00\x00\x00\x00\x00\x00"))
+	c.send(false, mysqlPacket(1, "\xff\x28\x04#42000You have an error"))
+
+	c.send(true, mysqlPacket(0, "\x01"))
+
+	messages := receiveMessages(t, c.listener, 7, func(m *TCPMessage) bool { return m.MySQL != nil })
+
+	if m := messages[0]; !m.IsIncoming || m.MySQL.Name() != "query" || string(m.MySQL.Query) != "SELECT id FROM users" || m.MySQL.Database != "shop" || !bytes.Equal(m.Bytes(), query) {
+		t.Errorf("Should emit query as sent: %q %+v", m.Bytes(), m.MySQL)
+	}
+
+	if m := messages[1]; m.IsIncoming || m.AssocMessage != messages[0] || m.MySQL.Rows != 2 || !bytes.Equal(m.Bytes(), result) {
+		t.Errorf("Should emit result set: %q %+v", m.Bytes(), m.MySQL)
+	}
+
+	if m := messages[3]; m.MySQL.Command != MySQLComStmtPrepare || m.MySQL.StatementID != 7 || m.AssocMessage != messages[2] {
+		t.Errorf("Should emit prepared statement ID: %+v", m.MySQL)
+	}
+
+	if m := messages[4]; m.MySQL.Command != MySQLComStmtExecute || m.MySQL.StatementID != 7 || string(m.MySQL.Query) != "SELECT name FROM users WHERE id = ?" {
+		t.Errorf("Should describe executed statement: %+v", m.MySQL)
+	}
+
+	if m := messages[5]; m.MySQL.ErrorCode != 1064 {
+		t.Errorf("Should emit error code: %+v", m.MySQL)
+	}
+
+	if m := messages[6]; m.MySQL.Command != MySQLComQuit || !m.IsIncoming {
+		t.Errorf("Should emit command without result: %+v", m.MySQL)
+	}
+
+	if messages[0].UUID() == nil || bytes.Equal(messages[0].UUID(), messages[2].UUID()) || !bytes.Equal(messages[0].UUID(), messages[1].UUID()) {
+		t.Error("Result should share UUID with its command")
+	}
+}
+
+func TestRawListenerMySQLAfterHandshake(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMySQL})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Result of command sent before capture is ignored
+	c.send(false, mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+
+	c.send(true, mysqlPacket(0, "\x02shop"))
+	c.send(false, mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+
+	// Result set terminated by EOF packets, followed by OK of stored procedure
+	c.send(true, mysqlPacket(0, "\x03CALL p()"))
+	c.send(false, mysqlPackets(
+		mysqlPacket(1, "\x01"),
+		mysqlPacket(2, "\x03def\x04shop\x00\x00\x01a\x01a"),
+		mysqlPacket(3, "\xfe\x00\x00\x0a\x00"),
+		mysqlPacket(4, "\x011"),
+		mysqlPacket(5, "\xfe\x00\x00\x0a\x00"),
+	))
+	c.send(false, mysqlPacket(6, "\x00\x03\x00\x02\x00\x00\x00"))
+
+	c.send(true, mysqlPacket(0, "\x03UPDATE t SET a = 1"))
+
+	messages := receiveMessages(t, c.listener, 5, func(m *TCPMessage) bool { return m.MySQL != nil })
+
+	if m := messages[1]; m.MySQL.Command != MySQLComInitDB || m.MySQL.ErrorCode != 0 {
+		t.Errorf("Should emit result of COM_INIT_DB: %+v", m.MySQL)
+	}
+
+	if m := messages[2]; m.MySQL.Database != "shop" {
+		t.Errorf("Should track default database: %+v", m.MySQL)
+	}
+
+	if m := messages[3]; m.MySQL.Rows != 4 || m.AssocMessage != messages[2] {
+		t.Errorf("Should emit all results of the query: %+v", m.MySQL)
+	}
+}
+
+func TestRawListenerMySQLTLS(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolMySQL})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 101, serverSeq: 501}
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fSYN, 0, 100, nil).Dump())
+
+	c.send(false, mysqlPacket(0, "\x0a8.0.36\x00\x01\x00\x00\x0012345678\x00\x08\x8a\x21\x02\x00\x00\x01"))
+	c.send(true, mysqlPacket(1, "\x08\x88\x00\x01\x00\x00\x00\x01\x21"+string(make([]byte, 23))))
+	c.send(true, []byte("\x16\x03\x01\x00\x05hello"))
+
+	receiveMessages(t, c.listener, 0, func(m *TCPMessage) bool { return m.MySQL != nil })
+}
+
+func TestMySQLCommandName(t *testing.T) {
+	if name := (&MySQLCommand{Command: MySQLComStmtExecute}).Name(); name != "stmt_execute" {
+		t.Error("Wrong name", name)
+	}
+
+	if name := (&MySQLCommand{Command: 0xab}).Name(); name != "0xab" {
+		t.Error("Should name unknown commands by code", name)
+	}
+}
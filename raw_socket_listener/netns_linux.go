@@ -0,0 +1,54 @@
+package rawSocket
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// setns syscall numbers, not all of them defined by syscall package
+var sysSetns = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"ppc64le": 350,
+	"riscv64": 268,
+	"s390x":   339,
+}
+
+// inNetns runs fn on OS thread switched to given network namespace.
+// Sockets, including pcap handles, keep namespace they were created in, so they can be used from any thread later.
+func inNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+
+	trap, ok := sysSetns[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("Network namespaces are not supported on %s", runtime.GOARCH)
+	}
+
+	ns, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		// Thread is never unlocked, so it is terminated when goroutine exits, instead of returning to the pool in other namespace
+		runtime.LockOSThread()
+
+		if _, _, errno := syscall.RawSyscall(trap, ns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+			errCh <- fmt.Errorf("Can't enter network namespace %s: %v", path, errno)
+			return
+		}
+
+		errCh <- fn()
+	}()
+
+	return <-errCh
+}
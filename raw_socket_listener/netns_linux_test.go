@@ -0,0 +1,27 @@
+package rawSocket
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInNetns(t *testing.T) {
+	called := false
+	if err := inNetns("", func() error { called = true; return nil }); err != nil || !called {
+		t.Error("Should run in current namespace if path is blank")
+	}
+
+	err := inNetns("/proc/self/ns/net", func() error { return errors.New("fn error") })
+	if err == nil {
+		t.Fatal("Should return error")
+	}
+
+	// Entering namespace requires CAP_SYS_ADMIN
+	if err.Error() != "fn error" {
+		t.Skip("Can't enter network namespace:", err)
+	}
+
+	if err := inNetns("/proc/unknown/ns/net", func() error { return nil }); err == nil {
+		t.Error("Should fail if namespace does not exist")
+	}
+}
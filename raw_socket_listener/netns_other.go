@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package rawSocket
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func inNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+
+	return fmt.Errorf("Network namespaces are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,49 @@
+package rawSocket
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// pauseBPF matches no packets, so kernel stops copying traffic into capture buffers while listener is paused
+const pauseBPF = "less 1"
+
+// Pause stops pushing captured packets for processing, keeping devices open and messages state.
+// Where engine supports BPF, devices filter is replaced by the one matching nothing,
+// otherwise packets are discarded in user space.
+func (t *Listener) Pause() error {
+	if !atomic.CompareAndSwapInt32(&t.paused, 0, 1) {
+		return nil
+	}
+
+	return t.refreshFilters()
+}
+
+// Resume restores capture stopped by Pause
+func (t *Listener) Resume() error {
+	if !atomic.CompareAndSwapInt32(&t.paused, 1, 0) {
+		return nil
+	}
+
+	return t.refreshFilters()
+}
+
+// IsPaused reports if capture is paused
+func (t *Listener) IsPaused() bool {
+	return t.isPaused()
+}
+
+func (t *Listener) isPaused() bool {
+	return atomic.LoadInt32(&t.paused) == 1
+}
+
+func (t *Listener) refreshFilters() error {
+	if runtime.GOOS == "darwin" {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.applyFilters()
+}
@@ -0,0 +1,48 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestListenerPause(t *testing.T) {
+	l, _ := NewListener("", "80", engineTest, true, 0, &ListenerConfig{})
+	defer l.Close()
+
+	device := pcap.Interface{Name: "eth0"}
+	filter := l.deviceBPF(device)
+
+	if err := l.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !l.IsPaused() {
+		t.Error("Should be paused")
+	}
+
+	if bpf := l.deviceBPF(device); bpf != pauseBPF {
+		t.Error("Should filter out all packets while paused:", bpf)
+	}
+
+	l.sendPacket(newPacketBuffer(buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")).Dump()))
+	time.Sleep(10 * time.Millisecond)
+	if l.Stats().PacketsReceived != 0 {
+		t.Error("Packets should be discarded while paused")
+	}
+
+	if err := l.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bpf := l.deviceBPF(device); bpf != filter {
+		t.Error("Should restore filter:", bpf)
+	}
+
+	l.sendPacket(newPacketBuffer(buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")).Dump()))
+	time.Sleep(10 * time.Millisecond)
+	if l.Stats().PacketsReceived != 1 {
+		t.Error("Packets should be captured after resume")
+	}
+}
@@ -0,0 +1,381 @@
+package rawSocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Offline capture: packets are read from .pcap or .pcapng file, and processed as if they were captured live.
+// Packet timestamps of the file are used as message times.
+
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+
+	pcapngSectionHeader      = 0x0a0d0d0a
+	pcapngByteOrderMagic     = 0x1a2b3c4d
+	pcapngInterfaceDesc      = 1
+	pcapngObsoletePacket     = 2
+	pcapngSimplePacket       = 3
+	pcapngNameResolution     = 4
+	pcapngEnhancedPacket     = 6
+	pcapngOptionTSResolution = 9
+	pcapngOptionTSOffset     = 14
+
+	// Sanity limit of block size, to not allocate memory for corrupted length
+	pcapMaxBlockSize = 16 << 20
+)
+
+var errPcapFormat = errors.New("Not a pcap or pcapng file")
+
+// pcapFileInterface is capture interface of pcapng file. Classic pcap files have single interface.
+type pcapFileInterface struct {
+	linkType layers.LinkType
+	// Timestamp units per second, and offset of timestamps in seconds
+	tsUnits  uint64
+	tsOffset int64
+}
+
+// pcapFilePacket is packet read from capture file
+type pcapFilePacket struct {
+	data      []byte
+	timestamp time.Time
+	// Index of capture interface, and its link type
+	iface    int
+	linkType layers.LinkType
+}
+
+// pcapFileReader reads packets of classic pcap, or pcapng file. Files with multiple sections and interfaces
+// of different link types are supported. Name resolution, statistics and other blocks not containing packets
+// are skipped.
+type pcapFileReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	interfaces []pcapFileInterface
+	// Time of the last packet, used for simple packet blocks which have no timestamp
+	last time.Time
+
+	buf []byte
+}
+
+func newPcapFileReader(r io.Reader) (*pcapFileReader, error) {
+	f := &pcapFileReader{r: bufio.NewReaderSize(r, 1<<16)}
+
+	magic, err := f.r.Peek(4)
+	if err != nil {
+		return nil, errPcapFormat
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		f.ng = true
+		return f, f.readSectionHeader()
+	}
+
+	return f, f.readPcapHeader()
+}
+
+// readPcapHeader reads global header of classic pcap file
+func (f *pcapFileReader) readPcapHeader() error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(f.r, header); err != nil {
+		return errPcapFormat
+	}
+
+	iface := pcapFileInterface{tsUnits: 1e6}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header) {
+		case pcapMagicMicroseconds:
+			f.order = order
+		case pcapMagicNanoseconds:
+			f.order = order
+			iface.tsUnits = 1e9
+		}
+	}
+
+	if f.order == nil {
+		return errPcapFormat
+	}
+
+	// Upper bits of link type field hold FCS information
+	iface.linkType = layers.LinkType(f.order.Uint32(header[20:]) & 0xffff)
+	f.interfaces = []pcapFileInterface{iface}
+
+	return nil
+}
+
+// readSectionHeader reads section header block of pcapng file, which sets byte order of the section
+func (f *pcapFileReader) readSectionHeader() error {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f.r, header); err != nil {
+		return errPcapFormat
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(header[8:]) == pcapngByteOrderMagic:
+		f.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[8:]) == pcapngByteOrderMagic:
+		f.order = binary.BigEndian
+	default:
+		return errPcapFormat
+	}
+
+	// Interfaces are defined per section
+	f.interfaces = nil
+
+	// Rest of the block: version, section length and options
+	_, err := f.readBlockBody(f.order.Uint32(header[4:]), 12)
+
+	return err
+}
+
+// readBlockBody reads rest of the block after first read bytes, and returns its body without trailing length
+func (f *pcapFileReader) readBlockBody(length uint32, read int) ([]byte, error) {
+	if length%4 != 0 || length < uint32(read)+4 || length > pcapMaxBlockSize {
+		return nil, fmt.Errorf("Wrong pcapng block length: %d", length)
+	}
+
+	size := int(length) - read
+	if cap(f.buf) < size {
+		f.buf = make([]byte, size)
+	}
+	body := f.buf[:size]
+
+	if _, err := io.ReadFull(f.r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return body[:size-4], nil
+}
+
+// next returns next packet of the file, or io.EOF at the end of the file. Packet data is valid until next call.
+func (f *pcapFileReader) next() (*pcapFilePacket, error) {
+	if !f.ng {
+		return f.nextPcap()
+	}
+
+	for {
+		header, err := f.r.Peek(8)
+		if err == io.EOF && len(header) == 0 {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		blockType := f.order.Uint32(header)
+		if blockType == pcapngSectionHeader {
+			if err := f.readSectionHeader(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		length := f.order.Uint32(header[4:])
+		f.r.Discard(8)
+
+		body, err := f.readBlockBody(length, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case pcapngInterfaceDesc:
+			f.readInterface(body)
+		case pcapngEnhancedPacket, pcapngObsoletePacket, pcapngSimplePacket:
+			if packet := f.readPacket(blockType, body); packet != nil {
+				return packet, nil
+			}
+		}
+	}
+}
+
+// readInterface reads interface description block, with timestamp resolution and offset options
+func (f *pcapFileReader) readInterface(body []byte) {
+	if len(body) < 8 {
+		return
+	}
+
+	iface := pcapFileInterface{linkType: layers.LinkType(f.order.Uint16(body)), tsUnits: 1e6}
+
+	for options := body[8:]; len(options) >= 4; {
+		code, length := f.order.Uint16(options), int(f.order.Uint16(options[2:]))
+		if code == 0 || len(options) < 4+length {
+			break
+		}
+		value := options[4 : 4+length]
+
+		switch {
+		case code == pcapngOptionTSResolution && length == 1:
+			iface.tsUnits = 1
+			for i := 0; i < int(value[0]&0x7f); i++ {
+				if value[0]&0x80 != 0 {
+					iface.tsUnits *= 2
+				} else {
+					iface.tsUnits *= 10
+				}
+			}
+		case code == pcapngOptionTSOffset && length == 8:
+			iface.tsOffset = int64(f.order.Uint64(value))
+		}
+
+		// Options are padded to 32 bits
+		options = options[4+(length+3)/4*4:]
+	}
+
+	f.interfaces = append(f.interfaces, iface)
+}
+
+// readPacket reads packet block, returns nil if block is malformed or refers unknown interface
+func (f *pcapFileReader) readPacket(blockType uint32, body []byte) *pcapFilePacket {
+	var index, capLen int
+	var ts uint64
+	var data []byte
+
+	switch blockType {
+	case pcapngEnhancedPacket:
+		if len(body) < 20 {
+			return nil
+		}
+		index = int(f.order.Uint32(body))
+		ts = uint64(f.order.Uint32(body[4:]))<<32 | uint64(f.order.Uint32(body[8:]))
+		capLen, data = int(f.order.Uint32(body[12:])), body[20:]
+	case pcapngObsoletePacket:
+		if len(body) < 20 {
+			return nil
+		}
+		index = int(f.order.Uint16(body))
+		ts = uint64(f.order.Uint32(body[4:]))<<32 | uint64(f.order.Uint32(body[8:]))
+		capLen, data = int(f.order.Uint32(body[12:])), body[20:]
+	case pcapngSimplePacket:
+		if len(body) < 4 {
+			return nil
+		}
+		// Packet is truncated to the block size, if it was larger than snaplen
+		capLen, data = int(f.order.Uint32(body)), body[4:]
+	}
+
+	if index >= len(f.interfaces) || capLen > len(data) {
+		return nil
+	}
+
+	iface := f.interfaces[index]
+
+	timestamp := f.last
+	if blockType != pcapngSimplePacket {
+		timestamp = iface.time(ts)
+		f.last = timestamp
+	}
+
+	return &pcapFilePacket{data: data[:capLen], timestamp: timestamp, iface: index, linkType: iface.linkType}
+}
+
+// time converts timestamp in interface units to time
+func (iface *pcapFileInterface) time(ts uint64) time.Time {
+	sec, frac := ts/iface.tsUnits, ts%iface.tsUnits
+
+	var nsec int64
+	if 1e9%iface.tsUnits == 0 {
+		nsec = int64(frac * (1e9 / iface.tsUnits))
+	} else {
+		nsec = int64(float64(frac) * 1e9 / float64(iface.tsUnits))
+	}
+
+	return time.Unix(int64(sec)+iface.tsOffset, nsec)
+}
+
+// nextPcap reads packet record of classic pcap file
+func (f *pcapFileReader) nextPcap() (*pcapFilePacket, error) {
+	header := make([]byte, 16)
+	if n, err := io.ReadFull(f.r, header); n == 0 && err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	capLen := f.order.Uint32(header[8:])
+	if capLen > pcapMaxBlockSize {
+		return nil, fmt.Errorf("Wrong pcap packet length: %d", capLen)
+	}
+
+	if cap(f.buf) < int(capLen) {
+		f.buf = make([]byte, capLen)
+	}
+	data := f.buf[:capLen]
+
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	iface := &f.interfaces[0]
+	ts := uint64(f.order.Uint32(header))*iface.tsUnits + uint64(f.order.Uint32(header[4:]))
+
+	return &pcapFilePacket{data: data, timestamp: iface.time(ts), linkType: iface.linkType}, nil
+}
+
+// readPcapFile processes packets of capture file given as listener address. Packets are filtered by port in
+// user space. Messages left incomplete at the end of the file are dispatched when they expire.
+func (t *Listener) readPcapFile() error {
+	file, err := os.Open(t.addr)
+	if err != nil {
+		return err
+	}
+
+	reader, err := newPcapFileReader(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("%s: %v", t.addr, err)
+	}
+
+	go func() {
+		defer file.Close()
+
+		device := pcap.Interface{Name: t.addr}
+		decoders := make(map[int]*packetDecoder)
+
+		for {
+			packet, err := reader.next()
+			if err == io.EOF {
+				log.Println("End of capture file", t.addr)
+				return
+			} else if err != nil {
+				log.Println("Can't read capture file", t.addr, err)
+				return
+			}
+
+			decoder, ok := decoders[packet.iface]
+			if !ok {
+				if decoder, err = newPacketDecoder(packet.linkType); err != nil {
+					log.Println(err, "on interface", packet.iface, "of", t.addr)
+				}
+				decoders[packet.iface] = decoder
+			}
+			if decoder == nil {
+				continue
+			}
+
+			data := decoder.decode(packet.data)
+			if len(data) == 0 {
+				continue
+			}
+
+			if !t.processIPPacket(data, packet.timestamp, device, false) {
+				return
+			}
+		}
+	}()
+
+	t.readyCh <- true
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapngBlock encodes little endian pcapng block, padding the body
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+
+	buf := make([]byte, 12+len(body))
+	binary.LittleEndian.PutUint32(buf, blockType)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)))
+	copy(buf[8:], body)
+	binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(len(buf)))
+
+	return buf
+}
+
+func pcapngSection() []byte {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body, pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint64(body[8:], 0xffffffffffffffff)
+
+	return pcapngBlock(pcapngSectionHeader, body)
+}
+
+// pcapngInterface encodes interface description block, with timestamp resolution option if tsresol is not 0
+func pcapngInterface(linkType layers.LinkType, tsresol byte) []byte {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body, uint16(linkType))
+	binary.LittleEndian.PutUint32(body[4:], 65535)
+
+	if tsresol != 0 {
+		body = append(body, pcapngOptionTSResolution, 0, 1, 0, tsresol, 0, 0, 0)
+		body = append(body, 0, 0, 0, 0)
+	}
+
+	return pcapngBlock(pcapngInterfaceDesc, body)
+}
+
+func pcapngPacket(iface uint32, ts uint64, data []byte) []byte {
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body, iface)
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+
+	return pcapngBlock(pcapngEnhancedPacket, append(body, data...))
+}
+
+func pcapngNames(ip net.IP, name string) []byte {
+	body := []byte{1, 0, 0, 0}
+	binary.LittleEndian.PutUint16(body[2:], uint16(4+len(name)+1))
+	body = append(body, ip.To4()...)
+	body = append(body, name...)
+	body = append(body, 0)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+
+	return pcapngBlock(pcapngNameResolution, append(body, 0, 0, 0, 0))
+}
+
+// buildTCP serializes TCP segment of connection between 10.0.0.1:51234 client and 10.0.0.2:80 server
+func buildTCP(t *testing.T, isIncoming bool, seq, ack uint32, payload string) []byte {
+	ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 51234, DstPort: 80, Seq: seq, Ack: ack, ACK: true, PSH: true, Window: 1000}
+	if !isIncoming {
+		ip4.SrcIP, ip4.DstIP = ip4.DstIP, ip4.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip4, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestPcapFileReader(t *testing.T) {
+	var file bytes.Buffer
+	file.Write(pcapngSection())
+	file.Write(pcapngNames(net.IP{10, 0, 0, 2}, "api.example.com"))
+	file.Write(pcapngInterface(layers.LinkTypeEthernet, 0))
+	file.Write(pcapngInterface(layers.LinkTypeRaw, 9))
+	file.Write(pcapngPacket(1, 1500000000123456789, []byte{1, 2, 3}))
+	file.Write(pcapngPacket(0, 1500000000123456, []byte{4, 5}))
+	file.Write(pcapngPacket(2, 0, []byte{6}))
+	// New section starts without interfaces
+	file.Write(pcapngSection())
+	file.Write(pcapngInterface(layers.LinkTypeLinuxSLL, 0x80|20))
+	file.Write(pcapngPacket(0, 3<<20, []byte{7}))
+
+	reader, err := newPcapFileReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		data     []byte
+		ts       int64
+		iface    int
+		linkType layers.LinkType
+	}{
+		{[]byte{1, 2, 3}, 1500000000123456789, 1, layers.LinkTypeRaw},
+		{[]byte{4, 5}, 1500000000123456000, 0, layers.LinkTypeEthernet},
+		{[]byte{7}, 3000000000, 0, layers.LinkTypeLinuxSLL},
+	}
+
+	for i, e := range expected {
+		packet, err := reader.next()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		if !bytes.Equal(packet.data, e.data) || packet.timestamp.UnixNano() != e.ts || packet.iface != e.iface || packet.linkType != e.linkType {
+			t.Errorf("Wrong packet %d: %v %d %d %s", i, packet.data, packet.timestamp.UnixNano(), packet.iface, packet.linkType)
+		}
+	}
+
+	if _, err := reader.next(); err != io.EOF {
+		t.Error("Should end reading:", err)
+	}
+}
+
+func TestPcapFileReaderClassic(t *testing.T) {
+	var file bytes.Buffer
+
+	// Big endian file with nanosecond timestamps
+	header := make([]byte, 24)
+	binary.BigEndian.PutUint32(header, pcapMagicNanoseconds)
+	binary.BigEndian.PutUint32(header[16:], 65535)
+	binary.BigEndian.PutUint32(header[20:], uint32(layers.LinkTypeNull))
+	file.Write(header)
+
+	record := make([]byte, 16)
+	binary.BigEndian.PutUint32(record, 1500000000)
+	binary.BigEndian.PutUint32(record[4:], 123456789)
+	binary.BigEndian.PutUint32(record[8:], 2)
+	binary.BigEndian.PutUint32(record[12:], 2)
+	file.Write(record)
+	file.Write([]byte{1, 2})
+
+	reader, err := newPcapFileReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := reader.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.data, []byte{1, 2}) || packet.timestamp.UnixNano() != 1500000000123456789 || packet.linkType != layers.LinkTypeNull {
+		t.Errorf("Wrong packet: %v %d %s", packet.data, packet.timestamp.UnixNano(), packet.linkType)
+	}
+
+	if _, err := reader.next(); err != io.EOF {
+		t.Error("Should end reading:", err)
+	}
+
+	if _, err := newPcapFileReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n...."))); err != errPcapFormat {
+		t.Error("Should reject other files:", err)
+	}
+}
+
+func TestRawListenerPcapFile(t *testing.T) {
+	request := "GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	frame := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(frame, gopacket.SerializeOptions{},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+		gopacket.Payload(buildTCP(t, true, 1, 1, request)))
+
+	ts := uint64(time.Unix(1500000000, 0).UnixNano())
+
+	// Request captured on ethernet interface, and response on tunnel interface
+	file, _ := ioutil.TempFile("", "gor_*.pcapng")
+	defer os.Remove(file.Name())
+
+	file.Write(pcapngSection())
+	file.Write(pcapngInterface(layers.LinkTypeEthernet, 9))
+	file.Write(pcapngInterface(layers.LinkTypeRaw, 9))
+	file.Write(pcapngPacket(0, ts, frame.Bytes()))
+	file.Write(pcapngPacket(1, ts+2000000, buildTCP(t, false, 1, 1+uint32(len(request)), response)))
+	file.Close()
+
+	listener, err := NewListener(file.Name(), "80", EnginePcapFile, true, 10*time.Millisecond, &ListenerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-listener.Receiver():
+			if m.IsIncoming && (string(m.Bytes()) != request || m.CaptureStart.UnixNano() != int64(ts)) {
+				t.Errorf("Wrong request: %q %d", m.Bytes(), m.CaptureStart.UnixNano())
+			}
+
+			if !m.IsIncoming && (string(m.Bytes()) != response || m.CaptureEnd.Sub(m.AssocMessage.CaptureStart) != 2*time.Millisecond) {
+				t.Errorf("Wrong response: %q", m.Bytes())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should read messages of the file")
+		}
+	}
+}
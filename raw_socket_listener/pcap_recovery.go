@@ -0,0 +1,174 @@
+package rawSocket
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// Delay between attempts to re-open interrupted capture, doubled after each failed attempt
+const pcapReopenMinDelay = 100 * time.Millisecond
+const pcapReopenMaxDelay = 30 * time.Second
+
+// How often list of interfaces is checked for added or removed ones
+const pcapDevicesRefresh = 5 * time.Second
+
+// pcapCapture is state of device capture goroutine, which outlives handles re-opened after interruptions
+type pcapCapture struct {
+	device pcap.Interface
+	stop   chan struct{}
+}
+
+func (c *pcapCapture) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func nextReopenDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > pcapReopenMaxDelay {
+		return pcapReopenMaxDelay
+	}
+
+	return delay
+}
+
+// addPcapCapture registers capture of the device, returns nil if device is already captured
+func (t *Listener) addPcapCapture(device pcap.Interface) *pcapCapture {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.pcapDevices[device.Name]; ok {
+		return nil
+	}
+
+	c := &pcapCapture{device: device, stop: make(chan struct{})}
+	t.pcapDevices[device.Name] = c
+
+	return c
+}
+
+func (t *Listener) removePcapCapture(c *pcapCapture) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pcapDevices[c.device.Name] == c {
+		delete(t.pcapDevices, c.device.Name)
+	}
+}
+
+// pcapCaptureDevice returns current state of captured device, addresses can be updated by syncPcapDevices
+func (t *Listener) pcapCaptureDevice(c *pcapCapture) pcap.Interface {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return c.device
+}
+
+// stopPcapCapture stops capture goroutine of the device. Should be called with t.mu locked.
+func (t *Listener) stopPcapCapture(c *pcapCapture) {
+	close(c.stop)
+	delete(t.pcapDevices, c.device.Name)
+
+	for _, h := range t.pcapHandles {
+		if h.device.Name == c.device.Name {
+			h.Close()
+		}
+	}
+}
+
+// syncPcapDevices starts capture on new devices, stops it on devices which are gone,
+// and updates BPF filters of devices which addresses changed
+func (t *Listener) syncPcapDevices(devices map[string]pcap.Interface) {
+	t.mu.Lock()
+
+	for name, c := range t.pcapDevices {
+		device, ok := devices[name]
+		delete(devices, name)
+
+		if !ok {
+			log.Println("Stop capturing on", name, "interface is gone")
+			t.stopPcapCapture(c)
+			continue
+		}
+
+		if deviceAddrs(device) == deviceAddrs(c.device) {
+			continue
+		}
+
+		c.device = device
+		for _, h := range t.pcapHandles {
+			if h.device.Name != name {
+				continue
+			}
+
+			h.device = device
+			if err := h.SetBPFFilter(t.deviceBPF(device)); err != nil {
+				log.Println("BPF filter error:", err, "Device:", name)
+			}
+		}
+	}
+
+	t.mu.Unlock()
+
+	started := make(chan error, len(devices))
+	for _, device := range devices {
+		log.Println("Start capturing on", device.Name, "addresses:", deviceAddrs(device))
+		go t.capturePcapDevice(device, started)
+	}
+
+	// Errors are logged by capturePcapDevice, device will be retried on next sync
+	for range devices {
+		<-started
+	}
+}
+
+// watchPcapDevices periodically checks devices matching listener address, to capture interfaces added after start,
+// like new containers veth interfaces, and to stop capturing removed ones
+func (t *Listener) watchPcapDevices() {
+	ticker := time.NewTicker(pcapDevicesRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var found []pcap.Interface
+		err := inNetns(t.netns, func() (err error) {
+			found, err = findPcapDevices(t.addr)
+			return
+		})
+
+		if _, notFound := err.(*DeviceNotFoundError); err != nil && !notFound {
+			log.Println("Can't get list of network interfaces:", err)
+			continue
+		}
+
+		devices := make(map[string]pcap.Interface)
+		for _, d := range found {
+			devices[d.Name] = d
+		}
+
+		t.syncPcapDevices(devices)
+	}
+}
+
+// deviceAddrs returns sorted list of device addresses, used to detect changes
+func deviceAddrs(device pcap.Interface) string {
+	addrs := make([]string, len(device.Addresses))
+	for i, a := range device.Addresses {
+		addrs[i] = a.IP.String()
+	}
+	sort.Strings(addrs)
+
+	return strings.Join(addrs, ",")
+}
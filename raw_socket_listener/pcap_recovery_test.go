@@ -0,0 +1,78 @@
+package rawSocket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestNextReopenDelay(t *testing.T) {
+	if d := nextReopenDelay(pcapReopenMinDelay); d != 2*pcapReopenMinDelay {
+		t.Error("Should double delay", d)
+	}
+
+	if d := nextReopenDelay(20 * time.Second); d != pcapReopenMaxDelay {
+		t.Error("Should limit delay", d)
+	}
+}
+
+func TestPcapCaptureRegistry(t *testing.T) {
+	l, _ := NewListener("", "80", engineTest, true, 0, &ListenerConfig{})
+	defer l.Close()
+
+	c := l.addPcapCapture(pcap.Interface{Name: "eth0"})
+	if c == nil {
+		t.Fatal("Should register capture")
+	}
+
+	if l.addPcapCapture(pcap.Interface{Name: "eth0"}) != nil {
+		t.Error("Should not capture device twice")
+	}
+
+	l.mu.Lock()
+	l.stopPcapCapture(c)
+	l.mu.Unlock()
+
+	if !c.stopped() {
+		t.Error("Capture should be stopped")
+	}
+
+	// Device captured again before stopped goroutine exited
+	restarted := l.addPcapCapture(pcap.Interface{Name: "eth0"})
+	if restarted == nil {
+		t.Fatal("Should capture device again after stop")
+	}
+
+	l.removePcapCapture(c)
+	if l.pcapDevices["eth0"] != restarted {
+		t.Error("Stopped capture should not remove new one")
+	}
+}
+
+func TestSyncPcapDevices(t *testing.T) {
+	l, _ := NewListener("", "80", engineTest, true, 0, &ListenerConfig{})
+	defer l.Close()
+
+	gone := l.addPcapCapture(pcap.Interface{Name: "veth1"})
+	changed := l.addPcapCapture(pcap.Interface{Name: "eth0", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1")}}})
+
+	l.syncPcapDevices(map[string]pcap.Interface{
+		"eth0":  {Name: "eth0", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.2")}}},
+		"veth2": {Name: "veth2"},
+	})
+
+	if !gone.stopped() {
+		t.Error("Should stop capture of removed device")
+	}
+
+	if changed.stopped() || deviceAddrs(l.pcapCaptureDevice(changed)) != "10.0.0.2" {
+		t.Error("Should update addresses of captured device", l.pcapCaptureDevice(changed))
+	}
+
+	// New device can't be opened without libpcap, and will be retried on next sync
+	if _, ok := l.pcapDevices["veth2"]; ok {
+		t.Error("Failed device should not be registered")
+	}
+}
@@ -0,0 +1,109 @@
+package rawSocket
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange holds inclusive range of ports. Single port represented as range with same bounds.
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+// parsePorts parses comma separated list of ports and port ranges: "80,8000-8100".
+// Returns error if port is not a number, is out of range, or range bounds are reversed.
+func parsePorts(ports string) (result []portRange, err error) {
+	for _, p := range strings.Split(ports, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(p), "-", 2)
+
+		from, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to := from
+
+		if len(bounds) == 2 {
+			if to, err = parsePort(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		if to < from {
+			return nil, fmt.Errorf("Wrong port range %q: start is greater than end", strings.TrimSpace(p))
+		}
+
+		result = append(result, portRange{from, to})
+	}
+
+	return
+}
+
+func parsePort(port string) (uint16, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil || n < 0 || n > 65535 {
+		return 0, fmt.Errorf("Wrong port %q", strings.TrimSpace(port))
+	}
+
+	return uint16(n), nil
+}
+
+// isAnyPort checks if port 0 (all ports) is in the list
+func isAnyPort(ports []portRange) bool {
+	for _, p := range ports {
+		if p.from == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isListenPort checks if port is one of the ports we are listening on
+func (t *Listener) isListenPort(port uint16) bool {
+	if t.anyPort {
+		return true
+	}
+
+	for _, p := range t.ports {
+		if port >= p.from && port <= p.to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isIncoming checks if packet is sent to the one of listened ports (request), or from it (response)
+//
+// When listening on all ports both source and destination ports are matching,
+// so we assume that server ports are lower than ephemeral ports of clients.
+func (t *Listener) isIncoming(srcPort, destPort uint16) bool {
+	if t.anyPort {
+		return destPort < srcPort
+	}
+
+	return t.isListenPort(destPort)
+}
+
+// bpfPorts returns BPF expression matching all listened ports, `dir` can be "src" or "dst"
+func (t *Listener) bpfPorts(dir string) string {
+	protocol := t.transportProtocol()
+
+	if t.anyPort {
+		return protocol
+	}
+
+	filters := make([]string, len(t.ports))
+
+	for i, p := range t.ports {
+		if p.from == p.to {
+			filters[i] = protocol + " " + dir + " port " + strconv.Itoa(int(p.from))
+		} else {
+			filters[i] = protocol + " " + dir + " portrange " + strconv.Itoa(int(p.from)) + "-" + strconv.Itoa(int(p.to))
+		}
+	}
+
+	return "(" + strings.Join(filters, " or ") + ")"
+}
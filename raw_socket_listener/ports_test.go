@@ -0,0 +1,85 @@
+package rawSocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testPorts returns ports parsed by parsePorts, which are known to be valid
+func testPorts(ports string) []portRange {
+	result, _ := parsePorts(ports)
+	return result
+}
+
+func TestParsePorts(t *testing.T) {
+	cases := []struct {
+		ports    string
+		expected []portRange
+	}{
+		{"80", []portRange{{80, 80}}},
+		{"80,443", []portRange{{80, 80}, {443, 443}}},
+		{"8000-8100", []portRange{{8000, 8100}}},
+		{"80, 8000-8100", []portRange{{80, 80}, {8000, 8100}}},
+		{"0", []portRange{{0, 0}}},
+		{"65535", []portRange{{65535, 65535}}},
+	}
+
+	for _, c := range cases {
+		if ports, err := parsePorts(c.ports); err != nil || !reflect.DeepEqual(ports, c.expected) {
+			t.Error("Wrong ports", c.ports, ports, c.expected, err)
+		}
+	}
+
+	for _, ports := range []string{"80,8O", "", "80,", "65536", "-1", "8100-8000", "80-", "1-70000"} {
+		if _, err := parsePorts(ports); err == nil {
+			t.Error("Should reject ports", ports)
+		}
+	}
+}
+
+func TestListenerWrongPorts(t *testing.T) {
+	if _, err := NewListener("", "80,8O", engineTest, false, 0, &ListenerConfig{}); err == nil {
+		t.Error("Listener should not start with wrong ports")
+	}
+}
+
+func TestListenPorts(t *testing.T) {
+	l := &Listener{ports: testPorts("80,8000-8100")}
+
+	for _, p := range []uint16{80, 8000, 8050, 8100} {
+		if !l.isListenPort(p) {
+			t.Error("Should match port", p)
+		}
+	}
+
+	for _, p := range []uint16{0, 81, 7999, 8101} {
+		if l.isListenPort(p) {
+			t.Error("Should not match port", p)
+		}
+	}
+
+	if !l.isIncoming(54321, 8050) || l.isIncoming(8050, 54321) {
+		t.Error("Should detect direction by listened port")
+	}
+
+	if bpf := l.bpfPorts("dst"); bpf != "(tcp dst port 80 or tcp dst portrange 8000-8100)" {
+		t.Error("Wrong BPF", bpf)
+	}
+}
+
+func TestListenAnyPort(t *testing.T) {
+	l := &Listener{ports: testPorts("0")}
+	l.anyPort = isAnyPort(l.ports)
+
+	if !l.isListenPort(80) || !l.isListenPort(54321) {
+		t.Error("Should match all ports")
+	}
+
+	if !l.isIncoming(54321, 8080) || l.isIncoming(8080, 54321) {
+		t.Error("Server port should be lower than client port")
+	}
+
+	if bpf := l.bpfPorts("src"); bpf != "tcp" {
+		t.Error("Should match all tcp traffic", bpf)
+	}
+}
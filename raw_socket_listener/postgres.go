@@ -0,0 +1,642 @@
+package rawSocket
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+// With ProtocolPostgres connections are decoded as PostgreSQL frontend/backend protocol. Messages sent by client
+// are grouped into requests: simple query, extended query messages up to Sync, function call, or copy data. Each
+// request is emitted holding its messages as sent, and server messages up to ReadyForQuery are emitted as its
+// response. Startup message and authentication are emitted as request too, with password messages handled
+// according to ListenerConfig.PostgresAuth. Connections captured after startup are decoded starting from the next
+// request. Connections switched to TLS, and connections with missing segments, are not decoded anymore.
+
+// Kinds of PostgreSQL requests
+const (
+	PostgresStartup       = "startup"
+	PostgresSimpleQuery   = "query"
+	PostgresExtendedQuery = "extended"
+	PostgresFunctionCall  = "function"
+	PostgresCopyData      = "copy"
+	PostgresTerminate     = "terminate"
+)
+
+// Handling of password messages sent during authentication, see ListenerConfig.PostgresAuth
+const (
+	// Password messages are removed from startup request
+	PostgresAuthStrip = "strip"
+	// Password messages are emitted as captured
+	PostgresAuthKeep = "keep"
+	// Password messages are replaced with ones holding ListenerConfig.PostgresPassword
+	PostgresAuthReplace = "replace"
+)
+
+// Codes of untyped messages sent by client before startup
+const (
+	pgProtocolVersion3 = 196608
+	pgCancelRequest    = 80877102
+	pgSSLRequest       = 80877103
+	pgGSSENCRequest    = 80877104
+)
+
+// Authentication request codes
+const (
+	pgAuthOK                = 0
+	pgAuthCleartextPassword = 3
+	pgAuthMD5Password       = 5
+)
+
+// Maximum size of message, larger length means data is not PostgreSQL protocol
+const pgMaxMessageLength = 1 << 30
+
+// Types of messages client can send after startup
+var pgFrontendTypes = []byte("BCcDdEfFHPpQSX")
+
+// PostgresQuery describes message holding PostgreSQL request, or its response
+type PostgresQuery struct {
+	// Request kind, like PostgresSimpleQuery
+	Kind string
+
+	// SQL of Query message, and of statements parsed or bound by extended query messages. Statements prepared by
+	// previous requests are included if their preparation was captured.
+	Queries [][]byte
+
+	// User and database of the connection, sent in startup message
+	User     string
+	Database string
+
+	// Response fields: command tag of the last CommandComplete message, like "SELECT 2", number of DataRow messages,
+	// and SQLSTATE code of ErrorResponse, set if request failed
+	Tag       string
+	Rows      uint64
+	ErrorCode string
+}
+
+type pgPhase int
+
+const (
+	// Connection captured after startup, decoding starts from the next request
+	pgPhaseUnknown pgPhase = iota
+	// Client sends untyped messages: startup message, or requests to switch connection to encryption
+	pgPhaseStartup
+	pgPhaseAuthentication
+	pgPhaseReady
+)
+
+// pgConn holds PostgreSQL decoding state of single connection
+type pgConn struct {
+	client, server pgDirection
+
+	phase pgPhase
+	user  string
+	db    string
+
+	// Server replies to SSLRequest and GSSENCRequest with single byte, not framed as message
+	encryptionRequested bool
+
+	// Last authentication request, and salt of MD5 authentication
+	authCode uint32
+	salt     []byte
+
+	// Queries of statements prepared on the connection, by statement name
+	statements map[string][]byte
+
+	// Request being sent, and sent requests waiting for ReadyForQuery, in order
+	request *pgRequest
+	pending []*pgRequest
+
+	// Number of requests, it keeps UUIDs of requests sent in the same segment distinct
+	requests uint32
+
+	// Decoding failed, like because of missing segment, and message boundaries are lost
+	broken bool
+}
+
+// pgDirection holds state of messages sent by one side of connection
+type pgDirection struct {
+	streamPosition
+
+	// Not complete message header, it can be split between segments
+	header []byte
+	// Message has no type byte, like startup message
+	untyped bool
+	// Type and payload of message being received, and payload bytes left to receive
+	msgType   byte
+	payload   []byte
+	remaining int
+	// Message bytes, including header
+	raw       []byte
+	truncated bool
+}
+
+// pgRequest holds request and state of its response decoding
+type pgRequest struct {
+	request  *TCPMessage
+	response *TCPMessage
+	query    *PostgresQuery
+
+	// Statements parsed by the request
+	parsed map[string]bool
+
+	tag       string
+	rows      uint64
+	errorCode string
+}
+
+func newPgConn() *pgConn {
+	return &pgConn{statements: make(map[string][]byte)}
+}
+
+// feed splits data of the segment into messages, and decodes messages which are complete
+func (c *pgConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if gap > 0 {
+		// Message boundaries are unknown after missing data
+		t.breakPostgres(c)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	if isIncoming && c.phase == pgPhaseUnknown {
+		// First data of client: startup message, or request of connection captured after startup
+		if isPgStartup(data) {
+			c.phase = pgPhaseStartup
+		} else if len(data) > 0 && bytes.IndexByte(pgFrontendTypes, data[0]) != -1 {
+			c.phase = pgPhaseReady
+		} else {
+			t.breakPostgres(c)
+			return
+		}
+	}
+
+	for len(data) > 0 && !c.broken {
+		if !isIncoming && c.encryptionRequested {
+			c.encryptionRequested = false
+			// 'S' or 'G' mean connection is switched to encryption
+			if data[0] != 'N' {
+				t.breakPostgres(c)
+				return
+			}
+			data = data[1:]
+			continue
+		}
+
+		if d.remaining == 0 {
+			d.untyped = isIncoming && c.phase == pgPhaseStartup
+
+			size := 5
+			if d.untyped {
+				size = 4
+			}
+
+			n := size - len(d.header)
+			if n > len(data) {
+				n = len(data)
+			}
+
+			d.header = append(d.header, data[:n]...)
+			data = data[n:]
+			if len(d.header) < size {
+				return
+			}
+
+			length := binary.BigEndian.Uint32(d.header[size-4:])
+			if length < 4 || length > pgMaxMessageLength {
+				t.breakPostgres(c)
+				return
+			}
+
+			d.msgType = 0
+			if !d.untyped {
+				d.msgType = d.header[0]
+			}
+			d.appendRaw(d.header, t.config.MaxMessageSize)
+			d.header = d.header[:0]
+			d.remaining = int(length) - 4
+
+			if d.remaining == 0 {
+				t.processPgMessage(c, packet, isIncoming)
+				continue
+			}
+		}
+
+		n := d.remaining
+		if n > len(data) {
+			n = len(data)
+		}
+
+		d.appendPayload(data[:n], t.config.MaxMessageSize)
+		d.appendRaw(data[:n], t.config.MaxMessageSize)
+		d.remaining -= n
+		data = data[n:]
+
+		if d.remaining == 0 {
+			t.processPgMessage(c, packet, isIncoming)
+		}
+	}
+}
+
+// isPgStartup checks if data starts with untyped message client sends before startup
+func isPgStartup(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+
+	switch binary.BigEndian.Uint32(data[4:8]) {
+	case pgProtocolVersion3, pgSSLRequest, pgGSSENCRequest, pgCancelRequest:
+		return true
+	}
+
+	return false
+}
+
+// appendPayload adds payload bytes, discarding ones beyond maximum message size
+func (d *pgDirection) appendPayload(data []byte, maxSize int) {
+	if maxSize > 0 && len(d.payload)+len(data) > maxSize {
+		if len(d.payload) >= maxSize {
+			return
+		}
+		data = data[:maxSize-len(d.payload)]
+	}
+
+	d.payload = append(d.payload, data...)
+}
+
+// appendRaw adds message bytes, discarding ones beyond maximum message size
+func (d *pgDirection) appendRaw(data []byte, maxSize int) {
+	if maxSize > 0 && len(d.raw)+len(data) > maxSize {
+		d.truncated = true
+		if len(d.raw) >= maxSize {
+			return
+		}
+		data = data[:maxSize-len(d.raw)]
+	}
+
+	d.raw = append(d.raw, data...)
+}
+
+// processPgMessage decodes complete message
+func (t *shard) processPgMessage(c *pgConn, packet *TCPPacket, isIncoming bool) {
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	payload, raw, truncated := d.payload, d.raw, d.truncated
+	d.payload, d.raw, d.truncated = nil, nil, false
+
+	if !isIncoming {
+		t.processPgBackendMessage(c, packet, d.msgType, payload, raw, truncated)
+		return
+	}
+
+	if d.untyped {
+		t.processPgStartup(c, packet, payload, raw)
+		return
+	}
+
+	if c.phase == pgPhaseAuthentication {
+		if d.msgType == 'p' {
+			t.processPgPassword(c, payload)
+		}
+		return
+	}
+
+	t.processPgFrontendMessage(c, packet, d.msgType, payload, raw, truncated)
+}
+
+// processPgStartup decodes untyped message sent before startup
+func (t *shard) processPgStartup(c *pgConn, packet *TCPPacket, payload, raw []byte) {
+	if len(payload) < 4 {
+		t.breakPostgres(c)
+		return
+	}
+
+	switch binary.BigEndian.Uint32(payload) {
+	case pgSSLRequest, pgGSSENCRequest:
+		c.encryptionRequested = true
+	case pgProtocolVersion3:
+		// Parameters are pairs of strings terminated by 0, and list ends with empty name
+		fields := bytes.Split(payload[4:], []byte{0})
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch string(fields[i]) {
+			case "user":
+				c.user = string(fields[i+1])
+			case "database":
+				c.db = string(fields[i+1])
+			}
+		}
+		if c.db == "" {
+			c.db = c.user
+		}
+
+		c.phase = pgPhaseAuthentication
+		c.request = t.newPgRequest(c, packet, PostgresStartup)
+		c.request.appendRequest(raw, false, t.config.MaxMessageSize)
+	default:
+		// Cancel request, or unsupported protocol version
+		t.breakPostgres(c)
+	}
+}
+
+// processPgPassword adds password message to startup request, according to ListenerConfig.PostgresAuth
+func (t *shard) processPgPassword(c *pgConn, payload []byte) {
+	r := c.request
+	if r == nil {
+		return
+	}
+
+	switch t.config.PostgresAuth {
+	case PostgresAuthKeep:
+		r.appendRequest(pgMessage('p', payload), false, t.config.MaxMessageSize)
+	case PostgresAuthReplace:
+		var password []byte
+
+		switch c.authCode {
+		case pgAuthCleartextPassword:
+			password = []byte(t.config.PostgresPassword)
+		case pgAuthMD5Password:
+			password = []byte(pgMD5Password(c.user, t.config.PostgresPassword, c.salt))
+		default:
+			// SASL messages depend on server nonce, so they can't be replaced
+			return
+		}
+
+		r.appendRequest(pgMessage('p', append(password, 0)), false, t.config.MaxMessageSize)
+	}
+}
+
+// pgMD5Password returns password as sent for MD5 authentication: "md5" followed by md5(md5(password + user) + salt)
+func pgMD5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// pgMessage builds typed message
+func pgMessage(msgType byte, payload []byte) []byte {
+	msg := make([]byte, 5, 5+len(payload))
+	msg[0] = msgType
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(payload)+4))
+
+	return append(msg, payload...)
+}
+
+// processPgFrontendMessage adds message to the request being sent, and emits request once it is complete
+func (t *shard) processPgFrontendMessage(c *pgConn, packet *TCPPacket, msgType byte, payload, raw []byte, truncated bool) {
+	if c.request == nil {
+		kind := PostgresExtendedQuery
+		switch msgType {
+		case 'Q':
+			kind = PostgresSimpleQuery
+		case 'F':
+			kind = PostgresFunctionCall
+		case 'd', 'c', 'f':
+			kind = PostgresCopyData
+		case 'X':
+			kind = PostgresTerminate
+		}
+
+		c.request = t.newPgRequest(c, packet, kind)
+	}
+
+	r := c.request
+	r.appendRequest(raw, truncated, t.config.MaxMessageSize)
+	r.request.updateCaptureTime(packet.Timestamp)
+
+	switch msgType {
+	case 'Q':
+		query, _ := pgString(payload)
+		r.query.Queries = append(r.query.Queries, query)
+	case 'P':
+		name, n := pgString(payload)
+		query, _ := pgString(payload[n:])
+
+		c.statements[string(name)] = query
+		r.parsed[string(name)] = true
+		r.query.Queries = append(r.query.Queries, query)
+	case 'B':
+		_, n := pgString(payload)
+		name, _ := pgString(payload[n:])
+
+		if query, ok := c.statements[string(name)]; ok && !r.parsed[string(name)] {
+			r.query.Queries = append(r.query.Queries, query)
+		}
+	case 'C':
+		if len(payload) > 0 && payload[0] == 'S' {
+			name, _ := pgString(payload[1:])
+			delete(c.statements, string(name))
+		}
+	}
+
+	switch msgType {
+	case 'Q', 'S', 'F':
+		t.sendPgRequest(c, true)
+	case 'X', 'c', 'f':
+		t.sendPgRequest(c, false)
+	}
+}
+
+// pgString returns string terminated by 0, and number of bytes it takes with terminator
+func pgString(data []byte) ([]byte, int) {
+	if i := bytes.IndexByte(data, 0); i != -1 {
+		return data[:i], i + 1
+	}
+
+	return data, len(data)
+}
+
+func (t *shard) newPgRequest(c *pgConn, packet *TCPPacket, kind string) *pgRequest {
+	c.requests++
+
+	message := NewTCPMessage(packet.Seq, packet.Ack+c.requests, true)
+	message.packets = []*TCPPacket{packet.headerCopy()}
+	message.updateCaptureTime(packet.Timestamp)
+
+	query := &PostgresQuery{Kind: kind, User: c.user, Database: c.db}
+	message.Postgres = query
+
+	return &pgRequest{request: message, query: query, parsed: make(map[string]bool)}
+}
+
+// appendRequest adds message bytes to the request, discarding ones beyond maximum message size
+func (r *pgRequest) appendRequest(raw []byte, truncated bool, maxSize int) {
+	m := r.request
+	if m.Truncated {
+		return
+	}
+
+	p := m.packets[0]
+	if maxSize > 0 && len(p.Data)+len(raw) > maxSize {
+		raw = raw[:maxSize-len(p.Data)]
+		truncated = true
+	}
+
+	p.Data = append(p.Data, raw...)
+	m.size = len(p.Data)
+	m.Truncated = truncated
+}
+
+// sendPgRequest emits request being sent. If server replies to it, request waits for the response.
+func (t *shard) sendPgRequest(c *pgConn, hasResponse bool) {
+	r := c.request
+	c.request = nil
+
+	r.request.End = time.Now()
+	t.emit(r.request)
+
+	if hasResponse {
+		c.pending = append(c.pending, r)
+	}
+}
+
+// processPgBackendMessage adds server message to the response, and emits response once server is ready for the
+// next query
+func (t *shard) processPgBackendMessage(c *pgConn, packet *TCPPacket, msgType byte, payload, raw []byte, truncated bool) {
+	// Server can reply before Sync, if client sent Flush
+	r := c.request
+	if len(c.pending) > 0 {
+		r = c.pending[0]
+	}
+
+	if msgType == 'R' && len(payload) >= 4 {
+		c.authCode = binary.BigEndian.Uint32(payload)
+		if c.authCode == pgAuthMD5Password && len(payload) >= 8 {
+			c.salt = append([]byte{}, payload[4:8]...)
+		}
+	}
+
+	if r == nil {
+		// Response to request sent before capture started, or asynchronous notification
+		return
+	}
+
+	if t.trackResponse {
+		if r.response == nil {
+			r.response = NewTCPMessage(packet.Seq, packet.Ack, false)
+			r.response.packets = []*TCPPacket{packet.headerCopy()}
+			r.response.AssocMessage = r.request
+		}
+
+		m := r.response
+		m.updateCaptureTime(packet.Timestamp)
+
+		if !m.Truncated {
+			p := m.packets[0]
+			if max := t.config.MaxMessageSize; max > 0 && len(p.Data)+len(raw) > max {
+				raw = raw[:max-len(p.Data)]
+				truncated = true
+			}
+			p.Data = append(p.Data, raw...)
+			m.size = len(p.Data)
+			m.Truncated = truncated
+		}
+	}
+
+	switch msgType {
+	case 'D':
+		r.rows++
+	case 'C':
+		tag, _ := pgString(payload)
+		r.tag = string(tag)
+	case 'E':
+		r.errorCode = pgErrorCode(payload)
+
+		// Startup failed, server closes connection without ReadyForQuery
+		if c.phase == pgPhaseAuthentication {
+			if r == c.request {
+				t.sendPgRequest(c, true)
+			}
+			t.finishPgResponse(c)
+		}
+	case 'R':
+		if c.authCode == pgAuthOK && r == c.request && r.query.Kind == PostgresStartup {
+			t.sendPgRequest(c, true)
+		}
+	case 'Z':
+		if c.phase == pgPhaseAuthentication {
+			c.phase = pgPhaseReady
+		}
+
+		if len(c.pending) > 0 {
+			t.finishPgResponse(c)
+		}
+	}
+}
+
+// pgErrorCode returns SQLSTATE code of ErrorResponse
+func pgErrorCode(payload []byte) string {
+	// Fields are type byte followed by string, list ends with 0
+	for len(payload) > 0 && payload[0] != 0 {
+		value, n := pgString(payload[1:])
+		if payload[0] == 'C' {
+			return string(value)
+		}
+		payload = payload[1+n:]
+	}
+
+	return ""
+}
+
+// finishPgResponse emits response of the first pending request
+func (t *shard) finishPgResponse(c *pgConn) {
+	r := c.pending[0]
+	c.pending = c.pending[1:]
+
+	if r.response == nil {
+		return
+	}
+
+	query := *r.query
+	query.Tag = r.tag
+	query.Rows = r.rows
+	query.ErrorCode = r.errorCode
+
+	r.response.Postgres = &query
+	r.response.End = time.Now()
+
+	t.emit(r.response)
+}
+
+// breakPostgres stops decoding of connection, responses in progress are discarded
+func (t *shard) breakPostgres(c *pgConn) {
+	for _, r := range c.pending {
+		if r.response != nil {
+			atomic.AddUint64(&t.stats.messagesExpired, 1)
+		}
+	}
+	c.pending = nil
+
+	if c.request != nil {
+		atomic.AddUint64(&t.stats.messagesExpired, 1)
+		c.request = nil
+	}
+
+	for _, d := range []*pgDirection{&c.client, &c.server} {
+		d.header, d.payload, d.raw = nil, nil, nil
+	}
+
+	c.broken = true
+}
+
+// close discards messages in progress once connection is closed
+func (c *pgConn) close(t *shard, stream *tcpStream) {
+	t.breakPostgres(c)
+}
@@ -0,0 +1,193 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func pgTestStartup(code uint32, params string) []byte {
+	msg := make([]byte, 8, 8+len(params))
+	binary.BigEndian.PutUint32(msg, uint32(8+len(params)))
+	binary.BigEndian.PutUint32(msg[4:], code)
+
+	return append(msg, params...)
+}
+
+func pgTestMessages(messages ...[]byte) []byte {
+	return bytes.Join(messages, nil)
+}
+
+// pgTestConn reuses MySQL test connection, sending data and receiving messages the same way
+func pgTestConn(t *testing.T, config *ListenerConfig) *testConn {
+	config.Protocol = ProtocolPostgres
+	listener, err := NewListener("", "0", engineTest, true, time.Minute, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fSYN, 0, 100, nil).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, fSYN|fACK, 101, 500, nil).Dump())
+
+	return &testConn{listener: listener, clientSeq: 101, serverSeq: 501}
+}
+
+func TestRawListenerPostgres(t *testing.T) {
+	c := pgTestConn(t, &ListenerConfig{PostgresAuth: PostgresAuthReplace, PostgresPassword: "secret"})
+	defer c.listener.Close()
+
+	startup := pgTestStartup(pgProtocolVersion3, "user\x00bob\x00database\x00shop\x00\x00")
+	c.send(true, startup)
+	c.send(false, pgMessage('R', []byte("\x00\x00\x00\x05salt")))
+	c.send(true, pgMessage('p', []byte("md5captured\x00")))
+	c.send(false, pgTestMessages(
+		pgMessage('R', []byte("\x00\x00\x00\x00")),
+		pgMessage('S', []byte("server_version\x0016\x00")),
+		pgMessage('K', []byte("\x00\x00\x00\x01\x00\x00\x00\x02")),
+		pgMessage('Z', []byte("I")),
+	))
+
+	query := pgMessage('Q', []byte("SELECT 1; SELECT 2\x00"))
+	c.send(true, query)
+	response := pgTestMessages(
+		pgMessage('T', []byte("\x00\x01?column?\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x17\x00\x04\xff\xff\xff\xff\x00\x00")),
+		pgMessage('D', []byte("\x00\x01\x00\x00\x00\x011")),
+		pgMessage('C', []byte("SELECT 1\x00")),
+		pgMessage('T', []byte("\x00\x01?column?\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x17\x00\x04\xff\xff\xff\xff\x00\x00")),
+		pgMessage('D', []byte("\x00\x01\x00\x00\x00\x012")),
+		pgMessage('C', []byte("SELECT 1\x00")),
+		pgMessage('Z', []byte("I")),
+	)
+	// Message header is split between segments
+	c.send(false, response[:len(response)-4])
+	c.send(false, response[len(response)-4:])
+
+	// Extended query, server replies to Flush before Sync
+	c.send(true, pgTestMessages(
+		pgMessage('P', []byte("users\x00SELECT name FROM users WHERE id = $1\x00\x00\x00")),
+		pgMessage('H', nil),
+	))
+	c.send(false, pgMessage('1', nil))
+	c.send(true, pgTestMessages(
+		pgMessage('B', []byte("\x00users\x00\x00\x00\x00\x01\x00\x00\x00\x017\x00\x00")),
+		pgMessage('E', []byte("\x00\x00\x00\x00\x00")),
+		pgMessage('S', nil),
+		// Pipelined request, executing statement prepared before
+		pgMessage('B', []byte("\x00users\x00\x00\x00\x00\x01\x00\x00\x00\x018\x00\x00")),
+		pgMessage('E', []byte("\x00\x00\x00\x00\x00")),
+		pgMessage('S', nil),
+	))
+	c.send(false, pgTestMessages(
+		pgMessage('2', nil),
+		pgMessage('D', []byte("\x00\x01\x00\x00\x00\x03ann")),
+		pgMessage('C', []byte("SELECT 1\x00")),
+		pgMessage('Z', []byte("I")),
+		pgMessage('E', []byte("SERROR\x00C22P02\x00Minvalid input\x00\x00")),
+		pgMessage('Z', []byte("I")),
+	))
+
+	c.send(true, pgMessage('X', nil))
+
+	messages := receiveMessages(t, c.listener, 9, func(m *TCPMessage) bool { return m.Postgres != nil })
+
+	if m := messages[0]; m.Postgres.Kind != PostgresStartup || m.Postgres.User != "bob" || m.Postgres.Database != "shop" ||
+		!bytes.Equal(m.Bytes(), append(startup, pgMessage('p', []byte("md5a472781a92412d8a652b427f4c5b7f3f\x00"))...)) {
+		t.Errorf("Should emit startup with replaced password: %q %+v", m.Bytes(), m.Postgres)
+	}
+
+	if m := messages[1]; m.IsIncoming || m.AssocMessage != messages[0] || !bytes.HasSuffix(m.Bytes(), pgMessage('Z', []byte("I"))) {
+		t.Errorf("Should emit authentication response: %q", m.Bytes())
+	}
+
+	if m := messages[2]; m.Postgres.Kind != PostgresSimpleQuery || len(m.Postgres.Queries) != 1 || string(m.Postgres.Queries[0]) != "SELECT 1; SELECT 2" || !bytes.Equal(m.Bytes(), query) {
+		t.Errorf("Should emit query as sent: %q %+v", m.Bytes(), m.Postgres)
+	}
+
+	if m := messages[3]; m.AssocMessage != messages[2] || m.Postgres.Rows != 2 || m.Postgres.Tag != "SELECT 1" || !bytes.Equal(m.Bytes(), response) {
+		t.Errorf("Should emit query response: %q %+v", m.Bytes(), m.Postgres)
+	}
+
+	if m := messages[4]; m.Postgres.Kind != PostgresExtendedQuery || len(m.Postgres.Queries) != 1 || string(m.Postgres.Queries[0]) != "SELECT name FROM users WHERE id = $1" {
+		t.Errorf("Should emit extended query: %q %+v", m.Bytes(), m.Postgres)
+	}
+
+	if m := messages[5]; m.Postgres.Kind != PostgresExtendedQuery || len(m.Postgres.Queries) != 1 || string(m.Postgres.Queries[0]) != "SELECT name FROM users WHERE id = $1" {
+		t.Errorf("Should describe statement prepared before: %+v", m.Postgres)
+	}
+
+	if m := messages[6]; m.AssocMessage != messages[4] || m.Postgres.Rows != 1 || !bytes.HasPrefix(m.Bytes(), pgMessage('1', nil)) {
+		t.Errorf("Should emit response including messages sent before Sync: %q %+v", m.Bytes(), m.Postgres)
+	}
+
+	if m := messages[7]; m.AssocMessage != messages[5] || m.Postgres.ErrorCode != "22P02" {
+		t.Errorf("Should emit error of pipelined request: %+v", m.Postgres)
+	}
+
+	if m := messages[8]; m.Postgres.Kind != PostgresTerminate {
+		t.Errorf("Should emit terminate: %+v", m.Postgres)
+	}
+}
+
+func TestRawListenerPostgresStripPassword(t *testing.T) {
+	c := pgTestConn(t, &ListenerConfig{})
+	defer c.listener.Close()
+
+	startup := pgTestStartup(pgProtocolVersion3, "user\x00bob\x00\x00")
+	c.send(true, startup)
+	c.send(false, pgMessage('R', []byte("\x00\x00\x00\x03")))
+	c.send(true, pgMessage('p', []byte("captured\x00")))
+	c.send(false, pgMessage('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00")))
+
+	messages := receiveMessages(t, c.listener, 2, func(m *TCPMessage) bool { return m.Postgres != nil })
+
+	if m := messages[0]; !bytes.Equal(m.Bytes(), startup) || m.Postgres.Database != "bob" {
+		t.Errorf("Should remove password message: %q %+v", m.Bytes(), m.Postgres)
+	}
+
+	if m := messages[1]; m.Postgres.ErrorCode != "28P01" {
+		t.Errorf("Should emit authentication error: %+v", m.Postgres)
+	}
+}
+
+func TestRawListenerPostgresSSL(t *testing.T) {
+	c := pgTestConn(t, &ListenerConfig{})
+	defer c.listener.Close()
+
+	c.send(true, pgTestStartup(pgSSLRequest, ""))
+	c.send(false, []byte("S"))
+	c.send(true, []byte("\x16\x03\x01\x00\x05hello"))
+
+	receiveMessages(t, c.listener, 0, func(m *TCPMessage) bool { return m.Postgres != nil })
+}
+
+func TestRawListenerPostgresAfterStartup(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolPostgres})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Response to request sent before capture is ignored
+	c.send(false, pgTestMessages(pgMessage('C', []byte("SELECT 0\x00")), pgMessage('Z', []byte("I"))))
+
+	c.send(true, pgMessage('Q', []byte("BEGIN\x00")))
+	c.send(false, pgTestMessages(pgMessage('C', []byte("BEGIN\x00")), pgMessage('Z', []byte("T"))))
+
+	messages := receiveMessages(t, c.listener, 2, func(m *TCPMessage) bool { return m.Postgres != nil })
+	if m := messages[1]; m.Postgres.Tag != "BEGIN" || m.AssocMessage != messages[0] {
+		t.Errorf("Should decode requests of connection captured after startup: %+v", m.Postgres)
+	}
+}
+
+func TestPgMD5Password(t *testing.T) {
+	// md5(md5("secret" + "bob") + "salt")
+	if password := pgMD5Password("bob", "secret", []byte("salt")); password != "md5a472781a92412d8a652b427f4c5b7f3f" {
+		t.Error("Wrong password", password)
+	}
+}
+
+func TestListenerPostgresAuth(t *testing.T) {
+	if _, err := NewListener("", "0", engineTest, false, time.Minute, &ListenerConfig{PostgresAuth: "drop"}); err == nil {
+		t.Error("Should reject unknown authentication handling")
+	}
+}
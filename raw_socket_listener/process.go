@@ -0,0 +1,61 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// How often list of sockets owned by the process is refreshed
+const processRefreshInterval = time.Second
+
+// watchProcess loads ports of sockets owned by ListenerConfig.PID or ListenerConfig.Cgroup,
+// and keeps them up to date while listener is running
+func (t *Listener) watchProcess() error {
+	ports, err := t.readProcessPorts()
+	if err != nil {
+		return err
+	}
+
+	t.processPorts.Store(ports)
+
+	go func() {
+		ticker := time.NewTicker(processRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Keep previous state if process is temporary unavailable
+			if ports, err := t.readProcessPorts(); err != nil {
+				log.Println("Can't read sockets of the process:", err)
+			} else {
+				t.processPorts.Store(ports)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isProcessPacket checks if packet belongs to one of sockets owned by the process.
+// Both ports are checked, so traffic of server and client sockets of the process is captured.
+func (t *Listener) isProcessPacket(data []byte) bool {
+	ports, ok := t.processPorts.Load().(map[uint16]bool)
+	if !ok {
+		return true
+	}
+
+	if len(data) < packetHeaderSize+4 {
+		return false
+	}
+
+	srcPort := binary.BigEndian.Uint16(data[packetHeaderSize : packetHeaderSize+2])
+	destPort := binary.BigEndian.Uint16(data[packetHeaderSize+2 : packetHeaderSize+4])
+
+	return ports[srcPort] || ports[destPort]
+}
@@ -0,0 +1,135 @@
+package rawSocket
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mount points of procfs and cgroup filesystem, changed in tests
+var procRoot = "/proc"
+var cgroupRoot = "/sys/fs/cgroup"
+
+// processPIDs returns ListenerConfig.PID, or all processes of ListenerConfig.Cgroup
+func (t *Listener) processPIDs() (pids []int, err error) {
+	if t.config.PID != 0 {
+		pids = append(pids, t.config.PID)
+	}
+
+	if t.config.Cgroup == "" {
+		return
+	}
+
+	path := t.config.Cgroup
+	if !strings.HasPrefix(path, cgroupRoot) {
+		path = filepath.Join(cgroupRoot, path)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cgroup.procs entry: %s", line)
+		}
+		pids = append(pids, pid)
+	}
+
+	return
+}
+
+// socketInodes returns inodes of sockets opened by the process
+func socketInodes(pid int) (inodes map[string]bool, err error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	inodes = make(map[string]bool)
+	for _, fd := range fds {
+		// Link looks like "socket:[12345]"
+		link, err := os.Readlink(filepath.Join(dir, fd.Name()))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+
+		inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+	}
+
+	return
+}
+
+// readProcNet adds local ports of sockets from /proc/net/tcp-like table, which belong to given inodes
+func readProcNet(path string, inodes map[string]bool, ports map[uint16]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || !inodes[fields[9]] {
+			continue
+		}
+
+		i := strings.LastIndexByte(fields[1], ':')
+		if i == -1 {
+			continue
+		}
+
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+
+		ports[uint16(port)] = true
+	}
+
+	return scanner.Err()
+}
+
+// readProcessPorts returns local ports of all sockets owned by the process
+func (t *Listener) readProcessPorts() (map[uint16]bool, error) {
+	pids, err := t.processPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make(map[uint16]bool)
+
+	for _, pid := range pids {
+		inodes, err := socketInodes(pid)
+		if err != nil {
+			// Process exited
+			if os.IsNotExist(err) && t.config.Cgroup != "" {
+				continue
+			}
+			return nil, err
+		}
+
+		// Socket tables of the process network namespace
+		for _, table := range []string{t.transportProtocol(), t.transportProtocol() + "6"} {
+			path := filepath.Join(procRoot, strconv.Itoa(pid), "net", table)
+			if err := readProcNet(path, inodes, ports); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	return ports, nil
+}
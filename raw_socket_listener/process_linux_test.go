@@ -0,0 +1,95 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:9C40 0100007F:1F90 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 20 4 30 10 -1
+   2: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2001 1 0000000000000000 100 0 0 10 0
+`
+
+func fakeProcess(t *testing.T, root string, pid string, inodes ...string) {
+	fd := filepath.Join(root, pid, "fd")
+	netDir := filepath.Join(root, pid, "net")
+
+	if err := os.MkdirAll(fd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(netDir, 0755)
+
+	for i, inode := range inodes {
+		os.Symlink("socket:["+inode+"]", filepath.Join(fd, string(rune('3'+i))))
+	}
+	os.Symlink("/dev/null", filepath.Join(fd, "0"))
+
+	ioutil.WriteFile(filepath.Join(netDir, "tcp"), []byte(procNetTCP), 0644)
+}
+
+func TestProcessPorts(t *testing.T) {
+	root, _ := ioutil.TempDir("", "gor_proc")
+	defer os.RemoveAll(root)
+
+	defer func(proc, cgroup string) { procRoot, cgroupRoot = proc, cgroup }(procRoot, cgroupRoot)
+	procRoot = filepath.Join(root, "proc")
+	cgroupRoot = filepath.Join(root, "cgroup")
+
+	fakeProcess(t, procRoot, "100", "1001", "1002")
+	fakeProcess(t, procRoot, "200", "2001")
+
+	l := &Listener{config: &ListenerConfig{Protocol: ProtocolTCP, PID: 100}}
+
+	ports, err := l.readProcessPorts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ports) != 2 || !ports[8080] || !ports[40000] {
+		t.Error("Should read ports of process sockets", ports)
+	}
+
+	os.MkdirAll(filepath.Join(cgroupRoot, "web.slice"), 0755)
+	// Process 300 already exited
+	ioutil.WriteFile(filepath.Join(cgroupRoot, "web.slice", "cgroup.procs"), []byte("100\n200\n300\n"), 0644)
+
+	l.config = &ListenerConfig{Protocol: ProtocolTCP, Cgroup: "web.slice"}
+	if ports, err = l.readProcessPorts(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ports) != 3 || !ports[80] {
+		t.Error("Should read ports of all cgroup processes", ports)
+	}
+
+	l.config = &ListenerConfig{Protocol: ProtocolTCP, PID: 300}
+	if _, err = l.readProcessPorts(); err == nil {
+		t.Error("Should fail if process does not exist")
+	}
+}
+
+func TestIsProcessPacket(t *testing.T) {
+	l := &Listener{}
+
+	packet := make([]byte, packetHeaderSize+20)
+	binary.BigEndian.PutUint16(packet[packetHeaderSize:], 40000)
+	binary.BigEndian.PutUint16(packet[packetHeaderSize+2:], 80)
+
+	if !l.isProcessPacket(packet) {
+		t.Error("Should capture everything if process filter not set")
+	}
+
+	l.processPorts.Store(map[uint16]bool{8080: true})
+	if l.isProcessPacket(packet) {
+		t.Error("Should skip packets of other processes")
+	}
+
+	l.processPorts.Store(map[uint16]bool{80: true})
+	if !l.isProcessPacket(packet) {
+		t.Error("Should capture packets of the process")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package rawSocket
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func (t *Listener) readProcessPorts() (map[uint16]bool, error) {
+	return nil, fmt.Errorf("Capture filtering by process is not supported on %s", runtime.GOOS)
+}
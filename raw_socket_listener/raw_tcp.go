@@ -0,0 +1,99 @@
+package rawSocket
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// With ProtocolRawTCP no HTTP parsing is done: data of each connection direction is emitted as it arrives, one chunk
+// per segment, in order of sequence numbers. Chunks carry connection ID and offset in the byte stream of the direction,
+// so binary protocols can be recorded and replayed byte for byte. When connection is closed by FIN from both sides,
+// RST, or expired as idle, empty chunk marked as closed is emitted.
+
+// TCPChunk describes message holding data of raw TCP connection
+type TCPChunk struct {
+	// Connection ID, shared by chunks of both directions, hex encoded like UUID
+	ConnID []byte
+
+	// Offset of chunk data in the byte stream of its direction. Offset following the previous chunk means no data
+	// was lost between them.
+	Offset uint64
+
+	// Connection is closed, chunk has no data
+	Closed bool
+}
+
+// rawTCPConn holds state of connection captured in raw TCP mode
+type rawTCPConn struct {
+	id             []byte
+	client, server rawTCPDirection
+}
+
+// rawTCPDirection holds position of one direction in its byte stream
+type rawTCPDirection struct {
+	streamPosition
+	// Offset of nextSeq in the byte stream
+	offset uint64
+}
+
+func newRawTCPConn(stream *tcpStream) *rawTCPConn {
+	return &rawTCPConn{id: newConnID(stream)}
+}
+
+// newConnID returns ID of the connection, hex encoded like UUID. Time is added, so connections reusing same addresses
+// and ports get distinct IDs.
+func newConnID(stream *tcpStream) []byte {
+	key := append([]byte{}, stream.id[:]...)
+	key = strconv.AppendInt(key, time.Now().UnixNano(), 10)
+
+	sha := sha1.Sum(key)
+	id := make([]byte, 40)
+	hex.Encode(id, sha[:])
+
+	return id
+}
+
+// feed emits data of the segment not emitted yet
+func (c *rawTCPConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if len(data) == 0 {
+		return
+	}
+	packet = packet.slice(len(packet.Data)-len(data), len(packet.Data))
+
+	// Missing data is skipped, it shows as gap between offsets
+	offset := d.offset + uint64(gap)
+	d.offset = offset + uint64(len(data))
+
+	message := NewTCPMessage(packet.Seq, packet.Ack, isIncoming)
+	message.packets = []*TCPPacket{packet}
+	packet.buf.retain()
+	message.size = len(packet.Data)
+	message.End = message.Start
+	message.updateCaptureTime(packet.Timestamp)
+	message.Chunk = &TCPChunk{ConnID: c.id, Offset: offset}
+
+	t.emit(message)
+}
+
+// close emits closing chunk of the connection
+func (c *rawTCPConn) close(t *shard, stream *tcpStream) {
+	// Packet only carries connection addresses
+	packet := &TCPPacket{Addr: stream.id[:16], DstAddr: stream.id[16:32]}
+	packet.SrcPort = uint16(stream.id[32])<<8 | uint16(stream.id[33])
+	packet.DestPort = uint16(stream.id[34])<<8 | uint16(stream.id[35])
+
+	message := NewTCPMessage(0, 0, true)
+	message.packets = []*TCPPacket{packet}
+	message.End = message.Start
+	message.Chunk = &TCPChunk{ConnID: c.id, Offset: c.client.offset, Closed: true}
+
+	t.emit(message)
+}
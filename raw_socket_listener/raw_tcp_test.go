@@ -0,0 +1,87 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRawListenerRawTCP(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolRawTCP})
+	defer listener.Close()
+
+	send := func(isIncoming bool, flags uint8, ack, seq uint32, data string) {
+		listener.packetsChan <- newPacketBuffer(buildConnPacket(isIncoming, 1, flags, ack, seq, []byte(data)).Dump())
+	}
+
+	send(true, fSYN, 0, 100, "")
+	send(false, fSYN|fACK, 101, 500, "")
+
+	// Binary data looking like HTTP is not parsed
+	send(true, fACK, 501, 101, "GET ")
+	// Retransmission covering new data as well
+	send(true, fACK, 501, 101, "GET \x00\x01")
+	send(false, fACK, 107, 501, "\xff\xfe")
+	// Segment is lost
+	send(true, fACK, 503, 117, "\x02")
+	send(true, fFIN|fACK, 503, 118, "")
+	send(false, fFIN|fACK, 119, 503, "")
+
+	expected := []struct {
+		incoming bool
+		offset   uint64
+		data     string
+		closed   bool
+	}{
+		{true, 0, "GET ", false},
+		{true, 4, "\x00\x01", false},
+		{false, 0, "\xff\xfe", false},
+		{true, 16, "\x02", false},
+		{true, 17, "", true},
+	}
+
+	var connID []byte
+
+	for i, e := range expected {
+		select {
+		case m := <-listener.messagesChan:
+			c := m.Chunk
+			if c == nil || m.IsIncoming != e.incoming || c.Offset != e.offset || string(m.Bytes()) != e.data || c.Closed != e.closed {
+				t.Errorf("Wrong chunk %d: %q %+v", i, m.Bytes(), c)
+				continue
+			}
+
+			if connID == nil {
+				connID = c.ConnID
+			} else if !bytes.Equal(c.ConnID, connID) {
+				t.Error("Chunks of connection should share connection ID")
+			}
+
+			if m.Src().Port == 0 && m.Dst().Port == 0 {
+				t.Error("Chunk should have connection addresses")
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit chunks", i)
+		}
+	}
+}
+
+func TestRawListenerRawTCPReset(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Minute, &ListenerConfig{Protocol: ProtocolRawTCP})
+	defer listener.Close()
+
+	// Connection captured in the middle
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fACK, 1, 1000, []byte("a")).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, fRST, 1, 1001, nil).Dump())
+
+	for i, closed := range []bool{false, true} {
+		select {
+		case m := <-listener.messagesChan:
+			if m.Chunk == nil || m.Chunk.Closed != closed || m.Chunk.Offset != uint64(i) {
+				t.Errorf("Wrong chunk %d: %+v", i, m.Chunk)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit chunks", i)
+		}
+	}
+}
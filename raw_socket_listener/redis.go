@@ -0,0 +1,443 @@
+package rawSocket
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// With ProtocolRedis connections are decoded as RESP2 or RESP3. Each command sent by client, as array of bulk
+// strings or inline command, is emitted as request holding it as sent, and each reply is emitted as response of the
+// command, in order, since clients can pipeline commands. RESP3 push messages are not replies, and are skipped.
+// After client subscribes to channels or starts MONITOR, server sends messages instead of replies, so commands
+// are emitted without responses. Connections with missing segments, or data not looking like RESP, are not decoded
+// anymore.
+
+// Maximum size of RESP line, like array header, or inline command
+const respMaxLineSize = 64 * 1024
+
+// Maximum size of command argument kept in RedisCommand
+const respMaxArgSize = 1024
+
+// Commands switching connection to receiving messages instead of replies
+var redisStreamingCommands = map[string]bool{
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"SSUBSCRIBE": true,
+	"MONITOR":    true,
+}
+
+// RedisCommand describes message holding Redis command, or its reply
+type RedisCommand struct {
+	// ID of the connection, shared by all its commands, hex encoded like UUID
+	ConnID []byte
+
+	// Command name in upper case, like "GET", its first argument, usually key, and number of arguments including
+	// command name
+	Name string
+	Key  []byte
+	Args int
+
+	// Reply fields: type byte of reply, like '+' for simple string, and message of error reply
+	ReplyType byte
+	Error     string
+}
+
+// redisConn holds RESP decoding state of single connection
+type redisConn struct {
+	id             []byte
+	client, server respDirection
+
+	// Commands waiting for replies, in order
+	pending []*redisPending
+
+	// Server sends messages instead of replies, see redisStreamingCommands
+	streaming bool
+
+	// Number of commands, it keeps UUIDs of commands sent in the same segment distinct
+	commands uint32
+
+	// Decoding failed, like because of missing segment, and value boundaries are lost
+	broken bool
+}
+
+type redisPending struct {
+	request *TCPMessage
+	command *RedisCommand
+}
+
+// respDirection holds state of values sent by one side of connection
+type respDirection struct {
+	streamPosition
+
+	// Not complete line
+	line []byte
+	// Bytes of bulk string left to receive, including CRLF, and where its data is kept
+	bulk    int64
+	collect int
+	// Elements left to receive in each not complete aggregate value. Attributes are negative, since they are not
+	// elements of the parent aggregate.
+	stack []int64
+
+	// Value being received, and whether it is complete
+	value    *respValue
+	complete bool
+}
+
+// Bulk string data kept in respValue
+const (
+	respCollectNone = iota
+	respCollectArg
+	respCollectError
+)
+
+// respValue collects single top level value: command or reply
+type respValue struct {
+	message *TCPMessage
+
+	// Type byte of the value, attributes preceding value are not counted
+	valueType byte
+	// First arguments of command, number of arguments, and error message of reply
+	args  [][]byte
+	nargs int
+	err   []byte
+}
+
+func newRedisConn(stream *tcpStream) *redisConn {
+	return &redisConn{id: newConnID(stream)}
+}
+
+// feed parses values of the segment, and emits values which are complete
+func (c *redisConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if gap > 0 {
+		// Value boundaries are unknown after missing data
+		t.breakRedis(c)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	for len(data) > 0 && !c.broken {
+		if d.value == nil {
+			d.value = t.newRESPValue(c, packet, isIncoming)
+		}
+		v := d.value
+		v.message.updateCaptureTime(packet.Timestamp)
+
+		if d.bulk > 0 {
+			n := int64(len(data))
+			if n > d.bulk {
+				n = d.bulk
+			}
+
+			v.appendRaw(data[:n], t.config.MaxMessageSize)
+			d.collectBulk(data[:n])
+			d.bulk -= n
+			data = data[n:]
+
+			if d.bulk == 0 {
+				d.finishElement()
+			}
+		} else {
+			i := bytes.IndexByte(data, '\n')
+			if i == -1 {
+				d.line = append(d.line, data...)
+				v.appendRaw(data, t.config.MaxMessageSize)
+				if len(d.line) > respMaxLineSize {
+					t.breakRedis(c)
+				}
+				return
+			}
+
+			line := append(d.line, data[:i+1]...)
+			v.appendRaw(data[:i+1], t.config.MaxMessageSize)
+			d.line = d.line[:0]
+			data = data[i+1:]
+
+			if !d.parseLine(line, isIncoming) {
+				t.breakRedis(c)
+				return
+			}
+		}
+
+		if d.complete {
+			t.finishRESPValue(c, isIncoming)
+		}
+	}
+}
+
+// parseLine handles line of the value: type byte followed by its data, or inline command. Returns false if data
+// is not RESP.
+func (d *respDirection) parseLine(line []byte, isIncoming bool) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	v := d.value
+
+	if len(line) == 0 {
+		// Empty inline command
+		return isIncoming && len(d.stack) == 0
+	}
+
+	topLevel := len(d.stack) == 0 && v.valueType == 0
+
+	if isIncoming && topLevel && line[0] != '*' {
+		// Inline command, arguments separated by spaces
+		for _, b := range line {
+			if b < 0x20 && b != '\t' || b == 0x7f {
+				return false
+			}
+		}
+
+		v.valueType = '*'
+		for _, arg := range bytes.Fields(line) {
+			if len(v.args) < 2 {
+				v.args = append(v.args, appendLimited(nil, arg, respMaxArgSize))
+			}
+			v.nargs++
+		}
+		d.complete = true
+
+		return true
+	}
+
+	if topLevel && line[0] != '|' {
+		v.valueType = line[0]
+	}
+
+	switch line[0] {
+	case '*', '%', '~', '>', '|':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || n < -1 {
+			return false
+		}
+
+		if len(d.stack) == 0 && isIncoming {
+			v.nargs = int(n)
+		}
+
+		switch line[0] {
+		case '%':
+			n *= 2
+		case '|':
+			// Attribute precedes value, it is not element of the parent
+			if n <= 0 {
+				return true
+			}
+			d.stack = append(d.stack, -2*n)
+			return true
+		}
+
+		if n <= 0 {
+			d.finishElement()
+			return true
+		}
+
+		d.stack = append(d.stack, n)
+	case '$', '=', '!':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || n < -1 {
+			return false
+		}
+
+		if n == -1 {
+			d.finishElement()
+			return true
+		}
+
+		// Bulk data is followed by CRLF
+		d.bulk = n + 2
+		d.collect = respCollectNone
+
+		switch {
+		case isIncoming && len(d.stack) == 1 && len(v.args) < 2:
+			v.args = append(v.args, nil)
+			d.collect = respCollectArg
+		case !isIncoming && len(d.stack) == 0 && line[0] == '!':
+			d.collect = respCollectError
+		}
+	case '+', ':', '_', ',', '#', '(':
+		d.finishElement()
+	case '-':
+		if len(d.stack) == 0 {
+			v.err = append([]byte{}, line[1:]...)
+		}
+		d.finishElement()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// finishElement counts element of the aggregate being received, and marks top level value complete
+func (d *respDirection) finishElement() {
+	for len(d.stack) > 0 {
+		top := &d.stack[len(d.stack)-1]
+
+		if *top < 0 {
+			*top++
+			if *top == 0 {
+				// Attribute is complete, value follows it
+				d.stack = d.stack[:len(d.stack)-1]
+			}
+			return
+		}
+
+		*top--
+		if *top > 0 {
+			return
+		}
+
+		d.stack = d.stack[:len(d.stack)-1]
+	}
+
+	d.complete = true
+}
+
+func (t *shard) newRESPValue(c *redisConn, packet *TCPPacket, isIncoming bool) *respValue {
+	ack := packet.Ack
+	if isIncoming {
+		c.commands++
+		ack += c.commands
+	}
+
+	message := NewTCPMessage(packet.Seq, ack, isIncoming)
+	message.packets = []*TCPPacket{packet.headerCopy()}
+
+	return &respValue{message: message}
+}
+
+// appendRaw adds value bytes to the message, discarding ones beyond maximum message size
+func (v *respValue) appendRaw(data []byte, maxSize int) {
+	m := v.message
+	if m.Truncated {
+		return
+	}
+
+	p := m.packets[0]
+	if maxSize > 0 && len(p.Data)+len(data) > maxSize {
+		data = data[:maxSize-len(p.Data)]
+		m.Truncated = true
+	}
+
+	p.Data = append(p.Data, data...)
+	m.size = len(p.Data)
+}
+
+// collectBulk keeps bulk string data needed to describe the value, CRLF following data is not kept
+func (d *respDirection) collectBulk(data []byte) {
+	if d.collect == respCollectNone {
+		return
+	}
+
+	if content := d.bulk - 2; content < int64(len(data)) {
+		if content < 0 {
+			content = 0
+		}
+		data = data[:content]
+	}
+
+	v := d.value
+	if d.collect == respCollectArg {
+		v.args[len(v.args)-1] = appendLimited(v.args[len(v.args)-1], data, respMaxArgSize)
+	} else {
+		v.err = appendLimited(v.err, data, respMaxArgSize)
+	}
+}
+
+// appendLimited appends data, keeping size of buf within the limit
+func appendLimited(buf []byte, data []byte, limit int) []byte {
+	if len(buf)+len(data) > limit {
+		if len(buf) >= limit {
+			return buf
+		}
+		data = data[:limit-len(buf)]
+	}
+
+	return append(buf, data...)
+}
+
+// finishRESPValue emits command, or reply as response of the first pending command
+func (t *shard) finishRESPValue(c *redisConn, isIncoming bool) {
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	v := d.value
+	d.value, d.complete = nil, false
+	v.message.End = time.Now()
+
+	if isIncoming {
+		t.emitRedisCommand(c, v)
+		return
+	}
+
+	// Push messages are sent by server at any time, and reply to command sent before capture started has no command
+	if v.valueType == '>' || c.streaming || len(c.pending) == 0 {
+		return
+	}
+
+	p := c.pending[0]
+	c.pending = c.pending[1:]
+
+	command := *p.command
+	command.ReplyType = v.valueType
+	command.Error = string(v.err)
+
+	v.message.AssocMessage = p.request
+	v.message.Redis = &command
+
+	t.emit(v.message)
+}
+
+// emitRedisCommand emits command, and waits for its reply if responses are tracked
+func (t *shard) emitRedisCommand(c *redisConn, v *respValue) {
+	command := &RedisCommand{ConnID: c.id, Args: v.nargs}
+	if len(v.args) > 0 {
+		command.Name = string(bytes.ToUpper(v.args[0]))
+	}
+	if len(v.args) > 1 {
+		command.Key = v.args[1]
+	}
+
+	v.message.Redis = command
+	t.emit(v.message)
+
+	if redisStreamingCommands[command.Name] {
+		c.streaming = true
+		c.pending = nil
+	}
+
+	if t.trackResponse && !c.streaming {
+		c.pending = append(c.pending, &redisPending{request: v.message, command: command})
+	}
+}
+
+// breakRedis stops decoding of connection, values in progress and replies not received yet are discarded
+func (t *shard) breakRedis(c *redisConn) {
+	atomic.AddUint64(&t.stats.messagesExpired, uint64(len(c.pending)))
+	c.pending = nil
+
+	for _, d := range []*respDirection{&c.client, &c.server} {
+		d.line, d.stack, d.value = nil, nil, nil
+	}
+
+	c.broken = true
+}
+
+// close discards messages in progress once connection is closed
+func (c *redisConn) close(t *shard, stream *tcpStream) {
+	t.breakRedis(c)
+}
@@ -0,0 +1,90 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRawListenerRedis(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolRedis})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Pipelined commands, split in the middle of bulk string
+	commands := "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n*3\r\n$3\r\nset\r\n$3\r\nbar\r\n$1\r\n1\r\n"
+	c.send(true, []byte(commands[:20]))
+	c.send(true, []byte(commands[20:]))
+	c.send(false, []byte("$3\r\nabc\r\n+OK\r\n"))
+
+	c.send(true, []byte("PING\r\n"))
+	c.send(false, []byte("+PONG\r\n"))
+
+	// RESP3 push message is not a reply, and attribute is part of the reply
+	c.send(true, []byte("*1\r\n$4\r\nKEYS\r\n"))
+	c.send(false, []byte(">3\r\n+message\r\n+ch\r\n+hi\r\n|1\r\n+ttl\r\n:5\r\n*2\r\n$1\r\na\r\n%1\r\n+b\r\n_\r\n"))
+
+	c.send(true, []byte("*1\r\n$4\r\nINCR\r\n*1\r\n$4\r\nEVAL\r\n"))
+	c.send(false, []byte("-ERR wrong number of arguments\r\n!9\r\nNOSCRIPT \r\n"))
+
+	// Messages sent after subscription are not replies
+	c.send(true, []byte("*2\r\n$9\r\nSUBSCRIBE\r\n$2\r\nch\r\n"))
+	c.send(false, []byte("*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"))
+
+	messages := receiveMessages(t, listener, 13, func(m *TCPMessage) bool { return m.Redis != nil })
+
+	if m := messages[0]; !m.IsIncoming || m.Redis.Name != "GET" || string(m.Redis.Key) != "foo" || m.Redis.Args != 2 || string(m.Bytes()) != commands[:22] {
+		t.Errorf("Should emit command as sent: %q %+v", m.Bytes(), m.Redis)
+	}
+
+	if m := messages[1]; m.Redis.Name != "SET" || string(m.Redis.Key) != "bar" || m.Redis.Args != 3 {
+		t.Errorf("Should emit pipelined command: %q %+v", m.Bytes(), m.Redis)
+	}
+
+	if m := messages[2]; m.IsIncoming || m.AssocMessage != messages[0] || m.Redis.ReplyType != '$' || m.Redis.Name != "GET" || string(m.Bytes()) != "$3\r\nabc\r\n" {
+		t.Errorf("Should emit reply of the first command: %q %+v", m.Bytes(), m.Redis)
+	}
+
+	if m := messages[3]; m.AssocMessage != messages[1] || m.Redis.ReplyType != '+' {
+		t.Errorf("Should emit reply of the second command: %q %+v", m.Bytes(), m.Redis)
+	}
+
+	if m := messages[4]; m.Redis.Name != "PING" || m.Redis.Args != 1 || string(m.Bytes()) != "PING\r\n" {
+		t.Errorf("Should emit inline command: %q %+v", m.Bytes(), m.Redis)
+	}
+
+	if m := messages[7]; m.AssocMessage != messages[6] || m.Redis.ReplyType != '*' || !bytes.HasPrefix(m.Bytes(), []byte("|1")) || !bytes.HasSuffix(m.Bytes(), []byte("_\r\n")) {
+		t.Errorf("Should emit reply with attribute: %q %+v", m.Bytes(), m.Redis)
+	}
+
+	if m := messages[10]; m.Redis.Name != "INCR" || m.Redis.Error != "ERR wrong number of arguments" {
+		t.Errorf("Should emit error: %+v", m.Redis)
+	}
+
+	if m := messages[11]; m.Redis.Name != "EVAL" || m.Redis.ReplyType != '!' || m.Redis.Error != "NOSCRIPT " {
+		t.Errorf("Should emit bulk error: %+v", m.Redis)
+	}
+
+	if m := messages[12]; m.Redis.Name != "SUBSCRIBE" || !m.IsIncoming {
+		t.Errorf("Should emit subscription: %+v", m.Redis)
+	}
+
+	for _, m := range messages {
+		if !bytes.Equal(m.Redis.ConnID, messages[0].Redis.ConnID) {
+			t.Error("Commands should share connection ID")
+		}
+	}
+}
+
+func TestRawListenerRedisNotRESP(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolRedis})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	c.send(true, []byte("\x16\x03\x01\x00\x05hello\r\n"))
+	c.send(true, []byte("PING\r\n"))
+
+	receiveMessages(t, listener, 0, func(m *TCPMessage) bool { return m.Redis != nil })
+}
@@ -0,0 +1,160 @@
+package rawSocket
+
+import (
+	"time"
+)
+
+// Default time to wait for missing segment, before giving up and processing what we have
+const defaultReorderTimeout = 100 * time.Millisecond
+
+// reorderBuffer holds segments of one direction of connection, which were captured ahead of expected sequence number.
+// Segments are released in sequence order once the gap is filled, or when waiting for the missing segment timed out.
+type reorderBuffer struct {
+	nextSeq uint32
+	started bool
+
+	// Sorted by Seq
+	segments []*TCPPacket
+	// Since when we are waiting for the missing segment
+	since time.Time
+}
+
+// start sets expected sequence number, for example from SYN packet
+func (b *reorderBuffer) start(seq uint32) {
+	b.nextSeq = seq
+	b.started = true
+}
+
+// add returns segments ready for processing, in sequence order.
+// If there is gap before the packet it is buffered, until gap filled, or number of buffered segments exceed `window`.
+func (b *reorderBuffer) add(packet *TCPPacket, window int) []*TCPPacket {
+	if !b.started {
+		b.start(packet.Seq)
+	}
+
+	if seqDiff(packet.Seq, b.nextSeq) <= 0 {
+		b.advance(packet)
+
+		return append([]*TCPPacket{packet}, b.drain()...)
+	}
+
+	b.insert(packet)
+
+	if len(b.segments) > window {
+		return b.release()
+	}
+
+	return nil
+}
+
+func (b *reorderBuffer) insert(packet *TCPPacket) {
+	if len(b.segments) == 0 {
+		b.since = time.Now()
+	}
+
+	i := len(b.segments)
+	for i > 0 && seqDiff(packet.Seq, b.segments[i-1].Seq) < 0 {
+		i--
+	}
+
+	b.segments = append(b.segments, nil)
+	copy(b.segments[i+1:], b.segments[i:])
+	b.segments[i] = packet
+}
+
+func (b *reorderBuffer) advance(packet *TCPPacket) {
+	if end := packet.nextSeq(); seqDiff(end, b.nextSeq) > 0 {
+		b.nextSeq = end
+	}
+}
+
+// drain returns buffered segments which are not separated by gap anymore
+func (b *reorderBuffer) drain() (ready []*TCPPacket) {
+	for len(b.segments) > 0 && seqDiff(b.segments[0].Seq, b.nextSeq) <= 0 {
+		ready = append(ready, b.segments[0])
+		b.advance(b.segments[0])
+		b.segments = b.segments[1:]
+	}
+
+	if len(ready) > 0 && len(b.segments) > 0 {
+		b.since = time.Now()
+	}
+
+	return
+}
+
+// release stops waiting for the first missing segment, and returns segments following it
+func (b *reorderBuffer) release() []*TCPPacket {
+	if len(b.segments) == 0 {
+		return nil
+	}
+
+	b.nextSeq = b.segments[0].Seq
+
+	return b.drain()
+}
+
+// releaseAll returns all buffered segments, ignoring gaps
+func (b *reorderBuffer) releaseAll() (ready []*TCPPacket) {
+	for len(b.segments) > 0 {
+		ready = append(ready, b.release()...)
+	}
+
+	return
+}
+
+// expired returns segments for which waiting for the missing data timed out
+func (b *reorderBuffer) expired(now time.Time, timeout time.Duration) (ready []*TCPPacket) {
+	for len(b.segments) > 0 && now.Sub(b.since) >= timeout {
+		ready = append(ready, b.release()...)
+	}
+
+	return
+}
+
+// reorder passes packet through reorder buffer of its direction, and returns segments ready for processing
+func (s *tcpStream) reorder(packet *TCPPacket, isIncoming bool, window int) []*TCPPacket {
+	if isIncoming {
+		return s.clientSegments.add(packet, window)
+	}
+
+	return s.serverSegments.add(packet, window)
+}
+
+// processSegments passes data packets to message assembling, through reorder buffer if it is enabled
+func (t *shard) processSegments(stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if t.config.ReorderWindow <= 0 {
+		t.processTCPData(stream, packet, isIncoming)
+		return
+	}
+
+	// Buffered segments hold their buffers until released
+	packet.buf.retain()
+
+	for _, p := range stream.reorder(packet, isIncoming, t.config.ReorderWindow) {
+		t.processTCPData(stream, p, isIncoming)
+		p.buf.release()
+	}
+}
+
+// releaseSegments processes buffered segments of the connection. If `all` is false only timed out ones are released.
+func (t *shard) releaseSegments(stream *tcpStream, now time.Time, all bool) {
+	var client, server []*TCPPacket
+
+	if all {
+		client, server = stream.clientSegments.releaseAll(), stream.serverSegments.releaseAll()
+	} else {
+		client = stream.clientSegments.expired(now, t.config.ReorderTimeout)
+		server = stream.serverSegments.expired(now, t.config.ReorderTimeout)
+	}
+
+	for _, p := range client {
+		t.processTCPData(stream, p, true)
+		p.buf.release()
+	}
+
+	for _, p := range server {
+		t.processTCPData(stream, p, false)
+		p.buf.release()
+	}
+}
@@ -0,0 +1,89 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func segmentsData(segments []*TCPPacket) []byte {
+	var buf []byte
+	for _, s := range segments {
+		buf = append(buf, s.Data...)
+	}
+
+	return buf
+}
+
+func TestReorderBufferInOrder(t *testing.T) {
+	b := &reorderBuffer{}
+
+	if ready := b.add(buildPacket(true, 1, 1, []byte("ab")), 10); !bytes.Equal(segmentsData(ready), []byte("ab")) {
+		t.Error("Should pass first segment", ready)
+	}
+
+	if ready := b.add(buildPacket(true, 1, 3, []byte("cd")), 10); !bytes.Equal(segmentsData(ready), []byte("cd")) {
+		t.Error("Should pass segment in order", ready)
+	}
+
+	// Retransmission of already passed data
+	if ready := b.add(buildPacket(true, 1, 1, []byte("ab")), 10); len(ready) != 1 {
+		t.Error("Should pass old segments as is", ready)
+	}
+}
+
+func TestReorderBufferGap(t *testing.T) {
+	b := &reorderBuffer{}
+	b.start(1)
+
+	if ready := b.add(buildPacket(true, 1, 5, []byte("ef")), 10); len(ready) != 0 {
+		t.Error("Should wait for missing segment", ready)
+	}
+
+	if ready := b.add(buildPacket(true, 1, 3, []byte("cd")), 10); len(ready) != 0 {
+		t.Error("Should wait for missing segment", ready)
+	}
+
+	if ready := b.add(buildPacket(true, 1, 1, []byte("ab")), 10); !bytes.Equal(segmentsData(ready), []byte("abcdef")) {
+		t.Error("Should release segments in order", string(segmentsData(ready)))
+	}
+}
+
+func TestReorderBufferWindow(t *testing.T) {
+	b := &reorderBuffer{}
+	b.start(1)
+
+	b.add(buildPacket(true, 1, 3, []byte("c")), 1)
+
+	if ready := b.add(buildPacket(true, 1, 4, []byte("d")), 1); !bytes.Equal(segmentsData(ready), []byte("cd")) {
+		t.Error("Should stop waiting when window is full", string(segmentsData(ready)))
+	}
+}
+
+func TestReorderBufferTimeout(t *testing.T) {
+	b := &reorderBuffer{}
+	b.start(1)
+
+	b.add(buildPacket(true, 1, 3, []byte("c")), 10)
+
+	if ready := b.expired(time.Now(), time.Second); len(ready) != 0 {
+		t.Error("Should wait until timeout", ready)
+	}
+
+	if ready := b.expired(time.Now().Add(time.Second), time.Second); !bytes.Equal(segmentsData(ready), []byte("c")) {
+		t.Error("Should release segments after timeout", ready)
+	}
+}
+
+func TestReorderBufferWraparound(t *testing.T) {
+	b := &reorderBuffer{}
+	b.start(0xFFFFFFFF)
+
+	if ready := b.add(buildPacket(true, 1, 1, []byte("c")), 10); len(ready) != 0 {
+		t.Error("Should wait for missing segment", ready)
+	}
+
+	if ready := b.add(buildPacket(true, 1, 0xFFFFFFFF, []byte("ab")), 10); !bytes.Equal(segmentsData(ready), []byte("abc")) {
+		t.Error("Should release segments in order", string(segmentsData(ready)))
+	}
+}
@@ -0,0 +1,227 @@
+package rawSocket
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+)
+
+// shard owns reassembly state of part of connections, and processes their packets in own goroutine.
+// Connections are assigned to shards by hash of their addresses, so both directions of connection processed by same shard.
+type shard struct {
+	// Keep counters first, to guarantee 64bit alignment required by atomic
+	messagesInFlight int64
+	bytesInFlight    int64
+	streamsInFlight  int64
+
+	*Listener
+
+	// buffer of TCPMessages waiting to be send
+	// ID -> TCPMessage
+	messages map[tcpID]*TCPMessage
+	// Total size of messages data, see ListenerConfig.MaxBufferedBytes
+	bufferedBytes int
+	// Messages ordered by time of the last packet
+	expiry expiryQueue
+
+	// Per connection reassembly state
+	streams map[connID]*tcpStream
+
+	// Last request of each UDP flow, waiting for response
+	udpRequests map[connID]*TCPMessage
+
+	// Packets of connections assigned to the shard
+	packetsChan chan *packetBuffer
+
+	// ListenerConfig.MaxMessages and ListenerConfig.MaxBufferedBytes, split between shards
+	maxMessages, maxBufferedBytes int
+
+	// Dispatched messages waiting to be sent to ReceiverBatches()
+	batch []*TCPMessage
+}
+
+func newShards(l *Listener, n int) (shards []*shard) {
+	for i := 0; i < n; i++ {
+		s := &shard{
+			Listener:         l,
+			messages:         make(map[tcpID]*TCPMessage),
+			streams:          make(map[connID]*tcpStream),
+			udpRequests:      make(map[connID]*TCPMessage),
+			maxMessages:      (l.config.MaxMessages + n - 1) / n,
+			maxBufferedBytes: (l.config.MaxBufferedBytes + n - 1) / n,
+		}
+
+		// Single shard processes all packets, no need to route them
+		if n == 1 {
+			s.packetsChan = l.packetsChan
+		} else {
+			s.packetsChan = make(chan *packetBuffer, l.config.PacketsBufferSize/n+1)
+		}
+
+		shards = append(shards, s)
+	}
+
+	return
+}
+
+// routePackets sends captured packets to shards until listener is stopped
+func (t *Listener) routePackets() {
+	for {
+		select {
+		case <-t.ctx.Done():
+			t.closeCapture()
+
+			for len(t.packetsChan) > 0 {
+				buf := <-t.packetsChan
+				t.packetShard(buf.data).packetsChan <- buf
+			}
+
+			return
+		case buf := <-t.packetsChan:
+			t.packetShard(buf.data).packetsChan <- buf
+		}
+	}
+}
+
+// packetShard returns shard processing connection of the packet
+func (t *Listener) packetShard(data []byte) *shard {
+	if len(t.shards) == 1 || len(data) < packetHeaderSize+4 {
+		return t.shards[0]
+	}
+
+	srcIP, dstIP := data[:16], data[16:packetAddrSize]
+	srcPort, dstPort := data[packetHeaderSize:packetHeaderSize+2], data[packetHeaderSize+2:packetHeaderSize+4]
+
+	// Destination address is unknown for packets captured by raw_socket engine over IPv6, see packetConnID
+	if isZeroBytes(dstIP) {
+		srcIP, dstIP = nil, nil
+	}
+
+	// Endpoints are hashed in canonical order, so both directions of connection get same hash
+	if c := bytes.Compare(srcIP, dstIP); c > 0 || (c == 0 && bytes.Compare(srcPort, dstPort) > 0) {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	hash := uint32(2166136261)
+	for _, part := range [][]byte{srcIP, srcPort, dstIP, dstPort} {
+		hash = fnvHash(hash, part)
+	}
+
+	return t.shards[hash%uint32(len(t.shards))]
+}
+
+// fnvHash continues FNV-1a hash with given bytes
+func fnvHash(hash uint32, data []byte) uint32 {
+	for _, b := range data {
+		hash = (hash ^ uint32(b)) * 16777619
+	}
+
+	return hash
+}
+
+// listen processes packets of the shard until done is closed, then dispatches all in-flight messages
+func (t *shard) listen(done <-chan struct{}) {
+	gcTicker := time.NewTicker(t.messageExpire / 2)
+	defer gcTicker.Stop()
+
+	var reorderTick <-chan time.Time
+	if t.config.ReorderWindow > 0 {
+		reorderTicker := time.NewTicker(t.config.ReorderTimeout / 2)
+		defer reorderTicker.Stop()
+
+		reorderTick = reorderTicker.C
+	}
+
+	var batchTick <-chan time.Time
+	if t.batchesChan != nil {
+		batchTicker := time.NewTicker(t.config.BatchInterval)
+		defer batchTicker.Stop()
+
+		batchTick = batchTicker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			t.flush()
+			return
+		case buf := <-t.packetsChan:
+			t.processPacket(buf)
+		case <-gcTicker.C:
+			now := time.Now()
+
+			t.expireMessages(now)
+			t.expireStreams(now)
+			t.expireUDPRequests(now)
+		case now := <-reorderTick:
+			for _, stream := range t.streams {
+				t.releaseSegments(stream, now, false)
+			}
+		case <-batchTick:
+			t.flushBatch()
+		}
+
+		t.updateGauges()
+	}
+}
+
+// updateGauges publishes sizes of shard state for ListenerStats
+func (t *shard) updateGauges() {
+	atomic.StoreInt64(&t.messagesInFlight, int64(len(t.messages)))
+	atomic.StoreInt64(&t.bytesInFlight, int64(t.bufferedBytes))
+	atomic.StoreInt64(&t.streamsInFlight, int64(len(t.streams)+len(t.udpRequests)))
+}
+
+// processPacket parses captured packet and passes it to message assembling.
+// Buffer is released afterwards, unless packet is held by message or reorder buffer.
+func (t *shard) processPacket(buf *packetBuffer) {
+	defer buf.release()
+
+	atomic.AddUint64(&t.stats.packetsReceived, 1)
+
+	data := buf.data
+	if !t.isProcessPacket(data) {
+		return
+	}
+
+	if t.udp {
+		t.processUDPPacket(data, buf)
+		return
+	}
+
+	packet := ParseTCPPacket(data[:16], data[16:packetAddrSize], data[packetHeaderSize:])
+	packet.Timestamp = packetTimestamp(data)
+	packet.buf = buf
+	t.processTCPPacket(packet)
+	t.evictMessages()
+}
+
+// flush processes already captured packets and dispatches all in-flight messages
+func (t *shard) flush() {
+	for len(t.packetsChan) > 0 {
+		t.processPacket(<-t.packetsChan)
+	}
+
+	now := time.Now()
+	for _, stream := range t.streams {
+		t.releaseSegments(stream, now, true)
+	}
+
+	// Dispatch requests before responses, so responses can be associated with them
+	for _, message := range t.messages {
+		if message.IsIncoming {
+			t.dispatchMessage(message)
+		}
+	}
+
+	for _, message := range t.messages {
+		t.dispatchMessage(message)
+	}
+
+	t.flushBatch()
+
+	atomic.StoreInt64(&t.messagesInFlight, 0)
+	atomic.StoreInt64(&t.bytesInFlight, 0)
+	atomic.StoreInt64(&t.streamsInFlight, 0)
+}
@@ -0,0 +1,74 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPacketShard(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Second, &ListenerConfig{Shards: 4})
+	defer listener.Close()
+
+	used := make(map[*shard]bool)
+
+	for port := uint16(1); port <= 32; port++ {
+		req := buildConnPacket(true, port, 0, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+		resp := buildConnPacket(false, port, 0, 19, 1, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+		s := listener.packetShard(req.Dump())
+		if listener.packetShard(resp.Dump()) != s {
+			t.Fatal("Both directions of connection should be processed by same shard", port)
+		}
+
+		used[s] = true
+	}
+
+	if len(used) < 2 {
+		t.Error("Connections should be spread between shards", len(used))
+	}
+}
+
+func TestRawListenerShards(t *testing.T) {
+	testRawListenerShards(t, false)
+}
+
+// Packets captured by raw_socket engine over IPv6 have no destination address
+func TestRawListenerShardsUnknownDestination(t *testing.T) {
+	testRawListenerShards(t, true)
+}
+
+func testRawListenerShards(t *testing.T, noDstAddr bool) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Second, &ListenerConfig{Shards: 4})
+
+	for port := uint16(1); port <= 20; port++ {
+		req := buildConnPacket(true, port, 0, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+		resp := buildConnPacket(false, port, 0, req.Seq+uint32(len(req.Data)), 1, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+		if noDstAddr {
+			req.DstAddr, resp.DstAddr = nil, nil
+		}
+
+		listener.packetsChan <- newPacketBuffer(req.Dump())
+		listener.packetsChan <- newPacketBuffer(resp.Dump())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	listener.Close()
+
+	var requests, responses int
+	for m := range listener.Receiver() {
+		if m.IsIncoming {
+			requests++
+			continue
+		}
+
+		responses++
+		if m.AssocMessage == nil || !bytes.Equal(m.UUID(), m.AssocMessage.UUID()) {
+			t.Error("Response should be associated with request", m.Port())
+		}
+	}
+
+	if requests != 20 || responses != 20 {
+		t.Error("Should receive all messages", requests, responses)
+	}
+}
@@ -0,0 +1,111 @@
+package rawSocket
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+type listenerCounters struct {
+	packetsReceived    uint64
+	messagesDispatched uint64
+	messagesExpired    uint64
+	messagesEvicted    uint64
+
+	packetsBufferDropped  uint64
+	messagesBufferDropped uint64
+
+	captureInterrupted uint64
+	captureResumed     uint64
+}
+
+// ListenerStats is a snapshot of Listener counters
+type ListenerStats struct {
+	// Packets passed to the TCP processing
+	PacketsReceived uint64
+	// Packets dropped by kernel because pcap or AF_PACKET ring buffer was full, or uprobe events lost because perf buffer was full
+	PacketsDropped uint64
+	// Packets dropped by network interface or its driver
+	PacketsIfDropped uint64
+
+	// Messages sent to Receiver() channel
+	MessagesDispatched uint64
+	// Messages removed on expire without being sent, like responses without requests
+	MessagesExpired uint64
+	// Messages which are still being assembled
+	MessagesInFlight int64
+	// Messages discarded unfinished because ListenerConfig.MaxMessages or ListenerConfig.MaxBufferedBytes was exceeded
+	MessagesEvicted uint64
+	// Size of data of messages which are still being assembled
+	BytesInFlight int64
+	// Connections and UDP flows with reassembly state
+	StreamsInFlight int64
+
+	// Captured packets waiting for processing
+	PacketsQueued int
+	// Messages, or batches of messages, waiting to be read from Receiver() or ReceiverBatches()
+	MessagesQueued int
+
+	// Packets discarded by backpressure policy because packets buffer was full
+	PacketsBufferDropped uint64
+	// Messages discarded by backpressure policy because messages buffer was full
+	MessagesBufferDropped uint64
+
+	// How many times pcap capture was interrupted, like when interface went down, and resumed after re-opening
+	CaptureInterrupted uint64
+	CaptureResumed     uint64
+}
+
+// Stats returns capture statistics. Packets drop counters available only for pcap engine.
+func (t *Listener) Stats() (stats ListenerStats) {
+	stats.PacketsReceived = atomic.LoadUint64(&t.stats.packetsReceived)
+	stats.MessagesDispatched = atomic.LoadUint64(&t.stats.messagesDispatched)
+	stats.MessagesExpired = atomic.LoadUint64(&t.stats.messagesExpired)
+	for _, s := range t.shards {
+		stats.MessagesInFlight += atomic.LoadInt64(&s.messagesInFlight)
+		stats.BytesInFlight += atomic.LoadInt64(&s.bytesInFlight)
+		stats.StreamsInFlight += atomic.LoadInt64(&s.streamsInFlight)
+
+		// Single shard reads listener packetsChan directly
+		if len(t.shards) > 1 {
+			stats.PacketsQueued += len(s.packetsChan)
+		}
+	}
+	stats.PacketsQueued += len(t.packetsChan)
+	stats.MessagesQueued = len(t.messagesChan) + len(t.batchesChan)
+	stats.MessagesEvicted = atomic.LoadUint64(&t.stats.messagesEvicted)
+	stats.PacketsBufferDropped = atomic.LoadUint64(&t.stats.packetsBufferDropped)
+	stats.MessagesBufferDropped = atomic.LoadUint64(&t.stats.messagesBufferDropped)
+	stats.CaptureInterrupted = atomic.LoadUint64(&t.stats.captureInterrupted)
+	stats.CaptureResumed = atomic.LoadUint64(&t.stats.captureResumed)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, h := range t.pcapHandles {
+		s, err := h.Stats()
+		if err != nil {
+			log.Println("Can't get pcap stats:", err)
+			continue
+		}
+
+		stats.PacketsDropped += uint64(s.PacketsDropped)
+		stats.PacketsIfDropped += uint64(s.PacketsIfDropped)
+	}
+
+	stats.PacketsDropped += t.afpackets.dropped()
+	stats.PacketsDropped += t.uprobes.dropped()
+
+	return
+}
+
+func (t *Listener) removePcapHandle(handle *pcapHandle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, h := range t.pcapHandles {
+		if h == handle {
+			t.pcapHandles = append(t.pcapHandles[:i], t.pcapHandles[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRawListenerStatsGauges(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, false, time.Second, &ListenerConfig{})
+	defer listener.Close()
+
+	data := []byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n12345")
+	listener.packetsChan <- newPacketBuffer(buildPacket(true, 1, 1, data).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 2, 0, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")).Dump())
+
+	time.Sleep(50 * time.Millisecond)
+
+	stats := listener.Stats()
+
+	if stats.MessagesInFlight != 1 || stats.BytesInFlight != int64(len(data)) {
+		t.Error("Should report unfinished message", stats.MessagesInFlight, stats.BytesInFlight)
+	}
+
+	if stats.StreamsInFlight != 2 {
+		t.Error("Should report connections state", stats.StreamsInFlight)
+	}
+
+	if stats.PacketsQueued != 0 || stats.MessagesQueued != 1 {
+		t.Error("Should report queues length", stats.PacketsQueued, stats.MessagesQueued)
+	}
+}
@@ -0,0 +1,58 @@
+package rawSocket
+
+// streamDecoder decodes data of TCP connection captured with protocol other than HTTP, like ProtocolMySQL.
+// Decoder of connection is created once connection has data, see streamDecoders.
+type streamDecoder interface {
+	// feed decodes data of the segment, segments of each direction are passed in order
+	feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool)
+	// close is called once connection is closed or expired, messages still decoded are discarded
+	close(t *shard, stream *tcpStream)
+}
+
+// streamDecoders holds constructors of connection decoders by protocol. HTTP has no entry: it is parsed by listener
+// itself, along with HTTP/2, WebSocket and TLS it can be switched to.
+var streamDecoders = map[string]func(stream *tcpStream) streamDecoder{
+	ProtocolRawTCP:    func(stream *tcpStream) streamDecoder { return newRawTCPConn(stream) },
+	ProtocolMySQL:     func(*tcpStream) streamDecoder { return newMySQLConn() },
+	ProtocolPostgres:  func(*tcpStream) streamDecoder { return newPgConn() },
+	ProtocolRedis:     func(stream *tcpStream) streamDecoder { return newRedisConn(stream) },
+	ProtocolMemcached: func(*tcpStream) streamDecoder { return &memcachedConn{} },
+	ProtocolMongo:     func(*tcpStream) streamDecoder { return &mongoConn{pending: make(map[int32]*mongoPending)} },
+	ProtocolKafka:     func(*tcpStream) streamDecoder { return &kafkaConn{pending: make(map[int32]*kafkaPending)} },
+	ProtocolThrift:    func(*tcpStream) streamDecoder { return &thriftConn{pending: make(map[int32]*thriftPending)} },
+}
+
+// streamPosition holds position of decoder in the byte stream of one connection direction
+type streamPosition struct {
+	started bool
+	// Sequence number following data passed to decoder
+	nextSeq uint32
+}
+
+// trim returns data of the segment not passed to decoder yet, retransmitted part is skipped. Data is empty if segment
+// is retransmitted completely. Gap is number of bytes missing before the segment, segment data is returned whole then.
+func (p *streamPosition) trim(stream *tcpStream, packet *TCPPacket, isIncoming bool) (data []byte, gap int) {
+	if !p.started {
+		p.nextSeq, p.started = packet.Seq, true
+
+		// Data sent after SYN is counted from the beginning of the stream
+		if isn, ok := stream.isn(isIncoming); ok {
+			p.nextSeq = isn + 1
+		}
+	}
+
+	data = packet.Data
+	switch diff := seqDiff(packet.Seq, p.nextSeq); {
+	case diff > 0:
+		gap = int(diff)
+	case diff < 0:
+		// Retransmission of already passed data
+		if int(-diff) >= len(data) {
+			return nil, 0
+		}
+		data = data[-diff:]
+	}
+	p.nextSeq = packet.nextSeq()
+
+	return
+}
@@ -0,0 +1,41 @@
+package rawSocket
+
+import (
+	"testing"
+)
+
+func TestStreamPositionTrim(t *testing.T) {
+	stream := newTCPStream(connID{})
+	stream.clientISN, stream.clientSYN = 100, true
+
+	var p streamPosition
+
+	cases := []struct {
+		seq  uint32
+		data string
+		trim string
+		gap  int
+	}{
+		{101, "abc", "abc", 0},
+		// Retransmission covering new data
+		{102, "bcde", "de", 0},
+		// Retransmission of passed data only
+		{101, "abcde", "", 0},
+		// Data is missing before the segment
+		{110, "xy", "xy", 4},
+		{112, "z", "z", 0},
+	}
+
+	for i, c := range cases {
+		data, gap := p.trim(stream, buildPacket(true, 1, c.seq, []byte(c.data)), true)
+		if string(data) != c.trim || gap != c.gap {
+			t.Errorf("%d: Wrong trimmed data %q, gap %d", i, data, gap)
+		}
+	}
+
+	// Position of connection captured without SYN starts with its first segment
+	p = streamPosition{}
+	if data, gap := p.trim(stream, buildPacket(false, 1, 500, []byte("ok")), false); string(data) != "ok" || gap != 0 {
+		t.Errorf("Wrong trimmed data %q, gap %d", data, gap)
+	}
+}
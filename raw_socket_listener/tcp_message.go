@@ -7,9 +7,9 @@ import (
 	"encoding/hex"
 	"github.com/buger/gor/proto"
 	"log"
+	"net"
 	"strconv"
 	"time"
-	"net"
 )
 
 var _ = log.Println
@@ -33,14 +33,75 @@ type TCPMessage struct {
 	End          time.Time
 	IsIncoming   bool
 
+	// Capture timestamps of the first and the last packet, with nanosecond precision if supported by engine.
+	// Unlike Start and End, which are set when packets processed, reflect original timing of the traffic.
+	// Zero if timestamps are unknown.
+	CaptureStart time.Time
+	CaptureEnd   time.Time
+
+	// Message exceeded maximum size, and data beyond it was discarded
+	Truncated bool
+
+	// Set if message holds payload of WebSocket frame, instead of HTTP message
+	WebSocket *WebSocketFrame
+
+	// Set if message is request or response of gRPC call
+	GRPC *GRPCCall
+
+	// Set if message holds data of connection captured with ProtocolRawTCP
+	Chunk *TCPChunk
+
+	// Set if message is command or result of connection captured with ProtocolMySQL
+	MySQL *MySQLCommand
+
+	// Set if message is request or response of connection captured with ProtocolPostgres
+	Postgres *PostgresQuery
+
+	// Set if message is command or reply of connection captured with ProtocolRedis
+	Redis *RedisCommand
+
+	// Set if message is command or reply of connection captured with ProtocolMemcached
+	Memcached *MemcachedCommand
+
+	// Set if message is request or response of connection captured with ProtocolMongo
+	Mongo *MongoCommand
+
+	// Set if message is request or response of connection captured with ProtocolKafka
+	Kafka *KafkaRequest
+
+	// Set if message is call or reply of connection captured with ProtocolThrift
+	Thrift *ThriftMessage
+
 	packets []*TCPPacket
 
+	// Maximum size of message data, unlimited if 0
+	maxSize int
+	// Total size of packets data, same as Size()
+	size int
+	// Position in Listener expiry queue, -1 if not queued
+	expiryIndex int
+	// Sequence number following the last discarded byte
+	truncatedEnd uint32
+
+	// Headers block was received and checked for `Expect: 100-continue`
+	headersChecked bool
+	// Request body is sent after `100 Continue` response
+	expectContinue bool
+
+	// How end of the body is detected, see IsFinished
+	framing httpFraming
+	// Complete response removed from messages, waiting for its request, see shard.parkResponse
+	parked bool
+
+	// Connection message belongs to
+	stream *tcpStream
+
 	delChan chan *TCPMessage
 }
 
 // NewTCPMessage pointer created from a Acknowledgment number and a channel of messages readuy to be deleted
 func NewTCPMessage(Seq, Ack uint32, IsIncoming bool) (msg *TCPMessage) {
-	msg = &TCPMessage{Seq: Seq, Ack: Ack, IsIncoming: IsIncoming}
+	msg = &TCPMessage{Seq: Seq, Ack: Ack, IsIncoming: IsIncoming, expiryIndex: -1}
 	msg.Start = time.Now()
 
 	return
@@ -84,45 +145,192 @@ func (t *TCPMessage) Size() (size int) {
 }
 
 // AddPacket to the message and ensure packet uniqueness
-// TCP allows that packet can be re-send multiple times
+// TCP allows that packet can be re-send multiple times. Retransmitted segment can cover
+// different range than original ones: already received data is discarded, and only new parts are added.
 func (t *TCPMessage) AddPacket(packet *TCPPacket) {
-	packetFound := false
+	segments := t.uniqueSegments(packet)
 
-	for _, pkt := range t.packets {
-		if packet.Seq == pkt.Seq {
-			packetFound = true
-			break
-		}
+	if len(segments) == 0 {
+		return
 	}
 
-	if !packetFound {
-		// Packets not always captured in same Seq order, and sometimes we need to prepend
-		if len(t.packets) == 0 || packet.Seq > t.packets[len(t.packets)-1].Seq {
-			t.packets = append(t.packets, packet)
-		} else if packet.Seq < t.packets[0].Seq {
-			t.packets = append([]*TCPPacket{packet}, t.packets...)
-			t.Seq = packet.Seq // Message Seq should indicated starting seq
-		} else { // insert somewhere in the middle...
-			for i, p := range t.packets {
-				if packet.Seq < p.Seq {
-					t.packets = append(t.packets[:i], append([]*TCPPacket{packet}, t.packets[i:]...)...)
-					break
-				}
+	for _, s := range segments {
+		if t.maxSize > 0 {
+			if s = t.truncate(s); s == nil {
+				continue
 			}
 		}
 
-		if t.IsIncoming {
-			t.End = time.Now()
-		} else {
-			t.End = time.Now().Add(time.Millisecond)
+		t.insertPacket(s)
+	}
+
+	if t.IsIncoming {
+		t.End = time.Now()
+	} else {
+		t.End = time.Now().Add(time.Millisecond)
+	}
+
+	t.updateCaptureTime(packet.Timestamp)
+
+	if packet.OrigAck != 0 {
+		t.DataAck = packet.OrigAck
+	}
+}
+
+// updateCaptureTime extends capture time range of the message, packets can be captured out of order
+func (t *TCPMessage) updateCaptureTime(ts time.Time) {
+	if ts.IsZero() {
+		return
+	}
+
+	if t.CaptureStart.IsZero() || ts.Before(t.CaptureStart) {
+		t.CaptureStart = ts
+	}
+
+	if ts.After(t.CaptureEnd) {
+		t.CaptureEnd = ts
+	}
+}
+
+// uniqueSegments returns parts of packet data which are not received yet.
+// Packet returned as is if there is no overlaps.
+func (t *TCPMessage) uniqueSegments(packet *TCPPacket) (segments []*TCPPacket) {
+	size := len(packet.Data)
+	// Start of not checked yet data, relative to packet Seq
+	offset := 0
+
+	for _, p := range t.packets {
+		start := int(seqDiff(p.Seq, packet.Seq))
+		end := start + len(p.Data)
+
+		if end <= offset {
+			continue
+		}
+
+		if start >= size {
+			break
+		}
+
+		if start > offset {
+			segments = append(segments, packet.slice(offset, start))
+		}
+
+		offset = end
+
+		if offset >= size {
+			return
 		}
+	}
+
+	if offset == 0 {
+		return []*TCPPacket{packet}
+	}
+
+	return append(segments, packet.slice(offset, size))
+}
+
+// detach copies message data out of packet buffers and releases them, so buffers can be reused
+// while message is processed by the receiver
+func (t *TCPMessage) detach() {
+	pooled := false
+	for _, p := range t.packets {
+		if p.buf.pooled() {
+			pooled = true
+			break
+		}
+	}
+
+	if !pooled {
+		return
+	}
+
+	data := t.Bytes()
+	addr := append([]byte{}, t.packets[0].Addr...)
+	dstAddr := append([]byte{}, t.packets[0].DstAddr...)
+
+	for _, p := range t.packets {
+		n := len(p.Data)
+		p.Data, data = data[:n:n], data[n:]
+		p.Addr, p.DstAddr = addr, dstAddr
+		// TCP header is not needed after message is assembled
+		p.Raw = nil
+
+		p.buf.release()
+		p.buf = nil
+	}
+}
+
+// release returns packet buffers of discarded message, its data should not be used after
+func (t *TCPMessage) release() {
+	for _, p := range t.packets {
+		p.buf.release()
+	}
+}
+
+// truncate cuts part of the packet exceeding maximum message size, counting from the message Seq.
+// Returns nil if whole packet is beyond the limit.
+func (t *TCPMessage) truncate(packet *TCPPacket) *TCPPacket {
+	offset := int(seqDiff(packet.Seq, t.Seq))
+
+	if offset+len(packet.Data) <= t.maxSize {
+		return packet
+	}
+
+	if end := packet.nextSeq(); !t.Truncated || seqLess(t.truncatedEnd, end) {
+		t.truncatedEnd = end
+	}
+	t.Truncated = true
+
+	if offset >= t.maxSize {
+		return nil
+	}
+
+	return packet.slice(0, t.maxSize-offset)
+}
+
+// truncatedSize returns number of bytes discarded from the end of message
+func (t *TCPMessage) truncatedSize() int {
+	if !t.Truncated || len(t.packets) == 0 {
+		return 0
+	}
+
+	if size := seqDiff(t.truncatedEnd, t.packets[len(t.packets)-1].nextSeq()); size > 0 {
+		return int(size)
+	}
 
-		if packet.OrigAck != 0 {
-			t.DataAck = packet.OrigAck
+	return 0
+}
+
+// insertPacket keeps packets sorted by Seq
+func (t *TCPMessage) insertPacket(packet *TCPPacket) {
+	t.size += len(packet.Data)
+	packet.buf.retain()
+
+	// Packets not always captured in same Seq order, and sometimes we need to prepend
+	if len(t.packets) == 0 || t.seqLess(t.packets[len(t.packets)-1].Seq, packet.Seq) {
+		t.packets = append(t.packets, packet)
+	} else if t.seqLess(packet.Seq, t.packets[0].Seq) {
+		t.packets = append([]*TCPPacket{packet}, t.packets...)
+		t.Seq = packet.Seq // Message Seq should indicated starting seq
+	} else { // insert somewhere in the middle...
+		for i, p := range t.packets {
+			if t.seqLess(packet.Seq, p.Seq) {
+				t.packets = append(t.packets[:i], append([]*TCPPacket{packet}, t.packets[i:]...)...)
+				break
+			}
 		}
 	}
 }
 
+// seqLess compares sequence numbers, relative to connection ISN if it is known
+func (t *TCPMessage) seqLess(a, b uint32) bool {
+	if t.stream != nil {
+		return t.stream.seqLess(a, b, t.IsIncoming)
+	}
+
+	return seqLess(a, b)
+}
+
 // Check if there is missing packet
 func (t *TCPMessage) isSeqMissing() bool {
 	if len(t.packets) == 1 {
@@ -136,7 +344,7 @@ func (t *TCPMessage) isSeqMissing() bool {
 		}
 		np := t.packets[i+1]
 
-		if np.Seq != p.Seq+uint32(len(p.Data)) {
+		if np.Seq != p.nextSeq() {
 			return true
 		}
 	}
@@ -157,7 +365,8 @@ func (t *TCPMessage) isHeadersReceived() bool {
 	return false
 }
 
-// isMultipart returns true if message contains from multiple tcp packets
+// IsFinished checks if message is complete: headers are received, and body according to Content-Length
+// or chunked transfer encoding, so message can be dispatched without waiting for expire
 func (t *TCPMessage) IsFinished() bool {
 	payload := t.packets[0].Data
 
@@ -165,31 +374,9 @@ func (t *TCPMessage) IsFinished() bool {
 		return true
 	}
 
-	m := payload[:4]
-
 	if t.IsIncoming {
-		// If one GET, OPTIONS, or HEAD request
-		if bytes.Equal(m, []byte("GET ")) || bytes.Equal(m, []byte("OPTI")) || bytes.Equal(m, []byte("HEAD")) {
-			if !t.isSeqMissing() && t.isHeadersReceived() {
-				return true
-			} else {
-				return false
-			}
-		} else {
-			// Sometimes header comes after the body :(
-			if bytes.Equal(m, []byte("POST")) || bytes.Equal(m, []byte("PUT ")) || bytes.Equal(m, []byte("PATC")) {
-
-				if t.isHeadersReceived() {
-					if length := proto.Header(payload, []byte("Content-Length")); len(length) > 0 {
-						l, _ := strconv.Atoi(string(length))
-
-						// If content-length equal current body length
-						if l > 0 && l == t.BodySize() {
-							return true
-						}
-					}
-				}
-			}
+		if !isRequestStart(payload) {
+			return false
 		}
 	} else {
 		// Request not found
@@ -198,39 +385,19 @@ func (t *TCPMessage) IsFinished() bool {
 			return false
 		}
 
-		if !bytes.Equal(m, []byte("HTTP")) {
+		if !bytes.Equal(payload[:4], []byte("HTTP")) {
 			return false
 		}
-
-		if length := proto.Header(payload, []byte("Content-Length")); len(length) > 0 {
-			if length[0] == '0' {
-				return true
-			}
-
-			l, _ := strconv.Atoi(string(length))
-
-			// If content-length equal current body length
-			if l > 0 && l == t.BodySize() {
-				return true
-			}
-		} else {
-			if enc := proto.Header(payload, []byte("Transfer-Encoding")); len(enc) == 0 {
-				return true
-			} else {
-				if len(t.packets) > 1 && bytes.LastIndex(t.packets[len(t.packets)-1].Data, ChunkEnd) != -1 {
-					return true
-				}
-			}
-		}
 	}
 
-	return false
+	return t.isComplete()
 }
 
 func (t *TCPMessage) UUID() []byte {
 	var key []byte
 
-	if t.IsIncoming {
+	// Messages sent by server without requests, like WebSocket frames
+	if t.IsIncoming || t.AssocMessage == nil {
 		// log.Println("UUID:", t.Ack, t.Start.UnixNano())
 		key = strconv.AppendInt(key, t.Start.UnixNano(), 10)
 		key = strconv.AppendUint(key, uint64(t.Ack), 10)
@@ -250,16 +417,22 @@ func (t *TCPMessage) UUID() []byte {
 // UpdateResponseAck should be called after packet is added
 func (t *TCPMessage) UpdateResponseAck() uint32 {
 	lastPacket := t.packets[len(t.packets)-1]
-	respAck := lastPacket.Seq + uint32(len(lastPacket.Data))
+	respAck := lastPacket.nextSeq()
 
-	if t.ResponseAck != respAck {
-		t.ResponseAck = lastPacket.Seq + uint32(len(lastPacket.Data))
+	// Response acknowledges discarded data as well
+	if t.Truncated && seqLess(respAck, t.truncatedEnd) {
+		respAck = t.truncatedEnd
+	}
 
-		// We swappwed src and dst port
-		copy(t.ResponseID[:16], lastPacket.Addr)
-		copy(t.ResponseID[16:], lastPacket.Raw[2:4]) // Src port
-		copy(t.ResponseID[18:], lastPacket.Raw[0:2]) // Dest port
-		binary.BigEndian.PutUint32(t.ResponseID[20:24], t.ResponseAck)
+	if t.ResponseAck != respAck {
+		t.ResponseAck = respAck
+
+		// We swappwed src and dst address and port
+		copy(t.ResponseID[:16], lastPacket.DstAddr)
+		copy(t.ResponseID[16:32], lastPacket.Addr)
+		copy(t.ResponseID[32:], lastPacket.Raw[2:4]) // Src port
+		copy(t.ResponseID[34:], lastPacket.Raw[0:2]) // Dest port
+		binary.BigEndian.PutUint32(t.ResponseID[36:40], t.ResponseAck)
 	}
 
 	return t.ResponseAck
@@ -269,6 +442,45 @@ func (t *TCPMessage) ID() tcpID {
 	return t.packets[0].ID
 }
 
+// IP returns address message was sent from
 func (t *TCPMessage) IP() net.IP {
-	return net.IP(t.packets[0].Addr)
-}
\ No newline at end of file
+	return addrIP(t.packets[0].Addr)
+}
+
+// Src returns address and port message was sent from: client for requests, and server for responses
+func (t *TCPMessage) Src() *net.TCPAddr {
+	return &net.TCPAddr{IP: addrIP(t.packets[0].Addr), Port: int(t.packets[0].SrcPort)}
+}
+
+// Dst returns address and port message was sent to. Address is unspecified for raw_socket engine.
+func (t *TCPMessage) Dst() *net.TCPAddr {
+	return &net.TCPAddr{IP: addrIP(t.packets[0].DstAddr), Port: int(t.packets[0].DestPort)}
+}
+
+// addrIP converts address from the packet header to IP. IPv4 address occupies first 4 bytes of 16 bytes field.
+func addrIP(addr []byte) net.IP {
+	if len(addr) == net.IPv6len && !isZeroBytes(addr[:net.IPv4len]) && isZeroBytes(addr[net.IPv4len:]) {
+		return net.IP(addr[:net.IPv4len])
+	}
+
+	return net.IP(addr)
+}
+
+func isZeroBytes(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Port returns listened port message belongs to: destination port for requests, and source port for responses
+func (t *TCPMessage) Port() uint16 {
+	if t.IsIncoming {
+		return t.packets[0].DestPort
+	}
+
+	return t.packets[0].SrcPort
+}
@@ -4,17 +4,27 @@ import (
 	"bytes"
 	"encoding/binary"
 	_ "log"
+	"net"
 	"testing"
+	"time"
 )
 
 func buildPacket(isIncoming bool, Ack, Seq uint32, Data []byte) (packet *TCPPacket) {
+	return buildConnPacket(isIncoming, 1, 0, Ack, Seq, Data)
+}
+
+// buildConnPacket builds packet of connection from given client port, with TCP flags
+func buildConnPacket(isIncoming bool, clientPort uint16, flags uint8, Ack, Seq uint32, Data []byte) (packet *TCPPacket) {
 	var srcPort, destPort uint16
+	var srcAddr, dstAddr []byte
 
 	// For tests `listening` port is 0
 	if isIncoming {
-		srcPort = 1
+		srcPort = clientPort
+		srcAddr, dstAddr = []byte("123"), []byte("456")
 	} else {
-		destPort = 1
+		destPort = clientPort
+		srcAddr, dstAddr = []byte("456"), []byte("123")
 	}
 
 	buf := make([]byte, 16)
@@ -23,9 +33,10 @@ func buildPacket(isIncoming bool, Ack, Seq uint32, Data []byte) (packet *TCPPack
 	binary.BigEndian.PutUint32(buf[4:8], Seq)
 	binary.BigEndian.PutUint32(buf[8:12], Ack)
 	buf[12] = 64
+	buf[13] = flags
 	buf = append(buf, Data...)
 
-	packet = ParseTCPPacket([]byte("123"), buf)
+	packet = ParseTCPPacket(srcAddr, dstAddr, buf)
 
 	return packet
 }
@@ -67,9 +78,58 @@ func TestTCPMessagePacketsOrder(t *testing.T) {
 	}
 }
 
+func TestTCPMessageSeqWraparound(t *testing.T) {
+	msg := buildMessage(buildPacket(true, 1, 1, []byte("c")))
+	msg.AddPacket(buildPacket(true, 1, 0xFFFFFFFF, []byte("ab")))
+	msg.AddPacket(buildPacket(true, 1, 2, []byte("d")))
+
+	if !bytes.Equal(msg.Bytes(), []byte("abcd")) {
+		t.Error("Should order packets when sequence number wraps", string(msg.Bytes()))
+	}
+
+	if msg.isSeqMissing() {
+		t.Error("Should not have missing packets")
+	}
+
+	if msg.UpdateResponseAck() != 3 {
+		t.Error("Wrong response ack", msg.ResponseAck)
+	}
+}
+
+func TestTCPMessageRetransmission(t *testing.T) {
+	msg := buildMessage(buildPacket(true, 1, 1, []byte("abc")))
+	msg.AddPacket(buildPacket(true, 1, 4, []byte("def")))
+
+	// Retransmitted segment overlapping both packets, with new data at the end
+	msg.AddPacket(buildPacket(true, 1, 2, []byte("bcdefgh")))
+
+	if !bytes.Equal(msg.Bytes(), []byte("abcdefgh")) {
+		t.Error("Should discard overlapping part", string(msg.Bytes()))
+	}
+
+	// Segment fully covered by received data
+	msg.AddPacket(buildPacket(true, 1, 3, []byte("cde")))
+
+	if !bytes.Equal(msg.Bytes(), []byte("abcdefgh")) {
+		t.Error("Should discard duplicated data", string(msg.Bytes()))
+	}
+
+	// Segment filling gaps around received packet
+	msg = buildMessage(buildPacket(true, 1, 3, []byte("c")))
+	msg.AddPacket(buildPacket(true, 1, 1, []byte("abcde")))
+
+	if !bytes.Equal(msg.Bytes(), []byte("abcde")) {
+		t.Error("Should fill gaps", string(msg.Bytes()))
+	}
+
+	if msg.Seq != 1 {
+		t.Error("Message Seq should point to the first byte", msg.Seq)
+	}
+}
+
 func TestTCPMessageSize(t *testing.T) {
 	msg := buildMessage(buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\na")))
-	msg.AddPacket(buildPacket(true, 1, 2, []byte("b")))
+	msg.AddPacket(buildPacket(true, 1, 40, []byte("b")))
 
 	if msg.BodySize() != 2 {
 		t.Error("Should count only body", msg.BodySize())
@@ -80,6 +140,39 @@ func TestTCPMessageSize(t *testing.T) {
 	}
 }
 
+func TestTCPMessageTruncate(t *testing.T) {
+	msg := NewTCPMessage(1, 1, true)
+	msg.maxSize = 5
+
+	msg.AddPacket(buildPacket(true, 1, 1, []byte("abc")))
+	msg.AddPacket(buildPacket(true, 1, 4, []byte("def")))
+	msg.AddPacket(buildPacket(true, 1, 7, []byte("ghi")))
+
+	if !bytes.Equal(msg.Bytes(), []byte("abcde")) {
+		t.Error("Should discard data beyond limit", string(msg.Bytes()))
+	}
+
+	if !msg.Truncated {
+		t.Error("Should be marked as truncated")
+	}
+
+	if msg.truncatedSize() != 4 {
+		t.Error("Should count discarded data", msg.truncatedSize())
+	}
+
+	if msg.UpdateResponseAck() != 10 {
+		t.Error("Response ack should include discarded data", msg.ResponseAck)
+	}
+
+	msg = NewTCPMessage(1, 1, true)
+	msg.maxSize = 5
+	msg.AddPacket(buildPacket(true, 1, 1, []byte("abcde")))
+
+	if msg.Truncated {
+		t.Error("Should not be truncated if fits the limit")
+	}
+}
+
 func TestTCPMessageIsFinished(t *testing.T) {
 	methodsWithoutBodies := []string{"GET", "OPTIONS", "HEAD"}
 
@@ -112,11 +205,22 @@ func TestTCPMessageIsFinished(t *testing.T) {
 		t.Error("non http or wrong methods considered as not finished")
 	}
 
+	msg = buildMessage(buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\n\r\n")))
+	if !msg.IsFinished() {
+		t.Error("Request without Content-Length should have no body")
+	}
+
 	// Responses
 	msg = buildMessage(buildPacket(false, 1, 1, []byte("HTTP/1.1 200 OK\r\n\r\n")))
 	msg.AssocMessage = &TCPMessage{}
+	if msg.IsFinished() {
+		t.Error("Response without Content-Length should be read until connection is closed")
+	}
+
+	msg = buildMessage(buildPacket(false, 1, 1, []byte("HTTP/1.1 204 No Content\r\n\r\n")))
+	msg.AssocMessage = &TCPMessage{}
 	if !msg.IsFinished() {
-		t.Error("Should mark simple response as finished")
+		t.Error("Should mark response without body as finished")
 	}
 
 	msg = buildMessage(buildPacket(false, 1, 1, []byte("HTTP/1.1 200 OK\r\n\r\n")))
@@ -189,3 +293,55 @@ func TestTCPMessageIsHeadersReceived(t *testing.T) {
 		t.Error("Should found double new line: headers received")
 	}
 }
+
+func TestTCPMessageCaptureTime(t *testing.T) {
+	ts := time.Unix(1500000000, 123456789)
+
+	p1 := buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\n"))
+	p2 := buildPacket(true, 1, p1.Seq+uint32(len(p1.Data)), []byte("a"))
+	p3 := buildPacket(true, 1, p2.Seq+1, []byte("b"))
+
+	p1.Timestamp = ts
+	p2.Timestamp = ts.Add(time.Microsecond)
+	p3.Timestamp = ts.Add(2 * time.Microsecond)
+
+	msg := buildMessage(p2)
+	msg.AddPacket(p3)
+	msg.AddPacket(p1)
+
+	if !msg.CaptureStart.Equal(ts) || !msg.CaptureEnd.Equal(p3.Timestamp) {
+		t.Error("Should track capture time of the first and the last packet", msg.CaptureStart.UnixNano(), msg.CaptureEnd.UnixNano())
+	}
+
+	msg = buildMessage(buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")))
+	if !msg.CaptureStart.IsZero() {
+		t.Error("Capture time should be unknown")
+	}
+}
+
+func TestTCPMessageAddr(t *testing.T) {
+	p := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+	p.Addr = make([]byte, 16)
+	copy(p.Addr, net.ParseIP("10.0.0.1").To4())
+	p.DstAddr = net.ParseIP("2001:db8::2")
+	p.SrcPort, p.DestPort = 51234, 80
+
+	msg := buildMessage(p)
+
+	if src := msg.Src().String(); src != "10.0.0.1:51234" {
+		t.Error("Wrong source", src)
+	}
+
+	if dst := msg.Dst().String(); dst != "[2001:db8::2]:80" {
+		t.Error("Wrong destination", dst)
+	}
+
+	if ip := msg.IP().String(); ip != "10.0.0.1" {
+		t.Error("Wrong IP", ip)
+	}
+
+	p.DstAddr = make([]byte, 16)
+	if !msg.Dst().IP.IsUnspecified() {
+		t.Error("Unknown destination should be unspecified")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var _ = log.Println
@@ -22,7 +23,38 @@ const (
 	fNS
 )
 
-type tcpID [24]byte
+// Source address, destination address, source port, destination port and ack
+type tcpID [40]byte
+
+// Size of addresses part of the header, prepended to each captured packet: source and destination IP, 16 bytes each
+const packetAddrSize = 32
+
+// Size of the whole header: addresses followed by capture timestamp in nanoseconds, 0 if unknown
+const packetHeaderSize = packetAddrSize + 8
+
+// putPacketHeader fills header of captured packet. Buffer may be reused, so header is cleared first.
+func putPacketHeader(buf []byte, srcIP, dstIP []byte, timestamp time.Time) {
+	header := buf[:packetHeaderSize]
+	for i := range header {
+		header[i] = 0
+	}
+
+	copy(header[:16], srcIP)
+	copy(header[16:packetAddrSize], dstIP)
+
+	if !timestamp.IsZero() {
+		binary.BigEndian.PutUint64(header[packetAddrSize:], uint64(timestamp.UnixNano()))
+	}
+}
+
+// packetTimestamp returns capture timestamp from the header of captured packet
+func packetTimestamp(data []byte) time.Time {
+	if ts := binary.BigEndian.Uint64(data[packetAddrSize:packetHeaderSize]); ts != 0 {
+		return time.Unix(0, int64(ts))
+	}
+
+	return time.Time{}
+}
 
 // TCPPacket provides tcp packet parser
 // Packet structure: http://en.wikipedia.org/wiki/Transmission_Control_Protocol
@@ -33,18 +65,30 @@ type TCPPacket struct {
 	Ack        uint32
 	OrigAck    uint32
 	DataOffset uint8
+	Flags      uint16
+
+	Raw     []byte
+	Data    []byte
+	Addr    []byte
+	DstAddr []byte
+	ID      tcpID
+
+	// When packet was captured, zero if unknown
+	Timestamp time.Time
 
-	Raw  []byte
-	Data []byte
-	Addr []byte
-	ID   tcpID
+	// Packet split from coalesced segment, and starts new HTTP message following complete one
+	messageStart bool
+
+	// Buffer packet data belongs to, retained while packet is held by message or reorder buffer
+	buf *packetBuffer
 }
 
-// ParseTCPPacket takes address and tcp payload and returns parsed TCPPacket
-func ParseTCPPacket(addr []byte, data []byte) (p *TCPPacket) {
+// ParseTCPPacket takes source and destination addresses and tcp payload and returns parsed TCPPacket
+func ParseTCPPacket(addr []byte, dstAddr []byte, data []byte) (p *TCPPacket) {
 	p = &TCPPacket{Raw: data}
 	p.ParseBasic()
 	p.Addr = addr
+	p.DstAddr = dstAddr
 	p.GenID()
 
 	return
@@ -52,9 +96,10 @@ func ParseTCPPacket(addr []byte, data []byte) (p *TCPPacket) {
 
 func (p *TCPPacket) GenID() {
 	copy(p.ID[:16], p.Addr)
-	copy(p.ID[16:], p.Raw[0:2])  // Src port
-	copy(p.ID[18:], p.Raw[2:4])  // Dest port
-	copy(p.ID[20:], p.Raw[8:12]) // Ack
+	copy(p.ID[16:32], p.DstAddr)
+	copy(p.ID[32:], p.Raw[0:2])  // Src port
+	copy(p.ID[34:], p.Raw[2:4])  // Dest port
+	copy(p.ID[36:], p.Raw[8:12]) // Ack
 }
 
 func (p *TCPPacket) UpdateAck(ack uint32) {
@@ -64,6 +109,46 @@ func (p *TCPPacket) UpdateAck(ack uint32) {
 	p.GenID()
 }
 
+// seqDiff returns distance between sequence numbers using serial number arithmetic (RFC 1982),
+// so wrapping of 32-bit sequence space does not break comparisons
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+// seqLess checks if sequence number `a` goes before `b`
+func seqLess(a, b uint32) bool {
+	return seqDiff(a, b) < 0
+}
+
+// nextSeq returns sequence number following packet data
+func (p *TCPPacket) nextSeq() uint32 {
+	return p.Seq + uint32(len(p.Data))
+}
+
+// slice returns copy of the packet holding only part of its data, `from` and `to` are offsets in the data
+func (p *TCPPacket) slice(from, to int) *TCPPacket {
+	np := *p
+	np.Seq = p.Seq + uint32(from)
+	np.Data = p.Data[from:to]
+	np.messageStart = p.messageStart && from == 0
+
+	return &np
+}
+
+// headerCopy returns packet without data, used by messages decoded from frames. Addresses are copied,
+// since packet ones point to the reused buffer.
+func (p *TCPPacket) headerCopy() *TCPPacket {
+	return &TCPPacket{
+		Addr:     append([]byte{}, p.Addr...),
+		DstAddr:  append([]byte{}, p.DstAddr...),
+		SrcPort:  p.SrcPort,
+		DestPort: p.DestPort,
+		Seq:      p.Seq,
+		Ack:      p.Ack,
+		ID:       p.ID,
+	}
+}
+
 // ParseBasic set of fields
 func (t *TCPPacket) ParseBasic() {
 	t.DestPort = binary.BigEndian.Uint16(t.Raw[2:4])
@@ -71,17 +156,19 @@ func (t *TCPPacket) ParseBasic() {
 	t.Seq = binary.BigEndian.Uint32(t.Raw[4:8])
 	t.Ack = binary.BigEndian.Uint32(t.Raw[8:12])
 	t.DataOffset = (t.Raw[12] & 0xF0) >> 4
+	t.Flags = uint16(t.Raw[12]&0x01)<<8 | uint16(t.Raw[13])
 
 	// log.Println("DataOffset:", t.DataOffset, t.DestPort, t.SrcPort, t.Seq, t.Ack)
 
 	t.Data = t.Raw[t.DataOffset*4:]
 }
 
+// Dump returns packet in the format used by packets channel: header followed by TCP segment
 func (t *TCPPacket) Dump() []byte {
-	buf := make([]byte, len(t.Data)+16+16)
-	copy(buf[:16], t.Addr)
+	buf := make([]byte, len(t.Data)+packetHeaderSize+16)
+	putPacketHeader(buf, t.Addr, t.DstAddr, t.Timestamp)
 
-	tcpBuf := buf[16:]
+	tcpBuf := buf[packetHeaderSize:]
 
 	binary.BigEndian.PutUint16(tcpBuf[2:4], t.DestPort)
 	binary.BigEndian.PutUint16(tcpBuf[0:2], t.SrcPort)
@@ -89,7 +176,8 @@ func (t *TCPPacket) Dump() []byte {
 	binary.BigEndian.PutUint32(tcpBuf[4:8], t.Seq)
 	binary.BigEndian.PutUint32(tcpBuf[8:12], t.Ack)
 
-	tcpBuf[12] = 64
+	tcpBuf[12] = 64 | byte(t.Flags>>8)
+	tcpBuf[13] = byte(t.Flags)
 	copy(tcpBuf[16:], t.Data)
 
 	return buf
@@ -0,0 +1,202 @@
+package rawSocket
+
+import (
+	"time"
+)
+
+// connID identifies TCP connection by its 4-tuple: client address, server address, client port and server port.
+// Both directions of connection share same connID.
+type connID [36]byte
+
+// How long connection state kept after last seen packet, if it has no in-flight messages
+const streamIdleTimeout = time.Minute
+
+// tcpStream holds reassembly state of single TCP connection
+//
+// All sequence and ack based lookups are scoped by connection, so messages from concurrent connections
+// which happen to share ACK or SEQ values are never merged together.
+type tcpStream struct {
+	id connID
+
+	// Initial sequence numbers, learned from SYN (client) and SYN-ACK (server) packets
+	clientISN, serverISN uint32
+	clientSYN, serverSYN bool
+	clientFIN, serverFIN bool
+	lastSeen             time.Time
+
+	// Not dispatched messages of this connection
+	messages map[tcpID]*TCPMessage
+
+	// Requests waiting for responses, and responses captured before their requests, in order they were sent
+	pendingRequests, pendingResponses []*TCPMessage
+
+	// Out of order segments of each direction
+	clientSegments, serverSegments reorderBuffer
+
+	// HTTP/2 decoding state, if connection started with h2c preface
+	h2c *h2cConn
+	// WebSocket decoding state, if handshake response switched connection to frames
+	ws *wsConn
+	// Decoding state of connection captured with protocol other than HTTP, nil until it has data
+	decoder streamDecoder
+	// TLS decryption state, if connection started with TLS handshake and server keys are known
+	tls *tlsConn
+}
+
+func newTCPStream(id connID) *tcpStream {
+	return &tcpStream{
+		id:       id,
+		messages: make(map[tcpID]*TCPMessage),
+	}
+}
+
+// packetConnID returns id of connection packet belongs to
+func packetConnID(packet *TCPPacket, isIncoming bool) (id connID) {
+	clientAddr, serverAddr := packet.Addr, packet.DstAddr
+	clientPort, serverPort := packet.Raw[0:2], packet.Raw[2:4]
+	if !isIncoming {
+		clientAddr, serverAddr = serverAddr, clientAddr
+		clientPort, serverPort = serverPort, clientPort
+	}
+
+	// Destination address is unknown for packets captured by raw_socket engine over IPv6,
+	// so connection is identified by ports only
+	if isZeroBytes(packet.DstAddr) {
+		clientAddr, serverAddr = nil, nil
+	}
+
+	copy(id[:16], clientAddr)
+	copy(id[16:32], serverAddr)
+	copy(id[32:34], clientPort)
+	copy(id[34:36], serverPort)
+
+	return
+}
+
+// isn returns initial sequence number of given direction, if SYN was captured
+func (s *tcpStream) isn(isIncoming bool) (uint32, bool) {
+	if isIncoming {
+		return s.clientISN, s.clientSYN
+	}
+
+	return s.serverISN, s.serverSYN
+}
+
+// seqLess compares sequence numbers of given direction. If ISN known, comparison done relative to it,
+// which covers whole sequence space, otherwise serial number arithmetic is used.
+func (s *tcpStream) seqLess(a, b uint32, isIncoming bool) bool {
+	if isn, ok := s.isn(isIncoming); ok {
+		return a-isn < b-isn
+	}
+
+	return seqLess(a, b)
+}
+
+// trackFlags updates connection state from SYN and FIN flags, returns true if connection is closed
+func (s *tcpStream) trackFlags(packet *TCPPacket, isIncoming bool) bool {
+	if packet.Flags&fSYN != 0 {
+		if isIncoming {
+			s.clientISN, s.clientSYN = packet.Seq, true
+			s.clientSegments.start(packet.Seq + 1)
+		} else {
+			s.serverISN, s.serverSYN = packet.Seq, true
+			s.serverSegments.start(packet.Seq + 1)
+		}
+	}
+
+	if packet.Flags&fRST != 0 {
+		return true
+	}
+
+	if packet.Flags&fFIN != 0 {
+		if isIncoming {
+			s.clientFIN = true
+		} else {
+			s.serverFIN = true
+		}
+	}
+
+	return s.clientFIN && s.serverFIN
+}
+
+// stream returns state of connection packet belongs to, creating it if needed
+func (t *shard) stream(packet *TCPPacket, isIncoming bool) *tcpStream {
+	id := packetConnID(packet, isIncoming)
+
+	stream, ok := t.streams[id]
+	if !ok {
+		stream = newTCPStream(id)
+		t.streams[id] = stream
+	}
+
+	stream.lastSeen = time.Now()
+
+	return stream
+}
+
+// closeStream dispatches all pending messages of the connection, and removes its state
+func (t *shard) closeStream(stream *tcpStream) {
+	t.releaseSegments(stream, time.Now(), true)
+
+	// Dispatch requests before responses, so responses can be associated with them
+	for _, message := range stream.messages {
+		if message.IsIncoming {
+			t.dispatchMessage(message)
+		}
+	}
+
+	for _, message := range stream.messages {
+		t.dispatchMessage(message)
+	}
+
+	t.removeStream(stream)
+}
+
+// removeStream drops responses waiting for requests, discards state of protocol decoding, and forgets connection
+func (t *shard) removeStream(stream *tcpStream) {
+	t.dropResponses(stream.pendingResponses)
+	if stream.h2c != nil {
+		t.breakH2C(stream.h2c)
+	}
+	if stream.ws != nil {
+		t.breakWebSocket(stream.ws)
+	}
+	if stream.decoder != nil {
+		stream.decoder.close(t, stream)
+		stream.decoder = nil
+	}
+	delete(t.streams, stream.id)
+}
+
+// closeDirection dispatches pending messages of the direction finished by FIN. If data before FIN is still missing,
+// messages are left to be dispatched on connection close or expire.
+func (t *shard) closeDirection(stream *tcpStream, fin *TCPPacket, isIncoming bool) {
+	segments := &stream.serverSegments
+	if isIncoming {
+		segments = &stream.clientSegments
+	}
+
+	if t.config.ReorderWindow > 0 && segments.started && seqDiff(fin.Seq, segments.nextSeq) > 0 {
+		return
+	}
+
+	for _, p := range segments.releaseAll() {
+		t.processTCPData(stream, p, isIncoming)
+		p.buf.release()
+	}
+
+	for _, message := range stream.messages {
+		if message.IsIncoming == isIncoming {
+			t.dispatchMessage(message)
+		}
+	}
+}
+
+// expireStreams removes state of idle connections
+func (t *shard) expireStreams(now time.Time) {
+	for _, stream := range t.streams {
+		if len(stream.messages) == 0 && now.Sub(stream.lastSeen) >= streamIdleTimeout {
+			t.removeStream(stream)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// With ProtocolThrift connections are decoded as Thrift RPC, using binary or compact protocol, with framed or
+// unframed transport. Protocol and transport are detected by the first bytes sent by client. Each call is emitted
+// as request holding the message as sent, including frame size, and replies are emitted as responses of calls with
+// the same sequence ID. Oneway calls get no reply. Unframed messages end with their struct, so they are parsed
+// to find their size. Connections with missing segments, or data not looking like Thrift, are not decoded anymore.
+
+// Thrift message types
+const (
+	ThriftCall      = 1
+	ThriftReply     = 2
+	ThriftException = 3
+	ThriftOneway    = 4
+)
+
+// Maximum size of message, messages are buffered until they are complete to find their size
+const thriftMaxMessageSize = 16 * 1024 * 1024
+
+// Maximum nesting of structs and containers
+const thriftMaxDepth = 64
+
+// Maximum number of calls waiting for reply
+const thriftMaxPending = 1000
+
+// Protocol IDs of message header
+const (
+	thriftBinaryVersion = 0x8001
+	thriftCompactID     = 0x82
+)
+
+var errThriftShort = errors.New("Thrift message is not complete")
+var errThriftInvalid = errors.New("Data is not Thrift message")
+
+// ThriftMessage describes message holding Thrift call, or its reply
+type ThriftMessage struct {
+	// Method name, prefixed with service name for multiplexed protocol, like "Users:get"
+	Method string
+
+	// Message type, like ThriftCall. Type of reply is ThriftReply, or ThriftException if call failed in server.
+	Type   byte
+	SeqID  int32
+	Framed bool
+	// Connection uses compact protocol, and not binary one
+	Compact bool
+}
+
+// thriftConn holds Thrift decoding state of single connection
+type thriftConn struct {
+	client, server thriftDirection
+
+	// Protocol and transport, detected by the first bytes sent by client
+	detected bool
+	framed   bool
+	compact  bool
+
+	// Calls waiting for reply, by sequence ID
+	pending map[int32]*thriftPending
+
+	// Decoding failed, like because of missing segment, and message boundaries are lost
+	broken bool
+}
+
+type thriftPending struct {
+	request *TCPMessage
+	info    *ThriftMessage
+}
+
+// thriftDirection holds state of messages sent by one side of connection
+type thriftDirection struct {
+	streamPosition
+
+	// Bytes of messages which are not complete, and segment holding their start
+	buf    []byte
+	packet *TCPPacket
+}
+
+// feed buffers data of the segment, and emits messages which are complete
+func (c *thriftConn) feed(t *shard, stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data, gap := d.trim(stream, packet, isIncoming)
+	if gap > 0 {
+		// Message boundaries are unknown after missing data
+		t.breakThrift(c)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	// Replies sent before the first captured call can't be matched to calls
+	if !c.detected && !isIncoming {
+		return
+	}
+
+	if len(d.buf) == 0 {
+		d.packet = packet
+	}
+	d.buf = append(d.buf, data...)
+
+	if !c.detected {
+		if len(d.buf) < 6 {
+			return
+		}
+
+		switch {
+		case d.buf[0] == 0x80 && d.buf[1] == 0x01:
+		case d.buf[0] == thriftCompactID:
+			c.compact = true
+		case d.buf[4] == 0x80 && d.buf[5] == 0x01:
+			c.framed = true
+		case d.buf[4] == thriftCompactID:
+			c.framed, c.compact = true, true
+		default:
+			t.breakThrift(c)
+			return
+		}
+		c.detected = true
+	}
+
+	for len(d.buf) > 0 {
+		size, info, err := c.parseMessage(d.buf)
+		if err == errThriftShort {
+			if len(d.buf) > thriftMaxMessageSize {
+				t.breakThrift(c)
+			}
+			return
+		}
+		if err != nil || info.Type < ThriftCall || info.Type > ThriftOneway {
+			t.breakThrift(c)
+			return
+		}
+
+		t.emitThrift(c, d, d.buf[:size], info, packet, isIncoming)
+
+		// Next message starts in the current segment
+		d.buf = d.buf[size:]
+		d.packet = packet
+	}
+
+	d.buf = nil
+}
+
+// emitThrift emits call, or reply as response of the call with the same sequence ID
+func (t *shard) emitThrift(c *thriftConn, d *thriftDirection, data []byte, info *ThriftMessage, packet *TCPPacket, isIncoming bool) {
+	message := NewTCPMessage(d.packet.Seq, d.packet.Ack, isIncoming)
+	message.packets = []*TCPPacket{d.packet.headerCopy()}
+	message.updateCaptureTime(d.packet.Timestamp)
+	message.updateCaptureTime(packet.Timestamp)
+
+	if max := t.config.MaxMessageSize; max > 0 && len(data) > max {
+		data = data[:max]
+		message.Truncated = true
+	}
+	message.packets[0].Data = append([]byte{}, data...)
+	message.size = len(data)
+	message.End = time.Now()
+	message.Thrift = info
+
+	if isIncoming {
+		if info.Type != ThriftCall && info.Type != ThriftOneway {
+			return
+		}
+
+		// Sequence ID is usually unique within connection, so it keeps UUIDs distinct
+		message.Ack += uint32(info.SeqID)
+		t.emit(message)
+
+		if t.trackResponse && info.Type == ThriftCall && len(c.pending) < thriftMaxPending {
+			c.pending[info.SeqID] = &thriftPending{request: message, info: info}
+		}
+		return
+	}
+
+	p, ok := c.pending[info.SeqID]
+	if !ok || info.Type != ThriftReply && info.Type != ThriftException {
+		return
+	}
+	delete(c.pending, info.SeqID)
+
+	reply := *p.info
+	reply.Type = info.Type
+
+	message.AssocMessage = p.request
+	message.Thrift = &reply
+
+	t.emit(message)
+}
+
+// breakThrift stops decoding of connection, messages in progress and replies not received yet are discarded
+func (t *shard) breakThrift(c *thriftConn) {
+	atomic.AddUint64(&t.stats.messagesExpired, uint64(len(c.pending)))
+	c.pending = make(map[int32]*thriftPending)
+
+	for _, d := range []*thriftDirection{&c.client, &c.server} {
+		d.buf, d.packet = nil, nil
+	}
+
+	c.broken = true
+}
+
+// close discards messages in progress once connection is closed
+func (c *thriftConn) close(t *shard, stream *tcpStream) {
+	t.breakThrift(c)
+}
+
+// parseMessage returns size of the message at the start of data, including frame size, and its header
+func (c *thriftConn) parseMessage(data []byte) (int, *ThriftMessage, error) {
+	r := &thriftReader{data: data, compact: c.compact}
+	size := 0
+
+	if c.framed {
+		if len(data) < 4 {
+			return 0, nil, errThriftShort
+		}
+
+		frame := int(int32(binary.BigEndian.Uint32(data)))
+		if frame <= 0 || frame > thriftMaxMessageSize {
+			return 0, nil, errThriftInvalid
+		}
+
+		// Only header is parsed, frame holds the whole message
+		size = 4 + frame
+		r.data = data[4:]
+	}
+
+	info := r.messageHeader()
+	if r.err != nil {
+		if r.err == errThriftShort && size > 0 && len(data) >= size {
+			return 0, nil, errThriftInvalid
+		}
+		return 0, nil, r.err
+	}
+	info.Framed, info.Compact = c.framed, c.compact
+
+	if size > 0 {
+		if len(data) < size {
+			return 0, nil, errThriftShort
+		}
+		return size, info, nil
+	}
+
+	r.skip(thriftTypeStruct, 0)
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+
+	return len(data) - len(r.data), info, nil
+}
+
+// Field types, as encoded by binary protocol. Compact protocol types are converted to them.
+const (
+	thriftTypeBool   = 2
+	thriftTypeByte   = 3
+	thriftTypeDouble = 4
+	thriftTypeI16    = 6
+	thriftTypeI32    = 8
+	thriftTypeI64    = 10
+	thriftTypeString = 11
+	thriftTypeStruct = 12
+	thriftTypeMap    = 13
+	thriftTypeSet    = 14
+	thriftTypeList   = 15
+	thriftTypeUUID   = 16
+)
+
+// Binary protocol types by compact protocol type. Booleans of fields are encoded in type: 1 is true, and 2 false.
+var thriftCompactTypes = [...]byte{
+	1: thriftTypeBool, 2: thriftTypeBool, 3: thriftTypeByte, 4: thriftTypeI16, 5: thriftTypeI32, 6: thriftTypeI64,
+	7: thriftTypeDouble, 8: thriftTypeString, 9: thriftTypeList, 10: thriftTypeSet, 11: thriftTypeMap,
+	12: thriftTypeStruct, 13: thriftTypeUUID,
+}
+
+// thriftReader reads Thrift values, failing all reads after the first error
+type thriftReader struct {
+	data    []byte
+	compact bool
+	err     error
+}
+
+func (r *thriftReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > thriftMaxMessageSize {
+		r.err = errThriftInvalid
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errThriftShort
+		return nil
+	}
+
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *thriftReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *thriftReader) int32() int32 {
+	if b := r.bytes(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *thriftReader) varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.data)
+	switch {
+	case n == 0:
+		r.err = errThriftShort
+		return 0
+	case n < 0:
+		r.err = errThriftInvalid
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return v
+}
+
+// length reads size of string or container
+func (r *thriftReader) length() int {
+	if r.compact {
+		return int(r.varint())
+	}
+
+	return int(r.int32())
+}
+
+// messageHeader reads message type, method name and sequence ID
+func (r *thriftReader) messageHeader() *ThriftMessage {
+	info := &ThriftMessage{}
+
+	if r.compact {
+		if r.byte() != thriftCompactID {
+			r.err = errThriftInvalid
+		}
+		b := r.byte()
+		info.Type = b >> 5
+		info.SeqID = int32(r.varint())
+		info.Method = string(r.bytes(r.length()))
+	} else {
+		version := uint32(r.int32())
+		if r.err == nil && version>>16 != thriftBinaryVersion {
+			r.err = errThriftInvalid
+		}
+		info.Type = byte(version)
+		info.Method = string(r.bytes(r.length()))
+		info.SeqID = r.int32()
+	}
+
+	return info
+}
+
+// skip reads value of given type, and values nested in it
+func (r *thriftReader) skip(typ byte, depth int) {
+	if depth > thriftMaxDepth {
+		r.err = errThriftInvalid
+		return
+	}
+
+	switch typ {
+	case thriftTypeBool, thriftTypeByte:
+		r.bytes(1)
+	case thriftTypeDouble:
+		r.bytes(8)
+	case thriftTypeUUID:
+		r.bytes(16)
+	case thriftTypeI16, thriftTypeI32, thriftTypeI64:
+		if r.compact {
+			r.varint()
+		} else if typ == thriftTypeI16 {
+			r.bytes(2)
+		} else if typ == thriftTypeI32 {
+			r.bytes(4)
+		} else {
+			r.bytes(8)
+		}
+	case thriftTypeString:
+		r.bytes(r.length())
+	case thriftTypeStruct:
+		r.skipStruct(depth)
+	case thriftTypeMap:
+		r.skipMap(depth)
+	case thriftTypeSet, thriftTypeList:
+		r.skipList(depth)
+	default:
+		r.err = errThriftInvalid
+	}
+}
+
+func (r *thriftReader) skipStruct(depth int) {
+	for r.err == nil {
+		b := r.byte()
+		if r.err != nil || b == 0 {
+			return
+		}
+
+		if !r.compact {
+			// Field ID
+			r.bytes(2)
+			r.skip(b, depth+1)
+			continue
+		}
+
+		if b>>4 == 0 {
+			// Field ID is not delta of the previous one
+			r.varint()
+		}
+
+		typ := r.compactType(b & 0x0f)
+		if b&0x0f == 1 || b&0x0f == 2 {
+			// Boolean value is encoded in type
+			continue
+		}
+		r.skip(typ, depth+1)
+	}
+}
+
+func (r *thriftReader) skipList(depth int) {
+	var typ byte
+	var size int
+
+	if r.compact {
+		b := r.byte()
+		typ, size = r.compactType(b&0x0f), int(b>>4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+	} else {
+		typ = r.byte()
+		size = int(r.int32())
+	}
+
+	r.skipElements(size, depth, typ)
+}
+
+func (r *thriftReader) skipMap(depth int) {
+	var keyType, valueType byte
+	var size int
+
+	if r.compact {
+		size = int(r.varint())
+		if size == 0 {
+			return
+		}
+		b := r.byte()
+		keyType, valueType = r.compactType(b>>4), r.compactType(b&0x0f)
+	} else {
+		keyType, valueType = r.byte(), r.byte()
+		size = int(r.int32())
+	}
+
+	r.skipElements(size, depth, keyType, valueType)
+}
+
+// skipElements reads container elements, cycling through types of map keys and values
+func (r *thriftReader) skipElements(size int, depth int, types ...byte) {
+	if size < 0 || size > thriftMaxMessageSize {
+		r.err = errThriftInvalid
+		return
+	}
+
+	for i := 0; i < size && r.err == nil; i++ {
+		for _, typ := range types {
+			r.skip(typ, depth+1)
+		}
+	}
+}
+
+// compactType converts compact protocol type to binary protocol one
+func (r *thriftReader) compactType(typ byte) byte {
+	if int(typ) >= len(thriftCompactTypes) || thriftCompactTypes[typ] == 0 {
+		r.err = errThriftInvalid
+		return 0
+	}
+
+	return thriftCompactTypes[typ]
+}
@@ -0,0 +1,120 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func thriftTestBinary(typ byte, method string, seqID int32, args []byte) []byte {
+	msg := make([]byte, 8, 12+len(method)+len(args))
+	binary.BigEndian.PutUint32(msg, thriftBinaryVersion<<16|uint32(typ))
+	binary.BigEndian.PutUint32(msg[4:], uint32(len(method)))
+	msg = append(msg, method...)
+	msg = append(msg, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(msg[len(msg)-4:], uint32(seqID))
+
+	return append(msg, args...)
+}
+
+// thriftTestCompact builds compact message, sequence ID and method name length should fit into single byte varint
+func thriftTestCompact(typ byte, method string, seqID byte, args []byte) []byte {
+	msg := []byte{thriftCompactID, 1 | typ<<5, seqID, byte(len(method))}
+	msg = append(msg, method...)
+
+	return append(msg, args...)
+}
+
+func thriftTestFrame(msg []byte) []byte {
+	frame := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+
+	return append(frame, msg...)
+}
+
+func TestRawListenerThriftBinary(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolThrift})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Fields: string, list of i32, and map of string to bool
+	args := []byte("\x0b\x00\x01\x00\x00\x00\x03bob" +
+		"\x0f\x00\x02\x08\x00\x00\x00\x02\x00\x00\x00\x01\x00\x00\x00\x02" +
+		"\x0d\x00\x03\x0b\x02\x00\x00\x00\x01\x00\x00\x00\x01a\x01" +
+		"\x00")
+	call := thriftTestBinary(ThriftCall, "Users:get", 1, args)
+	oneway := thriftTestBinary(ThriftOneway, "log", 2, []byte("\x00"))
+
+	// Unframed call split inside of the struct, followed by oneway call
+	c.send(true, call[:30])
+	c.send(true, append(call[30:], oneway...))
+
+	exception := thriftTestBinary(ThriftException, "Users:get", 1, []byte("\x0b\x00\x01\x00\x00\x00\x04fail\x00"))
+	c.send(false, exception)
+
+	messages := receiveMessages(t, listener, 3, func(m *TCPMessage) bool { return m.Thrift != nil })
+
+	if m := messages[0]; m.Thrift.Method != "Users:get" || m.Thrift.Type != ThriftCall || m.Thrift.Framed || m.Thrift.Compact || !bytes.Equal(m.Bytes(), call) {
+		t.Errorf("Should emit call as sent: %q %+v", m.Bytes(), m.Thrift)
+	}
+
+	if m := messages[1]; m.Thrift.Type != ThriftOneway || !bytes.Equal(m.Bytes(), oneway) {
+		t.Errorf("Should emit oneway call: %q %+v", m.Bytes(), m.Thrift)
+	}
+
+	if m := messages[2]; m.IsIncoming || m.AssocMessage != messages[0] || m.Thrift.Type != ThriftException || m.Thrift.Method != "Users:get" {
+		t.Errorf("Should emit exception as reply: %q %+v", m.Bytes(), m.Thrift)
+	}
+}
+
+func TestRawListenerThriftFramedCompact(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolThrift})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	// Fields: binary, boolean encoded in type, list of i32, and struct holding i64
+	args := []byte("\x18\x03bob\x11\x19\x25\x02\x04\x2c\x16\x02\x00\x00")
+	call := thriftTestFrame(thriftTestCompact(ThriftCall, "ping", 7, args))
+	c.send(true, call)
+
+	reply := thriftTestFrame(thriftTestCompact(ThriftReply, "ping", 7, []byte("\x05\x00\x54\x00")))
+	c.send(false, reply[:3])
+	c.send(false, reply[3:])
+
+	messages := receiveMessages(t, listener, 2, func(m *TCPMessage) bool { return m.Thrift != nil })
+
+	if m := messages[0]; m.Thrift.Method != "ping" || m.Thrift.SeqID != 7 || !m.Thrift.Framed || !m.Thrift.Compact || !bytes.Equal(m.Bytes(), call) {
+		t.Errorf("Should emit framed call: %q %+v", m.Bytes(), m.Thrift)
+	}
+
+	if m := messages[1]; m.AssocMessage != messages[0] || m.Thrift.Type != ThriftReply || !bytes.Equal(m.Bytes(), reply) {
+		t.Errorf("Should emit reply: %q %+v", m.Bytes(), m.Thrift)
+	}
+}
+
+func TestThriftCompactStruct(t *testing.T) {
+	c := &thriftConn{compact: true}
+
+	msg := thriftTestCompact(ThriftCall, "ping", 1, []byte("\x18\x03bob\x11\x19\x25\x02\x04\x2c\x16\x02\x00\x00"))
+	if size, _, err := c.parseMessage(append(msg, "next"...)); err != nil || size != len(msg) {
+		t.Error("Should find end of unframed message", size, err)
+	}
+
+	if _, _, err := c.parseMessage(msg[:len(msg)-1]); err != errThriftShort {
+		t.Error("Should wait for the rest of message", err)
+	}
+}
+
+func TestRawListenerThriftNotThrift(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{Protocol: ProtocolThrift})
+	defer listener.Close()
+
+	c := &testConn{listener: listener, clientSeq: 1000, serverSeq: 5000}
+
+	c.send(true, []byte("GET / HTTP/1.1\r\n\r\n"))
+
+	receiveMessages(t, listener, 0, func(m *TCPMessage) bool { return m.Thrift != nil })
+}
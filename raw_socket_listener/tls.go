@@ -0,0 +1,900 @@
+package rawSocket
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TLS sessions are decrypted using private key of the server, if client and server agreed on RSA key exchange:
+// pre-master secret is sent by client encrypted with the server public key. Sessions using (EC)DHE key exchange,
+// and TLS 1.3 can't be decrypted this way, their secrets are read from key log, see tls_keylog.go.
+// Decrypted application data is processed as if it was captured in plaintext.
+
+// TLS record content types
+const (
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordAlert            = 21
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+)
+
+// TLS handshake message types
+const (
+	tlsClientHello       = 1
+	tlsServerHello       = 2
+	tlsClientKeyExchange = 16
+)
+
+// TLS extensions
+const (
+	tlsExtServerName           = 0
+	tlsExtExtendedMasterSecret = 0x17
+)
+
+const (
+	tlsVersion10 = 0x0301
+	tlsVersion11 = 0x0302
+	tlsVersion12 = 0x0303
+
+	tlsRecordHeaderSize    = 5
+	tlsHandshakeHeaderSize = 4
+	tlsRandomSize          = 32
+	tlsMasterSecretSize    = 48
+	tlsGCMExplicitNonce    = 8
+
+	// Maximum size of encrypted record fragment
+	tlsMaxRecordSize = 1<<14 + 2048
+	// Maximum size of records kept while waiting for secrets to be logged
+	tlsMaxPending = 4 * tlsMaxRecordSize
+
+	// Maximum number of remembered sessions, which can be resumed
+	maxTLSSessions = 10000
+)
+
+// tlsCipherSuite describes cipher suite using AES encryption
+type tlsCipherSuite struct {
+	keyLen, macLen, ivLen int
+	gcm                   bool
+	// Pre-master secret is encrypted with server RSA key, instead of being agreed using (EC)DHE
+	rsaKeyExchange bool
+	// Suite of TLS 1.3, which can't be used by previous versions
+	tls13 bool
+	// Hash used by PRF since TLS 1.2, and by HKDF of TLS 1.3
+	prf func() hash.Hash
+}
+
+var tlsCipherSuites = map[uint16]*tlsCipherSuite{
+	// TLS_RSA_WITH_AES_128_CBC_SHA, TLS_RSA_WITH_AES_256_CBC_SHA
+	0x002f: {keyLen: 16, macLen: sha1.Size, ivLen: aes.BlockSize, rsaKeyExchange: true, prf: sha256.New},
+	0x0035: {keyLen: 32, macLen: sha1.Size, ivLen: aes.BlockSize, rsaKeyExchange: true, prf: sha256.New},
+	// TLS_RSA_WITH_AES_128_CBC_SHA256, TLS_RSA_WITH_AES_256_CBC_SHA256
+	0x003c: {keyLen: 16, macLen: sha256.Size, ivLen: aes.BlockSize, rsaKeyExchange: true, prf: sha256.New},
+	0x003d: {keyLen: 32, macLen: sha256.Size, ivLen: aes.BlockSize, rsaKeyExchange: true, prf: sha256.New},
+	// TLS_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x009c: {keyLen: 16, ivLen: 4, gcm: true, rsaKeyExchange: true, prf: sha256.New},
+	0x009d: {keyLen: 32, ivLen: 4, gcm: true, rsaKeyExchange: true, prf: sha512.New384},
+
+	// TLS_DHE_RSA_WITH_AES_128_CBC_SHA, TLS_DHE_RSA_WITH_AES_256_CBC_SHA
+	0x0033: {keyLen: 16, macLen: sha1.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	0x0039: {keyLen: 32, macLen: sha1.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	// TLS_DHE_RSA_WITH_AES_128_CBC_SHA256, TLS_DHE_RSA_WITH_AES_256_CBC_SHA256
+	0x0067: {keyLen: 16, macLen: sha256.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	0x006b: {keyLen: 32, macLen: sha256.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	// TLS_DHE_RSA_WITH_AES_128_GCM_SHA256, TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0x009e: {keyLen: 16, ivLen: 4, gcm: true, prf: sha256.New},
+	0x009f: {keyLen: 32, ivLen: 4, gcm: true, prf: sha512.New384},
+
+	// TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA
+	0xc009: {keyLen: 16, macLen: sha1.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	0xc00a: {keyLen: 32, macLen: sha1.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	// TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA
+	0xc013: {keyLen: 16, macLen: sha1.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	0xc014: {keyLen: 32, macLen: sha1.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	// TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384
+	0xc023: {keyLen: 16, macLen: sha256.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	0xc024: {keyLen: 32, macLen: sha512.Size384, ivLen: aes.BlockSize, prf: sha512.New384},
+	// TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256, TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384
+	0xc027: {keyLen: 16, macLen: sha256.Size, ivLen: aes.BlockSize, prf: sha256.New},
+	0xc028: {keyLen: 32, macLen: sha512.Size384, ivLen: aes.BlockSize, prf: sha512.New384},
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02b: {keyLen: 16, ivLen: 4, gcm: true, prf: sha256.New},
+	0xc02c: {keyLen: 32, ivLen: 4, gcm: true, prf: sha512.New384},
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {keyLen: 16, ivLen: 4, gcm: true, prf: sha256.New},
+	0xc030: {keyLen: 32, ivLen: 4, gcm: true, prf: sha512.New384},
+
+	// TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384
+	0x1301: {keyLen: 16, ivLen: 12, gcm: true, tls13: true, prf: sha256.New},
+	0x1302: {keyLen: 32, ivLen: 12, gcm: true, tls13: true, prf: sha512.New384},
+}
+
+// tlsKeys holds server private keys and key log, see ListenerConfig.TLSKey and ListenerConfig.TLSKeyLog
+type tlsKeys struct {
+	// Key of any server, if single key file is given
+	defaultKey *rsa.PrivateKey
+	// Keys by server name, if directory is given
+	byName map[string]*rsa.PrivateKey
+
+	// Secrets of sessions, logged by server
+	keyLog *tlsKeyLog
+
+	// Master secrets by session ID, so resumed sessions can be decrypted. Shared by all shards.
+	mu       sync.Mutex
+	sessions map[string][]byte
+}
+
+// loadTLSKeys reads server private keys, and opens key log. Any of paths can be empty.
+func loadTLSKeys(keyPath, keyLogPath string) (keys *tlsKeys, err error) {
+	keys = &tlsKeys{byName: make(map[string]*rsa.PrivateKey), sessions: make(map[string][]byte)}
+
+	if keyPath != "" {
+		if err = keys.loadPrivateKeys(keyPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if keyLogPath != "" {
+		if keys.keyLog, err = openTLSKeyLog(keyLogPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// loadPrivateKeys reads PEM encoded RSA private key, or all keys of the directory, named by server name like "example.com.pem"
+func (k *tlsKeys) loadPrivateKeys(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		k.defaultKey, err = loadRSAKey(path)
+		return err
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if f.IsDir() || (ext != ".pem" && ext != ".key") {
+			continue
+		}
+
+		key, err := loadRSAKey(filepath.Join(path, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		k.byName[strings.ToLower(strings.TrimSuffix(f.Name(), ext))] = key
+	}
+
+	if len(k.byName) == 0 {
+		return fmt.Errorf("No TLS keys found in: %s", path)
+	}
+
+	return nil
+}
+
+// loadRSAKey reads first private key of PEM file, in PKCS #1 or PKCS #8 format
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+				return rsaKey, nil
+			}
+
+			return nil, fmt.Errorf("Not RSA private key: %s", path)
+		}
+	}
+
+	return nil, fmt.Errorf("No private key found: %s", path)
+}
+
+// decryptPreMaster decrypts pre-master secret using key of the server, or trying all keys if server name is unknown
+func (k *tlsKeys) decryptPreMaster(serverName string, encrypted []byte) []byte {
+	keys := []*rsa.PrivateKey{k.defaultKey}
+	if k.defaultKey == nil {
+		keys = keys[:0]
+		if key, ok := k.byName[serverName]; ok {
+			keys = append(keys, key)
+		}
+
+		for name, key := range k.byName {
+			if name != serverName {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		// Pre-master secret starts with TLS version, so wrong key is detected
+		if preMaster, err := rsa.DecryptPKCS1v15(nil, key, encrypted); err == nil && len(preMaster) == tlsMasterSecretSize && preMaster[0] == 3 {
+			return preMaster
+		}
+	}
+
+	return nil
+}
+
+func (k *tlsKeys) session(id []byte) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.sessions[string(id)]
+}
+
+func (k *tlsKeys) storeSession(id, masterSecret []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.sessions) >= maxTLSSessions {
+		k.sessions = make(map[string][]byte)
+	}
+
+	k.sessions[string(id)] = masterSecret
+}
+
+// tlsConn holds TLS decryption state of single connection
+type tlsConn struct {
+	client, server tlsDirection
+
+	version      uint16
+	suite        *tlsCipherSuite
+	clientRandom []byte
+	serverRandom []byte
+	serverName   string
+	sessionID    []byte
+	// Server accepted session ID offered by client, and master secret of the previous session is reused
+	resumed bool
+
+	// Both hellos have extended master secret extension, see RFC 7627
+	extendedMasterSecret bool
+	masterSecret         []byte
+	// Handshake messages used to compute extended master secret
+	transcript []byte
+
+	// Decrypted data of both directions is numbered, see processTLSPlaintext
+	plainStarted bool
+
+	// Session can't be decrypted, like because of unsupported cipher suite or missing segment
+	broken bool
+}
+
+// tlsDirection holds state of records sent by one side of connection
+type tlsDirection struct {
+	// Sequence number of the next expected segment, and not complete record from previous segments
+	nextSeq uint32
+	started bool
+	buf     []byte
+
+	// Not complete handshake message
+	handshake []byte
+
+	// Records are encrypted after ChangeCipherSpec
+	encrypted bool
+	block     cipher.Block
+	aead      cipher.AEAD
+	iv        []byte
+	macLen    int
+	recordSeq uint64
+
+	// TLS 1.3 traffic secret, and whether handshake of the direction is finished, so application secret is used
+	secret   []byte
+	finished bool
+
+	// Sequence number of the next decrypted data, passed to HTTP processing like segment of plaintext connection
+	plainSeq uint32
+	// First byte of record split in 1 and n-1 bytes, kept until the rest of record is decrypted
+	split []byte
+}
+
+// isTLSClientHello checks if packet starts TLS handshake
+func isTLSClientHello(packet *TCPPacket, isIncoming bool) bool {
+	data := packet.Data
+	return isIncoming && len(data) > tlsRecordHeaderSize && data[0] == tlsRecordHandshake && data[1] == 3 && data[tlsRecordHeaderSize] == tlsClientHello
+}
+
+// processTLS decrypts records of the segment, and passes decrypted data to HTTP processing
+func (t *shard) processTLS(stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	c := stream.tls
+	if c.broken {
+		return
+	}
+
+	d, other := &c.server, &c.client
+	if isIncoming {
+		d, other = other, d
+	}
+
+	data := packet.Data
+
+	if !d.started {
+		d.nextSeq, d.started = packet.Seq, true
+	}
+
+	switch diff := seqDiff(packet.Seq, d.nextSeq); {
+	case diff > 0:
+		// Missing record can't be skipped, since decryption depends on record sequence number
+		c.breakTLS()
+		return
+	case diff < 0:
+		// Retransmission of already processed data
+		if int(-diff) >= len(data) {
+			return
+		}
+		data = data[-diff:]
+	}
+	d.nextSeq = packet.Seq + uint32(len(packet.Data))
+
+	// Packet data is reused after processing, so incomplete records are copied
+	buf := data
+	if len(d.buf) > 0 {
+		d.buf = append(d.buf, data...)
+		buf = d.buf
+	}
+
+	for len(buf) >= tlsRecordHeaderSize {
+		length := int(binary.BigEndian.Uint16(buf[3:5]))
+		if length > tlsMaxRecordSize {
+			c.breakTLS()
+			return
+		}
+
+		if len(buf) < tlsRecordHeaderSize+length {
+			break
+		}
+
+		record := buf[:tlsRecordHeaderSize+length]
+
+		// Secrets can be logged after records are captured, so records are kept until they are
+		if !c.loadSecrets(d, t.tlsKeys, record[0], isIncoming) {
+			if len(buf) > tlsMaxPending {
+				c.breakTLS()
+				return
+			}
+			break
+		}
+		buf = buf[len(record):]
+
+		plaintext, ok := c.processRecord(d, t.tlsKeys, record[:tlsRecordHeaderSize], record[tlsRecordHeaderSize:], isIncoming)
+		if !ok {
+			c.breakTLS()
+			return
+		}
+
+		if len(plaintext) > 0 {
+			t.processTLSPlaintext(stream, d, other, packet, isIncoming, plaintext)
+		}
+	}
+
+	if !c.broken {
+		d.buf = append(d.buf[:0], buf...)
+	}
+}
+
+// processTLSPlaintext passes decrypted data as packet of plaintext connection
+func (t *shard) processTLSPlaintext(stream *tcpStream, d, other *tlsDirection, packet *TCPPacket, isIncoming bool, data []byte) {
+	// Plaintext sequence numbers start at the first application data, so first request and response
+	// are numbered like in plaintext connection
+	if c := stream.tls; !c.plainStarted {
+		d.plainSeq, other.plainSeq = packet.Seq, packet.Ack
+		c.plainStarted = true
+	}
+
+	// TLS 1.0 implementations send first byte of data in separate record, to protect CBC from BEAST attack.
+	// Single byte would be taken as complete message, so it is joined with the next record.
+	if stream.tls.version < tlsVersion11 && d.block != nil {
+		if d.split == nil && len(data) == 1 {
+			d.split = append([]byte{}, data...)
+			return
+		}
+
+		if d.split != nil {
+			data = append(d.split, data...)
+			d.split = nil
+		}
+	}
+
+	p := plaintextPacket(packet, d.plainSeq, other.plainSeq, data)
+	d.plainSeq += uint32(len(data))
+
+	for _, sp := range t.splitSegment(stream, p, isIncoming) {
+		t.processHTTPData(stream, sp, isIncoming)
+	}
+}
+
+// plaintextPacket builds packet carrying decrypted data, addressed like captured one
+func plaintextPacket(packet *TCPPacket, seq, ack uint32, data []byte) *TCPPacket {
+	raw := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(raw[0:2], packet.SrcPort)
+	binary.BigEndian.PutUint16(raw[2:4], packet.DestPort)
+	binary.BigEndian.PutUint32(raw[4:8], seq)
+	binary.BigEndian.PutUint32(raw[8:12], ack)
+	raw[12] = 5 << 4
+	raw[13] = fPSH | fACK
+	raw = append(raw, data...)
+
+	// Packet addresses point to the reused buffer
+	p := ParseTCPPacket(append([]byte{}, packet.Addr...), append([]byte{}, packet.DstAddr...), raw)
+	p.Timestamp = packet.Timestamp
+
+	return p
+}
+
+// breakTLS stops decryption of connection
+func (c *tlsConn) breakTLS() {
+	c.broken = true
+	c.client.buf, c.server.buf = nil, nil
+	c.transcript = nil
+}
+
+// loadSecrets sets keys of the direction using secrets from key log, before they are needed by the record.
+// Returns false if secrets are not logged yet.
+func (c *tlsConn) loadSecrets(d *tlsDirection, keys *tlsKeys, recordType byte, isIncoming bool) bool {
+	if d.encrypted || keys.keyLog == nil {
+		return true
+	}
+
+	switch {
+	case c.version == tlsVersion13 && recordType == tlsRecordApplicationData:
+		secret := keys.keyLog.secret(tls13Label(d, isIncoming), c.clientRandom)
+		if secret == nil {
+			return false
+		}
+
+		c.setTLS13Keys(d, secret)
+	case c.version != tlsVersion13 && recordType == tlsRecordChangeCipherSpec && c.masterSecret == nil:
+		c.masterSecret = keys.keyLog.secret(keyLogClientRandom, c.clientRandom)
+		return c.masterSecret != nil
+	}
+
+	return true
+}
+
+// processRecord handles single record, and returns decrypted application data.
+// Returns false if connection can't be decrypted further.
+func (c *tlsConn) processRecord(d *tlsDirection, keys *tlsKeys, header, fragment []byte, isIncoming bool) ([]byte, bool) {
+	recordType := header[0]
+
+	// TLS 1.3 sends not encrypted ChangeCipherSpec only for compatibility with middleboxes
+	if c.version == tlsVersion13 && recordType == tlsRecordChangeCipherSpec {
+		return nil, true
+	}
+
+	if d.encrypted && c.version == tlsVersion13 {
+		return c.processTLS13Record(d, header, fragment, isIncoming)
+	}
+
+	if d.encrypted {
+		plaintext, ok := d.decrypt(c.version, header, fragment)
+		if !ok || recordType != tlsRecordApplicationData {
+			// Encrypted Finished message and alerts are not needed
+			return nil, ok
+		}
+
+		return plaintext, true
+	}
+
+	switch recordType {
+	case tlsRecordChangeCipherSpec:
+		if c.masterSecret == nil || c.suite == nil {
+			return nil, false
+		}
+
+		c.setKeys(d, isIncoming)
+	case tlsRecordHandshake:
+		d.handshake = append(d.handshake, fragment...)
+
+		for len(d.handshake) >= tlsHandshakeHeaderSize {
+			length := int(d.handshake[1])<<16 | int(d.handshake[2])<<8 | int(d.handshake[3])
+			if len(d.handshake) < tlsHandshakeHeaderSize+length {
+				break
+			}
+
+			msg := d.handshake[:tlsHandshakeHeaderSize+length]
+			if !c.processHandshake(keys, msg) {
+				return nil, false
+			}
+
+			d.handshake = d.handshake[len(msg):]
+		}
+
+		d.handshake = append([]byte{}, d.handshake...)
+	case tlsRecordApplicationData:
+		// TLS 1.3 0-RTT data is sent before ServerHello, and is not decrypted.
+		// Otherwise application data can't be sent before handshake.
+		return nil, c.serverRandom == nil && keys.keyLog != nil
+	}
+
+	return nil, true
+}
+
+// processHandshake reads parameters of the session from not encrypted handshake messages
+func (c *tlsConn) processHandshake(keys *tlsKeys, msg []byte) bool {
+	if c.masterSecret == nil && c.version != tlsVersion13 {
+		c.transcript = append(c.transcript, msg...)
+	}
+
+	body := msg[tlsHandshakeHeaderSize:]
+
+	switch msg[0] {
+	case tlsClientHello:
+		return c.parseClientHello(body)
+	case tlsServerHello:
+		if !c.parseServerHello(body) {
+			return false
+		}
+
+		// Secrets of TLS 1.3 sessions are only in key log
+		if c.version == tlsVersion13 {
+			c.transcript = nil
+			return keys.keyLog != nil
+		}
+
+		// Abbreviated handshake, session can be decrypted if its full handshake was captured
+		if c.resumed {
+			c.masterSecret = keys.session(c.sessionID)
+		}
+	case tlsClientKeyExchange:
+		if c.suite == nil {
+			return false
+		}
+
+		if c.suite.rsaKeyExchange {
+			c.masterSecret = c.rsaMasterSecret(keys, body)
+		}
+		c.transcript = nil
+
+		// Master secret of (EC)DHE key exchange, or without server key, can be read from key log, see loadSecrets
+		if c.masterSecret == nil {
+			return keys.keyLog != nil
+		}
+
+		if len(c.sessionID) > 0 {
+			keys.storeSession(c.sessionID, c.masterSecret)
+		}
+	}
+
+	return true
+}
+
+// rsaMasterSecret decrypts pre-master secret sent by client, and derives master secret from it
+func (c *tlsConn) rsaMasterSecret(keys *tlsKeys, body []byte) []byte {
+	if len(body) < 2 {
+		return nil
+	}
+
+	encrypted := body[2:]
+	if len(encrypted) != int(binary.BigEndian.Uint16(body[:2])) {
+		return nil
+	}
+
+	preMaster := keys.decryptPreMaster(c.serverName, encrypted)
+	if preMaster == nil {
+		return nil
+	}
+
+	if c.extendedMasterSecret {
+		return c.prf(preMaster, "extended master secret", c.transcriptHash(), tlsMasterSecretSize)
+	}
+
+	return c.prf(preMaster, "master secret", concat(c.clientRandom, c.serverRandom), tlsMasterSecretSize)
+}
+
+// parseClientHello reads client random, server name and extensions
+func (c *tlsConn) parseClientHello(body []byte) bool {
+	// Version and random
+	if len(body) < 2+tlsRandomSize+1 {
+		return false
+	}
+	c.clientRandom = append([]byte{}, body[2:2+tlsRandomSize]...)
+
+	sessionID, r := readTLSVector(body[2+tlsRandomSize:], 1)
+	if r == nil {
+		return false
+	}
+	c.sessionID = append([]byte{}, sessionID...)
+
+	// Cipher suites and compression methods
+	if _, r = readTLSVector(r, 2); r == nil {
+		return false
+	}
+	if _, r = readTLSVector(r, 1); r == nil {
+		return false
+	}
+
+	return c.parseExtensions(r, func(extType uint16, data []byte) {
+		if extType == tlsExtServerName {
+			c.serverName = parseServerName(data)
+		}
+
+		// Client offers it, and it is used if server confirms it, see parseServerHello
+		if extType == tlsExtExtendedMasterSecret {
+			c.extendedMasterSecret = true
+		}
+	})
+}
+
+// parseServerHello reads negotiated version, cipher suite and session ID
+func (c *tlsConn) parseServerHello(body []byte) bool {
+	if len(body) < 2+tlsRandomSize+1 {
+		return false
+	}
+	c.version = binary.BigEndian.Uint16(body[:2])
+	c.serverRandom = append([]byte{}, body[2:2+tlsRandomSize]...)
+
+	sessionID, r := readTLSVector(body[2+tlsRandomSize:], 1)
+	if r == nil || len(r) < 3 {
+		return false
+	}
+	suiteID := binary.BigEndian.Uint16(r[:2])
+
+	clientEMS := c.extendedMasterSecret
+	c.extendedMasterSecret = false
+
+	ok := c.parseExtensions(r[3:], func(extType uint16, data []byte) {
+		if extType == tlsExtExtendedMasterSecret && clientEMS {
+			c.extendedMasterSecret = true
+		}
+
+		// TLS 1.3 is negotiated using extension, version field is kept as TLS 1.2
+		if extType == tlsExtSupportedVersions && len(data) == 2 {
+			c.version = binary.BigEndian.Uint16(data)
+		}
+	})
+
+	suite, known := tlsCipherSuites[suiteID]
+	if !ok || !known || c.version < tlsVersion10 || c.version > tlsVersion13 || suite.tls13 != (c.version == tlsVersion13) {
+		// Not supported cipher suite, like not using AES
+		return false
+	}
+	c.suite = suite
+
+	// Session ID of TLS 1.3 is only kept for compatibility, sessions are resumed using pre-shared keys
+	c.resumed = c.version != tlsVersion13 && len(sessionID) > 0 && bytes.Equal(sessionID, c.sessionID)
+	c.sessionID = append([]byte{}, sessionID...)
+
+	return true
+}
+
+// parseExtensions calls fn for each extension, extensions block can be missing
+func (c *tlsConn) parseExtensions(data []byte, fn func(extType uint16, data []byte)) bool {
+	if len(data) == 0 {
+		return true
+	}
+
+	extensions, r := readTLSVector(data, 2)
+	if r == nil {
+		return false
+	}
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[:2])
+
+		var ext []byte
+		if ext, extensions = readTLSVector(extensions[2:], 2); extensions == nil {
+			return false
+		}
+
+		fn(extType, ext)
+	}
+
+	return true
+}
+
+// parseServerName returns host name from server_name extension
+func parseServerName(data []byte) string {
+	list, r := readTLSVector(data, 2)
+	if r == nil {
+		return ""
+	}
+
+	for len(list) > 3 {
+		nameType := list[0]
+
+		var name []byte
+		if name, list = readTLSVector(list[1:], 2); list == nil {
+			return ""
+		}
+
+		// Host name
+		if nameType == 0 {
+			return strings.ToLower(string(name))
+		}
+	}
+
+	return ""
+}
+
+// readTLSVector reads vector with length prefix of given size, and returns data following it.
+// Returns nil rest if data is too short.
+func readTLSVector(data []byte, lenSize int) (vector, rest []byte) {
+	if len(data) < lenSize {
+		return nil, nil
+	}
+
+	length := 0
+	for _, b := range data[:lenSize] {
+		length = length<<8 | int(b)
+	}
+
+	if len(data) < lenSize+length {
+		return nil, nil
+	}
+
+	return data[lenSize : lenSize+length], data[lenSize+length:]
+}
+
+// setKeys derives encryption keys of the direction from master secret, see RFC 5246 section 6.3
+func (c *tlsConn) setKeys(d *tlsDirection, isIncoming bool) {
+	s := c.suite
+	keyBlock := c.prf(c.masterSecret, "key expansion", concat(c.serverRandom, c.clientRandom), 2*(s.macLen+s.keyLen+s.ivLen))
+
+	keys := keyBlock[2*s.macLen:]
+	ivs := keyBlock[2*(s.macLen+s.keyLen):]
+
+	// Client keys go first
+	key, iv := keys[s.keyLen:2*s.keyLen], ivs[s.ivLen:2*s.ivLen]
+	if isIncoming {
+		key, iv = keys[:s.keyLen], ivs[:s.ivLen]
+	}
+
+	d.block, _ = aes.NewCipher(key)
+	if s.gcm {
+		d.aead, _ = cipher.NewGCM(d.block)
+	}
+
+	d.iv = append([]byte{}, iv...)
+	d.macLen = s.macLen
+	d.recordSeq = 0
+	d.encrypted = true
+}
+
+// decrypt returns plaintext of encrypted record. Integrity is not verified, since data is already accepted by receiver.
+func (d *tlsDirection) decrypt(version uint16, header, fragment []byte) ([]byte, bool) {
+	defer func() { d.recordSeq++ }()
+
+	if d.aead != nil {
+		if len(fragment) < tlsGCMExplicitNonce+d.aead.Overhead() {
+			return nil, false
+		}
+
+		nonce := concat(d.iv, fragment[:tlsGCMExplicitNonce])
+		ciphertext := fragment[tlsGCMExplicitNonce:]
+
+		// Additional data is record sequence number, type, version, and length of plaintext
+		ad := make([]byte, 13)
+		binary.BigEndian.PutUint64(ad, d.recordSeq)
+		copy(ad[8:11], header[:3])
+		binary.BigEndian.PutUint16(ad[11:], uint16(len(ciphertext)-d.aead.Overhead()))
+
+		plaintext, err := d.aead.Open(nil, nonce, ciphertext, ad)
+		return plaintext, err == nil
+	}
+
+	iv, ciphertext := d.iv, fragment
+	// Since TLS 1.1 each record has explicit IV, TLS 1.0 uses last block of the previous record
+	if version >= tlsVersion11 {
+		if len(fragment) < aes.BlockSize {
+			return nil, false
+		}
+		iv, ciphertext = fragment[:aes.BlockSize], fragment[aes.BlockSize:]
+	}
+
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, false
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(d.block, iv).CryptBlocks(plaintext, ciphertext)
+
+	if version < tlsVersion11 {
+		d.iv = append(d.iv[:0], ciphertext[len(ciphertext)-aes.BlockSize:]...)
+	}
+
+	// Plaintext is followed by MAC and padding
+	padding := int(plaintext[len(plaintext)-1]) + 1
+	if padding+d.macLen > len(plaintext) {
+		return nil, false
+	}
+
+	return plaintext[:len(plaintext)-padding-d.macLen], true
+}
+
+// prf is TLS pseudorandom function: P_SHA256 (or hash of cipher suite) since TLS 1.2,
+// and combination of P_MD5 and P_SHA1 before it
+func (c *tlsConn) prf(secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := concat([]byte(label), seed)
+
+	if c.version >= tlsVersion12 {
+		return pHash(c.suite.prf, secret, labelSeed, n)
+	}
+
+	half := (len(secret) + 1) / 2
+	result := pHash(md5.New, secret[:half], labelSeed, n)
+	for i, b := range pHash(sha1.New, secret[len(secret)-half:], labelSeed, n) {
+		result[i] ^= b
+	}
+
+	return result
+}
+
+// transcriptHash returns hash of handshake messages, used as extended master secret seed
+func (c *tlsConn) transcriptHash() []byte {
+	if c.version >= tlsVersion12 {
+		h := c.suite.prf()
+		h.Write(c.transcript)
+		return h.Sum(nil)
+	}
+
+	md5Hash := md5.Sum(c.transcript)
+	sha1Hash := sha1.Sum(c.transcript)
+
+	return concat(md5Hash[:], sha1Hash[:])
+}
+
+// pHash expands secret and seed into n bytes, see RFC 5246 section 5
+func pHash(h func() hash.Hash, secret, seed []byte, n int) []byte {
+	result := make([]byte, 0, n+64)
+	mac := hmac.New(h, secret)
+
+	mac.Write(seed)
+	a := mac.Sum(nil)
+
+	for len(result) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		result = mac.Sum(result)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+
+	return result[:n]
+}
+
+func concat(a, b []byte) []byte {
+	return append(append(make([]byte, 0, len(a)+len(b)), a...), b...)
+}
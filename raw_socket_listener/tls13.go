@@ -0,0 +1,142 @@
+package rawSocket
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"hash"
+)
+
+// TLS 1.3 records are encrypted using traffic secrets read from key log: handshake secret until Finished message
+// of the direction, and application secret after it. Record type is encrypted too, and is the last not zero byte
+// of plaintext, see RFC 8446 section 5.2.
+
+const (
+	tlsVersion13 = 0x0304
+
+	tlsExtSupportedVersions = 0x2b
+
+	tlsFinished  = 20
+	tlsKeyUpdate = 24
+)
+
+// tls13Label returns key log label of the current traffic secret of direction
+func tls13Label(d *tlsDirection, isIncoming bool) string {
+	switch {
+	case isIncoming && d.finished:
+		return keyLogClientTraffic
+	case isIncoming:
+		return keyLogClientHandshake
+	case d.finished:
+		return keyLogServerTraffic
+	}
+
+	return keyLogServerHandshake
+}
+
+// setTLS13Keys derives key and IV of the direction from traffic secret, see RFC 8446 section 7.3
+func (c *tlsConn) setTLS13Keys(d *tlsDirection, secret []byte) {
+	s := c.suite
+
+	d.secret = secret
+	d.block, _ = aes.NewCipher(hkdfExpandLabel(s.prf, secret, "key", s.keyLen))
+	d.aead, _ = cipher.NewGCM(d.block)
+	d.iv = hkdfExpandLabel(s.prf, secret, "iv", s.ivLen)
+	d.recordSeq = 0
+	d.encrypted = true
+}
+
+// processTLS13Record decrypts record, and returns application data it carries
+func (c *tlsConn) processTLS13Record(d *tlsDirection, header, fragment []byte, isIncoming bool) ([]byte, bool) {
+	plaintext, ok := d.decryptTLS13(header, fragment)
+	if !ok {
+		// 0-RTT data can follow ClientHello, and it is skipped like server does when it rejects it
+		return nil, isIncoming && !d.finished
+	}
+
+	// Content type is followed by padding
+	i := len(plaintext) - 1
+	for i >= 0 && plaintext[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return nil, false
+	}
+
+	switch plaintext[i] {
+	case tlsRecordApplicationData:
+		return plaintext[:i], true
+	case tlsRecordHandshake:
+		c.processTLS13Handshake(d, plaintext[:i])
+	}
+
+	// Alerts are not needed
+	return nil, true
+}
+
+// processTLS13Handshake handles encrypted handshake messages, which change keys of the direction
+func (c *tlsConn) processTLS13Handshake(d *tlsDirection, data []byte) {
+	d.handshake = append(d.handshake, data...)
+
+	for len(d.handshake) >= tlsHandshakeHeaderSize {
+		length := int(d.handshake[1])<<16 | int(d.handshake[2])<<8 | int(d.handshake[3])
+		if len(d.handshake) < tlsHandshakeHeaderSize+length {
+			break
+		}
+
+		switch d.handshake[0] {
+		case tlsFinished:
+			// Application traffic secret is read from key log before the next record, see loadSecrets
+			d.finished, d.encrypted = true, false
+		case tlsKeyUpdate:
+			c.setTLS13Keys(d, hkdfExpandLabel(c.suite.prf, d.secret, "traffic upd", len(d.secret)))
+		}
+
+		d.handshake = d.handshake[tlsHandshakeHeaderSize+length:]
+	}
+
+	d.handshake = append([]byte{}, d.handshake...)
+}
+
+// decryptTLS13 returns plaintext of record. Nonce is IV combined with record sequence number,
+// and record header is additional data.
+func (d *tlsDirection) decryptTLS13(header, fragment []byte) ([]byte, bool) {
+	nonce := append([]byte{}, d.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(d.recordSeq >> (8 * uint(i)))
+	}
+
+	plaintext, err := d.aead.Open(nil, nonce, fragment, header)
+	if err != nil {
+		return nil, false
+	}
+	d.recordSeq++
+
+	return plaintext, true
+}
+
+// hkdfExpandLabel derives secret of given length with empty context, see RFC 8446 section 7.1
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+
+	info := []byte{byte(n >> 8), byte(n), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+
+	// HKDF-Expand, see RFC 5869 section 2.3
+	result := make([]byte, 0, n+64)
+	mac := hmac.New(h, secret)
+
+	var block []byte
+	for i := byte(1); len(result) < n; i++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+
+		result = append(result, block...)
+	}
+
+	return result[:n]
+}
@@ -0,0 +1,145 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Key log holds secrets of TLS sessions in NSS format, like one written by browsers, curl, or servers when
+// SSLKEYLOGFILE environment variable is set. Each line is label, client random, and secret, in hex:
+//
+//	CLIENT_RANDOM <client random> <master secret>
+//	CLIENT_HANDSHAKE_TRAFFIC_SECRET <client random> <secret>
+//
+// Sessions are matched by client random of ClientHello, so secrets of any key exchange can be used.
+
+// Key log labels
+const (
+	// TLS 1.2 and earlier master secret
+	keyLogClientRandom = "CLIENT_RANDOM"
+
+	// TLS 1.3 traffic secrets
+	keyLogClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// Maximum number of remembered secrets, all are dropped when exceeded
+const maxTLSKeyLogSecrets = 100000
+
+// tlsKeyLog reads secrets from key log file. File is read as it grows, so secrets logged by running server
+// can be used to decrypt its sessions in real time.
+type tlsKeyLog struct {
+	path string
+
+	mu sync.Mutex
+	// Size of already read data, and not complete last line
+	offset  int64
+	partial []byte
+	// Secrets by label and client random
+	secrets map[string][]byte
+}
+
+// openTLSKeyLog reads secrets already logged to the file
+func openTLSKeyLog(path string) (*tlsKeyLog, error) {
+	l := &tlsKeyLog{path: path, secrets: make(map[string][]byte)}
+
+	if err := l.read(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// secret returns logged secret of the session, reading new lines of the file if it is not known yet
+func (l *tlsKeyLog) secret(label string, clientRandom []byte) []byte {
+	key := label + " " + string(clientRandom)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if secret, ok := l.secrets[key]; ok {
+		return secret
+	}
+
+	if l.read() != nil {
+		return nil
+	}
+
+	return l.secrets[key]
+}
+
+// read parses lines appended since the last read. Truncated file, like after rotation, is read from the start.
+func (l *tlsKeyLog) read() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() < l.offset {
+		l.offset, l.partial = 0, nil
+	}
+
+	if info.Size() == l.offset {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, l.offset, info.Size()-l.offset))
+	if err != nil {
+		return err
+	}
+	l.offset += int64(len(data))
+
+	if len(l.partial) > 0 {
+		data = append(l.partial, data...)
+	}
+
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+
+		l.parseLine(data[:i])
+		data = data[i+1:]
+	}
+
+	l.partial = append([]byte{}, data...)
+
+	return nil
+}
+
+// parseLine stores secret of the line, comments and malformed lines are skipped
+func (l *tlsKeyLog) parseLine(line []byte) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || fields[0][0] == '#' {
+		return
+	}
+
+	clientRandom, err := hex.DecodeString(string(fields[1]))
+	if err != nil || len(clientRandom) != tlsRandomSize {
+		return
+	}
+
+	secret, err := hex.DecodeString(string(fields[2]))
+	if err != nil {
+		return
+	}
+
+	if len(l.secrets) >= maxTLSKeyLogSecrets {
+		l.secrets = make(map[string][]byte)
+	}
+
+	l.secrets[string(fields[0])+" "+string(clientRandom)] = secret
+}
@@ -0,0 +1,159 @@
+package rawSocket
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSKeyLogRead(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-keylog")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.log")
+	random := bytes.Repeat([]byte{0xab}, tlsRandomSize)
+	hexRandom := "abababababababababababababababababababababababababababababababab"
+
+	if _, err := openTLSKeyLog(path); err == nil {
+		t.Error("Should fail if file does not exist")
+	}
+
+	ioutil.WriteFile(path, []byte("# comment\nCLIENT_RANDOM 00 01\nCLIENT_RANDOM "+hexRandom+" 0102\nCLIENT_TRAFFIC_SECRET_0 "+hexRandom), 0600)
+
+	keyLog, err := openTLSKeyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := keyLog.secret(keyLogClientRandom, random); !bytes.Equal(s, []byte{1, 2}) {
+		t.Error("Should read logged secret", s)
+	}
+
+	if len(keyLog.secrets) != 1 {
+		t.Error("Should skip comments, malformed and not complete lines", keyLog.secrets)
+	}
+
+	// Lines appended by server are read when secret is not known yet
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(" 0304\n")
+	f.Close()
+
+	if s := keyLog.secret(keyLogClientTraffic, random); !bytes.Equal(s, []byte{3, 4}) {
+		t.Error("Should read appended secret", s)
+	}
+
+	// Rotated file is read from the start
+	ioutil.WriteFile(path, []byte("SERVER_TRAFFIC_SECRET_0 "+hexRandom+" 05\n"), 0600)
+
+	if s := keyLog.secret(keyLogServerTraffic, random); !bytes.Equal(s, []byte{5}) {
+		t.Error("Should read truncated file from the start", s)
+	}
+}
+
+func TestRawListenerTLSKeyLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-keylog")
+	defer os.RemoveAll(dir)
+
+	cert := tlsTestKey(t, dir, "server.pem")
+
+	suites := []struct {
+		version, suite uint16
+	}{
+		{tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		{tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA},
+		{tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+		{tls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256},
+	}
+
+	for _, s := range suites {
+		path := filepath.Join(dir, "keys.log")
+		ioutil.WriteFile(path, nil, 0600)
+
+		// Secrets are logged after listener is started
+		listener, err := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{TLSKeyLog: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyLog, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+
+		clientConfig, serverConfig := tlsConfigs(cert, s.version, s.suite)
+		serverConfig.KeyLogWriter = keyLog
+
+		segments, state := recordTLS(t, clientConfig, serverConfig,
+			"GET /1 HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+			"GET /2 HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb")
+		keyLog.Close()
+
+		if _, ok := tlsCipherSuites[state.CipherSuite]; !ok {
+			t.Logf("Cipher suite %x is not supported", state.CipherSuite)
+			listener.Close()
+			continue
+		}
+
+		sendSegments(listener, segments)
+
+		exchanges := receiveExchanges(t, listener, 4)
+		if exchanges["/1"] != "a" || exchanges["/2"] != "b" {
+			t.Errorf("Should decrypt TLS session, version %x suite %x: %q", s.version, state.CipherSuite, exchanges)
+		}
+
+		listener.Close()
+	}
+}
+
+func TestRawListenerTLSKeyLogDelayed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-keylog")
+	defer os.RemoveAll(dir)
+
+	cert := tlsTestKey(t, dir, "server.pem")
+	path := filepath.Join(dir, "keys.log")
+	ioutil.WriteFile(path, nil, 0600)
+
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{TLSKeyLog: path})
+	defer listener.Close()
+
+	var keyLog bytes.Buffer
+	clientConfig, serverConfig := tlsConfigs(cert, tls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256)
+	serverConfig.KeyLogWriter = &keyLog
+
+	segments, state := recordTLS(t, clientConfig, serverConfig,
+		"GET /1 HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+		"GET /2 HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb")
+	if _, ok := tlsCipherSuites[state.CipherSuite]; !ok {
+		t.Skipf("Cipher suite %x is not supported", state.CipherSuite)
+	}
+
+	// Records are kept until secrets are logged
+	last := len(segments) - 2
+	sendSegments(listener, segments[:last])
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Errorf("Should not emit messages without secrets: %q", m.Bytes())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ioutil.WriteFile(path, keyLog.Bytes(), 0600)
+
+	// Second exchange continues the connection
+	clientSeq, serverSeq := uint32(1), uint32(1000)
+	for _, s := range segments[:last] {
+		if s.isIncoming {
+			clientSeq += uint32(len(s.data))
+		} else {
+			serverSeq += uint32(len(s.data))
+		}
+	}
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq, segments[last].data).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, clientSeq+uint32(len(segments[last].data)), serverSeq, segments[last+1].data).Dump())
+
+	exchanges := receiveExchanges(t, listener, 4)
+	if exchanges["/1"] != "a" || exchanges["/2"] != "b" {
+		t.Errorf("Should decrypt records kept while waiting for secrets: %q", exchanges)
+	}
+}
@@ -0,0 +1,245 @@
+package rawSocket
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tlsRecorder logs data written by both sides of connection, in order
+type tlsRecorder struct {
+	mu       sync.Mutex
+	segments []tlsSegment
+}
+
+type tlsSegment struct {
+	isIncoming bool
+	data       []byte
+}
+
+type recordedConn struct {
+	net.Conn
+	recorder   *tlsRecorder
+	isIncoming bool
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	c.recorder.mu.Lock()
+	c.recorder.segments = append(c.recorder.segments, tlsSegment{c.isIncoming, append([]byte{}, b...)})
+	c.recorder.mu.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+// tlsTestKey writes PEM encoded RSA key to temporary directory, and returns certificate for it
+func tlsTestKey(t *testing.T, dir, name string) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(filepath.Join(dir, name), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: key}
+}
+
+// tlsConfigs returns configs of client and server, using only given version and cipher suite
+func tlsConfigs(cert tls.Certificate, version, suite uint16) (client, server *tls.Config) {
+	client = &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.com",
+		MinVersion:         version,
+		MaxVersion:         version,
+		CipherSuites:       []uint16{suite},
+	}
+	server = &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		MinVersion:             version,
+		MaxVersion:             version,
+		CipherSuites:           []uint16{suite},
+		SessionTicketsDisabled: true,
+	}
+
+	return
+}
+
+// recordTLS runs HTTP exchanges over TLS connection, and returns written data and negotiated parameters
+func recordTLS(t *testing.T, clientConfig, serverConfig *tls.Config, exchanges ...string) ([]tlsSegment, tls.ConnectionState) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &tlsRecorder{}
+
+	client := tls.Client(&recordedConn{clientConn, recorder, true}, clientConfig)
+	server := tls.Server(&recordedConn{serverConn, recorder, false}, serverConfig)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < len(exchanges); i += 2 {
+			if _, err := io.ReadFull(server, make([]byte, len(exchanges[i]))); err != nil {
+				done <- err
+				return
+			}
+			if _, err := server.Write([]byte(exchanges[i+1])); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// Messages are read whole, since records can be split, like in TLS 1.0
+	for i := 0; i < len(exchanges); i += 2 {
+		if _, err := client.Write([]byte(exchanges[i])); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, make([]byte, len(exchanges[i+1]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn.Close()
+	serverConn.Close()
+
+	return recorder.segments, client.ConnectionState()
+}
+
+// sendSegments sends recorded data to listener as TCP segments of single connection
+func sendSegments(listener *Listener, segments []tlsSegment) {
+	clientSeq, serverSeq := uint32(1), uint32(1000)
+
+	for _, s := range segments {
+		if s.isIncoming {
+			listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq, s.data).Dump())
+			clientSeq += uint32(len(s.data))
+		} else {
+			listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, clientSeq, serverSeq, s.data).Dump())
+			serverSeq += uint32(len(s.data))
+		}
+	}
+}
+
+func TestRawListenerTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-tls")
+	defer os.RemoveAll(dir)
+
+	cert := tlsTestKey(t, dir, "server.pem")
+
+	suites := []struct {
+		version, suite uint16
+	}{
+		{tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+		{tls.VersionTLS12, tls.TLS_RSA_WITH_AES_256_CBC_SHA},
+		{tls.VersionTLS10, tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+	}
+
+	for _, s := range suites {
+		listener, err := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{TLSKey: filepath.Join(dir, "server.pem")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clientConfig, serverConfig := tlsConfigs(cert, s.version, s.suite)
+		segments, _ := recordTLS(t, clientConfig, serverConfig,
+			"GET /1 HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+			"GET /2 HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb")
+		sendSegments(listener, segments)
+
+		exchanges := receiveExchanges(t, listener, 4)
+		if exchanges["/1"] != "a" || exchanges["/2"] != "b" {
+			t.Errorf("Should decrypt TLS session, version %x suite %x: %q", s.version, s.suite, exchanges)
+		}
+
+		listener.Close()
+	}
+}
+
+func TestRawListenerTLSUnknownKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-tls")
+	defer os.RemoveAll(dir)
+
+	// Key of the server is not known, and key of other server can't decrypt the session
+	tlsTestKey(t, dir, "example.com.pem")
+	cert := tlsTestKey(t, dir, "server.pem")
+
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{TLSKey: filepath.Join(dir, "example.com.pem")})
+	defer listener.Close()
+
+	clientConfig, serverConfig := tlsConfigs(cert, tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_GCM_SHA256)
+	segments, _ := recordTLS(t, clientConfig, serverConfig,
+		"GET / HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	sendSegments(listener, segments)
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Errorf("Should not emit encrypted data: %q", m.Bytes())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLoadTLSKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-tls")
+	defer os.RemoveAll(dir)
+
+	if _, err := loadTLSKeys(dir, ""); err == nil {
+		t.Error("Should fail if directory has no keys")
+	}
+
+	tlsTestKey(t, dir, "Example.com.pem")
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600)
+
+	keys, err := loadTLSKeys(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys.byName) != 1 || keys.byName["example.com"] == nil {
+		t.Error("Should index keys by server name", keys.byName)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "broken.key"), []byte("not a key"), 0600)
+	if _, err := loadTLSKeys(dir, ""); err == nil {
+		t.Error("Should fail on invalid key")
+	}
+}
@@ -0,0 +1,246 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+)
+
+// IP protocol numbers, see ipProtocol
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+	ipProtoGRE = 47
+)
+
+// Well-known UDP ports of tunnel protocols
+const (
+	vxlanPort  = 4789
+	genevePort = 6081
+)
+
+// EtherTypes which can be found inside tunnel headers
+const (
+	etherTypeIPv4    = 0x0800
+	etherTypeIPv6    = 0x86DD
+	etherTypeVLAN    = 0x8100
+	etherTypeQinQ    = 0x88A8
+	etherTypeTEB     = 0x6558 // Transparent Ethernet Bridging, GRE and Geneve carrying L2 frames
+	etherTypeERSPAN  = 0x88BE // ERSPAN Type II
+	etherTypeERSPAN3 = 0x22EB // ERSPAN Type III
+)
+
+// Tunnels can be nested (e.g. VXLAN inside GRE), but we do not want to loop forever on malformed packets
+const maxTunnelDepth = 4
+
+// BPF expression which matches tunnel traffic we know how to unwrap
+const bpfTunnels = "(ip proto 47) or (ip6 proto 47) or (udp dst port 4789) or (udp dst port 6081)"
+
+// ipPayload parses IPv4 or IPv6 header and returns transport protocol number and its payload
+func ipPayload(data []byte) (proto uint8, payload []byte, ok bool) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0F) * 4
+		if ihl < 20 || len(data) < ihl {
+			return
+		}
+
+		return data[9], data[ihl:], true
+	case 6:
+		if len(data) < 40 {
+			return
+		}
+
+		proto = data[6]
+		payload = data[40:]
+
+		// Skip Hop-by-Hop, Routing and Destination Options extension headers
+		for proto == 0 || proto == 43 || proto == 60 {
+			if len(payload) < 8 {
+				return 0, nil, false
+			}
+
+			extLen := (int(payload[1]) + 1) * 8
+			if len(payload) < extLen {
+				return 0, nil, false
+			}
+
+			proto = payload[0]
+			payload = payload[extLen:]
+		}
+
+		return proto, payload, true
+	}
+
+	return
+}
+
+// unwrapEthernet strips Ethernet header (including VLAN tags) and returns IP packet
+func unwrapEthernet(data []byte) ([]byte, bool) {
+	if len(data) < 14 {
+		return nil, false
+	}
+
+	etherType := binary.BigEndian.Uint16(data[12:14])
+	data = data[14:]
+
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(data) < 4 {
+			return nil, false
+		}
+
+		etherType = binary.BigEndian.Uint16(data[2:4])
+		data = data[4:]
+	}
+
+	return unwrapEtherType(etherType, data)
+}
+
+// unwrapEtherType returns IP packet carried inside payload of given EtherType
+func unwrapEtherType(etherType uint16, data []byte) ([]byte, bool) {
+	switch etherType {
+	case etherTypeIPv4, etherTypeIPv6:
+		return data, true
+	case etherTypeTEB:
+		return unwrapEthernet(data)
+	}
+
+	return nil, false
+}
+
+// unwrapGRE parses GRE header (RFC 2784, RFC 2890) and returns encapsulated IP packet
+func unwrapGRE(data []byte) ([]byte, bool) {
+	if len(data) < 4 {
+		return nil, false
+	}
+
+	flags := data[0]
+	etherType := binary.BigEndian.Uint16(data[2:4])
+	hdrLen := 4
+
+	// Checksum present
+	if flags&0x80 != 0 {
+		hdrLen += 4
+	}
+	// Key present
+	if flags&0x20 != 0 {
+		hdrLen += 4
+	}
+	// Sequence number present
+	if flags&0x10 != 0 {
+		hdrLen += 4
+	}
+
+	if len(data) < hdrLen {
+		return nil, false
+	}
+
+	data = data[hdrLen:]
+
+	switch etherType {
+	case etherTypeERSPAN:
+		// 8 bytes of ERSPAN Type II header followed by mirrored Ethernet frame.
+		// Type I ERSPAN have no sequence number and no ERSPAN header.
+		if flags&0x10 != 0 {
+			if len(data) < 8 {
+				return nil, false
+			}
+			data = data[8:]
+		}
+
+		return unwrapEthernet(data)
+	case etherTypeERSPAN3:
+		// 12 bytes of ERSPAN Type III header, plus optional 8 bytes of platform specific subheader
+		if len(data) < 12 {
+			return nil, false
+		}
+
+		optional := data[11]&0x01 != 0
+		data = data[12:]
+
+		if optional {
+			if len(data) < 8 {
+				return nil, false
+			}
+			data = data[8:]
+		}
+
+		return unwrapEthernet(data)
+	}
+
+	return unwrapEtherType(etherType, data)
+}
+
+// unwrapUDP returns encapsulated IP packet if UDP datagram belongs to VXLAN or Geneve tunnel
+func unwrapUDP(data []byte) ([]byte, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+
+	dstPort := binary.BigEndian.Uint16(data[2:4])
+	data = data[8:]
+
+	switch dstPort {
+	case vxlanPort:
+		// 8 bytes VXLAN header, "I" flag should be set
+		if len(data) < 8 || data[0]&0x08 == 0 {
+			return nil, false
+		}
+
+		return unwrapEthernet(data[8:])
+	case genevePort:
+		// 8 bytes fixed Geneve header followed by variable length options
+		if len(data) < 8 {
+			return nil, false
+		}
+
+		optLen := int(data[0]&0x3F) * 4
+		etherType := binary.BigEndian.Uint16(data[2:4])
+
+		if len(data) < 8+optLen {
+			return nil, false
+		}
+
+		return unwrapEtherType(etherType, data[8+optLen:])
+	}
+
+	return nil, false
+}
+
+// decapsulate unwraps GRE, VXLAN and Geneve tunnels and returns the innermost IP packet.
+// tunneled is false if the packet was not encapsulated, in this case data returned as is.
+// ok is false if packet can't be parsed or innermost packet is not TCP.
+func decapsulate(data []byte) (inner []byte, tunneled bool, ok bool) {
+	inner = data
+
+	for depth := 0; depth <= maxTunnelDepth; depth++ {
+		proto, payload, valid := ipPayload(inner)
+		if !valid {
+			return nil, tunneled, false
+		}
+
+		var next []byte
+
+		switch proto {
+		case ipProtoTCP:
+			return inner, tunneled, true
+		case ipProtoGRE:
+			next, valid = unwrapGRE(payload)
+		case ipProtoUDP:
+			next, valid = unwrapUDP(payload)
+		default:
+			valid = false
+		}
+
+		if !valid {
+			return nil, tunneled, false
+		}
+
+		inner = next
+		tunneled = true
+	}
+
+	return nil, tunneled, false
+}
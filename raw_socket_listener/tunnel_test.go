@@ -0,0 +1,148 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func buildIPv4(proto uint8, payload []byte) []byte {
+	buf := make([]byte, 20+len(payload))
+	buf[0] = 0x45
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	buf[9] = proto
+	copy(buf[12:16], []byte{10, 0, 0, 1})
+	copy(buf[16:20], []byte{10, 0, 0, 2})
+	copy(buf[20:], payload)
+
+	return buf
+}
+
+func buildEthernet(etherType uint16, payload []byte) []byte {
+	buf := make([]byte, 14+len(payload))
+	binary.BigEndian.PutUint16(buf[12:14], etherType)
+	copy(buf[14:], payload)
+
+	return buf
+}
+
+func buildUDP(dstPort uint16, payload []byte) []byte {
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(buf[2:4], dstPort)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(buf)))
+	copy(buf[8:], payload)
+
+	return buf
+}
+
+func innerTCPPacket() []byte {
+	return buildIPv4(ipProtoTCP, buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")).Raw)
+}
+
+func TestDecapsulateNotTunneled(t *testing.T) {
+	pkt := innerTCPPacket()
+
+	inner, tunneled, ok := decapsulate(pkt)
+
+	if !ok || tunneled {
+		t.Fatal("Plain TCP packet should be returned as is", ok, tunneled)
+	}
+
+	if !bytes.Equal(inner, pkt) {
+		t.Error("Should not modify packet")
+	}
+}
+
+func TestDecapsulateGRE(t *testing.T) {
+	inner := innerTCPPacket()
+
+	gre := []byte{0, 0, 0x08, 0x00}
+	checkTunnel(t, buildIPv4(ipProtoGRE, append(gre, inner...)), inner)
+
+	// With checksum, key and sequence number
+	gre = []byte{0xB0, 0, 0x08, 0x00, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2}
+	checkTunnel(t, buildIPv4(ipProtoGRE, append(gre, inner...)), inner)
+
+	// Transparent Ethernet Bridging
+	gre = []byte{0, 0, 0x65, 0x58}
+	checkTunnel(t, buildIPv4(ipProtoGRE, append(gre, buildEthernet(etherTypeIPv4, inner)...)), inner)
+}
+
+func TestDecapsulateERSPAN(t *testing.T) {
+	inner := innerTCPPacket()
+
+	// Type II: GRE with sequence number and 8 byte ERSPAN header
+	gre := []byte{0x10, 0, 0x88, 0xBE, 0, 0, 0, 1}
+	erspan := make([]byte, 8)
+	frame := buildEthernet(etherTypeIPv4, inner)
+
+	checkTunnel(t, buildIPv4(ipProtoGRE, append(append(gre, erspan...), frame...)), inner)
+
+	// VLAN tagged mirrored frame
+	tagged := make([]byte, 18+len(inner))
+	binary.BigEndian.PutUint16(tagged[12:14], etherTypeVLAN)
+	binary.BigEndian.PutUint16(tagged[16:18], etherTypeIPv4)
+	copy(tagged[18:], inner)
+
+	checkTunnel(t, buildIPv4(ipProtoGRE, append(append(gre, erspan...), tagged...)), inner)
+}
+
+func TestDecapsulateVXLAN(t *testing.T) {
+	inner := innerTCPPacket()
+
+	vxlan := []byte{0x08, 0, 0, 0, 0, 0, 42, 0}
+	udp := buildUDP(vxlanPort, append(vxlan, buildEthernet(etherTypeIPv4, inner)...))
+
+	checkTunnel(t, buildIPv4(ipProtoUDP, udp), inner)
+}
+
+func TestDecapsulateGeneve(t *testing.T) {
+	inner := innerTCPPacket()
+
+	// 1 option of 4 bytes
+	geneve := []byte{0x01, 0, 0x65, 0x58, 0, 0, 42, 0, 1, 2, 3, 4}
+	udp := buildUDP(genevePort, append(geneve, buildEthernet(etherTypeIPv4, inner)...))
+
+	checkTunnel(t, buildIPv4(ipProtoUDP, udp), inner)
+}
+
+func TestDecapsulateNested(t *testing.T) {
+	inner := innerTCPPacket()
+
+	vxlan := []byte{0x08, 0, 0, 0, 0, 0, 42, 0}
+	udp := buildUDP(vxlanPort, append(vxlan, buildEthernet(etherTypeIPv4, inner)...))
+
+	gre := []byte{0, 0, 0x08, 0x00}
+	checkTunnel(t, buildIPv4(ipProtoGRE, append(gre, buildIPv4(ipProtoUDP, udp)...)), inner)
+}
+
+func TestDecapsulateSkipUnknown(t *testing.T) {
+	// Regular UDP traffic
+	if _, _, ok := decapsulate(buildIPv4(ipProtoUDP, buildUDP(53, []byte("dns")))); ok {
+		t.Error("Should skip non tunnel UDP packets")
+	}
+
+	// Tunnel with UDP inside
+	gre := []byte{0, 0, 0x08, 0x00}
+	if _, _, ok := decapsulate(buildIPv4(ipProtoGRE, append(gre, buildIPv4(ipProtoUDP, buildUDP(53, nil))...))); ok {
+		t.Error("Should skip tunnels without TCP inside")
+	}
+
+	// Truncated tunnel header
+	if _, _, ok := decapsulate(buildIPv4(ipProtoGRE, []byte{0xB0, 0, 0x08, 0x00})); ok {
+		t.Error("Should skip truncated packets")
+	}
+}
+
+func checkTunnel(t *testing.T, pkt, expected []byte) {
+	inner, tunneled, ok := decapsulate(pkt)
+
+	if !ok || !tunneled {
+		t.Error("Should unwrap tunnel", ok, tunneled)
+		return
+	}
+
+	if !bytes.Equal(inner, expected) {
+		t.Error("Should return inner packet", inner, expected)
+	}
+}
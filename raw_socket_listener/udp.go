@@ -0,0 +1,140 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// Transport protocols Listener can capture
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+	// TCP without HTTP parsing, connection data is emitted in chunks, see TCPChunk
+	ProtocolRawTCP = "raw-tcp"
+	// TCP connections decoded as MySQL protocol, see MySQLCommand
+	ProtocolMySQL = "mysql"
+	// TCP connections decoded as PostgreSQL protocol, see PostgresQuery
+	ProtocolPostgres = "postgres"
+	// TCP connections decoded as Redis protocol, see RedisCommand
+	ProtocolRedis = "redis"
+	// TCP connections decoded as memcached text or binary protocol, see MemcachedCommand
+	ProtocolMemcached = "memcached"
+	// TCP connections decoded as MongoDB wire protocol, see MongoCommand
+	ProtocolMongo = "mongo"
+	// TCP connections to brokers decoded as Kafka protocol, see KafkaRequest
+	ProtocolKafka = "kafka"
+	// TCP connections decoded as Thrift RPC, see ThriftMessage
+	ProtocolThrift = "thrift"
+)
+
+const udpHeaderSize = 8
+
+// ipProtocol returns number of captured protocol, as used in IP header
+func (t *Listener) ipProtocol() byte {
+	if t.udp {
+		return ipProtoUDP
+	}
+
+	return ipProtoTCP
+}
+
+// transportProtocol returns name of captured transport protocol, ProtocolTCP or ProtocolUDP
+func (t *Listener) transportProtocol() string {
+	if t.udp {
+		return ProtocolUDP
+	}
+
+	return ProtocolTCP
+}
+
+// isHTTP checks if TCP connections are parsed as HTTP, and not decoded as other application protocol
+func (t *Listener) isHTTP() bool {
+	return t.newDecoder == nil
+}
+
+// hasData checks if captured segment should be processed.
+// TCP segments are needed only if they have data inside, or open or close connection, and UDP datagrams if they are not empty.
+func (t *Listener) hasData(segment []byte) bool {
+	if t.udp {
+		return len(segment) > udpHeaderSize
+	}
+
+	// Truncated TCP info
+	if len(segment) < 14 {
+		return false
+	}
+
+	// Get the 'data offset' (size of the TCP header in 32-bit words)
+	dataOffset := (segment[12] & 0xF0) >> 4
+
+	// Check that the buffer is larger than the size of the TCP header
+	return len(segment) > int(dataOffset*4) || segment[13]&(fSYN|fFIN|fRST) != 0
+}
+
+// parseUDPPacket takes source and destination addresses and UDP datagram, and returns it as packet without sequence numbers
+func parseUDPPacket(addr []byte, dstAddr []byte, data []byte) (p *TCPPacket) {
+	// Frames shorter than Ethernet minimum are padded, so size taken from header
+	if length := int(binary.BigEndian.Uint16(data[4:6])); length >= udpHeaderSize && length < len(data) {
+		data = data[:length]
+	}
+
+	p = &TCPPacket{Raw: data, Data: data[udpHeaderSize:], Addr: addr, DstAddr: dstAddr}
+	p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+	p.DestPort = binary.BigEndian.Uint16(data[2:4])
+
+	copy(p.ID[:16], p.Addr)
+	copy(p.ID[16:32], p.DstAddr)
+	copy(p.ID[32:], data[0:4]) // Src and dest ports
+
+	return
+}
+
+// processUDPPacket dispatches each datagram as separate message, without reassembly.
+// If responses are tracked, datagram sent from listened port is associated with the last request of the same flow.
+func (t *shard) processUDPPacket(data []byte, buf *packetBuffer) {
+	if len(data) < packetHeaderSize+udpHeaderSize {
+		return
+	}
+
+	packet := parseUDPPacket(data[:16], data[16:packetAddrSize], data[packetHeaderSize:])
+	packet.Timestamp = packetTimestamp(data)
+	packet.buf = buf
+	isIncoming := t.isIncoming(packet.SrcPort, packet.DestPort)
+	id := packetConnID(packet, isIncoming)
+
+	message := NewTCPMessage(0, 0, isIncoming)
+	message.packets = []*TCPPacket{packet}
+	buf.retain()
+	message.End = message.Start
+	message.CaptureStart, message.CaptureEnd = packet.Timestamp, packet.Timestamp
+
+	if isIncoming {
+		if t.trackResponse {
+			t.udpRequests[id] = message
+		}
+
+		t.emit(message)
+		return
+	}
+
+	request, ok := t.udpRequests[id]
+	if !ok {
+		atomic.AddUint64(&t.stats.messagesExpired, 1)
+		message.release()
+		return
+	}
+	delete(t.udpRequests, id)
+
+	message.AssocMessage = request
+	t.emit(message)
+}
+
+// expireUDPRequests forgets requests which got no response
+func (t *shard) expireUDPRequests(now time.Time) {
+	for id, request := range t.udpRequests {
+		if now.Sub(request.Start) >= t.messageExpire {
+			delete(t.udpRequests, id)
+		}
+	}
+}
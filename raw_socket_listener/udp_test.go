@@ -0,0 +1,96 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func buildUDPDatagram(isIncoming bool, clientPort uint16, data []byte) []byte {
+	buf := make([]byte, packetHeaderSize+udpHeaderSize+len(data))
+
+	client, server := []byte("123"), []byte("456")
+	serverPort := uint16(53)
+
+	if isIncoming {
+		copy(buf[:16], client)
+		copy(buf[16:packetAddrSize], server)
+		binary.BigEndian.PutUint16(buf[packetHeaderSize:], clientPort)
+		binary.BigEndian.PutUint16(buf[packetHeaderSize+2:], serverPort)
+	} else {
+		copy(buf[:16], server)
+		copy(buf[16:packetAddrSize], client)
+		binary.BigEndian.PutUint16(buf[packetHeaderSize:], serverPort)
+		binary.BigEndian.PutUint16(buf[packetHeaderSize+2:], clientPort)
+	}
+
+	binary.BigEndian.PutUint16(buf[packetHeaderSize+4:], uint16(udpHeaderSize+len(data)))
+	copy(buf[packetHeaderSize+udpHeaderSize:], data)
+
+	return buf
+}
+
+func TestRawListenerUDP(t *testing.T) {
+	listener, _ := NewListener("", "53", engineTest, true, 10*time.Millisecond, &ListenerConfig{Protocol: ProtocolUDP})
+	defer listener.Close()
+
+	// Ethernet padding after datagram
+	req := append(buildUDPDatagram(true, 40000, []byte("query")), 0, 0, 0)
+	listener.packetsChan <- newPacketBuffer(req)
+	listener.packetsChan <- newPacketBuffer(buildUDPDatagram(true, 40001, []byte("other query")))
+	listener.packetsChan <- newPacketBuffer(buildUDPDatagram(false, 40000, []byte("answer")))
+	// Response without request
+	listener.packetsChan <- newPacketBuffer(buildUDPDatagram(false, 40002, []byte("unknown")))
+
+	var messages []*TCPMessage
+	for len(messages) < 3 {
+		select {
+		case m := <-listener.messagesChan:
+			messages = append(messages, m)
+		case <-time.After(time.Second):
+			t.Fatal("Should emit each datagram as message", len(messages))
+		}
+	}
+
+	if !messages[0].IsIncoming || !bytes.Equal(messages[0].Bytes(), []byte("query")) {
+		t.Errorf("Wrong request: %q", messages[0].Bytes())
+	}
+
+	if messages[0].Port() != 53 {
+		t.Error("Wrong port", messages[0].Port())
+	}
+
+	resp := messages[2]
+	if resp.IsIncoming || !bytes.Equal(resp.Bytes(), []byte("answer")) {
+		t.Errorf("Wrong response: %q", resp.Bytes())
+	}
+
+	if resp.AssocMessage != messages[0] || !bytes.Equal(resp.UUID(), messages[0].UUID()) {
+		t.Error("Response should be associated with request of the same flow")
+	}
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Errorf("Should skip response without request: %q", m.Bytes())
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRawListenerUnknownProtocol(t *testing.T) {
+	if _, err := NewListener("", "53", engineTest, false, 0, &ListenerConfig{Protocol: "sctp"}); err == nil {
+		t.Error("Should return error for unknown protocol")
+	}
+}
+
+func TestUDPBPFPorts(t *testing.T) {
+	l := &Listener{ports: testPorts("53,8125"), udp: true}
+
+	if bpf := l.bpfPorts("dst"); bpf != "(udp dst port 53 or udp dst port 8125)" {
+		t.Error("Wrong BPF", bpf)
+	}
+
+	if l.hasData(make([]byte, udpHeaderSize)) || !l.hasData(make([]byte, udpHeaderSize+1)) {
+		t.Error("Should capture only datagrams with data")
+	}
+}
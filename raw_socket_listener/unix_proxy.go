@@ -0,0 +1,170 @@
+package rawSocket
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Unix domain socket traffic can't be captured from network interface, so Listener works as a proxy in front of the socket:
+// clients connect to the proxy socket, and traffic is relayed to the original one. Relayed data is turned into segments
+// of synthetic TCP connections, and processed the same way as captured traffic.
+
+// Server port of synthetic connections, client ports are assigned sequentially above it
+const unixProxyServerPort = 80
+
+var unixProxyAddr = []byte{127, 0, 0, 1}
+
+// parseUnixProxyAddr parses address in "proxy.sock:upstream.sock" format
+func parseUnixProxyAddr(addr string) (proxy, upstream string, err error) {
+	parts := strings.SplitN(addr, ":", 2)
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Unix socket proxy address should be in `proxy.sock:upstream.sock` format: %s", addr)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// readUnixProxy starts listening on proxy socket. Returns error if socket can't be created.
+func (t *Listener) readUnixProxy() error {
+	proxy, upstream, err := parseUnixProxyAddr(t.addr)
+	if err != nil {
+		return err
+	}
+
+	// Socket left by the previous run
+	if fi, err := os.Stat(proxy); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(proxy)
+	}
+
+	ln, err := net.Listen("unix", proxy)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.unixListener = ln
+	t.mu.Unlock()
+
+	go t.acceptUnixProxy(ln, upstream)
+
+	t.readyCh <- true
+
+	return nil
+}
+
+func (t *Listener) acceptUnixProxy(ln net.Listener, upstream string) {
+	clientPort := uint16(unixProxyServerPort)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			log.Println("Unix socket proxy stopped:", err)
+			return
+		}
+
+		if clientPort++; clientPort <= unixProxyServerPort {
+			clientPort = unixProxyServerPort + 1
+		}
+
+		go t.proxyUnixConn(conn, upstream, clientPort)
+	}
+}
+
+// unixProxyConn emits traffic of relayed connection as segments of synthetic TCP connection
+type unixProxyConn struct {
+	// Next sequence numbers of each side, accessed atomically since directions are relayed by own goroutines
+	clientSeq uint32
+	serverSeq uint32
+
+	clientPort uint16
+	listener   *Listener
+}
+
+func (t *Listener) proxyUnixConn(client net.Conn, upstream string, clientPort uint16) {
+	defer client.Close()
+
+	server, err := net.Dial("unix", upstream)
+	if err != nil {
+		log.Println("Unix socket proxy can't connect to", upstream, err)
+		return
+	}
+	defer server.Close()
+
+	c := &unixProxyConn{clientSeq: rand.Uint32(), serverSeq: rand.Uint32(), clientPort: clientPort, listener: t}
+	c.emit(true, fSYN, nil)
+	c.emit(false, fSYN|fACK, nil)
+
+	done := make(chan bool, 2)
+	go c.relay(server, client, true, done)
+	go c.relay(client, server, false, done)
+
+	<-done
+	<-done
+}
+
+// relay copies data from `src` to `dst` until EOF, emitting it before sending, so response never processed before request
+func (c *unixProxyConn) relay(dst, src net.Conn, isIncoming bool, done chan bool) {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := src.Read(buf)
+
+		if n > 0 {
+			c.emit(isIncoming, fACK|fPSH, buf[:n])
+
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	c.emit(isIncoming, fFIN|fACK, nil)
+
+	if uc, ok := dst.(*net.UnixConn); ok {
+		uc.CloseWrite()
+	}
+
+	done <- true
+}
+
+func (c *unixProxyConn) emit(isIncoming bool, flags uint16, data []byte) {
+	size := uint32(len(data))
+	// SYN and FIN occupy one sequence number
+	if flags&(fSYN|fFIN) != 0 {
+		size++
+	}
+
+	packet := &TCPPacket{Flags: flags, Data: data, Addr: unixProxyAddr, DstAddr: unixProxyAddr, Timestamp: time.Now()}
+
+	if isIncoming {
+		packet.SrcPort, packet.DestPort = c.clientPort, unixProxyServerPort
+		packet.Seq = atomic.AddUint32(&c.clientSeq, size) - size
+		packet.Ack = atomic.LoadUint32(&c.serverSeq)
+	} else {
+		packet.SrcPort, packet.DestPort = unixProxyServerPort, c.clientPort
+		packet.Seq = atomic.AddUint32(&c.serverSeq, size) - size
+		packet.Ack = atomic.LoadUint32(&c.clientSeq)
+	}
+
+	c.listener.sendPacket(newPacketBuffer(packet.Dump()))
+}
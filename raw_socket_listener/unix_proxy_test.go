@@ -0,0 +1,84 @@
+package rawSocket
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixProxy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor")
+	defer os.RemoveAll(dir)
+
+	upstream, proxy := filepath.Join(dir, "app.sock"), filepath.Join(dir, "gor.sock")
+
+	ln, err := net.Listen("unix", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+
+	listener, err := NewListener(proxy+":"+upstream, "0", EngineUnixProxy, true, 100*time.Millisecond, &ListenerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.IsReady()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", proxy)
+		},
+	}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://app/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body, _ := ioutil.ReadAll(resp.Body); !bytes.Equal(body, []byte("pong")) {
+			t.Error("Should relay response", string(body))
+		}
+		resp.Body.Close()
+	}
+
+	var requests, responses int
+	for requests+responses < 4 {
+		select {
+		case m := <-listener.Receiver():
+			if m.IsIncoming {
+				requests++
+				if !bytes.HasPrefix(m.Bytes(), []byte("GET /ping HTTP/1.1")) {
+					t.Errorf("Wrong request: %q", m.Bytes())
+				}
+			} else {
+				responses++
+				if m.AssocMessage == nil || !bytes.HasSuffix(m.Bytes(), []byte("pong")) {
+					t.Errorf("Wrong response: %q", m.Bytes())
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should capture requests and responses", requests, responses)
+		}
+	}
+}
+
+func TestParseUnixProxyAddr(t *testing.T) {
+	if proxy, upstream, err := parseUnixProxyAddr("/run/gor.sock:/run/app.sock"); err != nil || proxy != "/run/gor.sock" || upstream != "/run/app.sock" {
+		t.Error("Wrong address", proxy, upstream, err)
+	}
+
+	if _, _, err := parseUnixProxyAddr("/run/app.sock"); err == nil {
+		t.Error("Should require upstream socket")
+	}
+}
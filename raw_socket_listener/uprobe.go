@@ -0,0 +1,261 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Uprobe engine captures plaintext of TLS connections inside processes: uprobes attached to read and write functions
+// of OpenSSL and Go crypto/tls report data before it is encrypted, or after it is decrypted. Data of each TLS connection
+// is turned into segments of TCP connection, and processed the same way as captured traffic. Connection uses socket
+// addresses if they can be found in /proc, otherwise synthetic ones, like unix socket proxy does.
+
+// Kinds of uprobe events
+const (
+	uprobeRead = iota
+	uprobeWrite
+	// Socket of OpenSSL connection is set, fd is passed in total
+	uprobeSetFD
+	uprobeClose
+)
+
+// Event flag set for Go *tls.Conn, otherwise connection is OpenSSL SSL*
+const uprobeGoConn = 1 << 8
+
+// Event header: pid, flags, connection address, kernel time, chunk size, chunk offset and total size of the call
+const uprobeEventHeaderSize = 40
+
+// Connections without events are forgotten after this time
+const uprobeConnTimeout = 5 * time.Minute
+
+// Server port of synthetic connections, used if listener captures any port
+const uprobeServerPort = 443
+
+var uprobeSyntheticAddr = net.IP{127, 0, 0, 1}
+
+// uprobeEvent is sent by BPF programs. Data of large calls is split into chunks, each sent as separate event.
+type uprobeEvent struct {
+	pid   uint32
+	flags uint32
+	// Address of SSL or tls.Conn object
+	conn uint64
+	// CLOCK_MONOTONIC time in nanoseconds
+	time uint64
+	// Offset of the chunk in data of the call, and total size of data
+	offset uint32
+	total  uint32
+	data   []byte
+}
+
+func parseUprobeEvent(data []byte) (e uprobeEvent, ok bool) {
+	if len(data) < uprobeEventHeaderSize {
+		return e, false
+	}
+
+	e.pid = binary.LittleEndian.Uint32(data[0:4])
+	e.flags = binary.LittleEndian.Uint32(data[4:8])
+	e.conn = binary.LittleEndian.Uint64(data[8:16])
+	e.time = binary.LittleEndian.Uint64(data[16:24])
+	size := binary.LittleEndian.Uint32(data[24:28])
+	e.offset = binary.LittleEndian.Uint32(data[28:32])
+	e.total = binary.LittleEndian.Uint32(data[32:36])
+
+	if int(size) > len(data)-uprobeEventHeaderSize {
+		return e, false
+	}
+	e.data = data[uprobeEventHeaderSize : uprobeEventHeaderSize+size]
+
+	return e, true
+}
+
+func (e *uprobeEvent) kind() uint32 {
+	return e.flags & 0xff
+}
+
+type uprobeConnID struct {
+	pid  uint32
+	conn uint64
+}
+
+// uprobeConn is synthetic TCP connection of TLS connection
+type uprobeConn struct {
+	clientAddr, serverAddr net.IP
+	clientPort, serverPort uint16
+
+	// Process reads requests, otherwise it is client of captured server
+	isServer bool
+
+	// Next sequence numbers of each side, and sequence numbers of the calls being reported
+	clientSeq, serverSeq   uint32
+	clientCall, serverCall uint32
+
+	lastSeen time.Time
+}
+
+// uprobeTracker turns uprobe events into TCP segments
+type uprobeTracker struct {
+	listener *Listener
+
+	// Returns local and remote addresses of the socket. Fd is -1 if it is not known.
+	resolve func(pid uint32, conn uint64, isGo bool, fd int) (local, remote *net.TCPAddr, ok bool)
+
+	// Processes which events are processed, all if nil
+	pids map[uint32]bool
+
+	// Added to event time to get wall time
+	clockOffset int64
+
+	conns map[uprobeConnID]*uprobeConn
+	// Sockets set for OpenSSL connections
+	fds map[uprobeConnID]int
+
+	lastClientPort uint16
+}
+
+func newUprobeTracker(listener *Listener) *uprobeTracker {
+	return &uprobeTracker{
+		listener: listener,
+		conns:    make(map[uprobeConnID]*uprobeConn),
+		fds:      make(map[uprobeConnID]int),
+	}
+}
+
+func (t *uprobeTracker) process(e *uprobeEvent) {
+	if t.pids != nil && !t.pids[e.pid] {
+		return
+	}
+
+	id := uprobeConnID{e.pid, e.conn}
+
+	switch e.kind() {
+	case uprobeSetFD:
+		t.fds[id] = int(int32(e.total))
+	case uprobeClose:
+		delete(t.fds, id)
+
+		if c, ok := t.conns[id]; ok {
+			delete(t.conns, id)
+			t.emit(c, true, fFIN|fACK, nil, c.clientSeq, e.time)
+			t.emit(c, false, fFIN|fACK, nil, c.serverSeq, e.time)
+		}
+	case uprobeRead, uprobeWrite:
+		c, ok := t.conns[id]
+		if !ok {
+			if c = t.newConn(id, e); c == nil {
+				return
+			}
+		}
+		c.lastSeen = time.Now()
+
+		if len(e.data) == 0 {
+			return
+		}
+
+		isIncoming := (e.kind() == uprobeRead) == c.isServer
+
+		// Chunks of the call follow each other, and sequence numbers of all of them are reserved by the first one
+		var seq uint32
+		if isIncoming {
+			if e.offset == 0 {
+				c.clientCall = c.clientSeq
+				c.clientSeq += e.total
+			}
+			seq = c.clientCall + e.offset
+		} else {
+			if e.offset == 0 {
+				c.serverCall = c.serverSeq
+				c.serverSeq += e.total
+			}
+			seq = c.serverCall + e.offset
+		}
+
+		t.emit(c, isIncoming, fACK|fPSH, e.data, seq, e.time)
+	}
+}
+
+// newConn starts synthetic connection. Returns nil if connection does not use listened ports.
+func (t *uprobeTracker) newConn(id uprobeConnID, e *uprobeEvent) *uprobeConn {
+	fd, ok := t.fds[id]
+	if !ok {
+		fd = -1
+	}
+
+	c := &uprobeConn{clientSeq: 1, serverSeq: 1}
+
+	var local, remote *net.TCPAddr
+	resolved := false
+	if t.resolve != nil {
+		local, remote, resolved = t.resolve(id.pid, id.conn, e.flags&uprobeGoConn != 0, fd)
+	}
+
+	if resolved {
+		localPort, remotePort := uint16(local.Port), uint16(remote.Port)
+
+		switch {
+		case t.listener.isIncoming(remotePort, localPort):
+			c.isServer = true
+			c.clientAddr, c.clientPort = remote.IP, remotePort
+			c.serverAddr, c.serverPort = local.IP, localPort
+		case t.listener.isIncoming(localPort, remotePort):
+			c.clientAddr, c.clientPort = local.IP, localPort
+			c.serverAddr, c.serverPort = remote.IP, remotePort
+		default:
+			return nil
+		}
+	} else {
+		// Process is assumed to be server
+		c.isServer = true
+		c.clientAddr, c.serverAddr = uprobeSyntheticAddr, uprobeSyntheticAddr
+		c.serverPort = uprobeServerPort
+		if !t.listener.anyPort {
+			c.serverPort = t.listener.ports[0].from
+		}
+
+		if t.lastClientPort++; t.lastClientPort <= c.serverPort {
+			t.lastClientPort = c.serverPort + 1
+		}
+		c.clientPort = t.lastClientPort
+	}
+
+	if ip4 := c.clientAddr.To4(); ip4 != nil {
+		c.clientAddr = ip4
+	}
+	if ip4 := c.serverAddr.To4(); ip4 != nil {
+		c.serverAddr = ip4
+	}
+
+	t.conns[id] = c
+
+	t.emit(c, true, fSYN, nil, 0, e.time)
+	t.emit(c, false, fSYN|fACK, nil, 0, e.time)
+
+	return c
+}
+
+// emit sends segment of the connection. Ack is the next sequence number of other side.
+func (t *uprobeTracker) emit(c *uprobeConn, isIncoming bool, flags uint16, data []byte, seq uint32, eventTime uint64) {
+	packet := &TCPPacket{Flags: flags, Seq: seq, Data: data, Timestamp: time.Unix(0, int64(eventTime)+t.clockOffset)}
+
+	if isIncoming {
+		packet.Addr, packet.DstAddr = c.clientAddr, c.serverAddr
+		packet.SrcPort, packet.DestPort = c.clientPort, c.serverPort
+		packet.Ack = c.serverSeq
+	} else {
+		packet.Addr, packet.DstAddr = c.serverAddr, c.clientAddr
+		packet.SrcPort, packet.DestPort = c.serverPort, c.clientPort
+		packet.Ack = c.clientSeq
+	}
+
+	t.listener.sendPacket(newPacketBuffer(packet.Dump()))
+}
+
+// expire forgets connections without events, like ones of killed processes
+func (t *uprobeTracker) expire(now time.Time) {
+	for id, c := range t.conns {
+		if now.Sub(c.lastSeen) > uprobeConnTimeout {
+			delete(t.conns, id)
+			delete(t.fds, id)
+		}
+	}
+}
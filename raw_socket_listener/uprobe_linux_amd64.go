@@ -0,0 +1,848 @@
+package rawSocket
+
+import (
+	"bufio"
+	"debug/elf"
+	"debug/gosym"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/arch/x86/x86asm"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Default size of perf buffer of each CPU
+const defaultUprobeBufferSize = 1 << 20
+
+// Data of read or write call is sent in chunks, calls larger than uprobeChunkSize*uprobeMaxChunks are truncated
+const (
+	uprobeChunkSize = 16 * 1024
+	uprobeMaxChunks = 8
+)
+
+// Maximum number of calls in progress, which arguments are kept until function returns
+const uprobeMaxCalls = 10240
+
+// Offsets of registers in struct pt_regs passed to uprobe programs
+const (
+	ptRegsR14 = 8
+	ptRegsRBX = 40
+	ptRegsRAX = 80
+	ptRegsRCX = 88
+	ptRegsRSI = 104
+	ptRegsRDI = 112
+)
+
+// Stack of uprobe programs: key of arguments map (call id and pid), arguments (connection, buffer, size pointer),
+// key of scratch map, and size read from pointer
+const (
+	uprobeStackCallID  = -16
+	uprobeStackPID     = -8
+	uprobeStackArgs    = -40
+	uprobeStackSizePtr = -24
+	uprobeStackScratch = -48
+	uprobeStackSize    = -56
+)
+
+// Libraries uprobes are attached to, if ListenerConfig.UprobeBinaries is empty
+var defaultUprobeBinaries = []string{
+	"/lib/x86_64-linux-gnu/libssl.so.*",
+	"/usr/lib/x86_64-linux-gnu/libssl.so.*",
+	"/lib64/libssl.so.*",
+	"/usr/lib64/libssl.so.*",
+	"/usr/lib/libssl.so.*",
+}
+
+// Go crypto/tls functions. Uprobes are attached to returns of Read, since return probes break Go stack.
+const (
+	goTLSRead  = "crypto/tls.(*Conn).Read"
+	goTLSWrite = "crypto/tls.(*Conn).Write"
+	goTLSClose = "crypto/tls.(*Conn).Close"
+)
+
+// uprobeCapture holds BPF objects of uprobe engine
+type uprobeCapture struct {
+	events, args, scratch int
+
+	// Loaded programs by name, and attached uprobes
+	programs map[string]int
+	probes   []int
+
+	rings []*perfRing
+	epoll int
+
+	// Helper used to read process memory, bpf_probe_read on old kernels
+	probeRead int32
+
+	// Number of events lost because perf buffers were full
+	lost uint64
+}
+
+// dropped returns number of events lost because perf buffers were full
+func (c *uprobeCapture) dropped() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&c.lost)
+}
+
+func (c *uprobeCapture) close() {
+	for _, fd := range c.probes {
+		syscall.Close(fd)
+	}
+
+	for _, fd := range c.programs {
+		syscall.Close(fd)
+	}
+
+	for _, r := range c.rings {
+		r.close()
+	}
+
+	for _, fd := range []int{c.events, c.args, c.scratch, c.epoll} {
+		if fd > 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// readUprobe attaches uprobes to TLS functions of ListenerConfig.UprobeBinaries, or of system OpenSSL library
+func (t *Listener) readUprobe() error {
+	binaries, err := uprobeBinaries(t.config.UprobeBinaries)
+	if err != nil {
+		return err
+	}
+
+	c, err := newUprobeCapture(t.config.BufferSize)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range binaries {
+		if err = c.attach(path); err != nil {
+			c.close()
+			return err
+		}
+	}
+
+	tracker := newUprobeTracker(t)
+	tracker.resolve = uprobeSocketAddrs
+	tracker.clockOffset = time.Now().UnixNano() - int64(monotonicTime())
+	// Processes are known before the first events are read, so events of other processes don't slip through
+	t.refreshUprobePIDs(tracker)
+
+	t.mu.Lock()
+	t.uprobes = c
+	t.mu.Unlock()
+
+	go t.readUprobeEvents(c, tracker)
+
+	t.readyCh <- true
+
+	return nil
+}
+
+// uprobeBinaries expands glob patterns, and removes duplicate paths of the same file
+func uprobeBinaries(patterns []string) (binaries []string, err error) {
+	if len(patterns) == 0 {
+		patterns = defaultUprobeBinaries
+	}
+
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			if path, err = filepath.EvalSymlinks(path); err == nil && !seen[path] {
+				seen[path] = true
+				binaries = append(binaries, path)
+			}
+		}
+	}
+
+	if len(binaries) == 0 {
+		return nil, fmt.Errorf("No binaries found to attach uprobes: %s", strings.Join(patterns, ", "))
+	}
+
+	return
+}
+
+func newUprobeCapture(bufferSize int) (c *uprobeCapture, err error) {
+	c = &uprobeCapture{programs: make(map[string]int), probeRead: bpfFuncProbeReadUser}
+
+	defer func() {
+		if err != nil {
+			c.close()
+		}
+	}()
+
+	cpus, err := possibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.events, err = bpfCreateMap(bpfMapTypePerfEventArray, 4, 4, uint32(cpus[len(cpus)-1]+1)); err != nil {
+		return nil, err
+	}
+	if c.args, err = bpfCreateMap(bpfMapTypeHash, 16, 24, uprobeMaxCalls); err != nil {
+		return nil, err
+	}
+	if c.scratch, err = bpfCreateMap(bpfMapTypePerCPUArray, 4, uprobeEventHeaderSize+uprobeChunkSize, 1); err != nil {
+		return nil, err
+	}
+
+	if bufferSize == 0 {
+		bufferSize = defaultUprobeBufferSize
+	}
+	// Number of pages should be power of two
+	pages := 1
+	for pages*2*syscall.Getpagesize() <= bufferSize {
+		pages *= 2
+	}
+
+	if c.epoll, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, err
+	}
+
+	for _, cpu := range cpus {
+		ring, err := openPerfRing(cpu, pages)
+		if err != nil {
+			return nil, fmt.Errorf("Can't open perf buffer: %v", err)
+		}
+		c.rings = append(c.rings, ring)
+
+		key, fd := uint32(cpu), uint32(ring.fd)
+		if err = bpfUpdateMap(c.events, unsafe.Pointer(&key), unsafe.Pointer(&fd)); err != nil {
+			return nil, fmt.Errorf("Can't set perf buffer: %v", err)
+		}
+
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(ring.fd)}
+		if err = syscall.EpollCtl(c.epoll, syscall.EPOLL_CTL_ADD, ring.fd, &event); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// attach attaches uprobes to OpenSSL or Go crypto/tls functions of the binary
+func (c *uprobeCapture) attach(path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	symbols := make(map[string]elf.Symbol)
+	// Shared libraries export functions as dynamic symbols, executables may have only static ones
+	for _, read := range []func() ([]elf.Symbol, error){f.DynamicSymbols, f.Symbols} {
+		list, _ := read()
+		for _, s := range list {
+			if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value != 0 {
+				symbols[s.Name] = s
+			}
+		}
+	}
+
+	// Go executables are often built without symbol table, but functions can be found in pclntab
+	if _, ok := symbols[goTLSRead]; !ok {
+		goFunctions(f, symbols)
+	}
+
+	type probe struct {
+		symbol, program string
+		isReturn        bool
+	}
+	var probes []probe
+
+	if _, ok := symbols["SSL_read"]; ok {
+		probes = []probe{
+			{"SSL_read", "store", false}, {"SSL_read", "ssl_read", true},
+			{"SSL_write", "store", false}, {"SSL_write", "ssl_write", true},
+			{"SSL_read_ex", "store_ex", false}, {"SSL_read_ex", "ssl_read_ex", true},
+			{"SSL_write_ex", "store_ex", false}, {"SSL_write_ex", "ssl_write_ex", true},
+			{"SSL_set_fd", "ssl_set_fd", false},
+			{"SSL_free", "ssl_free", false},
+		}
+	} else if _, ok := symbols[goTLSRead]; ok {
+		probes = []probe{
+			{goTLSRead, "go_store", false},
+			{goTLSWrite, "go_write", false},
+			{goTLSClose, "go_close", false},
+		}
+	} else {
+		return fmt.Errorf("No OpenSSL or Go crypto/tls functions found in %s", path)
+	}
+
+	for _, p := range probes {
+		s, ok := symbols[p.symbol]
+		// Functions of newer OpenSSL versions
+		if !ok {
+			continue
+		}
+
+		offset, err := elfFileOffset(f, s.Value)
+		if err != nil {
+			return fmt.Errorf("Can't find %s in %s: %v", p.symbol, path, err)
+		}
+
+		if p.program == "go_store" {
+			// Read data is sent by probes at returns of the function
+			returns, err := elfReturnOffsets(f, s, offset)
+			if err != nil {
+				return fmt.Errorf("Can't find returns of %s in %s: %v", p.symbol, path, err)
+			}
+
+			for _, ret := range returns {
+				if err = c.attachProbe(path, ret, false, "go_read"); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err = c.attachProbe(path, offset, p.isReturn, p.program); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *uprobeCapture) attachProbe(path string, offset uint64, isReturn bool, name string) error {
+	prog, err := c.program(name)
+	if err != nil {
+		return err
+	}
+
+	fd, err := attachUprobe(path, offset, isReturn, prog)
+	if err != nil {
+		return err
+	}
+	c.probes = append(c.probes, fd)
+
+	return nil
+}
+
+// program returns loaded program, and loads it on first use
+func (c *uprobeCapture) program(name string) (int, error) {
+	if fd, ok := c.programs[name]; ok {
+		return fd, nil
+	}
+
+	fd, err := c.loadProgram(name)
+	// bpf_probe_read_user was added in Linux 5.5
+	if err != nil && c.probeRead == bpfFuncProbeReadUser {
+		c.probeRead = bpfFuncProbeRead
+		fd, err = c.loadProgram(name)
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	c.programs[name] = fd
+
+	return fd, nil
+}
+
+func (c *uprobeCapture) loadProgram(name string) (int, error) {
+	a := newBPFAsm()
+	// Context is kept in R6, since R1-R5 are overwritten by helpers
+	a.mov(bpfR6, bpfR1)
+
+	switch name {
+	case "store":
+		c.storeArgs(a, false, ptRegsRDI, ptRegsRSI, -1)
+	case "store_ex":
+		c.storeArgs(a, false, ptRegsRDI, ptRegsRSI, ptRegsRCX)
+	case "go_store":
+		c.storeArgs(a, true, ptRegsRAX, ptRegsRBX, -1)
+	case "ssl_read":
+		c.sendReturned(a, uprobeRead, false, false)
+	case "ssl_write":
+		c.sendReturned(a, uprobeWrite, false, false)
+	case "ssl_read_ex":
+		c.sendReturned(a, uprobeRead, false, true)
+	case "ssl_write_ex":
+		c.sendReturned(a, uprobeWrite, false, true)
+	case "go_read":
+		c.sendReturned(a, uprobeRead, true, false)
+	case "go_write":
+		c.sendGoWrite(a)
+	case "ssl_set_fd":
+		c.sendControl(a, uprobeSetFD, ptRegsRDI, ptRegsRSI)
+	case "ssl_free":
+		c.sendControl(a, uprobeClose, ptRegsRDI, -1)
+	case "go_close":
+		c.sendControl(a, uprobeClose|uprobeGoConn, ptRegsRAX, -1)
+	default:
+		return -1, fmt.Errorf("Unknown uprobe program: %s", name)
+	}
+
+	a.label("exit")
+	a.movImm(bpfR0, 0)
+	a.exit()
+
+	insns, err := a.assemble()
+	if err != nil {
+		return -1, err
+	}
+
+	return bpfLoadProgram(insns)
+}
+
+// storeCallKey stores key of the call arguments: thread id for C functions, and goroutine for Go,
+// since goroutine can move between threads during the call
+func (c *uprobeCapture) storeCallKey(a *bpfAsm, isGo bool) {
+	a.call(bpfFuncGetCurrentPIDTID)
+	if isGo {
+		// Go keeps current goroutine in R14
+		a.load(bpfDW, bpfR1, bpfR6, ptRegsR14)
+		a.store(bpfDW, bpfFP, uprobeStackCallID, bpfR1)
+	} else {
+		a.store(bpfDW, bpfFP, uprobeStackCallID, bpfR0)
+	}
+
+	a.aluImm(bpfRsh, bpfR0, 32)
+	a.store(bpfDW, bpfFP, uprobeStackPID, bpfR0)
+}
+
+// storeArgs keeps arguments of the call until function returns, sizeReg is -1 if there is no size pointer argument
+func (c *uprobeCapture) storeArgs(a *bpfAsm, isGo bool, connReg, bufReg, sizeReg int16) {
+	c.storeCallKey(a, isGo)
+
+	a.load(bpfDW, bpfR1, bpfR6, connReg)
+	a.store(bpfDW, bpfFP, uprobeStackArgs, bpfR1)
+	a.load(bpfDW, bpfR1, bpfR6, bufReg)
+	a.store(bpfDW, bpfFP, uprobeStackArgs+8, bpfR1)
+	if sizeReg != -1 {
+		a.load(bpfDW, bpfR1, bpfR6, sizeReg)
+		a.store(bpfDW, bpfFP, uprobeStackSizePtr, bpfR1)
+	} else {
+		a.storeImm(bpfDW, bpfFP, uprobeStackSizePtr, 0)
+	}
+
+	a.loadMap(bpfR1, c.args)
+	a.mov(bpfR2, bpfFP)
+	a.aluImm(bpfAdd, bpfR2, uprobeStackCallID)
+	a.mov(bpfR3, bpfFP)
+	a.aluImm(bpfAdd, bpfR3, uprobeStackArgs)
+	a.movImm(bpfR4, 0)
+	a.call(bpfFuncMapUpdateElem)
+}
+
+// sendReturned sends data of returned call, which arguments were stored on entry.
+// Number of bytes is returned value, or is written to size pointer by _ex OpenSSL functions.
+func (c *uprobeCapture) sendReturned(a *bpfAsm, kind uint32, isGo, isEx bool) {
+	c.storeCallKey(a, isGo)
+	c.lookupScratch(a)
+
+	a.loadMap(bpfR1, c.args)
+	a.mov(bpfR2, bpfFP)
+	a.aluImm(bpfAdd, bpfR2, uprobeStackCallID)
+	a.call(bpfFuncMapLookupElem)
+	a.jumpImm(bpfJEq, bpfR0, 0, "exit")
+
+	// Arguments are copied, since element is deleted
+	a.load(bpfDW, bpfR1, bpfR0, 0)
+	a.store(bpfDW, bpfR9, 8, bpfR1)
+	a.load(bpfDW, bpfR7, bpfR0, 8)
+	a.load(bpfDW, bpfR1, bpfR0, 16)
+	a.store(bpfDW, bpfFP, uprobeStackSizePtr, bpfR1)
+
+	a.loadMap(bpfR1, c.args)
+	a.mov(bpfR2, bpfFP)
+	a.aluImm(bpfAdd, bpfR2, uprobeStackCallID)
+	a.call(bpfFuncMapDeleteElem)
+
+	switch {
+	case isGo:
+		a.load(bpfDW, bpfR8, bpfR6, ptRegsRAX)
+	case isEx:
+		// Returns 1 on success
+		a.load(bpfDW, bpfR1, bpfR6, ptRegsRAX)
+		a.aluImm(bpfLsh, bpfR1, 32)
+		a.aluImm(bpfArsh, bpfR1, 32)
+		a.jumpImm(bpfJNE, bpfR1, 1, "exit")
+
+		a.mov(bpfR1, bpfFP)
+		a.aluImm(bpfAdd, bpfR1, uprobeStackSize)
+		a.movImm(bpfR2, 8)
+		a.load(bpfDW, bpfR3, bpfFP, uprobeStackSizePtr)
+		a.call(c.probeRead)
+		a.jumpImm(bpfJNE, bpfR0, 0, "exit")
+		a.load(bpfDW, bpfR8, bpfFP, uprobeStackSize)
+	default:
+		// Returned int is sign extended
+		a.load(bpfDW, bpfR8, bpfR6, ptRegsRAX)
+		a.aluImm(bpfLsh, bpfR8, 32)
+		a.aluImm(bpfArsh, bpfR8, 32)
+	}
+
+	c.sendData(a, kind)
+}
+
+// sendGoWrite sends data passed to Write, which writes all of it unless connection fails
+func (c *uprobeCapture) sendGoWrite(a *bpfAsm) {
+	c.storeCallKey(a, true)
+	c.lookupScratch(a)
+
+	// Go passes receiver and slice pointer and length in RAX, RBX and RCX
+	a.load(bpfDW, bpfR1, bpfR6, ptRegsRAX)
+	a.store(bpfDW, bpfR9, 8, bpfR1)
+	a.load(bpfDW, bpfR7, bpfR6, ptRegsRBX)
+	a.load(bpfDW, bpfR8, bpfR6, ptRegsRCX)
+
+	c.sendData(a, uprobeWrite|uprobeGoConn)
+}
+
+// sendControl sends event without data, value of valueReg is sent as total
+func (c *uprobeCapture) sendControl(a *bpfAsm, kind uint32, connReg, valueReg int16) {
+	c.storeCallKey(a, false)
+	c.lookupScratch(a)
+
+	a.load(bpfDW, bpfR1, bpfR6, connReg)
+	a.store(bpfDW, bpfR9, 8, bpfR1)
+	if valueReg != -1 {
+		a.load(bpfDW, bpfR8, bpfR6, valueReg)
+	} else {
+		a.movImm(bpfR8, 0)
+	}
+
+	c.fillHeader(a, kind)
+	a.storeImm(bpfW, bpfR9, 24, 0)
+	a.storeImm(bpfW, bpfR9, 28, 0)
+
+	a.mov(bpfR1, bpfR6)
+	a.loadMap(bpfR2, c.events)
+	a.movImm32(bpfR3, -1)
+	a.mov(bpfR4, bpfR9)
+	a.movImm(bpfR5, uprobeEventHeaderSize)
+	a.call(bpfFuncPerfEventOutput)
+}
+
+// lookupScratch sets R9 to event buffer
+func (c *uprobeCapture) lookupScratch(a *bpfAsm) {
+	a.storeImm(bpfW, bpfFP, uprobeStackScratch, 0)
+	a.loadMap(bpfR1, c.scratch)
+	a.mov(bpfR2, bpfFP)
+	a.aluImm(bpfAdd, bpfR2, uprobeStackScratch)
+	a.call(bpfFuncMapLookupElem)
+	a.jumpImm(bpfJEq, bpfR0, 0, "exit")
+	a.mov(bpfR9, bpfR0)
+}
+
+// fillHeader sets pid, flags, time and total size (R8) of event in R9. Connection is set by caller.
+func (c *uprobeCapture) fillHeader(a *bpfAsm, flags uint32) {
+	a.load(bpfDW, bpfR1, bpfFP, uprobeStackPID)
+	a.store(bpfW, bpfR9, 0, bpfR1)
+	a.storeImm(bpfW, bpfR9, 4, int32(flags))
+	a.call(bpfFuncKtimeGetNS)
+	a.store(bpfDW, bpfR9, 16, bpfR0)
+	a.store(bpfW, bpfR9, 32, bpfR8)
+}
+
+// sendData sends R8 bytes of buffer R7 in chunks, if R8 is positive
+func (c *uprobeCapture) sendData(a *bpfAsm, flags uint32) {
+	a.jumpImm(bpfJSLE, bpfR8, 0, "exit")
+	c.fillHeader(a, flags)
+
+	// Verifier requires sizes to be bounded, so chunks are unrolled
+	for i := 0; i < uprobeMaxChunks; i++ {
+		offset := int32(i * uprobeChunkSize)
+		label := "chunk" + strconv.Itoa(i)
+
+		a.jumpImm(bpfJLE, bpfR8, offset, "exit")
+
+		a.mov(bpfR2, bpfR8)
+		a.aluImm(bpfSub, bpfR2, offset)
+		a.jumpImm(bpfJLE, bpfR2, uprobeChunkSize, label+"_read")
+		a.movImm(bpfR2, uprobeChunkSize)
+		a.label(label + "_read")
+
+		a.store(bpfW, bpfR9, 24, bpfR2)
+		a.storeImm(bpfW, bpfR9, 28, offset)
+
+		a.mov(bpfR1, bpfR9)
+		a.aluImm(bpfAdd, bpfR1, uprobeEventHeaderSize)
+		a.mov(bpfR3, bpfR7)
+		a.aluImm(bpfAdd, bpfR3, offset)
+		a.call(c.probeRead)
+
+		a.mov(bpfR5, bpfR8)
+		a.aluImm(bpfSub, bpfR5, offset)
+		a.jumpImm(bpfJLE, bpfR5, uprobeChunkSize, label+"_send")
+		a.movImm(bpfR5, uprobeChunkSize)
+		a.label(label + "_send")
+		a.aluImm(bpfAdd, bpfR5, uprobeEventHeaderSize)
+
+		a.mov(bpfR1, bpfR6)
+		a.loadMap(bpfR2, c.events)
+		// BPF_F_CURRENT_CPU
+		a.movImm32(bpfR3, -1)
+		a.mov(bpfR4, bpfR9)
+		a.call(bpfFuncPerfEventOutput)
+	}
+}
+
+// goFunctions adds crypto/tls functions found in Go pclntab to symbols
+func goFunctions(f *elf.File, symbols map[string]elf.Symbol) {
+	pclntab, text := f.Section(".gopclntab"), f.Section(".text")
+	if pclntab == nil || text == nil {
+		return
+	}
+
+	data, err := pclntab.Data()
+	if err != nil {
+		return
+	}
+
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+	if err != nil {
+		return
+	}
+
+	for _, fn := range table.Funcs {
+		if strings.HasPrefix(fn.Name, "crypto/tls.") {
+			symbols[fn.Name] = elf.Symbol{Name: fn.Name, Info: byte(elf.STT_FUNC), Value: fn.Entry, Size: fn.End - fn.Entry}
+		}
+	}
+}
+
+// elfFileOffset converts virtual address of the function to offset in file, which is used by uprobes
+func elfFileOffset(f *elf.File, addr uint64) (uint64, error) {
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Flags&elf.PF_X != 0 && addr >= p.Vaddr && addr < p.Vaddr+p.Memsz {
+			return addr - p.Vaddr + p.Off, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Address %#x is not in executable segment", addr)
+}
+
+// elfReturnOffsets disassembles the function, and returns file offsets of its RET instructions
+func elfReturnOffsets(f *elf.File, s elf.Symbol, offset uint64) (offsets []uint64, err error) {
+	text := f.Section(".text")
+	if text == nil || s.Value < text.Addr || s.Value+s.Size > text.Addr+text.Size {
+		return nil, fmt.Errorf("Function is not in .text section")
+	}
+
+	code := make([]byte, s.Size)
+	if _, err = text.ReadAt(code, int64(s.Value-text.Addr)); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(code); {
+		inst, err := x86asm.Decode(code[i:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode instruction at %#x: %v", offset+uint64(i), err)
+		}
+
+		if inst.Op == x86asm.RET {
+			offsets = append(offsets, offset+uint64(i))
+		}
+		i += inst.Len
+	}
+
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("No returns found")
+	}
+
+	return
+}
+
+// readUprobeEvents reads perf buffers until listener is stopped. Events of all CPUs are ordered by time,
+// so request read by one thread is processed before response written by another.
+func (t *Listener) readUprobeEvents(c *uprobeCapture, tracker *uprobeTracker) {
+	defer func() {
+		t.mu.Lock()
+		t.uprobes = nil
+		t.mu.Unlock()
+
+		c.close()
+	}()
+
+	epollEvents := make([]syscall.EpollEvent, len(c.rings))
+	var events []uprobeEvent
+	lastExpire := time.Now()
+
+	for t.ctx.Err() == nil {
+		if _, err := syscall.EpollWait(c.epoll, epollEvents, 100); err != nil && err != syscall.EINTR {
+			log.Println("Uprobe capture stopped:", err)
+			return
+		}
+
+		events = events[:0]
+		for _, ring := range c.rings {
+			lost := ring.read(func(sample []byte) {
+				if e, ok := parseUprobeEvent(sample); ok {
+					e.data = append([]byte{}, e.data...)
+					events = append(events, e)
+				}
+			})
+			atomic.AddUint64(&c.lost, lost)
+		}
+
+		sort.SliceStable(events, func(i, j int) bool { return events[i].time < events[j].time })
+
+		for i := range events {
+			tracker.process(&events[i])
+		}
+
+		if now := time.Now(); now.Sub(lastExpire) > processRefreshInterval {
+			lastExpire = now
+			tracker.expire(now)
+			t.refreshUprobePIDs(tracker)
+		}
+	}
+}
+
+// refreshUprobePIDs limits events to processes of ListenerConfig.PID or ListenerConfig.Cgroup
+func (t *Listener) refreshUprobePIDs(tracker *uprobeTracker) {
+	if t.config.PID == 0 && t.config.Cgroup == "" {
+		return
+	}
+
+	pids, err := t.processPIDs()
+	if err != nil {
+		// Keep previous state if cgroup is temporary unavailable
+		log.Println("Can't read processes of cgroup:", err)
+		return
+	}
+
+	tracker.pids = make(map[uint32]bool)
+	for _, pid := range pids {
+		tracker.pids[uint32(pid)] = true
+	}
+}
+
+// monotonicTime returns CLOCK_MONOTONIC time in nanoseconds, used by bpf_ktime_get_ns
+func monotonicTime() uint64 {
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, 1, uintptr(unsafe.Pointer(&ts)), 0)
+
+	return uint64(ts.Nano())
+}
+
+// uprobeSocketAddrs finds addresses of the connection socket in /proc. Socket of Go connection is read from process memory.
+func uprobeSocketAddrs(pid uint32, conn uint64, isGo bool, fd int) (local, remote *net.TCPAddr, ok bool) {
+	if isGo {
+		fd = goConnFD(pid, conn)
+	}
+
+	if fd < 0 {
+		return nil, nil, false
+	}
+
+	// Link looks like "socket:[12345]"
+	link, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(int(pid)), "fd", strconv.Itoa(fd)))
+	if err != nil || !strings.HasPrefix(link, "socket:[") {
+		return nil, nil, false
+	}
+	inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+
+	for _, table := range []string{"tcp", "tcp6"} {
+		path := filepath.Join(procRoot, strconv.Itoa(int(pid)), "net", table)
+		if local, remote, ok = procNetSocket(path, inode); ok {
+			return
+		}
+	}
+
+	return nil, nil, false
+}
+
+// procNetSocket reads addresses of socket with given inode from /proc/net/tcp-like table
+func procNetSocket(path, inode string) (local, remote *net.TCPAddr, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] != inode {
+			continue
+		}
+
+		local, lok := parseProcNetAddr(fields[1])
+		remote, rok := parseProcNetAddr(fields[2])
+
+		return local, remote, lok && rok
+	}
+
+	return nil, nil, false
+}
+
+// parseProcNetAddr parses address like "0100007F:1F90". IP is written as 32 bit words in host byte order.
+func parseProcNetAddr(s string) (*net.TCPAddr, bool) {
+	i := strings.IndexByte(s, ':')
+	if i == -1 {
+		return nil, false
+	}
+
+	ip, err := hex.DecodeString(s[:i])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil, false
+	}
+
+	for w := 0; w < len(ip); w += 4 {
+		binary.BigEndian.PutUint32(ip[w:], binary.LittleEndian.Uint32(ip[w:]))
+	}
+
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, false
+	}
+
+	return &net.TCPAddr{IP: net.IP(ip), Port: int(port)}, true
+}
+
+// goConnFD reads socket of *tls.Conn from process memory: tls.Conn starts with net.Conn interface,
+// which value is *net.TCPConn pointing to *netFD, which starts with poll.FD holding socket after its mutex.
+func goConnFD(pid uint32, conn uint64) int {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(int(pid)), "mem"))
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	word := func(addr uint64) uint64 {
+		buf := make([]byte, 8)
+		if _, err := f.ReadAt(buf, int64(addr)); err != nil {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(buf)
+	}
+
+	tcpConn := word(conn + 8)
+	if tcpConn == 0 {
+		return -1
+	}
+
+	netFD := word(tcpConn)
+	if netFD == 0 {
+		return -1
+	}
+
+	return int(int64(word(netFD + 16)))
+}
@@ -0,0 +1,204 @@
+package rawSocket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"github.com/buger/gor/proto"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uprobeServerEnv makes TestUprobeHelperServer run TLS server, in process which traffic is captured
+const uprobeServerEnv = "GOR_UPROBE_TEST_SERVER"
+
+func TestUprobeHelperServer(t *testing.T) {
+	if os.Getenv(uprobeServerEnv) == "" {
+		return
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "pong" + r.URL.Path
+		// Written in multiple chunks
+		if r.URL.Path == "/large" {
+			body += strings.Repeat(".", 3*uprobeChunkSize)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	fmt.Println(server.Listener.Addr().String())
+
+	// Serve until test closes stdin
+	ioutil.ReadAll(os.Stdin)
+}
+
+// startUprobeServer runs server command, and returns port it prints, and function stopping it
+func startUprobeServer(t *testing.T, cmd *exec.Cmd) (port string, stop func()) {
+	stdout, _ := cmd.StdoutPipe()
+	stdin, _ := cmd.StdinPipe()
+
+	if err := cmd.Start(); err != nil {
+		t.Skip("Can't start server:", err)
+	}
+
+	stop = func() {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	if !scanner.Scan() {
+		stop()
+		t.Fatal("Server should print its address")
+	}
+
+	port = scanner.Text()
+	if _, p, err := net.SplitHostPort(port); err == nil {
+		port = p
+	}
+
+	return
+}
+
+// uprobeExchanges sends requests to the server, and returns server addresses of captured requests by response bodies
+func uprobeExchanges(t *testing.T, listener *Listener, port string, paths ...string) map[string]string {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	for _, path := range paths {
+		resp, err := client.Get("https://127.0.0.1:" + port + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	requests := make(map[string]string)
+	responses := make(map[string]string)
+
+	// Wait until all responses are captured, with their requests
+	timeout := time.After(2 * time.Second)
+	for len(responses) < len(paths) || len(requests) < len(paths) {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				requests[string(m.UUID())] = m.Dst().String()
+			} else {
+				responses[string(m.UUID())] = string(proto.Body(m.Bytes()))
+			}
+		case <-timeout:
+			t.Fatalf("Should capture messages: %d requests, %d responses", len(requests), len(responses))
+		}
+	}
+
+	exchanges := make(map[string]string)
+	for uuid, body := range responses {
+		exchanges[body] = requests[uuid]
+	}
+
+	return exchanges
+}
+
+func TestUprobeGoTLS(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(exe, "-test.run=^TestUprobeHelperServer$")
+	cmd.Env = append(os.Environ(), uprobeServerEnv+"=1")
+	port, stop := startUprobeServer(t, cmd)
+	defer stop()
+
+	// Client of the test process uses same binary, and is filtered out
+	listener, err := NewListener("", port, EngineUprobe, true, time.Minute, &ListenerConfig{UprobeBinaries: []string{exe}, PID: cmd.Process.Pid})
+	if err != nil {
+		t.Skip("Can't attach uprobes:", err)
+	}
+	defer listener.Close()
+
+	exchanges := uprobeExchanges(t, listener, port, "/1", "/large")
+	if exchanges["pong/1"] != "127.0.0.1:"+port {
+		t.Errorf("Should capture plaintext of Go TLS server, using socket addresses: %q", exchanges)
+	}
+
+	if exchanges["pong/large"+strings.Repeat(".", 3*uprobeChunkSize)] == "" {
+		t.Error("Should capture large response")
+	}
+}
+
+func TestUprobeOpenSSL(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("Python is required to run OpenSSL server")
+	}
+
+	dir, _ := ioutil.TempDir("", "gor-uprobe")
+	defer os.RemoveAll(dir)
+
+	cert := tlsTestKey(t, dir, "server.key")
+	ioutil.WriteFile(filepath.Join(dir, "server.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+
+	cmd := exec.Command(python, "-c", `
+import socket, ssl, sys
+ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+# Test key is small
+ctx.set_ciphers("DEFAULT:@SECLEVEL=0")
+ctx.load_cert_chain(sys.argv[1], sys.argv[2])
+s = socket.socket()
+s.bind(("127.0.0.1", 0))
+s.listen()
+print(s.getsockname()[1], flush=True)
+while True:
+    c = ctx.wrap_socket(s.accept()[0], server_side=True)
+    data = b""
+    while b"\r\n\r\n" not in data:
+        data += c.recv(4096)
+    body = b"pong" + data.split(b" ")[1]
+    c.sendall(b"HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s" % (len(body), body))
+    c.close()
+`, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	port, stop := startUprobeServer(t, cmd)
+	defer stop()
+
+	listener, err := NewListener("", port, EngineUprobe, true, time.Minute, &ListenerConfig{PID: cmd.Process.Pid})
+	if err != nil {
+		t.Skip("Can't attach uprobes:", err)
+	}
+	defer listener.Close()
+
+	exchanges := uprobeExchanges(t, listener, port, "/1", "/2")
+	if exchanges["pong/1"] != "127.0.0.1:"+port || exchanges["pong/2"] != "127.0.0.1:"+port {
+		t.Errorf("Should capture plaintext of OpenSSL server, using socket addresses: %q", exchanges)
+	}
+}
+
+func TestParseProcNetAddr(t *testing.T) {
+	if a, ok := parseProcNetAddr("0100007F:1F90"); !ok || a.String() != "127.0.0.1:8080" {
+		t.Error("Should parse IPv4 address", a)
+	}
+
+	if a, ok := parseProcNetAddr("0000000000000000FFFF00000100007F:01BB"); !ok || a.String() != "127.0.0.1:443" {
+		t.Error("Should parse IPv4 mapped IPv6 address", a)
+	}
+
+	if a, ok := parseProcNetAddr("B80D01200000000000000000010000000:0050"); ok {
+		t.Error("Should fail on malformed address", a)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+package rawSocket
+
+import (
+	"fmt"
+)
+
+// uprobeCapture is never created, uprobes are supported only on Linux amd64
+type uprobeCapture struct{}
+
+func (c *uprobeCapture) dropped() uint64 {
+	return 0
+}
+
+func (t *Listener) readUprobe() error {
+	return fmt.Errorf("Uprobe engine is supported only on Linux amd64")
+}
@@ -0,0 +1,135 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func uprobeTestEvent(kind uint32, conn uint64, offset, total uint32, data string) *uprobeEvent {
+	return &uprobeEvent{pid: 1, flags: kind, conn: conn, time: uint64(time.Now().UnixNano()), offset: offset, total: total, data: []byte(data)}
+}
+
+func TestParseUprobeEvent(t *testing.T) {
+	data := make([]byte, uprobeEventHeaderSize+8)
+	binary.LittleEndian.PutUint32(data[0:], 10)
+	binary.LittleEndian.PutUint32(data[4:], uprobeWrite|uprobeGoConn)
+	binary.LittleEndian.PutUint64(data[8:], 0xc000100000)
+	binary.LittleEndian.PutUint32(data[24:], 3)
+	binary.LittleEndian.PutUint32(data[28:], 16384)
+	binary.LittleEndian.PutUint32(data[32:], 16387)
+	copy(data[uprobeEventHeaderSize:], "abc")
+
+	// Perf samples are padded
+	e, ok := parseUprobeEvent(data)
+	if !ok || e.pid != 10 || e.kind() != uprobeWrite || e.flags&uprobeGoConn == 0 || e.conn != 0xc000100000 ||
+		e.offset != 16384 || e.total != 16387 || string(e.data) != "abc" {
+		t.Errorf("Should parse event: %+v", e)
+	}
+
+	binary.LittleEndian.PutUint32(data[24:], 9)
+	if _, ok := parseUprobeEvent(data); ok {
+		t.Error("Should fail if size exceeds sample")
+	}
+}
+
+func TestUprobeTrackerSynthetic(t *testing.T) {
+	listener, _ := NewListener("", "8443", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	tracker := newUprobeTracker(listener)
+
+	// Request is read in two calls, response is written in two chunks of single call
+	tracker.process(uprobeTestEvent(uprobeRead, 1, 0, 9, "GET /1 HT"))
+	tracker.process(uprobeTestEvent(uprobeRead, 1, 0, 10, "TP/1.1\r\n\r\n"))
+	tracker.process(uprobeTestEvent(uprobeWrite, 1, 0, 39, "HTTP/1.1 200 OK\r\n"))
+	tracker.process(uprobeTestEvent(uprobeWrite, 1, 17, 39, "Content-Length: 1\r\n\r\na"))
+
+	tracker.process(uprobeTestEvent(uprobeRead, 2, 0, 19, "GET /2 HTTP/1.1\r\n\r\n"))
+	tracker.process(uprobeTestEvent(uprobeWrite, 2, 0, 39, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"))
+
+	exchanges := receiveExchanges(t, listener, 4)
+	if exchanges["/1"] != "a" || exchanges["/2"] != "b" {
+		t.Errorf("Should emit TLS connections as TCP connections: %q", exchanges)
+	}
+
+	if c := tracker.conns[uprobeConnID{1, 1}]; c.serverPort != 8443 || c.clientPort == tracker.conns[uprobeConnID{1, 2}].clientPort {
+		t.Error("Synthetic connections should use listened port, and own client ports", c)
+	}
+
+	tracker.process(uprobeTestEvent(uprobeClose, 1, 0, 0, ""))
+	if len(tracker.conns) != 1 {
+		t.Error("Should forget closed connection")
+	}
+
+	tracker.expire(time.Now().Add(uprobeConnTimeout + time.Second))
+	if len(tracker.conns) != 0 {
+		t.Error("Should forget idle connection")
+	}
+}
+
+func TestUprobeTrackerResolved(t *testing.T) {
+	listener, _ := NewListener("", "443", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	// Connection 1 is accepted by the process, connection 2 is opened by it, connection 3 does not use listened port
+	addrs := map[int][2]*net.TCPAddr{
+		3: {{IP: net.ParseIP("10.0.0.1"), Port: 443}, {IP: net.ParseIP("10.0.0.2"), Port: 50000}},
+		4: {{IP: net.ParseIP("10.0.0.1"), Port: 50001}, {IP: net.ParseIP("10.0.0.3"), Port: 443}},
+		5: {{IP: net.ParseIP("10.0.0.1"), Port: 50002}, {IP: net.ParseIP("10.0.0.3"), Port: 8080}},
+	}
+
+	tracker := newUprobeTracker(listener)
+	tracker.resolve = func(pid uint32, conn uint64, isGo bool, fd int) (local, remote *net.TCPAddr, ok bool) {
+		a, ok := addrs[fd]
+		return a[0], a[1], ok
+	}
+
+	for conn := uint64(1); conn <= 3; conn++ {
+		tracker.process(uprobeTestEvent(uprobeSetFD, conn, 0, uint32(conn+2), ""))
+	}
+
+	tracker.process(uprobeTestEvent(uprobeRead, 1, 0, 19, "GET /1 HTTP/1.1\r\n\r\n"))
+	tracker.process(uprobeTestEvent(uprobeWrite, 1, 0, 39, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na"))
+	tracker.process(uprobeTestEvent(uprobeWrite, 2, 0, 19, "GET /2 HTTP/1.1\r\n\r\n"))
+	tracker.process(uprobeTestEvent(uprobeRead, 2, 0, 39, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"))
+	tracker.process(uprobeTestEvent(uprobeWrite, 3, 0, 19, "GET /3 HTTP/1.1\r\n\r\n"))
+
+	messages := make(map[string]*TCPMessage)
+	for i := 0; i < 4; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				messages[m.Src().String()] = m
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should dispatch messages", i)
+		}
+	}
+
+	if m := messages["10.0.0.2:50000"]; m == nil || m.Dst().String() != "10.0.0.1:443" {
+		t.Error("Should use socket addresses of accepted connection", messages)
+	}
+
+	if m := messages["10.0.0.1:50001"]; m == nil || m.Dst().String() != "10.0.0.3:443" {
+		t.Error("Should capture requests written by client", messages)
+	}
+
+	if _, ok := tracker.conns[uprobeConnID{1, 3}]; ok {
+		t.Error("Should ignore connections of not listened ports")
+	}
+}
+
+func TestUprobeTrackerPIDs(t *testing.T) {
+	listener, _ := NewListener("", "443", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	tracker := newUprobeTracker(listener)
+	tracker.pids = map[uint32]bool{2: true}
+
+	tracker.process(uprobeTestEvent(uprobeRead, 1, 0, 19, "GET /1 HTTP/1.1\r\n\r\n"))
+	if len(tracker.conns) != 0 {
+		t.Error("Should ignore events of other processes")
+	}
+}
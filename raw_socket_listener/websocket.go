@@ -0,0 +1,300 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// WebSocket connection is detected by `101 Switching Protocols` response to the request with `Upgrade: websocket`
+// header, so responses should be tracked. Handshake request and response are emitted as usual HTTP messages, and each
+// frame following them is emitted as separate message, holding unmasked frame payload, see TCPMessage.WebSocket.
+
+// WebSocket frame opcodes, see RFC 6455 section 5.2
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+)
+
+// Maximum size of frame header: 2 bytes, 8 bytes of extended payload length, and 4 bytes of masking key
+const wsMaxHeaderSize = 14
+
+var bSwitchingProtocols = []byte("101")
+
+// WebSocketFrame describes message holding payload of WebSocket frame
+type WebSocketFrame struct {
+	// UUID of the handshake request, shared by all frames of the connection
+	StreamID []byte
+
+	Opcode byte
+
+	// Final fragment of the message, false for frames continued by continuation frames
+	Fin bool
+}
+
+// wsConn holds WebSocket decoding state of single connection
+type wsConn struct {
+	streamID       []byte
+	client, server wsDirection
+
+	// Number of frames, it keeps UUIDs of frames sent in the same segment distinct
+	frames uint32
+
+	// Decoding failed, like because of missing segment, and frame boundaries are lost
+	broken bool
+}
+
+// wsDirection holds state of frames sent by one side of connection
+type wsDirection struct {
+	// Sequence number of the next expected segment
+	nextSeq uint32
+	started bool
+
+	// Not complete frame header, it can be split between segments
+	header []byte
+	// Frame which payload is being received
+	frame *wsFrame
+}
+
+// wsFrame collects payload of single frame
+type wsFrame struct {
+	message *TCPMessage
+
+	masked bool
+	mask   [4]byte
+
+	// Payload bytes received and left to receive, received ones include bytes beyond maximum message size
+	received, remaining uint64
+
+	payload []byte
+}
+
+// isWebSocketAccept checks if response accepts WebSocket handshake
+func isWebSocketAccept(payload []byte) bool {
+	if !bytes.HasPrefix(payload, bHTTP) || !bytes.Equal(proto.Status(payload), bSwitchingProtocols) {
+		return false
+	}
+
+	return bytes.EqualFold(proto.Header(payload, []byte("Upgrade")), []byte("websocket"))
+}
+
+// webSocketAcceptSize returns size of handshake response at the beginning of segment, if it is followed by frames.
+// Returns -1 otherwise.
+func webSocketAcceptSize(data []byte) int {
+	if !isWebSocketAccept(data) {
+		return -1
+	}
+
+	end := proto.MIMEHeadersEndPos(data)
+	if end == -1 || end+len(proto.EmptyLine) >= len(data) {
+		return -1
+	}
+
+	return end + len(proto.EmptyLine)
+}
+
+// checkWebSocketAccept switches connection to WebSocket frames, once response accepting handshake is received
+func (t *shard) checkWebSocketAccept(stream *tcpStream, response *TCPMessage) {
+	if stream.ws != nil || response.AssocMessage == nil || !bytes.HasPrefix(response.packets[0].Data, []byte("HTTP/1.1 101")) {
+		return
+	}
+
+	if response.isHeadersReceived() && isWebSocketAccept(response.Bytes()) {
+		stream.ws = &wsConn{streamID: response.AssocMessage.UUID()}
+	}
+}
+
+// processWebSocket decodes frames of the segment, and emits frames which are complete
+func (t *shard) processWebSocket(stream *tcpStream, packet *TCPPacket, isIncoming bool) {
+	c := stream.ws
+	if c.broken {
+		return
+	}
+
+	d := &c.server
+	if isIncoming {
+		d = &c.client
+	}
+
+	data := packet.Data
+
+	if !d.started {
+		d.nextSeq, d.started = packet.Seq, true
+	}
+
+	switch diff := seqDiff(packet.Seq, d.nextSeq); {
+	case diff > 0:
+		// Frame boundaries are unknown after missing data
+		t.breakWebSocket(c)
+		return
+	case diff < 0:
+		// Retransmission of already processed data
+		if int(-diff) >= len(data) {
+			return
+		}
+		data = data[-diff:]
+	}
+	d.nextSeq = packet.Seq + uint32(len(packet.Data))
+
+	for len(data) > 0 || d.frame != nil {
+		if d.frame == nil {
+			n := wsMaxHeaderSize - len(d.header)
+			if n > len(data) {
+				n = len(data)
+			}
+
+			header := append(d.header, data[:n]...)
+			size, frame, ok := parseWSFrameHeader(header)
+			if !ok {
+				t.breakWebSocket(c)
+				return
+			}
+
+			if frame == nil {
+				// Header is continued in the next segment
+				d.header = header
+				return
+			}
+
+			data = data[size-len(d.header):]
+			d.header = d.header[:0]
+
+			frame.message = t.newWSMessage(c, packet, isIncoming, header[0])
+			d.frame = frame
+		}
+
+		f := d.frame
+		n := uint64(len(data))
+		if n > f.remaining {
+			n = f.remaining
+		}
+
+		f.appendPayload(data[:n], t.config.MaxMessageSize)
+		f.message.updateCaptureTime(packet.Timestamp)
+		data = data[n:]
+
+		if f.remaining > 0 {
+			return
+		}
+
+		d.frame = nil
+		t.finishWSFrame(f)
+	}
+}
+
+// parseWSFrameHeader parses frame header. Frame is nil if header is not complete, ok is false if it is malformed.
+func parseWSFrameHeader(header []byte) (size int, frame *wsFrame, ok bool) {
+	if len(header) < 2 {
+		return 0, nil, true
+	}
+
+	frame = &wsFrame{masked: header[1]&0x80 != 0}
+	length := uint64(header[1] & 0x7f)
+
+	size = 2
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+
+	if frame.masked {
+		size += 4
+	}
+
+	if len(header) < size {
+		return 0, nil, true
+	}
+
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(header[2:10])
+		// Most significant bit must be 0
+		if length>>63 != 0 {
+			return 0, nil, false
+		}
+	}
+
+	// Control frames can't be fragmented, and their payload is limited
+	if opcode := header[0] & 0xf; opcode >= wsOpClose && (header[0]&0x80 == 0 || length > 125) {
+		return 0, nil, false
+	}
+
+	if frame.masked {
+		copy(frame.mask[:], header[size-4:size])
+	}
+	frame.remaining = length
+
+	return size, frame, true
+}
+
+// newWSMessage creates message of the frame, addressed like packets of the connection
+func (t *shard) newWSMessage(c *wsConn, packet *TCPPacket, isIncoming bool, firstByte byte) *TCPMessage {
+	c.frames++
+
+	message := NewTCPMessage(packet.Seq, packet.Ack+c.frames, isIncoming)
+	message.packets = []*TCPPacket{packet.headerCopy()}
+	message.WebSocket = &WebSocketFrame{
+		StreamID: c.streamID,
+		Opcode:   firstByte & 0xf,
+		Fin:      firstByte&0x80 != 0,
+	}
+
+	return message
+}
+
+// appendPayload adds unmasked part of the payload, discarding data beyond maximum message size
+func (f *wsFrame) appendPayload(data []byte, maxSize int) {
+	start := f.received
+	f.received += uint64(len(data))
+	f.remaining -= uint64(len(data))
+
+	if maxSize > 0 && len(f.payload)+len(data) > maxSize {
+		if len(f.payload) < maxSize {
+			data = data[:maxSize-len(f.payload)]
+		} else {
+			data = nil
+		}
+		f.message.Truncated = true
+	}
+
+	offset := len(f.payload)
+	f.payload = append(f.payload, data...)
+
+	if f.masked {
+		for i := offset; i < len(f.payload); i++ {
+			f.payload[i] ^= f.mask[(start+uint64(i-offset))%4]
+		}
+	}
+}
+
+// finishWSFrame emits frame, once its whole payload is received
+func (t *shard) finishWSFrame(f *wsFrame) {
+	f.message.packets[0].Data = f.payload
+	f.message.size = len(f.payload)
+	f.message.End = time.Now()
+
+	t.emit(f.message)
+}
+
+// breakWebSocket stops decoding of connection, frames in progress are discarded
+func (t *shard) breakWebSocket(c *wsConn) {
+	for _, d := range []*wsDirection{&c.client, &c.server} {
+		if d.frame != nil {
+			atomic.AddUint64(&t.stats.messagesExpired, 1)
+			d.frame = nil
+		}
+		d.header = nil
+	}
+
+	c.broken = true
+}
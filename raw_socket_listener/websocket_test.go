@@ -0,0 +1,206 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// wsTestFrame builds WebSocket frame, payload is masked if mask is given
+func wsTestFrame(fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	frame := []byte{opcode, 0}
+	if fin {
+		frame[0] |= 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) < 1<<16:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	if mask == nil {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+// wsTestConversation sends handshake, and returns sequence numbers following it
+func wsTestConversation(t *testing.T, listener *Listener) (streamID []byte, clientSeq, serverSeq uint32) {
+	request := []byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	response := []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n")
+	// Server greets client right after handshake, in the same segment
+	serverData := append(append([]byte{}, response...), wsTestFrame(true, wsOpText, nil, []byte("welcome"))...)
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, 100, 1, request).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, 1+uint32(len(request)), 100, serverData).Dump())
+
+	for _, expected := range []string{string(request), string(response)} {
+		select {
+		case m := <-listener.messagesChan:
+			if string(m.Bytes()) != expected || m.WebSocket != nil {
+				t.Fatalf("Should emit handshake as HTTP messages: %q", m.Bytes())
+			}
+			if m.IsIncoming {
+				streamID = m.UUID()
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit handshake")
+		}
+	}
+
+	return streamID, 1 + uint32(len(request)), 100 + uint32(len(serverData))
+}
+
+func receiveWSFrames(t *testing.T, listener *Listener, count int) (frames []*TCPMessage) {
+	for i := 0; i < count; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			frames = append(frames, m)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit WebSocket frames", i)
+		}
+	}
+
+	return
+}
+
+func TestRawListenerWebSocket(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	streamID, clientSeq, serverSeq := wsTestConversation(t, listener)
+
+	mask := []byte{1, 2, 3, 4}
+
+	// Fragmented text message, with ping between fragments, and header of the last fragment split between segments
+	client := wsTestFrame(false, wsOpText, mask, []byte("hel"))
+	client = append(client, wsTestFrame(true, wsOpPing, mask, nil)...)
+	last := wsTestFrame(true, wsOpContinuation, mask, []byte("lo"))
+	client = append(client, last[:3]...)
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq, client).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq+uint32(len(client)), last[3:]).Dump())
+
+	// Large frame, split between segments
+	large := wsTestFrame(true, wsOpBinary, nil, bytes.Repeat([]byte{'a'}, 70000))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, clientSeq, serverSeq, large[:1000]).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(false, 1, 0, clientSeq, serverSeq+1000, large[1000:]).Dump())
+
+	frames := receiveWSFrames(t, listener, 5)
+
+	expected := []struct {
+		incoming bool
+		opcode   byte
+		fin      bool
+		payload  string
+	}{
+		{false, wsOpText, true, "welcome"},
+		{true, wsOpText, false, "hel"},
+		{true, wsOpPing, true, ""},
+		{true, wsOpContinuation, true, "lo"},
+		{false, wsOpBinary, true, string(bytes.Repeat([]byte{'a'}, 70000))},
+	}
+
+	uuids := make(map[string]bool)
+
+	for i, e := range expected {
+		m := frames[i]
+		if m.WebSocket == nil || m.IsIncoming != e.incoming || m.WebSocket.Opcode != e.opcode || m.WebSocket.Fin != e.fin {
+			t.Errorf("Wrong frame %d: %+v %+v", i, m, m.WebSocket)
+			continue
+		}
+
+		if string(m.Bytes()) != e.payload {
+			t.Errorf("Should unmask payload of frame %d: %q", i, m.Bytes())
+		}
+
+		if !bytes.Equal(m.WebSocket.StreamID, streamID) {
+			t.Error("Frames should share UUID of handshake request")
+		}
+
+		uuids[string(m.UUID())] = true
+	}
+
+	if len(uuids) != len(expected) {
+		t.Error("Each frame should have own UUID")
+	}
+}
+
+func TestRawListenerWebSocketTruncated(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{MaxMessageSize: 200})
+	defer listener.Close()
+
+	_, clientSeq, serverSeq := wsTestConversation(t, listener)
+
+	// Payload is split between segments, and the second one is discarded completely
+	frame := wsTestFrame(true, wsOpText, []byte{1, 2, 3, 4}, bytes.Repeat([]byte("abcdef"), 50))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq, frame[:250]).Dump())
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq+250, frame[250:]).Dump())
+
+	frames := receiveWSFrames(t, listener, 2)
+	if m := frames[1]; !bytes.Equal(m.Bytes(), bytes.Repeat([]byte("abcdef"), 50)[:200]) || !m.Truncated {
+		t.Errorf("Should discard payload beyond maximum message size: %q", m.Bytes())
+	}
+}
+
+func TestRawListenerWebSocketMissingData(t *testing.T) {
+	listener, _ := NewListener("", "0", engineTest, true, time.Minute, &ListenerConfig{})
+	defer listener.Close()
+
+	_, clientSeq, serverSeq := wsTestConversation(t, listener)
+	receiveWSFrames(t, listener, 1)
+
+	frame := wsTestFrame(true, wsOpText, []byte{1, 2, 3, 4}, []byte("abcdef"))
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq, frame).Dump())
+	receiveWSFrames(t, listener, 1)
+
+	listener.packetsChan <- newPacketBuffer(buildConnPacket(true, 1, 0, serverSeq, clientSeq+uint32(len(frame))+10, frame).Dump())
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Errorf("Should stop decoding after missing data: %q", m.Bytes())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestParseWSFrameHeader(t *testing.T) {
+	frame := wsTestFrame(true, wsOpBinary, []byte{1, 2, 3, 4}, make([]byte, 300))
+
+	for i := 0; i < 8; i++ {
+		if _, f, ok := parseWSFrameHeader(frame[:i]); f != nil || !ok {
+			t.Error("Should wait for the rest of header", i)
+		}
+	}
+
+	if size, f, ok := parseWSFrameHeader(frame[:8]); !ok || size != 8 || f.remaining != 300 || !f.masked || f.mask != [4]byte{1, 2, 3, 4} {
+		t.Errorf("Should parse header with 16 bit length: %d %+v", size, f)
+	}
+
+	if size, f, ok := parseWSFrameHeader(wsTestFrame(true, wsOpBinary, nil, make([]byte, 70000))[:10]); !ok || size != 10 || f.remaining != 70000 || f.masked {
+		t.Errorf("Should parse header with 64 bit length: %d %+v", size, f)
+	}
+
+	if _, _, ok := parseWSFrameHeader([]byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}); ok {
+		t.Error("Should fail if length has most significant bit set")
+	}
+
+	if _, _, ok := parseWSFrameHeader(wsTestFrame(false, wsOpClose, nil, nil)); ok {
+		t.Error("Should fail on fragmented control frame")
+	}
+}
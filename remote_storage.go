@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// remoteObject describes object of cloud storage bucket
+type remoteObject struct {
+	Name string
+	Size int64
+	// Version of object content, to not resume reading of replaced object
+	ETag string
+}
+
+// remoteStorage lists and reads objects of cloud storage bucket
+type remoteStorage interface {
+	// list returns all objects with given name prefix, following pagination
+	list(prefix string) ([]remoteObject, error)
+	// open streams object starting from given offset. Returns errRemoteObjectChanged if object ETag
+	// doesn't match.
+	open(object remoteObject, offset int64) (io.ReadCloser, error)
+}
+
+// Schemes of remote file input paths, like s3://bucket/prefix
+var remoteStorages = map[string]func(bucket string) (remoteStorage, error){
+	"s3": newS3Storage,
+	"gs": newGCSStorage,
+	"az": newAzureStorage,
+}
+
+// parseRemotePath splits path like s3://bucket/recordings/*.gor into scheme, bucket and object name pattern.
+// Returns empty scheme for local paths.
+func parseRemotePath(p string) (scheme, bucket, pattern string) {
+	i := strings.Index(p, "://")
+	if i == -1 {
+		return
+	}
+
+	if _, ok := remoteStorages[p[:i]]; !ok {
+		return
+	}
+
+	scheme = p[:i]
+	bucket = p[i+3:]
+	if j := strings.IndexByte(bucket, '/'); j != -1 {
+		bucket, pattern = bucket[:j], bucket[j+1:]
+	}
+
+	return
+}
+
+// listRemoteObjects returns objects matching pattern. Pattern without wildcards is name prefix,
+// like "recordings/2019-01-01/".
+func listRemoteObjects(storage remoteStorage, pattern string) ([]remoteObject, error) {
+	wildcard := strings.IndexAny(pattern, "*?[\\")
+	if wildcard == -1 {
+		return storage.list(pattern)
+	}
+
+	objects, err := storage.list(pattern[:wildcard])
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []remoteObject
+	for _, o := range objects {
+		if ok, err := path.Match(pattern, o.Name); err != nil {
+			return nil, err
+		} else if ok {
+			matched = append(matched, o)
+		}
+	}
+
+	return matched, nil
+}
+
+// Number of attempts to resume reading of remote object after error, and delay before the first attempt,
+// which grows with each attempt
+const remoteReadRetries = 5
+
+var remoteRetryDelay = time.Second
+
+// remoteReader streams remote object, reopening it from the current offset if connection breaks,
+// so large objects are read without starting over
+type remoteReader struct {
+	storage remoteStorage
+	object  remoteObject
+	offset  int64
+	body    io.ReadCloser
+	retries int
+}
+
+func newRemoteReader(storage remoteStorage, object remoteObject) *remoteReader {
+	return &remoteReader{storage: storage, object: object}
+}
+
+func (r *remoteReader) Read(data []byte) (n int, err error) {
+	for {
+		if r.body == nil {
+			if r.body, err = r.storage.open(r.object, r.offset); err != nil {
+				r.body = nil
+				if !r.retry(err) {
+					return 0, err
+				}
+				continue
+			}
+		}
+
+		n, err = r.body.Read(data)
+		r.offset += int64(n)
+
+		if n > 0 {
+			r.retries = 0
+		}
+
+		if err == io.EOF && r.offset < r.object.Size {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err == nil || err == io.EOF {
+			return
+		}
+
+		r.body.Close()
+		r.body = nil
+
+		if n > 0 {
+			// Error will be seen again on the next read
+			return n, nil
+		}
+
+		if !r.retry(err) {
+			return 0, err
+		}
+	}
+}
+
+// retry waits before resuming the object, returns false if there are no attempts left
+func (r *remoteReader) retry(err error) bool {
+	if r.retries >= remoteReadRetries || err == errRemoteObjectChanged {
+		return false
+	}
+
+	// Client errors, like missing permissions, won't go away
+	if e, ok := err.(*remoteStatusError); ok && e.status < 500 && e.status != 429 {
+		return false
+	}
+
+	r.retries++
+
+	Debug("[INPUT-FILE] Resuming", r.object.Name, "at", r.offset, "after error:", err)
+	time.Sleep(time.Duration(r.retries) * remoteRetryDelay)
+
+	return true
+}
+
+func (r *remoteReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+
+	return nil
+}
+
+// remoteStatusError is returned for failed requests to the storage
+type remoteStatusError struct {
+	status int
+	body   string
+}
+
+func (e *remoteStatusError) Error() string {
+	return fmt.Sprintf("Storage responded with status %d: %s", e.status, e.body)
+}
+
+var errRemoteObjectChanged = errors.New("Remote object changed while reading")
+
+// checkRemoteResponse returns error for failed response, closing its body
+func checkRemoteResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return errRemoteObjectChanged
+	}
+
+	return &remoteStatusError{status: resp.StatusCode, body: string(body)}
+}
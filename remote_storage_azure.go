@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of Blob service REST API
+const azureAPIVersion = "2020-10-02"
+
+// azureStorage reads blobs of Azure Blob Storage container. Path has form az://container/prefix.
+//
+// Storage account is set in AZURE_STORAGE_ACCOUNT environment variable, and requests are authorized with
+// account key from AZURE_STORAGE_KEY, or with SAS token from AZURE_STORAGE_SAS_TOKEN. Without them requests
+// are anonymous, which works for public containers. Emulator, like Azurite, is set with
+// AZURE_STORAGE_BLOB_ENDPOINT, like http://127.0.0.1:10000/devstoreaccount1.
+type azureStorage struct {
+	client    *http.Client
+	account   string
+	container string
+	endpoint  *url.URL
+
+	key      []byte
+	sasToken url.Values
+}
+
+func newAzureStorage(container string) (remoteStorage, error) {
+	s := &azureStorage{
+		client:    &http.Client{},
+		account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		container: container,
+	}
+
+	if s.account == "" {
+		return nil, errors.New("Storage account should be set in AZURE_STORAGE_ACCOUNT")
+	}
+
+	endpoint := os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://" + s.account + ".blob.core.windows.net"
+	}
+
+	var err error
+	if s.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil {
+		return nil, fmt.Errorf("Wrong Azure endpoint %q: %s", endpoint, err)
+	}
+
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		if s.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("Wrong AZURE_STORAGE_KEY: %s", err)
+		}
+	} else if token := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); token != "" {
+		if s.sasToken, err = url.ParseQuery(strings.TrimPrefix(token, "?")); err != nil {
+			return nil, fmt.Errorf("Wrong AZURE_STORAGE_SAS_TOKEN: %s", err)
+		}
+	}
+
+	return s, nil
+}
+
+type azureListResult struct {
+	Blobs []struct {
+		Name          string
+		ContentLength int64  `xml:"Properties>Content-Length"`
+		ETag          string `xml:"Properties>Etag"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+func (s *azureStorage) list(prefix string) (objects []remoteObject, err error) {
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+
+	for {
+		resp, err := s.request("", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result azureListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode Azure blobs list: %s", err)
+		}
+
+		for _, blob := range result.Blobs {
+			objects = append(objects, remoteObject{Name: blob.Name, Size: blob.ContentLength, ETag: blob.ETag})
+		}
+
+		if result.NextMarker == "" {
+			return objects, nil
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
+
+func (s *azureStorage) open(object remoteObject, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("X-Ms-Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	if object.ETag != "" {
+		header.Set("If-Match", object.ETag)
+	}
+
+	resp, err := s.request(object.Name, nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// request makes GET request for given blob, or for container if blob is empty
+func (s *azureStorage) request(blob string, query url.Values, header http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path += "/" + s.container
+	if blob != "" {
+		u.Path += "/" + blob
+	}
+
+	params := url.Values{}
+	for name, values := range query {
+		params[name] = values
+	}
+	for name, values := range s.sasToken {
+		params[name] = values
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+
+	if s.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+azureSharedKeySignature(req, s.account, s.key))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRemoteResponse(resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// azureSharedKeySignature signs request without body with storage account key
+func azureSharedKeySignature(req *http.Request, account string, key []byte) string {
+	var b bytes.Buffer
+
+	b.WriteString(req.Method + "\n")
+	// Standard headers, only If-Match and Range are used
+	for _, name := range []string{"Content-Encoding", "Content-Language", "Content-Length", "Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		b.WriteString(req.Header.Get(name) + "\n")
+	}
+
+	var names []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	b.WriteString("/" + account + req.URL.EscapedPath())
+
+	query := req.URL.Query()
+	names = names[:0]
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b.Bytes())
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
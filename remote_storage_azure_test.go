@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAzure serves blobs of "container" of account "gor", with one blob per list page
+func fakeAzure(objects *fakeRemoteObjects, key []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Ms-Version") == "" || r.Header.Get("Authorization") != "SharedKey gor:"+azureSharedKeySignature(r, "gor", key) {
+			w.WriteHeader(403)
+			return
+		}
+
+		if r.URL.Path == "/gor/container" {
+			query := r.URL.Query()
+			if query.Get("restype") != "container" || query.Get("comp") != "list" {
+				w.WriteHeader(400)
+				return
+			}
+
+			names := objects.names(query.Get("prefix"), query.Get("marker"))
+			if len(names) == 0 {
+				fmt.Fprint(w, "<EnumerationResults><Blobs></Blobs><NextMarker/></EnumerationResults>")
+				return
+			}
+
+			next := ""
+			if len(names) > 1 {
+				next = names[0]
+			}
+
+			fmt.Fprintf(w, `<EnumerationResults><Blobs><Blob><Name>%s</Name><Properties><Content-Length>%d</Content-Length><Etag>0x1</Etag></Properties></Blob></Blobs><NextMarker>%s</NextMarker></EnumerationResults>`, names[0], len(objects.objects[names[0]]), next)
+			return
+		}
+
+		if r.Header.Get("If-Match") != "0x1" {
+			w.WriteHeader(412)
+			return
+		}
+
+		objects.serve(w, strings.TrimPrefix(r.URL.Path, "/gor/container/"), r.Header.Get("X-Ms-Range"))
+	}))
+}
+
+func TestInputFileAzure(t *testing.T) {
+	key := []byte("secret")
+
+	server := fakeAzure(newFakeRemoteObjects(map[string]string{
+		"rec/host1.gor": "1 1 1\ntest1" + payloadSeparator + "1 2 3\ntest3" + payloadSeparator,
+		"rec/host2.gor": "1 3 2\ntest2" + payloadSeparator,
+		"other.gor":     "1 4 4\ntest4" + payloadSeparator,
+	}), key)
+	defer server.Close()
+
+	os.Setenv("AZURE_STORAGE_ACCOUNT", "gor")
+	os.Setenv("AZURE_STORAGE_KEY", base64.StdEncoding.EncodeToString(key))
+	os.Setenv("AZURE_STORAGE_BLOB_ENDPOINT", server.URL+"/gor")
+	defer os.Unsetenv("AZURE_STORAGE_ACCOUNT")
+	defer os.Unsetenv("AZURE_STORAGE_KEY")
+	defer os.Unsetenv("AZURE_STORAGE_BLOB_ENDPOINT")
+
+	remoteRetryDelay = time.Millisecond
+	defer func() { remoteRetryDelay = time.Second }()
+
+	input := NewFileInput("az://container/rec/*.gor", false)
+	buf := make([]byte, 1000)
+
+	for _, expected := range []string{"test1", "test2", "test3"} {
+		n, _ := input.Read(buf)
+		if string(payloadBody(buf[:n])) != expected {
+			t.Errorf("Should emit %s: %q", expected, buf[:n])
+		}
+	}
+}
+
+func TestAzureSharedKeySignature(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://gor.blob.core.windows.net/container?restype=container&comp=list&prefix=rec%2F", nil)
+	req.Header.Set("X-Ms-Version", "2020-10-02")
+	req.Header.Set("X-Ms-Date", "Mon, 01 Jan 2024 00:00:00 GMT")
+
+	// Decoded string to sign
+	expected := "GET\n\n\n\n\n\n\n\n\n\n\n\nx-ms-date:Mon, 01 Jan 2024 00:00:00 GMT\nx-ms-version:2020-10-02\n/gor/container\ncomp:list\nprefix:rec/\nrestype:container"
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte(expected))
+
+	if signature := azureSharedKeySignature(req, "gor", []byte("key")); signature != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Error("Wrong signature:", signature)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Scope of access tokens, only reading is needed
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// gcsStorage reads objects of Google Cloud Storage bucket, using JSON API.
+//
+// Requests are authorized with service account key file set in GOOGLE_APPLICATION_CREDENTIALS environment
+// variable, or with service account of GCE instance. Without them requests are anonymous, which works for
+// public buckets. Emulator is set with STORAGE_EMULATOR_HOST.
+type gcsStorage struct {
+	client      *http.Client
+	bucket      string
+	endpoint    string
+	credentials *gcpCredentials
+}
+
+func newGCSStorage(bucket string) (remoteStorage, error) {
+	s := &gcsStorage{
+		client:   &http.Client{},
+		bucket:   bucket,
+		endpoint: "https://storage.googleapis.com",
+	}
+
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	if emulator != "" {
+		s.endpoint = strings.TrimSuffix(emulator, "/")
+		if !strings.Contains(s.endpoint, "://") {
+			s.endpoint = "http://" + s.endpoint
+		}
+	}
+
+	var err error
+	if s.credentials, err = newGCPCredentials(gcsScope, emulator != ""); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type gcsListResult struct {
+	Items []struct {
+		Name       string `json:"name"`
+		Size       string `json:"size"`
+		Generation string `json:"generation"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (s *gcsStorage) list(prefix string) (objects []remoteObject, err error) {
+	query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,generation),nextPageToken"}}
+
+	for {
+		resp, err := s.request("/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result gcsListResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode GCS objects list: %s", err)
+		}
+
+		for _, item := range result.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, remoteObject{Name: item.Name, Size: size, ETag: item.Generation})
+		}
+
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+func (s *gcsStorage) open(object remoteObject, offset int64) (io.ReadCloser, error) {
+	query := url.Values{"alt": {"media"}}
+	if object.ETag != "" {
+		query.Set("ifGenerationMatch", object.ETag)
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := s.request("/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(object.Name)+"?"+query.Encode(), header)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *gcsStorage) request(uri string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", s.endpoint+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	token, err := s.credentials.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRemoteResponse(resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
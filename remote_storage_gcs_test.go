@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGCS serves objects of "bucket", with one object per list page, and issues access tokens for
+// assertions signed with given key
+func fakeGCS(objects *fakeRemoteObjects, key *rsa.PrivateKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature) != nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.URL.Path == "/storage/v1/b/bucket/o" {
+			names := objects.names(r.URL.Query().Get("prefix"), r.URL.Query().Get("pageToken"))
+			if len(names) == 0 {
+				fmt.Fprint(w, "{}")
+				return
+			}
+
+			next := ""
+			if len(names) > 1 {
+				next = names[0]
+			}
+
+			fmt.Fprintf(w, `{"items": [{"name": %q, "size": "%d", "generation": "1"}], "nextPageToken": %q}`, names[0], len(objects.objects[names[0]]), next)
+			return
+		}
+
+		if r.URL.Query().Get("alt") != "media" || r.URL.Query().Get("ifGenerationMatch") != "1" {
+			w.WriteHeader(412)
+			return
+		}
+
+		objects.serve(w, strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"), r.Header.Get("Range"))
+	}))
+}
+
+func TestInputFileGCS(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	server := fakeGCS(newFakeRemoteObjects(map[string]string{
+		"rec/host1.gor": "1 1 1\ntest1" + payloadSeparator + "1 2 3\ntest3" + payloadSeparator,
+		"rec/host2.gor": "1 3 2\ntest2" + payloadSeparator,
+		"other.gor":     "1 4 4\ntest4" + payloadSeparator,
+	}), key)
+	defer server.Close()
+
+	keyFile, _ := ioutil.TempFile("", "gcs_key")
+	defer os.Remove(keyFile.Name())
+
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	json.NewEncoder(keyFile).Encode(map[string]string{
+		"client_email": "gor@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		"token_uri":    server.URL + "/token",
+	})
+	keyFile.Close()
+
+	os.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", keyFile.Name())
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+	remoteRetryDelay = time.Millisecond
+	defer func() { remoteRetryDelay = time.Second }()
+
+	input := NewFileInput("gs://bucket/rec/", false)
+	buf := make([]byte, 1000)
+
+	for _, expected := range []string{"test1", "test2", "test3"} {
+		n, _ := input.Read(buf)
+		if string(payloadBody(buf[:n])) != expected {
+			t.Errorf("Should emit %s: %q", expected, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hash of empty payload, all requests to S3 are made without body
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Storage reads objects of S3 bucket, or bucket of S3 compatible storage.
+//
+// Credentials and region are taken from standard AWS environment variables: AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, and AWS_REGION. Without credentials requests are not signed, which
+// works for public buckets. Storage other than AWS S3, like MinIO, is set with AWS_ENDPOINT_URL_S3 or
+// AWS_ENDPOINT_URL, and accessed with path-style URLs.
+type s3Storage struct {
+	client *http.Client
+	bucket string
+	region string
+
+	// Storage URL, and whether bucket is part of the path rather than of the host
+	endpoint  *url.URL
+	pathStyle bool
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Storage(bucket string) (remoteStorage, error) {
+	s := &s3Storage{
+		client:       &http.Client{},
+		bucket:       bucket,
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	switch {
+	case endpoint != "":
+		s.pathStyle = true
+	case strings.Contains(bucket, "."):
+		// Bucket with dots doesn't match wildcard certificate of virtual host
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+		s.pathStyle = true
+	default:
+		endpoint = "https://" + bucket + ".s3." + s.region + ".amazonaws.com"
+	}
+
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("Wrong S3 endpoint %q: %s", endpoint, err)
+	}
+
+	return s, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+		ETag string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Storage) list(prefix string) (objects []remoteObject, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+
+	for {
+		resp, err := s.request("", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode S3 objects list: %s", err)
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, remoteObject{Name: c.Key, Size: c.Size, ETag: c.ETag})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Storage) open(object remoteObject, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	if object.ETag != "" {
+		header.Set("If-Match", object.ETag)
+	}
+
+	resp, err := s.request(object.Name, nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// request makes signed GET request for given object, or for bucket if key is empty
+func (s *s3Storage) request(key string, query url.Values, header http.Header) (*http.Response, error) {
+	return s.do("GET", key, query, header, nil)
+}
+
+// do makes signed request with given method and body for object, or for bucket if key is empty
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		p += "/" + s.bucket
+	}
+	p += "/" + key
+	u.Path = p
+	u.RawPath = awsEscape(p, false)
+	u.RawQuery = awsCanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if s.accessKey != "" {
+		if body == nil {
+			signS3Request(req, s.region, s.accessKey, s.secretKey, s.sessionToken, time.Now())
+		} else {
+			hash := sha256.Sum256(body)
+			req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+			signAWSRequest(req, "s3", s.region, hex.EncodeToString(hash[:]), s.accessKey, s.secretKey, s.sessionToken, time.Now())
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRemoteResponse(resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// signS3Request adds AWS Signature Version 4 to the request without body
+func signS3Request(req *http.Request, region, accessKey, secretKey, sessionToken string, now time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	signAWSRequest(req, "s3", region, s3EmptyPayloadHash, accessKey, secretKey, sessionToken, now)
+}
+
+// signAWSRequest adds AWS Signature Version 4 for given service to the request, with hex encoded SHA256 hash
+// of its body
+func signAWSRequest(req *http.Request, service, region, payloadHash, accessKey, secretKey, sessionToken string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// All headers of the request are signed
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(key))
+}
+
+// awsEscape percent-encodes all characters except unreserved ones, and except slashes if they are not encoded
+func awsEscape(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// awsCanonicalQuery encodes query parameters sorted by name, as required for signing
+func awsCanonicalQuery(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			params = append(params, awsEscape(name, true)+"="+awsEscape(value, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
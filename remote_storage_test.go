@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRemoteObjects serves objects like cloud storage, breaking the first response of each object in the middle
+type fakeRemoteObjects struct {
+	mu      sync.Mutex
+	objects map[string]string
+	broken  map[string]bool
+}
+
+func newFakeRemoteObjects(objects map[string]string) *fakeRemoteObjects {
+	return &fakeRemoteObjects{objects: objects, broken: make(map[string]bool)}
+}
+
+// names returns sorted names of objects with prefix, which follow given name
+func (f *fakeRemoteObjects) names(prefix string, after string) (names []string) {
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) && name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// serve writes object starting from offset of range header
+func (f *fakeRemoteObjects) serve(w http.ResponseWriter, name string, rangeHeader string) {
+	data, ok := f.objects[name]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	offset := 0
+	if rangeHeader != "" {
+		offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-offset))
+		w.WriteHeader(206)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+
+	f.mu.Lock()
+	breakResponse := !f.broken[name]
+	f.broken[name] = true
+	f.mu.Unlock()
+
+	if breakResponse {
+		w.Write([]byte(data[offset : offset+(len(data)-offset)/2]))
+		return
+	}
+
+	w.Write([]byte(data[offset:]))
+}
+
+func TestParseRemotePath(t *testing.T) {
+	cases := []struct {
+		path, scheme, bucket, pattern string
+	}{
+		{"s3://bucket/rec/*.gor", "s3", "bucket", "rec/*.gor"},
+		{"gs://bucket", "gs", "bucket", ""},
+		{"az://container/", "az", "container", ""},
+		{"/tmp/requests.gor", "", "", ""},
+		{"ftp://host/requests.gor", "", "", ""},
+	}
+
+	for _, c := range cases {
+		scheme, bucket, pattern := parseRemotePath(c.path)
+		if scheme != c.scheme || bucket != c.bucket || pattern != c.pattern {
+			t.Errorf("Wrong parts of %s: %q %q %q", c.path, scheme, bucket, pattern)
+		}
+	}
+}
+
+// remoteObjectsStorage serves objects from memory
+type remoteObjectsStorage struct {
+	*fakeRemoteObjects
+}
+
+func (s remoteObjectsStorage) list(prefix string) (objects []remoteObject, err error) {
+	for _, name := range s.names(prefix, "") {
+		objects = append(objects, remoteObject{Name: name, Size: int64(len(s.objects[name]))})
+	}
+	return
+}
+
+func (s remoteObjectsStorage) open(object remoteObject, offset int64) (io.ReadCloser, error) {
+	data := s.objects[object.Name][offset:]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.broken[object.Name] {
+		s.broken[object.Name] = true
+		// Connection breaks in the middle of the object
+		return ioutil.NopCloser(strings.NewReader(data[:len(data)/2])), nil
+	}
+
+	return ioutil.NopCloser(strings.NewReader(data)), nil
+}
+
+func TestRemoteReader(t *testing.T) {
+	storage := remoteObjectsStorage{newFakeRemoteObjects(map[string]string{
+		"rec/1.gor":   "first",
+		"rec/2.gor":   "second",
+		"rec/2.log":   "log",
+		"rec/3/1.gor": "third",
+	})}
+
+	objects, _ := listRemoteObjects(storage, "rec/*.gor")
+	if len(objects) != 2 || objects[0].Name != "rec/1.gor" || objects[1].Name != "rec/2.gor" {
+		t.Fatal("Should match objects of the pattern:", objects)
+	}
+
+	if objects, _ := listRemoteObjects(storage, "rec/"); len(objects) != 4 {
+		t.Error("Should list objects with prefix:", objects)
+	}
+
+	remoteRetryDelay = time.Millisecond
+	defer func() { remoteRetryDelay = time.Second }()
+
+	data, err := ioutil.ReadAll(newRemoteReader(storage, objects[1]))
+	if err != nil || string(data) != "second" {
+		t.Errorf("Should resume reading: %q %v", data, err)
+	}
+}
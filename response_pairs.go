@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long original or replayed response waits for its pair, before comparison is abandoned
+const responsePairTimeout = time.Minute
+
+// responsePair holds original response of request, tracked by input, and response of replayed server. Responses
+// are stored as decoded by output, like raw payload for HTTP or parsed message for DNS.
+type responsePair struct {
+	id string
+	// Request payload, if output reports it along with differences
+	request  []byte
+	original interface{}
+	replayed interface{}
+	created  time.Time
+}
+
+// responsePairs pairs original and replayed responses by request ID, used by outputs comparing responses
+type responsePairs struct {
+	mu sync.Mutex
+	// Request ID -> responses waiting for their pair
+	pending     map[string]*responsePair
+	lastCleanup time.Time
+}
+
+func newResponsePairs() *responsePairs {
+	return &responsePairs{pending: make(map[string]*responsePair)}
+}
+
+// add stores request or one of its responses, and returns pair once both responses are received.
+// Responses waiting for their pair longer than responsePairTimeout are dropped.
+func (p *responsePairs) add(id, request []byte, original, replayed interface{}) *responsePair {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(p.lastCleanup) > responsePairTimeout {
+		for id, pair := range p.pending {
+			if now.Sub(pair.created) > responsePairTimeout {
+				delete(p.pending, id)
+			}
+		}
+		p.lastCleanup = now
+	}
+
+	pair, ok := p.pending[string(id)]
+	if !ok {
+		pair = &responsePair{id: string(id), created: now}
+		p.pending[pair.id] = pair
+	}
+
+	if request != nil {
+		pair.request = request
+	}
+	if original != nil {
+		pair.original = original
+	}
+	if replayed != nil {
+		pair.replayed = replayed
+	}
+
+	if pair.original == nil || pair.replayed == nil {
+		return nil
+	}
+
+	delete(p.pending, pair.id)
+
+	return pair
+}
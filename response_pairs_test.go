@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResponsePairs(t *testing.T) {
+	pairs := newResponsePairs()
+
+	if p := pairs.add([]byte("a"), []byte("GET /"), nil, nil); p != nil {
+		t.Error("Request alone should not complete pair")
+	}
+	if p := pairs.add([]byte("a"), nil, nil, "replayed"); p != nil {
+		t.Error("Pair should wait for original response")
+	}
+	if p := pairs.add([]byte("b"), nil, "other", nil); p != nil {
+		t.Error("Responses of other requests should not be paired")
+	}
+
+	p := pairs.add([]byte("a"), nil, "original", nil)
+	if p == nil || p.id != "a" || string(p.request) != "GET /" || p.original != "original" || p.replayed != "replayed" {
+		t.Fatalf("Responses should be paired: %+v", p)
+	}
+
+	if _, ok := pairs.pending["a"]; ok || len(pairs.pending) != 1 {
+		t.Error("Complete pair should be removed", len(pairs.pending))
+	}
+
+	// Response waiting for its pair too long is dropped
+	pairs.pending["b"].created = time.Now().Add(-2 * responsePairTimeout)
+	pairs.lastCleanup = time.Time{}
+	if p := pairs.add([]byte("b"), nil, nil, "replayed"); p != nil {
+		t.Error("Expired response should not be paired")
+	}
+	if c := pairs.pending["b"]; c == nil || c.original != nil {
+		t.Error("Expired response should be dropped")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// TCPConfig struct for holding configuration of TCP input and output, which connect gor instances
+type TCPConfig struct {
+	// Use TLS. Input requires certificate and key, and verifies client certificates with CA certificate if set.
+	// Output verifies input with CA certificate, system CAs by default, and authenticates with certificate and
+	// key if set.
+	TLS     bool
+	TLSCA   string
+	TLSCert string
+	TLSKey  string
+
+	// Shared secret, output proves it knows the secret before sending payloads. The secret itself is not sent.
+	Token string
+
+	// Output sends payloads in length-prefixed frames, and keeps up to AckWindow payloads not acknowledged by
+	// input, to resend them after reconnect. Input recognizes framed connections itself.
+	Ack       bool
+	AckWindow int
+}
+
+const (
+	tcpAuthChallenge = "GOR-AUTH "
+	tcpAuthOK        = "OK"
+	tcpAuthTimeout   = 10 * time.Second
+)
+
+// tcpAuthDigest returns proof of knowing the token for given challenge
+func tcpAuthDigest(token string, nonce []byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(nonce)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tcpAuthenticateClient sends random challenge to connected output, and checks its response.
+// Response is read with reader, which is used to read payloads afterwards.
+func tcpAuthenticateClient(conn net.Conn, reader *bufio.Reader, token string) error {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(tcpAuthTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "%s%x\n", tcpAuthChallenge, nonce); err != nil {
+		return err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(strings.TrimSpace(line)), []byte(tcpAuthDigest(token, nonce))) {
+		return errors.New("Wrong token")
+	}
+
+	_, err = fmt.Fprintln(conn, tcpAuthOK)
+
+	return err
+}
+
+// tcpAuthenticateServer responds to challenge of input
+func tcpAuthenticateServer(conn net.Conn, token string) error {
+	conn.SetDeadline(time.Now().Add(tcpAuthTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(line, tcpAuthChallenge) {
+		return errors.New("Input doesn't require token")
+	}
+
+	nonce, err := hex.DecodeString(strings.TrimSpace(line[len(tcpAuthChallenge):]))
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintln(conn, tcpAuthDigest(token, nonce)); err != nil {
+		return err
+	}
+
+	if line, err = reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != tcpAuthOK {
+		return errors.New("Input rejected token")
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes self-signed certificate of 127.0.0.1, usable as CA, server and client certificate
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gor"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return
+}
+
+func TestTCPInputTLSToken(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_tcp_tls")
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir)
+
+	input := NewTCPInput("127.0.0.1:0", &TCPConfig{TLS: true, TLSCA: cert, TLSCert: cert, TLSKey: key, Token: "secret"})
+	defer input.listener.Close()
+	address := input.listener.Addr().String()
+
+	connect := func(config *TCPConfig) (net.Conn, error) {
+		o := &TCPOutput{config: config}
+		o.tls, _ = newTLSConfig(config.TLSCA, config.TLSCert, config.TLSKey, false)
+
+		return o.connect(address)
+	}
+
+	if _, err := connect(&TCPConfig{TLS: true, TLSCA: cert, TLSCert: cert, TLSKey: key, Token: "wrong"}); err == nil {
+		t.Error("Should reject wrong token")
+	}
+
+	if _, err := connect(&TCPConfig{TLS: true, TLSCA: cert, Token: "secret"}); err == nil {
+		t.Error("Should require client certificate")
+	}
+
+	conn, err := connect(&TCPConfig{TLS: true, TLSCA: cert, TLSCert: cert, TLSKey: key, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n" + payloadSeparator))
+
+	buf := make([]byte, 1000)
+	n, _ := input.Read(buf)
+	if string(buf[:n]) != "1 1 1\nGET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("Should read payload: %q", buf[:n])
+	}
+}
+
+func TestTCPAuthenticate(t *testing.T) {
+	for _, c := range []struct {
+		clientToken, serverToken string
+		ok                       bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "other", false},
+	} {
+		client, server := net.Pipe()
+
+		done := make(chan error)
+		go func() {
+			done <- tcpAuthenticateServer(server, c.serverToken)
+			server.Close()
+		}()
+
+		clientErr := tcpAuthenticateClient(client, bufio.NewReader(client), c.clientToken)
+		client.Close()
+		serverErr := <-done
+
+		if (clientErr == nil) != c.ok || (serverErr == nil) != c.ok {
+			t.Errorf("Tokens %q and %q: input error %v, output error %v", c.clientToken, c.serverToken, clientErr, serverErr)
+		}
+	}
+}
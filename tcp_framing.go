@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Framed connection of TCP output starts with magic, which can't start payload separated by payloadSeparator,
+// followed by session ID of output worker. Each payload is sent as frame of 8 byte sequence number and 4 byte
+// length, and input acknowledges frames by sending sequence number of the last one received.
+//
+// Sequence numbers of output worker keep growing across reconnects, so input skips frames resent after reconnect
+// which it already received.
+const (
+	tcpFramedMagic    = "\x00GOR"
+	tcpSessionIDSize  = 16
+	tcpFrameHeaderLen = 12
+	tcpMaxFrameSize   = 256 * 1024 * 1024
+
+	// Input acknowledges frames once it has no more buffered, or after this many frames
+	tcpAckEvery = 100
+	// Output reconnects if frames are not acknowledged for this long
+	tcpAckTimeout = 30 * time.Second
+	// Input forgets session which has no connection for this long, output of session is considered stopped
+	tcpSessionTimeout = 10 * time.Minute
+)
+
+type tcpSessionID [tcpSessionIDSize]byte
+
+func newTCPSessionID() (id tcpSessionID) {
+	rand.Read(id[:])
+	return
+}
+
+// tcpFrame is payload sent by output, kept until input acknowledges it
+type tcpFrame struct {
+	seq  uint64
+	data []byte
+}
+
+func writeTCPFrame(w io.Writer, f tcpFrame) error {
+	var header [tcpFrameHeaderLen]byte
+	binary.BigEndian.PutUint64(header[:8], f.seq)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(f.data)))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.data)
+
+	return err
+}
+
+func readTCPFrame(r *bufio.Reader) (f tcpFrame, err error) {
+	var header [tcpFrameHeaderLen]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	f.seq = binary.BigEndian.Uint64(header[:8])
+	size := binary.BigEndian.Uint32(header[8:])
+	if size > tcpMaxFrameSize {
+		return f, fmt.Errorf("Frame of %d bytes is too large", size)
+	}
+
+	f.data = make([]byte, size)
+	_, err = io.ReadFull(r, f.data)
+
+	return
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Requests without response for this long are recorded without it
+const trafficResponseTimeout = 10 * time.Second
+
+// trafficRecord describes captured request and its response, as indexed by analytics outputs
+type trafficRecord struct {
+	Timestamp    time.Time `json:"@timestamp"`
+	ID           string    `json:"request_id"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Query        string    `json:"query,omitempty"`
+	Host         string    `json:"host,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	ClientIP     string    `json:"client_ip,omitempty"`
+	RequestSize  int       `json:"request_size"`
+	Status       int       `json:"status,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ResponseSize int       `json:"response_size,omitempty"`
+	// Latency in milliseconds, from request start until response end
+	Latency   float64 `json:"latency_ms,omitempty"`
+	Truncated bool    `json:"truncated,omitempty"`
+
+	GraphQLOperation string `json:"graphql_operation,omitempty"`
+	GraphQLType      string `json:"graphql_type,omitempty"`
+
+	// HTTP payloads, kept only if bodies are recorded
+	Request  []byte `json:"-"`
+	Response []byte `json:"-"`
+
+	received time.Time
+}
+
+// newTrafficRecord returns record of captured request
+func newTrafficRecord(payload []byte) *trafficRecord {
+	meta := payloadMeta(payload)
+	body := payloadBody(payload)
+
+	r := &trafficRecord{
+		ID:          string(meta[1]),
+		Method:      string(proto.Method(body)),
+		Path:        string(proto.Path(body)),
+		Host:        string(proto.Header(body, []byte("Host"))),
+		UserAgent:   string(proto.Header(body, []byte("User-Agent"))),
+		ClientIP:    string(clientIP(payload, body)),
+		RequestSize: len(proto.Body(body)),
+		Truncated:   isTruncatedPayload(payload),
+		received:    time.Now(),
+	}
+
+	if i := strings.IndexByte(r.Path, '?'); i != -1 {
+		r.Path, r.Query = r.Path[:i], r.Path[i+1:]
+	}
+
+	if start, err := strconv.ParseInt(string(meta[2]), 10, 64); err == nil {
+		r.Timestamp = time.Unix(0, start).UTC()
+	}
+
+	if op, ok := parseGraphQLRequest(body); ok {
+		r.GraphQLOperation, r.GraphQLType = op.Name, op.Type
+	}
+
+	return r
+}
+
+// setResponse adds metadata of captured response to record
+func (r *trafficRecord) setResponse(payload []byte) {
+	meta := payloadMeta(payload)
+	body := payloadBody(payload)
+
+	r.Status, _ = strconv.Atoi(string(proto.Status(body)))
+	r.ContentType = string(proto.Header(body, []byte("Content-Type")))
+	r.ResponseSize = len(proto.Body(body))
+	r.Truncated = r.Truncated || isTruncatedPayload(payload)
+	if latency, err := strconv.ParseInt(string(meta[2]), 10, 64); err == nil {
+		r.Latency = float64(latency) / float64(time.Millisecond)
+	}
+}
+
+// trafficRecords matches captured requests with their responses. Outputs indexing records queue payloads with write,
+// and receive complete records in goroutine started with run, which batches them.
+type trafficRecords struct {
+	// Keep HTTP payloads in records
+	bodies  bool
+	pending map[string]*trafficRecord
+
+	queue chan []byte
+	done  chan struct{}
+}
+
+func newTrafficRecords(bodies bool) *trafficRecords {
+	return &trafficRecords{
+		bodies:  bodies,
+		pending: make(map[string]*trafficRecord),
+		queue:   make(chan []byte, 1000),
+		done:    make(chan struct{}),
+	}
+}
+
+// write queues request or response payload for matching, other payloads are skipped
+func (t *trafficRecords) write(data []byte) {
+	if data[0] != RequestPayload && data[0] != ResponsePayload {
+		return
+	}
+
+	enqueuePayload(t.queue, nil, data)
+}
+
+// run matches queued payloads, and passes complete records to add, which batches them. Batch is flushed every interval,
+// along with requests without response for trafficResponseTimeout. Once stopped by close, all pending requests
+// are added and flushed.
+func (t *trafficRecords) run(interval time.Duration, add func(*trafficRecord), flush func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				for _, r := range t.expire(time.Now(), 0) {
+					add(r)
+				}
+				flush()
+				close(t.done)
+				return
+			}
+			if r := t.add(data); r != nil {
+				add(r)
+			}
+		case now := <-ticker.C:
+			for _, r := range t.expire(now, trafficResponseTimeout) {
+				add(r)
+			}
+			flush()
+		}
+	}
+}
+
+// close stops run, and waits until queued payloads are processed and the last batch is flushed
+func (t *trafficRecords) close() {
+	close(t.queue)
+	<-t.done
+}
+
+// add keeps request until its response is added, and returns record once it is complete
+func (t *trafficRecords) add(payload []byte) *trafficRecord {
+	if len(payloadMeta(payload)) < 3 {
+		return nil
+	}
+
+	if payload[0] == RequestPayload {
+		r := newTrafficRecord(payload)
+		if t.bodies {
+			r.Request = payloadBody(payload)
+		}
+		t.pending[r.ID] = r
+		return nil
+	}
+
+	if payload[0] != ResponsePayload {
+		return nil
+	}
+
+	id := string(payloadMeta(payload)[1])
+	r, ok := t.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(t.pending, id)
+
+	r.setResponse(payload)
+	if t.bodies {
+		r.Response = payloadBody(payload)
+	}
+
+	return r
+}
+
+// expire returns records of requests without response for longer than timeout, or all of them if timeout is 0
+func (t *trafficRecords) expire(now time.Time, timeout time.Duration) (expired []*trafficRecord) {
+	for id, r := range t.pending {
+		if timeout == 0 || now.Sub(r.received) > timeout {
+			expired = append(expired, r)
+			delete(t.pending, id)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficRecordsRun(t *testing.T) {
+	records := newTrafficRecords(false)
+
+	var added []*trafficRecord
+	flushed := 0
+	go records.run(time.Hour, func(r *trafficRecord) { added = append(added, r) }, func() { flushed++ })
+
+	records.write([]byte("1 a 1\nGET /a HTTP/1.1\r\n\r\n"))
+	records.write([]byte("2 a 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	records.write([]byte("3 a 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	records.write([]byte("1 b 1\nGET /b HTTP/1.1\r\n\r\n"))
+
+	// Request without response is added once output is closed
+	records.close()
+
+	if len(added) != 2 || added[0].ID != "a" || added[0].Status != 200 || added[1].ID != "b" || added[1].Status != 0 {
+		t.Errorf("Wrong records: %+v", added)
+	}
+
+	if flushed != 1 {
+		t.Error("Batch should be flushed on close", flushed)
+	}
+}